@@ -3,16 +3,36 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/controller"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
 )
 
 func badUsage() {
-	fmt.Fprintf(os.Stderr, "usage: %s controller-plugin <image>\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "       %s node-plugin <node_name> <image>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s controller-plugin [<options...>] <image>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s node-plugin [<options...>] <node_name> <image>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s backing-chains [<options...>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s gc [<options...>] <image>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s doctor [<options...>] <image>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s bench --storage-class=<name> [<options...>] <image>\n", os.Args[0])
+	fmt.Fprintf(
+		os.Stderr, "       %s volume-qmp [<options...>] <pvc_namespace>/<pvc_name> <command> [<arguments_json>]\n",
+		os.Args[0],
+	)
+	fmt.Fprintf(os.Stderr, "       %s qmp <socket_path> <command> [<arguments_json>]\n", os.Args[0])
 	os.Exit(2)
 }
 
@@ -21,30 +41,400 @@ func main() {
 		badUsage()
 	}
 
-	csiSocketPath := "/run/csi/socket"
-
 	switch os.Args[1] {
 	case "controller-plugin":
-		if len(os.Args) != 3 {
+		var endpoint csiplugin.Endpoint
+		var options csiplugin.ControllerPluginOptions
+
+		flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		addDriverNameFlag(flags)
+		addEndpointFlags(flags, &endpoint)
+		addShutdownGracePeriodFlag(flags, &options.ShutdownGracePeriod)
+		addLoggingFlags(flags)
+		flags.IntVar(
+			&options.MaxConcurrentSnapshotsPerBackingVolume, "max-concurrent-snapshots-per-backing-volume", 4,
+			"maximum number of snapshots being taken at once in the same backing volume",
+		)
+		flags.IntVar(
+			&options.Deletion.Workers, "deletion-workers", 4,
+			"maximum number of volumes of deleted PVCs being deleted at once",
+		)
+		flags.IntVar(
+			&options.Deletion.MaxConcurrentPerBackingVolume, "max-concurrent-deletions-per-backing-volume", 2,
+			"maximum number of volumes being deleted at once in the same backing volume",
+		)
+		flags.DurationVar(
+			&options.Deletion.MaxRetryDelay, "max-deletion-retry-delay", 5*time.Minute,
+			"maximum delay before retrying to delete a volume, which doubles with every failed attempt",
+		)
+		flags.StringVar(
+			&options.MetricsAddress, "metrics-address", "",
+			"address at which to serve Prometheus metrics, e.g. \":8080\" (disabled if empty)",
+		)
+		flags.DurationVar(
+			&options.BackingStoreProbeInterval, "backing-store-probe-interval", 5*time.Minute,
+			"how often to probe the health of backing volumes through a canary image (disabled if 0)",
+		)
+		flags.Func(
+			"usage-export-sink",
+			"where to export per-namespace usage records to: \"csv:<namespace>/<backing-pvc>[/<path>]\", an http(s) "+
+				"URL, or \"metrics\" (may be given several times; disabled if not given)",
+			func(value string) error {
+				sink, err := controller.ParseUsageSinkConfig(value)
+				options.UsageExport.Sinks = append(options.UsageExport.Sinks, sink)
+				return err
+			},
+		)
+		flags.DurationVar(
+			&options.UsageExport.Interval, "usage-export-interval", time.Hour,
+			"length of the periods that usage records cover, which start at multiples of it",
+		)
+		flags.BoolVar(
+			&options.LeaderElection.Enabled, "leader-election", false,
+			"elect a leader among replicas of the controller plugin, which alone runs background controllers",
+		)
+		flags.StringVar(
+			&options.LeaderElection.Namespace, "leader-election-namespace", "",
+			"namespace of the leader election Lease (defaults to the namespace of the controller plugin's pod)",
+		)
+		flags.DurationVar(
+			&options.LeaderElection.LeaseDuration, "leader-election-lease-duration", 15*time.Second,
+			"how long other replicas wait after the leader last renewed the Lease before taking over",
+		)
+		flags.DurationVar(
+			&options.LeaderElection.RenewDeadline, "leader-election-renew-deadline", 10*time.Second,
+			"how long the leader keeps trying to renew the Lease before giving up on leading",
+		)
+		flags.DurationVar(
+			&options.LeaderElection.RetryPeriod, "leader-election-retry-period", 5*time.Second,
+			"how long replicas wait between attempts to acquire or renew the Lease",
+		)
+		flags.Func(
+			"job-node-selector",
+			"node labels that the nodes running Jobs on volumes must have, e.g. \"storage-network=fast,zone=a\"",
+			func(value string) error {
+				selector, err := labels.ConvertSelectorToLabelsMap(value)
+				options.JobPlacement.NodeSelector = selector
+				return err
+			},
+		)
+		addMetadataPropagationFlags(flags, &options.MetadataPropagation)
+		addFaultInjectionFlag(flags)
+		addMaintenanceWindowFlag(flags)
+		flags.Func(
+			"job-affinity",
+			"affinity of the pods of Jobs on volumes, as a JSON Kubernetes Affinity object",
+			func(value string) error {
+				options.JobPlacement.Affinity = &corev1.Affinity{}
+				return json.Unmarshal([]byte(value), options.JobPlacement.Affinity)
+			},
+		)
+		_ = flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 1 {
 			badUsage()
 		}
 
-		err := csiplugin.RunControllerPlugin(csiSocketPath, os.Args[2])
+		err := csiplugin.RunControllerPlugin(endpoint, flags.Arg(0), options)
 		if err != nil {
 			log.Fatalln(err)
 		}
 
 	case "node-plugin":
-		if len(os.Args) != 4 {
+		var endpoint csiplugin.Endpoint
+		var options csiplugin.NodePluginOptions
+
+		flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		addDriverNameFlag(flags)
+		addEndpointFlags(flags, &endpoint)
+		addShutdownGracePeriodFlag(flags, &options.ShutdownGracePeriod)
+		addLoggingFlags(flags)
+		flags.StringVar(
+			&options.KubeletDir, "kubelet-dir", common.DefaultKubeletDir,
+			"directory where kubelet keeps its state on the node, which must be mounted at the same path",
+		)
+		flags.StringVar(
+			&options.MetricsAddress, "metrics-address", "",
+			"address at which to serve Prometheus metrics, e.g. \":8080\" (disabled if empty)",
+		)
+		flags.BoolVar(
+			&options.QemuNbdFallback, "qemu-nbd-fallback", false,
+			"stage volumes with qemu-nbd if qemu-storage-daemon is unavailable or fails to start (with reduced features)",
+		)
+		flags.IntVar(
+			&options.NbdModule.NbdsMax, "nbds-max", 0,
+			"nbds_max parameter with which to load the nbd kernel module if it isn't loaded (module default if 0)",
+		)
+		addMetadataPropagationFlags(flags, &options.MetadataPropagation)
+		addFaultInjectionFlag(flags)
+		flags.IntVar(
+			&options.NbdModule.MaxPart, "nbd-max-part", 0,
+			"max_part parameter with which to load the nbd kernel module if it isn't loaded (module default if 0)",
+		)
+		flags.IntVar(
+			&options.MaxConcurrentStagings, "max-concurrent-stagings", 8,
+			"maximum number of volumes being staged at once on the node, further ones waiting for their turn "+
+				"(unlimited if 0)",
+		)
+		_ = flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 2 {
+			badUsage()
+		}
+
+		err := csiplugin.RunNodePlugin(endpoint, flags.Arg(0), flags.Arg(1), options)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+	case "backing-chains":
+		flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		addDriverNameFlag(flags)
+		_ = flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 0 {
+			badUsage()
+		}
+
+		err := csiplugin.PrintBackingChains(os.Stdout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+	case "gc":
+		// for cleaning up after incidents, run by operators or as a Job
+		var options csiplugin.GarbageCollectionOptions
+
+		flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		addDriverNameFlag(flags)
+		flags.BoolVar(&options.Delete, "delete", false, "delete the garbage found instead of only reporting it")
+		flags.DurationVar(
+			&options.MinAge, "min-age", time.Hour,
+			"minimum age of the Jobs and ReplicaSets to consider garbage, to avoid racing with their creation",
+		)
+		addMaintenanceWindowFlag(flags)
+		_ = flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 1 {
+			badUsage()
+		}
+
+		err := csiplugin.CollectGarbage(os.Stdout, flags.Arg(0), options)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+	case "doctor":
+		// for troubleshooting installations, run by operators or in the controller plugin's pod
+		var options csiplugin.DoctorOptions
+
+		flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		addDriverNameFlag(flags)
+		flags.StringVar(
+			&options.ServiceAccount, "service-account", "",
+			"service account of the controller plugin whose permissions to check, as \"<namespace>/<name>\" "+
+				"(defaults to whoever runs the command)",
+		)
+		flags.StringVar(
+			&options.Namespace, "namespace", "subprovisioner",
+			"namespace in which to run the Jobs that check the prerequisites on each node",
+		)
+		_ = flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 1 {
 			badUsage()
 		}
 
-		err := csiplugin.RunNodePlugin(csiSocketPath, os.Args[2], os.Args[3])
+		healthy, err := csiplugin.RunDoctor(os.Stdout, flags.Arg(0), options)
 		if err != nil {
 			log.Fatalln(err)
 		}
+		if !healthy {
+			os.Exit(1)
+		}
+
+	case "bench":
+		// for validating backing volumes before putting workloads on them
+		options := csiplugin.BenchOptions{Size: resource.MustParse("1Gi")}
+
+		flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		addDriverNameFlag(flags)
+		flags.StringVar(
+			&options.StorageClass, "storage-class", "", "StorageClass to provision the temporary volume from",
+		)
+		flags.StringVar(
+			&options.BackingClaim, "backing-claim", "",
+			"backing volume to place the temporary volume in, among those the StorageClass allows",
+		)
+		flags.StringVar(&options.Node, "node", "", "node to run the workload on (picked by the scheduler if empty)")
+		flags.StringVar(
+			&options.Namespace, "namespace", "default", "namespace in which to create the temporary PVC and pod",
+		)
+		flags.Func("size", "capacity of the temporary volume (default 1Gi)", func(value string) error {
+			size, err := resource.ParseQuantity(value)
+			options.Size = size
+			return err
+		})
+		flags.BoolVar(
+			&options.Prefill, "prefill", true,
+			"write the whole volume before running the workload, so that reads don't hit unallocated clusters",
+		)
+		flags.StringVar(
+			&options.Workload.ReadWrite, "rw", "randrw", "read, write, randread, randwrite, rw, or randrw",
+		)
+		flags.IntVar(&options.Workload.RwMixRead, "rwmixread", 70, "percentage of reads in rw and randrw workloads")
+		flags.StringVar(&options.Workload.BlockSize, "bs", "4k", "block size")
+		flags.IntVar(&options.Workload.IoDepth, "iodepth", 32, "number of I/Os in flight per job")
+		flags.IntVar(&options.Workload.NumJobs, "numjobs", 1, "number of jobs issuing I/O in parallel")
+		flags.DurationVar(&options.Workload.Runtime, "runtime", 30*time.Second, "how long to run the workload for")
+		_ = flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 1 || options.StorageClass == "" {
+			badUsage()
+		}
+
+		err := csiplugin.RunBench(os.Stdout, flags.Arg(0), options)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+	case "volume-qmp":
+		// for debugging staged volumes, run on the node they are staged on
+		flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		addDriverNameFlag(flags)
+		kubeletDir := flags.String(
+			"kubelet-dir", common.DefaultKubeletDir,
+			"directory where kubelet keeps its state on the node, as given to the node plugin",
+		)
+		_ = flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 2 && flags.NArg() != 3 {
+			badUsage()
+		}
+
+		err := csiplugin.RunVolumeQmp(os.Stdout, *kubeletDir, flags.Arg(0), flags.Arg(1), flags.Arg(2))
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+	case "qmp":
+		// used by scripts that manipulate staged volumes, e.g., for replication
+		if len(os.Args) != 4 && len(os.Args) != 5 {
+			badUsage()
+		}
+
+		var arguments interface{}
+		if len(os.Args) == 5 {
+			arguments = json.RawMessage(os.Args[4])
+		}
+
+		result, err := common.QmpExecute(context.Background(), os.Args[2], os.Args[3], arguments)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		fmt.Println(string(result))
 
 	default:
 		badUsage()
 	}
 }
+
+// The driver name must be the same for the controller plugin, the node plugin, and the backing-chains, gc, doctor,
+// bench, and volume-qmp commands.
+func addDriverNameFlag(flags *flag.FlagSet) {
+	flags.Func(
+		"driver-name",
+		fmt.Sprintf(
+			"name of the CSI driver, which also prefixes the labels and annotations it sets (default \"%s\")",
+			common.DefaultDomain,
+		),
+		common.SetDomain,
+	)
+}
+
+// Both plugins serve CSI at the default unix socket unless told otherwise, e.g., to run csi-sanity against them over
+// TCP.
+func addEndpointFlags(flags *flag.FlagSet, endpoint *csiplugin.Endpoint) {
+	flags.StringVar(
+		&endpoint.Address, "endpoint", csiplugin.DefaultEndpoint,
+		"where to serve CSI, \"unix://<path>\" or \"tcp://<host>:<port>\" (TCP requires mutual TLS unless on loopback)",
+	)
+	flags.StringVar(&endpoint.TlsCertFile, "tls-cert", "", "PEM certificate to serve a TCP endpoint over TLS with")
+	flags.StringVar(&endpoint.TlsKeyFile, "tls-key", "", "PEM private key of the certificate given by -tls-cert")
+	flags.StringVar(
+		&endpoint.TlsClientCaFile, "tls-client-ca", "",
+		"PEM CA certificates that clients of a TCP endpoint must present certificates signed by",
+	)
+}
+
+// Both plugins shut down gracefully on SIGTERM. The grace period should be shorter than the pods'
+// terminationGracePeriodSeconds.
+func addShutdownGracePeriodFlag(flags *flag.FlagSet, gracePeriod *time.Duration) {
+	flags.DurationVar(
+		gracePeriod, "shutdown-grace-period", csiplugin.DefaultShutdownGracePeriod,
+		"how long in-flight requests may take to finish on SIGTERM before they are canceled",
+	)
+}
+
+// Both plugins log through klog, at the verbosity that these flags set. Messages that dependencies log with the standard
+// log package are logged at verbosity 0.
+func addLoggingFlags(flags *flag.FlagSet) {
+	klogFlags := flag.NewFlagSet("klog", flag.ExitOnError)
+	klog.InitFlags(klogFlags)
+
+	for _, name := range []string{"v", "vmodule"} {
+		klogFlag := klogFlags.Lookup(name)
+		flags.Var(klogFlag.Value, name, klogFlag.Usage)
+	}
+
+	klog.CopyStandardLogTo("INFO")
+}
+
+// Fault injection is for testing only, and off unless this flag or the SUBPROVISIONER_INJECT_FAULTS environment
+// variable, which the flag overrides, is set.
+func addFaultInjectionFlag(flags *flag.FlagSet) {
+	if spec := os.Getenv("SUBPROVISIONER_INJECT_FAULTS"); spec != "" {
+		if err := common.SetInjectedFaults(spec); err != nil {
+			log.Fatalf("SUBPROVISIONER_INJECT_FAULTS: %v", err)
+		}
+	}
+
+	flags.Func(
+		"inject-faults",
+		"FOR TESTING ONLY: comma-separated faults to inject, e.g. \"job-creation:fail:2,nbd-attach:delay:30s\"",
+		common.SetInjectedFaults,
+	)
+}
+
+// Maintenance, i.e., purging the trash, collecting orphaned images, rebalancing, and collecting garbage, is done by the
+// controller plugin and the gc command, so both take this flag.
+func addMaintenanceWindowFlag(flags *flag.FlagSet) {
+	flags.Func(
+		"maintenance-window",
+		"cron-style UTC schedule of when maintenance may start, e.g. \"* 0-5 * * *\" for nightly (any time if empty)",
+		common.SetMaintenanceWindow,
+	)
+}
+
+// The controller plugin creates most Jobs, but the node plugin creates the ReplicaSets that stage volumes, so both take
+// these flags, which should be the same for both.
+func addMetadataPropagationFlags(flags *flag.FlagSet, propagation *common.MetadataPropagation) {
+	flags.Func(
+		"propagate-pvc-labels",
+		"comma-separated keys of PVC labels to copy onto the Jobs, ReplicaSets, and pods that operate on their volumes",
+		func(value string) error {
+			propagation.Labels = strings.Split(value, ",")
+			return nil
+		},
+	)
+	flags.Func(
+		"propagate-pvc-annotations",
+		"comma-separated keys of PVC annotations to copy onto the Jobs, ReplicaSets, and pods that operate on their "+
+			"volumes",
+		func(value string) error {
+			propagation.Annotations = strings.Split(value, ",")
+			return nil
+		},
+	)
+}
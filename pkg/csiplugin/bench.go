@@ -0,0 +1,363 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// How long the benchmark's volume may take to be provisioned and staged, and its pod to start, on top of the
+// workload's runtime and the prefill.
+const benchStartupTimeout = 10 * time.Minute
+
+// Where the benchmark's pod gets the volume's block device.
+const benchDevicePath = "/dev/bench"
+
+type BenchOptions struct {
+	// The StorageClass to provision the temporary volume from, and optionally the backing volume among those it
+	// allows to place it in (see the "backing-claim" PVC annotation).
+	StorageClass string
+	BackingClaim string
+
+	// The node to run the workload on, or "" to let the scheduler pick one.
+	Node string
+
+	// Namespace in which to create the temporary PVC and pod.
+	Namespace string
+
+	// Capacity of the temporary volume, which the workload spans.
+	Size resource.Quantity
+
+	// Whether to write the whole volume before running the workload, so that it measures allocated rather than
+	// unallocated clusters, which read as zeros without touching the backing volume.
+	Prefill bool
+
+	Workload BenchWorkload
+}
+
+// An fio workload.
+type BenchWorkload struct {
+	ReadWrite string // fio's --rw: read, write, randread, randwrite, rw, or randrw
+	RwMixRead int    // percentage of reads in rw and randrw workloads
+	BlockSize string // e.g., "4k"
+	IoDepth   int
+	NumJobs   int
+	Runtime   time.Duration
+}
+
+func (w BenchWorkload) validate() error {
+	switch w.ReadWrite {
+	case "read", "write", "randread", "randwrite", "rw", "randrw":
+	default:
+		return fmt.Errorf(
+			"invalid workload \"%s\", must be read, write, randread, randwrite, rw, or randrw", w.ReadWrite,
+		)
+	}
+	if w.RwMixRead < 0 || w.RwMixRead > 100 {
+		return fmt.Errorf("invalid read percentage %d, must be between 0 and 100", w.RwMixRead)
+	}
+	if w.IoDepth < 1 || w.NumJobs < 1 {
+		return fmt.Errorf("I/O depth and number of jobs must be at least 1")
+	}
+	if w.Runtime < time.Second {
+		return fmt.Errorf("runtime must be at least 1s")
+	}
+	return nil
+}
+
+// The arguments to fio for running the workload against the benchmark's volume, with JSON output.
+func (w BenchWorkload) fioArgs() []string {
+	args := []string{
+		"--name=bench",
+		"--filename=" + benchDevicePath,
+		"--direct=1",
+		"--ioengine=libaio",
+		"--rw=" + w.ReadWrite,
+		"--bs=" + w.BlockSize,
+		"--iodepth=" + strconv.Itoa(w.IoDepth),
+		"--numjobs=" + strconv.Itoa(w.NumJobs),
+		"--time_based",
+		"--runtime=" + strconv.Itoa(int(w.Runtime.Seconds())),
+		"--group_reporting",
+		"--output-format=json",
+	}
+	if w.ReadWrite == "rw" || w.ReadWrite == "randrw" {
+		args = append(args, "--rwmixread="+strconv.Itoa(w.RwMixRead))
+	}
+	return args
+}
+
+// Provisions a temporary volume, runs an fio workload against it from a pod, and reports the throughput and latency
+// achieved. The workload's I/O goes through the same data path as that of any other workload: NBD, qemu-storage-daemon,
+// and the backing volume. The volume and pod are deleted afterwards.
+//
+// Like the backing-chains command, this runs from an operator's machine or in the controller plugin's pod. The pod
+// runs the given plugin image, which includes fio.
+func RunBench(out io.Writer, image string, options BenchOptions) error {
+	err := options.Workload.validate()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	clientset, err := newCliClientset()
+	if err != nil {
+		return err
+	}
+
+	// provision volume
+
+	volumeMode := corev1.PersistentVolumeBlock
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: common.NamePrefix + "-bench-",
+			Namespace:    options.Namespace,
+			Labels:       map[string]string{common.Domain + "/component": "bench"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			VolumeMode:       &volumeMode,
+			StorageClassName: &options.StorageClass,
+		},
+	}
+	pvc.Spec.Resources.Requests = corev1.ResourceList{corev1.ResourceStorage: options.Size}
+	if options.BackingClaim != "" {
+		pvc.Annotations = map[string]string{common.Domain + "/backing-claim": options.BackingClaim}
+	}
+
+	pvc, err = clientset.CoreV1().PersistentVolumeClaims(options.Namespace).Create(ctx, pvc, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err := clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).
+			Delete(context.Background(), pvc.Name, metav1.DeleteOptions{})
+		if err != nil {
+			fmt.Fprintf(out, "Failed to delete PVC %s in namespace %s: %v\n", pvc.Name, pvc.Namespace, err)
+		}
+	}()
+
+	// run workload
+
+	script := `set -o errexit -o pipefail -o nounset; `
+	if options.Prefill {
+		script += `fio --name=prefill --filename="$1" --direct=1 --ioengine=libaio --rw=write --bs=1M --iodepth=8 ` +
+			`--output=/dev/null; `
+	}
+	script += `shift; exec fio "$@"`
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: common.NamePrefix + "-bench-",
+			Namespace:    options.Namespace,
+			Labels:       map[string]string{common.Domain + "/component": "bench"},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{
+				{
+					Name:  "bench",
+					Image: image,
+					Command: append(
+						[]string{"bash", "-c", script, "bash", benchDevicePath}, options.Workload.fioArgs()...,
+					),
+					VolumeDevices: []corev1.VolumeDevice{{Name: "volume", DevicePath: benchDevicePath}},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "volume",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc.Name},
+					},
+				},
+			},
+		},
+	}
+
+	// go through the scheduler rather than setting spec.nodeName, so that volumes with volumeBindingMode
+	// WaitForFirstConsumer are provisioned for the node
+	if options.Node != "" {
+		pod.Spec.Affinity = &corev1.Affinity{
+			NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{
+							MatchFields: []corev1.NodeSelectorRequirement{
+								{
+									Key:      "metadata.name",
+									Operator: corev1.NodeSelectorOpIn,
+									Values:   []string{options.Node},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	pod, err = clientset.CoreV1().Pods(options.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err := clientset.CoreV1().Pods(pod.Namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{})
+		if err != nil {
+			fmt.Fprintf(out, "Failed to delete pod %s in namespace %s: %v\n", pod.Name, pod.Namespace, err)
+		}
+	}()
+
+	fmt.Fprintf(
+		out, "Running %s workload on PVC %s with pod %s in namespace %s...\n",
+		options.Workload.ReadWrite, pvc.Name, pod.Name, pod.Namespace,
+	)
+
+	timeout := benchStartupTimeout + options.Workload.Runtime
+	if options.Prefill {
+		timeout += benchStartupTimeout
+	}
+
+	finished, err := waitForPodToFinishWithin(ctx, clientset, pod.Name, pod.Namespace, timeout)
+	if err != nil {
+		return err
+	}
+
+	logs, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+	if err != nil {
+		return err
+	}
+
+	if finished.Status.Phase != corev1.PodSucceeded {
+		return fmt.Errorf("benchmark pod %s failed; its logs were:\n%s", pod.Name, logs)
+	}
+
+	results, err := parseFioOutput(string(logs))
+	if err != nil {
+		return err
+	}
+
+	// report results
+
+	fmt.Fprintf(
+		out, "Node %s, %s blocks, I/O depth %d, %d jobs, %v:\n",
+		finished.Spec.NodeName, options.Workload.BlockSize, options.Workload.IoDepth, options.Workload.NumJobs,
+		options.Workload.Runtime,
+	)
+	for _, result := range results {
+		fmt.Fprintf(
+			out, "  %-5s %10.0f IOPS  %10.1f MiB/s  latency mean %.3f ms, p50 %.3f ms, p99 %.3f ms, p99.9 %.3f ms\n",
+			result.direction+":", result.iops, result.bandwidth/(1<<20),
+			result.meanLatency.Seconds()*1000, result.p50Latency.Seconds()*1000,
+			result.p99Latency.Seconds()*1000, result.p999Latency.Seconds()*1000,
+		)
+	}
+
+	return nil
+}
+
+func waitForPodToFinishWithin(
+	ctx context.Context,
+	clientset *common.Clientset,
+	podName string,
+	podNamespace string,
+	timeout time.Duration,
+) (*corev1.Pod, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// TODO: Watch instead of polling.
+	for {
+		pod, err := clientset.CoreV1().Pods(podNamespace).Get(ctx, podName, metav1.GetOptions{})
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("benchmark pod %s didn't finish within %v", podName, timeout)
+		} else if err != nil {
+			return nil, err
+		}
+
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			return pod, nil
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// The results of an fio workload in one direction.
+type benchResult struct {
+	direction   string // "read" or "write"
+	iops        float64
+	bandwidth   float64 // bytes per second
+	meanLatency time.Duration
+	p50Latency  time.Duration
+	p99Latency  time.Duration
+	p999Latency time.Duration
+}
+
+type fioStats struct {
+	TotalIos int64   `json:"total_ios"`
+	Iops     float64 `json:"iops"`
+	BwBytes  float64 `json:"bw_bytes"`
+	ClatNs   struct {
+		Mean       float64            `json:"mean"`
+		Percentile map[string]float64 `json:"percentile"`
+	} `json:"clat_ns"`
+}
+
+// Parses fio's JSON output, which it may precede with warnings, into the results of each direction that saw any I/O.
+func parseFioOutput(output string) ([]benchResult, error) {
+	start := strings.Index(output, "{")
+	if start < 0 {
+		return nil, fmt.Errorf("fio didn't output any results: %s", output)
+	}
+
+	var parsed struct {
+		Jobs []struct {
+			Read  fioStats `json:"read"`
+			Write fioStats `json:"write"`
+		} `json:"jobs"`
+	}
+	err := json.NewDecoder(strings.NewReader(output[start:])).Decode(&parsed)
+	if err != nil {
+		return nil, fmt.Errorf("malformed fio output: %w", err)
+	}
+	if len(parsed.Jobs) != 1 {
+		return nil, fmt.Errorf("fio reported %d job groups, expected 1", len(parsed.Jobs))
+	}
+
+	var results []benchResult
+	for _, direction := range []struct {
+		name  string
+		stats fioStats
+	}{{"read", parsed.Jobs[0].Read}, {"write", parsed.Jobs[0].Write}} {
+		if direction.stats.TotalIos == 0 {
+			continue
+		}
+		percentile := direction.stats.ClatNs.Percentile
+		results = append(results, benchResult{
+			direction:   direction.name,
+			iops:        direction.stats.Iops,
+			bandwidth:   direction.stats.BwBytes,
+			meanLatency: time.Duration(direction.stats.ClatNs.Mean),
+			p50Latency:  time.Duration(percentile["50.000000"]),
+			p99Latency:  time.Duration(percentile["99.000000"]),
+			p999Latency: time.Duration(percentile["99.900000"]),
+		})
+	}
+
+	return results, nil
+}
@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBenchWorkload(t *testing.T) {
+	workload := BenchWorkload{
+		ReadWrite: "randrw",
+		RwMixRead: 70,
+		BlockSize: "4k",
+		IoDepth:   32,
+		NumJobs:   2,
+		Runtime:   30 * time.Second,
+	}
+
+	if err := workload.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"--name=bench",
+		"--filename=/dev/bench",
+		"--direct=1",
+		"--ioengine=libaio",
+		"--rw=randrw",
+		"--bs=4k",
+		"--iodepth=32",
+		"--numjobs=2",
+		"--time_based",
+		"--runtime=30",
+		"--group_reporting",
+		"--output-format=json",
+		"--rwmixread=70",
+	}
+	if got := workload.fioArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, modify := range []func(w *BenchWorkload){
+		func(w *BenchWorkload) { w.ReadWrite = "trim" },
+		func(w *BenchWorkload) { w.RwMixRead = 101 },
+		func(w *BenchWorkload) { w.IoDepth = 0 },
+		func(w *BenchWorkload) { w.NumJobs = 0 },
+		func(w *BenchWorkload) { w.Runtime = time.Millisecond },
+	} {
+		invalid := workload
+		modify(&invalid)
+		if err := invalid.validate(); err == nil {
+			t.Errorf("%+v: expected error", invalid)
+		}
+	}
+}
+
+func TestParseFioOutput(t *testing.T) {
+	output := `fio: some warning
+{
+  "fio version" : "fio-3.35",
+  "jobs" : [
+    {
+      "jobname" : "bench",
+      "read" : {
+        "total_ios" : 1000,
+        "iops" : 5000.5,
+        "bw_bytes" : 20482048,
+        "clat_ns" : {
+          "mean" : 250000.0,
+          "percentile" : {
+            "50.000000" : 200000,
+            "99.000000" : 1000000,
+            "99.900000" : 3000000
+          }
+        }
+      },
+      "write" : {
+        "total_ios" : 0,
+        "iops" : 0,
+        "bw_bytes" : 0,
+        "clat_ns" : {
+          "mean" : 0.0
+        }
+      }
+    }
+  ]
+}
+`
+
+	results, err := parseFioOutput(output)
+	want := []benchResult{
+		{
+			direction:   "read",
+			iops:        5000.5,
+			bandwidth:   20482048,
+			meanLatency: 250 * time.Microsecond,
+			p50Latency:  200 * time.Microsecond,
+			p99Latency:  time.Millisecond,
+			p999Latency: 3 * time.Millisecond,
+		},
+	}
+	if err != nil || !reflect.DeepEqual(results, want) {
+		t.Errorf("got %+v, %v", results, err)
+	}
+
+	for _, output := range []string{"fio: failed to open /dev/bench\n", `{"jobs": [}`, `{"jobs": []}`} {
+		if _, err := parseFioOutput(output); err == nil {
+			t.Errorf("%q: expected error", output)
+		}
+	}
+}
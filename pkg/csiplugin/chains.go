@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Prints the most recently recorded backing chains of every backing location as trees, with each image's backing file
+// as its parent, and annotated with the PVC or VolumeSnapshot that each image belongs to, or the source and clone
+// volumes whose common ancestor it is.
+func PrintBackingChains(out io.Writer) error {
+	ctx := context.Background()
+
+	clientset, err := newCliClientset()
+	if err != nil {
+		return err
+	}
+
+	allChains, err := common.ListBackingChains(ctx, clientset)
+	if err != nil {
+		return err
+	}
+
+	owners, err := listImageOwners(ctx, clientset)
+	if err != nil {
+		return err
+	}
+
+	for _, chains := range allChains {
+		for image := range chains {
+			if description, ok := describeCloneImage(image, owners); ok {
+				owners[image] = description
+			}
+		}
+	}
+
+	locations := make([]common.BackingLocation, 0, len(allChains))
+	for location := range allChains {
+		locations = append(locations, location)
+	}
+	sort.Slice(locations, func(i, j int) bool {
+		return fmt.Sprint(locations[i]) < fmt.Sprint(locations[j])
+	})
+
+	for _, location := range locations {
+		chains := allChains[location]
+
+		fmt.Fprintf(
+			out, "Backing PVC %s in namespace %s, base path \"%s\":\n",
+			location.PvcName, location.PvcNamespace, location.BasePath,
+		)
+
+		children := map[string][]string{}
+		for image, backing := range chains {
+			if _, ok := chains[backing]; !ok && backing != "" {
+				children[""] = append(children[""], backing) // outside of base path or missing
+			}
+			children[backing] = append(children[backing], image)
+		}
+
+		var printTree func(image string, prefix string, last bool)
+		printTree = func(image string, prefix string, last bool) {
+			branch, indent := "├── ", "│   "
+			if last {
+				branch, indent = "└── ", "    "
+			}
+
+			line := image
+			if owner, ok := owners[image]; ok {
+				line += "  (" + owner + ")"
+			} else if _, ok := chains[image]; !ok {
+				line += "  (not under base path or missing)"
+			}
+			fmt.Fprintf(out, "%s%s%s\n", prefix, branch, line)
+
+			printChildren(children[image], func(child string, last bool) {
+				printTree(child, prefix+indent, last)
+			})
+		}
+
+		printChildren(children[""], func(root string, last bool) {
+			printTree(root, "", last)
+		})
+
+		fmt.Fprintln(out)
+	}
+
+	return nil
+}
+
+func printChildren(children []string, print func(child string, last bool)) {
+	children = dedupSorted(children)
+	for i, child := range children {
+		print(child, i == len(children)-1)
+	}
+}
+
+func dedupSorted(list []string) []string {
+	sort.Strings(list)
+	result := list[:0]
+	for i, item := range list {
+		if i == 0 || item != list[i-1] {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Describes the volumes whose common ancestor the given image is, if it is one, given the descriptions of the owners of
+// images. Such images are deleted once both volumes are gone, which the description points out.
+func describeCloneImage(image string, owners map[string]string) (string, bool) {
+	source, clone, ok := common.ParseCloneImageName(image)
+	if !ok {
+		return "", false
+	}
+
+	describeVolume := func(uid types.UID) (string, bool) {
+		if owner, ok := owners[common.GenerateVolumeImageName(uid)]; ok {
+			return owner, true
+		}
+		return fmt.Sprintf("deleted volume %s", uid), false
+	}
+
+	sourceOwner, sourceExists := describeVolume(source)
+	cloneOwner, cloneExists := describeVolume(clone)
+
+	description := fmt.Sprintf("clone of %s as %s", sourceOwner, cloneOwner)
+	if !sourceExists && !cloneExists {
+		description += ", reclaimable"
+	}
+	return description, true
+}
+
+// Maps the names of volume and snapshot images to descriptions of the PVCs and VolumeSnapshots they belong to.
+func listImageOwners(ctx context.Context, clientset *common.Clientset) (map[string]string, error) {
+	listOptions := metav1.ListOptions{LabelSelector: common.Domain + "/uid"}
+	owners := map[string]string{}
+
+	pvcs, err := clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		image := common.GenerateVolumeImageName(common.VolumeUidOf(pvc))
+		owners[image] = fmt.Sprintf("PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+
+	volumeSnapshots, err := clientset.SnapshotV1().VolumeSnapshots(metav1.NamespaceAll).List(ctx, listOptions)
+	if k8serrors.IsNotFound(err) {
+		return owners, nil // volume snapshot CRDs aren't installed
+	} else if err != nil {
+		return nil, err
+	}
+	for i := range volumeSnapshots.Items {
+		volumeSnapshot := &volumeSnapshots.Items[i]
+		image := common.GenerateSnapshotImageName(volumeSnapshot.UID)
+		owners[image] = fmt.Sprintf("VolumeSnapshot %s/%s", volumeSnapshot.Namespace, volumeSnapshot.Name)
+	}
+
+	return owners, nil
+}
@@ -0,0 +1,29 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"testing"
+)
+
+func TestDescribeCloneImage(t *testing.T) {
+	owners := map[string]string{
+		"pvc-a.qcow2": "PVC default/a",
+		"pvc-b.qcow2": "PVC default/b",
+	}
+
+	tests := map[string]string{
+		"cloned-a-to-b.qcow2": "clone of PVC default/a as PVC default/b",
+		"cloned-a-to-c.qcow2": "clone of PVC default/a as deleted volume c",
+		"cloned-d-to-e.qcow2": "clone of deleted volume d as deleted volume e, reclaimable",
+	}
+	for image, want := range tests {
+		if got, ok := describeCloneImage(image, owners); !ok || got != want {
+			t.Errorf("%s: got %q, %v, want %q", image, got, ok, want)
+		}
+	}
+
+	if _, ok := describeCloneImage("pvc-a.qcow2", owners); ok {
+		t.Errorf("volume image described as a clone image")
+	}
+}
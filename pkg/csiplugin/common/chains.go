@@ -0,0 +1,358 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lithammer/dedent"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// A location in a backing volume under which volumes are stored, i.e., a backing PVC and base path.
+type BackingLocation struct {
+	PvcName      string
+	PvcNamespace string
+	BasePath     string
+}
+
+func BackingLocationOf(meta *metav1.ObjectMeta) BackingLocation {
+	return BackingLocation{
+		PvcName:      meta.Annotations[Domain+"/backing-pvc-name"],
+		PvcNamespace: meta.Annotations[Domain+"/backing-pvc-namespace"],
+		BasePath:     meta.Annotations[Domain+"/backing-pvc-base-path"],
+	}
+}
+
+func (l BackingLocation) hash() string {
+	// see GenerateStagingReplicaSetName() for why we hash
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(l.PvcName+"/"+l.BasePath)))
+}
+
+// Records of the backing chains of all qcow2 images in a backing location, as of some point in time. Maps the name of
+// each image (relative to the base path) to the name of its backing file, or to "" if it has none.
+type BackingChains map[string]string
+
+// What inspecting an image in a backing location found out about how it is laid out in the backing volume. Values that
+// couldn't be determined are -1.
+type ImageStats struct {
+	// the space that the image takes up in the backing volume, not including its backing files
+	AllocatedBytes int64
+
+	ClusterSize int64
+
+	// the number of extents that the image file is split into in the backing volume's file system
+	Extents int64
+}
+
+// The number of clusters allocated in the image file, including those holding its metadata, or -1 if unknown.
+func (s ImageStats) AllocatedClusters() int64 {
+	if s.AllocatedBytes < 0 || s.ClusterSize <= 0 {
+		return -1
+	}
+	return (s.AllocatedBytes + s.ClusterSize - 1) / s.ClusterSize
+}
+
+// How long the Job that inspects the images in a backing location may take before it is given up on.
+const backingChainInspectionTimeout = 30 * time.Minute
+
+var backingChainInspectionBackoffLimit int32 = 2
+
+// Determines the backing chains of all images in a backing location by running a Job that inspects them, and records
+// them in a ConfigMap in the backing PVC's namespace. Returns what was found out about the layout of each image that
+// could be inspected.
+//
+// Images that can't be inspected (e.g., because they are being written to or are corrupt) keep their previously
+// recorded backing file, if any. Raw images are inspected as raw (see ListRawImageNames()), and thus have none.
+func RefreshBackingChains(
+	ctx context.Context,
+	clientset *Clientset,
+	image string,
+	location BackingLocation,
+) (map[string]ImageStats, error) {
+	jobName := NamePrefix + "-inspect-" + location.hash()
+
+	rawImageNames, err := ListRawImageNames(ctx, clientset, location)
+	if err != nil {
+		return nil, err
+	}
+
+	script := ImageFormatFunction + dedent.Dedent(
+		`
+		set -o nounset
+
+		raw_image_names="$1"
+
+		cd /var/backing
+		for f in *.qcow2; do
+		    [[ -f "${f}" ]] || continue
+		    # images may be in use, hence --force-share
+		    format="$( image_format "${f}" )"
+		    if info="$( timeout 60 qemu-img info -f "${format}" --force-share --output=json "${f}" 2>/dev/null )" &&
+		        allocated="$( jq -r '.["actual-size"] // "-"' <<< "${info}" )" &&
+		        cluster_size="$( jq -r '.["cluster-size"] // "-"' <<< "${info}" )" &&
+		        backing="$( jq -r '.["backing-filename"] // ""' <<< "${info}" )"; then
+		        # how many extents the image file is split into in the backing volume's file system
+		        extents="$( timeout 60 filefrag "${f}" 2>/dev/null | sed -n 's/.*: \([0-9]*\) extents\? found$/\1/p' )"
+		        echo "ok ${f} ${allocated} ${cluster_size} ${extents:--} ${backing}"
+		    else
+		        echo "failed ${f}"
+		    fi
+		done
+		`,
+	)
+
+	err = CreateJob(
+		ctx, clientset,
+		JobConfig{
+			Name:      jobName,
+			Namespace: location.PvcNamespace,
+			Labels: map[string]string{
+				Domain + "/component": "backing-chain-inspection",
+			},
+			Image:              image,
+			Command:            []string{"bash", "-c", script, "bash", RawImageNamesArg(rawImageNames)},
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			BackoffLimit:       &backingChainInspectionBackoffLimit,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = WaitForJobToSucceedWithin(
+		ctx, clientset, jobName, location.PvcNamespace, backingChainInspectionTimeout,
+	)
+	if err != nil {
+		_ = DeleteJobSynchronously(ctx, clientset, jobName, location.PvcNamespace)
+		return nil, err
+	}
+
+	output, err := GetJobLogs(ctx, clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	err = DeleteJobSynchronously(ctx, clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	scanned, stats, failed := parseImageInspection(string(output))
+
+	if len(failed) > 0 {
+		klog.ErrorS(
+			nil, "Failed to inspect images", "images", failed, "basePath", location.BasePath,
+			"backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+		)
+	}
+
+	err = updateBackingChains(ctx, clientset, location, true, failed, func(chains BackingChains) {
+		for _, name := range failed {
+			if backing, ok := chains[name]; ok {
+				scanned[name] = backing
+			}
+		}
+		for name := range chains {
+			delete(chains, name)
+		}
+		for name, backing := range scanned {
+			chains[name] = backing
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Parses the output of the Job that inspects the images in a backing location, with lines of the form "ok <image>
+// <allocated bytes> <cluster size> <extents> <backing file or nothing>", where unknown numbers are "-", or "failed
+// <image>".
+func parseImageInspection(output string) (scanned BackingChains, stats map[string]ImageStats, failed []string) {
+	scanned = BackingChains{}
+	stats = map[string]ImageStats{}
+
+	parseValue := func(value string) int64 {
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return parsed
+		}
+		return -1
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		result, rest, _ := strings.Cut(scanner.Text(), " ")
+		switch result {
+		case "ok":
+			name, rest, _ := strings.Cut(rest, " ")
+			allocated, rest, _ := strings.Cut(rest, " ")
+			clusterSize, rest, _ := strings.Cut(rest, " ")
+			extents, backing, _ := strings.Cut(rest, " ")
+			scanned[name] = backing
+			stats[name] = ImageStats{
+				AllocatedBytes: parseValue(allocated),
+				ClusterSize:    parseValue(clusterSize),
+				Extents:        parseValue(extents),
+			}
+		case "failed":
+			failed = append(failed, rest)
+		}
+	}
+
+	return scanned, stats, failed
+}
+
+// Records changes to the backing chains of a backing location that are known to have been made, e.g., because an image
+// was just created or deleted, so that they are visible without waiting for the next refresh.
+func RecordBackingChainChanges(
+	ctx context.Context, clientset *Clientset, location BackingLocation, update func(chains BackingChains),
+) error {
+	return updateBackingChains(ctx, clientset, location, false, nil, update)
+}
+
+// If refreshed is true, failed lists the images that couldn't be inspected.
+func updateBackingChains(
+	ctx context.Context, clientset *Clientset, location BackingLocation, refreshed bool, failed []string,
+	update func(chains BackingChains),
+) error {
+	configMaps := clientset.CoreV1().ConfigMaps(location.PvcNamespace)
+	configMapName := NamePrefix + "-chains-" + location.hash()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, configMapName, metav1.GetOptions{})
+		exists := err == nil
+		if exists {
+			err = CheckNameCollision("ConfigMap", &configMap.ObjectMeta, "backing-chains")
+			if err != nil {
+				return err
+			}
+		} else if k8serrors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      configMapName,
+					Namespace: location.PvcNamespace,
+					Labels: map[string]string{
+						Domain + "/component": "backing-chains",
+					},
+					Annotations: map[string]string{
+						Domain + "/backing-pvc-name":      location.PvcName,
+						Domain + "/backing-pvc-namespace": location.PvcNamespace,
+						Domain + "/backing-pvc-base-path": location.BasePath,
+					},
+				},
+			}
+		} else if err != nil {
+			return err
+		}
+
+		chains := BackingChains{}
+		if data := configMap.Data["chains"]; data != "" {
+			err = json.Unmarshal([]byte(data), &chains)
+			if err != nil {
+				return fmt.Errorf("malformed ConfigMap %s in namespace %s: %w", configMap.Name, configMap.Namespace, err)
+			}
+		}
+
+		update(chains)
+
+		chainsJson, err := json.Marshal(chains)
+		if err != nil {
+			return err
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data["chains"] = string(chainsJson)
+
+		if refreshed {
+			failedJson, err := json.Marshal(failed)
+			if err != nil {
+				return err
+			}
+
+			configMap.Data["failed"] = string(failedJson)
+			configMap.Annotations[Domain+"/refreshed-at"] = metav1.Now().UTC().Format(metav1.RFC3339Micro)
+		}
+
+		if exists {
+			_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+			return err
+		}
+
+		_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			// created concurrently, retry on top of it
+			return k8serrors.NewConflict(corev1.Resource("configmaps"), configMapName, err)
+		}
+		return err
+	})
+}
+
+// Returns the most recently recorded backing chains of every backing location.
+func ListBackingChains(ctx context.Context, clientset *Clientset) (map[BackingLocation]BackingChains, error) {
+	list, err := clientset.CoreV1().ConfigMaps(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: Domain + "/component=backing-chains"})
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[BackingLocation]BackingChains{}
+	for i := range list.Items {
+		configMap := &list.Items[i]
+
+		var chains BackingChains
+		err = json.Unmarshal([]byte(configMap.Data["chains"]), &chains)
+		if err != nil {
+			return nil, fmt.Errorf("malformed ConfigMap %s in namespace %s: %w", configMap.Name, configMap.Namespace, err)
+		}
+
+		result[BackingLocationOf(&configMap.ObjectMeta)] = chains
+	}
+
+	return result, nil
+}
+
+// Returns the images of every backing location that couldn't be inspected the last time its backing chains were
+// refreshed, e.g., because they are corrupt.
+func ListUninspectableImages(ctx context.Context, clientset *Clientset) (map[BackingLocation][]string, error) {
+	list, err := clientset.CoreV1().ConfigMaps(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: Domain + "/component=backing-chains"})
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[BackingLocation][]string{}
+	for i := range list.Items {
+		configMap := &list.Items[i]
+
+		data, ok := configMap.Data["failed"]
+		if !ok {
+			continue // not refreshed yet
+		}
+
+		var failed []string
+		err = json.Unmarshal([]byte(data), &failed)
+		if err != nil {
+			return nil, fmt.Errorf("malformed ConfigMap %s in namespace %s: %w", configMap.Name, configMap.Namespace, err)
+		}
+
+		result[BackingLocationOf(&configMap.ObjectMeta)] = failed
+	}
+
+	return result, nil
+}
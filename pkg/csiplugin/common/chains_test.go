@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseImageInspection(t *testing.T) {
+	output := "+ cd /var/backing\n" +
+		"ok pvc-1.qcow2 196616 65536 3 snapshot-1.qcow2\n" +
+		"ok snapshot-1.qcow2 1048576 65536 - \n" +
+		"ok pvc-2.qcow2 - - - \n" +
+		"failed pvc-3.qcow2\n"
+
+	scanned, stats, failed := parseImageInspection(output)
+
+	wantScanned := BackingChains{"pvc-1.qcow2": "snapshot-1.qcow2", "snapshot-1.qcow2": "", "pvc-2.qcow2": ""}
+	if !reflect.DeepEqual(scanned, wantScanned) {
+		t.Errorf("got backing chains %v, want %v", scanned, wantScanned)
+	}
+
+	wantStats := map[string]ImageStats{
+		"pvc-1.qcow2":      {AllocatedBytes: 196616, ClusterSize: 65536, Extents: 3},
+		"snapshot-1.qcow2": {AllocatedBytes: 1048576, ClusterSize: 65536, Extents: -1},
+		"pvc-2.qcow2":      {AllocatedBytes: -1, ClusterSize: -1, Extents: -1},
+	}
+	if !reflect.DeepEqual(stats, wantStats) {
+		t.Errorf("got image stats %v, want %v", stats, wantStats)
+	}
+
+	if got := stats["pvc-1.qcow2"].AllocatedClusters(); got != 4 {
+		t.Errorf("got %d allocated clusters, want 4", got)
+	}
+	if got := stats["pvc-2.qcow2"].AllocatedClusters(); got != -1 {
+		t.Errorf("got %d allocated clusters for unknown allocation, want -1", got)
+	}
+
+	if !reflect.DeepEqual(failed, []string{"pvc-3.qcow2"}) {
+		t.Errorf("got failed images %v", failed)
+	}
+}
@@ -5,39 +5,264 @@ package common
 import (
 	"crypto/sha256"
 	"fmt"
+	"strings"
 
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
+// Name of the CSI driver, which also prefixes the labels, annotations, and finalizers that it sets on objects, so that
+// several instances of the driver with different names can coexist in a cluster without touching each other's
+// objects. Only changed on startup (see SetDomain()).
+var Domain = DefaultDomain
+
+// Prefix of the names of the objects that the driver creates, e.g., Jobs, ReplicaSets, and ConfigMaps, which is
+// followed by a dash. Derived from the driver name (see SetDomain()), so that several instances of the driver with
+// different names don't create objects with the same names in a backing PVC's namespace.
+var NamePrefix = DefaultNamePrefix
+
 const (
-	Domain  = "subprovisioner.gitlab.io"
-	Version = "0.0.0"
+	DefaultDomain     = "subprovisioner.gitlab.io"
+	DefaultNamePrefix = "subprovisioner"
+	Version           = "0.0.0"
+
+	// API group of the custom resources, which is shared by all instances of the driver.
+	Group = "subprovisioner.gitlab.io"
+
+	// Where kubelet keeps its state on most distributions. Others, like k0s, MicroK8s, or RKE2, place it elsewhere.
+	DefaultKubeletDir = "/var/lib/kubelet"
+
+	// Topology key under which the node plugin reports the zone of its node, and zonal volumes the zone of their
+	// backing volume. It is the well-known node label, which is where the zone of a node is taken from.
+	ZoneTopologyKey = "topology.kubernetes.io/zone"
 )
 
+// Sets the name of the CSI driver, which must be a DNS subdomain of at most 63 characters, as required by CSI.
+func SetDomain(name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid driver name \"%s\": %s", name, strings.Join(errs, ", "))
+	}
+	if len(name) > 63 {
+		return fmt.Errorf("invalid driver name \"%s\": must be no more than 63 characters", name)
+	}
+
+	Domain = name
+	NamePrefix = namePrefixFor(name)
+	return nil
+}
+
+// Longest name prefix derived from a driver name. Job names end up in a label of their pods, and so may be no longer
+// than 63 characters, which names made of a prefix of up to this length, an operation like "replicate", and a UID
+// don't exceed.
+const maxNamePrefixLength = 16
+
+// Returns the name prefix for a driver name: its first label, truncated to maxNamePrefixLength characters, e.g.,
+// "subprovisioner" for the default driver name.
+func namePrefixFor(name string) string {
+	prefix, _, _ := strings.Cut(name, ".")
+	if len(prefix) > maxNamePrefixLength {
+		prefix = strings.TrimRight(prefix[:maxNamePrefixLength], "-")
+	}
+	return prefix
+}
+
+// Name of a volume's image, relative to the base path of its backing volume.
+func GenerateVolumeImageName(pvcUid types.UID) string {
+	return fmt.Sprintf("pvc-%s.qcow2", pvcUid)
+}
+
 func GenerateVolumeImagePath(pvcUid types.UID) string {
-	return fmt.Sprintf("/var/backing/pvc-%s.qcow2", pvcUid)
+	return "/var/backing/" + GenerateVolumeImageName(pvcUid)
+}
+
+// Name of a snapshot's image, relative to the base path of its backing volume.
+func GenerateSnapshotImageName(volumeSnapshotUid types.UID) string {
+	return fmt.Sprintf("snapshot-%s.qcow2", volumeSnapshotUid)
 }
 
 func GenerateSnapshotImagePath(volumeSnapshotUid types.UID) string {
-	return fmt.Sprintf("/var/backing/snapshot-%s.qcow2", volumeSnapshotUid)
+	return "/var/backing/" + GenerateSnapshotImageName(volumeSnapshotUid)
+}
+
+// Name of the image that cloning a volume leaves behind as the common ancestor of the source volume and its clone,
+// which both are backed by, relative to the base path of their backing volume.
+func GenerateCloneImageName(sourcePvcUid types.UID, clonePvcUid types.UID) string {
+	return fmt.Sprintf("cloned-%s-to-%s.qcow2", sourcePvcUid, clonePvcUid)
+}
+
+// Returns the uids of the source and clone volumes whose common ancestor the given image is, if it is one (see
+// GenerateCloneImageName()).
+func ParseCloneImageName(imageName string) (types.UID, types.UID, bool) {
+	if !strings.HasPrefix(imageName, "cloned-") || !strings.HasSuffix(imageName, ".qcow2") {
+		return "", "", false
+	}
+	source, clone, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(imageName, "cloned-"), ".qcow2"), "-to-")
+	if !ok || source == "" || clone == "" {
+		return "", "", false
+	}
+	return types.UID(source), types.UID(clone), true
 }
 
 func GenerateCreationJobName(pvcUid types.UID) string {
-	return fmt.Sprintf("subprovisioner-create-%s", pvcUid)
+	return fmt.Sprintf("%s-create-%s", NamePrefix, pvcUid)
 }
 
 func GenerateDeletionJobName(pvcUid types.UID) string {
-	return fmt.Sprintf("subprovisioner-delete-%s", pvcUid)
+	return fmt.Sprintf("%s-delete-%s", NamePrefix, pvcUid)
 }
 
 func GenerateSnapshottingJobName(volumeSnapshotUid types.UID) string {
-	return fmt.Sprintf("subprovisioner-snapshot-%s", volumeSnapshotUid)
+	return fmt.Sprintf("%s-snapshot-%s", NamePrefix, volumeSnapshotUid)
+}
+
+// Name of the Job that hashes the content of a snapshot right after it is taken.
+func GenerateContentHashJobName(volumeSnapshotUid types.UID) string {
+	return fmt.Sprintf("%s-hash-%s", NamePrefix, volumeSnapshotUid)
+}
+
+// Name of the Job that verifies the content of a snapshot before the volume of the given PVC is created from it.
+func GenerateContentVerificationJobName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-verify-%s", NamePrefix, pvcUid)
+}
+
+// Name of the local copy of an image served over HTTPS that volumes may be backed by instead of the image itself,
+// relative to the base path of a backing volume. URLs can contain characters that file names can't, so they are
+// hashed.
+func GenerateHttpBackingCopyName(url string) string {
+	return fmt.Sprintf("http-%x.qcow2", sha256.Sum256([]byte(url)))
+}
+
+// Name of the Job that downloads an image served over HTTPS into a backing location.
+func GenerateHttpBackingPullJobName(location BackingLocation, url string) string {
+	hashedLocationAndUrl := sha256.Sum256([]byte(location.hash() + " " + url))
+	return fmt.Sprintf("%s-pull-%x", NamePrefix, hashedLocationAndUrl[:16])
+}
+
+// Name of the Job that deletes the given image, e.g., of a deleted snapshot, once nothing depends on it anymore. Image
+// names can be longer than Job names, so they are hashed.
+func GenerateImageCleanupJobName(imageName string) string {
+	hashedImageName := sha256.Sum256([]byte(imageName))
+	return fmt.Sprintf("%s-cleanup-%x", NamePrefix, hashedImageName[:16])
+}
+
+// Name of the Job that lists the files in a backing location for the gc command.
+func GenerateGarbageScanJobName(location BackingLocation) string {
+	return fmt.Sprintf("%s-gc-scan-%s", NamePrefix, location.hash()[:32])
+}
+
+// Name of the Job that deletes the files that the gc command found to be garbage in a backing location.
+func GenerateGarbageCollectionJobName(location BackingLocation) string {
+	return fmt.Sprintf("%s-gc-%s", NamePrefix, location.hash()[:32])
+}
+
+// Name of the image that the controller plugin periodically writes to and reads from to probe the health of a backing
+// volume, relative to the base path of the backing volume. It is hidden, so that nothing that goes over the images in a
+// backing volume, e.g., the gc command, mistakes it for the image of a volume.
+const BackingStoreCanaryImageName = ".canary.qcow2"
+
+// Name of the Job that probes the health of a backing volume through its canary image.
+func GenerateBackingStoreProbeJobName(location BackingLocation) string {
+	return fmt.Sprintf("%s-probe-%s", NamePrefix, location.hash()[:32])
+}
+
+// Name of the Job that appends usage records to a CSV file in a backing volume.
+func GenerateUsageExportJobName(location BackingLocation) string {
+	return fmt.Sprintf("%s-usage-export-%s", NamePrefix, location.hash()[:32])
+}
+
+// Name of the Lease that the replicas of the controller plugin compete for to run the controller monitor.
+func GenerateControllerLeaseName() string {
+	return NamePrefix + "-controller"
+}
+
+// Name of the Job that the doctor command runs on a node to check its prerequisites. Node names can be longer than Job
+// names, so they are hashed.
+func GenerateDoctorJobName(nodeName string) string {
+	hashedNodeName := sha256.Sum256([]byte(nodeName))
+	return fmt.Sprintf("%s-doctor-%x", NamePrefix, hashedNodeName[:16])
+}
+
+func GenerateMirrorResyncJobName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-mirror-resync-%s", NamePrefix, pvcUid)
 }
 
 func GenerateExpansionJobName(pvcUid types.UID) string {
-	return fmt.Sprintf("subprovisioner-expand-%s", pvcUid)
+	return fmt.Sprintf("%s-expand-%s", NamePrefix, pvcUid)
+}
+
+func GenerateShrinkJobName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-shrink-%s", NamePrefix, pvcUid)
+}
+
+func GenerateReplicationJobName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-replicate-%s", NamePrefix, pvcUid)
+}
+
+func GenerateResyncJobName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-resync-%s", NamePrefix, pvcUid)
+}
+
+func GenerateMigrationJobName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-migrate-%s", NamePrefix, pvcUid)
+}
+
+func GenerateRelocationJobName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-relocate-%s", NamePrefix, pvcUid)
+}
+
+func GenerateRelocationCleanupJobName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-unlink-%s", NamePrefix, pvcUid)
+}
+
+func GenerateExportJobName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-export-%s", NamePrefix, pvcUid)
 }
 
+// Name of the Job that flattens the image of a snapshot into a bundle. UIDs are unique across kinds, so this can't clash
+// with the Job exporting a volume.
+func GenerateSnapshotExportJobName(volumeSnapshotUid types.UID) string {
+	return fmt.Sprintf("%s-export-%s", NamePrefix, volumeSnapshotUid)
+}
+
+// Name of the Job that purges the image of a deleted volume from the trash once its retention period is over.
+func GenerateTrashPurgeJobName(volumeId string) string {
+	return fmt.Sprintf("%s-purge-%s", NamePrefix, volumeId)
+}
+
+// Name of the Job that restores the image of a deleted volume from the trash.
+func GenerateUndeleteJobName(volumeId string) string {
+	return fmt.Sprintf("%s-undelete-%s", NamePrefix, volumeId)
+}
+
+func GenerateBundleImportJobName(volumeId string) string {
+	return fmt.Sprintf("%s-unbundle-%s", NamePrefix, volumeId)
+}
+
+// Name of the Job that writes or reads the manifest of the bundle of the given VolumeExport or VolumeImport.
+func GenerateBundleManifestJobName(uid types.UID) string {
+	return fmt.Sprintf("%s-bundle-%s", NamePrefix, uid)
+}
+
+// Name of the VolumeReplication object created for a volume through the csi-addons replication API.
+func GenerateVolumeReplicationName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-%s", NamePrefix, pvcUid)
+}
+
+// Name of the ReplicaSet that exposes a volume or snapshot read-only for inspection, given the UID of its PVC or
+// VolumeSnapshot.
+func GenerateInspectionReplicaSetName(uid types.UID) string {
+	return fmt.Sprintf("%s-inspection-%s", NamePrefix, uid)
+}
+
+// Name of the ReplicaSet that serves a volume staged shared to the nodes it is staged on, and of the Service through
+// which they reach it.
+func GenerateSharedExportName(pvcUid types.UID) string {
+	return fmt.Sprintf("%s-share-%s", NamePrefix, pvcUid)
+}
+
+// The port on which the shared export of a volume serves it over NBD.
+const SharedExportPort = 10809
+
 func GenerateStagingReplicaSetName(pvcUid types.UID, nodeName string) string {
 	// Node object names must be DNS Subdomain Names, and so can be up to 253 characters in length, which means we
 	// can't embed nodeName directly in the object name we return here. But we also don't want to use the Node
@@ -45,5 +270,11 @@ func GenerateStagingReplicaSetName(pvcUid types.UID, nodeName string) string {
 	// to the same actual node in the cluster. We thus hash nodeName and append the result to the object name
 	// instead, and use SHA-256 to ensure there are no accidental (or purposeful) collisions.
 	hashedNodeName := sha256.Sum256([]byte(nodeName))
-	return fmt.Sprintf("subprovisioner-stage-%s-on-%x", pvcUid, hashedNodeName)
+	return fmt.Sprintf("%s-stage-%s-on-%x", NamePrefix, pvcUid, hashedNodeName)
+}
+
+// Name of the device-mapper device that verifies the integrity of the given volume while it is staged, if the volume
+// has integrity protection. Must match what scripts/qsd-with-nbd.sh derives from the path of the QMP socket.
+func GenerateIntegrityDeviceName(pvcUid types.UID) string {
+	return fmt.Sprintf("subprovisioner-%s", pvcUid)
 }
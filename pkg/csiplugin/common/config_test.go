@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+)
+
+func TestGenerateHttpBackingCopyName(t *testing.T) {
+	// must match what scripts/qsd-with-nbd.sh computes with sha256sum
+	got := GenerateHttpBackingCopyName("https://images.example.com/fedora-38.qcow2")
+	want := "http-e67ecefdffa9b6aabab237b46e303747d88a0b7fc41dd3225473ef73203bcc2c.qcow2"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSetDomainNamePrefix(t *testing.T) {
+	t.Cleanup(func() { _ = SetDomain(DefaultDomain) })
+
+	for _, test := range []struct {
+		driverName string
+		want       string
+	}{
+		{DefaultDomain, DefaultNamePrefix},
+		{"subprovisioner-fast.example.com", "subprovisioner-f"},
+		{"fast.example.com", "fast"},
+		{"localdisk", "localdisk"},
+		{"subprovisioner---x.example.com", "subprovisioner"},
+	} {
+		if err := SetDomain(test.driverName); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.driverName, err)
+		}
+		if NamePrefix != test.want {
+			t.Errorf("%s: got name prefix %s, want %s", test.driverName, NamePrefix, test.want)
+		}
+	}
+
+	_ = SetDomain("localdisk.example.com")
+	if got, want := GenerateCreationJobName("3a9e"), "localdisk-create-3a9e"; got != want {
+		t.Errorf("got Job name %s, want %s", got, want)
+	}
+}
+
+func TestParseCloneImageName(t *testing.T) {
+	name := GenerateCloneImageName("8e1a", "c27d")
+	if name != "cloned-8e1a-to-c27d.qcow2" {
+		t.Errorf("got %s", name)
+	}
+
+	source, clone, ok := ParseCloneImageName(name)
+	if !ok || source != "8e1a" || clone != "c27d" {
+		t.Errorf("got %s, %s, %v", source, clone, ok)
+	}
+
+	for _, name := range []string{"cloned-8e1a.qcow2", "cloned--to-c27d.qcow2", "pvc-8e1a.qcow2", "cloned-a-to-b"} {
+		if _, _, ok := ParseCloneImageName(name); ok {
+			t.Errorf("%s: expected not to parse", name)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Converts an error returned by a gRPC handler into a gRPC status error, unless it already is one.
+//
+// The sidecars decide whether and how soon to retry operations based on the code, so it should reflect what went
+// wrong: missing objects map to NotFound, conflicting updates to Aborted, failures to reach the Kubernetes API to
+// Unavailable, and anything else (e.g., the API rejecting our requests) to Internal. Errors caused by the user or by
+// the state of the volume should be returned as status errors with the appropriate code to begin with.
+func ToGrpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var code codes.Code
+	var urlErr *url.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case k8serrors.IsNotFound(err):
+		code = codes.NotFound
+	case k8serrors.IsAlreadyExists(err):
+		code = codes.AlreadyExists
+	case k8serrors.IsConflict(err):
+		code = codes.Aborted
+	case k8serrors.IsServerTimeout(err), k8serrors.IsTimeout(err), k8serrors.IsTooManyRequests(err),
+		k8serrors.IsServiceUnavailable(err), k8serrors.IsInternalError(err), k8serrors.IsUnexpectedServerError(err),
+		errors.As(err, &urlErr):
+		code = codes.Unavailable
+	default:
+		code = codes.Internal
+	}
+
+	return status.Error(code, err.Error())
+}
+
+// Reasons given in the google.rpc.ErrorInfo details of errors (see ErrorWithReason()), which tell clients what went
+// wrong without them having to parse messages. Once released, a reason must keep its meaning.
+const (
+	ReasonBackingStoreFull        = "BACKING_STORE_FULL"        // the backing volume has no room for the volume
+	ReasonBackingStoreUnhealthy   = "BACKING_STORE_UNHEALTHY"   // operations in the backing volume kept failing
+	ReasonBackingStoreMaintenance = "BACKING_STORE_MAINTENANCE" // the backing PVC is under maintenance
+	ReasonBackingStoreDraining    = "BACKING_STORE_DRAINING"    // the backing PVC is being drained
+	ReasonVolumeBusy              = "VOLUME_BUSY"               // the volume is busy with another operation
+	ReasonVolumeStaged            = "VOLUME_STAGED"             // the operation requires the volume to be unstaged
+	ReasonJobFailed               = "JOB_FAILED"                // a Job carrying out the operation failed
+	ReasonJobUnschedulable        = "JOB_UNSCHEDULABLE"         // a Job carrying out the operation can't be scheduled
+	ReasonNbdDevicesExhausted     = "NBD_DEVICES_EXHAUSTED"     // the node has no free NBD device
+	ReasonStagingQueued           = "STAGING_QUEUED"            // other volumes are being staged on the node
+)
+
+// Like status.Errorf(), but the status also carries a google.rpc.ErrorInfo detail with the given reason, the driver's
+// name as its domain, and the given metadata, which should identify the objects involved, e.g., by
+// "backingPvcNamespace" and "backingPvcName" keys.
+func ErrorWithReason(
+	code codes.Code, reason string, metadata map[string]string, format string, args ...interface{},
+) error {
+	st := status.Newf(code, format, args...)
+
+	withDetails, err := st.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: Domain, Metadata: metadata})
+	if err != nil {
+		return st.Err() // can't happen, as the detail can always be marshaled
+	}
+	return withDetails.Err()
+}
+
+// Returns the google.rpc.ErrorInfo detail of the given error, or nil if it has none.
+func ErrorInfoOf(err error) *errdetails.ErrorInfo {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
+
+// Fails with codes.AlreadyExists if an object that was to be created already exists but wasn't created by the driver
+// for the same purpose, as told by its "component" label, e.g., because another instance of the driver that derives
+// the same name prefix (see NamePrefix), or another tool, uses the same name in the namespace.
+func CheckNameCollision(kind string, existing *metav1.ObjectMeta, component string) error {
+	if existing.Labels[Domain+"/component"] == component {
+		return nil
+	}
+
+	return status.Errorf(
+		codes.AlreadyExists,
+		"%s %s in namespace %s already exists but wasn't created by driver %s; if another driver instance created "+
+			"it, give the instances names with distinct first labels",
+		kind, existing.Name, existing.Namespace, Domain,
+	)
+}
+
+func errNoObjectsFound(resource string, labelSelector string) error {
+	return k8serrors.NewNotFound(schema.GroupResource{Resource: resource}, labelSelector)
+}
+
+func errMoreThanOneObjectFound(resource string, labelSelector string) error {
+	return status.Errorf(codes.Internal, "more than one object of %s matches \"%s\"", resource, labelSelector)
+}
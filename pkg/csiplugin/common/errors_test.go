@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestToGrpcError(t *testing.T) {
+	pvcs := schema.GroupResource{Resource: "persistentvolumeclaims"}
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode codes.Code
+	}{
+		{"status error", status.Error(codes.InvalidArgument, "bad"), codes.InvalidArgument},
+		{"canceled", context.Canceled, codes.Canceled},
+		{"wrapped deadline", fmt.Errorf("waiting: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{"not found", k8serrors.NewNotFound(pvcs, "pvc"), codes.NotFound},
+		{"no objects found", errNoObjectsFound("pods", "job-name=job"), codes.NotFound},
+		{"already exists", k8serrors.NewAlreadyExists(pvcs, "pvc"), codes.AlreadyExists},
+		{"conflict", k8serrors.NewConflict(pvcs, "pvc", errors.New("modified")), codes.Aborted},
+		{"too many requests", k8serrors.NewTooManyRequests("slow down", 1), codes.Unavailable},
+		{"server timeout", k8serrors.NewServerTimeout(pvcs, "get", 1), codes.Unavailable},
+		{"unreachable", &url.Error{Op: "Get", URL: "https://api", Err: errors.New("refused")}, codes.Unavailable},
+		{"forbidden", k8serrors.NewForbidden(pvcs, "pvc", errors.New("denied")), codes.Internal},
+		{"other", errors.New("failed"), codes.Internal},
+	}
+
+	for _, test := range tests {
+		err := ToGrpcError(test.err)
+
+		if code := status.Code(err); code != test.wantCode {
+			t.Errorf("%s: got code %v, want %v", test.name, code, test.wantCode)
+		}
+	}
+
+	if ToGrpcError(nil) != nil {
+		t.Errorf("nil error was converted to non-nil error")
+	}
+}
+
+func TestErrorWithReason(t *testing.T) {
+	err := ErrorWithReason(
+		codes.Aborted, ReasonVolumeBusy, map[string]string{"state": "cloning"}, "volume is being %s", "cloned",
+	)
+
+	if status.Code(err) != codes.Aborted || status.Convert(err).Message() != "volume is being cloned" {
+		t.Errorf("got %v", err)
+	}
+
+	info := ErrorInfoOf(ToGrpcError(err))
+	if info == nil || info.Reason != ReasonVolumeBusy || info.Domain != Domain || info.Metadata["state"] != "cloning" {
+		t.Errorf("got error info %v", info)
+	}
+
+	if info := ErrorInfoOf(busyStateError("staged")); info == nil || info.Reason != ReasonVolumeStaged {
+		t.Errorf("got error info %v for a staged volume", info)
+	}
+
+	if info := ErrorInfoOf(status.Error(codes.Internal, "oops")); info != nil {
+		t.Errorf("got error info %v for a status without details", info)
+	}
+	if info := ErrorInfoOf(errors.New("oops")); info != nil {
+		t.Errorf("got error info %v for a plain error", info)
+	}
+}
@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Reference to an object that events can be emitted on.
+type EventObject struct {
+	APIVersion string
+	Kind       string
+	Name       string
+	Namespace  string
+	UID        types.UID
+}
+
+func PvcEventObject(pvc *corev1.PersistentVolumeClaim) EventObject {
+	return EventObject{
+		APIVersion: "v1",
+		Kind:       "PersistentVolumeClaim",
+		Name:       pvc.Name,
+		Namespace:  pvc.Namespace,
+		UID:        pvc.UID,
+	}
+}
+
+func VolumeSnapshotEventObject(meta *metav1.ObjectMeta) EventObject {
+	return EventObject{
+		APIVersion: "snapshot.storage.k8s.io/v1",
+		Kind:       "VolumeSnapshot",
+		Name:       meta.Name,
+		Namespace:  meta.Namespace,
+		UID:        meta.UID,
+	}
+}
+
+// Emits a Kubernetes Event on the given object. eventType is corev1.EventTypeNormal or corev1.EventTypeWarning.
+func EmitEvent(
+	ctx context.Context,
+	clientset *Clientset,
+	object EventObject,
+	eventType string,
+	reason string,
+	messageFmt string,
+	args ...interface{},
+) error {
+	now := metav1.NewTime(time.Now())
+
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: object.Name + ".",
+			Namespace:    object.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: object.APIVersion,
+			Kind:       object.Kind,
+			Name:       object.Name,
+			Namespace:  object.Namespace,
+			UID:        object.UID,
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Source:         corev1.EventSource{Component: Domain},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	_, err := clientset.CoreV1().Events(object.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+// Like EmitEvent(), but emits the Event on the backing PVC with the given name and namespace, e.g., about the images in
+// it.
+func EmitBackingPvcEvent(
+	ctx context.Context,
+	clientset *Clientset,
+	backingPvcName string,
+	backingPvcNamespace string,
+	eventType string,
+	reason string,
+	messageFmt string,
+	args ...interface{},
+) error {
+	backingPvc, err := clientset.CoreV1().PersistentVolumeClaims(backingPvcNamespace).
+		Get(ctx, backingPvcName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	return EmitEvent(ctx, clientset, PvcEventObject(backingPvc), eventType, reason, messageFmt, args...)
+}
+
+// How many of the last lines of some logs LogExcerpt() keeps, and how long the excerpt may be at most.
+const (
+	logExcerptLines     = 5
+	logExcerptMaxLength = 512
+)
+
+// Returns the last few non-empty lines of the given logs, which usually say what went wrong, shortened to a length
+// that suits the message of an Event.
+func LogExcerpt(logs string) string {
+	var lines []string
+	for _, line := range strings.Split(logs, "\n") {
+		if line = strings.TrimRight(line, " \t\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > logExcerptLines {
+		lines = lines[len(lines)-logExcerptLines:]
+	}
+
+	excerpt := strings.Join(lines, "\n")
+	if len(excerpt) > logExcerptMaxLength {
+		start := len(excerpt) - logExcerptMaxLength + len("...")
+		for start < len(excerpt) && !utf8.RuneStart(excerpt[start]) {
+			start++
+		}
+		excerpt = "..." + excerpt[start:]
+	}
+	return excerpt
+}
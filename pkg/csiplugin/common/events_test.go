@@ -0,0 +1,32 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLogExcerpt(t *testing.T) {
+	tests := []struct {
+		logs string
+		want string
+	}{
+		{"", ""},
+		{"+ qemu-img create\nfailed\n", "+ qemu-img create\nfailed"},
+		{"1\n2\n\n3\n4\n5\n6\n  \n", "2\n3\n4\n5\n6"},
+	}
+
+	for _, test := range tests {
+		if got := LogExcerpt(test.logs); got != test.want {
+			t.Errorf("LogExcerpt(%q): got %q, want %q", test.logs, got, test.want)
+		}
+	}
+
+	// long lines are cut from the front, without splitting characters
+
+	got := LogExcerpt(strings.Repeat("é", 1000) + "\nthe end")
+	if len(got) > logExcerptMaxLength || !strings.HasPrefix(got, "...é") || !strings.HasSuffix(got, "\nthe end") {
+		t.Errorf("got %q", got)
+	}
+}
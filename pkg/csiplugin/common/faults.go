@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// Points at which faults can be injected, for testing how the plugins recover from failures and whether retried
+// operations are idempotent.
+const (
+	FaultJobCreation    = "job-creation"    // creating a Job
+	FaultMetadataUpdate = "metadata-update" // writing the labels, annotations, or finalizers of an object
+	FaultNbdAttach      = "nbd-attach"      // creating the ReplicaSet that attaches a volume to an NBD device
+)
+
+var faultPoints = []string{FaultJobCreation, FaultMetadataUpdate, FaultNbdAttach}
+
+// A fault to inject at a given point: delaying it, failing it, or both.
+type faultRule struct {
+	delay time.Duration
+
+	// whether to fail, and how many more times if failing only a given number of times (negative if always)
+	fail      bool
+	remaining int
+}
+
+// The faults to inject at each point. Only set on startup (see SetInjectedFaults()), and empty unless testing.
+var injectedFaults = map[string][]*faultRule{}
+
+// Serializes the counting of failures injected a given number of times.
+var injectedFaultsMutex sync.Mutex
+
+// Sets the faults to inject, given as comma-separated "<point>:<action>" rules, where <point> is one of the Fault*
+// constants and <action> is one of:
+//
+//   - "fail": fail every time;
+//   - "fail:<n>": fail the first n times, and then succeed;
+//   - "delay:<duration>": wait for the given duration every time, e.g., "delay:5s".
+//
+// Several rules may be given for the same point, e.g., "job-creation:delay:10s,job-creation:fail:2". Faults are
+// injected deterministically, so that tests can rely on them.
+func SetInjectedFaults(spec string) error {
+	faults := map[string][]*faultRule{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		if entry == "" {
+			continue
+		}
+
+		rule, point, err := parseFaultRule(entry)
+		if err != nil {
+			return err
+		}
+
+		faults[point] = append(faults[point], rule)
+	}
+
+	injectedFaults = faults
+	return nil
+}
+
+func parseFaultRule(entry string) (*faultRule, string, error) {
+	fields := strings.SplitN(entry, ":", 3)
+
+	if len(fields) < 2 || !containsString(faultPoints, fields[0]) {
+		return nil, "", fmt.Errorf(
+			"invalid fault \"%s\": must be \"<point>:<action>\", where <point> is one of %s",
+			entry, strings.Join(faultPoints, ", "),
+		)
+	}
+
+	switch {
+	case fields[1] == "fail" && len(fields) == 2:
+		return &faultRule{fail: true, remaining: -1}, fields[0], nil
+
+	case fields[1] == "fail":
+		count, err := strconv.Atoi(fields[2])
+		if err != nil || count < 1 {
+			return nil, "", fmt.Errorf("invalid fault \"%s\": number of failures must be a positive integer", entry)
+		}
+		return &faultRule{fail: true, remaining: count}, fields[0], nil
+
+	case fields[1] == "delay" && len(fields) == 3:
+		delay, err := time.ParseDuration(fields[2])
+		if err != nil || delay <= 0 {
+			return nil, "", fmt.Errorf("invalid fault \"%s\": delay must be a positive duration", entry)
+		}
+		return &faultRule{delay: delay}, fields[0], nil
+
+	default:
+		return nil, "", fmt.Errorf(
+			"invalid fault \"%s\": action must be \"fail\", \"fail:<n>\", or \"delay:<duration>\"", entry,
+		)
+	}
+}
+
+// Injects the faults set for the given point, if any: waits for the delays, and fails with codes.Unavailable, which
+// callers treat like any other transient failure, if a failure is due. Returns nil right away unless testing.
+func InjectFault(ctx context.Context, point string) error {
+	for _, rule := range injectedFaults[point] {
+		if rule.delay > 0 {
+			klog.InfoS("Injecting fault: delaying", "point", point, "delay", rule.delay)
+
+			select {
+			case <-time.After(rule.delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if rule.fail && rule.takeFailure() {
+			klog.InfoS("Injecting fault: failing", "point", point)
+			return status.Errorf(codes.Unavailable, "injected fault: %s failed", point)
+		}
+	}
+
+	return nil
+}
+
+// Whether the rule fails this time, counting the failure if it only fails a given number of times.
+func (r *faultRule) takeFailure() bool {
+	injectedFaultsMutex.Lock()
+	defer injectedFaultsMutex.Unlock()
+
+	switch {
+	case r.remaining < 0:
+		return true
+	case r.remaining > 0:
+		r.remaining--
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSetInjectedFaults(t *testing.T) {
+	t.Cleanup(func() { _ = SetInjectedFaults("") })
+
+	err := SetInjectedFaults("job-creation:fail,metadata-update:fail:2,nbd-attach:delay:5s,nbd-attach:fail:1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string][]faultRule{
+		FaultJobCreation:    {{fail: true, remaining: -1}},
+		FaultMetadataUpdate: {{fail: true, remaining: 2}},
+		FaultNbdAttach:      {{delay: 5 * time.Second}, {fail: true, remaining: 1}},
+	}
+	for point, wantRules := range want {
+		rules := injectedFaults[point]
+		if len(rules) != len(wantRules) {
+			t.Errorf("%s: got %d rules, want %d", point, len(rules), len(wantRules))
+			continue
+		}
+		for i := range rules {
+			if *rules[i] != wantRules[i] {
+				t.Errorf("%s: got rule %+v, want %+v", point, *rules[i], wantRules[i])
+			}
+		}
+	}
+
+	for _, spec := range []string{
+		"job-creation",
+		"volume-deletion:fail",
+		"job-creation:crash",
+		"job-creation:fail:0",
+		"job-creation:fail:many",
+		"job-creation:delay",
+		"job-creation:delay:soon",
+		"job-creation:delay:-1s",
+	} {
+		if err := SetInjectedFaults(spec); err == nil {
+			t.Errorf("%s: expected error", spec)
+		}
+	}
+}
+
+func TestInjectFault(t *testing.T) {
+	t.Cleanup(func() { _ = SetInjectedFaults("") })
+
+	ctx := context.Background()
+
+	if err := InjectFault(ctx, FaultJobCreation); err != nil {
+		t.Errorf("injected fault without any set: %v", err)
+	}
+
+	err := SetInjectedFaults("job-creation:fail:2,nbd-attach:delay:1ms")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, wantFailure := range []bool{true, true, false, false} {
+		err := InjectFault(ctx, FaultJobCreation)
+		if (err != nil) != wantFailure {
+			t.Errorf("call %d: got %v, want failure %v", i, err, wantFailure)
+		}
+		if err != nil && status.Code(err) != codes.Unavailable {
+			t.Errorf("call %d: got code %v, want %v", i, status.Code(err), codes.Unavailable)
+		}
+	}
+
+	if err := InjectFault(ctx, FaultNbdAttach); err != nil {
+		t.Errorf("delay failed: %v", err)
+	}
+	if err := InjectFault(ctx, FaultMetadataUpdate); err != nil {
+		t.Errorf("injected fault at a point without any set: %v", err)
+	}
+
+	err = SetInjectedFaults("nbd-attach:delay:1h")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := InjectFault(canceled, FaultNbdAttach); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,155 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The formats of volume images, as chosen by the "format" StorageClass parameter and recorded in the "format"
+// annotation of PVCs. Raw images keep the same file name as qcow2 images, so that everything that only moves or
+// removes images handles both alike, but are always opened with their format given explicitly, as probing the format
+// of an image whose contents the volume's user controls could make it be taken for a qcow2 image backed by any file.
+const (
+	ImageFormatQcow2 = "qcow2"
+	ImageFormatRaw   = "raw"
+)
+
+// Returns the format of the volume's image. Volumes created before formats could be chosen are qcow2.
+func VolumeImageFormatOf(meta *metav1.ObjectMeta) string {
+	if format := meta.Annotations[Domain+"/format"]; format != "" {
+		return format
+	}
+	return ImageFormatQcow2
+}
+
+// The operations that rely on qcow2 features such as backing files and persistent dirty bitmaps, and thus don't
+// support raw images, by the state they put the volume in.
+var qcow2OnlyOperations = map[string]string{
+	"cloning":      "cloned",
+	"snapshotting": "snapshotted",
+	"shrinking":    "shrunk",
+	"replicating":  "replicated",
+	"resyncing":    "replicated",
+	"migrating":    "migrated to another backing volume",
+	"relocating":   "relocated within their backing volume",
+	"exporting":    "exported",
+	"inspecting":   "inspected",
+}
+
+// Fails with codes.FailedPrecondition if the volume's image is raw and newState is that of an operation that only
+// supports qcow2 images.
+func CheckRawVolumeState(meta *metav1.ObjectMeta, newState string) error {
+	if VolumeImageFormatOf(meta) != ImageFormatRaw {
+		return nil
+	}
+	if operation, ok := qcow2OnlyOperations[newState]; ok {
+		return status.Errorf(codes.FailedPrecondition, "volumes with raw images can't be %s", operation)
+	}
+	return nil
+}
+
+// Lists the names of the raw images in a backing location, i.e., those of the volumes of PVCs and PVs whose format is
+// raw, for Jobs that go over the images there to open them as raw instead of probing their format (see
+// ImageFormatFunction).
+func ListRawImageNames(ctx context.Context, clientset *Clientset, location BackingLocation) ([]string, error) {
+	pvcs, err := clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: Domain + "/uid"})
+	if err != nil {
+		return nil, err
+	}
+
+	// PVs outlive their PVCs if their reclaim policy is Retain
+
+	pvs, err := clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return rawImageNamesIn(pvcs.Items, pvs.Items, location), nil
+}
+
+func rawImageNamesIn(
+	pvcs []corev1.PersistentVolumeClaim,
+	pvs []corev1.PersistentVolume,
+	location BackingLocation,
+) []string {
+	names := map[string]bool{}
+
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		if VolumeImageFormatOf(&pvc.ObjectMeta) == ImageFormatRaw && BackingLocationOf(&pvc.ObjectMeta) == location {
+			names[GenerateVolumeImageName(VolumeUidOf(pvc))] = true
+		}
+	}
+
+	for i := range pvs {
+		pv := &pvs[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != Domain {
+			continue
+		}
+		if pv.Spec.CSI.VolumeAttributes["format"] == ImageFormatRaw && pvLocationOf(pv) == location {
+			names[GenerateVolumeImageName(types.UID(pv.Spec.CSI.VolumeHandle))] = true
+		}
+	}
+
+	result := make([]string, 0, len(names))
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// The backing location of a PV's volume, which its annotations override if it was moved since the PV was created.
+func pvLocationOf(pv *corev1.PersistentVolume) BackingLocation {
+	if pv.Annotations[Domain+"/backing-pvc-name"] != "" {
+		return BackingLocationOf(&pv.ObjectMeta)
+	}
+
+	attributes := pv.Spec.CSI.VolumeAttributes
+	return BackingLocation{
+		PvcName:      attributes["backingPvcName"],
+		PvcNamespace: attributes["backingPvcNamespace"],
+		BasePath:     attributes["backingPvcBasePath"],
+	}
+}
+
+// The argument that passes the given raw image names to a script that starts with ImageFormatFunction.
+func RawImageNamesArg(names []string) string {
+	return strings.Join(names, "\n")
+}
+
+// A bash function for scripts of Jobs that go over the images in a backing location, which prints the format to open
+// the image with the given name in the current directory with: "raw" if it is one of the newline-separated names in
+// the raw_image_names variable, which the script sets from RawImageNamesArg(), or if it is the image of a raw volume in
+// the trash, as told by the metadata beside it, and "qcow2" otherwise. Raw images must never be opened without their
+// format, as probing it could take a forged qcow2 header written by the volume's user for real.
+//
+// Images of raw volumes whose PVC and PV are both gone, which are only left behind until their deletion finishes, are
+// still taken for qcow2 images. The has_qcow2_magic function tells whether opening them as such failed because they
+// aren't qcow2 images at all.
+const ImageFormatFunction = `
+has_qcow2_magic() {
+    [[ "$( head -c 4 "$1" | od -An -tx1 | tr -d ' \n' )" == 514649fb ]]
+}
+
+image_format() {
+    local metadata="${1%.qcow2}.json"
+    if grep -qFx -- "$1" <<< "${raw_image_names}" ||
+        [[ "$1" == trash-* && -f "${metadata}" &&
+            "$( jq -r '.volumeAttributes.format // ""' "${metadata}" 2> /dev/null )" == raw ]]; then
+        echo raw
+    else
+        echo qcow2
+    fi
+}
+`
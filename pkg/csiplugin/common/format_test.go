@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckRawVolumeState(t *testing.T) {
+	meta := func(format string) *metav1.ObjectMeta {
+		return &metav1.ObjectMeta{Annotations: map[string]string{Domain + "/format": format}}
+	}
+
+	tests := []struct {
+		format   string
+		newState string
+		wantCode codes.Code
+	}{
+		{ImageFormatRaw, "idle", codes.OK},
+		{ImageFormatRaw, "expanding", codes.OK},
+		{ImageFormatRaw, "snapshotting", codes.FailedPrecondition},
+		{ImageFormatRaw, "cloning", codes.FailedPrecondition},
+		{ImageFormatRaw, "migrating", codes.FailedPrecondition},
+		{ImageFormatQcow2, "snapshotting", codes.OK},
+		{"", "snapshotting", codes.OK},
+	}
+
+	for _, test := range tests {
+		err := CheckRawVolumeState(meta(test.format), test.newState)
+		if code := status.Code(err); code != test.wantCode {
+			t.Errorf("%s (format %q): got code %v, want %v", test.newState, test.format, code, test.wantCode)
+		}
+	}
+}
+
+func TestRawImageNamesIn(t *testing.T) {
+	location := BackingLocation{PvcName: "backing", PvcNamespace: "ns"}
+	other := BackingLocation{PvcName: "other", PvcNamespace: "ns"}
+
+	pvc := func(uid string, format string, location BackingLocation) corev1.PersistentVolumeClaim {
+		return corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{Domain + "/uid": uid},
+				Annotations: map[string]string{
+					Domain + "/format":                format,
+					Domain + "/backing-pvc-name":      location.PvcName,
+					Domain + "/backing-pvc-namespace": location.PvcNamespace,
+				},
+			},
+		}
+	}
+
+	pv := func(handle string, format string, location BackingLocation) corev1.PersistentVolume {
+		return corev1.PersistentVolume{
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{
+						Driver:       Domain,
+						VolumeHandle: handle,
+						VolumeAttributes: map[string]string{
+							"format":              format,
+							"backingPvcName":      location.PvcName,
+							"backingPvcNamespace": location.PvcNamespace,
+						},
+					},
+				},
+			},
+		}
+	}
+
+	pvcs := []corev1.PersistentVolumeClaim{
+		pvc("a", ImageFormatRaw, location),
+		pvc("b", ImageFormatQcow2, location),
+		pvc("c", ImageFormatRaw, other),
+	}
+	pvs := []corev1.PersistentVolume{
+		pv("a", ImageFormatRaw, location),
+		pv("d", ImageFormatRaw, location), // retained after its PVC was deleted
+		pv("e", "", location),
+	}
+
+	got := rawImageNamesIn(pvcs, pvs, location)
+	want := []string{"pvc-a.qcow2", "pvc-d.qcow2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestImageFormatFunction(t *testing.T) {
+	for _, tool := range []string{"bash", "jq", "od"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"pvc-raw.qcow2":       "QFI\xfb",
+		"pvc-qcow2.qcow2":     "QFI\xfb",
+		"trash-raw-1.qcow2":   "",
+		"trash-raw-1.json":    `{"volumeAttributes": {"format": "raw"}}`,
+		"trash-qcow2-1.qcow2": "",
+		"trash-qcow2-1.json":  `{"volumeAttributes": {}}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	script := ImageFormatFunction + `
+		raw_image_names="$1"
+		shift
+		for image in "$@"; do
+		    echo "${image} $( image_format "${image}" ) $( has_qcow2_magic "${image}" && echo magic || echo plain )"
+		done
+	`
+	images := []string{"pvc-raw.qcow2", "pvc-qcow2.qcow2", "trash-raw-1.qcow2", "trash-qcow2-1.qcow2"}
+	args := append([]string{"-c", script, "bash", RawImageNamesArg([]string{"pvc-raw.qcow2"})}, images...)
+	cmd := exec.Command("bash", args...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Split(strings.TrimSpace(string(output)), "\n")
+	want := []string{
+		"pvc-raw.qcow2 raw magic",
+		"pvc-qcow2.qcow2 qcow2 magic",
+		"trash-raw-1.qcow2 raw plain",
+		"trash-qcow2-1.qcow2 qcow2 plain",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var ImageCatalogResource = schema.GroupVersionResource{
+	Group:    Group,
+	Version:  "v1alpha1",
+	Resource: "imagecatalogs",
+}
+
+type ImageCatalogSpec struct {
+	Images []ImageCatalogImage `json:"images"`
+}
+
+// Exactly one of VolumeSnapshot, Qcow2File, Import, and HttpBackingFile must be set.
+type ImageCatalogImage struct {
+	Name            string                             `json:"name"`
+	VolumeSnapshot  *ImageCatalogVolumeSnapshotSource  `json:"volumeSnapshot,omitempty"`
+	Qcow2File       *ImageCatalogQcow2FileSource       `json:"qcow2File,omitempty"`
+	Import          *ImageCatalogImportSource          `json:"import,omitempty"`
+	HttpBackingFile *ImageCatalogHttpBackingFileSource `json:"httpBackingFile,omitempty"`
+}
+
+type ImageCatalogVolumeSnapshotSource struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// An existing qcow2 file in a backing volume that is adopted as a base image. It must be in the same backing volume as
+// the volumes created from it, which are backed by a read-only copy of it, so that the file itself may later be
+// modified or removed.
+type ImageCatalogQcow2FileSource struct {
+	BackingClaimName      string            `json:"backingClaimName"`
+	BackingClaimNamespace string            `json:"backingClaimNamespace"`
+	Path                  string            `json:"path"` // relative to the root of the backing volume
+	Size                  resource.Quantity `json:"size"` // virtual size of the image
+	Sha256                string            `json:"sha256,omitempty"`
+}
+
+// A disk image in any of the formats in ImportableImageFormats that is converted into each volume created from it.
+// Exactly one of URL and Path must be set.
+type ImageCatalogImportSource struct {
+	URL    string `json:"url,omitempty"`  // http:// or https:// URL
+	Path   string `json:"path,omitempty"` // relative to the base path of the volume being created
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// A disk image served over HTTPS that volumes created from it are backed by directly, through QEMU's curl block
+// driver, so that its data is only downloaded as it is read. The server must support range requests, and the image
+// must never change, as volumes read from it for as long as they are backed by it.
+//
+// If Pull is set, the image is also downloaded into the backing volume in the background, as a read-only qcow2 copy
+// named by GenerateHttpBackingCopyName(), which volumes are switched to the next time they are staged.
+type ImageCatalogHttpBackingFileSource struct {
+	URL    string            `json:"url"`              // https:// URL
+	Format string            `json:"format,omitempty"` // "qcow2" (the default) or "raw"
+	Size   resource.Quantity `json:"size"`             // virtual size of the image
+	Pull   bool              `json:"pull,omitempty"`
+}
+
+// Formats that image imports accept, as named by "qemu-img info".
+var ImportableImageFormats = []string{"raw", "qcow2", "vmdk", "vdi", "vhdx", "vpc"}
+
+var sha256Regexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Resolves a "<catalog>/<image>" reference to an image in a (cluster-scoped) ImageCatalog object.
+func ResolveCatalogImage(ctx context.Context, clientset *Clientset, ref string) (*ImageCatalogImage, error) {
+	catalogName, imageName, found := strings.Cut(ref, "/")
+	if !found || catalogName == "" || imageName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid image catalog reference \"%s\"", ref)
+	}
+
+	obj, err := clientset.Dynamic.Resource(ImageCatalogResource).Get(ctx, catalogName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, status.Errorf(codes.NotFound, "image catalog \"%s\" not found", catalogName)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var spec ImageCatalogSpec
+	rawSpec, _ := obj.Object["spec"].(map[string]interface{})
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(rawSpec, &spec)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "malformed image catalog \"%s\": %v", catalogName, err)
+	}
+
+	for i := range spec.Images {
+		image := &spec.Images[i]
+		if image.Name != imageName {
+			continue
+		}
+
+		sources := 0
+		for _, isSet := range []bool{
+			image.VolumeSnapshot != nil, image.Qcow2File != nil, image.Import != nil, image.HttpBackingFile != nil,
+		} {
+			if isSet {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"image \"%s\" in catalog \"%s\" must specify exactly one of volumeSnapshot, qcow2File, import, "+
+					"and httpBackingFile",
+				imageName, catalogName,
+			)
+		}
+
+		var sha256 *string
+		if image.Import != nil {
+			sha256 = &image.Import.Sha256
+		} else if image.Qcow2File != nil {
+			sha256 = &image.Qcow2File.Sha256
+		}
+		if sha256 != nil && *sha256 != "" {
+			*sha256 = strings.ToLower(*sha256)
+			if !sha256Regexp.MatchString(*sha256) {
+				return nil, status.Errorf(
+					codes.InvalidArgument, "image \"%s\" in catalog \"%s\" has a malformed sha256 checksum",
+					imageName, catalogName,
+				)
+			}
+		}
+
+		if image.Import != nil {
+			importSource := image.Import
+			if (importSource.URL == "") == (importSource.Path == "") {
+				return nil, status.Errorf(
+					codes.InvalidArgument,
+					"import of image \"%s\" in catalog \"%s\" must specify exactly one of url and path",
+					imageName, catalogName,
+				)
+			}
+			if importSource.URL != "" && !strings.HasPrefix(importSource.URL, "http://") &&
+				!strings.HasPrefix(importSource.URL, "https://") {
+				return nil, status.Errorf(
+					codes.InvalidArgument,
+					"import of image \"%s\" in catalog \"%s\" must use an http:// or https:// URL",
+					imageName, catalogName,
+				)
+			}
+		}
+
+		if httpSource := image.HttpBackingFile; httpSource != nil {
+			if !strings.HasPrefix(httpSource.URL, "https://") {
+				return nil, status.Errorf(
+					codes.InvalidArgument,
+					"HTTP backing file of image \"%s\" in catalog \"%s\" must use an https:// URL",
+					imageName, catalogName,
+				)
+			}
+			if httpSource.Format == "" {
+				httpSource.Format = "qcow2"
+			} else if httpSource.Format != "qcow2" && httpSource.Format != "raw" {
+				return nil, status.Errorf(
+					codes.InvalidArgument,
+					"HTTP backing file of image \"%s\" in catalog \"%s\" must have format qcow2 or raw",
+					imageName, catalogName,
+				)
+			}
+		}
+
+		return image, nil
+	}
+
+	return nil, status.Errorf(codes.NotFound, "image \"%s\" not found in catalog \"%s\"", imageName, catalogName)
+}
@@ -4,12 +4,15 @@ package common
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	"google.golang.org/grpc/codes"
 	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 type JobConfig struct {
@@ -21,83 +24,395 @@ type JobConfig struct {
 	Command []string
 	Args    []string
 
+	// The backing volume to mount. If BackingPvcName is empty, none is.
 	BackingPvcName     string
 	BackingPvcBasePath string
+
+	// Other PVCs to mount, which must be in the same namespace as the Job.
+	ExtraPvcMounts []PvcMount
+
+	// If set, the Job's pod runs on this node and the given host directories are mounted at the same paths.
+	NodeName       string
+	HostPathMounts []string
+
+	// How often the Job's pod is retried before the Job fails. If nil, the Job is retried (practically) forever.
+	BackoffLimit *int32
+
+	// The PVC or VolumeSnapshot the Job operates on, if any, whose labels and annotations are propagated to the Job
+	// and its pod as given by DefaultMetadataPropagation.
+	PropagateFrom *metav1.ObjectMeta
+
+	// Whether the Job does background maintenance, in which case its command runs with the lowest CPU and I/O
+	// priority (see maintenanceCommandPrefix).
+	Maintenance bool
+}
+
+// Constrains the nodes that Jobs run on, e.g., to those with fast paths to the backing volumes.
+type JobPlacement struct {
+	NodeSelector map[string]string
+	Affinity     *v1.Affinity
+}
+
+// Where Jobs that aren't bound to a specific node run. Set by the controller plugin on startup, before any Job is
+// created.
+var DefaultJobPlacement JobPlacement
+
+func (p JobPlacement) apply(podSpec *v1.PodSpec) {
+	podSpec.NodeSelector = p.NodeSelector
+	podSpec.Affinity = p.Affinity
+}
+
+type PvcMount struct {
+	PvcName   string
+	MountPath string
+	SubPath   string
 }
 
-// Idempotent. The backing volume is mounted at "/var/backing".
+// Idempotent. The backing volume, if any, is mounted at "/var/backing". Fails with codes.AlreadyExists if a Job with
+// the same name but another "component" label exists (see CheckNameCollision()).
 func CreateJob(ctx context.Context, clientset *Clientset, config JobConfig) error {
+	_, err := CreateJobIfMissing(ctx, clientset, config)
+	return err
+}
+
+// Like CreateJob(), but also returns whether this call created the Job rather than finding it in place, e.g., so that
+// an operation is only reported as started once when its request is retried.
+func CreateJobIfMissing(ctx context.Context, clientset *Clientset, config JobConfig) (bool, error) {
+	err := InjectFault(ctx, FaultJobCreation)
+	if err != nil {
+		return false, err
+	}
+
+	command := config.Command
+	if config.Maintenance && len(command) > 0 {
+		command = append(append([]string{}, maintenanceCommandPrefix...), command...)
+	}
+
 	podSpec := v1.PodSpec{
+		NodeName:      config.NodeName,
 		RestartPolicy: v1.RestartPolicyNever,
 		Containers: []v1.Container{
 			{
 				Name:    "container",
 				Image:   config.Image,
-				Command: config.Command,
+				Command: command,
 				Args:    config.Args,
-				VolumeMounts: []v1.VolumeMount{
-					{
-						Name:      "backing",
-						MountPath: "/var/backing",
-						SubPath:   config.BackingPvcBasePath,
-					},
-				},
 			},
 		},
-		Volumes: []v1.Volume{
-			{
-				Name: "backing",
-				VolumeSource: v1.VolumeSource{
-					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
-						ClaimName: config.BackingPvcName,
-					},
-				},
+	}
+
+	if config.BackingPvcName != "" {
+		podSpec.Containers[0].VolumeMounts = append(
+			podSpec.Containers[0].VolumeMounts,
+			v1.VolumeMount{Name: "backing", MountPath: "/var/backing", SubPath: config.BackingPvcBasePath},
+		)
+		podSpec.Volumes = append(podSpec.Volumes, v1.Volume{
+			Name: "backing",
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: config.BackingPvcName},
 			},
-		},
+		})
+	}
+
+	for i, mount := range config.ExtraPvcMounts {
+		volumeName := fmt.Sprintf("extra-%d", i)
+
+		podSpec.Containers[0].VolumeMounts = append(
+			podSpec.Containers[0].VolumeMounts,
+			v1.VolumeMount{Name: volumeName, MountPath: mount.MountPath, SubPath: mount.SubPath},
+		)
+		podSpec.Volumes = append(podSpec.Volumes, v1.Volume{
+			Name: volumeName,
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: mount.PvcName},
+			},
+		})
+	}
+
+	if config.NodeName == "" {
+		DefaultJobPlacement.apply(&podSpec)
+	}
+
+	hostPathType := v1.HostPathDirectory
+	for i, path := range config.HostPathMounts {
+		volumeName := fmt.Sprintf("host-%d", i)
+
+		podSpec.Containers[0].VolumeMounts = append(
+			podSpec.Containers[0].VolumeMounts,
+			v1.VolumeMount{Name: volumeName, MountPath: path},
+		)
+		podSpec.Volumes = append(podSpec.Volumes, v1.Volume{
+			Name: volumeName,
+			VolumeSource: v1.VolumeSource{
+				HostPath: &v1.HostPathVolumeSource{Path: path, Type: &hostPathType},
+			},
+		})
 	}
 
 	var backofflimit int32 = 99999
+	if config.BackoffLimit != nil {
+		backofflimit = *config.BackoffLimit
+	}
+	labels, annotations := DefaultMetadataPropagation.propagate(config.PropagateFrom, config.Labels, nil)
+	podLabels, podAnnotations := DefaultMetadataPropagation.propagate(config.PropagateFrom, nil, nil)
+
 	job := batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      config.Name,
-			Namespace: config.Namespace,
-			Labels:    config.Labels,
+			Name:        config.Name,
+			Namespace:   config.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
 		},
 		Spec: batchv1.JobSpec{
 			BackoffLimit: &backofflimit,
 			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      podLabels,
+					Annotations: podAnnotations,
+				},
 				Spec: podSpec,
 			},
 		},
 	}
 
-	_, err := clientset.BatchV1().Jobs(config.Namespace).Create(ctx, &job, metav1.CreateOptions{})
-	if err != nil && !k8serrors.IsAlreadyExists(err) {
-		return err
+	_, err = clientset.BatchV1().Jobs(config.Namespace).Create(ctx, &job, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		existing, err := clientset.BatchV1().Jobs(config.Namespace).Get(ctx, config.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return false, CheckNameCollision("Job", &existing.ObjectMeta, config.Labels[Domain+"/component"])
 	}
 
-	return nil
+	return err == nil, err
 }
 
+// How often the pods of a Job may fail before WaitForJobToSucceed() stops waiting for it. The Job itself keeps retrying
+// them, so that waiting for it again resumes where the failed wait left off.
+const jobPodFailuresBeforeGivingUp = 3
+
+// How often WaitForJobToSucceedWithin() checks whether the Job's pod can be scheduled.
+const jobSchedulabilityCheckInterval = 15 * time.Second
+
+// Waits for the Job to succeed. Fails with reason ReasonJobFailed if the Job fails, or if its pods failed
+// jobPodFailuresBeforeGivingUp times, in which case the error includes the logs of the Job's most recent failed pod.
+// The Job is left in place.
 func WaitForJobToSucceed(
 	ctx context.Context,
 	clientset *Clientset,
 	jobName string,
 	jobNamespace string,
 ) error {
-	// TODO: Watch instead of polling.
+	var outcome jobOutcome
+
+	err := watchObject(
+		ctx, clientset.BatchV1().RESTClient(), "jobs", jobNamespace, jobName, &batchv1.Job{},
+		func(object runtime.Object) (bool, error) {
+			if object == nil {
+				return false, k8serrors.NewNotFound(batchv1.Resource("jobs"), jobName)
+			}
+			outcome = evaluateJob(object.(*batchv1.Job), jobPodFailuresBeforeGivingUp)
+			return outcome.done, nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case outcome.failure != "":
+		return jobFailedError(clientset, codes.Internal, jobName, jobNamespace, "failed: "+outcome.failure)
+	case outcome.podFailures > 0:
+		return jobFailedError(
+			clientset, codes.Unavailable, jobName, jobNamespace,
+			fmt.Sprintf("is being retried after its pods failed %d times", outcome.podFailures),
+		)
+	default:
+		return nil
+	}
+}
+
+// What waiting for a Job has come to.
+type jobOutcome struct {
+	done        bool   // whether to stop waiting
+	failure     string // the message of the Job's failure, if it failed
+	podFailures int32  // the number of times its pods failed, if too many did while the Job is still being retried
+}
+
+// Evaluates the status of a Job that is being waited for. If maxPodFailures is positive, the wait is abandoned once
+// the Job's pods failed that many times.
+func evaluateJob(job *batchv1.Job, maxPodFailures int32) jobOutcome {
+	if job.Status.Succeeded > 0 {
+		return jobOutcome{done: true}
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == v1.ConditionTrue {
+			return jobOutcome{done: true, failure: condition.Message}
+		}
+	}
+
+	if maxPodFailures > 0 && job.Status.Failed >= maxPodFailures {
+		return jobOutcome{done: true, podFailures: job.Status.Failed}
+	}
+
+	return jobOutcome{}
+}
+
+// Returns an error with reason ReasonJobFailed saying that the Job failed as described, along with the logs of its
+// most recent failed pod, if any.
+func jobFailedError(
+	clientset *Clientset,
+	code codes.Code,
+	jobName string,
+	jobNamespace string,
+	description string,
+) error {
+	metadata := map[string]string{"jobName": jobName, "jobNamespace": jobNamespace}
+
+	logs, err := getJobPodLogs(context.Background(), clientset, jobName, jobNamespace, true)
+	if err != nil || len(logs) == 0 {
+		return ErrorWithReason(code, ReasonJobFailed, metadata, "job %s %s", jobName, description)
+	}
+	return ErrorWithReason(code, ReasonJobFailed, metadata, "job %s %s; its logs were:\n%s", jobName, description, logs)
+}
+
+// Like WaitForJobToSucceed, but fails if the Job doesn't succeed within the given time, if it fails, or if its pod
+// can't be scheduled for a while, e.g., because the node it is pinned to is gone. The error includes the logs of the
+// Job's most recent pod, if any, and has reason ReasonJobFailed or ReasonJobUnschedulable. The Job is left in place.
+func WaitForJobToSucceedWithin(
+	ctx context.Context,
+	clientset *Clientset,
+	jobName string,
+	jobNamespace string,
+	timeout time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	for {
-		job, err := clientset.BatchV1().Jobs(jobNamespace).Get(ctx, jobName, metav1.GetOptions{})
+		// watch the Job for a while, then check whether its pod is stuck
+
+		var outcome jobOutcome
+
+		watchCtx, cancelWatch := context.WithTimeout(ctx, jobSchedulabilityCheckInterval)
+		err := watchObject(
+			watchCtx, clientset.BatchV1().RESTClient(), "jobs", jobNamespace, jobName, &batchv1.Job{},
+			func(object runtime.Object) (bool, error) {
+				if object == nil {
+					return false, k8serrors.NewNotFound(batchv1.Resource("jobs"), jobName)
+				}
+				outcome = evaluateJob(object.(*batchv1.Job), 0)
+				return outcome.done, nil
+			},
+		)
+		cancelWatch()
+
+		if ctx.Err() == context.DeadlineExceeded {
+			return jobFailedError(
+				clientset, codes.Internal, jobName, jobNamespace, fmt.Sprintf("didn't succeed within %v", timeout),
+			)
+		} else if err == nil && outcome.failure != "" {
+			return jobFailedError(clientset, codes.Internal, jobName, jobNamespace, "failed: "+outcome.failure)
+		} else if err == nil {
+			return nil
+		} else if err != context.DeadlineExceeded {
+			return err
+		}
+
+		unschedulable, err := jobPodIsUnschedulable(ctx, clientset, jobName, jobNamespace)
 		if err != nil {
 			return err
+		} else if unschedulable {
+			return ErrorWithReason(
+				codes.Internal, ReasonJobUnschedulable,
+				map[string]string{"jobName": jobName, "jobNamespace": jobNamespace},
+				"the pod of job %s can't be scheduled", jobName,
+			)
 		}
+	}
+}
 
-		if job.Status.Succeeded > 0 {
-			return nil
+// Whether a pod of the Job has been unschedulable for over a minute.
+func jobPodIsUnschedulable(
+	ctx context.Context,
+	clientset *Clientset,
+	jobName string,
+	jobNamespace string,
+) (bool, error) {
+	pods, err := clientset.CoreV1().Pods(jobNamespace).
+		List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + jobName})
+	if err != nil {
+		return false, err
+	}
+
+	for _, pod := range pods.Items {
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodScheduled && condition.Status == v1.ConditionFalse &&
+				condition.Reason == v1.PodReasonUnschedulable &&
+				time.Since(condition.LastTransitionTime.Time) > time.Minute {
+				return true, nil
+			}
 		}
+	}
+
+	return false, nil
+}
 
-		time.Sleep(1 * time.Second)
+// Returns the logs of the Job's most recent pod.
+func GetJobLogs(
+	ctx context.Context,
+	clientset *Clientset,
+	jobName string,
+	jobNamespace string,
+) ([]byte, error) {
+	return getJobPodLogs(ctx, clientset, jobName, jobNamespace, false)
+}
+
+// Returns the logs of the Job's most recent pod or, if onlyFailed is true, of its most recent failed pod, falling back
+// to its most recent pod if none failed.
+func getJobPodLogs(
+	ctx context.Context,
+	clientset *Clientset,
+	jobName string,
+	jobNamespace string,
+	onlyFailed bool,
+) ([]byte, error) {
+	pods, err := clientset.CoreV1().Pods(jobNamespace).
+		List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + jobName})
+	if err != nil {
+		return nil, err
+	}
+
+	var latest, latestFailed *v1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if latest == nil || latest.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			latest = pod
+		}
+		if pod.Status.Phase == v1.PodFailed &&
+			(latestFailed == nil || latestFailed.CreationTimestamp.Before(&pod.CreationTimestamp)) {
+			latestFailed = pod
+		}
+	}
+	if onlyFailed && latestFailed != nil {
+		latest = latestFailed
+	}
+	if latest == nil {
+		return nil, errNoObjectsFound("pods", "job-name="+jobName)
+	}
+
+	return clientset.CoreV1().Pods(jobNamespace).GetLogs(latest.Name, &v1.PodLogOptions{}).DoRaw(ctx)
+}
+
+// Returns the end of the logs of the Job's most recent failed pod, or of its most recent pod if none failed, for
+// including in Events (see LogExcerpt()). Returns an empty string if there are no logs or they can't be retrieved.
+func JobLogExcerpt(ctx context.Context, clientset *Clientset, jobName string, jobNamespace string) string {
+	logs, err := getJobPodLogs(ctx, clientset, jobName, jobNamespace, true)
+	if err != nil {
+		return ""
 	}
+	return LogExcerpt(string(logs))
 }
 
 // Idempotent. Succeeds immediately if the object no longer exists.
@@ -111,19 +426,43 @@ func DeleteJobSynchronously(
 
 	propagationPolicy := metav1.DeletePropagationForeground
 	err := jobs.Delete(ctx, jobName, metav1.DeleteOptions{PropagationPolicy: &propagationPolicy})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-	// TODO: Watch instead of polling.
-	for {
-		if err != nil {
-			if k8serrors.IsNotFound(err) {
-				return nil
-			} else {
-				return err
-			}
-		}
+	// with foreground propagation, the Job only disappears once its pods are gone
 
-		time.Sleep(1 * time.Second)
+	return waitForObjectDeletion(ctx, clientset.BatchV1().RESTClient(), "jobs", jobNamespace, jobName, &batchv1.Job{})
+}
 
-		_, err = jobs.Get(ctx, jobName, metav1.GetOptions{})
+// Deletes the remaining pods of the Job with the given name, e.g., that deleting it orphaned, and waits until they are
+// gone.
+func DeleteJobPodsSynchronously(
+	ctx context.Context,
+	clientset *Clientset,
+	jobName string,
+	jobNamespace string,
+) error {
+	pods := clientset.CoreV1().Pods(jobNamespace)
+
+	list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + jobName})
+	if err != nil {
+		return err
 	}
+
+	for _, pod := range list.Items {
+		err := pods.Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+
+		err = waitForObjectDeletion(ctx, clientset.CoreV1().RESTClient(), "pods", jobNamespace, pod.Name, &v1.Pod{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
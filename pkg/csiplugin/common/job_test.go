@@ -0,0 +1,37 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestEvaluateJob(t *testing.T) {
+	failed := batchv1.JobCondition{Type: batchv1.JobFailed, Status: v1.ConditionTrue, Message: "backoff limit reached"}
+
+	tests := []struct {
+		name           string
+		status         batchv1.JobStatus
+		maxPodFailures int32
+		want           jobOutcome
+	}{
+		{"running", batchv1.JobStatus{Active: 1}, 3, jobOutcome{}},
+		{"succeeded", batchv1.JobStatus{Succeeded: 1, Failed: 5}, 3, jobOutcome{done: true}},
+		{
+			"failed", batchv1.JobStatus{Failed: 1, Conditions: []batchv1.JobCondition{failed}}, 3,
+			jobOutcome{done: true, failure: "backoff limit reached"},
+		},
+		{"retrying", batchv1.JobStatus{Active: 1, Failed: 2}, 3, jobOutcome{}},
+		{"retried too often", batchv1.JobStatus{Active: 1, Failed: 3}, 3, jobOutcome{done: true, podFailures: 3}},
+		{"retrying without limit", batchv1.JobStatus{Active: 1, Failed: 30}, 0, jobOutcome{}},
+	}
+
+	for _, test := range tests {
+		if got := evaluateJob(&batchv1.Job{Status: test.status}, test.maxPodFailures); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Whether the backing PVC is annotated as being under maintenance, and the reason given in the annotation, if any.
+// The annotation's value is "true" or a reason, and "false" or an empty value mean the PVC isn't under maintenance.
+func BackingPvcMaintenance(backingPvc *corev1.PersistentVolumeClaim) (underMaintenance bool, reason string) {
+	switch value := backingPvc.Annotations[Domain+"/maintenance"]; value {
+	case "", "false":
+		return false, ""
+	case "true":
+		return true, ""
+	default:
+		return true, value
+	}
+}
+
+// Returns an Unavailable error if the backing PVC is under maintenance, during which no volumes are created in it and
+// no Jobs that modify its contents are run, while volumes in it can still be staged. Succeeds if the backing PVC
+// doesn't exist, leaving it to the caller to fail for that reason.
+func CheckBackingPvcMaintenance(
+	ctx context.Context,
+	clientset *Clientset,
+	backingPvcName string,
+	backingPvcNamespace string,
+) error {
+	return checkBackingPvc(ctx, clientset, backingPvcName, backingPvcNamespace, false)
+}
+
+// The backing location that volumes are being migrated to off the given backing PVC, if its "drain-to" annotation names
+// another backing PVC (in the same namespace) to drain it to. The "drain-to-base-path" annotation gives the base path
+// within that PVC.
+func BackingPvcDrainTarget(backingPvc *corev1.PersistentVolumeClaim) (target BackingLocation, draining bool) {
+	name := backingPvc.Annotations[Domain+"/drain-to"]
+	if name == "" {
+		return BackingLocation{}, false
+	}
+
+	return BackingLocation{
+		PvcName:      name,
+		PvcNamespace: backingPvc.Namespace,
+		BasePath:     backingPvc.Annotations[Domain+"/drain-to-base-path"],
+	}, true
+}
+
+// Like CheckBackingPvcMaintenance, but also fails if the backing PVC is being drained, in which case no new volumes may
+// be placed in it either.
+func CheckBackingPvcAcceptsVolumes(
+	ctx context.Context,
+	clientset *Clientset,
+	backingPvcName string,
+	backingPvcNamespace string,
+) error {
+	return checkBackingPvc(ctx, clientset, backingPvcName, backingPvcNamespace, true)
+}
+
+func checkBackingPvc(
+	ctx context.Context,
+	clientset *Clientset,
+	backingPvcName string,
+	backingPvcNamespace string,
+	forNewVolumes bool,
+) error {
+	backingPvc, err := clientset.CoreV1().PersistentVolumeClaims(backingPvcNamespace).
+		Get(ctx, backingPvcName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	metadata := map[string]string{"backingPvcName": backingPvcName, "backingPvcNamespace": backingPvcNamespace}
+
+	if underMaintenance, reason := BackingPvcMaintenance(backingPvc); underMaintenance && reason == "" {
+		return ErrorWithReason(
+			codes.Unavailable, ReasonBackingStoreMaintenance, metadata,
+			"backing PVC %s in namespace %s is under maintenance", backingPvcName, backingPvcNamespace,
+		)
+	} else if underMaintenance {
+		return ErrorWithReason(
+			codes.Unavailable, ReasonBackingStoreMaintenance, metadata,
+			"backing PVC %s in namespace %s is under maintenance: %s", backingPvcName, backingPvcNamespace, reason,
+		)
+	}
+
+	if target, draining := BackingPvcDrainTarget(backingPvc); forNewVolumes && draining {
+		metadata["targetPvcName"] = target.PvcName
+		return ErrorWithReason(
+			codes.Unavailable, ReasonBackingStoreDraining, metadata,
+			"backing PVC %s in namespace %s is being drained to backing PVC %s",
+			backingPvcName, backingPvcNamespace, target.PvcName,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBackingPvcMaintenance(t *testing.T) {
+	tests := []struct {
+		annotations          map[string]string
+		wantUnderMaintenance bool
+		wantReason           string
+	}{
+		{nil, false, ""},
+		{map[string]string{Domain + "/maintenance": ""}, false, ""},
+		{map[string]string{Domain + "/maintenance": "false"}, false, ""},
+		{map[string]string{Domain + "/maintenance": "true"}, true, ""},
+		{map[string]string{Domain + "/maintenance": "migrating to new array"}, true, "migrating to new array"},
+	}
+
+	for _, test := range tests {
+		pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations}}
+
+		underMaintenance, reason := BackingPvcMaintenance(pvc)
+		if underMaintenance != test.wantUnderMaintenance || reason != test.wantReason {
+			t.Errorf(
+				"%v: got (%v, \"%s\"), want (%v, \"%s\")",
+				test.annotations, underMaintenance, reason, test.wantUnderMaintenance, test.wantReason,
+			)
+		}
+	}
+}
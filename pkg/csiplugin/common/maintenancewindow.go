@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maintenance Jobs, e.g., purging the trash, collecting orphaned images, and collecting garbage, run with the lowest
+// CPU and I/O priority, so that they don't compete with the I/O of staged volumes on the nodes they run on. The I/O
+// priority only has an effect with I/O schedulers that honor it, like BFQ.
+var maintenanceCommandPrefix = []string{"ionice", "--class", "idle", "nice", "--adjustment=19"}
+
+// The times at which maintenance may start, or nil if at any time. Only set on startup (see SetMaintenanceWindow()).
+var maintenanceWindow *MaintenanceWindow
+
+// A cron-style schedule of the times at which maintenance may start, in UTC.
+type MaintenanceWindow struct {
+	minutes     uint64
+	hours       uint64
+	daysOfMonth uint64
+	months      uint64
+	daysOfWeek  uint64
+
+	// whether the day of the month or the day of the week is "*", as when neither is, a day matches if either does
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+// The fields of a schedule, in order, and the values that each may take.
+var maintenanceWindowFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // both 0 and 7 are Sunday
+}
+
+// Parses a schedule with the five fields of a crontab entry: minute, hour, day of the month, month, and day of the
+// week. Each field is "*" or a comma-separated list of values and ranges, each optionally followed by "/<step>", e.g.,
+// "* 0-5 * * 1-5" for every minute from 0:00 to 5:59 on weekdays. Names of months and days aren't supported.
+func ParseMaintenanceWindow(spec string) (*MaintenanceWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(maintenanceWindowFields) {
+		return nil, fmt.Errorf(
+			"invalid maintenance window \"%s\": must have 5 fields (minute, hour, day of month, month, day of week)",
+			spec,
+		)
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseMaintenanceWindowField(
+			field, maintenanceWindowFields[i].min, maintenanceWindowFields[i].max,
+		)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"invalid maintenance window \"%s\": %s: %w", spec, maintenanceWindowFields[i].name, err,
+			)
+		}
+	}
+
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1 << 0
+	}
+
+	return &MaintenanceWindow{
+		minutes:       bits[0],
+		hours:         bits[1],
+		daysOfMonth:   bits[2],
+		months:        bits[3],
+		daysOfWeek:    bits[4],
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}, nil
+}
+
+// Returns the values matched by a field as a bit set.
+func parseMaintenanceWindowField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+
+	for _, item := range strings.Split(field, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(item, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepSpec)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step \"%s\"", stepSpec)
+			}
+		}
+
+		first, last := min, max
+		if rangeSpec != "*" {
+			firstSpec, lastSpec, isRange := strings.Cut(rangeSpec, "-")
+
+			var err error
+			first, err = parseMaintenanceWindowValue(firstSpec, min, max)
+			if err != nil {
+				return 0, err
+			}
+
+			last = first
+			if isRange {
+				last, err = parseMaintenanceWindowValue(lastSpec, min, max)
+				if err != nil {
+					return 0, err
+				}
+				if last < first {
+					return 0, fmt.Errorf("invalid range \"%s\"", rangeSpec)
+				}
+			} else if hasStep {
+				last = max // as in crontab, "<first>/<step>" runs from first to the end of the range
+			}
+		}
+
+		for value := first; value <= last; value += step {
+			bits |= 1 << value
+		}
+	}
+
+	return bits, nil
+}
+
+func parseMaintenanceWindowValue(spec string, min int, max int) (int, error) {
+	value, err := strconv.Atoi(spec)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("invalid value \"%s\", must be between %d and %d", spec, min, max)
+	}
+	return value, nil
+}
+
+// Whether maintenance may start at the given time.
+func (w *MaintenanceWindow) Contains(t time.Time) bool {
+	t = t.UTC()
+
+	matchesDayOfMonth := w.daysOfMonth&(1<<t.Day()) != 0
+	matchesDayOfWeek := w.daysOfWeek&(1<<t.Weekday()) != 0
+
+	var matchesDay bool
+	switch {
+	case w.anyDayOfMonth:
+		matchesDay = matchesDayOfWeek
+	case w.anyDayOfWeek:
+		matchesDay = matchesDayOfMonth
+	default:
+		matchesDay = matchesDayOfMonth || matchesDayOfWeek
+	}
+
+	return matchesDay &&
+		w.minutes&(1<<t.Minute()) != 0 &&
+		w.hours&(1<<t.Hour()) != 0 &&
+		w.months&(1<<t.Month()) != 0
+}
+
+// Sets the times at which maintenance may start, given as a schedule as accepted by ParseMaintenanceWindow(). An empty
+// schedule lets maintenance start at any time.
+func SetMaintenanceWindow(spec string) error {
+	if spec == "" {
+		maintenanceWindow = nil
+		return nil
+	}
+
+	window, err := ParseMaintenanceWindow(spec)
+	if err != nil {
+		return err
+	}
+
+	maintenanceWindow = window
+	return nil
+}
+
+// Whether maintenance may start at the given time, as per the maintenance window, if any.
+func InMaintenanceWindow(t time.Time) bool {
+	return maintenanceWindow == nil || maintenanceWindow.Contains(t)
+}
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowContains(t *testing.T) {
+	// 2023-03-06 is a Monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2023, time.March, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	for _, tc := range []struct {
+		spec string
+		time time.Time
+		want bool
+	}{
+		{"* * * * *", at(6, 12, 34), true},
+		{"* 0-5 * * *", at(6, 0, 0), true},
+		{"* 0-5 * * *", at(6, 5, 59), true},
+		{"* 0-5 * * *", at(6, 6, 0), false},
+		{"* 22,23,0-3 * * *", at(6, 23, 30), true},
+		{"* 22,23,0-3 * * *", at(6, 12, 0), false},
+		{"*/15 * * * *", at(6, 12, 45), true},
+		{"*/15 * * * *", at(6, 12, 46), false},
+		{"10/20 * * * *", at(6, 12, 50), true},
+		{"10/20 * * * *", at(6, 12, 0), false},
+		{"* * * * 1-5", at(6, 12, 0), true},
+		{"* * * * 1-5", at(5, 12, 0), false},
+		{"* * * * 7", at(5, 12, 0), true},
+		{"* * * * 0", at(5, 12, 0), true},
+		{"* * * 4 *", at(6, 12, 0), false},
+		{"* * 1 * 1", at(6, 12, 0), true}, // either day field matches
+		{"* * 1 * 2", at(6, 12, 0), false},
+		{"* 2 * * *", time.Date(2023, time.March, 6, 3, 0, 0, 0, time.FixedZone("CET", 3600)), true},
+	} {
+		window, err := ParseMaintenanceWindow(tc.spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.spec, err)
+			continue
+		}
+
+		if got := window.Contains(tc.time); got != tc.want {
+			t.Errorf("%s: Contains(%v) = %v, want %v", tc.spec, tc.time, got, tc.want)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"* 5-1 * * *",
+		"*/0 * * * *",
+		"* * * jan *",
+		"* -1 * * *",
+	} {
+		if _, err := ParseMaintenanceWindow(spec); err == nil {
+			t.Errorf("%s: expected error", spec)
+		}
+	}
+}
+
+func TestInMaintenanceWindow(t *testing.T) {
+	t.Cleanup(func() { _ = SetMaintenanceWindow("") })
+
+	now := time.Date(2023, time.March, 6, 12, 0, 0, 0, time.UTC)
+
+	if !InMaintenanceWindow(now) {
+		t.Errorf("expected maintenance to be allowed at any time without a window")
+	}
+
+	if err := SetMaintenanceWindow("* 0-5 * * *"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if InMaintenanceWindow(now) {
+		t.Errorf("expected maintenance to be disallowed outside of the window")
+	}
+	if !InMaintenanceWindow(now.Add(-8 * time.Hour)) {
+		t.Errorf("expected maintenance to be allowed within the window")
+	}
+}
@@ -0,0 +1,579 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// The field manager that the API server attributes requests that don't name one to, which it derives from the
+// client's user agent, i.e., the name of the plugin binary. This includes all writes of plugin versions prior to the
+// use of server-side apply, and object creations.
+const defaultFieldManager = "csi-plugin"
+
+// Returns the name of the field manager that the plugin writes the metadata (labels, annotations, and finalizers) of
+// objects as. Instances with different driver names use different field managers.
+func FieldManager() string {
+	return Domain
+}
+
+// Sets the given labels and annotations on a PVC, and adds the given finalizers to it (see updateMetadata).
+func ApplyPvcMetadata(
+	ctx context.Context,
+	clientset *Clientset,
+	pvcName string,
+	pvcNamespace string,
+	metadata metav1.ObjectMeta,
+) error {
+	return updateMetadata(ctx, pvcMetadataClient(clientset, pvcNamespace), pvcName, false, mergeMetadata(metadata))
+}
+
+// Lets mutate change the labels, annotations, and finalizers of a PVC, and writes the changes unless the PVC was
+// changed in the meantime, in which case this is retried with a fresh copy of the PVC (see updateMetadata).
+func UpdatePvcMetadata(
+	ctx context.Context,
+	clientset *Clientset,
+	pvcName string,
+	pvcNamespace string,
+	mutate func(pvc *corev1.PersistentVolumeClaim) error,
+) error {
+	return updateMetadata(
+		ctx, pvcMetadataClient(clientset, pvcNamespace), pvcName, true,
+		func(obj metav1.Object) error { return mutate(obj.(*corev1.PersistentVolumeClaim)) },
+	)
+}
+
+// Like ApplyPvcMetadata, but for PVs.
+func ApplyPvMetadata(ctx context.Context, clientset *Clientset, pvName string, metadata metav1.ObjectMeta) error {
+	return updateMetadata(ctx, pvMetadataClient(clientset), pvName, false, mergeMetadata(metadata))
+}
+
+// Like ApplyPvcMetadata, but for VolumeSnapshots.
+func ApplyVolumeSnapshotMetadata(
+	ctx context.Context,
+	clientset *Clientset,
+	volumeSnapshotName string,
+	volumeSnapshotNamespace string,
+	metadata metav1.ObjectMeta,
+) error {
+	return updateMetadata(
+		ctx, volumeSnapshotMetadataClient(clientset, volumeSnapshotNamespace), volumeSnapshotName, false,
+		mergeMetadata(metadata),
+	)
+}
+
+// Like UpdatePvcMetadata, but for VolumeSnapshots.
+func UpdateVolumeSnapshotMetadata(
+	ctx context.Context,
+	clientset *Clientset,
+	volumeSnapshotName string,
+	volumeSnapshotNamespace string,
+	mutate func(volumeSnapshot *volumesnapshotv1.VolumeSnapshot) error,
+) error {
+	return updateMetadata(
+		ctx, volumeSnapshotMetadataClient(clientset, volumeSnapshotNamespace), volumeSnapshotName, true,
+		func(obj metav1.Object) error { return mutate(obj.(*volumesnapshotv1.VolumeSnapshot)) },
+	)
+}
+
+func mergeMetadata(metadata metav1.ObjectMeta) func(obj metav1.Object) error {
+	return func(obj metav1.Object) error {
+		if len(metadata.Labels) > 0 {
+			labels := obj.GetLabels()
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			for key, value := range metadata.Labels {
+				labels[key] = value
+			}
+			obj.SetLabels(labels)
+		}
+
+		if len(metadata.Annotations) > 0 {
+			annotations := obj.GetAnnotations()
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			for key, value := range metadata.Annotations {
+				annotations[key] = value
+			}
+			obj.SetAnnotations(annotations)
+		}
+
+		for _, finalizer := range metadata.Finalizers {
+			if !containsString(obj.GetFinalizers(), finalizer) {
+				obj.SetFinalizers(append(obj.GetFinalizers(), finalizer))
+			}
+		}
+
+		return nil
+	}
+}
+
+// Gets and writes the metadata of objects of one kind.
+type metadataClient struct {
+	apiVersion string
+	kind       string
+	get        func(ctx context.Context, name string) (metav1.Object, error)
+	patch      func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) error
+}
+
+func pvcMetadataClient(clientset *Clientset, namespace string) metadataClient {
+	pvcs := clientset.CoreV1().PersistentVolumeClaims(namespace)
+	return metadataClient{
+		apiVersion: "v1",
+		kind:       "PersistentVolumeClaim",
+		get: func(ctx context.Context, name string) (metav1.Object, error) {
+			return pvcs.Get(ctx, name, metav1.GetOptions{})
+		},
+		patch: func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) error {
+			_, err := pvcs.Patch(ctx, name, pt, data, opts)
+			return err
+		},
+	}
+}
+
+func pvMetadataClient(clientset *Clientset) metadataClient {
+	pvs := clientset.CoreV1().PersistentVolumes()
+	return metadataClient{
+		apiVersion: "v1",
+		kind:       "PersistentVolume",
+		get: func(ctx context.Context, name string) (metav1.Object, error) {
+			return pvs.Get(ctx, name, metav1.GetOptions{})
+		},
+		patch: func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) error {
+			_, err := pvs.Patch(ctx, name, pt, data, opts)
+			return err
+		},
+	}
+}
+
+func volumeSnapshotMetadataClient(clientset *Clientset, namespace string) metadataClient {
+	volumeSnapshots := clientset.SnapshotV1().VolumeSnapshots(namespace)
+	return metadataClient{
+		apiVersion: "snapshot.storage.k8s.io/v1",
+		kind:       "VolumeSnapshot",
+		get: func(ctx context.Context, name string) (metav1.Object, error) {
+			return volumeSnapshots.Get(ctx, name, metav1.GetOptions{})
+		},
+		patch: func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) error {
+			_, err := volumeSnapshots.Patch(ctx, name, pt, data, opts)
+			return err
+		},
+	}
+}
+
+// Gets an object, lets mutate change its labels, annotations, and finalizers, and writes the changes with a single
+// request, as FieldManager(). If exclusive is true, the request fails if the object was changed since it was read, in
+// which case this is retried with a fresh copy of the object.
+//
+// Changes are written with a server-side apply request that includes the metadata that the plugin already applied,
+// which would otherwise be removed. Conflicts with other field managers aren't forced, so that the plugin doesn't
+// clobber metadata that others took over, and instead fail with codes.FailedPrecondition. Metadata written by requests
+// that don't name a field manager is taken over, though, as it was written by the plugin itself. Since leaving a field
+// out of an apply request only removes it if no other field manager owns it, removing metadata that others own too,
+// e.g., a finalizer that was added along with the object, is done with a JSON patch instead.
+func updateMetadata(
+	ctx context.Context,
+	client metadataClient,
+	name string,
+	exclusive bool,
+	mutate func(obj metav1.Object) error,
+) error {
+	return retry.OnError(retry.DefaultRetry, isRetriableConflict, func() error {
+		obj, err := client.get(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		before := metadataOf(obj)
+		finalizersBefore := append([]string(nil), obj.GetFinalizers()...)
+
+		err = mutate(obj)
+		if err != nil {
+			return err
+		}
+
+		after := metadataOf(obj)
+		changed, removed := diffMetadata(before, after)
+		if len(changed) == 0 && len(removed) == 0 {
+			return nil
+		}
+
+		owners, err := metadataOwners(obj.GetManagedFields())
+		if err != nil {
+			return err
+		}
+
+		var resourceVersion string
+		if exclusive {
+			resourceVersion = obj.GetResourceVersion()
+		}
+
+		options := metav1.PatchOptions{FieldManager: FieldManager()}
+		var patchType types.PatchType
+		var data []byte
+
+		if removedFieldsAreShared(owners, removed) {
+			patchType = types.JSONPatchType
+			data, err = metadataJsonPatch(before, after, finalizersBefore, changed, removed, resourceVersion)
+		} else {
+			force := forceApply(owners, changed)
+			options.Force = &force
+			patchType = types.ApplyPatchType
+			data, err = metadataApplyPatch(
+				client.apiVersion, client.kind, obj.GetName(), obj.GetNamespace(), resourceVersion,
+				appliedMetadata(owners, after, changed),
+			)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = InjectFault(ctx, FaultMetadataUpdate)
+		if err != nil {
+			return err
+		}
+
+		err = client.patch(ctx, name, patchType, data, options)
+		if isFieldManagerConflict(err) {
+			return status.Errorf(
+				codes.FailedPrecondition, "metadata of %s %s that the plugin manages was changed by others: %v",
+				client.kind, name, err,
+			)
+		}
+		return err
+	})
+}
+
+// A label, annotation, or finalizer of an object.
+type metadataField struct {
+	kind string // "labels", "annotations", or "finalizers"
+	key  string // the label or annotation key, or the finalizer itself
+}
+
+func (f metadataField) less(other metadataField) bool {
+	return f.kind < other.kind || f.kind == other.kind && f.key < other.key
+}
+
+// Returns the labels, annotations, and finalizers of an object, the latter with empty values.
+func metadataOf(obj metav1.Object) map[metadataField]string {
+	fields := map[metadataField]string{}
+	for key, value := range obj.GetLabels() {
+		fields[metadataField{"labels", key}] = value
+	}
+	for key, value := range obj.GetAnnotations() {
+		fields[metadataField{"annotations", key}] = value
+	}
+	for _, finalizer := range obj.GetFinalizers() {
+		fields[metadataField{"finalizers", finalizer}] = ""
+	}
+	return fields
+}
+
+// Returns the fields that were added or changed, and those that were removed, in order.
+func diffMetadata(before map[metadataField]string, after map[metadataField]string) (changed, removed []metadataField) {
+	for field, value := range after {
+		if oldValue, ok := before[field]; !ok || oldValue != value {
+			changed = append(changed, field)
+		}
+	}
+	for field := range before {
+		if _, ok := after[field]; !ok {
+			removed = append(removed, field)
+		}
+	}
+
+	sort.Slice(changed, func(i, j int) bool { return changed[i].less(changed[j]) })
+	sort.Slice(removed, func(i, j int) bool { return removed[i].less(removed[j]) })
+	return changed, removed
+}
+
+// Who owns a metadata field, according to the managed fields of its object.
+type fieldOwners struct {
+	applied bool     // the plugin, through server-side apply
+	plugin  bool     // the plugin, through other requests
+	others  []string // other field managers
+}
+
+// Returns the owners of the labels, annotations, and finalizers of an object.
+func metadataOwners(entries []metav1.ManagedFieldsEntry) (map[metadataField]*fieldOwners, error) {
+	owners := map[metadataField]*fieldOwners{}
+
+	for _, entry := range entries {
+		if entry.Subresource != "" || entry.FieldsV1 == nil {
+			continue
+		}
+
+		var fieldSet struct {
+			Metadata struct {
+				Labels      map[string]json.RawMessage `json:"f:labels"`
+				Annotations map[string]json.RawMessage `json:"f:annotations"`
+				Finalizers  map[string]json.RawMessage `json:"f:finalizers"`
+			} `json:"f:metadata"`
+		}
+		err := json.Unmarshal(entry.FieldsV1.Raw, &fieldSet)
+		if err != nil {
+			return nil, err
+		}
+
+		var fields []metadataField
+		for key := range fieldSet.Metadata.Labels {
+			if label, ok := cutPrefix(key, "f:"); ok {
+				fields = append(fields, metadataField{"labels", label})
+			}
+		}
+		for key := range fieldSet.Metadata.Annotations {
+			if annotation, ok := cutPrefix(key, "f:"); ok {
+				fields = append(fields, metadataField{"annotations", annotation})
+			}
+		}
+		for key := range fieldSet.Metadata.Finalizers {
+			var finalizer string
+			if value, ok := cutPrefix(key, "v:"); ok && json.Unmarshal([]byte(value), &finalizer) == nil {
+				fields = append(fields, metadataField{"finalizers", finalizer})
+			}
+		}
+
+		for _, field := range fields {
+			if owners[field] == nil {
+				owners[field] = &fieldOwners{}
+			}
+
+			switch {
+			case entry.Manager == FieldManager() && entry.Operation == metav1.ManagedFieldsOperationApply:
+				owners[field].applied = true
+			case entry.Manager == FieldManager() || entry.Manager == defaultFieldManager:
+				owners[field].plugin = true
+			default:
+				owners[field].others = append(owners[field].others, entry.Manager)
+			}
+		}
+	}
+
+	return owners, nil
+}
+
+func cutPrefix(s string, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// Returns whether some of the removed fields are owned by anyone other than the plugin through server-side apply, and
+// thus wouldn't be removed by an apply request.
+func removedFieldsAreShared(owners map[metadataField]*fieldOwners, removed []metadataField) bool {
+	for _, field := range removed {
+		if o := owners[field]; o != nil && (o.plugin || len(o.others) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether applying the changed fields must take them over from requests of the plugin that don't use
+// server-side apply, which would otherwise conflict. Conflicts with other field managers are never forced.
+func forceApply(owners map[metadataField]*fieldOwners, changed []metadataField) bool {
+	force := false
+	for _, field := range changed {
+		if o := owners[field]; o != nil {
+			if len(o.others) > 0 {
+				return false
+			}
+			force = force || o.plugin
+		}
+	}
+	return force
+}
+
+// Returns the metadata to apply, i.e., the changed fields and those that the plugin already applied and still exist.
+func appliedMetadata(
+	owners map[metadataField]*fieldOwners,
+	after map[metadataField]string,
+	changed []metadataField,
+) map[metadataField]string {
+	applied := map[metadataField]string{}
+	for field, o := range owners {
+		if value, ok := after[field]; ok && o.applied {
+			applied[field] = value
+		}
+	}
+	for _, field := range changed {
+		applied[field] = after[field]
+	}
+	return applied
+}
+
+// Returns a server-side apply patch that sets the given metadata on an object. If resourceVersion isn't empty, the
+// patch only applies to that version of the object.
+func metadataApplyPatch(
+	apiVersion string,
+	kind string,
+	name string,
+	namespace string,
+	resourceVersion string,
+	applied map[metadataField]string,
+) ([]byte, error) {
+	metadata := map[string]interface{}{"name": name}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	if resourceVersion != "" {
+		metadata["resourceVersion"] = resourceVersion
+	}
+
+	labels := map[string]string{}
+	annotations := map[string]string{}
+	var finalizers []string
+
+	for field, value := range applied {
+		switch field.kind {
+		case "labels":
+			labels[field.key] = value
+		case "annotations":
+			annotations[field.key] = value
+		case "finalizers":
+			finalizers = append(finalizers, field.key)
+		}
+	}
+	sort.Strings(finalizers)
+
+	if len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	if len(finalizers) > 0 {
+		metadata["finalizers"] = finalizers
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata":   metadata,
+	})
+}
+
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Returns a JSON patch that turns the metadata before into the metadata after, first testing that the removed fields
+// still have the values in before. If resourceVersion isn't empty, the patch only applies to that version of the
+// object.
+func metadataJsonPatch(
+	before map[metadataField]string,
+	after map[metadataField]string,
+	finalizersBefore []string,
+	changed []metadataField,
+	removed []metadataField,
+	resourceVersion string,
+) ([]byte, error) {
+	var operations []jsonPatchOperation
+
+	if resourceVersion != "" {
+		operations = append(operations, jsonPatchOperation{
+			Op: "test", Path: "/metadata/resourceVersion", Value: resourceVersion,
+		})
+	}
+
+	// remove finalizers back to front, so that the indices of those still to be removed don't change
+	for i := len(finalizersBefore) - 1; i >= 0; i-- {
+		if _, ok := after[metadataField{"finalizers", finalizersBefore[i]}]; !ok {
+			path := "/metadata/finalizers/" + strconv.Itoa(i)
+			operations = append(
+				operations,
+				jsonPatchOperation{Op: "test", Path: path, Value: finalizersBefore[i]},
+				jsonPatchOperation{Op: "remove", Path: path},
+			)
+		}
+	}
+
+	for _, field := range removed {
+		if field.kind != "finalizers" {
+			path := metadataFieldPath(field)
+			operations = append(
+				operations,
+				jsonPatchOperation{Op: "test", Path: path, Value: before[field]},
+				jsonPatchOperation{Op: "remove", Path: path},
+			)
+		}
+	}
+
+	created := map[string]bool{}
+	for field := range before {
+		created[field.kind] = true
+	}
+
+	for _, field := range changed {
+		if !created[field.kind] {
+			var empty interface{} = map[string]string{}
+			if field.kind == "finalizers" {
+				empty = []string{}
+			}
+			operations = append(
+				operations, jsonPatchOperation{Op: "add", Path: "/metadata/" + field.kind, Value: empty},
+			)
+			created[field.kind] = true
+		}
+
+		var value interface{} = after[field]
+		path := metadataFieldPath(field)
+		if field.kind == "finalizers" {
+			value, path = field.key, "/metadata/finalizers/-"
+		}
+		operations = append(operations, jsonPatchOperation{Op: "add", Path: path, Value: value})
+	}
+
+	return json.Marshal(operations)
+}
+
+func metadataFieldPath(field metadataField) string {
+	return "/metadata/" + field.kind + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(field.key)
+}
+
+// Returns whether err is a conflict that retrying with a fresh copy of the object may resolve, i.e., the object was
+// changed since it was read, which fails JSON patches with a "test" operation as invalid.
+func isRetriableConflict(err error) bool {
+	return k8serrors.IsConflict(err) && !isFieldManagerConflict(err) || k8serrors.IsInvalid(err)
+}
+
+func isFieldManagerConflict(err error) bool {
+	var apiStatus k8serrors.APIStatus
+	if !errors.As(err, &apiStatus) || apiStatus.Status().Details == nil {
+		return false
+	}
+	for _, cause := range apiStatus.Status().Details.Causes {
+		if cause.Type == metav1.CauseTypeFieldManagerConflict {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMetadataOwners(t *testing.T) {
+	entries := []metav1.ManagedFieldsEntry{
+		{
+			Manager:   "subprovisioner.gitlab.io",
+			Operation: metav1.ManagedFieldsOperationApply,
+			FieldsV1: &metav1.FieldsV1{Raw: []byte(
+				`{"f:metadata":{"f:annotations":{"f:a/state":{}},"f:finalizers":{"v:\"a/cleanup\"":{}}}}`,
+			)},
+		},
+		{
+			Manager:   "csi-plugin",
+			Operation: metav1.ManagedFieldsOperationUpdate,
+			FieldsV1: &metav1.FieldsV1{Raw: []byte(
+				`{"f:metadata":{"f:annotations":{".":{},"f:a/state":{}},"f:labels":{"f:a/uid":{}}}}`,
+			)},
+		},
+		{
+			Manager:   "kubectl-edit",
+			Operation: metav1.ManagedFieldsOperationUpdate,
+			FieldsV1:  &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:labels":{"f:a/uid":{}}},"f:spec":{}}`)},
+		},
+		{
+			Manager:     "kube-controller-manager",
+			Operation:   metav1.ManagedFieldsOperationUpdate,
+			Subresource: "status",
+			FieldsV1:    &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:a/state":{}}}}`)},
+		},
+	}
+
+	got, err := metadataOwners(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[metadataField]*fieldOwners{
+		{"annotations", "a/state"}:  {applied: true, plugin: true},
+		{"finalizers", "a/cleanup"}: {applied: true},
+		{"labels", "a/uid"}:         {plugin: true, others: []string{"kubectl-edit"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestForceApply(t *testing.T) {
+	owners := map[metadataField]*fieldOwners{
+		{"annotations", "applied"}: {applied: true},
+		{"annotations", "plugin"}:  {plugin: true},
+		{"annotations", "others"}:  {plugin: true, others: []string{"kubectl-edit"}},
+	}
+
+	tests := []struct {
+		changed   []string
+		wantForce bool
+	}{
+		{[]string{"new"}, false},
+		{[]string{"applied"}, false},
+		{[]string{"applied", "plugin"}, true},
+		{[]string{"plugin", "others"}, false},
+	}
+
+	for _, test := range tests {
+		var changed []metadataField
+		for _, key := range test.changed {
+			changed = append(changed, metadataField{"annotations", key})
+		}
+
+		if force := forceApply(owners, changed); force != test.wantForce {
+			t.Errorf("%v: got force %v, want %v", test.changed, force, test.wantForce)
+		}
+	}
+}
+
+func TestMetadataApplyPatch(t *testing.T) {
+	owners := map[metadataField]*fieldOwners{
+		{"annotations", "a/state"}:    {applied: true},
+		{"annotations", "a/capacity"}: {applied: true},
+		{"annotations", "a/removed"}:  {applied: true},
+		{"labels", "user"}:            {others: []string{"kubectl-edit"}},
+		{"finalizers", "a/cleanup"}:   {plugin: true},
+	}
+	after := map[metadataField]string{
+		{"annotations", "a/state"}:    "staged",
+		{"annotations", "a/capacity"}: "1024",
+		{"annotations", "a/nodes"}:    "n1",
+		{"labels", "user"}:            "x",
+		{"finalizers", "a/cleanup"}:   "",
+	}
+	changed := []metadataField{{"annotations", "a/nodes"}, {"annotations", "a/state"}}
+
+	patch, err := metadataApplyPatch(
+		"v1", "PersistentVolumeClaim", "pvc", "default", "42", appliedMetadata(owners, after, changed),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `{"apiVersion":"v1","kind":"PersistentVolumeClaim","metadata":{"annotations":{` +
+		`"a/capacity":"1024","a/nodes":"n1","a/state":"staged"},` +
+		`"name":"pvc","namespace":"default","resourceVersion":"42"}}`
+	if string(patch) != want {
+		t.Errorf("got patch %s, want %s", patch, want)
+	}
+}
+
+func TestMetadataJsonPatch(t *testing.T) {
+	tests := []struct {
+		name             string
+		before           map[metadataField]string
+		after            map[metadataField]string
+		finalizersBefore []string
+		resourceVersion  string
+		wantPatch        string
+	}{
+		{
+			name: "removed finalizer",
+			before: map[metadataField]string{
+				{"finalizers", "other"}:     "",
+				{"finalizers", "a/cleanup"}: "",
+			},
+			after:            map[metadataField]string{{"finalizers", "other"}: ""},
+			finalizersBefore: []string{"other", "a/cleanup"},
+			wantPatch: `[{"op":"test","path":"/metadata/finalizers/1","value":"a/cleanup"},` +
+				`{"op":"remove","path":"/metadata/finalizers/1"}]`,
+		},
+		{
+			name: "changed and removed",
+			before: map[metadataField]string{
+				{"annotations", "a/state"}: "staged",
+				{"annotations", "a/nodes"}: "n1",
+				{"labels", "a/uid"}:        "1234",
+			},
+			after: map[metadataField]string{
+				{"annotations", "a/state"}:  "idle",
+				{"annotations", "a~b"}:      "",
+				{"labels", "a/uid"}:         "1234",
+				{"finalizers", "a/cleanup"}: "",
+			},
+			resourceVersion: "42",
+			wantPatch: `[{"op":"test","path":"/metadata/resourceVersion","value":"42"},` +
+				`{"op":"test","path":"/metadata/annotations/a~1nodes","value":"n1"},` +
+				`{"op":"remove","path":"/metadata/annotations/a~1nodes"},` +
+				`{"op":"add","path":"/metadata/annotations/a~1state","value":"idle"},` +
+				`{"op":"add","path":"/metadata/annotations/a~0b","value":""},` +
+				`{"op":"add","path":"/metadata/finalizers","value":[]},` +
+				`{"op":"add","path":"/metadata/finalizers/-","value":"a/cleanup"}]`,
+		},
+	}
+
+	for _, test := range tests {
+		changed, removed := diffMetadata(test.before, test.after)
+
+		patch, err := metadataJsonPatch(
+			test.before, test.after, test.finalizersBefore, changed, removed, test.resourceVersion,
+		)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if string(patch) != test.wantPatch {
+			t.Errorf("%s: got patch %s, want %s", test.name, patch, test.wantPatch)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Where Jobs and staging pods mount the backing volume that holds the mirror of a mirrored volume.
+const MirrorMountPath = "/var/mirror"
+
+// The copies of a mirrored volume, as recorded in the "mirror-degraded" annotation of its PVC when one of them is out
+// of date.
+const (
+	PrimaryCopy = "primary"
+	MirrorCopy  = "mirror"
+)
+
+// Path of a mirrored volume's mirror image in Jobs and staging pods.
+func GenerateVolumeMirrorImagePath(pvcUid types.UID) string {
+	return MirrorMountPath + "/" + GenerateVolumeImageName(pvcUid)
+}
+
+// Returns the location of the mirror of a mirrored volume, which shares the namespace and base path of the volume's
+// backing volume, or false if the volume isn't mirrored.
+func MirrorLocationOf(meta *metav1.ObjectMeta) (BackingLocation, bool) {
+	name := meta.Annotations[Domain+"/mirror-backing-pvc-name"]
+	if name == "" {
+		return BackingLocation{}, false
+	}
+
+	location := BackingLocationOf(meta)
+	location.PvcName = name
+	return location, true
+}
+
+// Returns which copy of a mirrored volume is out of date (PrimaryCopy or MirrorCopy), or "" if neither is.
+func DegradedCopyOf(meta *metav1.ObjectMeta) string {
+	return meta.Annotations[Domain+"/mirror-degraded"]
+}
+
+// Returns where the up-to-date copies of a volume are: the location to mount as the backing volume, which holds the
+// only up-to-date copy unless the volume is mirrored and neither copy is degraded, in which case the mirror is also
+// returned as a mount at MirrorMountPath.
+func VolumeCopiesOf(meta *metav1.ObjectMeta) (BackingLocation, *PvcMount) {
+	location := BackingLocationOf(meta)
+
+	mirror, mirrored := MirrorLocationOf(meta)
+	switch {
+	case !mirrored:
+		return location, nil
+	case DegradedCopyOf(meta) == PrimaryCopy:
+		return mirror, nil
+	case DegradedCopyOf(meta) == MirrorCopy:
+		return location, nil
+	default:
+		return location, &PvcMount{PvcName: mirror.PvcName, MountPath: MirrorMountPath, SubPath: mirror.BasePath}
+	}
+}
+
+// The operations that only know about the image in a volume's backing volume, and would thus leave its mirror behind,
+// by the state they put the volume in.
+var unmirroredOperations = map[string]string{
+	"cloning":      "cloned",
+	"snapshotting": "snapshotted",
+	"shrinking":    "shrunk",
+	"replicating":  "replicated",
+	"resyncing":    "replicated",
+	"migrating":    "migrated to another backing volume",
+	"relocating":   "relocated within their backing volume",
+	"exporting":    "exported",
+}
+
+// Fails with codes.FailedPrecondition if the volume is mirrored and newState is that of an operation that doesn't
+// support mirrored volumes.
+func checkMirroredVolumeState(meta *metav1.ObjectMeta, newState string) error {
+	if _, mirrored := MirrorLocationOf(meta); !mirrored {
+		return nil
+	}
+	if operation, ok := unmirroredOperations[newState]; ok {
+		return status.Errorf(codes.FailedPrecondition, "mirrored volumes can't be %s", operation)
+	}
+	return nil
+}
+
+// The QMP node names of the copies of a mirrored volume in the quorum that staging pods serve it from, and the names
+// under which the quorum knows them as its children. Must match scripts/qsd-with-nbd.sh.
+var (
+	mirrorCopyNodeNames  = map[string]string{PrimaryCopy: "qcow2", MirrorCopy: "mirror-qcow2"}
+	mirrorCopyChildNames = map[string]string{PrimaryCopy: "children.0", MirrorCopy: "children.1"}
+)
+
+// Returns the copy of a mirrored volume that the given QMP node belongs to, or "" if none.
+func MirrorCopyOfNode(nodeName string) string {
+	for which, name := range mirrorCopyNodeNames {
+		if name == nodeName {
+			return which
+		}
+	}
+	return ""
+}
+
+// Returns the name of the given copy of a mirrored volume as a child of the quorum that staging pods serve the volume
+// from, e.g., for removing it from the quorum with x-blockdev-change.
+func MirrorCopyChildName(which string) string {
+	return mirrorCopyChildNames[which]
+}
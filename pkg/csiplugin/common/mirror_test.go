@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestVolumeCopiesOf(t *testing.T) {
+	annotations := func(mirror string, degraded string) map[string]string {
+		return map[string]string{
+			Domain + "/backing-pvc-name":        "primary",
+			Domain + "/backing-pvc-namespace":   "ns",
+			Domain + "/backing-pvc-base-path":   "base",
+			Domain + "/mirror-backing-pvc-name": mirror,
+			Domain + "/mirror-degraded":         degraded,
+		}
+	}
+
+	primary := BackingLocation{PvcName: "primary", PvcNamespace: "ns", BasePath: "base"}
+	mirror := BackingLocation{PvcName: "mirror", PvcNamespace: "ns", BasePath: "base"}
+
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		wantLocation BackingLocation
+		wantMount    *PvcMount
+	}{
+		{"not mirrored", annotations("", ""), primary, nil},
+		{
+			"mirrored", annotations("mirror", ""),
+			primary, &PvcMount{PvcName: "mirror", MountPath: MirrorMountPath, SubPath: "base"},
+		},
+		{"primary degraded", annotations("mirror", PrimaryCopy), mirror, nil},
+		{"mirror degraded", annotations("mirror", MirrorCopy), primary, nil},
+	}
+
+	for _, test := range tests {
+		location, mount := VolumeCopiesOf(&metav1.ObjectMeta{Annotations: test.annotations})
+
+		if location != test.wantLocation {
+			t.Errorf("%s: got location %+v, want %+v", test.name, location, test.wantLocation)
+		}
+		if !reflect.DeepEqual(mount, test.wantMount) {
+			t.Errorf("%s: got mount %+v, want %+v", test.name, mount, test.wantMount)
+		}
+	}
+}
+
+func TestCheckMirroredVolumeState(t *testing.T) {
+	mirrored := &metav1.ObjectMeta{Annotations: map[string]string{Domain + "/mirror-backing-pvc-name": "mirror"}}
+	unmirrored := &metav1.ObjectMeta{}
+
+	tests := []struct {
+		meta     *metav1.ObjectMeta
+		newState string
+		wantCode codes.Code
+	}{
+		{mirrored, "idle", codes.OK},
+		{mirrored, "expanding", codes.OK},
+		{mirrored, "resyncing-mirror", codes.OK},
+		{mirrored, "snapshotting", codes.FailedPrecondition},
+		{mirrored, "migrating", codes.FailedPrecondition},
+		{unmirrored, "snapshotting", codes.OK},
+	}
+
+	for _, test := range tests {
+		err := checkMirroredVolumeState(test.meta, test.newState)
+		if code := status.Code(err); code != test.wantCode {
+			t.Errorf("%s (mirrored: %v): got code %v, want %v",
+				test.newState, test.meta == mirrored, code, test.wantCode)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Which labels and annotations of PVCs (or VolumeSnapshots) are copied onto the Jobs and ReplicaSets that operate on
+// their volumes (or snapshots), and onto their pods, e.g., so that cost allocation and policy tooling attribute those
+// to the same tenant.
+type MetadataPropagation struct {
+	Labels      []string
+	Annotations []string
+}
+
+// What metadata Jobs and ReplicaSets get from the objects they operate on. Set by the plugins on startup, before any
+// Job or ReplicaSet is created.
+var DefaultMetadataPropagation MetadataPropagation
+
+// Returns the given labels and annotations, plus those of the given object that are to be propagated. The given ones
+// take precedence, so that propagation can't interfere with the labels that identify helper objects. The given maps
+// aren't modified, and from may be nil.
+func (p MetadataPropagation) propagate(
+	from *metav1.ObjectMeta,
+	labels map[string]string,
+	annotations map[string]string,
+) (map[string]string, map[string]string) {
+	if from == nil {
+		return labels, annotations
+	}
+	return propagateKeys(p.Labels, from.Labels, labels), propagateKeys(p.Annotations, from.Annotations, annotations)
+}
+
+func propagateKeys(keys []string, from map[string]string, to map[string]string) map[string]string {
+	var result map[string]string
+
+	for _, key := range keys {
+		value, ok := from[key]
+		if _, exists := to[key]; !ok || exists {
+			continue
+		}
+
+		if result == nil {
+			result = make(map[string]string, len(to)+len(keys))
+			for k, v := range to {
+				result[k] = v
+			}
+		}
+		result[key] = value
+	}
+
+	if result == nil {
+		return to
+	}
+	return result
+}
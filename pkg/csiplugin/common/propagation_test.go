@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMetadataPropagation(t *testing.T) {
+	propagation := MetadataPropagation{
+		Labels:      []string{"team", "cost-center", Domain + "/component"},
+		Annotations: []string{"owner"},
+	}
+
+	from := &metav1.ObjectMeta{
+		Labels: map[string]string{
+			"team":                "storage",
+			"app":                 "db",
+			Domain + "/component": "bogus",
+		},
+		Annotations: map[string]string{"owner": "alice", "note": "hi"},
+	}
+
+	tests := []struct {
+		name            string
+		from            *metav1.ObjectMeta
+		labels          map[string]string
+		annotations     map[string]string
+		wantLabels      map[string]string
+		wantAnnotations map[string]string
+	}{
+		{
+			"nothing to propagate from",
+			nil,
+			map[string]string{Domain + "/component": "volume-creation"},
+			nil,
+			map[string]string{Domain + "/component": "volume-creation"},
+			nil,
+		},
+		{
+			"own labels take precedence",
+			from,
+			map[string]string{Domain + "/component": "volume-creation"},
+			nil,
+			map[string]string{Domain + "/component": "volume-creation", "team": "storage"},
+			map[string]string{"owner": "alice"},
+		},
+		{
+			"no own metadata",
+			from,
+			nil,
+			map[string]string{"other": "x"},
+			map[string]string{"team": "storage", Domain + "/component": "bogus"},
+			map[string]string{"owner": "alice", "other": "x"},
+		},
+	}
+
+	for _, test := range tests {
+		labels := copyMap(test.labels)
+		annotations := copyMap(test.annotations)
+
+		gotLabels, gotAnnotations := propagation.propagate(test.from, labels, annotations)
+
+		if !reflect.DeepEqual(gotLabels, test.wantLabels) {
+			t.Errorf("%s: got labels %v, want %v", test.name, gotLabels, test.wantLabels)
+		}
+		if !reflect.DeepEqual(gotAnnotations, test.wantAnnotations) {
+			t.Errorf("%s: got annotations %v, want %v", test.name, gotAnnotations, test.wantAnnotations)
+		}
+		if !reflect.DeepEqual(labels, test.labels) || !reflect.DeepEqual(annotations, test.annotations) {
+			t.Errorf("%s: given maps were modified", test.name)
+		}
+	}
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
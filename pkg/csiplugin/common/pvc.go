@@ -4,16 +4,17 @@ package common
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
 )
 
 func FindPvcByLabelSelector(
@@ -29,84 +30,284 @@ func FindPvcByLabelSelector(
 
 	switch len(list.Items) {
 	case 0:
-		return nil, errors.New("no objects found")
+		return nil, errNoObjectsFound("persistentvolumeclaims", labelSelector)
 	case 1:
-		return &list.Items[0], nil
+		pvc := &list.Items[0]
+		if _, err := ConvertState(&pvc.ObjectMeta); err != nil {
+			return nil, err
+		}
+		return pvc, nil
 	default:
-		return nil, errors.New("more than one object found")
+		return nil, errMoreThanOneObjectFound("persistentvolumeclaims", labelSelector)
 	}
 }
 
-func StrategicMergePatchPvc(
+// Returns the UID that the volume of a PVC is keyed by, e.g., in the name of its image file, and which is also its CSI
+// volume id. This is the UID of the PVC that the volume was created for, and differs from the PVC's own UID if the
+// volume was retained and later adopted by another PVC.
+func VolumeUidOf(pvc *corev1.PersistentVolumeClaim) types.UID {
+	return types.UID(pvc.Labels[Domain+"/uid"])
+}
+
+func SetPvcStateToIdle(
 	ctx context.Context,
 	clientset *Clientset,
 	pvcName string,
 	pvcNamespace string,
-	patch corev1.PersistentVolumeClaim,
 ) error {
-	jsonPatch, err := json.Marshal(patch)
-	if err != nil {
-		return err
-	}
-
-	_, err = clientset.CoreV1().PersistentVolumeClaims(pvcNamespace).
-		Patch(ctx, pvcName, types.StrategicMergePatchType, jsonPatch, metav1.PatchOptions{})
-	return err
+	return ApplyPvcMetadata(
+		ctx, clientset, pvcName, pvcNamespace,
+		metav1.ObjectMeta{Annotations: map[string]string{Domain + "/state": "idle"}},
+	)
 }
 
-func SetPvcStateToIdle(
+func SetPvcStateTo(
 	ctx context.Context,
 	clientset *Clientset,
 	pvcName string,
 	pvcNamespace string,
+	newState string,
 ) error {
-	return StrategicMergePatchPvc(
+	return updatePvcState(
 		ctx, clientset, pvcName, pvcNamespace,
-		corev1.PersistentVolumeClaim{
-			ObjectMeta: metav1.ObjectMeta{
-				Annotations: map[string]string{Domain + "/state": "idle"},
-			},
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			if pvc.DeletionTimestamp != nil {
+				return status.Errorf(codes.FailedPrecondition, "volume is being deleted")
+			}
+
+			err := checkMirroredVolumeState(&pvc.ObjectMeta, newState)
+			if err != nil {
+				return err
+			}
+
+			err = CheckRawVolumeState(&pvc.ObjectMeta, newState)
+			if err != nil {
+				return err
+			}
+
+			changed, err := transitionState(pvc.Annotations[Domain+"/state"], newState)
+			if err != nil || !changed {
+				return err
+			}
+
+			pvc.Annotations[Domain+"/state"] = newState
+			return nil
 		},
 	)
 }
 
-func SetPvcStateTo(
+// Like UpdatePvcMetadata, but first brings the PVC's state to StateVersion. Since the state annotation may have been
+// changed in the meantime too, mutate decides anew whether and how to transition the state of the volume if this is
+// retried.
+func updatePvcState(
 	ctx context.Context,
 	clientset *Clientset,
 	pvcName string,
 	pvcNamespace string,
+	mutate func(pvc *corev1.PersistentVolumeClaim) error,
+) error {
+	return UpdatePvcMetadata(ctx, clientset, pvcName, pvcNamespace, func(pvc *corev1.PersistentVolumeClaim) error {
+		if _, err := ConvertState(&pvc.ObjectMeta); err != nil {
+			return err
+		}
+		return mutate(pvc)
+	})
+}
+
+// Returns whether a volume in the given state must be put in newState, or an error if it can't be because it is busy
+// with another operation or staged.
+func transitionState(state string, newState string) (changed bool, err error) {
+	switch state {
+	case newState:
+		return false, nil
+	case "idle":
+		return true, nil
+	default:
+		return false, busyStateError(state)
+	}
+}
+
+// Returns the error to fail operations with while the volume is in the given state (other than "idle").
+func busyStateError(state string) error {
+	var description string
+
+	switch state {
+	case "expanding":
+		description = "volume is being expanded"
+	case "shrinking":
+		description = "volume is being shrunk"
+	case "cloning":
+		description = "volume is being cloned"
+	case "snapshotting":
+		description = "volume is being snapshotted"
+	case "replicating":
+		description = "volume is being replicated"
+	case "resyncing":
+		description = "volume is being resynced"
+	case "migrating":
+		description = "volume is being migrated to another backing volume"
+	case "relocating":
+		description = "volume is being relocated within its backing volume"
+	case "exporting":
+		description = "volume is being exported"
+	case "inspecting":
+		description = "volume is being inspected"
+	case "resyncing-mirror":
+		description = "volume's out-of-date copy is being resynchronized"
+	case "unsharing":
+		description = "volume's shared export is being shut down"
+	case "staged":
+		return ErrorWithReason(
+			codes.FailedPrecondition, ReasonVolumeStaged, map[string]string{"state": state}, "volume is staged",
+		)
+	default:
+		return status.Errorf(codes.Internal, "volume is in an unknown state")
+	}
+
+	return ErrorWithReason(codes.Aborted, ReasonVolumeBusy, map[string]string{"state": state}, "%s", description)
+}
+
+// Like SetPvcStateTo, but if the volume is busy with another operation and the PVC has the "queue-operations"
+// annotation set to "true", polls until the volume becomes idle instead of failing.
+//
+// This is best-effort waiting rather than a queue: operations waiting for the same volume don't necessarily start in
+// the order they arrived, and stop waiting once ctx is done (e.g., when the sidecar's timeout for the gRPC call
+// expires), in which case the sidecar retries them later. Operations never wait for a volume to be unstaged.
+func WaitToSetPvcStateTo(
+	ctx context.Context,
+	clientset *Clientset,
+	pvc *corev1.PersistentVolumeClaim,
 	newState string,
 ) error {
-	pvcs := clientset.CoreV1().PersistentVolumeClaims(pvcNamespace)
-	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		pvc, err := pvcs.Get(ctx, pvcName, metav1.GetOptions{})
-		if err != nil {
+	waiting := false
+
+	for {
+		err := SetPvcStateTo(ctx, clientset, pvc.Name, pvc.Namespace, newState)
+		if status.Code(err) != codes.Aborted || !PvcQueuesOperations(pvc) {
 			return err
 		}
 
-		if pvc.DeletionTimestamp != nil {
-			return status.Errorf(codes.FailedPrecondition, "volume is being deleted")
+		if !waiting {
+			klog.V(2).InfoS(
+				"Waiting to start operation on PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "state", newState,
+				"reason", status.Convert(err).Message(),
+			)
+			waiting = true
 		}
 
-		switch pvc.Annotations[Domain+"/state"] {
-		case newState:
-			return nil
-		case "idle":
-			pvc.Annotations[Domain+"/state"] = newState
-			_, err = pvcs.Update(ctx, pvc, metav1.UpdateOptions{})
-			return err
-		case "expanding":
-			return status.Errorf(codes.FailedPrecondition, "volume is being expanded")
-		case "cloning":
-			return status.Errorf(codes.FailedPrecondition, "volume is being cloned")
-		case "snapshotting":
-			return status.Errorf(codes.FailedPrecondition, "volume is being snapshotted")
-		case "staged":
-			return status.Errorf(codes.FailedPrecondition, "volume is staged")
-		default:
-			return status.Errorf(codes.FailedPrecondition, "volume is in an unknown state")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
 		}
-	})
+	}
+}
+
+func PvcQueuesOperations(pvc *corev1.PersistentVolumeClaim) bool {
+	return pvc.Annotations[Domain+"/queue-operations"] == "true"
+}
+
+// The capacity that the volume of the given PVC is being expanded to while staged, which the controller plugin records
+// in the "pending-capacity" annotation, or else its current capacity. The "capacity" annotation is only updated once
+// the node plugin has grown the volume's image, so that the volume never appears bigger than it is.
+func TargetCapacityOf(pvc *corev1.PersistentVolumeClaim) (int64, error) {
+	if pending, ok := pvc.Annotations[Domain+"/pending-capacity"]; ok {
+		return strconv.ParseInt(pending, 10, 64)
+	}
+	return strconv.ParseInt(pvc.Annotations[Domain+"/capacity"], 10, 64)
+}
+
+// Records in the given PVC that its volume now has the given capacity, and drops its pending capacity (see
+// TargetCapacityOf) unless it is bigger still.
+func CommitCapacity(pvc *corev1.PersistentVolumeClaim, capacity int64) {
+	pvc.Annotations[Domain+"/capacity"] = strconv.FormatInt(capacity, 10)
+
+	pending, err := strconv.ParseInt(pvc.Annotations[Domain+"/pending-capacity"], 10, 64)
+	if err != nil || pending <= capacity {
+		delete(pvc.Annotations, Domain+"/pending-capacity")
+	}
+}
+
+// Immutable volumes may only be staged read-only and can't be expanded. They may still be cloned and snapshotted.
+//
+// A volume is immutable if its StorageClass made it so, which is recorded in the volume attributes of its PV, or if its
+// PVC has the "immutable" annotation set to "true". Since users can remove that annotation, the lock is also recorded
+// on the PV by LockImmutableVolume, and only setting the "immutable" annotation on the PV to "false", which users
+// without permission to update PVs can't do, unlocks the volume again.
+func VolumeIsImmutable(pvc *corev1.PersistentVolumeClaim, pv *corev1.PersistentVolume) bool {
+	switch pv.Annotations[Domain+"/immutable"] {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	if pv.Spec.CSI != nil && pv.Spec.CSI.VolumeAttributes["immutable"] == "true" {
+		return true
+	}
+
+	return pvc.Annotations[Domain+"/immutable"] == "true"
+}
+
+// Returns whether the volume of the given PVC is immutable (see VolumeIsImmutable). If it is, this is also recorded on
+// its PV, so that removing the annotation from the PVC doesn't unlock the volume.
+func LockImmutableVolume(
+	ctx context.Context,
+	clientset *Clientset,
+	pvc *corev1.PersistentVolumeClaim,
+) (immutable bool, err error) {
+	if pvc.Spec.VolumeName == "" {
+		return false, status.Errorf(
+			codes.FailedPrecondition, "PVC %s in namespace %s is not bound", pvc.Name, pvc.Namespace,
+		)
+	}
+
+	pv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	immutable = VolumeIsImmutable(pvc, pv)
+
+	if immutable && pv.Annotations[Domain+"/immutable"] == "" {
+		err = ApplyPvMetadata(
+			ctx, clientset, pv.Name,
+			metav1.ObjectMeta{Annotations: map[string]string{Domain + "/immutable": "true"}},
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return immutable, nil
+}
+
+// Volumes demoted to replication secondaries through the csi-addons replication API aren't replicated and may only be
+// staged read-only, until they are promoted again.
+func PvcIsReplicationSecondary(pvc *corev1.PersistentVolumeClaim) bool {
+	return pvc.Annotations[Domain+"/replication-role"] == "secondary"
+}
+
+// Marks the volume as a replication secondary, or as a regular volume if secondary is false. Takes effect the next
+// time the volume is staged.
+func SetPvcReplicationRole(
+	ctx context.Context,
+	clientset *Clientset,
+	pvcName string,
+	pvcNamespace string,
+	secondary bool,
+) error {
+	return updatePvcState(
+		ctx, clientset, pvcName, pvcNamespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			if secondary {
+				pvc.Annotations[Domain+"/replication-role"] = "secondary"
+			} else {
+				delete(pvc.Annotations, Domain+"/replication-role")
+			}
+			return nil
+		},
+	)
 }
 
 func StagePvcOnNode(
@@ -115,37 +316,88 @@ func StagePvcOnNode(
 	pvcName string,
 	pvcNamespace string,
 	nodeName string,
+	readonly bool,
+	shared bool,
+	immutable bool,
 ) error {
-	pvcs := clientset.CoreV1().PersistentVolumeClaims(pvcNamespace)
-	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		pvc, err := pvcs.Get(ctx, pvcName, metav1.GetOptions{})
-		if err != nil {
-			return err
-		}
+	return updatePvcState(
+		ctx, clientset, pvcName, pvcNamespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			state := pvc.Annotations[Domain+"/state"]
 
-		state := pvc.Annotations[Domain+"/state"]
-
-		if pvc.DeletionTimestamp != nil {
-			return status.Errorf(codes.FailedPrecondition, "volume is being deleted")
-		} else if state == "expanding" {
-			return status.Errorf(codes.FailedPrecondition, "volume is being expanded")
-		} else if state == "snapshotting" {
-			return status.Errorf(codes.FailedPrecondition, "volume is being snapshotted")
-		} else if state == "cloning" {
-			return status.Errorf(codes.FailedPrecondition, "volume is being cloned")
-		} else if state != "idle" && state != "staged" {
-			return status.Errorf(codes.FailedPrecondition, "volume is in an unknown state")
-		}
+			if pvc.DeletionTimestamp != nil {
+				return status.Errorf(codes.FailedPrecondition, "volume is being deleted")
+			} else if !readonly && immutable {
+				return status.Errorf(codes.FailedPrecondition, "volume is immutable and may only be staged read-only")
+			} else if !readonly && PvcIsReplicationSecondary(pvc) {
+				return status.Errorf(
+					codes.FailedPrecondition, "volume is a replication secondary and may only be staged read-only",
+				)
+			} else if state != "idle" && state != "staged" {
+				return busyStateError(state)
+			}
 
-		pvc.Annotations[Domain+"/state"] = "staged"
+			err := stageOnNode(pvc.Annotations, nodeName, readonly, shared)
+			if err != nil {
+				return err
+			}
 
-		stagedOnNodes := stringListToSet(pvc.Annotations[Domain+"/staged-on-nodes"])
-		stagedOnNodes[nodeName] = struct{}{}
-		pvc.Annotations[Domain+"/staged-on-nodes"] = setToStringList(stagedOnNodes)
+			pvc.Annotations[Domain+"/state"] = "staged"
+			return nil
+		},
+	)
+}
 
-		_, err = pvcs.Update(ctx, pvc, metav1.UpdateOptions{})
-		return err
-	})
+// Records in the given PVC annotations that the volume is staged on the given node. A volume may be staged read-only on
+// any number of nodes at once, each of which serves the image through its own read-only export, but if it is staged
+// read-write on a node, it can't be staged on any other node, as readers elsewhere would see the image change under
+// them and writers elsewhere would corrupt it. The node that staged the volume read-write is recorded in the
+// "staged-read-write-on-node" annotation.
+//
+// A volume staged shared, i.e., with access mode ReadWriteMany, is instead served by a single shared export that all
+// nodes it is staged on connect to, and can be staged shared on any number of nodes at once, but not otherwise while
+// it is. That it is staged shared is recorded in the "staged-shared" annotation.
+func stageOnNode(annotations map[string]string, nodeName string, readonly bool, shared bool) error {
+	stagedOnNodes := stringListToSet(annotations[Domain+"/staged-on-nodes"])
+	readWriteNode := annotations[Domain+"/staged-read-write-on-node"]
+	stagedShared := annotations[Domain+"/staged-shared"] == "true"
+
+	if readWriteNode != "" && readWriteNode != nodeName {
+		return status.Errorf(codes.FailedPrecondition, "volume is staged read-write on node %s", readWriteNode)
+	}
+
+	if shared {
+		for otherNode := range stagedOnNodes {
+			if otherNode != nodeName && !stagedShared {
+				return status.Errorf(
+					codes.FailedPrecondition,
+					"volume is staged on node %s without its shared export and can't be staged shared", otherNode,
+				)
+			}
+		}
+		annotations[Domain+"/staged-shared"] = "true"
+	} else if stagedShared {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"volume is staged shared on nodes %s and can only be staged shared, with access mode ReadWriteMany",
+			annotations[Domain+"/staged-on-nodes"],
+		)
+	} else if !readonly {
+		for otherNode := range stagedOnNodes {
+			if otherNode != nodeName {
+				return status.Errorf(
+					codes.FailedPrecondition,
+					"volume is staged on node %s and can only be staged read-write on a single node", otherNode,
+				)
+			}
+		}
+		annotations[Domain+"/staged-read-write-on-node"] = nodeName
+	}
+
+	stagedOnNodes[nodeName] = struct{}{}
+	annotations[Domain+"/staged-on-nodes"] = setToStringList(stagedOnNodes)
+
+	return nil
 }
 
 func UnstagePvcFromNode(
@@ -155,28 +407,53 @@ func UnstagePvcFromNode(
 	pvcNamespace string,
 	nodeName string,
 ) error {
-	pvcs := clientset.CoreV1().PersistentVolumeClaims(pvcNamespace)
-	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		pvc, err := pvcs.Get(ctx, pvcName, metav1.GetOptions{})
-		if err != nil {
-			return err
-		}
+	return updatePvcState(
+		ctx, clientset, pvcName, pvcNamespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			if pvc.Annotations[Domain+"/state"] != "staged" {
+				return nil
+			}
 
-		if pvc.Annotations[Domain+"/state"] == "staged" {
 			stagedOnNodes := stringListToSet(pvc.Annotations[Domain+"/staged-on-nodes"])
 			delete(stagedOnNodes, nodeName)
 
+			if pvc.Annotations[Domain+"/staged-read-write-on-node"] == nodeName {
+				delete(pvc.Annotations, Domain+"/staged-read-write-on-node")
+			}
+
 			if len(stagedOnNodes) == 0 {
 				delete(pvc.Annotations, Domain+"/staged-on-nodes")
-				pvc.Annotations[Domain+"/state"] = "idle"
+				pvc.Annotations[Domain+"/last-unstaged"] = time.Now().UTC().Format(time.RFC3339)
+
+				// the shared export must be shut down before the volume can be staged or operated on otherwise
+				if pvc.Annotations[Domain+"/staged-shared"] == "true" {
+					pvc.Annotations[Domain+"/state"] = "unsharing"
+				} else {
+					pvc.Annotations[Domain+"/state"] = "idle"
+				}
 			} else {
 				pvc.Annotations[Domain+"/staged-on-nodes"] = setToStringList(stagedOnNodes)
 			}
-		}
+			return nil
+		},
+	)
+}
 
-		_, err = pvcs.Update(ctx, pvc, metav1.UpdateOptions{})
-		return err
-	})
+// Puts a volume that was staged shared back in the "idle" state once its shared export was shut down. Does nothing if
+// the volume isn't in the "unsharing" state.
+func FinishUnsharingPvc(ctx context.Context, clientset *Clientset, pvcName string, pvcNamespace string) error {
+	return updatePvcState(
+		ctx, clientset, pvcName, pvcNamespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			if pvc.Annotations[Domain+"/state"] != "unsharing" {
+				return nil
+			}
+
+			delete(pvc.Annotations, Domain+"/staged-shared")
+			pvc.Annotations[Domain+"/state"] = "idle"
+			return nil
+		},
+	)
 }
 
 func stringListToSet(list string) map[string]struct{} {
@@ -190,9 +467,15 @@ func stringListToSet(list string) map[string]struct{} {
 }
 
 func setToStringList(set map[string]struct{}) string {
+	items := make([]string, 0, len(set))
+	for item := range set {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+
 	var builder strings.Builder
 	empty := true
-	for item := range set {
+	for _, item := range items {
 		if !empty {
 			builder.WriteRune(',')
 		}
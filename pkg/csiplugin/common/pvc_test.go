@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestVolumeIsImmutable(t *testing.T) {
+	tests := []struct {
+		name              string
+		pvcAnnotation     string
+		pvAnnotation      string
+		pvVolumeAttribute string
+		wantImmutable     bool
+	}{
+		{"mutable", "", "", "", false},
+		{"locked through PVC", "true", "", "", true},
+		{"locked through StorageClass", "", "", "true", true},
+		{"lock recorded on PV", "", "true", "", true},
+		{"unlocked by admin", "true", "false", "", false},
+		{"StorageClass lock unlocked by admin", "", "false", "true", false},
+		{"invalid PVC annotation", "yes", "", "", false},
+	}
+
+	for _, test := range tests {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}},
+		}
+		if test.pvcAnnotation != "" {
+			pvc.Annotations[Domain+"/immutable"] = test.pvcAnnotation
+		}
+
+		pv := &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{VolumeAttributes: map[string]string{}},
+				},
+			},
+		}
+		if test.pvAnnotation != "" {
+			pv.Annotations[Domain+"/immutable"] = test.pvAnnotation
+		}
+		if test.pvVolumeAttribute != "" {
+			pv.Spec.CSI.VolumeAttributes["immutable"] = test.pvVolumeAttribute
+		}
+
+		if got := VolumeIsImmutable(pvc, pv); got != test.wantImmutable {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.wantImmutable)
+		}
+	}
+}
+
+func TestTransitionState(t *testing.T) {
+	tests := []struct {
+		state       string
+		newState    string
+		wantChanged bool
+		wantCode    codes.Code
+	}{
+		{"idle", "snapshotting", true, codes.OK},
+		{"snapshotting", "snapshotting", false, codes.OK},
+		{"resyncing", "resyncing", false, codes.OK},
+		{"expanding", "cloning", false, codes.Aborted},
+		{"cloning", "expanding", false, codes.Aborted},
+		{"snapshotting", "replicating", false, codes.Aborted},
+		{"replicating", "snapshotting", false, codes.Aborted},
+		{"resyncing", "replicating", false, codes.Aborted},
+		{"staged", "expanding", false, codes.FailedPrecondition},
+		{"", "expanding", false, codes.Internal},
+		{"bogus", "expanding", false, codes.Internal},
+	}
+
+	for _, test := range tests {
+		changed, err := transitionState(test.state, test.newState)
+
+		if code := status.Code(err); code != test.wantCode {
+			t.Errorf("%s -> %s: got code %v, want %v", test.state, test.newState, code, test.wantCode)
+		}
+		if changed != test.wantChanged {
+			t.Errorf("%s -> %s: got changed %v, want %v", test.state, test.newState, changed, test.wantChanged)
+		}
+	}
+}
+
+func TestStageOnNode(t *testing.T) {
+	tests := []struct {
+		name              string
+		stagedOnNodes     string
+		readWriteNode     string
+		stagedShared      bool
+		nodeName          string
+		readonly          bool
+		shared            bool
+		wantStagedOnNodes string
+		wantReadWriteNode string
+		wantCode          codes.Code
+	}{
+		{"first read-only", "", "", false, "a", true, false, "a", "", codes.OK},
+		{"more read-only", "a,c", "", false, "b", true, false, "a,b,c", "", codes.OK},
+		{"first read-write", "", "", false, "a", false, false, "a", "a", codes.OK},
+		{"read-write again", "a", "a", false, "a", false, false, "a", "a", codes.OK},
+		{"read-write after read-only on same node", "a", "", false, "a", false, false, "a", "a", codes.OK},
+		{"read-write after read-only elsewhere", "a", "", false, "b", false, false, "a", "", codes.FailedPrecondition},
+		{"read-only after read-write elsewhere", "a", "a", false, "b", true, false, "a", "a", codes.FailedPrecondition},
+		{
+			"read-write after read-write elsewhere", "a", "a", false, "b", false, false, "a", "a",
+			codes.FailedPrecondition,
+		},
+		{"first shared", "", "", false, "a", false, true, "a", "", codes.OK},
+		{"more shared", "a,c", "", true, "b", false, true, "a,b,c", "", codes.OK},
+		{"shared after read-only elsewhere", "a", "", false, "b", false, true, "a", "", codes.FailedPrecondition},
+		{"shared after read-write elsewhere", "a", "a", false, "b", false, true, "a", "a", codes.FailedPrecondition},
+		{"read-only after shared elsewhere", "a", "", true, "b", true, false, "a", "", codes.FailedPrecondition},
+		{"read-write after shared elsewhere", "a", "", true, "b", false, false, "a", "", codes.FailedPrecondition},
+	}
+
+	for _, test := range tests {
+		annotations := map[string]string{}
+		if test.stagedOnNodes != "" {
+			annotations[Domain+"/staged-on-nodes"] = test.stagedOnNodes
+		}
+		if test.readWriteNode != "" {
+			annotations[Domain+"/staged-read-write-on-node"] = test.readWriteNode
+		}
+		if test.stagedShared {
+			annotations[Domain+"/staged-shared"] = "true"
+		}
+
+		err := stageOnNode(annotations, test.nodeName, test.readonly, test.shared)
+
+		if code := status.Code(err); code != test.wantCode {
+			t.Errorf("%s: got code %v, want %v", test.name, code, test.wantCode)
+		}
+		if got := annotations[Domain+"/staged-on-nodes"]; got != test.wantStagedOnNodes {
+			t.Errorf("%s: got staged-on-nodes %q, want %q", test.name, got, test.wantStagedOnNodes)
+		}
+		if got := annotations[Domain+"/staged-read-write-on-node"]; got != test.wantReadWriteNode {
+			t.Errorf("%s: got staged-read-write-on-node %q, want %q", test.name, got, test.wantReadWriteNode)
+		}
+		wantShared := test.stagedShared || (test.shared && test.wantCode == codes.OK)
+		if got := annotations[Domain+"/staged-shared"] == "true"; got != wantShared {
+			t.Errorf("%s: got staged-shared %v, want %v", test.name, got, wantShared)
+		}
+	}
+}
+
+func TestPendingCapacity(t *testing.T) {
+	tests := []struct {
+		name        string
+		capacity    string
+		pending     string
+		commit      int64
+		wantTarget  int64
+		wantPending string
+	}{
+		{"nothing pending", "100", "", 100, 100, ""},
+		{"grown to pending capacity", "100", "200", 200, 200, ""},
+		{"expanded again while growing", "100", "300", 200, 300, "300"},
+	}
+
+	for _, test := range tests {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{Domain + "/capacity": test.capacity}},
+		}
+		if test.pending != "" {
+			pvc.Annotations[Domain+"/pending-capacity"] = test.pending
+		}
+
+		if got, err := TargetCapacityOf(pvc); err != nil || got != test.wantTarget {
+			t.Errorf("%s: got target %d, %v, want %d", test.name, got, err, test.wantTarget)
+		}
+
+		CommitCapacity(pvc, test.commit)
+
+		if got := pvc.Annotations[Domain+"/capacity"]; got != strconv.FormatInt(test.commit, 10) {
+			t.Errorf("%s: got capacity %s, want %d", test.name, got, test.commit)
+		}
+		if got := pvc.Annotations[Domain+"/pending-capacity"]; got != test.wantPending {
+			t.Errorf("%s: got pending capacity %q, want %q", test.name, got, test.wantPending)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Path of the QMP socket of the qemu-storage-daemon instance staging the given volume on a node with the given kubelet
+// directory. Unix socket paths are limited to about 100 characters, which is why this isn't placed next to the staging
+// path.
+func GenerateQmpSocketPath(kubeletDir string, pvcUid types.UID) string {
+	return fmt.Sprintf("%s/plugins/subprovisioner/qmp/%s.sock", kubeletDir, pvcUid)
+}
+
+// Path of the second QMP socket of the qemu-storage-daemon instance staging the given volume, which the node plugin
+// keeps connected to in order to receive events, as each QMP socket only serves one client at a time. Must match what
+// scripts/qsd-with-nbd.sh derives from the path of the first socket.
+func GenerateQmpEventsSocketPath(kubeletDir string, pvcUid types.UID) string {
+	return fmt.Sprintf("%s/plugins/subprovisioner/qmp/%s-events.sock", kubeletDir, pvcUid)
+}
+
+// Path of the NBD socket of the qemu-nbd instance staging the given volume if the node plugin fell back to qemu-nbd
+// because qemu-storage-daemon couldn't be used. Must match what scripts/qsd-with-nbd.sh derives from the path of the
+// QMP socket.
+func GenerateQemuNbdSocketPath(kubeletDir string, pvcUid types.UID) string {
+	return fmt.Sprintf("%s/plugins/subprovisioner/qmp/%s-nbd.sock", kubeletDir, pvcUid)
+}
+
+// Path of the file in which the staging pod of the given volume reports that the volume's image chain is corrupt, if
+// checking it on staging is enabled. Must match what scripts/qsd-with-nbd.sh derives from the path of the QMP socket.
+func GenerateStagingCheckReportPath(kubeletDir string, pvcUid types.UID) string {
+	return fmt.Sprintf("%s/plugins/subprovisioner/qmp/%s-check.txt", kubeletDir, pvcUid)
+}
+
+// Path of the file in which the staging pod of the given volume records which NBD device it connected the volume to,
+// so that the volume can be connected to the same device again if the pod or its container restarts. Must match what
+// scripts/qsd-with-nbd.sh derives from the path of the QMP socket.
+func GenerateNbdDeviceRecordPath(kubeletDir string, pvcUid types.UID) string {
+	return fmt.Sprintf("%s/plugins/subprovisioner/qmp/%s-nbd-dev", kubeletDir, pvcUid)
+}
+
+// Path of the file in which the node plugin records which copy of the given mirrored volume is out of date once it
+// removed that copy from the volume's quorum, so that the staging pod doesn't serve it again if the pod or its
+// container restarts. Must match what scripts/qsd-with-nbd.sh derives from the path of the QMP socket.
+func GenerateMirrorDegradedRecordPath(kubeletDir string, pvcUid types.UID) string {
+	return fmt.Sprintf("%s/plugins/subprovisioner/qmp/%s-mirror-degraded", kubeletDir, pvcUid)
+}
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+	Event string `json:"event"`
+}
+
+// An asynchronous event emitted by qemu-storage-daemon.
+type QmpEvent struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+func (e *QmpEvent) Time() time.Time {
+	return time.Unix(e.Timestamp.Seconds, e.Timestamp.Microseconds*1000)
+}
+
+// Runs a single QMP command against the qemu-storage-daemon listening on the given socket and returns its result.
+func QmpExecute(
+	ctx context.Context,
+	socketPath string,
+	command string,
+	arguments interface{},
+) (json.RawMessage, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+
+	reader := bufio.NewReader(conn)
+	encoder := json.NewEncoder(conn)
+
+	// skip greeting
+	if _, err := reader.ReadBytes('\n'); err != nil {
+		return nil, err
+	}
+
+	execute := func(command string, arguments interface{}) (json.RawMessage, error) {
+		request := map[string]interface{}{"execute": command}
+		if arguments != nil {
+			request["arguments"] = arguments
+		}
+
+		if err := encoder.Encode(request); err != nil {
+			return nil, err
+		}
+
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return nil, err
+			}
+
+			var response qmpResponse
+			if err := json.Unmarshal(line, &response); err != nil {
+				return nil, err
+			}
+
+			switch {
+			case response.Event != "":
+				continue // asynchronous events may be interleaved with responses
+			case response.Error != nil:
+				return nil, fmt.Errorf("QMP command %s failed: %s", command, response.Error.Desc)
+			default:
+				return response.Return, nil
+			}
+		}
+	}
+
+	if _, err := execute("qmp_capabilities", nil); err != nil {
+		return nil, err
+	}
+
+	return execute(command, arguments)
+}
+
+// Connects to the qemu-storage-daemon listening on the given socket and passes every event it emits to handle, until
+// the connection fails or ctx is canceled. Always returns a non-nil error.
+func QmpReadEvents(ctx context.Context, socketPath string, handle func(event QmpEvent)) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// unblock reads when ctx is canceled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	// report cancellation rather than the resulting read failure
+	fail := func(err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	// skip greeting and leave capabilities negotiation mode, as events are only emitted after that
+
+	if _, err := reader.ReadBytes('\n'); err != nil {
+		return fail(err)
+	}
+
+	if err := json.NewEncoder(conn).Encode(map[string]interface{}{"execute": "qmp_capabilities"}); err != nil {
+		return fail(err)
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return fail(err)
+		}
+
+		var event QmpEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return err
+		}
+
+		if event.Event != "" {
+			handle(event)
+		}
+	}
+}
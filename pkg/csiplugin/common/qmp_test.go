@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQmpReadEvents(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "qmp.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// pretend to be qemu-storage-daemon, which only emits events after capabilities negotiation
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || !strings.Contains(line, "qmp_capabilities") {
+			return
+		}
+
+		_, _ = conn.Write([]byte(`{"return": {}}` + "\n"))
+		_, _ = conn.Write([]byte(
+			`{"event": "BLOCK_IO_ERROR", "data": {"operation": "write"}, ` +
+				`"timestamp": {"seconds": 1700000000, "microseconds": 500}}` + "\n",
+		))
+		_, _ = conn.Write([]byte(`{"event": "BLOCK_EXPORT_DELETED", "data": {"id": "export"}}` + "\n"))
+	}()
+
+	var events []QmpEvent
+	err = QmpReadEvents(context.Background(), socketPath, func(event QmpEvent) {
+		events = append(events, event)
+	})
+	if err == nil {
+		t.Fatal("expected an error once the connection is closed")
+	}
+
+	if len(events) != 2 || events[0].Event != "BLOCK_IO_ERROR" || events[1].Event != "BLOCK_EXPORT_DELETED" {
+		t.Fatalf("got events %+v", events)
+	}
+	if got := events[0].Time().UnixMicro(); got != 1700000000000500 {
+		t.Errorf("got timestamp %d", got)
+	}
+}
+
+func TestQmpReadEventsCanceled(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "qmp.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// a daemon that never says anything
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		cancel()
+		_, _ = conn.Read(make([]byte, 1)) // until the client hangs up
+	}()
+
+	err = QmpReadEvents(ctx, socketPath, func(event QmpEvent) {})
+	if err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The id of the throttle group that qemu-storage-daemon throttles a staged volume's I/O with (see
+// scripts/qsd-with-nbd.sh).
+const QsdThrottleGroupId = "throttle"
+
+// The throttle limits of a volume, which qemu-storage-daemon enforces on all I/O to it. Zero means unlimited.
+type VolumeQos struct {
+	MaxIops      int64 // operations per second, reads and writes combined
+	MaxBandwidth int64 // bytes per second, reads and writes combined
+}
+
+// Returns the throttle limits of a volume, given by the "max-iops" and "max-bandwidth" annotations of its PVC, which
+// may be changed at any time, including while the volume is staged. Fails with codes.InvalidArgument if either is
+// malformed. The limits in effect are these capped by those of the volume's StorageClass (see StorageClassQosOf()).
+func VolumeQosOf(meta *metav1.ObjectMeta) (VolumeQos, error) {
+	var qos VolumeQos
+
+	for annotation, limit := range map[string]*int64{
+		Domain + "/max-iops":      &qos.MaxIops,
+		Domain + "/max-bandwidth": &qos.MaxBandwidth,
+	} {
+		value, ok := meta.Annotations[annotation]
+		if !ok {
+			continue
+		}
+
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Sign() < 0 {
+			return VolumeQos{}, status.Errorf(
+				codes.InvalidArgument,
+				"annotation \"%s\" must be a non-negative quantity, got \"%s\"", annotation, value,
+			)
+		}
+
+		*limit = quantity.Value()
+	}
+
+	return qos, nil
+}
+
+// Returns the throttle limits that a volume's StorageClass imposes with its "maxIops" and "maxBandwidth" parameters,
+// which the controller plugin validated and recorded in the volume context, as given to NodeStageVolume and kept in the
+// volume attributes of its PV. Unlike the annotations of the PVC, users can't change these, so they cap the limits
+// given by the annotations (see CappedBy()).
+func StorageClassQosOf(volumeContext map[string]string) (VolumeQos, error) {
+	var qos VolumeQos
+
+	for key, limit := range map[string]*int64{
+		"maxIops":      &qos.MaxIops,
+		"maxBandwidth": &qos.MaxBandwidth,
+	} {
+		value, ok := volumeContext[key]
+		if !ok {
+			continue
+		}
+
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return VolumeQos{}, status.Errorf(codes.Internal, "invalid volume context entry \"%s\": \"%s\"", key, value)
+		}
+
+		*limit = parsed
+	}
+
+	return qos, nil
+}
+
+// Returns these limits, each lowered to the corresponding one of the given limits if that is stricter. Zero is
+// unlimited, and thus never stricter.
+func (q VolumeQos) CappedBy(limits VolumeQos) VolumeQos {
+	capped := func(limit int64, ceiling int64) int64 {
+		if ceiling > 0 && (limit == 0 || limit > ceiling) {
+			return ceiling
+		}
+		return limit
+	}
+
+	return VolumeQos{
+		MaxIops:      capped(q.MaxIops, limits.MaxIops),
+		MaxBandwidth: capped(q.MaxBandwidth, limits.MaxBandwidth),
+	}
+}
+
+// The value of the "limits" property of a qemu-storage-daemon throttle group that enforces these limits. Limits that
+// are zero are set explicitly, so that setting the property lifts them.
+func (q VolumeQos) ThrottleLimits() map[string]int64 {
+	return map[string]int64{
+		"iops-total": q.MaxIops,
+		"bps-total":  q.MaxBandwidth,
+	}
+}
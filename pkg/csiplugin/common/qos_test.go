@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestVolumeQosOf(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		want        VolumeQos
+	}{
+		{nil, VolumeQos{}},
+		{map[string]string{Domain + "/max-iops": "1000"}, VolumeQos{MaxIops: 1000}},
+		{map[string]string{Domain + "/max-iops": "2k"}, VolumeQos{MaxIops: 2000}},
+		{
+			map[string]string{Domain + "/max-iops": "500", Domain + "/max-bandwidth": "100Mi"},
+			VolumeQos{MaxIops: 500, MaxBandwidth: 100 << 20},
+		},
+		{map[string]string{Domain + "/max-bandwidth": "0"}, VolumeQos{}},
+	}
+	for _, test := range tests {
+		got, err := VolumeQosOf(&metav1.ObjectMeta{Annotations: test.annotations})
+		if err != nil || got != test.want {
+			t.Errorf("%v: got %+v, %v", test.annotations, got, err)
+		}
+	}
+
+	for _, annotations := range []map[string]string{
+		{Domain + "/max-iops": "lots"},
+		{Domain + "/max-iops": "-1"},
+		{Domain + "/max-bandwidth": ""},
+	} {
+		if _, err := VolumeQosOf(&metav1.ObjectMeta{Annotations: annotations}); err == nil {
+			t.Errorf("%v: expected error", annotations)
+		}
+	}
+}
+
+func TestStorageClassQosOf(t *testing.T) {
+	got, err := StorageClassQosOf(map[string]string{"maxIops": "500", "maxBandwidth": "1048576", "readAhead": "4096"})
+	if err != nil || got != (VolumeQos{MaxIops: 500, MaxBandwidth: 1 << 20}) {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	got, err = StorageClassQosOf(nil)
+	if err != nil || got != (VolumeQos{}) {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	if _, err := StorageClassQosOf(map[string]string{"maxIops": "1k"}); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestVolumeQosCappedBy(t *testing.T) {
+	tests := []struct {
+		qos    VolumeQos
+		limits VolumeQos
+		want   VolumeQos
+	}{
+		{VolumeQos{}, VolumeQos{}, VolumeQos{}},
+		{VolumeQos{MaxIops: 100}, VolumeQos{}, VolumeQos{MaxIops: 100}},
+		{VolumeQos{}, VolumeQos{MaxIops: 100}, VolumeQos{MaxIops: 100}},
+		{VolumeQos{MaxIops: 50}, VolumeQos{MaxIops: 100}, VolumeQos{MaxIops: 50}},
+		{VolumeQos{MaxIops: 500}, VolumeQos{MaxIops: 100}, VolumeQos{MaxIops: 100}},
+		{
+			VolumeQos{MaxIops: 500, MaxBandwidth: 1 << 20}, VolumeQos{MaxBandwidth: 1 << 30},
+			VolumeQos{MaxIops: 500, MaxBandwidth: 1 << 20},
+		},
+	}
+
+	for _, test := range tests {
+		if got := test.qos.CappedBy(test.limits); got != test.want {
+			t.Errorf("%+v capped by %+v: got %+v, want %+v", test.qos, test.limits, got, test.want)
+		}
+	}
+}
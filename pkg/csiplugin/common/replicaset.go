@@ -4,8 +4,7 @@ package common
 
 import (
 	"context"
-	"errors"
-	"time"
+	"fmt"
 
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
@@ -27,23 +26,46 @@ type ReplicaSetConfig struct {
 	Command []string
 	Args    []string
 
+	// Requested and maximum amounts of compute resources for the container.
+	Resources v1.ResourceRequirements
+
 	BackingPvcName     string
 	BackingPvcBasePath string
+
+	// Other PVCs to mount, which must be in the same namespace as the ReplicaSet.
+	ExtraPvcMounts []PvcMount
+
+	// The kubelet directory of the node, whose "plugins" and "pods" subdirectories are passed through to the container
+	// at the same paths. Defaults to DefaultKubeletDir.
+	KubeletDir string
+
+	// If set, the kubelet directory isn't passed through, e.g., for pods that don't serve volumes to the kubelet.
+	WithoutKubeletDir bool
+
+	// The PVC or VolumeSnapshot the ReplicaSet serves, whose labels and annotations are propagated to the ReplicaSet
+	// and its pods as given by DefaultMetadataPropagation.
+	PropagateFrom *metav1.ObjectMeta
 }
 
-// Idempotent. The backing volume is mounted at "/var/backing", and "/var/lib/kubelet" is passed through to the
-// container.
+// Idempotent. The backing volume is mounted at "/var/backing". Fails with codes.AlreadyExists if a ReplicaSet with the
+// same name but another "component" label exists (see CheckNameCollision()).
 func CreateReplicaSet(ctx context.Context, clientset *Clientset, config ReplicaSetConfig) error {
+	kubeletDir := config.KubeletDir
+	if kubeletDir == "" {
+		kubeletDir = DefaultKubeletDir
+	}
+
 	privileged := true
 	hostPathType := v1.HostPathDirectory
 	podSpec := v1.PodSpec{
 		NodeName: config.NodeName,
 		Containers: []v1.Container{
 			{
-				Name:    "container",
-				Image:   config.Image,
-				Command: config.Command,
-				Args:    config.Args,
+				Name:      "container",
+				Image:     config.Image,
+				Command:   config.Command,
+				Args:      config.Args,
+				Resources: config.Resources,
 				SecurityContext: &v1.SecurityContext{
 					Privileged: &privileged,
 				},
@@ -55,11 +77,11 @@ func CreateReplicaSet(ctx context.Context, clientset *Clientset, config ReplicaS
 					},
 					{
 						Name:      "plugins-dir",
-						MountPath: "/var/lib/kubelet/plugins",
+						MountPath: kubeletDir + "/plugins",
 					},
 					{
 						Name:      "volume-dir",
-						MountPath: "/var/lib/kubelet/pods",
+						MountPath: kubeletDir + "/pods",
 					},
 				},
 			},
@@ -77,7 +99,7 @@ func CreateReplicaSet(ctx context.Context, clientset *Clientset, config ReplicaS
 				Name: "plugins-dir",
 				VolumeSource: v1.VolumeSource{
 					HostPath: &v1.HostPathVolumeSource{
-						Path: "/var/lib/kubelet/plugins",
+						Path: kubeletDir + "/plugins",
 						Type: &hostPathType,
 					},
 				},
@@ -86,7 +108,7 @@ func CreateReplicaSet(ctx context.Context, clientset *Clientset, config ReplicaS
 				Name: "volume-dir",
 				VolumeSource: v1.VolumeSource{
 					HostPath: &v1.HostPathVolumeSource{
-						Path: "/var/lib/kubelet/pods",
+						Path: kubeletDir + "/pods",
 						Type: &hostPathType,
 					},
 				},
@@ -94,12 +116,35 @@ func CreateReplicaSet(ctx context.Context, clientset *Clientset, config ReplicaS
 		},
 	}
 
+	if config.WithoutKubeletDir {
+		podSpec.Containers[0].VolumeMounts = podSpec.Containers[0].VolumeMounts[:1]
+		podSpec.Volumes = podSpec.Volumes[:1]
+	}
+
+	for i, mount := range config.ExtraPvcMounts {
+		volumeName := fmt.Sprintf("extra-%d", i)
+
+		podSpec.Containers[0].VolumeMounts = append(
+			podSpec.Containers[0].VolumeMounts,
+			v1.VolumeMount{Name: volumeName, MountPath: mount.MountPath, SubPath: mount.SubPath},
+		)
+		podSpec.Volumes = append(podSpec.Volumes, v1.Volume{
+			Name: volumeName,
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: mount.PvcName},
+			},
+		})
+	}
+
+	labels, annotations := DefaultMetadataPropagation.propagate(config.PropagateFrom, config.Labels, config.Annotations)
+	podLabels, podAnnotations := DefaultMetadataPropagation.propagate(config.PropagateFrom, config.MatchLabels, nil)
+
 	replicaSet := appsv1.ReplicaSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        config.Name,
 			Namespace:   config.Namespace,
-			Labels:      config.Labels,
-			Annotations: config.Annotations,
+			Labels:      labels,
+			Annotations: annotations,
 		},
 		Spec: appsv1.ReplicaSetSpec{
 			Replicas: &config.Replicas,
@@ -108,19 +153,26 @@ func CreateReplicaSet(ctx context.Context, clientset *Clientset, config ReplicaS
 			},
 			Template: v1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: config.MatchLabels,
+					Labels:      podLabels,
+					Annotations: podAnnotations,
 				},
 				Spec: podSpec,
 			},
 		},
 	}
 
-	_, err := clientset.AppsV1().ReplicaSets(config.Namespace).Create(ctx, &replicaSet, metav1.CreateOptions{})
-	if err != nil && !k8serrors.IsAlreadyExists(err) {
-		return err
+	replicaSets := clientset.AppsV1().ReplicaSets(config.Namespace)
+
+	_, err := replicaSets.Create(ctx, &replicaSet, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		existing, err := replicaSets.Get(ctx, config.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		return CheckNameCollision("ReplicaSet", &existing.ObjectMeta, config.Labels[Domain+"/component"])
 	}
 
-	return nil
+	return err
 }
 
 func FindReplicaSetByLabelSelector(
@@ -136,11 +188,11 @@ func FindReplicaSetByLabelSelector(
 
 	switch len(list.Items) {
 	case 0:
-		return nil, errors.New("no objects found")
+		return nil, errNoObjectsFound("replicasets", labelSelector)
 	case 1:
 		return &list.Items[0], nil
 	default:
-		return nil, errors.New("more than one object found")
+		return nil, errMoreThanOneObjectFound("replicasets", labelSelector)
 	}
 }
 
@@ -155,19 +207,15 @@ func DeleteReplicaSetSynchronously(
 
 	propagationPolicy := metav1.DeletePropagationForeground
 	err := replicaSets.Delete(ctx, replicaSetName, metav1.DeleteOptions{PropagationPolicy: &propagationPolicy})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-	// TODO: Watch instead of polling.
-	for {
-		if err != nil {
-			if k8serrors.IsNotFound(err) {
-				return nil
-			} else {
-				return err
-			}
-		}
-
-		time.Sleep(1 * time.Second)
+	// with foreground propagation, the ReplicaSet only disappears once its pods are gone
 
-		_, err = replicaSets.Get(ctx, replicaSetName, metav1.GetOptions{})
-	}
+	return waitForObjectDeletion(
+		ctx, clientset.AppsV1().RESTClient(), "replicasets", replicaSetNamespace, replicaSetName, &appsv1.ReplicaSet{},
+	)
 }
@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"strconv"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// Version of the layout of the state we keep in annotations on PVCs and VolumeSnapshots. Bump this whenever that
+// layout changes in a way that plugin versions understanding only the previous layout would misinterpret, and add a
+// conversion from the previous version to the stateConversions map.
+//
+// Plugin versions refuse to operate on volumes and snapshots whose state has a newer version than they know about,
+// so that rolling upgrades don't strand volumes by having old plugin instances misread or clobber state written by
+// new ones.
+const StateVersion = 3
+
+// Converts state from version N (the key) to version N+1 in place. Version 0 is the layout prior to the
+// introduction of state versioning.
+var stateConversions = map[int]func(meta *metav1.ObjectMeta){
+	0: func(meta *metav1.ObjectMeta) {}, // version 1 only added the version annotation itself
+
+	// Version 2 added volumes staged shared on several nodes, which older versions would stage on other nodes without
+	// their shared export. The layout of existing state didn't change.
+	1: func(meta *metav1.ObjectMeta) {},
+
+	// Version 3 added raw volume images (see the "format" annotation), which older versions would open as qcow2,
+	// letting a guest that writes a qcow2 header into its raw volume make them follow an arbitrary backing file. The
+	// layout of existing state didn't change, as volumes without the annotation remain qcow2.
+	2: func(meta *metav1.ObjectMeta) {},
+}
+
+func StateVersionAnnotations() map[string]string {
+	return map[string]string{Domain + "/state-version": strconv.Itoa(StateVersion)}
+}
+
+func stateVersionOf(meta *metav1.ObjectMeta) (int, error) {
+	value, ok := meta.Annotations[Domain+"/state-version"]
+	if !ok {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 0 {
+		return -1, status.Errorf(codes.Internal, "object has malformed state version \"%s\"", value)
+	}
+
+	return version, nil
+}
+
+// Brings the state in the given object's annotations to StateVersion in place. Returns whether the object was
+// modified. Fails if the state was written by a newer plugin version.
+func ConvertState(meta *metav1.ObjectMeta) (bool, error) {
+	version, err := stateVersionOf(meta)
+	if err != nil {
+		return false, err
+	}
+
+	if version > StateVersion {
+		return false, status.Errorf(
+			codes.FailedPrecondition,
+			"state of %s/%s has version %d, but this plugin only supports up to version %d; is an upgrade in progress?",
+			meta.Namespace, meta.Name, version, StateVersion,
+		)
+	}
+
+	if version == StateVersion {
+		return false, nil
+	}
+
+	for ; version < StateVersion; version++ {
+		stateConversions[version](meta)
+	}
+
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[Domain+"/state-version"] = strconv.Itoa(StateVersion)
+
+	return true, nil
+}
+
+// Checks the state version of all PVCs managed by the plugin, logging those that can't be handled by this plugin
+// version. If persist is true, PVCs with state of an older version are converted and updated.
+func CheckPvcStateVersions(ctx context.Context, clientset *Clientset, persist bool) error {
+	listOptions := metav1.ListOptions{LabelSelector: Domain + "/uid"}
+
+	pvcList, err := clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+
+	for i := range pvcList.Items {
+		pvc := &pvcList.Items[i]
+
+		checkStateVersion(&pvc.ObjectMeta, "PVC", persist, func() error {
+			return UpdatePvcMetadata(
+				ctx, clientset, pvc.Name, pvc.Namespace,
+				func(pvc *corev1.PersistentVolumeClaim) error {
+					_, err := ConvertState(&pvc.ObjectMeta)
+					return err
+				},
+			)
+		})
+	}
+
+	return nil
+}
+
+// Like CheckPvcStateVersions, but for VolumeSnapshots.
+func CheckVolumeSnapshotStateVersions(ctx context.Context, clientset *Clientset, persist bool) error {
+	listOptions := metav1.ListOptions{LabelSelector: Domain + "/uid"}
+
+	volumeSnapshotList, err := clientset.SnapshotV1().VolumeSnapshots(metav1.NamespaceAll).List(ctx, listOptions)
+	if k8serrors.IsNotFound(err) {
+		return nil // volume snapshot CRDs aren't installed
+	} else if err != nil {
+		return err
+	}
+
+	for i := range volumeSnapshotList.Items {
+		volumeSnapshot := &volumeSnapshotList.Items[i]
+
+		checkStateVersion(&volumeSnapshot.ObjectMeta, "VolumeSnapshot", persist, func() error {
+			return UpdateVolumeSnapshotMetadata(
+				ctx, clientset, volumeSnapshot.Name, volumeSnapshot.Namespace,
+				func(volumeSnapshot *volumesnapshotv1.VolumeSnapshot) error {
+					_, err := ConvertState(&volumeSnapshot.ObjectMeta)
+					return err
+				},
+			)
+		})
+	}
+
+	return nil
+}
+
+func checkStateVersion(meta *metav1.ObjectMeta, kind string, persist bool, update func() error) {
+	version, err := stateVersionOf(meta)
+	if err != nil {
+		klog.ErrorS(err, "Can't determine state version", "kind", kind, "object", klog.KRef(meta.Namespace, meta.Name))
+		return
+	}
+
+	switch {
+	case version > StateVersion:
+		klog.ErrorS(
+			nil, "Object has a state version newer than supported; won't touch it",
+			"kind", kind, "object", klog.KRef(meta.Namespace, meta.Name), "version", version,
+			"supportedVersion", StateVersion,
+		)
+	case version < StateVersion && persist:
+		klog.InfoS(
+			"Converting state", "kind", kind, "object", klog.KRef(meta.Namespace, meta.Name),
+			"fromVersion", version, "toVersion", StateVersion,
+		)
+		if err := update(); err != nil && !k8serrors.IsNotFound(err) {
+			// not fatal, as the state is also converted whenever the object is next updated
+			klog.ErrorS(err, "Failed to convert state", "kind", kind, "object", klog.KRef(meta.Namespace, meta.Name))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestConvertState(t *testing.T) {
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		wantModified bool
+		wantCode     codes.Code
+	}{
+		{"no annotations", nil, true, codes.OK},
+		{"unversioned", map[string]string{Domain + "/state": "idle"}, true, codes.OK},
+		{"current", map[string]string{Domain + "/state-version": strconv.Itoa(StateVersion)}, false, codes.OK},
+		{"newer", map[string]string{Domain + "/state-version": strconv.Itoa(StateVersion + 1)}, false, codes.FailedPrecondition},
+		{"malformed", map[string]string{Domain + "/state-version": "one"}, false, codes.Internal},
+		{"negative", map[string]string{Domain + "/state-version": "-1"}, false, codes.Internal},
+	}
+
+	for _, test := range tests {
+		meta := &metav1.ObjectMeta{Name: "pvc", Namespace: "default", Annotations: test.annotations}
+
+		modified, err := ConvertState(meta)
+
+		if code := status.Code(err); code != test.wantCode {
+			t.Errorf("%s: got code %v, want %v", test.name, code, test.wantCode)
+			continue
+		}
+		if modified != test.wantModified {
+			t.Errorf("%s: got modified %v, want %v", test.name, modified, test.wantModified)
+		}
+		if err == nil && meta.Annotations[Domain+"/state-version"] != strconv.Itoa(StateVersion) {
+			t.Errorf("%s: state version annotation is \"%s\" after conversion",
+				test.name, meta.Annotations[Domain+"/state-version"])
+		}
+	}
+}
+
+func TestStateConversionsAreComplete(t *testing.T) {
+	for version := 0; version < StateVersion; version++ {
+		if stateConversions[version] == nil {
+			t.Errorf("missing conversion from state version %d", version)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Deleted volumes whose StorageClass has the "stickyData" parameter set to "true" keep their image, renamed in place to
+// "sticky-<hash>-<capacity>.qcow2", where <hash> identifies the namespace and name of their PVC and <capacity> is the
+// volume's capacity in bytes, so that a PVC later created with the same namespace and name in the same backing volume
+// can reattach it.
+
+func stickyImagePrefix(pvcNamespace string, pvcName string) string {
+	hash := sha256.Sum256([]byte(pvcNamespace + "/" + pvcName))
+	return fmt.Sprintf("sticky-%x-", hash[:16])
+}
+
+// Name of the image that a deleted volume of the given PVC leaves behind, relative to the base path of its backing
+// volume.
+func GenerateStickyImageName(pvcNamespace string, pvcName string, capacity int64) string {
+	return fmt.Sprintf("%s%d.qcow2", stickyImagePrefix(pvcNamespace, pvcName), capacity)
+}
+
+// Returns the capacity of the volume that left the given image behind if it is the sticky image of a PVC with the given
+// namespace and name, or false otherwise.
+func ParseStickyImageName(name string, pvcNamespace string, pvcName string) (int64, bool) {
+	prefix := stickyImagePrefix(pvcNamespace, pvcName)
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".qcow2") {
+		return 0, false
+	}
+
+	capacity, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".qcow2"), 10, 64)
+	if err != nil || capacity <= 0 {
+		return 0, false
+	}
+	return capacity, true
+}
+
+// Glob pattern matching the sticky images of a PVC with the given namespace and name, whatever their capacity.
+func StickyImagePattern(pvcNamespace string, pvcName string) string {
+	return stickyImagePrefix(pvcNamespace, pvcName) + "*.qcow2"
+}
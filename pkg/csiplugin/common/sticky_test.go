@@ -0,0 +1,25 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStickyImageName(t *testing.T) {
+	name := GenerateStickyImageName("ns", "data", 1<<30)
+
+	if capacity, ok := ParseStickyImageName(name, "ns", "data"); !ok || capacity != 1<<30 {
+		t.Errorf("ParseStickyImageName(%q): got (%d, %v)", name, capacity, ok)
+	}
+	if _, ok := ParseStickyImageName(name, "ns", "other"); ok {
+		t.Errorf("ParseStickyImageName(%q) for another PVC: unexpectedly ok", name)
+	}
+	if _, ok := ParseStickyImageName(GenerateVolumeImageName("uid"), "ns", "data"); ok {
+		t.Errorf("ParseStickyImageName() of a volume image: unexpectedly ok")
+	}
+	if !strings.HasPrefix(name, strings.TrimSuffix(StickyImagePattern("ns", "data"), "*.qcow2")) {
+		t.Errorf("StickyImagePattern() doesn't match %q", name)
+	}
+}
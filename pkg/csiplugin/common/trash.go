@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Deleted volumes whose StorageClass has a "trashRetention" parameter are moved to the trash of their backing volume
+// instead of being removed: their image is renamed to "trash-<uid>-<expiry>.qcow2" in place, where <expiry> is the Unix
+// time at which it may be purged, so that its backing chain stays intact, and a "trash-<uid>-<expiry>.json" file next
+// to it holds a TrashedVolume describing how to recreate the volume's PVC and PV.
+
+// Parses the "trashRetention" StorageClass parameter, for how long the images of deleted volumes are kept in the trash.
+// Returns 0 if it isn't set, in which case deleted volumes are removed right away.
+func ParseTrashRetention(parameters map[string]string) (time.Duration, error) {
+	value := parameters["trashRetention"]
+	if value == "" {
+		return 0, nil
+	}
+
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return 0, status.Errorf(
+			codes.InvalidArgument, "parameter \"trashRetention\" must be a non-negative duration, e.g., \"72h\"",
+		)
+	}
+	return retention, nil
+}
+
+// Name of the image of a deleted volume in the trash, relative to the base path of its backing volume.
+func GenerateTrashImageName(volumeId types.UID, expiresAt time.Time) string {
+	return fmt.Sprintf("trash-%s-%d.qcow2", volumeId, expiresAt.Unix())
+}
+
+// Name of the file describing a trashed volume, given the name of its image in the trash.
+func TrashMetadataName(trashImageName string) string {
+	return strings.TrimSuffix(trashImageName, ".qcow2") + ".json"
+}
+
+// Parses the name of an image in the trash (see GenerateTrashImageName), returning false if it isn't one.
+func ParseTrashImageName(name string) (volumeId types.UID, expiresAt time.Time, ok bool) {
+	if !strings.HasPrefix(name, "trash-") || !strings.HasSuffix(name, ".qcow2") {
+		return "", time.Time{}, false
+	}
+
+	rest := strings.TrimSuffix(strings.TrimPrefix(name, "trash-"), ".qcow2")
+	separator := strings.LastIndex(rest, "-")
+	if separator <= 0 {
+		return "", time.Time{}, false
+	}
+
+	seconds, err := strconv.ParseInt(rest[separator+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return types.UID(rest[:separator]), time.Unix(seconds, 0), true
+}
+
+// What is needed to recreate the PVC and PV of a volume in the trash.
+type TrashedVolume struct {
+	VolumeBundleEntry `json:",inline"`
+
+	Namespace        string `json:"namespace"`
+	StorageClassName string `json:"storageClassName"`
+
+	// The volume attributes of the volume's PV, and those of its annotations that belong to the driver.
+	VolumeAttributes map[string]string `json:"volumeAttributes,omitempty"`
+	PvAnnotations    map[string]string `json:"pvAnnotations,omitempty"`
+}
+
+func ParseTrashedVolume(data []byte) (*TrashedVolume, error) {
+	var trashed TrashedVolume
+	err := json.Unmarshal(data, &trashed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trashed volume description: %w", err)
+	}
+
+	if trashed.VolumeId == "" || trashed.Name == "" || trashed.Namespace == "" || trashed.Capacity <= 0 ||
+		len(trashed.AccessModes) == 0 {
+		return nil, fmt.Errorf("invalid trashed volume description: incomplete")
+	}
+
+	return &trashed, nil
+}
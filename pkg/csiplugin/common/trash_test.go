@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTrashImageName(t *testing.T) {
+	expiresAt := time.Unix(1700000000, 0)
+	name := GenerateTrashImageName("0b7c-42", expiresAt)
+
+	if name != "trash-0b7c-42-1700000000.qcow2" {
+		t.Fatalf("got name %q", name)
+	}
+	if metadata := TrashMetadataName(name); metadata != "trash-0b7c-42-1700000000.json" {
+		t.Errorf("got metadata name %q", metadata)
+	}
+
+	volumeId, parsedExpiresAt, ok := ParseTrashImageName(name)
+	if !ok || volumeId != "0b7c-42" || !parsedExpiresAt.Equal(expiresAt) {
+		t.Errorf("ParseTrashImageName(%q): got (%q, %v, %v)", name, volumeId, parsedExpiresAt, ok)
+	}
+
+	for _, other := range []string{"pvc-0b7c.qcow2", "trash-0b7c.qcow2", "trash--1.qcow2", "trash-0b7c-x.qcow2"} {
+		if _, _, ok := ParseTrashImageName(other); ok {
+			t.Errorf("ParseTrashImageName(%q): unexpectedly ok", other)
+		}
+	}
+}
+
+func TestParseTrashRetention(t *testing.T) {
+	tests := []struct {
+		value    string
+		want     time.Duration
+		wantCode codes.Code
+	}{
+		{"", 0, codes.OK},
+		{"72h", 72 * time.Hour, codes.OK},
+		{"0s", 0, codes.OK},
+		{"-1h", 0, codes.InvalidArgument},
+		{"3 days", 0, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		got, err := ParseTrashRetention(map[string]string{"trashRetention": test.value})
+		if code := status.Code(err); code != test.wantCode || got != test.want {
+			t.Errorf("%q: got (%v, %v), want (%v, %v)", test.value, got, code, test.want, test.wantCode)
+		}
+	}
+}
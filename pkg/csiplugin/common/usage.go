@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long the Job that measures the usage of a backing volume may take before it is given up on.
+const backingUsageMeasurementTimeout = 5 * time.Minute
+
+var backingUsageMeasurementBackoffLimit int32 = 1
+
+// Size and used space of the file system of a backing volume, in bytes.
+type BackingUsage struct {
+	Size int64
+	Used int64
+}
+
+// The share of the file system that is used, between 0 and 1.
+func (u BackingUsage) UsedFraction() float64 {
+	if u.Size <= 0 {
+		return 1
+	}
+	return float64(u.Used) / float64(u.Size)
+}
+
+// Measures the usage of the file system of the backing volume by running a Job that mounts it.
+func MeasureBackingUsage(
+	ctx context.Context,
+	clientset *Clientset,
+	image string,
+	location BackingLocation,
+) (BackingUsage, error) {
+	jobName := NamePrefix + "-usage-" + location.hash()
+
+	err := CreateJob(
+		ctx, clientset,
+		JobConfig{
+			Name:      jobName,
+			Namespace: location.PvcNamespace,
+			Labels: map[string]string{
+				Domain + "/component": "backing-usage-measurement",
+			},
+			Image:              image,
+			Command:            []string{"bash", "-c", "df --block-size=1 --output=size,used /var/backing | tail -n 1"},
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			BackoffLimit:       &backingUsageMeasurementBackoffLimit,
+		},
+	)
+	if err != nil {
+		return BackingUsage{}, err
+	}
+
+	err = WaitForJobToSucceedWithin(ctx, clientset, jobName, location.PvcNamespace, backingUsageMeasurementTimeout)
+	if err != nil {
+		_ = DeleteJobSynchronously(ctx, clientset, jobName, location.PvcNamespace)
+		return BackingUsage{}, err
+	}
+
+	output, err := GetJobLogs(ctx, clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return BackingUsage{}, err
+	}
+
+	err = DeleteJobSynchronously(ctx, clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return BackingUsage{}, err
+	}
+
+	return parseBackingUsage(string(output))
+}
+
+// Parses the "<size> <used>" line output by df.
+func parseBackingUsage(output string) (BackingUsage, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return BackingUsage{}, fmt.Errorf("unexpected df output: %q", output)
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return BackingUsage{}, fmt.Errorf("unexpected df output: %q", output)
+	}
+
+	used, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return BackingUsage{}, fmt.Errorf("unexpected df output: %q", output)
+	}
+
+	return BackingUsage{Size: size, Used: used}, nil
+}
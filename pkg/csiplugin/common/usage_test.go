@@ -0,0 +1,24 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import "testing"
+
+func TestParseBackingUsage(t *testing.T) {
+	usage, err := parseBackingUsage("   10737418240    2147483648\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage != (BackingUsage{Size: 10737418240, Used: 2147483648}) {
+		t.Errorf("got %+v", usage)
+	}
+	if usage.UsedFraction() != 0.2 {
+		t.Errorf("got used fraction %v", usage.UsedFraction())
+	}
+
+	for _, output := range []string{"", "1B 2B", "1 2 3", "Filesystem 1B-blocks"} {
+		if _, err := parseBackingUsage(output); err == nil {
+			t.Errorf("%q: expected error", output)
+		}
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"github.com/kubernetes-csi/external-snapshotter/client/v6/clientset/versioned"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -17,9 +19,14 @@ type SnapshotClientSet = versioned.Clientset
 type Clientset struct {
 	*kubernetes.Clientset
 	*SnapshotClientSet
+	Dynamic dynamic.Interface // for our own custom resources
 }
 
+// Waits until the file exists and is a block device. There is no way to be notified of that, so the file is checked
+// repeatedly, at first often, as the device usually appears soon, and then every couple of seconds.
 func WaitUntilFileIsBlockDevice(ctx context.Context, name string) error {
+	backoff := wait.Backoff{Duration: 100 * time.Millisecond, Factor: 2, Steps: 10, Cap: 2 * time.Second}
+
 	for {
 		if stat, err := os.Stat(name); err == nil {
 			// file exists
@@ -29,10 +36,12 @@ func WaitUntilFileIsBlockDevice(ctx context.Context, name string) error {
 			}
 		} else if !errors.Is(err, os.ErrNotExist) {
 			return err // could not determine whether file exists and is a block device
-		} else if ctx.Err() != nil {
-			return ctx.Err() // file doesn't exist or isn't a block device but context is done
 		}
 
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err() // file doesn't exist or isn't a block device but context is done
+		case <-time.After(backoff.Step()):
+		}
 	}
 }
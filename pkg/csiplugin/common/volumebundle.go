@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var VolumeExportResource = schema.GroupVersionResource{
+	Group:    Group,
+	Version:  "v1alpha1",
+	Resource: "volumeexports",
+}
+
+var VolumeImportResource = schema.GroupVersionResource{
+	Group:    Group,
+	Version:  "v1alpha1",
+	Resource: "volumeimports",
+}
+
+// A bundle is a directory in a PVC holding a flattened image named "pvc-<uid>.qcow2" for each volume in it, where <uid>
+// is the volume's id, and "snapshot-<uid>.qcow2" for each snapshot, where <uid> is the VolumeSnapshot's uid, and a
+// "manifest.json" file with a VolumeBundleManifest describing them. Images in bundles in the raw format end in ".raw"
+// instead (see BundleFileName()).
+type VolumeBundleLocation struct {
+	// Name of the PVC holding the bundle, which must be in the same namespace as the backing PVC of the volumes.
+	ClaimName string `json:"claimName"`
+
+	// Directory in the PVC holding the bundle. Defaults to the PVC's root.
+	Path string `json:"path,omitempty"`
+}
+
+type VolumeBundleManifest struct {
+	// The format of the images in the bundle, ImageFormatQcow2 if empty.
+	Format    string                      `json:"format,omitempty"`
+	Volumes   []VolumeBundleEntry         `json:"volumes"`
+	Snapshots []VolumeBundleSnapshotEntry `json:"snapshots,omitempty"`
+}
+
+// What is needed to recreate a volume's PVC and PV.
+type VolumeBundleEntry struct {
+	VolumeId    string                              `json:"volumeId"`
+	Name        string                              `json:"name"`
+	Labels      map[string]string                   `json:"labels,omitempty"`
+	Capacity    int64                               `json:"capacity"`
+	AccessModes []corev1.PersistentVolumeAccessMode `json:"accessModes"`
+	VolumeMode  *corev1.PersistentVolumeMode        `json:"volumeMode,omitempty"`
+}
+
+func (e *VolumeBundleEntry) ImageName() string {
+	return fmt.Sprintf("pvc-%s.qcow2", e.VolumeId)
+}
+
+// A point-in-time image of a volume, which imports leave alone, for use outside of the cluster.
+type VolumeBundleSnapshotEntry struct {
+	SnapshotId    string `json:"snapshotId"`
+	Name          string `json:"name"`
+	SourcePvcName string `json:"sourcePvcName,omitempty"`
+	Size          int64  `json:"size"`
+}
+
+func (e *VolumeBundleSnapshotEntry) ImageName() string {
+	return fmt.Sprintf("snapshot-%s.qcow2", e.SnapshotId)
+}
+
+// Returns the name of the file in a bundle in the given format that holds the image with the given name.
+func BundleFileName(imageName string, format string) string {
+	if format == ImageFormatRaw {
+		return strings.TrimSuffix(imageName, ".qcow2") + ".raw"
+	}
+	return imageName
+}
+
+func ParseVolumeBundleManifest(data []byte) (*VolumeBundleManifest, error) {
+	var manifest VolumeBundleManifest
+	err := json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest: %w", err)
+	}
+
+	if manifest.Format != "" && manifest.Format != ImageFormatQcow2 && manifest.Format != ImageFormatRaw {
+		return nil, fmt.Errorf("invalid bundle manifest: unknown image format \"%s\"", manifest.Format)
+	}
+
+	for _, entry := range manifest.Volumes {
+		if entry.VolumeId == "" || entry.Name == "" || entry.Capacity <= 0 || len(entry.AccessModes) == 0 {
+			return nil, fmt.Errorf("invalid bundle manifest: incomplete entry for volume \"%s\"", entry.VolumeId)
+		}
+	}
+
+	for _, entry := range manifest.Snapshots {
+		if entry.SnapshotId == "" || entry.Name == "" || entry.Size <= 0 {
+			return nil, fmt.Errorf("invalid bundle manifest: incomplete entry for snapshot \"%s\"", entry.SnapshotId)
+		}
+	}
+
+	return &manifest, nil
+}
+
+// Exports the given PVCs and VolumeSnapshots, which must be in the same namespace as the VolumeExport, to a bundle.
+type VolumeExport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VolumeExportSpec   `json:"spec"`
+	Status VolumeBundleStatus `json:"status,omitempty"`
+}
+
+type VolumeExportSpec struct {
+	PvcNames      []string             `json:"pvcNames,omitempty"`
+	SnapshotNames []string             `json:"snapshotNames,omitempty"`
+	Target        VolumeBundleLocation `json:"target"`
+
+	// The format of the images in the bundle, ImageFormatQcow2 if empty.
+	Format string `json:"format,omitempty"`
+}
+
+// Recreates the PVCs and PVs of the volumes in a bundle in the namespace of the VolumeImport, placing the volumes in
+// the backing volume of the given StorageClass.
+type VolumeImport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VolumeImportSpec   `json:"spec"`
+	Status VolumeBundleStatus `json:"status,omitempty"`
+}
+
+type VolumeImportSpec struct {
+	StorageClassName string               `json:"storageClassName"`
+	Source           VolumeBundleLocation `json:"source"`
+}
+
+type VolumeBundleStatus struct {
+	// "Completed" or "Failed" once done, otherwise empty.
+	Phase          string       `json:"phase,omitempty"`
+	Message        string       `json:"message,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+func (s *VolumeBundleStatus) Done() bool {
+	return s.Phase == "Completed" || s.Phase == "Failed"
+}
+
+func ListVolumeExports(ctx context.Context, clientset *Clientset) ([]VolumeExport, error) {
+	list, err := clientset.Dynamic.Resource(VolumeExportResource).
+		Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	exports := make([]VolumeExport, len(list.Items))
+	for i := range list.Items {
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(list.Items[i].Object, &exports[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return exports, nil
+}
+
+func ListVolumeImports(ctx context.Context, clientset *Clientset) ([]VolumeImport, error) {
+	list, err := clientset.Dynamic.Resource(VolumeImportResource).
+		Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	imports := make([]VolumeImport, len(list.Items))
+	for i := range list.Items {
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(list.Items[i].Object, &imports[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return imports, nil
+}
+
+func UpdateVolumeExportStatus(ctx context.Context, clientset *Clientset, export *VolumeExport) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(export)
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.Dynamic.Resource(VolumeExportResource).Namespace(export.Namespace).
+		UpdateStatus(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	return err
+}
+
+func UpdateVolumeImportStatus(ctx context.Context, clientset *Clientset, volumeImport *VolumeImport) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(volumeImport)
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.Dynamic.Resource(VolumeImportResource).Namespace(volumeImport.Namespace).
+		UpdateStatus(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	return err
+}
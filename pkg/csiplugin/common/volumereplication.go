@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var VolumeReplicationResource = schema.GroupVersionResource{
+	Group:    Group,
+	Version:  "v1alpha1",
+	Resource: "volumereplications",
+}
+
+type VolumeReplication struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VolumeReplicationSpec   `json:"spec"`
+	Status VolumeReplicationStatus `json:"status,omitempty"`
+}
+
+type VolumeReplicationSpec struct {
+	// Name of the PVC to replicate, in the same namespace as the VolumeReplication.
+	PvcName string `json:"pvcName"`
+
+	// Minimum time between replications, as a Go duration string (e.g., "1h").
+	Interval metav1.Duration `json:"interval"`
+
+	Target VolumeReplicationTarget `json:"target"`
+
+	// Maximum duration of each replication, as a Go duration string. Replications that take longer are aborted and
+	// retried. Defaults to DefaultVolumeReplicationTimeout.
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// Created through the csi-addons replication API rather than by the user, and removed when replication is
+	// disabled through it.
+	Managed bool `json:"managed,omitempty"`
+}
+
+// The replica is stored under "<path>/pvc-<uid>/" in the target PVC, which must be in the same namespace as the
+// volume's backing PVC. The target PVC will usually be a volume shared with another cluster (e.g., an NFS export of
+// that cluster's backing volume) or backed by an object store.
+type VolumeReplicationTarget struct {
+	ClaimName string `json:"claimName"`
+	Path      string `json:"path,omitempty"`
+
+	// The <uid> above, i.e., the volume id of the replication's source volume. Defaults to that of the replicated
+	// volume, but must be set for replication secondaries that aren't the same volume as their primary (e.g., because
+	// they were provisioned separately in another cluster) for resyncing them to find the primary's replica.
+	VolumeId string `json:"volumeId,omitempty"`
+}
+
+// Returns the directory holding the replica in the target, relative to its path.
+func (t *VolumeReplicationTarget) ReplicaDirectory(pvcUid types.UID) string {
+	if t.VolumeId != "" {
+		return fmt.Sprintf("pvc-%s", t.VolumeId)
+	}
+	return fmt.Sprintf("pvc-%s", pvcUid)
+}
+
+const DefaultVolumeReplicationTimeout = 6 * time.Hour
+
+func (s *VolumeReplicationSpec) TimeoutOrDefault() time.Duration {
+	if s.Timeout == nil || s.Timeout.Duration <= 0 {
+		return DefaultVolumeReplicationTimeout
+	}
+	return s.Timeout.Duration
+}
+
+type VolumeReplicationStatus struct {
+	LastSyncTime     *metav1.Time `json:"lastSyncTime,omitempty"`
+	LastSyncSequence int64        `json:"lastSyncSequence,omitempty"`
+	LastSyncError    string       `json:"lastSyncError,omitempty"`
+}
+
+func ListVolumeReplications(ctx context.Context, clientset *Clientset) ([]VolumeReplication, error) {
+	list, err := clientset.Dynamic.Resource(VolumeReplicationResource).
+		Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	replications := make([]VolumeReplication, len(list.Items))
+	for i := range list.Items {
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(list.Items[i].Object, &replications[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return replications, nil
+}
+
+func GetVolumeReplication(
+	ctx context.Context,
+	clientset *Clientset,
+	name string,
+	namespace string,
+) (*VolumeReplication, error) {
+	obj, err := clientset.Dynamic.Resource(VolumeReplicationResource).Namespace(namespace).
+		Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var replication VolumeReplication
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &replication)
+	if err != nil {
+		return nil, err
+	}
+
+	return &replication, nil
+}
+
+// Idempotent. Succeeds without modifying the existing object if one with the same name already exists.
+func CreateVolumeReplication(ctx context.Context, clientset *Clientset, replication *VolumeReplication) error {
+	replication.APIVersion = VolumeReplicationResource.GroupVersion().String()
+	replication.Kind = "VolumeReplication"
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(replication)
+	if err != nil {
+		return err
+	}
+	delete(obj, "status")
+
+	_, err = clientset.Dynamic.Resource(VolumeReplicationResource).Namespace(replication.Namespace).
+		Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Idempotent. Succeeds immediately if the object no longer exists.
+func DeleteVolumeReplication(ctx context.Context, clientset *Clientset, name string, namespace string) error {
+	err := clientset.Dynamic.Resource(VolumeReplicationResource).Namespace(namespace).
+		Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+func UpdateVolumeReplicationStatus(
+	ctx context.Context,
+	clientset *Clientset,
+	replication *VolumeReplication,
+) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(replication)
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.Dynamic.Resource(VolumeReplicationResource).Namespace(replication.Namespace).
+		UpdateStatus(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	return err
+}
@@ -4,10 +4,10 @@ package common
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
+	"fmt"
 
 	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -25,27 +25,30 @@ func FindVolumeSnapshotByLabelSelector(
 
 	switch len(list.Items) {
 	case 0:
-		return nil, errors.New("no objects found")
+		return nil, errNoObjectsFound("volumesnapshots", labelSelector)
 	case 1:
-		return &list.Items[0], nil
+		volumeSnapshot := &list.Items[0]
+		if _, err := ConvertState(&volumeSnapshot.ObjectMeta); err != nil {
+			return nil, err
+		}
+		return volumeSnapshot, nil
 	default:
-		return nil, errors.New("more than one object found")
+		return nil, errMoreThanOneObjectFound("volumesnapshots", labelSelector)
 	}
 }
 
-func MergePatchVolumeSnapshot(
+// Returns the PVCs whose volumes were created from the snapshot with the given uid and still exist. Their images are
+// backed by the snapshot's image, which must thus be kept around while they exist.
+func ListSnapshotDependents(
 	ctx context.Context,
 	clientset *Clientset,
-	volumeSnapshotName string,
-	volumeSnapshotNamespace string,
-	patch volumesnapshotv1.VolumeSnapshot,
-) error {
-	jsonPatch, err := json.Marshal(patch)
+	volumeSnapshotUid types.UID,
+) ([]corev1.PersistentVolumeClaim, error) {
+	list, err := clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s/source-snapshot-uid=%s", Domain, volumeSnapshotUid)})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = clientset.SnapshotV1().VolumeSnapshots(volumeSnapshotNamespace).
-		Patch(ctx, volumeSnapshotName, types.MergePatchType, jsonPatch, metav1.PatchOptions{})
-	return err
+	return list.Items, nil
 }
@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+// Watches the object with the given name until done returns true or an error, calling it with the current version of
+// the object whenever it changes, or with nil while the object doesn't exist. The watch is restricted to that one
+// object and reestablished (with backoff) if it breaks. Fails with the context's error if it is done first.
+func watchObject(
+	ctx context.Context,
+	client cache.Getter,
+	resource string,
+	namespace string,
+	name string,
+	objType runtime.Object,
+	done func(object runtime.Object) (bool, error),
+) error {
+	lw := cache.NewListWatchFromClient(client, resource, namespace, fields.OneTermEqualSelector("metadata.name", name))
+
+	precondition := func(store cache.Store) (bool, error) {
+		objects := store.List()
+		if len(objects) == 0 {
+			return done(nil)
+		}
+		return done(objects[0].(runtime.Object))
+	}
+
+	_, err := watchtools.UntilWithSync(ctx, lw, objType, precondition, func(event watch.Event) (bool, error) {
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			return done(event.Object)
+		case watch.Deleted:
+			return done(nil)
+		default:
+			return false, nil
+		}
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Waits until the object with the given name no longer exists.
+func waitForObjectDeletion(
+	ctx context.Context,
+	client cache.Getter,
+	resource string,
+	namespace string,
+	name string,
+	objType runtime.Object,
+) error {
+	return watchObject(ctx, client, resource, namespace, name, objType, func(object runtime.Object) (bool, error) {
+		return object == nil, nil
+	})
+}
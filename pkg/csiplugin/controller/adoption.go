@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Re-links retained volumes to the PVCs that their PVs are later bound to.
+//
+// When a PVC whose PV has reclaim policy Retain is deleted, the volume's image is kept (see pvcDeletionController).
+// Once an administrator makes the PV available again and it is bound to a new PVC, the new PVC lacks the labels,
+// annotations, and finalizer that the plugin relies on. This controller adds them, keying the volume by the UID of the
+// PVC it was originally created for, which is also the PV's volume handle.
+type adoptionController struct {
+	clientset *common.Clientset
+}
+
+func (c *adoptionController) run(stopCh chan struct{}) {
+	wait.Until(c.adoptRetainedVolumes, 30*time.Second, stopCh)
+}
+
+func (c *adoptionController) adoptRetainedVolumes() {
+	ctx := context.Background() // TODO
+
+	pvs, err := c.clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != common.Domain || pv.Status.Phase != corev1.VolumeBound ||
+			pv.Spec.ClaimRef == nil {
+			continue
+		}
+
+		err := c.adopt(ctx, pv)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to adopt volume", "volume", pv.Spec.CSI.VolumeHandle,
+				"pvc", klog.KRef(pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name),
+			)
+		}
+	}
+}
+
+func (c *adoptionController) adopt(ctx context.Context, pv *corev1.PersistentVolume) error {
+	volumeUid := pv.Spec.CSI.VolumeHandle
+
+	pvc, err := c.clientset.CoreV1().PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).
+		Get(ctx, pv.Spec.ClaimRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if pvc.UID != pv.Spec.ClaimRef.UID || pvc.DeletionTimestamp != nil ||
+		pvc.Labels[common.Domain+"/uid"] == volumeUid {
+		return nil // bound to another PVC in the meantime, being deleted, or nothing to do
+	}
+
+	// The PVC that the volume previously belonged to may still be around if it is in the process of being deleted.
+
+	previous, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s/uid=%s", common.Domain, volumeUid)})
+	if err != nil {
+		return err
+	}
+	if len(previous.Items) > 0 {
+		return fmt.Errorf(
+			"volume still belongs to PVC %s in namespace %s", previous.Items[0].Name, previous.Items[0].Namespace,
+		)
+	}
+
+	klog.InfoS("Adopting volume", "volume", volumeUid, "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+
+	capacity := pv.Spec.Capacity[corev1.ResourceStorage]
+	attributes := pv.Spec.CSI.VolumeAttributes
+
+	// the volume may have been migrated to another backing volume since its PV was created (see drainController)
+	location := common.BackingLocation{
+		PvcName:      attributes["backingPvcName"],
+		PvcNamespace: attributes["backingPvcNamespace"],
+		BasePath:     attributes["backingPvcBasePath"],
+	}
+	if pv.Annotations[common.Domain+"/backing-pvc-name"] != "" {
+		location = common.BackingLocationOf(&pv.ObjectMeta)
+	}
+
+	annotations := map[string]string{
+		common.Domain + "/backing-pvc-name":      location.PvcName,
+		common.Domain + "/backing-pvc-namespace": location.PvcNamespace,
+		common.Domain + "/backing-pvc-base-path": location.BasePath,
+		common.Domain + "/capacity":              strconv.FormatInt(capacity.Value(), 10),
+		common.Domain + "/state":                 "idle",
+	}
+	for key, value := range common.StateVersionAnnotations() {
+		annotations[key] = value
+	}
+	if mirrorBackingPvcName := attributes["mirrorBackingPvcName"]; mirrorBackingPvcName != "" {
+		annotations[common.Domain+"/mirror-backing-pvc-name"] = mirrorBackingPvcName
+		annotations[common.Domain+"/mirror-degraded"] = pv.Annotations[common.Domain+"/mirror-degraded"]
+	}
+	if format := attributes["format"]; format != "" {
+		annotations[common.Domain+"/format"] = format
+	}
+
+	return common.ApplyPvcMetadata(
+		ctx, c.clientset, pvc.Name, pvc.Namespace,
+		metav1.ObjectMeta{
+			Labels: map[string]string{
+				common.Domain + "/uid": volumeUid,
+			},
+			Annotations: annotations,
+			Finalizers:  []string{common.Domain + "/cleanup"},
+		},
+	)
+}
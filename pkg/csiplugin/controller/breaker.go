@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/metrics"
+	"google.golang.org/grpc/codes"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// Number of consecutive failures of volume creation jobs in a backing volume after which it is considered unhealthy.
+const backingStoreFailureThreshold = 3
+
+// How long no new volumes are created in an unhealthy backing volume before trying again.
+const backingStoreCooldown = 5 * time.Minute
+
+var backingStoreUnhealthy = metrics.Default.NewGaugeVec(
+	"subprovisioner_backing_store_unhealthy",
+	"Whether volume creation in a backing volume is currently suspended because its jobs kept failing.",
+	"backing_pvc_namespace", "backing_pvc_name",
+)
+
+// Tracks failures of volume creation jobs and of probes (see backingStoreProbeController) per backing volume, and fails
+// volume creation in backing volumes whose jobs keep failing (e.g., because the backing volume can't be mounted or is
+// out of space) for a while, instead of piling up more failing jobs. Once the cooldown expires, a single failure makes the backing volume unhealthy again, while a
+// success makes it healthy.
+type backingStoreBreaker struct {
+	mutex  sync.Mutex
+	stores map[string]*backingStoreHealth // keyed by "<namespace>/<name>" of the backing PVC
+}
+
+type backingStoreHealth struct {
+	failures    int
+	lastFailure string
+	openUntil   time.Time
+}
+
+// Returns an error if no volumes should be created in the given backing volume right now.
+func (b *backingStoreBreaker) check(key string, now time.Time) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	health := b.stores[key]
+	if health == nil || !now.Before(health.openUntil) {
+		return nil
+	}
+
+	retryAt := health.openUntil.UTC().Format(time.RFC3339)
+
+	return common.ErrorWithReason(
+		codes.Unavailable, common.ReasonBackingStoreUnhealthy,
+		map[string]string{"backingVolume": key, "retryAt": retryAt},
+		"backing volume %s is unhealthy after %d consecutive failures (last: %s); not creating volumes in it until %s",
+		key, health.failures, health.lastFailure, retryAt,
+	)
+}
+
+// Records a failure in the given backing volume. Returns true if this made the backing volume unhealthy.
+func (b *backingStoreBreaker) recordFailure(key string, reason string, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.stores == nil {
+		b.stores = map[string]*backingStoreHealth{}
+	}
+
+	health := b.stores[key]
+	if health == nil {
+		health = &backingStoreHealth{}
+		b.stores[key] = health
+	}
+
+	health.failures++
+	health.lastFailure = reason
+
+	if health.failures < backingStoreFailureThreshold || now.Before(health.openUntil) {
+		return false
+	}
+
+	health.openUntil = now.Add(backingStoreCooldown)
+	return true
+}
+
+// Records a success in the given backing volume. Returns true if the backing volume was unhealthy until now.
+func (b *backingStoreBreaker) recordSuccess(key string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	health := b.stores[key]
+	if health == nil {
+		return false
+	}
+
+	delete(b.stores, key)
+	return health.failures >= backingStoreFailureThreshold
+}
+
+// Like common.WaitForJobToSucceed, but records the outcome of the volume creation job with the breaker of the backing
+// volume it runs in. If the job's pod keeps failing until the backing volume is considered unhealthy, the job is
+// deleted and an error is returned, so that creation starts over once the backing volume has recovered. Each failure of
+// the job's pod, and the job's success, are also reported through Events, like waitForJob() does.
+func (s *ControllerServer) waitForCreationJob(
+	ctx context.Context,
+	events jobEvents,
+	jobName string,
+	backingPvcName string,
+	backingPvcNamespace string,
+) error {
+	key := backingPvcNamespace + "/" + backingPvcName
+	seenFailures := int32(-1) // failures before we started waiting were already recorded by whoever saw them
+
+	// TODO: Watch instead of polling.
+	for {
+		job, err := s.Clientset.BatchV1().Jobs(backingPvcNamespace).Get(ctx, jobName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if job.Status.Succeeded > 0 {
+			if s.backingStores.recordSuccess(key) {
+				s.reportBackingStoreHealth(ctx, backingPvcName, backingPvcNamespace, "")
+			}
+			// a job that had already succeeded, e.g., because the request is retried, was already reported
+			if seenFailures >= 0 {
+				s.reportJobSuccess(ctx, events, jobName, backingPvcNamespace)
+			}
+			return nil
+		}
+
+		if seenFailures < 0 {
+			seenFailures = job.Status.Failed
+		}
+
+		for ; seenFailures < job.Status.Failed; seenFailures++ {
+			s.reportJobFailure(ctx, events, jobName, backingPvcNamespace)
+
+			reason := fmt.Sprintf("job %s failed", jobName)
+			if logs, err := common.GetJobLogs(ctx, s.Clientset, jobName, backingPvcNamespace); err == nil {
+				if lines := bytes.Split(bytes.TrimSpace(logs), []byte("\n")); len(lines[len(lines)-1]) > 0 {
+					reason = fmt.Sprintf("%s: %s", reason, lines[len(lines)-1])
+				}
+			}
+
+			if s.backingStores.recordFailure(key, reason, time.Now()) {
+				s.reportBackingStoreHealth(ctx, backingPvcName, backingPvcNamespace, reason)
+			}
+		}
+
+		if err := s.backingStores.check(key, time.Now()); err != nil {
+			deleteErr := common.DeleteJobSynchronously(context.Background(), s.Clientset, jobName, backingPvcNamespace)
+			if deleteErr != nil {
+				klog.ErrorS(deleteErr, "Failed to delete Job", "job", klog.KRef(backingPvcNamespace, jobName))
+			}
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// Updates the backing store health metric and emits an Event on the backing PVC. An empty reason means the backing
+// volume recovered. Failures are only logged, as this is best-effort.
+func (s *ControllerServer) reportBackingStoreHealth(
+	ctx context.Context, backingPvcName string, backingPvcNamespace string, reason string,
+) {
+	if reason != "" {
+		klog.ErrorS(
+			nil, "Backing PVC is unhealthy", "backingPvc", klog.KRef(backingPvcNamespace, backingPvcName),
+			"reason", reason,
+		)
+		backingStoreUnhealthy.Set(1, backingPvcNamespace, backingPvcName)
+	} else {
+		klog.InfoS("Backing PVC is healthy again", "backingPvc", klog.KRef(backingPvcNamespace, backingPvcName))
+		backingStoreUnhealthy.Set(0, backingPvcNamespace, backingPvcName)
+	}
+
+	backingPvc, err := s.Clientset.CoreV1().PersistentVolumeClaims(backingPvcNamespace).
+		Get(ctx, backingPvcName, metav1.GetOptions{})
+	if err == nil && reason != "" {
+		err = common.EmitEvent(
+			ctx, s.Clientset, common.PvcEventObject(backingPvc), corev1.EventTypeWarning, "BackingStoreUnhealthy",
+			"Not creating volumes in this backing volume for %v after %d consecutive failures: %s",
+			backingStoreCooldown, backingStoreFailureThreshold, reason,
+		)
+	} else if err == nil {
+		err = common.EmitEvent(
+			ctx, s.Clientset, common.PvcEventObject(backingPvc), corev1.EventTypeNormal, "BackingStoreHealthy",
+			"Volumes are being created in this backing volume successfully again",
+		)
+	}
+	if err != nil {
+		klog.ErrorS(err, "Failed to emit event", "backingPvc", klog.KRef(backingPvcNamespace, backingPvcName))
+	}
+}
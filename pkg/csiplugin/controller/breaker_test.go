@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackingStoreBreaker(t *testing.T) {
+	var b backingStoreBreaker
+	now := time.Now()
+
+	for i := 1; i < backingStoreFailureThreshold; i++ {
+		if b.recordFailure("ns/a", "mount failed", now) {
+			t.Fatalf("unhealthy after %d failures", i)
+		}
+	}
+	if err := b.check("ns/a", now); err != nil {
+		t.Fatalf("failed below threshold: %v", err)
+	}
+
+	if !b.recordFailure("ns/a", "mount failed", now) {
+		t.Fatal("not unhealthy at threshold")
+	}
+	if err := b.check("ns/a", now); err == nil {
+		t.Fatal("didn't fail when unhealthy")
+	}
+	if err := b.check("ns/b", now); err != nil {
+		t.Fatalf("other backing volume affected: %v", err)
+	}
+
+	// further failures during the cooldown don't report it again
+
+	if b.recordFailure("ns/a", "mount failed", now.Add(time.Second)) {
+		t.Fatal("reported unhealthy twice")
+	}
+
+	// after the cooldown, one attempt is let through, and a single failure suffices to suspend creation again
+
+	afterCooldown := now.Add(backingStoreCooldown + time.Second)
+	if err := b.check("ns/a", afterCooldown); err != nil {
+		t.Fatalf("failed after cooldown: %v", err)
+	}
+	if !b.recordFailure("ns/a", "mount failed", afterCooldown) {
+		t.Fatal("not unhealthy again after failing after cooldown")
+	}
+
+	// success makes it healthy
+
+	if !b.recordSuccess("ns/a") {
+		t.Fatal("recovery not reported")
+	}
+	if err := b.check("ns/a", afterCooldown); err != nil {
+		t.Fatalf("failed after success: %v", err)
+	}
+	if b.recordSuccess("ns/a") || b.recordSuccess("ns/b") {
+		t.Fatal("recovery of healthy backing volume reported")
+	}
+}
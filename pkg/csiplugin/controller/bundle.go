@@ -0,0 +1,649 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Carries out VolumeExports and VolumeImports, which move volumes between clusters through bundles (see
+// common.VolumeBundleLocation) in a PVC that both clusters can access, e.g., an NFS export.
+//
+// Exporting a volume flattens its image into the bundle while keeping the volume in the "exporting" state, so volumes
+// are only exported while not staged, and are retried until they are. Snapshot images never change, so snapshots are
+// exported as soon as they are ready to use. The manifest is written last, so a bundle is complete once it has one.
+// Importing copies the images into the StorageClass' backing volume and creates a PV for each volume, with the same
+// volume id, that is pre-bound to a new PVC with the volume's original name; adoptionController then takes over as for
+// retained volumes.
+type bundleController struct {
+	clientset *common.Clientset
+	image     string
+
+	mutex      sync.Mutex
+	inProgress map[types.UID]bool // by VolumeExport or VolumeImport UID
+}
+
+// How long copying a single volume to or from a bundle may take.
+const bundleJobTimeout = 6 * time.Hour
+
+var bundleJobBackoffLimit int32 = 2
+
+// Returned while a volume to export is staged or busy, in which case the export is retried later.
+var errBundleVolumeBusy = errors.New("waiting for volumes to become idle")
+
+// Returned while a snapshot to export isn't ready to use, in which case the export is retried later.
+var errBundleSnapshotNotReady = errors.New("waiting for snapshots to become ready")
+
+// Returned for VolumeExports of volumes and VolumeImports into StorageClasses that belong to another instance of the
+// driver, which are left alone for that instance to carry out.
+var errBundleOtherDriver = errors.New("volumes belong to another driver")
+
+func (c *bundleController) run(stopCh chan struct{}) {
+	c.inProgress = map[types.UID]bool{}
+	wait.Until(c.startPending, 30*time.Second, stopCh)
+}
+
+func (c *bundleController) startPending() {
+	ctx := context.Background() // TODO
+
+	exports, err := common.ListVolumeExports(ctx, c.clientset)
+	if err != nil {
+		runtime.HandleError(err)
+	} else {
+		for i := range exports {
+			export := &exports[i]
+			c.start(export.UID, &export.Status, func() error {
+				return c.export(ctx, export)
+			}, func() error {
+				return common.UpdateVolumeExportStatus(ctx, c.clientset, export)
+			})
+		}
+	}
+
+	imports, err := common.ListVolumeImports(ctx, c.clientset)
+	if err != nil {
+		runtime.HandleError(err)
+	} else {
+		for i := range imports {
+			volumeImport := &imports[i]
+			c.start(volumeImport.UID, &volumeImport.Status, func() error {
+				return c.importBundle(ctx, volumeImport)
+			}, func() error {
+				return common.UpdateVolumeImportStatus(ctx, c.clientset, volumeImport)
+			})
+		}
+	}
+}
+
+// Runs do in the background unless the object is done or already in progress, and records the outcome in its status.
+func (c *bundleController) start(
+	uid types.UID,
+	bundleStatus *common.VolumeBundleStatus,
+	do func() error,
+	updateStatus func() error,
+) {
+	if bundleStatus.Done() {
+		return
+	}
+
+	c.mutex.Lock()
+	inProgress := c.inProgress[uid]
+	c.inProgress[uid] = true
+	c.mutex.Unlock()
+
+	if inProgress {
+		return
+	}
+
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			delete(c.inProgress, uid)
+			c.mutex.Unlock()
+		}()
+
+		message := bundleStatus.Message
+		err := do()
+
+		switch {
+		case errors.Is(err, errBundleOtherDriver):
+			return
+		case errors.Is(err, errBundleVolumeBusy), errors.Is(err, errBundleSnapshotNotReady):
+			bundleStatus.Message = err.Error()
+		case err != nil:
+			klog.ErrorS(err, "Failed to carry out volume bundle", "uid", uid)
+			now := metav1.Now()
+			bundleStatus.Phase = "Failed"
+			bundleStatus.Message = err.Error()
+			bundleStatus.CompletionTime = &now
+		default:
+			now := metav1.Now()
+			bundleStatus.Phase = "Completed"
+			bundleStatus.Message = ""
+			bundleStatus.CompletionTime = &now
+		}
+
+		if !bundleStatus.Done() && bundleStatus.Message == message {
+			return // avoid needless updates, as we retry often
+		}
+
+		err = updateStatus()
+		if err != nil {
+			runtime.HandleError(err)
+		}
+	}()
+}
+
+func (c *bundleController) export(ctx context.Context, export *common.VolumeExport) error {
+	format := export.Spec.Format
+	if format != "" && format != common.ImageFormatQcow2 && format != common.ImageFormatRaw {
+		return fmt.Errorf("unknown image format \"%s\"", format)
+	}
+	if len(export.Spec.PvcNames) == 0 && len(export.Spec.SnapshotNames) == 0 {
+		return fmt.Errorf("nothing to export")
+	}
+
+	manifest := common.VolumeBundleManifest{Format: format}
+	var backingPvcNamespace string
+
+	for _, pvcName := range export.Spec.PvcNames {
+		pvc, err := c.clientset.CoreV1().PersistentVolumeClaims(export.Namespace).
+			Get(ctx, pvcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if pvc.Labels[common.Domain+"/uid"] == "" {
+			if provisioner := pvc.Annotations["volume.kubernetes.io/storage-provisioner"]; provisioner != "" &&
+				provisioner != common.Domain {
+				return errBundleOtherDriver
+			}
+			return fmt.Errorf("PVC %s is not a Subprovisioner volume", pvcName)
+		}
+
+		location := common.BackingLocationOf(&pvc.ObjectMeta)
+		if backingPvcNamespace != "" && location.PvcNamespace != backingPvcNamespace {
+			return fmt.Errorf("the volumes' backing PVCs must all be in the same namespace")
+		}
+		backingPvcNamespace = location.PvcNamespace
+
+		entry, err := bundleEntryOf(pvc)
+		if err != nil {
+			return err
+		}
+
+		err = c.exportVolume(ctx, pvc, location, export.Spec.Target, format)
+		if err != nil {
+			return err
+		}
+
+		manifest.Volumes = append(manifest.Volumes, entry)
+	}
+
+	for _, volumeSnapshotName := range export.Spec.SnapshotNames {
+		volumeSnapshot, err := c.clientset.SnapshotV1().VolumeSnapshots(export.Namespace).
+			Get(ctx, volumeSnapshotName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		entry, err := c.bundleSnapshotEntryOf(ctx, volumeSnapshot)
+		if err != nil {
+			return err
+		}
+
+		location := common.BackingLocationOf(&volumeSnapshot.ObjectMeta)
+		if backingPvcNamespace != "" && location.PvcNamespace != backingPvcNamespace {
+			return fmt.Errorf("the volumes' backing PVCs must all be in the same namespace")
+		}
+		backingPvcNamespace = location.PvcNamespace
+
+		err = c.exportSnapshot(ctx, volumeSnapshot, location, export.Spec.Target, format)
+		if err != nil {
+			return err
+		}
+
+		manifest.Snapshots = append(manifest.Snapshots, entry)
+	}
+
+	manifestJson, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	script := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+		printf '%s\n' "$1" > /var/backing/manifest.json.tmp
+		mv -f /var/backing/manifest.json.tmp /var/backing/manifest.json
+		`,
+	)
+
+	_, err = c.runBundleJob(ctx, common.JobConfig{
+		Name:               common.GenerateBundleManifestJobName(export.UID),
+		Namespace:          backingPvcNamespace,
+		Command:            []string{"bash", "-c", script, "bash", string(manifestJson)},
+		BackingPvcName:     export.Spec.Target.ClaimName,
+		BackingPvcBasePath: export.Spec.Target.Path,
+	})
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS(
+		"Exported volumes and snapshots", "volumeExport", klog.KRef(export.Namespace, export.Name),
+		"volumes", len(manifest.Volumes), "snapshots", len(manifest.Snapshots),
+	)
+	return nil
+}
+
+// Describes the volume of the given PVC in a bundle manifest.
+func bundleEntryOf(pvc *corev1.PersistentVolumeClaim) (common.VolumeBundleEntry, error) {
+	capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]
+	if !ok {
+		return common.VolumeBundleEntry{}, fmt.Errorf("PVC %s is not bound", pvc.Name)
+	}
+
+	var labels map[string]string
+	for key, value := range pvc.Labels {
+		if key != common.Domain+"/uid" && key != common.Domain+"/source-snapshot-uid" &&
+			key != common.Domain+"/source-pvc-uid" {
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[key] = value
+		}
+	}
+
+	return common.VolumeBundleEntry{
+		VolumeId:    string(common.VolumeUidOf(pvc)),
+		Name:        pvc.Name,
+		Labels:      labels,
+		Capacity:    capacity.Value(),
+		AccessModes: pvc.Spec.AccessModes,
+		VolumeMode:  pvc.Spec.VolumeMode,
+	}, nil
+}
+
+// Describes the given VolumeSnapshot in a bundle manifest. Fails with errBundleSnapshotNotReady if it isn't ready to
+// use, and with errBundleOtherDriver if it belongs to another driver.
+func (c *bundleController) bundleSnapshotEntryOf(
+	ctx context.Context,
+	volumeSnapshot *volumesnapshotv1.VolumeSnapshot,
+) (common.VolumeBundleSnapshotEntry, error) {
+	snapshotStatus := volumeSnapshot.Status
+	if snapshotStatus == nil || snapshotStatus.ReadyToUse == nil || !*snapshotStatus.ReadyToUse {
+		return common.VolumeBundleSnapshotEntry{}, fmt.Errorf(
+			"%w: VolumeSnapshot %s is not ready to use", errBundleSnapshotNotReady, volumeSnapshot.Name,
+		)
+	}
+
+	if volumeSnapshot.Labels[common.Domain+"/uid"] == "" {
+		if snapshotStatus.BoundVolumeSnapshotContentName != nil {
+			content, err := c.clientset.SnapshotV1().VolumeSnapshotContents().
+				Get(ctx, *snapshotStatus.BoundVolumeSnapshotContentName, metav1.GetOptions{})
+			if err != nil {
+				return common.VolumeBundleSnapshotEntry{}, err
+			}
+			if content.Spec.Driver != common.Domain {
+				return common.VolumeBundleSnapshotEntry{}, errBundleOtherDriver
+			}
+		}
+		return common.VolumeBundleSnapshotEntry{}, fmt.Errorf(
+			"VolumeSnapshot %s is not a Subprovisioner snapshot", volumeSnapshot.Name,
+		)
+	}
+
+	size, err := strconv.ParseInt(volumeSnapshot.Annotations[common.Domain+"/size"], 10, 64)
+	if err != nil {
+		return common.VolumeBundleSnapshotEntry{}, fmt.Errorf(
+			"failed to determine size of VolumeSnapshot %s", volumeSnapshot.Name,
+		)
+	}
+
+	var sourcePvcName string
+	if volumeSnapshot.Spec.Source.PersistentVolumeClaimName != nil {
+		sourcePvcName = *volumeSnapshot.Spec.Source.PersistentVolumeClaimName
+	}
+
+	return common.VolumeBundleSnapshotEntry{
+		SnapshotId:    volumeSnapshot.Labels[common.Domain+"/uid"],
+		Name:          volumeSnapshot.Name,
+		SourcePvcName: sourcePvcName,
+		Size:          size,
+	}, nil
+}
+
+// Flattens the volume's image into the bundle. Fails with errBundleVolumeBusy if the volume is staged or busy.
+func (c *bundleController) exportVolume(
+	ctx context.Context,
+	pvc *corev1.PersistentVolumeClaim,
+	location common.BackingLocation,
+	target common.VolumeBundleLocation,
+	format string,
+) error {
+	pvcUid := common.VolumeUidOf(pvc)
+
+	err := common.SetPvcStateTo(ctx, c.clientset, pvc.Name, pvc.Namespace, "exporting")
+	if code := status.Code(err); code == codes.Aborted || code == codes.FailedPrecondition {
+		return fmt.Errorf("%w: PVC %s: %s", errBundleVolumeBusy, pvc.Name, status.Convert(err).Message())
+	} else if err != nil {
+		return err
+	}
+
+	defer func() {
+		err := common.SetPvcStateToIdle(context.Background(), c.clientset, pvc.Name, pvc.Namespace)
+		if err != nil {
+			klog.ErrorS(err, "Failed to return PVC to idle", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+	}()
+
+	_, err = c.runBundleJob(ctx, exportJobConfig(
+		common.GenerateExportJobName(pvcUid), &pvc.ObjectMeta, common.GenerateVolumeImageName(pvcUid),
+		location, target, format,
+	))
+	return err
+}
+
+// Flattens the snapshot's image into the bundle.
+func (c *bundleController) exportSnapshot(
+	ctx context.Context,
+	volumeSnapshot *volumesnapshotv1.VolumeSnapshot,
+	location common.BackingLocation,
+	target common.VolumeBundleLocation,
+	format string,
+) error {
+	_, err := c.runBundleJob(ctx, exportJobConfig(
+		common.GenerateSnapshotExportJobName(volumeSnapshot.UID), &volumeSnapshot.ObjectMeta,
+		common.GenerateSnapshotImageName(volumeSnapshot.UID), location, target, format,
+	))
+	return err
+}
+
+// The Job that flattens the image with the given name into a bundle in the given format.
+func exportJobConfig(
+	jobName string,
+	propagateFrom *metav1.ObjectMeta,
+	imageName string,
+	location common.BackingLocation,
+	target common.VolumeBundleLocation,
+	format string,
+) common.JobConfig {
+	if format == "" {
+		format = common.ImageFormatQcow2
+	}
+
+	script := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+		qemu-img convert -f qcow2 -O "$3" "/var/backing/$1" "/var/bundle/$2.tmp"
+		mv -f "/var/bundle/$2.tmp" "/var/bundle/$2"
+		`,
+	)
+
+	return common.JobConfig{
+		Name:          jobName,
+		Namespace:     location.PvcNamespace,
+		PropagateFrom: propagateFrom,
+		Command: []string{
+			"bash", "-c", script, "bash", imageName, common.BundleFileName(imageName, format), format,
+		},
+		BackingPvcName:     location.PvcName,
+		BackingPvcBasePath: location.BasePath,
+		ExtraPvcMounts: []common.PvcMount{
+			{PvcName: target.ClaimName, MountPath: "/var/bundle", SubPath: target.Path},
+		},
+	}
+}
+
+func (c *bundleController) importBundle(ctx context.Context, volumeImport *common.VolumeImport) error {
+	storageClass, err := c.clientset.StorageV1().StorageClasses().
+		Get(ctx, volumeImport.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if storageClass.Provisioner != common.Domain {
+		return errBundleOtherDriver
+	}
+
+	location := common.BackingLocation{
+		PvcName:      storageClass.Parameters["backingClaimName"],
+		PvcNamespace: storageClass.Parameters["backingClaimNamespace"],
+		BasePath:     storageClass.Parameters["basePath"],
+	}
+
+	err = common.CheckBackingPvcAcceptsVolumes(ctx, c.clientset, location.PvcName, location.PvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	// read the manifest
+
+	output, err := c.runBundleJob(ctx, common.JobConfig{
+		Name:               common.GenerateBundleManifestJobName(volumeImport.UID),
+		Namespace:          location.PvcNamespace,
+		Command:            []string{"cat", "/var/backing/manifest.json"},
+		BackingPvcName:     volumeImport.Spec.Source.ClaimName,
+		BackingPvcBasePath: volumeImport.Spec.Source.Path,
+	})
+	if err != nil {
+		return err
+	}
+
+	manifest, err := common.ParseVolumeBundleManifest(output)
+	if err != nil {
+		return err
+	}
+
+	// import each volume
+
+	for i := range manifest.Volumes {
+		err := c.importVolume(ctx, volumeImport, storageClass, location, manifest.Format, &manifest.Volumes[i])
+		if err != nil {
+			return fmt.Errorf("failed to import PVC %s: %w", manifest.Volumes[i].Name, err)
+		}
+	}
+
+	klog.InfoS(
+		"Imported volumes", "volumeImport", klog.KRef(volumeImport.Namespace, volumeImport.Name),
+		"volumes", len(manifest.Volumes),
+	)
+	return nil
+}
+
+// Idempotent. Copies the volume's image into the backing volume, and creates its PV and PVC unless they already exist.
+func (c *bundleController) importVolume(
+	ctx context.Context,
+	volumeImport *common.VolumeImport,
+	storageClass *storagev1.StorageClass,
+	location common.BackingLocation,
+	format string,
+	entry *common.VolumeBundleEntry,
+) error {
+	pv := bundlePersistentVolume(entry, volumeImport.Namespace, storageClass, location)
+
+	_, err := c.clientset.CoreV1().PersistentVolumes().Get(ctx, pv.Name, metav1.GetOptions{})
+	if err == nil {
+		return nil // already imported
+	} else if !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	script := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+		if [[ ! -e "/var/backing/$1" ]]; then
+			qemu-img convert -f "$3" -O qcow2 "/var/bundle/$2" "/var/backing/$1.tmp"
+			mv -f "/var/backing/$1.tmp" "/var/backing/$1"
+		fi
+		`,
+	)
+
+	if format == "" {
+		format = common.ImageFormatQcow2
+	}
+
+	_, err = c.runBundleJob(ctx, common.JobConfig{
+		Name:      common.GenerateBundleImportJobName(entry.VolumeId),
+		Namespace: location.PvcNamespace,
+		Command: []string{
+			"bash", "-c", script, "bash", entry.ImageName(), common.BundleFileName(entry.ImageName(), format), format,
+		},
+		BackingPvcName:     location.PvcName,
+		BackingPvcBasePath: location.BasePath,
+		ExtraPvcMounts: []common.PvcMount{
+			{
+				PvcName:   volumeImport.Spec.Source.ClaimName,
+				MountPath: "/var/bundle",
+				SubPath:   volumeImport.Spec.Source.Path,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	recordBackingChainChanges(ctx, c.clientset, location, func(chains common.BackingChains) {
+		chains[entry.ImageName()] = ""
+	})
+
+	// create the PVC first, so that the PV is never available to other PVCs
+
+	pvc := bundlePersistentVolumeClaim(entry, volumeImport.Namespace, storageClass.Name)
+	_, err = c.clientset.CoreV1().PersistentVolumeClaims(volumeImport.Namespace).
+		Create(ctx, pvc, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	_, err = c.clientset.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	return nil
+}
+
+// The PV of an imported volume, pre-bound to the PVC that bundlePersistentVolumeClaim returns.
+func bundlePersistentVolume(
+	entry *common.VolumeBundleEntry,
+	namespace string,
+	storageClass *storagev1.StorageClass,
+	location common.BackingLocation,
+) *corev1.PersistentVolume {
+	reclaimPolicy := corev1.PersistentVolumeReclaimDelete
+	if storageClass.ReclaimPolicy != nil {
+		reclaimPolicy = *storageClass.ReclaimPolicy
+	}
+
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("pvc-%s", entry.VolumeId),
+			Annotations: map[string]string{
+				// lets the external-provisioner delete the volume according to the reclaim policy
+				"pv.kubernetes.io/provisioned-by": common.Domain,
+			},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: *resource.NewQuantity(entry.Capacity, resource.BinarySI),
+			},
+			AccessModes:                   entry.AccessModes,
+			VolumeMode:                    entry.VolumeMode,
+			StorageClassName:              storageClass.Name,
+			PersistentVolumeReclaimPolicy: reclaimPolicy,
+			MountOptions:                  storageClass.MountOptions,
+			ClaimRef: &corev1.ObjectReference{
+				APIVersion: "v1",
+				Kind:       "PersistentVolumeClaim",
+				Name:       entry.Name,
+				Namespace:  namespace,
+			},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       common.Domain,
+					VolumeHandle: entry.VolumeId,
+					VolumeAttributes: map[string]string{
+						"pvcName":             entry.Name,
+						"pvcNamespace":        namespace,
+						"backingPvcName":      location.PvcName,
+						"backingPvcNamespace": location.PvcNamespace,
+						"backingPvcBasePath":  location.BasePath,
+					},
+				},
+			},
+		},
+	}
+}
+
+// The PVC of an imported volume, bound to the PV that bundlePersistentVolume returns.
+func bundlePersistentVolumeClaim(
+	entry *common.VolumeBundleEntry,
+	namespace string,
+	storageClassName string,
+) *corev1.PersistentVolumeClaim {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      entry.Name,
+			Namespace: namespace,
+			Labels:    entry.Labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      entry.AccessModes,
+			StorageClassName: &storageClassName,
+			VolumeMode:       entry.VolumeMode,
+			VolumeName:       fmt.Sprintf("pvc-%s", entry.VolumeId),
+		},
+	}
+	pvc.Spec.Resources.Requests = corev1.ResourceList{
+		corev1.ResourceStorage: *resource.NewQuantity(entry.Capacity, resource.BinarySI),
+	}
+	return pvc
+}
+
+// Runs a Job to completion and returns its logs. The Job is deleted in any case, so that it is run anew if retried.
+func (c *bundleController) runBundleJob(ctx context.Context, config common.JobConfig) ([]byte, error) {
+	config.Image = c.image
+	config.BackoffLimit = &bundleJobBackoffLimit
+	config.Labels = map[string]string{common.Domain + "/component": "volume-bundle"}
+
+	err := common.CreateJob(ctx, c.clientset, config)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err := common.DeleteJobSynchronously(context.Background(), c.clientset, config.Name, config.Namespace)
+		if err != nil {
+			runtime.HandleError(err)
+		}
+	}()
+
+	err = common.WaitForJobToSucceedWithin(ctx, c.clientset, config.Name, config.Namespace, bundleJobTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return common.GetJobLogs(ctx, c.clientset, config.Name, config.Namespace)
+}
@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	block := corev1.PersistentVolumeBlock
+	retain := corev1.PersistentVolumeReclaimRetain
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "data",
+			Namespace: "old",
+			Labels: map[string]string{
+				"app":                                  "db",
+				common.Domain + "/uid":                 "1234",
+				common.Domain + "/source-snapshot-uid": "5678",
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			VolumeMode:  &block,
+		},
+		Status: corev1.PersistentVolumeClaimStatus{
+			Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+		},
+	}
+
+	entry, err := bundleEntryOf(pvc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestJson, err := json.Marshal(common.VolumeBundleManifest{Volumes: []common.VolumeBundleEntry{entry}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := common.ParseVolumeBundleManifest(manifestJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Volumes) != 1 || !reflect.DeepEqual(manifest.Volumes[0], entry) {
+		t.Fatalf("got %+v, want %+v", manifest.Volumes, entry)
+	}
+	if entry.ImageName() != "pvc-1234.qcow2" {
+		t.Errorf("got image name %s", entry.ImageName())
+	}
+
+	storageClass := &storagev1.StorageClass{
+		ObjectMeta:    metav1.ObjectMeta{Name: "sc"},
+		ReclaimPolicy: &retain,
+	}
+	location := common.BackingLocation{PvcName: "backing", PvcNamespace: "storage", BasePath: "volumes"}
+
+	pv := bundlePersistentVolume(&entry, "new", storageClass, location)
+	newPvc := bundlePersistentVolumeClaim(&entry, "new", storageClass.Name)
+
+	if pv.Name != "pvc-1234" || pv.Spec.CSI.VolumeHandle != "1234" || newPvc.Spec.VolumeName != pv.Name {
+		t.Errorf("PV %s with handle %s, PVC bound to %s", pv.Name, pv.Spec.CSI.VolumeHandle, newPvc.Spec.VolumeName)
+	}
+	if pv.Spec.ClaimRef.Name != "data" || pv.Spec.ClaimRef.Namespace != "new" {
+		t.Errorf("PV pre-bound to %s/%s", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy != retain || *pv.Spec.VolumeMode != block {
+		t.Errorf("got reclaim policy %s, volume mode %s", pv.Spec.PersistentVolumeReclaimPolicy, *pv.Spec.VolumeMode)
+	}
+	if pv.Spec.CSI.VolumeAttributes["backingPvcName"] != "backing" ||
+		pv.Spec.CSI.VolumeAttributes["backingPvcNamespace"] != "storage" ||
+		pv.Spec.CSI.VolumeAttributes["backingPvcBasePath"] != "volumes" {
+		t.Errorf("got volume attributes %v", pv.Spec.CSI.VolumeAttributes)
+	}
+	if !reflect.DeepEqual(newPvc.Labels, map[string]string{"app": "db"}) {
+		t.Errorf("got labels %v", newPvc.Labels)
+	}
+	if capacity := newPvc.Spec.Resources.Requests[corev1.ResourceStorage]; capacity.Value() != 1<<30 {
+		t.Errorf("got requested capacity %s", capacity.String())
+	}
+}
+
+func TestParseVolumeBundleManifest(t *testing.T) {
+	manifest, err := common.ParseVolumeBundleManifest([]byte(
+		`{"format":"raw","volumes":[],"snapshots":[{"snapshotId":"5678","name":"daily","size":1073741824}]}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Format != common.ImageFormatRaw || len(manifest.Snapshots) != 1 ||
+		manifest.Snapshots[0].ImageName() != "snapshot-5678.qcow2" {
+		t.Errorf("got %+v", manifest)
+	}
+
+	for _, manifest := range []string{
+		`not json`,
+		`{"volumes":[{"volumeId":"1234","name":"data","capacity":0,"accessModes":["ReadWriteOnce"]}]}`,
+		`{"volumes":[{"volumeId":"","name":"data","capacity":1,"accessModes":["ReadWriteOnce"]}]}`,
+		`{"format":"vmdk","volumes":[]}`,
+		`{"volumes":[],"snapshots":[{"snapshotId":"5678","name":"daily","size":0}]}`,
+	} {
+		if _, err := common.ParseVolumeBundleManifest([]byte(manifest)); err == nil {
+			t.Errorf("%s: expected error", manifest)
+		}
+	}
+}
+
+func TestExportJobConfig(t *testing.T) {
+	location := common.BackingLocation{PvcName: "backing", PvcNamespace: "storage", BasePath: "volumes"}
+	target := common.VolumeBundleLocation{ClaimName: "bundle", Path: "my-bundle"}
+
+	tests := []struct {
+		format   string
+		wantFile string
+		wantArg  string
+	}{
+		{"", "snapshot-5678.qcow2", "qcow2"},
+		{"qcow2", "snapshot-5678.qcow2", "qcow2"},
+		{"raw", "snapshot-5678.raw", "raw"},
+	}
+
+	for _, test := range tests {
+		config := exportJobConfig("job", nil, "snapshot-5678.qcow2", location, target, test.format)
+
+		args := config.Command[len(config.Command)-3:]
+		if !reflect.DeepEqual(args, []string{"snapshot-5678.qcow2", test.wantFile, test.wantArg}) {
+			t.Errorf("%q: got arguments %v", test.format, args)
+		}
+		if config.Namespace != "storage" || config.BackingPvcName != "backing" ||
+			config.BackingPvcBasePath != "volumes" {
+			t.Errorf("%q: got backing PVC %s/%s", test.format, config.Namespace, config.BackingPvcName)
+		}
+		if len(config.ExtraPvcMounts) != 1 || config.ExtraPvcMounts[0].PvcName != "bundle" ||
+			config.ExtraPvcMounts[0].SubPath != "my-bundle" {
+			t.Errorf("%q: got mounts %+v", test.format, config.ExtraPvcMounts)
+		}
+	}
+}
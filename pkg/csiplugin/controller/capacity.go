@@ -0,0 +1,262 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/metrics"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+var (
+	backingStoreSizeBytes = metrics.Default.NewGaugeVec(
+		"subprovisioner_backing_store_size_bytes",
+		"Size of the file system of a backing volume.",
+		"backing_pvc_namespace", "backing_pvc_name",
+	)
+	backingStoreUsedBytes = metrics.Default.NewGaugeVec(
+		"subprovisioner_backing_store_used_bytes",
+		"Space used in the file system of a backing volume.",
+		"backing_pvc_namespace", "backing_pvc_name",
+	)
+	backingStoreFreeBytes = metrics.Default.NewGaugeVec(
+		"subprovisioner_backing_store_free_bytes",
+		"Space left in the file system of a backing volume.",
+		"backing_pvc_namespace", "backing_pvc_name",
+	)
+	backingStoreOvercommitRatio = metrics.Default.NewGaugeVec(
+		"subprovisioner_backing_store_overcommit_ratio",
+		"Total capacity of the volumes in a backing volume divided by the size of its file system.",
+		"backing_pvc_namespace", "backing_pvc_name",
+	)
+	backingStoreImages = metrics.Default.NewGaugeVec(
+		"subprovisioner_backing_store_images",
+		"Number of qcow2 images in a backing volume, including those of snapshots, as last recorded.",
+		"backing_pvc_namespace", "backing_pvc_name",
+	)
+	backingStoreSnapshots = metrics.Default.NewGaugeVec(
+		"subprovisioner_backing_store_snapshots",
+		"Number of VolumeSnapshots whose images are in a backing volume.",
+		"backing_pvc_namespace", "backing_pvc_name",
+	)
+	backingStoreProvisionedBytes = metrics.Default.NewGaugeVec(
+		"subprovisioner_backing_store_provisioned_bytes",
+		"Total capacity of the volumes of a StorageClass in a backing volume, counting mirrors.",
+		"backing_pvc_namespace", "backing_pvc_name", "storage_class",
+	)
+	backingStoreVolumes = metrics.Default.NewGaugeVec(
+		"subprovisioner_backing_store_volumes",
+		"Number of volumes of a StorageClass in a backing volume, counting mirrors.",
+		"backing_pvc_namespace", "backing_pvc_name", "storage_class",
+	)
+)
+
+// A backing volume, which may hold volumes under several base paths.
+type backingStore struct {
+	namespace string
+	name      string
+}
+
+type backingStoreSummary struct {
+	// any location in the backing volume, from which to measure the usage of its file system
+	location common.BackingLocation
+
+	provisioned map[string]int64 // by StorageClass
+	volumes     map[string]int   // by StorageClass
+	images      int
+	snapshots   int
+}
+
+// Periodically exports metrics about the capacity of every backing volume that a StorageClass refers to or that holds
+// volumes, for capacity planning. Measuring the usage of a backing volume's file system runs a Job, so this only runs
+// if metrics are served.
+type capacityMetricsController struct {
+	clientset *common.Clientset
+	image     string
+}
+
+func (c *capacityMetricsController) run(stopCh chan struct{}) {
+	wait.Until(c.exportAll, 5*time.Minute, stopCh)
+}
+
+func (c *capacityMetricsController) exportAll() {
+	ctx := context.Background() // TODO
+
+	storageClasses, err := c.clientset.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	volumeSnapshots, err := c.clientset.SnapshotV1().VolumeSnapshots(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if k8serrors.IsNotFound(err) {
+		volumeSnapshots = &volumesnapshotv1.VolumeSnapshotList{} // volume snapshot CRDs aren't installed
+	} else if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	chains, err := common.ListBackingChains(ctx, c.clientset)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	summaries := summarizeBackingStores(storageClasses.Items, pvcs.Items, volumeSnapshots.Items, chains)
+
+	// measure everything before updating the metrics, so that scrapes in between don't miss any
+
+	usages := map[backingStore]common.BackingUsage{}
+	for store, summary := range summaries {
+		usage, err := common.MeasureBackingUsage(ctx, c.clientset, c.image, summary.location)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to measure usage of backing PVC", "backingPvc", klog.KRef(store.namespace, store.name),
+			)
+			continue
+		}
+		usages[store] = usage
+	}
+
+	for _, gauge := range []*metrics.GaugeVec{
+		backingStoreSizeBytes, backingStoreUsedBytes, backingStoreFreeBytes, backingStoreOvercommitRatio,
+		backingStoreImages, backingStoreSnapshots, backingStoreProvisionedBytes, backingStoreVolumes,
+	} {
+		gauge.Reset()
+	}
+
+	for store, summary := range summaries {
+		backingStoreImages.Set(float64(summary.images), store.namespace, store.name)
+		backingStoreSnapshots.Set(float64(summary.snapshots), store.namespace, store.name)
+
+		var provisioned int64
+		for storageClass, capacity := range summary.provisioned {
+			provisioned += capacity
+			backingStoreProvisionedBytes.Set(float64(capacity), store.namespace, store.name, storageClass)
+			backingStoreVolumes.Set(float64(summary.volumes[storageClass]), store.namespace, store.name, storageClass)
+		}
+
+		if usage, ok := usages[store]; ok {
+			backingStoreSizeBytes.Set(float64(usage.Size), store.namespace, store.name)
+			backingStoreUsedBytes.Set(float64(usage.Used), store.namespace, store.name)
+			backingStoreFreeBytes.Set(float64(usage.Size-usage.Used), store.namespace, store.name)
+			if usage.Size > 0 {
+				backingStoreOvercommitRatio.Set(float64(provisioned)/float64(usage.Size), store.namespace, store.name)
+			}
+		}
+	}
+}
+
+// Summarizes the contents of every backing volume that one of the given StorageClasses of the driver refers to or that
+// holds one of the given volumes.
+func summarizeBackingStores(
+	storageClasses []storagev1.StorageClass,
+	pvcs []corev1.PersistentVolumeClaim,
+	volumeSnapshots []volumesnapshotv1.VolumeSnapshot,
+	chains map[common.BackingLocation]common.BackingChains,
+) map[backingStore]*backingStoreSummary {
+	summaries := map[backingStore]*backingStoreSummary{}
+
+	summaryOf := func(location common.BackingLocation) *backingStoreSummary {
+		store := backingStore{namespace: location.PvcNamespace, name: location.PvcName}
+		summary, ok := summaries[store]
+		if !ok {
+			summary = &backingStoreSummary{
+				location:    location,
+				provisioned: map[string]int64{},
+				volumes:     map[string]int{},
+			}
+			summaries[store] = summary
+		}
+		return summary
+	}
+
+	for i := range storageClasses {
+		storageClass := &storageClasses[i]
+		if storageClass.Provisioner != common.Domain {
+			continue
+		}
+		for _, location := range StorageClassLocations(storageClass.Parameters) {
+			summaryOf(location)
+		}
+	}
+
+	for i := range pvcs {
+		pvc := &pvcs[i]
+
+		capacity, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64)
+		if err != nil {
+			continue // not created yet
+		}
+
+		storageClass := ""
+		if pvc.Spec.StorageClassName != nil {
+			storageClass = *pvc.Spec.StorageClassName
+		}
+
+		locations := []common.BackingLocation{common.BackingLocationOf(&pvc.ObjectMeta)}
+		if mirror, mirrored := common.MirrorLocationOf(&pvc.ObjectMeta); mirrored {
+			locations = append(locations, mirror)
+		}
+
+		for _, location := range locations {
+			summary := summaryOf(location)
+			summary.provisioned[storageClass] += capacity
+			summary.volumes[storageClass]++
+		}
+	}
+
+	for i := range volumeSnapshots {
+		summaryOf(common.BackingLocationOf(&volumeSnapshots[i].ObjectMeta)).snapshots++
+	}
+
+	for location, locationChains := range chains {
+		summaryOf(location).images += len(locationChains)
+	}
+
+	return summaries
+}
+
+// The backing volumes that a StorageClass of the driver may place volumes or their mirrors in, given its parameters.
+func StorageClassLocations(parameters map[string]string) []common.BackingLocation {
+	locations := rebalanceLocations(parameters)
+
+	if name := parameters["mirrorBackingClaimName"]; name != "" {
+		locations = append(locations, common.BackingLocation{
+			PvcName:      name,
+			PvcNamespace: parameters["backingClaimNamespace"],
+			BasePath:     parameters["basePath"],
+		})
+	}
+
+	// the StorageClass would fail to create volumes if this were invalid, so it doesn't refer to any backing volume
+	claims, _ := parseZonalBackingClaims(parameters["zonalBackingClaims"], parameters["backingClaimNamespace"])
+	for _, claim := range claims {
+		locations = append(locations, common.BackingLocation{
+			PvcName:      claim.name,
+			PvcNamespace: claim.namespace,
+			BasePath:     parameters["basePath"],
+		})
+	}
+
+	return locations
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSummarizeBackingStores(t *testing.T) {
+	backedBy := func(name string, basePath string, extra map[string]string) metav1.ObjectMeta {
+		annotations := map[string]string{
+			common.Domain + "/backing-pvc-name":      name,
+			common.Domain + "/backing-pvc-namespace": "ns",
+			common.Domain + "/backing-pvc-base-path": basePath,
+		}
+		for key, value := range extra {
+			annotations[key] = value
+		}
+		return metav1.ObjectMeta{Annotations: annotations}
+	}
+
+	fast, slow := "fast", "slow"
+
+	storageClasses := []storagev1.StorageClass{
+		{
+			Provisioner: common.Domain,
+			Parameters: map[string]string{
+				"backingClaimName":      "a",
+				"backingClaimNamespace": "ns",
+				"allowedBackingClaims":  "empty",
+			},
+		},
+		{
+			Provisioner: "other.example.com",
+			Parameters:  map[string]string{"backingClaimName": "foreign", "backingClaimNamespace": "ns"},
+		},
+	}
+
+	pvcs := []corev1.PersistentVolumeClaim{
+		{
+			ObjectMeta: backedBy("a", "", map[string]string{common.Domain + "/capacity": "100"}),
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &fast},
+		},
+		{
+			ObjectMeta: backedBy("a", "other", map[string]string{common.Domain + "/capacity": "50"}),
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &slow},
+		},
+		{
+			ObjectMeta: backedBy("a", "", map[string]string{
+				common.Domain + "/capacity":                "30",
+				common.Domain + "/mirror-backing-pvc-name": "b",
+			}),
+			Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &fast},
+		},
+		{
+			// not created yet
+			ObjectMeta: backedBy("a", "", nil),
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &fast},
+		},
+	}
+
+	volumeSnapshots := []volumesnapshotv1.VolumeSnapshot{
+		{ObjectMeta: backedBy("a", "", nil)},
+		{ObjectMeta: backedBy("a", "other", nil)},
+	}
+
+	chains := map[common.BackingLocation]common.BackingChains{
+		{PvcName: "a", PvcNamespace: "ns"}:                    {"x.qcow2": "", "y.qcow2": "x.qcow2"},
+		{PvcName: "a", PvcNamespace: "ns", BasePath: "other"}: {"z.qcow2": ""},
+	}
+
+	got := summarizeBackingStores(storageClasses, pvcs, volumeSnapshots, chains)
+
+	if len(got) != 3 {
+		t.Fatalf("got %d backing stores, want 3: %+v", len(got), got)
+	}
+
+	a := got[backingStore{namespace: "ns", name: "a"}]
+	if a == nil ||
+		!reflect.DeepEqual(a.provisioned, map[string]int64{"fast": 130, "slow": 50}) ||
+		!reflect.DeepEqual(a.volumes, map[string]int{"fast": 2, "slow": 1}) ||
+		a.images != 3 || a.snapshots != 2 {
+		t.Errorf("a: got %+v", a)
+	}
+
+	b := got[backingStore{namespace: "ns", name: "b"}]
+	if b == nil ||
+		!reflect.DeepEqual(b.provisioned, map[string]int64{"fast": 30}) ||
+		b.location != (common.BackingLocation{PvcName: "b", PvcNamespace: "ns"}) {
+		t.Errorf("b: got %+v", b)
+	}
+
+	empty := got[backingStore{namespace: "ns", name: "empty"}]
+	if empty == nil || len(empty.provisioned) != 0 || empty.images != 0 {
+		t.Errorf("empty: got %+v", empty)
+	}
+}
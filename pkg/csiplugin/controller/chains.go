@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/metrics"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+var (
+	volumeLayoutLabels = []string{"volume_id", "namespace", "persistentvolumeclaim"}
+
+	volumeBackingChainLength = metrics.Default.NewGaugeVec(
+		"subprovisioner_volume_backing_chain_length",
+		"Number of qcow2 images in the backing chain of a volume, including its own, as last recorded.",
+		volumeLayoutLabels...,
+	)
+	volumeImageAllocatedClusters = metrics.Default.NewGaugeVec(
+		"subprovisioner_volume_image_allocated_clusters",
+		"Number of clusters allocated in the qcow2 image of a volume, not counting its backing files.",
+		volumeLayoutLabels...,
+	)
+	volumeImageExtents = metrics.Default.NewGaugeVec(
+		"subprovisioner_volume_image_extents",
+		"Number of extents that the qcow2 image file of a volume is split into in its backing volume.",
+		volumeLayoutLabels...,
+	)
+	volumeImageFragmentationRatio = metrics.Default.NewGaugeVec(
+		"subprovisioner_volume_image_fragmentation_ratio",
+		"Extents of the qcow2 image file of a volume per allocated cluster, from near 0 if the image file is "+
+			"contiguous to 1 if none of its clusters are adjacent.",
+		volumeLayoutLabels...,
+	)
+)
+
+// Periodically records the backing chains of the images in every backing location that holds volumes, so that
+// operators can inspect them (see the "backing-chains" command) without having to look at the backing volumes
+// themselves. Also keeps the allocated size recorded for each VolumeSnapshot and volume up to date, and exports
+// metrics about the layout of each volume's image.
+type backingChainsController struct {
+	clientset *common.Clientset
+	image     string
+}
+
+func (c *backingChainsController) run(stopCh chan struct{}) {
+	wait.Until(c.refreshAll, 10*time.Minute, stopCh)
+}
+
+func (c *backingChainsController) refreshAll() {
+	ctx := context.Background() // TODO
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	volumeSnapshots, err := c.clientset.SnapshotV1().VolumeSnapshots(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if k8serrors.IsNotFound(err) {
+		volumeSnapshots = &volumesnapshotv1.VolumeSnapshotList{} // volume snapshot CRDs aren't installed
+	} else if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	locations := map[common.BackingLocation][]volumesnapshotv1.VolumeSnapshot{}
+	volumes := map[common.BackingLocation][]corev1.PersistentVolumeClaim{}
+	for i := range pvcs.Items {
+		location := common.BackingLocationOf(&pvcs.Items[i].ObjectMeta)
+		if _, ok := locations[location]; !ok {
+			locations[location] = nil
+		}
+		volumes[location] = append(volumes[location], pvcs.Items[i])
+	}
+	for i := range volumeSnapshots.Items {
+		location := common.BackingLocationOf(&volumeSnapshots.Items[i].ObjectMeta)
+		locations[location] = append(locations[location], volumeSnapshots.Items[i])
+	}
+
+	stats := map[common.BackingLocation]map[string]common.ImageStats{}
+
+	for location, snapshots := range locations {
+		locationStats, err := common.RefreshBackingChains(ctx, c.clientset, c.image, location)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to refresh backing chains",
+				"backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+			)
+			continue
+		}
+
+		stats[location] = locationStats
+		recordSnapshotAllocatedSizes(ctx, c.clientset, snapshots, locationStats)
+		recordVolumeAllocatedSizes(ctx, c.clientset, volumes[location], locationStats)
+	}
+
+	chains, err := common.ListBackingChains(ctx, c.clientset)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	exportVolumeLayouts(pvcs.Items, chains, stats)
+}
+
+// Exports metrics about how the image of each of the given volumes is laid out in its backing volume, i.e., the length
+// of its backing chain and how fragmented the image file is, e.g., for alerting on volumes that would benefit from
+// being flattened or compacted. Metrics whose values are unknown, e.g., because the image couldn't be inspected, are
+// left out.
+func exportVolumeLayouts(
+	pvcs []corev1.PersistentVolumeClaim,
+	chains map[common.BackingLocation]common.BackingChains,
+	stats map[common.BackingLocation]map[string]common.ImageStats,
+) {
+	for _, gauge := range []*metrics.GaugeVec{
+		volumeBackingChainLength, volumeImageAllocatedClusters, volumeImageExtents, volumeImageFragmentationRatio,
+	} {
+		gauge.Reset()
+	}
+
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		location := common.BackingLocationOf(&pvc.ObjectMeta)
+		imageName := common.GenerateVolumeImageName(common.VolumeUidOf(pvc))
+		labels := []string{string(common.VolumeUidOf(pvc)), pvc.Namespace, pvc.Name}
+
+		if length := backingChainLength(chains[location], imageName); length > 0 {
+			volumeBackingChainLength.Set(float64(length), labels...)
+		}
+
+		imageStats, ok := stats[location][imageName]
+		if !ok {
+			continue
+		}
+
+		clusters := imageStats.AllocatedClusters()
+		if clusters >= 0 {
+			volumeImageAllocatedClusters.Set(float64(clusters), labels...)
+		}
+		if imageStats.Extents >= 0 {
+			volumeImageExtents.Set(float64(imageStats.Extents), labels...)
+		}
+		if clusters > 0 && imageStats.Extents >= 0 {
+			volumeImageFragmentationRatio.Set(float64(imageStats.Extents)/float64(clusters), labels...)
+		}
+	}
+}
+
+// Returns the number of images in the backing chain of the given image, including itself, or 0 if it isn't recorded.
+// Stops at images that aren't recorded, and at cycles, which can only be recorded if the records are broken.
+func backingChainLength(chains common.BackingChains, imageName string) int {
+	seen := map[string]bool{}
+	for name := imageName; name != "" && !seen[name]; name = chains[name] {
+		if _, ok := chains[name]; !ok {
+			break
+		}
+		seen[name] = true
+	}
+	return len(seen)
+}
+
+// Records changes to the backing chains of a backing location right after making them, so that they don't only become
+// visible on the next periodic refresh. Failing to do so isn't fatal, since that refresh will eventually catch up.
+func recordBackingChainChanges(
+	ctx context.Context, clientset *common.Clientset, location common.BackingLocation,
+	update func(chains common.BackingChains),
+) {
+	err := common.RecordBackingChainChanges(ctx, clientset, location, update)
+	if err != nil {
+		klog.ErrorS(
+			err, "Failed to record backing chain changes",
+			"backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+		)
+	}
+}
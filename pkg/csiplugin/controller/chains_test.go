@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"testing"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+)
+
+func TestBackingChainLength(t *testing.T) {
+	chains := common.BackingChains{
+		"pvc-a.qcow2":       "snapshot-s2.qcow2",
+		"snapshot-s2.qcow2": "snapshot-s1.qcow2",
+		"snapshot-s1.qcow2": "",
+		"pvc-b.qcow2":       "",
+		"pvc-c.qcow2":       "http-1234.qcow2", // backing file not recorded yet
+		"loop-1.qcow2":      "loop-2.qcow2",
+		"loop-2.qcow2":      "loop-1.qcow2",
+	}
+
+	for image, want := range map[string]int{
+		"pvc-a.qcow2":  3,
+		"pvc-b.qcow2":  1,
+		"pvc-c.qcow2":  1,
+		"pvc-d.qcow2":  0,
+		"loop-1.qcow2": 2,
+	} {
+		if got := backingChainLength(chains, image); got != want {
+			t.Errorf("%s: got %d, want %d", image, got, want)
+		}
+	}
+}
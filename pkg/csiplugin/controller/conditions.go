@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The conditions recorded in the "conditions" annotation of PVCs and their PVs, which tell what a volume is going
+// through in more detail than its state annotation, which only serves to keep operations on it from interfering with
+// each other.
+const (
+	// Whether the volume can be used, i.e., it was created and isn't being deleted.
+	volumeConditionReady = "Ready"
+
+	// Whether the volume's image was created and populated from its source, if any.
+	volumeConditionDataPopulated = "DataPopulated"
+
+	// Whether the volume is staged on any node.
+	volumeConditionStaged = "Staged"
+
+	// Whether something is wrong with the volume (see volumeCondition()) or a copy of a mirrored volume is out of date.
+	volumeConditionDegraded = "Degraded"
+
+	// Whether the PVC was deleted and the volume is yet to be deleted.
+	volumeConditionDeleting = "Deleting"
+)
+
+// How long a deleted PVC may wait for its volume to be deleted before it is considered stuck.
+const deletionStuckPeriod = 10 * time.Minute
+
+// Derives the conditions of the volume of the given PVC, without transition times. creationJob is the volume's
+// creation Job, or nil if there is none. abnormal describes what is wrong with the volume, if anything.
+func volumeConditions(
+	pvc *corev1.PersistentVolumeClaim,
+	creationJob *batchv1.Job,
+	abnormal string,
+	now time.Time,
+) []metav1.Condition {
+	populated := metav1.Condition{Type: volumeConditionDataPopulated, Status: metav1.ConditionFalse}
+
+	switch {
+	case pvc.Spec.VolumeName != "" || (creationJob != nil && creationJob.Status.Succeeded > 0):
+		populated.Status, populated.Reason = metav1.ConditionTrue, "Populated"
+		populated.Message = "The volume was created"
+	case creationJob == nil:
+		populated.Reason, populated.Message = "CreationPending", "Volume creation hasn't started"
+	case jobFailureMessage(creationJob) != "":
+		populated.Reason = "CreationFailed"
+		populated.Message = fmt.Sprintf("Volume creation failed: %s", jobFailureMessage(creationJob))
+	case creationJob.Status.Failed > 0:
+		populated.Reason = "CreationFailing"
+		populated.Message = fmt.Sprintf(
+			"Volume creation failed %d times and is being retried (see Job %s in namespace %s)",
+			creationJob.Status.Failed, creationJob.Name, creationJob.Namespace,
+		)
+	default:
+		populated.Reason, populated.Message = "Creating", "The volume is being created"
+	}
+
+	stagedOnNodes := pvc.Annotations[common.Domain+"/staged-on-nodes"]
+	staged := metav1.Condition{
+		Type: volumeConditionStaged, Status: metav1.ConditionFalse, Reason: "NotStaged",
+		Message: "The volume isn't staged on any node",
+	}
+	if stagedOnNodes != "" {
+		staged.Status, staged.Reason = metav1.ConditionTrue, "StagedOnNodes"
+		staged.Message = fmt.Sprintf("The volume is staged on nodes %s", stagedOnNodes)
+	}
+
+	var problems []string
+	if abnormal != "" {
+		problems = append(problems, abnormal)
+	}
+	if degraded := common.DegradedCopyOf(&pvc.ObjectMeta); degraded != "" {
+		problems = append(problems, fmt.Sprintf("the %s copy is out of date", degraded))
+	}
+	degraded := metav1.Condition{
+		Type: volumeConditionDegraded, Status: metav1.ConditionFalse, Reason: "Healthy",
+		Message: "Nothing is wrong with the volume",
+	}
+	if abnormal != "" {
+		degraded.Status, degraded.Reason = metav1.ConditionTrue, "Abnormal"
+	} else if len(problems) > 0 {
+		degraded.Status, degraded.Reason = metav1.ConditionTrue, "MirrorCopyOutOfDate"
+	}
+	if len(problems) > 0 {
+		degraded.Message = strings.Join(problems, "; ")
+	}
+
+	deleting := metav1.Condition{
+		Type: volumeConditionDeleting, Status: metav1.ConditionFalse, Reason: "NotDeleted",
+		Message: "The PVC wasn't deleted",
+	}
+	if pvc.DeletionTimestamp != nil {
+		deleting.Status = metav1.ConditionTrue
+
+		switch {
+		case stagedOnNodes != "":
+			deleting.Reason = "AwaitingUnstage"
+			deleting.Message = fmt.Sprintf(
+				"The volume is deleted once it is unstaged from nodes %s", stagedOnNodes,
+			)
+		case now.Sub(pvc.DeletionTimestamp.Time) > deletionStuckPeriod:
+			deleting.Reason = "StuckAwaitingCleanup"
+			deleting.Message = fmt.Sprintf(
+				"The volume still wasn't deleted %v after its PVC was, see the controller plugin's logs",
+				deletionStuckPeriod,
+			)
+		default:
+			deleting.Reason, deleting.Message = "DeletingVolume", "The volume is being deleted"
+		}
+	}
+
+	ready := metav1.Condition{
+		Type: volumeConditionReady, Status: metav1.ConditionTrue, Reason: "VolumeReady",
+		Message: "The volume can be used",
+	}
+	if populated.Status != metav1.ConditionTrue {
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, populated.Reason, populated.Message
+	} else if deleting.Status == metav1.ConditionTrue {
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, "Deleting", "The PVC was deleted"
+	}
+
+	return []metav1.Condition{ready, populated, staged, degraded, deleting}
+}
+
+// Returns the message of the Job's failure, or "" if it hasn't failed.
+func jobFailureMessage(job *batchv1.Job) string {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			if condition.Message == "" {
+				return condition.Reason
+			}
+			return condition.Message
+		}
+	}
+	return ""
+}
+
+// Merges the given conditions into those recorded in the annotation with the given value, keeping the transition
+// times of conditions whose status didn't change, and returns the new value of the annotation.
+func mergeVolumeConditions(recorded string, conditions []metav1.Condition, now time.Time) (string, error) {
+	var merged []metav1.Condition
+	if recorded != "" {
+		_ = json.Unmarshal([]byte(recorded), &merged) // malformed conditions are replaced
+	}
+
+	for _, condition := range conditions {
+		condition.LastTransitionTime = metav1.NewTime(now)
+		meta.SetStatusCondition(&merged, condition)
+	}
+
+	value, err := json.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// Records the volume's conditions on its PVC and, if it is bound, its PV, unless they didn't change.
+func (c *volumeHealthController) recordConditions(
+	ctx context.Context,
+	pvc *corev1.PersistentVolumeClaim,
+	conditions []metav1.Condition,
+) error {
+	previous := pvc.Annotations[common.Domain+"/conditions"]
+
+	value, err := mergeVolumeConditions(previous, conditions, time.Now())
+	if err != nil {
+		return err
+	}
+	if value == previous {
+		return nil
+	}
+
+	annotations := metav1.ObjectMeta{Annotations: map[string]string{common.Domain + "/conditions": value}}
+
+	err = common.ApplyPvcMetadata(ctx, c.clientset, pvc.Name, pvc.Namespace, annotations)
+	if err != nil {
+		return err
+	}
+
+	if pvc.Spec.VolumeName != "" {
+		err = common.ApplyPvMetadata(ctx, c.clientset, pvc.Spec.VolumeName, annotations)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
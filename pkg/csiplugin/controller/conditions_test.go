@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestVolumeConditions(t *testing.T) {
+	now := time.Now()
+
+	pvc := func(
+		volumeName string,
+		annotations map[string]string,
+		deletedAgo time.Duration,
+	) *corev1.PersistentVolumeClaim {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: volumeName},
+		}
+		if deletedAgo > 0 {
+			deletedAt := metav1.NewTime(now.Add(-deletedAgo))
+			pvc.DeletionTimestamp = &deletedAt
+		}
+		return pvc
+	}
+	job := func(status batchv1.JobStatus) *batchv1.Job {
+		return &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "creation", Namespace: "backing"}, Status: status}
+	}
+	failed := batchv1.JobStatus{
+		Failed:     6,
+		Conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "Limit"}},
+	}
+	staged := map[string]string{common.Domain + "/staged-on-nodes": "node-1"}
+	degraded := map[string]string{common.Domain + "/mirror-degraded": common.MirrorCopy}
+
+	tests := []struct {
+		name        string
+		pvc         *corev1.PersistentVolumeClaim
+		creationJob *batchv1.Job
+		abnormal    string
+		want        map[string]string // reason of each condition, prefixed with "+" if its status is True
+	}{
+		{
+			"pending", pvc("", nil, 0), nil, "",
+			map[string]string{"Ready": "CreationPending", "DataPopulated": "CreationPending"},
+		},
+		{
+			"creating", pvc("", nil, 0), job(batchv1.JobStatus{Active: 1}), "",
+			map[string]string{"Ready": "Creating", "DataPopulated": "Creating"},
+		},
+		{
+			"creation failing", pvc("", nil, 0), job(batchv1.JobStatus{Active: 1, Failed: 2}), "",
+			map[string]string{"Ready": "CreationFailing", "DataPopulated": "CreationFailing"},
+		},
+		{
+			"creation failed", pvc("", nil, 0), job(failed), "",
+			map[string]string{"Ready": "CreationFailed", "DataPopulated": "CreationFailed"},
+		},
+		{
+			"ready", pvc("pv", nil, 0), nil, "",
+			map[string]string{
+				"Ready": "+VolumeReady", "DataPopulated": "+Populated", "Staged": "NotStaged",
+				"Degraded": "Healthy", "Deleting": "NotDeleted",
+			},
+		},
+		{
+			"staged and abnormal", pvc("pv", staged, 0), nil, "staging pod on node node-1 is not ready",
+			map[string]string{"Ready": "+VolumeReady", "Staged": "+StagedOnNodes", "Degraded": "+Abnormal"},
+		},
+		{"mirror degraded", pvc("pv", degraded, 0), nil, "", map[string]string{"Degraded": "+MirrorCopyOutOfDate"}},
+		{
+			"deleting", pvc("pv", nil, time.Minute), nil, "",
+			map[string]string{"Ready": "Deleting", "Deleting": "+DeletingVolume"},
+		},
+		{
+			"deleting while staged", pvc("pv", staged, time.Hour), nil, "",
+			map[string]string{"Deleting": "+AwaitingUnstage"},
+		},
+		{"stuck", pvc("pv", nil, time.Hour), nil, "", map[string]string{"Deleting": "+StuckAwaitingCleanup"}},
+	}
+
+	for _, test := range tests {
+		got := map[string]string{}
+		for _, condition := range volumeConditions(test.pvc, test.creationJob, test.abnormal, now) {
+			got[condition.Type] = condition.Reason
+			if condition.Status == metav1.ConditionTrue {
+				got[condition.Type] = "+" + condition.Reason
+			}
+		}
+
+		for conditionType, want := range test.want {
+			if got[conditionType] != want {
+				t.Errorf("%s: got %s condition %s, want %s", test.name, conditionType, got[conditionType], want)
+			}
+		}
+	}
+}
+
+func TestMergeVolumeConditions(t *testing.T) {
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	condition := func(status metav1.ConditionStatus, reason string) []metav1.Condition {
+		return []metav1.Condition{{Type: volumeConditionReady, Status: status, Reason: reason, Message: reason}}
+	}
+	transitionTime := func(value string) time.Time {
+		var conditions []metav1.Condition
+		if err := json.Unmarshal([]byte(value), &conditions); err != nil || len(conditions) != 1 {
+			t.Fatalf("malformed conditions %s: %v", value, err)
+		}
+		return conditions[0].LastTransitionTime.Time.UTC()
+	}
+
+	value, err := mergeVolumeConditions("", condition(metav1.ConditionFalse, "Creating"), start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a change of reason keeps the transition time
+
+	value, err = mergeVolumeConditions(value, condition(metav1.ConditionFalse, "CreationFailing"), start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := transitionTime(value); !got.Equal(start) {
+		t.Errorf("got transition time %v, want %v", got, start)
+	}
+
+	// a change of status doesn't
+
+	value, err = mergeVolumeConditions(value, condition(metav1.ConditionTrue, "VolumeReady"), start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := transitionTime(value); !got.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("got transition time %v, want %v", got, start.Add(2*time.Hour))
+	}
+
+	// nothing changes if nothing did
+
+	again, err := mergeVolumeConditions(value, condition(metav1.ConditionTrue, "VolumeReady"), start.Add(3*time.Hour))
+	if err != nil || again != value {
+		t.Errorf("got %s, %v, want %s", again, err, value)
+	}
+}
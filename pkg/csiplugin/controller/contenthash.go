@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// How long hashing the content of a single snapshot may take.
+const contentHashJobTimeout = 6 * time.Hour
+
+var contentHashJobBackoffLimit int32 = 2
+
+// Computes a hash of the content of a snapshot as seen by volumes created from it, independently of how that content
+// is laid out in the snapshot's backing chain. The snapshot's image is converted to a temporary raw image in the
+// backing volume, which takes up as much space as the snapshot's data, and that is hashed. The result has the form
+// "sha256:<hex digest>".
+func hashSnapshotContent(
+	ctx context.Context,
+	clientset *common.Clientset,
+	image string,
+	jobName string,
+	location common.BackingLocation,
+	volumeSnapshotMeta *metav1.ObjectMeta,
+) (string, error) {
+	volumeSnapshotUid := volumeSnapshotMeta.UID
+
+	hashingScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+
+		raw="/var/backing/$2.raw"
+		trap 'rm -f "${raw}"' EXIT
+
+		qemu-img convert -f qcow2 -O raw "/var/backing/$1" "${raw}"
+		echo "content-hash sha256:$( sha256sum "${raw}" | cut -d ' ' -f 1 )"
+		`,
+	)
+
+	err := common.CreateJob(
+		ctx, clientset,
+		common.JobConfig{
+			Name:      jobName,
+			Namespace: location.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component":    "snapshot-hashing",
+				common.Domain + "/snapshot-uid": string(volumeSnapshotUid),
+			},
+			Image: image,
+			Command: []string{
+				"bash", "-c", hashingScript, "bash", common.GenerateSnapshotImageName(volumeSnapshotUid), jobName,
+			},
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			BackoffLimit:       &contentHashJobBackoffLimit,
+			PropagateFrom:      volumeSnapshotMeta,
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	err = common.WaitForJobToSucceedWithin(ctx, clientset, jobName, location.PvcNamespace, contentHashJobTimeout)
+	if err != nil {
+		_ = common.DeleteJobSynchronously(ctx, clientset, jobName, location.PvcNamespace)
+		return "", err
+	}
+
+	logs, err := common.GetJobLogs(ctx, clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return "", err
+	}
+
+	err = common.DeleteJobSynchronously(ctx, clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return "", err
+	}
+
+	hash, ok := parseContentHash(string(logs))
+	if !ok {
+		return "", fmt.Errorf("job %s didn't output a content hash", jobName)
+	}
+
+	return hash, nil
+}
+
+// Parses the "content-hash <hash>" line output by the hashing Job.
+func parseContentHash(logs string) (string, bool) {
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "content-hash sha256:") {
+			hash := strings.TrimPrefix(line, "content-hash ")
+			return hash, len(hash) == len("sha256:")+64
+		}
+	}
+	return "", false
+}
+
+// Hashes the content of a newly taken snapshot and records it in the "content-hash" annotation of its VolumeSnapshot.
+// The snapshot is usable either way, so failures are only logged and reported through an Event on the VolumeSnapshot.
+func (s *ControllerServer) recordSnapshotContentHash(
+	ctx context.Context,
+	volumeSnapshotMeta *metav1.ObjectMeta,
+	location common.BackingLocation,
+) {
+	jobName := common.GenerateContentHashJobName(volumeSnapshotMeta.UID)
+
+	hash, err := hashSnapshotContent(ctx, s.Clientset, s.Image, jobName, location, volumeSnapshotMeta)
+	if err == nil {
+		err = common.ApplyVolumeSnapshotMetadata(
+			ctx, s.Clientset, volumeSnapshotMeta.Name, volumeSnapshotMeta.Namespace,
+			metav1.ObjectMeta{Annotations: map[string]string{common.Domain + "/content-hash": hash}},
+		)
+	}
+	if err == nil {
+		return
+	}
+
+	klog.ErrorS(
+		err, "Failed to hash content of VolumeSnapshot",
+		"volumeSnapshot", klog.KRef(volumeSnapshotMeta.Namespace, volumeSnapshotMeta.Name),
+	)
+
+	err = common.EmitEvent(
+		ctx, s.Clientset, common.VolumeSnapshotEventObject(volumeSnapshotMeta),
+		corev1.EventTypeWarning, "ContentHashFailed",
+		"Failed to hash the snapshot's content, so volumes created from it won't be verified",
+	)
+	if err != nil {
+		klog.ErrorS(err, "Failed to emit event")
+	}
+}
+
+// Checks that the content of a snapshot still matches the hash recorded when it was taken, if any, before a volume is
+// created from it. Fails with codes.DataLoss if it doesn't, and reports that through an Event on the VolumeSnapshot.
+func (s *ControllerServer) verifySnapshotContent(
+	ctx context.Context,
+	volumeSnapshotMeta *metav1.ObjectMeta,
+	destPvcUid types.UID,
+) error {
+	wantHash, ok := volumeSnapshotMeta.Annotations[common.Domain+"/content-hash"]
+	if !ok {
+		return nil
+	}
+
+	location := common.BackingLocationOf(volumeSnapshotMeta)
+	jobName := common.GenerateContentVerificationJobName(destPvcUid)
+
+	hash, err := hashSnapshotContent(ctx, s.Clientset, s.Image, jobName, location, volumeSnapshotMeta)
+	if err != nil {
+		return err
+	}
+
+	if hash == wantHash {
+		return nil
+	}
+
+	err = common.EmitEvent(
+		ctx, s.Clientset, common.VolumeSnapshotEventObject(volumeSnapshotMeta),
+		corev1.EventTypeWarning, "ContentHashMismatch",
+		"The snapshot's content hash is %s but was %s when it was taken", hash, wantHash,
+	)
+	if err != nil {
+		klog.ErrorS(err, "Failed to emit event")
+	}
+
+	return status.Errorf(
+		codes.DataLoss, "content of snapshot %s in namespace %s doesn't match the hash recorded when it was taken",
+		volumeSnapshotMeta.Name, volumeSnapshotMeta.Namespace,
+	)
+}
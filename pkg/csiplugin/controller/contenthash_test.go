@@ -0,0 +1,31 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseContentHash(t *testing.T) {
+	digest := strings.Repeat("0123456789abcdef", 4)
+
+	tests := []struct {
+		logs     string
+		wantHash string
+		wantOk   bool
+	}{
+		{"+ qemu-img convert\ncontent-hash sha256:" + digest + "\n", "sha256:" + digest, true},
+		{"+ echo 'content-hash sha256:" + digest + "'\n", "", false},
+		{"content-hash sha256:\n", "", false},
+		{"content-hash md5:" + digest[:32] + "\n", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		hash, ok := parseContentHash(test.logs)
+		if ok != test.wantOk || (ok && hash != test.wantHash) {
+			t.Errorf("%q: got (%q, %v), want (%q, %v)", test.logs, hash, ok, test.wantHash, test.wantOk)
+		}
+	}
+}
@@ -5,7 +5,10 @@ package controller
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
@@ -13,19 +16,46 @@ import (
 	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
 )
 
 type ControllerServer struct {
 	csi.UnimplementedControllerServer
 	Clientset *common.Clientset
 	Image     string
+
+	// The cache of the driver's PVCs, which ListVolumes() is served from (see NewPvcInformer()).
+	PvcInformer cache.SharedIndexInformer
+
+	// Maximum number of snapshots being taken at once in the same backing volume.
+	MaxConcurrentSnapshotsPerBackingVolume int
+
+	operations                operationCache
+	snapshotsPerVolume        keyedSemaphore
+	snapshotsPerBackingVolume keyedSemaphore
+	backingStores             backingStoreBreaker
+	backingUsage              backingUsageCache
 }
 
 func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	key := "volume " + req.Name
+	resp, err := s.operations.run(ctx, key, req, func(ctx context.Context) (protoiface.MessageV1, error) {
+		return s.createVolume(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*csi.CreateVolumeResponse), nil
+}
+
+func (s *ControllerServer) createVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	// TODO: If we are cloning an existing volume but cloning is eventually cancelled before succeeding due to the
 	// new PVC being deleted, the source PVC might forever be stuck in the "cloning" state and be unmountable. Fix
 	// this somehow. Maybe add some label to the new PVC identifying the source PVC (if Kubernetes doesn't already
@@ -49,15 +79,148 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	if err != nil {
 		return nil, err
 	}
-	backingPvcName, err := getParameter("backingClaimName")
+	backingPvcNamespace, err := getParameter("backingClaimNamespace")
 	if err != nil {
 		return nil, err
 	}
-	backingPvcNamespace, err := getParameter("backingClaimNamespace")
+	backingPvcBasePath := req.Parameters["basePath"]
+
+	zonalBackingClaims, err := parseZonalBackingClaims(req.Parameters["zonalBackingClaims"], backingPvcNamespace)
 	if err != nil {
 		return nil, err
 	}
-	backingPvcBasePath := req.Parameters["basePath"]
+
+	backingPvcName := req.Parameters["backingClaimName"]
+	if zonalBackingClaims == nil && backingPvcName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing/empty parameter \"backingClaimName\"")
+	} else if zonalBackingClaims != nil && backingPvcName != "" {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"parameters \"backingClaimName\" and \"zonalBackingClaims\" are mutually exclusive",
+		)
+	}
+
+	mirrorBackingPvcName := req.Parameters["mirrorBackingClaimName"]
+	if mirrorBackingPvcName != "" && zonalBackingClaims != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"parameters \"mirrorBackingClaimName\" and \"zonalBackingClaims\" are mutually exclusive",
+		)
+	}
+
+	trashRetention, err := common.ParseTrashRetention(req.Parameters)
+	if err != nil {
+		return nil, err
+	} else if trashRetention > 0 && mirrorBackingPvcName != "" {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"parameters \"mirrorBackingClaimName\" and \"trashRetention\" are mutually exclusive",
+		)
+	}
+
+	stickyData := false
+	switch req.Parameters["stickyData"] {
+	case "", "false":
+	case "true":
+		stickyData = true
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "parameter \"stickyData\" must be \"true\" or \"false\"")
+	}
+
+	immutable := false
+	switch req.Parameters["immutable"] {
+	case "", "false":
+	case "true":
+		immutable = true
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "parameter \"immutable\" must be \"true\" or \"false\"")
+	}
+
+	checkOnStage := false
+	switch req.Parameters["checkOnStage"] {
+	case "", "false":
+	case "true":
+		checkOnStage = true
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "parameter \"checkOnStage\" must be \"true\" or \"false\"")
+	}
+
+	integrity := false
+	switch req.Parameters["integrity"] {
+	case "", "false":
+	case "true":
+		integrity = true
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "parameter \"integrity\" must be \"true\" or \"false\"")
+	}
+
+	verifyZeroed := false
+	switch req.Parameters["verifyZeroed"] {
+	case "", "false":
+	case "true":
+		verifyZeroed = true
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "parameter \"verifyZeroed\" must be \"true\" or \"false\"")
+	}
+
+	format := common.ImageFormatQcow2
+	switch req.Parameters["format"] {
+	case "", common.ImageFormatQcow2:
+	case common.ImageFormatRaw:
+		format = common.ImageFormatRaw
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "parameter \"format\" must be \"qcow2\" or \"raw\"")
+	}
+
+	// Raw images have no backing files, so they can't be populated from snapshots, other volumes, or catalog images
+	// without copying all their data, nor have qcow2 metadata to check or tune. Reattached images and mirrors are
+	// always qcow2.
+
+	if format == common.ImageFormatRaw {
+		for _, other := range []string{
+			"stickyData", "mirrorBackingClaimName", "checkOnStage", "qcow2Options", "maxQcow2CacheSize",
+		} {
+			if value := req.Parameters[other]; value != "" && value != "false" {
+				return nil, status.Errorf(
+					codes.InvalidArgument, "parameter \"%s\" can't be used with raw images", other,
+				)
+			}
+		}
+	}
+
+	// reattached images are neither mirrored nor formatted for dm-integrity, would never reach the trash, and hold
+	// previous data by design
+
+	if stickyData {
+		for _, other := range []string{"mirrorBackingClaimName", "trashRetention", "integrity", "verifyZeroed"} {
+			if value := req.Parameters[other]; value != "" && value != "false" {
+				return nil, status.Errorf(
+					codes.InvalidArgument, "parameters \"stickyData\" and \"%s\" are mutually exclusive", other,
+				)
+			}
+		}
+	}
+
+	stagingTuning, err := parseStagingTuning(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	overcommitRatio, err := parseOvercommitRatio(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	queueOperations := false
+	switch req.Parameters["queueConflictingOperations"] {
+	case "", "false":
+	case "true":
+		queueOperations = true
+	default:
+		return nil, status.Errorf(
+			codes.InvalidArgument, "parameter \"queueConflictingOperations\" must be \"true\" or \"false\"",
+		)
+	}
 
 	pvc, err := s.Clientset.CoreV1().
 		PersistentVolumeClaims(pvcNamespace).Get(ctx, pvcName, metav1.GetOptions{})
@@ -65,6 +228,107 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		return nil, err
 	}
 
+	_, err = common.ConvertState(&pvc.ObjectMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	// Operations that populate volumes only know about the image in the backing volume.
+
+	if mirrorBackingPvcName != "" &&
+		(req.VolumeContentSource != nil || pvc.Labels[common.Domain+"/populated-pvc-uid"] != "") {
+		return nil, status.Errorf(
+			codes.InvalidArgument, "volumes with parameter \"mirrorBackingClaimName\" can only be created empty",
+		)
+	}
+
+	// Volumes with integrity protection are formatted for dm-integrity when first staged, which would destroy any
+	// content they were created with.
+
+	if integrity &&
+		(req.VolumeContentSource != nil || pvc.Labels[common.Domain+"/populated-pvc-uid"] != "") {
+		return nil, status.Errorf(
+			codes.InvalidArgument, "volumes with parameter \"integrity\" can only be created empty",
+		)
+	}
+
+	if format == common.ImageFormatRaw &&
+		(req.VolumeContentSource != nil || pvc.Labels[common.Domain+"/populated-pvc-uid"] != "") {
+		return nil, status.Errorf(codes.InvalidArgument, "volumes with raw images can only be created empty")
+	}
+
+	// backing volume override
+
+	// The PVC may ask for a specific backing volume instead of the StorageClass' default one, but only if the
+	// administrator explicitly allowed that backing volume in the StorageClass' "allowedBackingClaims" parameter.
+
+	if override := pvc.Annotations[common.Domain+"/backing-claim"]; override != "" {
+		if zonalBackingClaims != nil {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"annotation \"%s/backing-claim\" can't be used with parameter \"zonalBackingClaims\"", common.Domain,
+			)
+		}
+		backingPvcName, backingPvcNamespace, err = resolveBackingClaimOverride(
+			override, backingPvcNamespace, req.Parameters["allowedBackingClaims"],
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// zonal backing volume
+
+	// The volume goes in the backing volume of a zone it must be accessible from, and is then only accessible from that
+	// zone. Volumes created from other volumes or snapshots must go where their sources are, and retries where the
+	// first attempt went.
+
+	zone := ""
+	if zonalBackingClaims != nil {
+		required, err := s.sourceBackingLocation(ctx, req.VolumeContentSource)
+		if err != nil {
+			return nil, err
+		}
+		if required == nil && pvc.Annotations[common.Domain+"/zone"] != "" {
+			location := common.BackingLocationOf(&pvc.ObjectMeta)
+			required = &location
+		}
+
+		claim, err := selectZonalBackingClaim(zonalBackingClaims, req.AccessibilityRequirements, required)
+		if err != nil {
+			return nil, err
+		}
+		zone, backingPvcName, backingPvcNamespace = claim.zone, claim.name, claim.namespace
+	}
+
+	// fail fast if the backing volume is under maintenance, being drained, or volume creation has been failing in it
+
+	err = common.CheckBackingPvcAcceptsVolumes(ctx, s.Clientset, backingPvcName, backingPvcNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.backingStores.check(backingPvcNamespace+"/"+backingPvcName, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// the mirror of a mirrored volume goes in another backing volume in the same namespace
+
+	if mirrorBackingPvcName != "" {
+		if mirrorBackingPvcName == backingPvcName {
+			return nil, status.Errorf(
+				codes.InvalidArgument, "volume and its mirror would both be in backing volume \"%s/%s\"",
+				backingPvcNamespace, backingPvcName,
+			)
+		}
+
+		err = common.CheckBackingPvcAcceptsVolumes(ctx, s.Clientset, mirrorBackingPvcName, backingPvcNamespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// capacity
 
 	capacity, _, maxCapacity, err := validateCapacity(req.CapacityRange)
@@ -72,6 +336,70 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		return nil, err
 	}
 
+	location := common.BackingLocation{
+		PvcName: backingPvcName, PvcNamespace: backingPvcNamespace, BasePath: backingPvcBasePath,
+	}
+
+	// sticky data
+
+	// The image that a deleted volume of a PVC with the same namespace and name left behind in the backing volume is
+	// only reattached, or discarded, once the new PVC confirms which through its "reattach-data" annotation. Retries
+	// stick to reattaching if the first attempt decided to, as the image has been renamed by then.
+
+	stickyImageName := pvc.Annotations[common.Domain+"/reattached-from"]
+	if stickyImageName != "" {
+		if previous, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64); err == nil &&
+			previous > capacity {
+			capacity = previous
+		}
+	} else if stickyData {
+		found, stickyCapacity, err := s.findStickyImage(ctx, location, pvc)
+		if err != nil {
+			return nil, err
+		}
+
+		switch reattach := pvc.Annotations[common.Domain+"/reattach-data"]; {
+		case found == "":
+		case reattach == "true":
+			if req.VolumeContentSource != nil || pvc.Labels[common.Domain+"/populated-pvc-uid"] != "" {
+				return nil, status.Errorf(
+					codes.InvalidArgument, "can't both reattach data and create the volume from a data source",
+				)
+			}
+			if stickyCapacity > capacity {
+				if maxCapacity != 0 && stickyCapacity > maxCapacity {
+					return nil, status.Errorf(
+						codes.OutOfRange, "the data to reattach needs a capacity of %d bytes, more than the limit",
+						stickyCapacity,
+					)
+				}
+				capacity = stickyCapacity
+			}
+			stickyImageName = found
+		case reattach == "false":
+			err = s.discardStickyImage(ctx, location, found)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"a deleted PVC with the same name left data behind; annotate this PVC with \"%s/reattach-data\" "+
+					"set to \"true\" to reattach it or \"false\" to discard it",
+				common.Domain,
+			)
+		}
+	}
+
+	// make sure the volume fits in the backing volume, if the StorageClass limits overcommitment
+
+	if overcommitRatio > 0 {
+		err = s.checkBackingSpace(ctx, location, pvc.UID, capacity, overcommitRatio)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// capabilities
 
 	for _, cap := range req.VolumeCapabilities {
@@ -84,11 +412,36 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
 			csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
-			csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
 		default:
 			return nil, status.Errorf(
 				codes.InvalidArgument,
-				"only access modes ReadWriteOnce, ReadWriteOncePod, and ReadOnlyMany are supported",
+				"only access modes ReadWriteOnce, ReadWriteOncePod, ReadOnlyMany, and ReadWriteMany are supported",
+			)
+		}
+
+		// Volumes staged on several nodes read-write are served to all of them by a single shared export, which
+		// neither has a dm-integrity device, as each node would keep its own, nor can have a copy of a mirrored
+		// volume removed from its quorum, as no node plugin watches it.
+		if cap.AccessMode.Mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+			if integrity {
+				return nil, status.Errorf(
+					codes.InvalidArgument, "volumes with parameter \"integrity\" can't be ReadWriteMany",
+				)
+			}
+			if mirrorBackingPvcName != "" {
+				return nil, status.Errorf(
+					codes.InvalidArgument, "volumes with parameter \"mirrorBackingClaimName\" can't be ReadWriteMany",
+				)
+			}
+		}
+
+		// staging read-only can't format the volume or replay the dm-integrity journal
+		if integrity && (cap.AccessMode.Mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+			cap.AccessMode.Mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY) {
+			return nil, status.Errorf(
+				codes.InvalidArgument, "volumes with parameter \"integrity\" can't be read-only",
 			)
 		}
 	}
@@ -100,22 +453,38 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	// on (because the corresponding PVC has meanwhile been deleted) are never leaked, as in those cases Kubernetes
 	// doesn't know how to call DeleteVolume() because it doesn't know what VolumeId to use.
 
-	err = common.StrategicMergePatchPvc(
+	annotations := map[string]string{
+		common.Domain + "/backing-pvc-name":      backingPvcName,
+		common.Domain + "/backing-pvc-namespace": backingPvcNamespace,
+		common.Domain + "/backing-pvc-base-path": backingPvcBasePath,
+		common.Domain + "/capacity":              strconv.FormatInt(capacity, 10),
+		common.Domain + "/state":                 "idle",
+		common.Domain + "/format":                format,
+	}
+	for key, value := range common.StateVersionAnnotations() {
+		annotations[key] = value
+	}
+	if queueOperations {
+		annotations[common.Domain+"/queue-operations"] = "true"
+	}
+	if zone != "" {
+		annotations[common.Domain+"/zone"] = zone
+	}
+	if mirrorBackingPvcName != "" {
+		annotations[common.Domain+"/mirror-backing-pvc-name"] = mirrorBackingPvcName
+	}
+	if stickyImageName != "" {
+		annotations[common.Domain+"/reattached-from"] = stickyImageName
+	}
+
+	err = common.ApplyPvcMetadata(
 		ctx, s.Clientset, pvcName, pvcNamespace,
-		corev1.PersistentVolumeClaim{
-			ObjectMeta: metav1.ObjectMeta{
-				Labels: map[string]string{
-					common.Domain + "/uid": string(pvc.UID),
-				},
-				Annotations: map[string]string{
-					common.Domain + "/backing-pvc-name":      backingPvcName,
-					common.Domain + "/backing-pvc-namespace": backingPvcNamespace,
-					common.Domain + "/backing-pvc-base-path": backingPvcBasePath,
-					common.Domain + "/capacity":              strconv.FormatInt(capacity, 10),
-					common.Domain + "/state":                 "idle",
-				},
-				Finalizers: []string{common.Domain + "/cleanup"},
+		metav1.ObjectMeta{
+			Labels: map[string]string{
+				common.Domain + "/uid": string(pvc.UID),
 			},
+			Annotations: annotations,
+			Finalizers:  []string{common.Domain + "/cleanup"},
 		},
 	)
 	if err != nil {
@@ -124,9 +493,32 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 
 	// create qcow2 file
 
-	if req.VolumeContentSource == nil {
-		err = s.createVolumeFromNothing(
+	// PVCs reference catalog images through spec.dataSourceRef, which the external-provisioner doesn't handle, so
+	// populatorController creates prime PVCs naming the image in an annotation for us to provision instead.
+
+	ref := pvc.Annotations[common.Domain+"/catalog-image"]
+	if pvc.Labels[common.Domain+"/populated-pvc-uid"] == "" {
+		ref = ""
+	}
+
+	// leave room for dm-integrity's metadata
+
+	imageSize := capacity
+	if integrity {
+		imageSize = integrityImageSize(capacity)
+	}
+
+	if stickyImageName != "" {
+		err = s.createVolumeFromStickyImage(ctx, location, pvc, capacity, stickyImageName)
+	} else if req.VolumeContentSource == nil && ref != "" {
+		err = s.createVolumeFromCatalogImage(
 			ctx, backingPvcName, backingPvcNamespace, backingPvcBasePath, pvc, capacity,
+			maxCapacity, ref,
+		)
+	} else if req.VolumeContentSource == nil {
+		err = s.createVolumeFromNothing(
+			ctx, backingPvcName, backingPvcNamespace, backingPvcBasePath, mirrorBackingPvcName, pvc, imageSize,
+			format, verifyZeroed,
 		)
 	} else if source := req.VolumeContentSource.GetVolume(); source != nil {
 		err = s.createVolumeFromVolume(
@@ -159,6 +551,32 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 			ContentSource: req.VolumeContentSource,
 		},
 	}
+	if immutable {
+		// recorded in the PV, where users can't change it
+		resp.Volume.VolumeContext["immutable"] = "true"
+	}
+	if checkOnStage {
+		resp.Volume.VolumeContext["checkOnStage"] = "true"
+	}
+	if integrity {
+		resp.Volume.VolumeContext["integrity"] = "true"
+	}
+	if format == common.ImageFormatRaw {
+		// recorded in the PV, so that the image is opened correctly when the volume is retained and adopted
+		resp.Volume.VolumeContext["format"] = format
+	}
+	if mirrorBackingPvcName != "" {
+		// recorded in the PV, so that the mirror isn't forgotten when the volume is retained and adopted
+		resp.Volume.VolumeContext["mirrorBackingPvcName"] = mirrorBackingPvcName
+	}
+	for key, value := range stagingTuning {
+		resp.Volume.VolumeContext[key] = value
+	}
+	if zone != "" {
+		resp.Volume.AccessibleTopology = []*csi.Topology{
+			{Segments: map[string]string{common.ZoneTopologyKey: zone}},
+		}
+	}
 	return resp, nil
 }
 
@@ -167,14 +585,47 @@ func (s *ControllerServer) createVolumeFromNothing(
 	backingPvcName string,
 	backingPvcNamespace string,
 	backingPvcBasePath string,
+	mirrorBackingPvcName string,
 	pvc *corev1.PersistentVolumeClaim,
 	capacity int64,
+	format string,
+	verifyZeroed bool,
 ) error {
 	volumeImagePath := common.GenerateVolumeImagePath(pvc.UID)
 	creationJobName := common.GenerateCreationJobName(pvc.UID)
 
-	err := common.CreateJob(
-		ctx, s.Clientset,
+	// raw images are created sparse, and thus read as zeros without taking up space until written to
+
+	command := []string{
+		"qemu-img", "create", "-f", format,
+		volumeImagePath, strconv.FormatInt(capacity, 10),
+	}
+
+	// mirrored volumes start out with two identical empty images
+
+	var extraPvcMounts []common.PvcMount
+	if mirrorBackingPvcName != "" {
+		command = []string{
+			"bash", "-c", `qemu-img create -f qcow2 "$1" "$3" && qemu-img create -f qcow2 "$2" "$3"`, "bash",
+			volumeImagePath, common.GenerateVolumeMirrorImagePath(pvc.UID), strconv.FormatInt(capacity, 10),
+		}
+		extraPvcMounts = []common.PvcMount{
+			{PvcName: mirrorBackingPvcName, MountPath: common.MirrorMountPath, SubPath: backingPvcBasePath},
+		}
+	}
+
+	if verifyZeroed {
+		images := []string{volumeImagePath}
+		if mirrorBackingPvcName != "" {
+			images = append(images, common.GenerateVolumeMirrorImagePath(pvc.UID))
+		}
+		command = append(
+			[]string{"bash", "-c", zeroedCreationScript, "bash", format, strconv.FormatInt(capacity, 10)}, images...,
+		)
+	}
+
+	err := s.startJob(
+		ctx, creationJobEvents(pvc),
 		common.JobConfig{
 			Name:      creationJobName,
 			Namespace: backingPvcNamespace,
@@ -182,30 +633,77 @@ func (s *ControllerServer) createVolumeFromNothing(
 				common.Domain + "/component": "volume-creation",
 				common.Domain + "/pvc-uid":   string(pvc.UID),
 			},
-			Image: s.Image,
-			Command: []string{
-				"qemu-img", "create", "-f", "qcow2",
-				volumeImagePath, strconv.FormatInt(capacity, 10),
-			},
+			PropagateFrom:      &pvc.ObjectMeta,
+			Image:              s.Image,
+			Command:            command,
 			BackingPvcName:     backingPvcName,
 			BackingPvcBasePath: backingPvcBasePath,
+			ExtraPvcMounts:     extraPvcMounts,
+			NodeName:           selectedNodeOf(pvc),
 		},
 	)
 	if err != nil {
 		return err
 	}
 
-	err = common.WaitForJobToSucceed(ctx, s.Clientset, creationJobName, backingPvcNamespace)
+	err = s.waitForCreationJob(
+		ctx, creationJobEvents(pvc), creationJobName, backingPvcName, backingPvcNamespace,
+	)
 	if err != nil {
 		return err
 	}
 
+	location := common.BackingLocation{
+		PvcName: backingPvcName, PvcNamespace: backingPvcNamespace, BasePath: backingPvcBasePath,
+	}
+	recordBackingChainChanges(ctx, s.Clientset, location, func(chains common.BackingChains) {
+		chains[common.GenerateVolumeImageName(pvc.UID)] = ""
+	})
+
 	// Keeping the volume creation Job around until the volume is deleted makes idempotency easier, so that's what
 	// we do.
 
-	return nil
+	if !verifyZeroed {
+		return nil
+	}
+
+	return common.ApplyPvcMetadata(
+		ctx, s.Clientset, pvc.Name, pvc.Namespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/verified-zeroed": time.Now().UTC().Format(time.RFC3339)},
+		},
+	)
 }
 
+// Creates empty images of the given capacity and verifies that their whole logical content reads as zeros, zeroing
+// them explicitly if it doesn't, for StorageClasses with the "verifyZeroed" parameter. Images without a backing file
+// have no allocated clusters, which the qcow2 format defines to read as zeros, and raw images are created as sparse
+// files, whose holes read as zeros, so that new volumes never expose stale data from the backing volume, but some
+// environments require proof.
+var zeroedCreationScript = dedent.Dedent(
+	`
+	set -o errexit -o pipefail -o nounset -o xtrace
+
+	format="$1"
+	capacity="$2"
+	shift 2
+
+	zeros="driver=null-co,read-zeroes=on,size=${capacity}"
+
+	for image in "$@"; do
+	    qemu-img create -f "${format}" "${image}" "${capacity}"
+	    image_opts="driver=${format},file.driver=file,file.filename=${image}"
+
+	    # qemu-img compare exits with 1 if the contents differ, and with 2 on errors
+	    if ! qemu-img compare --image-opts "${image_opts}" "${zeros}"; then
+	        >&2 echo "new image ${image} doesn't read as zeros, zeroing it explicitly"
+	        qemu-img convert -n --image-opts "${zeros}" -O "${format}" "${image}"
+	        qemu-img compare --image-opts "${image_opts}" "${zeros}"
+	    fi
+	done
+	`,
+)
+
 func (s *ControllerServer) createVolumeFromVolume(
 	ctx context.Context,
 	backingPvcName string,
@@ -222,14 +720,14 @@ func (s *ControllerServer) createVolumeFromVolume(
 		return err
 	}
 
-	err = common.SetPvcStateTo(ctx, s.Clientset, sourcePvc.Name, sourcePvc.Namespace, "cloning")
+	err = common.WaitToSetPvcStateTo(ctx, s.Clientset, sourcePvc, "cloning")
 	if err != nil {
 		return err
 	}
 
 	sourceCapacity, err := strconv.ParseInt(sourcePvc.Annotations[common.Domain+"/capacity"], 10, 64)
 	if err != nil {
-		return status.Errorf(codes.Unknown, "failed to determine source volume capacity")
+		return status.Errorf(codes.Internal, "failed to determine source volume capacity")
 	}
 	if maxCapacity != 0 && sourceCapacity > maxCapacity {
 		return status.Errorf(
@@ -241,9 +739,25 @@ func (s *ControllerServer) createVolumeFromVolume(
 		capacity = sourceCapacity
 	}
 
-	sourceVolumeImagePath := common.GenerateVolumeImagePath(sourcePvc.UID)
+	// A clone is backed by the common ancestor that it shares with the source volume, which is recorded before the
+	// image is created, so that the image is tracked as soon as it may exist. The clone also shares the source
+	// volume's backing chain, and thus depends on the same snapshot, if any.
+
+	cloneLabels := map[string]string{common.Domain + "/source-pvc-uid": string(common.VolumeUidOf(sourcePvc))}
+	if sourceSnapshotUid := sourcePvc.Labels[common.Domain+"/source-snapshot-uid"]; sourceSnapshotUid != "" {
+		cloneLabels[common.Domain+"/source-snapshot-uid"] = sourceSnapshotUid
+	}
+
+	err = common.ApplyPvcMetadata(
+		ctx, s.Clientset, destPvc.Name, destPvc.Namespace, metav1.ObjectMeta{Labels: cloneLabels},
+	)
+	if err != nil {
+		return err
+	}
+
+	sourceVolumeImagePath := common.GenerateVolumeImagePath(common.VolumeUidOf(sourcePvc))
 	destVolumeImagePath := common.GenerateVolumeImagePath(destPvc.UID)
-	commonAncestorImageName := fmt.Sprintf("cloned-%s-to-%s.qcow2", sourcePvc.UID, destPvc.UID)
+	commonAncestorImageName := common.GenerateCloneImageName(common.VolumeUidOf(sourcePvc), destPvc.UID)
 	creationJobName := common.GenerateCreationJobName(destPvc.UID)
 
 	creationScript := dedent.Dedent(
@@ -264,14 +778,15 @@ func (s *ControllerServer) createVolumeFromVolume(
 		qemu-img create -f qcow2 -b "${common_ancestor_relative}" -F qcow2 "${dest}" "${capacity}"
 
 		qemu-img create -f qcow2 -b "${common_ancestor_relative}" -F qcow2 "${source}.new"
+		/subprovisioner/copy-replication-bitmaps.sh "${source}" "${source}.new"
 		mv -f "${source}.new" "${source}"
 
 		chmod a-w "/var/backing/${common_ancestor_relative}"  # should never modify this image
 		`,
 	)
 
-	err = common.CreateJob(
-		ctx, s.Clientset,
+	err = s.startJob(
+		ctx, creationJobEvents(destPvc),
 		common.JobConfig{
 			Name:      creationJobName,
 			Namespace: backingPvcNamespace,
@@ -279,7 +794,8 @@ func (s *ControllerServer) createVolumeFromVolume(
 				common.Domain + "/component": "volume-creation",
 				common.Domain + "/pvc-uid":   string(destPvc.UID),
 			},
-			Image: s.Image,
+			PropagateFrom: &destPvc.ObjectMeta,
+			Image:         s.Image,
 			Command: []string{
 				"bash", "-c", creationScript, "bash",
 				sourceVolumeImagePath, destVolumeImagePath, commonAncestorImageName,
@@ -287,17 +803,32 @@ func (s *ControllerServer) createVolumeFromVolume(
 			},
 			BackingPvcName:     backingPvcName,
 			BackingPvcBasePath: backingPvcBasePath,
+			NodeName:           selectedNodeOf(destPvc),
 		},
 	)
 	if err != nil {
 		return err
 	}
 
-	err = common.WaitForJobToSucceed(ctx, s.Clientset, creationJobName, backingPvcNamespace)
+	err = s.waitForCreationJob(
+		ctx, creationJobEvents(destPvc), creationJobName, backingPvcName, backingPvcNamespace,
+	)
 	if err != nil {
 		return err
 	}
 
+	location := common.BackingLocation{
+		PvcName: backingPvcName, PvcNamespace: backingPvcNamespace, BasePath: backingPvcBasePath,
+	}
+	recordBackingChainChanges(ctx, s.Clientset, location, func(chains common.BackingChains) {
+		sourceImageName := common.GenerateVolumeImageName(common.VolumeUidOf(sourcePvc))
+		if chains[sourceImageName] != commonAncestorImageName {
+			chains[commonAncestorImageName] = chains[sourceImageName]
+			chains[sourceImageName] = commonAncestorImageName
+		}
+		chains[common.GenerateVolumeImageName(destPvc.UID)] = commonAncestorImageName
+	})
+
 	err = common.SetPvcStateToIdle(ctx, s.Clientset, sourcePvc.Name, sourcePvc.Namespace)
 	if err != nil {
 		return err
@@ -329,7 +860,7 @@ func (s *ControllerServer) createVolumeFromSnapshot(
 
 	snapshotSize, err := strconv.ParseInt(volumeSnapshot.Annotations[common.Domain+"/size"], 10, 64)
 	if err != nil {
-		return status.Errorf(codes.Unknown, "failed to determine source snapshot size")
+		return status.Errorf(codes.Internal, "failed to determine source snapshot size")
 	}
 	if maxCapacity != 0 && snapshotSize > maxCapacity {
 		return status.Errorf(
@@ -341,9 +872,32 @@ func (s *ControllerServer) createVolumeFromSnapshot(
 		capacity = snapshotSize
 	}
 
+	// verify the snapshot's content, unless a previous call already did so and started creating the volume
+
 	creationJobName := common.GenerateCreationJobName(destPvc.UID)
-	err = common.CreateJob(
-		ctx, s.Clientset,
+
+	_, err = s.Clientset.BatchV1().Jobs(backingPvcNamespace).Get(ctx, creationJobName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		err = s.verifySnapshotContent(ctx, &volumeSnapshot.ObjectMeta, destPvc.UID)
+	}
+	if err != nil {
+		return err
+	}
+
+	// record the dependency on the snapshot before its image becomes the backing file of the new volume
+
+	err = common.ApplyPvcMetadata(
+		ctx, s.Clientset, destPvc.Name, destPvc.Namespace,
+		metav1.ObjectMeta{
+			Labels: map[string]string{common.Domain + "/source-snapshot-uid": string(volumeSnapshot.UID)},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = s.startJob(
+		ctx, creationJobEvents(destPvc),
 		common.JobConfig{
 			Name:      creationJobName,
 			Namespace: backingPvcNamespace,
@@ -351,69 +905,626 @@ func (s *ControllerServer) createVolumeFromSnapshot(
 				common.Domain + "/component": "volume-creation",
 				common.Domain + "/pvc-uid":   string(destPvc.UID),
 			},
-			Image: s.Image,
+			PropagateFrom: &destPvc.ObjectMeta,
+			Image:         s.Image,
 			Command: []string{
 				"qemu-img",
 				"create",
 				"-f", "qcow2",
-				"-b", fmt.Sprintf("snapshot-%s.qcow2", volumeSnapshot.UID),
+				"-b", common.GenerateSnapshotImageName(volumeSnapshot.UID),
 				"-F", "qcow2",
-				fmt.Sprintf("/var/backing/pvc-%s.qcow2", destPvc.UID),
+				common.GenerateVolumeImagePath(destPvc.UID),
 				strconv.FormatInt(capacity, 10),
 			},
 			BackingPvcName:     backingPvcName,
 			BackingPvcBasePath: backingPvcBasePath,
+			NodeName:           selectedNodeOf(destPvc),
 		},
 	)
 	if err != nil {
 		return err
 	}
 
-	err = common.WaitForJobToSucceed(ctx, s.Clientset, creationJobName, backingPvcNamespace)
+	err = s.waitForCreationJob(
+		ctx, creationJobEvents(destPvc), creationJobName, backingPvcName, backingPvcNamespace,
+	)
 	if err != nil {
 		return err
 	}
 
+	location := common.BackingLocation{
+		PvcName: backingPvcName, PvcNamespace: backingPvcNamespace, BasePath: backingPvcBasePath,
+	}
+	recordBackingChainChanges(ctx, s.Clientset, location, func(chains common.BackingChains) {
+		chains[common.GenerateVolumeImageName(destPvc.UID)] = common.GenerateSnapshotImageName(volumeSnapshot.UID)
+	})
+
 	// Keeping the volume creation Job around until the volume is deleted makes idempotency easier, so that's what
 	// we do.
 
 	return nil
 }
 
-func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	// This will only be called after we remove our finalizer from the volume's PVC, at which point the volume will
-	// already have been deleted.
-
-	if req.VolumeId == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "must specify volume id")
+func (s *ControllerServer) createVolumeFromCatalogImage(
+	ctx context.Context,
+	backingPvcName string,
+	backingPvcNamespace string,
+	backingPvcBasePath string,
+	destPvc *corev1.PersistentVolumeClaim,
+	capacity int64,
+	maxCapacity int64,
+	ref string,
+) error {
+	image, err := common.ResolveCatalogImage(ctx, s.Clientset, ref)
+	if err != nil {
+		return err
 	}
 
-	resp := &csi.DeleteVolumeResponse{}
-	return resp, nil
-}
+	if source := image.VolumeSnapshot; source != nil {
+		volumeSnapshot, err := s.Clientset.SnapshotV1().VolumeSnapshots(source.Namespace).
+			Get(ctx, source.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
 
-func (s *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method ValidateVolumeCapabilities not required by Kubernetes")
-}
+		if volumeSnapshot.Status == nil || volumeSnapshot.Status.ReadyToUse == nil ||
+			!*volumeSnapshot.Status.ReadyToUse {
+			return status.Errorf(
+				codes.Unavailable, "snapshot for image \"%s\" is not ready to use yet", ref,
+			)
+		}
 
-func (s *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	caps := []csi.ControllerServiceCapability_RPC_Type{
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
-		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
-		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		return s.createVolumeFromSnapshot(
+			ctx, backingPvcName, backingPvcNamespace, backingPvcBasePath, destPvc, capacity,
+			maxCapacity, volumeSnapshot.UID,
+		)
 	}
 
-	csiCaps := make([]*csi.ControllerServiceCapability, len(caps))
-	for i, cap := range caps {
-		csiCaps[i] = &csi.ControllerServiceCapability{
-			Type: &csi.ControllerServiceCapability_Rpc{
-				Rpc: &csi.ControllerServiceCapability_RPC{
-					Type: cap,
-				},
-			},
-		}
+	if source := image.Import; source != nil {
+		return s.createVolumeFromImport(
+			ctx, backingPvcName, backingPvcNamespace, backingPvcBasePath, destPvc, capacity, ref, source,
+		)
+	}
+
+	if source := image.HttpBackingFile; source != nil {
+		return s.createVolumeFromHttpBackingFile(
+			ctx, backingPvcName, backingPvcNamespace, backingPvcBasePath, destPvc, capacity, maxCapacity, source,
+		)
+	}
+
+	source := image.Qcow2File
+
+	if source.BackingClaimName != backingPvcName || source.BackingClaimNamespace != backingPvcNamespace {
+		return status.Errorf(
+			codes.InvalidArgument, "image \"%s\" is stored in a different backing volume than this volume", ref,
+		)
+	}
+
+	imageSize := source.Size.Value()
+	if maxCapacity != 0 && imageSize > maxCapacity {
+		return status.Errorf(
+			codes.InvalidArgument, "source image size (%d) exceeds maximum capacity (%d)",
+			imageSize, maxCapacity,
+		)
+	}
+	if capacity < imageSize {
+		capacity = imageSize
+	}
+
+	// The backing file path is given relative to the root of the backing volume, but only the base path is visible
+	// to the Jobs and staging pods, so the image must be somewhere under it.
+
+	backingFilePath, err := filepath.Rel(
+		filepath.Join("/", backingPvcBasePath), filepath.Join("/", source.Path),
+	)
+	if err != nil || backingFilePath == ".." || strings.HasPrefix(backingFilePath, "../") {
+		return status.Errorf(
+			codes.InvalidArgument, "image \"%s\" is not under the base path \"%s\" of this volume",
+			ref, backingPvcBasePath,
+		)
+	}
+
+	creationJobName := common.GenerateCreationJobName(destPvc.UID)
+	creationScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+
+		source="$1"
+		dest="$2"
+		capacity="$3"
+		sha256="$4"
+
+		info="$( qemu-img info -f qcow2 --output=json "${source}" )"
+
+		if jq -e '.["backing-filename"] // .["format-specific"].data["data-file"]' <<< "${info}" >/dev/null; then
+		    >&2 echo "images with backing files or external data files are not supported"
+		    exit 1
+		fi
+
+		actual_sha256="$( sha256sum "${source}" | cut -d ' ' -f 1 )"
+
+		if [[ -n "${sha256}" && "${actual_sha256}" != "${sha256}" ]]; then
+		    >&2 echo "image checksum (${actual_sha256}) doesn't match the catalog (${sha256})"
+		    exit 1
+		fi
+
+		# Volumes aren't backed by the adopted file itself, which may be modified or removed at any time, but by a
+		# read-only copy of it that is named after its checksum and thus shared by all volumes provisioned from the
+		# same contents. The copy is verified in case the file was modified while being copied, and only put in
+		# place once complete.
+
+		copy="catalog-${actual_sha256}.qcow2"
+
+		if [[ ! -e "/var/backing/${copy}" ]]; then
+		    cp --reflink=auto "${source}" "${dest}.copy"
+		    sha256sum --check --strict <<< "${actual_sha256}  ${dest}.copy"
+		    chmod a-w "${dest}.copy"
+		    ln "${dest}.copy" "/var/backing/${copy}" || [[ -e "/var/backing/${copy}" ]]
+		    rm -f "${dest}.copy"
+		fi
+
+		qemu-img create -f qcow2 -b "${copy}" -F qcow2 "${dest}" "${capacity}"
+		`,
+	)
+
+	err = s.startJob(
+		ctx, creationJobEvents(destPvc),
+		common.JobConfig{
+			Name:      creationJobName,
+			Namespace: backingPvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "volume-creation",
+				common.Domain + "/pvc-uid":   string(destPvc.UID),
+			},
+			PropagateFrom: &destPvc.ObjectMeta,
+			Image:         s.Image,
+			Command: []string{
+				"bash", "-c", creationScript, "bash",
+				filepath.Join("/var/backing", backingFilePath), common.GenerateVolumeImagePath(destPvc.UID),
+				strconv.FormatInt(capacity, 10), source.Sha256,
+			},
+			BackingPvcName:     backingPvcName,
+			BackingPvcBasePath: backingPvcBasePath,
+			NodeName:           selectedNodeOf(destPvc),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = s.waitForJob(ctx, creationJobEvents(destPvc), creationJobName, backingPvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	// the name of the copy is only known in advance if the catalog gives its checksum
+
+	if source.Sha256 != "" {
+		location := common.BackingLocation{
+			PvcName: backingPvcName, PvcNamespace: backingPvcNamespace, BasePath: backingPvcBasePath,
+		}
+		recordBackingChainChanges(ctx, s.Clientset, location, func(chains common.BackingChains) {
+			copyImageName := fmt.Sprintf("catalog-%s.qcow2", source.Sha256)
+			chains[copyImageName] = ""
+			chains[common.GenerateVolumeImageName(destPvc.UID)] = copyImageName
+		})
+	}
+
+	// Keeping the volume creation Job around until the volume is deleted makes idempotency easier, so that's what
+	// we do.
+
+	return recordVerifiedSha256(ctx, s.Clientset, destPvc, source.Sha256)
+}
+
+func (s *ControllerServer) createVolumeFromImport(
+	ctx context.Context,
+	backingPvcName string,
+	backingPvcNamespace string,
+	backingPvcBasePath string,
+	destPvc *corev1.PersistentVolumeClaim,
+	capacity int64,
+	ref string,
+	source *common.ImageCatalogImportSource,
+) error {
+	var sourceArg string
+	if source.URL != "" {
+		sourceArg = source.URL
+	} else {
+		sourceArg = filepath.Join("/var/backing", source.Path)
+		if !strings.HasPrefix(sourceArg, "/var/backing/") {
+			return status.Errorf(
+				codes.InvalidArgument, "image \"%s\" is not under the base path \"%s\" of this volume",
+				ref, backingPvcBasePath,
+			)
+		}
+	}
+
+	creationJobName := common.GenerateCreationJobName(destPvc.UID)
+	creationScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+
+		source="$1"
+		dest="$2"
+		capacity="$3"
+		formats="$4"
+		sha256="$5"
+
+		case "${source}" in
+		    http://*|https://*)
+		        input="${dest}.download"
+		        curl --fail --location --retry 5 --output "${input}" "${source}"
+		        ;;
+		    *)
+		        input="${source}"
+		        ;;
+		esac
+
+		info="$( qemu-img info --output=json "${input}" )"
+		format="$( jq -r '.format' <<< "${info}" )"
+		size="$( jq -r '.["virtual-size"]' <<< "${info}" )"
+
+		if [[ -n "${sha256}" ]]; then
+		    sha256sum --check --strict <<< "${sha256}  ${input}"
+		fi
+
+		case " ${formats} " in
+		    *" ${format} "*)
+		        ;;
+		    *)
+		        >&2 echo "unsupported image format: ${format}"
+		        exit 1
+		        ;;
+		esac
+
+		# Images must be self-contained, as referencing other files could expose data we shouldn't have access to.
+		if jq -e '.["backing-filename"] // .["format-specific"].data["data-file"]' <<< "${info}" >/dev/null; then
+		    >&2 echo "images with backing files or external data files are not supported"
+		    exit 1
+		fi
+
+		# vmdk descriptors may reference extent files anywhere, so only accept single-file vmdk images, whose only
+		# extent is the image itself.
+		if [[ "${format}" == vmdk ]] && ! jq -e --arg input "${input}" '
+		    .["format-specific"].data as $data |
+		    ($data["create-type"] | IN("monolithicSparse", "streamOptimized")) and
+		    ($data.extents | length == 1 and .[0].filename == $input)
+		    ' <<< "${info}" >/dev/null; then
+		    >&2 echo "only monolithicSparse and streamOptimized vmdk images are supported"
+		    exit 1
+		fi
+
+		if [ "${size}" -gt "${capacity}" ]; then
+		    >&2 echo "image virtual size (${size}) exceeds volume capacity (${capacity})"
+		    exit 1
+		fi
+
+		# Only replace the destination image once it is complete, so a volume is never left half-populated.
+
+		qemu-img convert -p -f "${format}" -O qcow2 "${input}" "${dest}.new"
+		qemu-img resize -f qcow2 "${dest}.new" "${capacity}"
+		mv -f "${dest}.new" "${dest}"
+
+		if [[ "${input}" != "${source}" ]]; then
+		    rm -f "${input}"
+		fi
+		`,
+	)
+
+	err := s.startJob(
+		ctx, creationJobEvents(destPvc),
+		common.JobConfig{
+			Name:      creationJobName,
+			Namespace: backingPvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "volume-creation",
+				common.Domain + "/pvc-uid":   string(destPvc.UID),
+			},
+			PropagateFrom: &destPvc.ObjectMeta,
+			Image:         s.Image,
+			Command: []string{
+				"bash", "-c", creationScript, "bash",
+				sourceArg, common.GenerateVolumeImagePath(destPvc.UID), strconv.FormatInt(capacity, 10),
+				strings.Join(common.ImportableImageFormats, " "), source.Sha256,
+			},
+			BackingPvcName:     backingPvcName,
+			BackingPvcBasePath: backingPvcBasePath,
+			NodeName:           selectedNodeOf(destPvc),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = s.waitForJob(ctx, creationJobEvents(destPvc), creationJobName, backingPvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	location := common.BackingLocation{
+		PvcName: backingPvcName, PvcNamespace: backingPvcNamespace, BasePath: backingPvcBasePath,
+	}
+	recordBackingChainChanges(ctx, s.Clientset, location, func(chains common.BackingChains) {
+		chains[common.GenerateVolumeImageName(destPvc.UID)] = ""
+	})
+
+	// Keeping the volume creation Job around until the volume is deleted makes idempotency easier, so that's what
+	// we do.
+
+	return recordVerifiedSha256(ctx, s.Clientset, destPvc, source.Sha256)
+}
+
+func (s *ControllerServer) createVolumeFromHttpBackingFile(
+	ctx context.Context,
+	backingPvcName string,
+	backingPvcNamespace string,
+	backingPvcBasePath string,
+	destPvc *corev1.PersistentVolumeClaim,
+	capacity int64,
+	maxCapacity int64,
+	source *common.ImageCatalogHttpBackingFileSource,
+) error {
+	imageSize := source.Size.Value()
+	if maxCapacity != 0 && imageSize > maxCapacity {
+		return status.Errorf(
+			codes.InvalidArgument, "source image size (%d) exceeds maximum capacity (%d)",
+			imageSize, maxCapacity,
+		)
+	}
+	if capacity < imageSize {
+		capacity = imageSize
+	}
+
+	creationJobName := common.GenerateCreationJobName(destPvc.UID)
+	creationScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+
+		url="$1"
+		format="$2"
+		dest="$3"
+		capacity="$4"
+		copy="$5"
+
+		# If the image was already pulled into the backing volume, the volume is backed by the local copy, which has
+		# the same contents, right away.
+
+		if [[ -e "/var/backing/${copy}" ]]; then
+		    qemu-img create -f qcow2 -b "${copy}" -F qcow2 "${dest}" "${capacity}"
+		    exit 0
+		fi
+
+		info="$( qemu-img info -f "${format}" --output=json "${url}" )"
+		size="$( jq -r '.["virtual-size"]' <<< "${info}" )"
+
+		# Images must be self-contained, as referencing other files could expose data we shouldn't have access to.
+		if jq -e '.["backing-filename"] // .["format-specific"].data["data-file"]' <<< "${info}" >/dev/null; then
+		    >&2 echo "images with backing files or external data files are not supported"
+		    exit 1
+		fi
+
+		if [ "${size}" -gt "${capacity}" ]; then
+		    >&2 echo "image virtual size (${size}) exceeds volume capacity (${capacity})"
+		    exit 1
+		fi
+
+		qemu-img create -f qcow2 -b "${url}" -F "${format}" "${dest}" "${capacity}"
+		`,
+	)
+
+	err := s.startJob(
+		ctx, creationJobEvents(destPvc),
+		common.JobConfig{
+			Name:      creationJobName,
+			Namespace: backingPvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "volume-creation",
+				common.Domain + "/pvc-uid":   string(destPvc.UID),
+			},
+			PropagateFrom: &destPvc.ObjectMeta,
+			Image:         s.Image,
+			Command: []string{
+				"bash", "-c", creationScript, "bash",
+				source.URL, source.Format, common.GenerateVolumeImagePath(destPvc.UID),
+				strconv.FormatInt(capacity, 10), common.GenerateHttpBackingCopyName(source.URL),
+			},
+			BackingPvcName:     backingPvcName,
+			BackingPvcBasePath: backingPvcBasePath,
+			NodeName:           selectedNodeOf(destPvc),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = s.waitForJob(ctx, creationJobEvents(destPvc), creationJobName, backingPvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	// Whether the volume is backed by the URL or the local copy is only known to the Job, so the backing chain is
+	// left for the periodic inspection to record.
+
+	// Keeping the volume creation Job around until the volume is deleted makes idempotency easier, so that's what
+	// we do.
+
+	if !source.Pull {
+		return nil
+	}
+
+	location := common.BackingLocation{
+		PvcName: backingPvcName, PvcNamespace: backingPvcNamespace, BasePath: backingPvcBasePath,
+	}
+	return startHttpBackingFilePull(ctx, s.Clientset, s.Image, location, source)
+}
+
+// Starts downloading an image served over HTTPS into the backing location in the background, unless that is already
+// underway or done. The copy is shared by all volumes in the backing location that are backed by the image, so that it
+// is only downloaded once, and the Job that makes it is kept around so that it isn't started again.
+func startHttpBackingFilePull(
+	ctx context.Context,
+	clientset *common.Clientset,
+	image string,
+	location common.BackingLocation,
+	source *common.ImageCatalogHttpBackingFileSource,
+) error {
+	pullScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+
+		url="$1"
+		format="$2"
+		copy="/var/backing/$3"
+
+		# The copy is only put in place once complete, as staging switches volumes to it as soon as it exists.
+
+		if [[ ! -e "${copy}" ]]; then
+		    qemu-img convert -p -f "${format}" -O qcow2 "${url}" "${copy}.new"
+		    chmod a-w "${copy}.new"
+		    mv -f "${copy}.new" "${copy}"
+		fi
+		`,
+	)
+
+	return common.CreateJob(
+		ctx, clientset,
+		common.JobConfig{
+			Name:      common.GenerateHttpBackingPullJobName(location, source.URL),
+			Namespace: location.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "http-backing-pull",
+			},
+			Image: image,
+			Command: []string{
+				"bash", "-c", pullScript, "bash",
+				source.URL, source.Format, common.GenerateHttpBackingCopyName(source.URL),
+			},
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+		},
+	)
+}
+
+// Records on the PVC the checksum that the source image of a volume was verified against, if any.
+func recordVerifiedSha256(
+	ctx context.Context,
+	clientset *common.Clientset,
+	pvc *corev1.PersistentVolumeClaim,
+	sha256 string,
+) error {
+	if sha256 == "" {
+		return nil
+	}
+
+	return common.ApplyPvcMetadata(
+		ctx, clientset, pvc.Name, pvc.Namespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/verified-sha256": sha256},
+		},
+	)
+}
+
+func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	// This will only be called after we remove our finalizer from the volume's PVC, at which point the volume will
+	// already have been deleted.
+
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "must specify volume id")
+	}
+
+	s.operations.forget(func(key string, resp protoiface.MessageV1) bool {
+		createResp, ok := resp.(*csi.CreateVolumeResponse)
+		return ok && createResp.Volume.VolumeId == req.VolumeId || key == "expansion of volume "+req.VolumeId
+	})
+
+	resp := &csi.DeleteVolumeResponse{}
+	return resp, nil
+}
+
+func (s *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ValidateVolumeCapabilities not required by Kubernetes")
+}
+
+func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	// This is mostly for the external-health-monitor, which polls it for volume conditions (see
+	// volumeHealthController). It is polled, so it is served from the PVC cache rather than listing all PVCs from
+	// the API server each time.
+
+	volumes, err := listCachedPvcs(s.PvcInformer)
+	if err != nil {
+		return nil, err
+	}
+
+	// The starting token is an index into the list of volumes sorted by id. Volumes created or deleted between pages
+	// may thus shift the following ones, so that some are returned twice or skipped, which the CSI spec allows.
+
+	start := 0
+	if req.StartingToken != "" {
+		start, err = strconv.Atoi(req.StartingToken)
+		if err != nil || start < 0 || start > len(volumes) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token \"%s\"", req.StartingToken)
+		}
+	}
+
+	end := len(volumes)
+	if req.MaxEntries > 0 && start+int(req.MaxEntries) < end {
+		end = start + int(req.MaxEntries)
+	}
+
+	resp := &csi.ListVolumesResponse{}
+
+	for i := start; i < end; i++ {
+		pvc := volumes[i]
+
+		capacity, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64)
+		if err != nil {
+			capacity = 0 // unknown
+		}
+
+		condition := pvc.Annotations[common.Domain+"/abnormal-condition"]
+
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      string(common.VolumeUidOf(pvc)),
+				CapacityBytes: capacity,
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: &csi.VolumeCondition{
+					Abnormal: condition != "",
+					Message:  condition,
+				},
+			},
+		})
+	}
+
+	if end < len(volumes) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+
+	return resp, nil
+}
+
+func (s *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	caps := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+	}
+
+	csiCaps := make([]*csi.ControllerServiceCapability, len(caps))
+	for i, cap := range caps {
+		csiCaps[i] = &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: cap,
+				},
+			},
+		}
 	}
 
 	resp := &csi.ControllerGetCapabilitiesResponse{
@@ -423,6 +1534,17 @@ func (s *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *c
 }
 
 func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	key := "snapshot " + req.Name
+	resp, err := s.operations.run(ctx, key, req, func(ctx context.Context) (protoiface.MessageV1, error) {
+		return s.createSnapshot(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*csi.CreateSnapshotResponse), nil
+}
+
+func (s *ControllerServer) createSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
 	// TODO: If we are snapshotting a volume but snapshotting is eventually cancelled before succeeding due to the
 	// VolumeSnapshot being deleted, the source PVC might forever be stuck in the "snapshotting" state and be
 	// unmountable. Fix this somehow. Maybe add some label to the VolumeSnapshot identifying the source PVC (if
@@ -448,20 +1570,29 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
 		return nil, err
 	}
 
+	contentHash := false
+	switch req.Parameters["contentHash"] {
+	case "", "false":
+	case "true":
+		contentHash = true
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "parameter \"contentHash\" must be \"true\" or \"false\"")
+	}
+
 	volumeSnapshot, err := s.Clientset.SnapshotV1().VolumeSnapshots(volumeSnapshotNamespace).
 		Get(ctx, volumeSnapshotName, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
 
-	sourcePvcUid := types.UID(req.SourceVolumeId)
-	sourcePvc, err := common.FindPvcByLabelSelector(
-		ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, sourcePvcUid))
+	_, err = common.ConvertState(&volumeSnapshot.ObjectMeta)
 	if err != nil {
 		return nil, err
 	}
 
-	err = common.SetPvcStateTo(ctx, s.Clientset, sourcePvc.Name, sourcePvc.Namespace, "snapshotting")
+	sourcePvcUid := types.UID(req.SourceVolumeId)
+	sourcePvc, err := common.FindPvcByLabelSelector(
+		ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, sourcePvcUid))
 	if err != nil {
 		return nil, err
 	}
@@ -470,32 +1601,129 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
 	backingPvcNamespace := sourcePvc.Annotations[common.Domain+"/backing-pvc-namespace"]
 	backingPvcBasePath := sourcePvc.Annotations[common.Domain+"/backing-pvc-base-path"]
 
+	err = common.CheckBackingPvcMaintenance(ctx, s.Clientset, backingPvcName, backingPvcNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots of the same volume would conflict anyway, so we make them wait for each other instead of failing.
+	// We also limit the number of snapshots taken at once in the same backing volume, so that scheduled snapshots of
+	// many volumes don't overwhelm it.
+
+	err = s.snapshotsPerVolume.acquire(ctx, string(sourcePvcUid), 1)
+	if err != nil {
+		return nil, err
+	}
+	defer s.snapshotsPerVolume.release(string(sourcePvcUid))
+
+	backingVolumeKey := backingPvcNamespace + "/" + backingPvcName
+	err = s.snapshotsPerBackingVolume.acquire(ctx, backingVolumeKey, s.MaxConcurrentSnapshotsPerBackingVolume)
+	if err != nil {
+		return nil, err
+	}
+	defer s.snapshotsPerBackingVolume.release(backingVolumeKey)
+
+	err = common.WaitToSetPvcStateTo(ctx, s.Clientset, sourcePvc, "snapshotting")
+	if err != nil {
+		return nil, err
+	}
+
 	size, err := strconv.ParseInt(sourcePvc.Annotations[common.Domain+"/capacity"], 10, 64)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "failed to determine snapshot size")
+		return nil, status.Errorf(codes.Internal, "failed to determine snapshot size")
 	}
 
-	err = common.MergePatchVolumeSnapshot(
+	err = common.ApplyVolumeSnapshotMetadata(
 		ctx, s.Clientset, volumeSnapshotName, volumeSnapshotNamespace,
-		volumesnapshotv1.VolumeSnapshot{
-			ObjectMeta: metav1.ObjectMeta{
-				Labels: map[string]string{
-					common.Domain + "/uid": string(volumeSnapshot.UID),
-				},
-				Annotations: map[string]string{
-					common.Domain + "/backing-pvc-name":      backingPvcName,
-					common.Domain + "/backing-pvc-namespace": backingPvcNamespace,
-					common.Domain + "/backing-pvc-base-path": backingPvcBasePath,
-					common.Domain + "/size":                  strconv.FormatInt(size, 10),
-				},
+		metav1.ObjectMeta{
+			Labels: map[string]string{
+				common.Domain + "/uid": string(volumeSnapshot.UID),
 			},
+			Annotations: map[string]string{
+				common.Domain + "/backing-pvc-name":      backingPvcName,
+				common.Domain + "/backing-pvc-namespace": backingPvcNamespace,
+				common.Domain + "/backing-pvc-base-path": backingPvcBasePath,
+				common.Domain + "/size":                  strconv.FormatInt(size, 10),
+				common.Domain + "/state-version":         strconv.Itoa(common.StateVersion),
+			},
+			Finalizers: []string{common.Domain + "/cleanup"},
 		},
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	// The volume's image is backed by the snapshot's image once the Job succeeds, so a retry after a later step failed
+	// must not create the snapshot's image again. The Job itself is also safe to run again, e.g., if the controller
+	// plugin stopped before recording its completion.
+
 	snapshottingJobName := common.GenerateSnapshottingJobName(volumeSnapshot.UID)
+
+	var allocatedSize int64
+	if volumeSnapshot.Annotations[common.Domain+"/image-created"] == "true" {
+		allocatedSize = recordedSnapshotAllocatedSize(&volumeSnapshot.ObjectMeta, size)
+	} else {
+		allocatedSize, err = s.createSnapshotImage(ctx, volumeSnapshot, sourcePvc, snapshottingJobName, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = common.DeleteJobSynchronously(ctx, s.Clientset, snapshottingJobName, backingPvcNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	location := common.BackingLocation{
+		PvcName: backingPvcName, PvcNamespace: backingPvcNamespace, BasePath: backingPvcBasePath,
+	}
+	recordBackingChainChanges(ctx, s.Clientset, location, func(chains common.BackingChains) {
+		volumeImageName := common.GenerateVolumeImageName(common.VolumeUidOf(sourcePvc))
+		snapshotImageName := common.GenerateSnapshotImageName(volumeSnapshot.UID)
+		if chains[volumeImageName] != snapshotImageName {
+			chains[snapshotImageName] = chains[volumeImageName]
+			chains[volumeImageName] = snapshotImageName
+		}
+	})
+
+	err = common.SetPvcStateToIdle(ctx, s.Clientset, sourcePvc.Name, sourcePvc.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// the snapshot's image is never modified, so it can be hashed while the volume is in use again
+
+	if _, ok := volumeSnapshot.Annotations[common.Domain+"/content-hash"]; contentHash && !ok {
+		s.recordSnapshotContentHash(ctx, &volumeSnapshot.ObjectMeta, location)
+	}
+
+	resp := &csi.CreateSnapshotResponse{
+		Snapshot: &csi.Snapshot{
+			SizeBytes:      allocatedSize,
+			SnapshotId:     string(volumeSnapshot.UID),
+			SourceVolumeId: req.SourceVolumeId,
+			CreationTime:   timestamppb.Now(), // is this fine?
+			ReadyToUse:     true,
+		},
+	}
+	return resp, nil
+}
+
+// Creates the image of a snapshot with a Job, making the volume's image backed by it, and records that on the
+// VolumeSnapshot. Returns the snapshot's allocated size. The Job is left in place.
+func (s *ControllerServer) createSnapshotImage(
+	ctx context.Context,
+	volumeSnapshot *volumesnapshotv1.VolumeSnapshot,
+	sourcePvc *corev1.PersistentVolumeClaim,
+	jobName string,
+	size int64,
+) (int64, error) {
+	location := common.BackingLocationOf(&sourcePvc.ObjectMeta)
+
+	// If the volume's image is already backed by the snapshot's image, a previous run of the Job got that far, and
+	// only its last steps are repeated. Otherwise, the hard link and the new image may be left over from a previous run
+	// that failed in between, and are simply replaced.
+
 	snapshottingScript := dedent.Dedent(
 		`
 		set -o errexit -o pipefail -o nounset -o xtrace
@@ -503,81 +1731,162 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
 		pvc="$1"
 		snapshot="$2"
 
-		ln -f "/var/backing/${pvc}" "/var/backing/${snapshot}"
+		backing="$(
+		    qemu-img info -f qcow2 --output=json "/var/backing/${pvc}" | jq -r '.["backing-filename"] // empty'
+		)"
+
+		if [[ -e "/var/backing/${snapshot}" && "${backing}" == "${snapshot}" ]]; then
+		    echo "volume is already backed by the snapshot"
+		else
+		    ln -f "/var/backing/${pvc}" "/var/backing/${snapshot}"
 
-		qemu-img create -f qcow2 -b "${snapshot}" -F qcow2 "/var/backing/${pvc}.new"
-		mv -f "/var/backing/${pvc}.new" "/var/backing/${pvc}"
+		    qemu-img create -f qcow2 -b "${snapshot}" -F qcow2 "/var/backing/${pvc}.new"
+		    /subprovisioner/copy-replication-bitmaps.sh "/var/backing/${pvc}" "/var/backing/${pvc}.new"
+		    mv -f "/var/backing/${pvc}.new" "/var/backing/${pvc}"
+		fi
 
 		chmod a-w "/var/backing/${snapshot}"  # should never modify this image
+
+		info="$( qemu-img info -f qcow2 --output=json "/var/backing/${snapshot}" )"
+		echo "allocated-size $( jq '.["actual-size"]' <<< "${info}" )"
 		`,
 	)
 
-	err = common.CreateJob(
-		ctx, s.Clientset,
+	err := s.startJob(
+		ctx, snapshottingJobEvents(&volumeSnapshot.ObjectMeta),
 		common.JobConfig{
-			Name:      snapshottingJobName,
-			Namespace: backingPvcNamespace,
+			Name:      jobName,
+			Namespace: location.PvcNamespace,
 			Labels: map[string]string{
 				common.Domain + "/component": "volume-snapshotting",
-				common.Domain + "/pvc-uid":   string(sourcePvc.UID),
+				common.Domain + "/pvc-uid":   string(common.VolumeUidOf(sourcePvc)),
 			},
-			Image: s.Image,
+			PropagateFrom: &sourcePvc.ObjectMeta,
+			Image:         s.Image,
 			Command: []string{
 				"bash", "-c", snapshottingScript, "bash",
-				fmt.Sprintf("pvc-%s.qcow2", sourcePvc.UID),
-				fmt.Sprintf("snapshot-%s.qcow2", volumeSnapshot.UID),
+				common.GenerateVolumeImageName(common.VolumeUidOf(sourcePvc)),
+				common.GenerateSnapshotImageName(volumeSnapshot.UID),
 			},
-			BackingPvcName:     backingPvcName,
-			BackingPvcBasePath: backingPvcBasePath,
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
 		},
 	)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	err = common.WaitForJobToSucceed(ctx, s.Clientset, snapshottingJobName, backingPvcNamespace)
+	err = s.waitForJob(ctx, snapshottingJobEvents(&volumeSnapshot.ObjectMeta), jobName, location.PvcNamespace)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	err = common.DeleteJobSynchronously(ctx, s.Clientset, snapshottingJobName, backingPvcNamespace)
-	if err != nil {
-		return nil, err
-	}
+	allocatedSize := s.measureSnapshotAllocatedSize(
+		ctx, volumeSnapshot.Name, volumeSnapshot.Namespace, jobName, location.PvcNamespace, size,
+	)
 
-	err = common.SetPvcStateToIdle(ctx, s.Clientset, sourcePvc.Name, sourcePvc.Namespace)
+	err = common.ApplyVolumeSnapshotMetadata(
+		ctx, s.Clientset, volumeSnapshot.Name, volumeSnapshot.Namespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/image-created": "true"},
+		},
+	)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	resp := &csi.CreateSnapshotResponse{
-		Snapshot: &csi.Snapshot{
-			SizeBytes:      size,
-			SnapshotId:     string(volumeSnapshot.UID),
-			SourceVolumeId: req.SourceVolumeId,
-			CreationTime:   timestamppb.Now(), // is this fine?
-			ReadyToUse:     true,
-		},
-	}
-	return resp, nil
+	return allocatedSize, nil
 }
 
 func (s *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	// TODO: Delete any qcow2 images in the backing chains that aren't referenced by any PVC or snapshot anymore. To
-	// ensure idempotency, probably begin by creating graph of all qcow2 files connected to the top-level file being
-	// deleted (regardless of edge direction), determine which will be left dangling and should be deleted, and
-	// finally delete them all in one go. Must also take care to synchronize with volumes being created from the
-	// snapshot.
+	// The snapshot's image is deleted by snapshotCleanupController once the VolumeSnapshot is gone and nothing depends
+	// on the image anymore.
 
 	if req.SnapshotId == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "must specify snapshot id")
 	}
 
+	s.operations.forget(func(key string, resp protoiface.MessageV1) bool {
+		createResp, ok := resp.(*csi.CreateSnapshotResponse)
+		return ok && createResp.Snapshot.SnapshotId == req.SnapshotId
+	})
+
+	// Volumes created from the snapshot are backed by its image, so it must be kept around while they exist. We
+	// don't block deletion of the snapshot itself, but let users know that its image is still in use.
+
+	volumeSnapshotUid := types.UID(req.SnapshotId)
+
+	dependents, err := common.ListSnapshotDependents(ctx, s.Clientset, volumeSnapshotUid)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dependents) > 0 {
+		names := make([]string, len(dependents))
+		for i := range dependents {
+			names[i] = dependents[i].Namespace + "/" + dependents[i].Name
+		}
+
+		klog.V(2).InfoS("Retaining image of snapshot for dependent PVCs", "snapshot", volumeSnapshotUid, "pvcs", names)
+		s.reportSnapshotDependents(ctx, volumeSnapshotUid, names)
+	}
+
 	resp := &csi.DeleteSnapshotResponse{}
 	return resp, nil
 }
 
+// Lets users know why a deleted snapshot's image is retained, through an Event on the VolumeSnapshot. Best-effort,
+// since this is purely informational, and done only once per VolumeSnapshot, as the external-snapshotter keeps
+// retrying DeleteSnapshot() until the VolumeSnapshot is gone.
+func (s *ControllerServer) reportSnapshotDependents(
+	ctx context.Context, volumeSnapshotUid types.UID, dependentNames []string,
+) {
+	volumeSnapshot, err := common.FindVolumeSnapshotByLabelSelector(
+		ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, volumeSnapshotUid))
+	if k8serrors.IsNotFound(err) {
+		return // already gone, nobody to report to
+	} else if err != nil {
+		klog.ErrorS(err, "Failed to report dependents of snapshot", "snapshot", volumeSnapshotUid)
+		return
+	}
+
+	if volumeSnapshot.Annotations[common.Domain+"/dependents-reported"] == "true" {
+		return
+	}
+
+	err = common.EmitEvent(
+		ctx, s.Clientset, common.VolumeSnapshotEventObject(&volumeSnapshot.ObjectMeta),
+		corev1.EventTypeNormal, "SnapshotHasDependents",
+		"Snapshot image is retained while volumes created from it exist: %s", strings.Join(dependentNames, ", "),
+	)
+	if err == nil {
+		err = common.ApplyVolumeSnapshotMetadata(
+			ctx, s.Clientset, volumeSnapshot.Name, volumeSnapshot.Namespace,
+			metav1.ObjectMeta{
+				Annotations: map[string]string{common.Domain + "/dependents-reported": "true"},
+			},
+		)
+	}
+	if err != nil && !k8serrors.IsNotFound(err) {
+		klog.ErrorS(
+			err, "Failed to report dependents of VolumeSnapshot",
+			"volumeSnapshot", klog.KRef(volumeSnapshot.Namespace, volumeSnapshot.Name),
+		)
+	}
+}
+
 func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	key := "expansion of volume " + req.VolumeId
+	resp, err := s.operations.run(ctx, key, req, func(ctx context.Context) (protoiface.MessageV1, error) {
+		return s.controllerExpandVolume(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*csi.ControllerExpandVolumeResponse), nil
+}
+
+func (s *ControllerServer) controllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	// TODO: Handle case where this RPC is retried with a larger min capacity, but the volume expansion job is
 	// already running and expanding the volume to the previous lower min capacity.
 
@@ -605,13 +1914,21 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 		return nil, err
 	}
 
-	backingPvcName := pvc.Annotations[common.Domain+"/backing-pvc-name"]
-	backingPvcNamespace := pvc.Annotations[common.Domain+"/backing-pvc-namespace"]
-	backingPvcBasePath := pvc.Annotations[common.Domain+"/backing-pvc-base-path"]
+	// both copies of a mirrored volume are expanded, or only the up-to-date one if the other is degraded
+
+	location, mirrorMount := common.VolumeCopiesOf(&pvc.ObjectMeta)
+	backingPvcName := location.PvcName
+	backingPvcNamespace := location.PvcNamespace
+	backingPvcBasePath := location.BasePath
+
+	err = common.CheckBackingPvcMaintenance(ctx, s.Clientset, backingPvcName, backingPvcNamespace)
+	if err != nil {
+		return nil, err
+	}
 
 	currentCapacity, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "failed to determine current volume capacity")
+		return nil, status.Errorf(codes.Internal, "failed to determine current volume capacity")
 	}
 	if maxCapacity != 0 && currentCapacity > maxCapacity {
 		return nil, status.Errorf(
@@ -625,7 +1942,8 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 		// succeeded, but the external-resizer sidecar container failed to patch the PVC because the PVC was
 		// mutated while the gRPC was being run (we changed the state annotation on it twice). external-resizer
 		// should arguably be fixed to tolerate this. TODO: We should eventually get rid of annotations on the
-		// PVC that the user can control, though, and this problem may just go away then.
+		// PVC that the user can control, though, and this problem may just go away then. The capacity of a staged
+		// volume is only recorded once the node plugin has grown it, so there is nothing left for it to do.
 		resp := &csi.ControllerExpandVolumeResponse{
 			CapacityBytes:         currentCapacity,
 			NodeExpansionRequired: false,
@@ -633,44 +1951,108 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 		return resp, nil
 	}
 
-	// update volume state
+	immutable, err := common.LockImmutableVolume(ctx, s.Clientset, pvc)
+	if err != nil {
+		return nil, err
+	}
+	if immutable {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume is immutable")
+	}
+
+	// LockImmutableVolume() made sure that the PVC is bound
 
-	err = common.SetPvcStateTo(ctx, s.Clientset, pvc.Name, pvc.Namespace, "expanding")
+	pv, err := s.Clientset.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if pv.Spec.CSI != nil && pv.Spec.CSI.VolumeAttributes["integrity"] == "true" {
+		return nil, status.Errorf(codes.FailedPrecondition, "volumes with integrity protection can't be expanded")
+	}
+
+	// update volume state, unless the volume is staged, in which case the node plugin expands it; that the volume's
+	// image format allows expanding it is checked first, as failing to set the state is taken to mean that it's staged
+
+	err = common.CheckRawVolumeState(&pvc.ObjectMeta, "expanding")
 	if err != nil {
 		return nil, err
 	}
 
+	err = common.WaitToSetPvcStateTo(ctx, s.Clientset, pvc, "expanding")
+	if status.Code(err) == codes.FailedPrecondition && pvc.Annotations[common.Domain+"/state"] == "staged" {
+		return s.expandStagedVolume(ctx, pvc, mirrorMount != nil, capacity)
+	} else if err != nil {
+		return nil, err
+	}
+
 	// create volume expansion job
 
-	volumeImagePath := common.GenerateVolumeImagePath(pvc.UID)
-	expansionJobName := common.GenerateExpansionJobName(pvc.UID)
+	volumeImagePath := common.GenerateVolumeImagePath(common.VolumeUidOf(pvc))
+	expansionJobName := common.GenerateExpansionJobName(common.VolumeUidOf(pvc))
+
+	var extraPvcMounts []common.PvcMount
+	var mirrorImagePaths []string
+	if mirrorMount != nil {
+		extraPvcMounts = []common.PvcMount{*mirrorMount}
+		mirrorImagePaths = []string{common.GenerateVolumeMirrorImagePath(common.VolumeUidOf(pvc))}
+	}
+
+	// Cloned volumes and volumes created from snapshots are overlays of their source's image, which is left as is.
+	// Reads past the end of the backing file return zeros, so the overlay can simply be grown beyond it, without
+	// flattening the chain. The backing file must be opened along with the overlay for this, though, which is why
+	// inspecting the chain first fails outright if it is broken.
+	//
+	// A volume that was shrunk (see shrinkController) may have a backing file that is bigger than the volume was, whose
+	// data past the volume's previous end must not show through the new area. QEMU zeroes that area itself when growing
+	// an overlay, but the script zeroes it explicitly as well, from the capacity recorded before expanding, which is
+	// still recorded if the Job is run again after resizing the image. Zeroing is only metadata for qcow2 images.
 
 	expansionScript := dedent.Dedent(
 		`
 		set -o errexit -o pipefail -o nounset -o xtrace
-		size="$( qemu-img info -f qcow2 --output=json "$1" | jq '.["virtual-size"]' )"
-		if [ "${size}" -lt "$2" ]; then
-		    qemu-img resize -f qcow2 "$1" "$2"
-		fi
+
+		format="$1"
+		capacity="$2"
+		previous_capacity="$3"
+		shift 3
+
+		for image in "$@"; do
+		    chain="$( qemu-img info -f "${format}" --backing-chain --output=json "${image}" )"
+		    size="$( jq '.[0]["virtual-size"]' <<< "${chain}" )"
+		    backing_size="$( jq '.[1]["virtual-size"] // 0' <<< "${chain}" )"
+
+		    if (( size < capacity )); then
+		        qemu-img resize -f "${format}" "${image}" "${capacity}"
+		    fi
+
+		    end="$(( backing_size < capacity ? backing_size : capacity ))"
+		    if (( end > previous_capacity )); then
+		        qemu-io -f "${format}" --cmd "write -z ${previous_capacity} $(( end - previous_capacity ))" "${image}"
+		    fi
+		done
 		`,
 	)
 
-	err = common.CreateJob(
-		ctx, s.Clientset,
+	err = s.startJob(
+		ctx, expansionJobEvents(pvc),
 		common.JobConfig{
 			Name:      expansionJobName,
 			Namespace: backingPvcNamespace,
 			Labels: map[string]string{
 				common.Domain + "/component": "volume-expansion",
-				common.Domain + "/pvc-uid":   string(pvc.UID),
-			},
-			Image: s.Image,
-			Command: []string{
-				"bash", "-c", expansionScript, "bash",
-				volumeImagePath, strconv.FormatInt(capacity, 10),
+				common.Domain + "/pvc-uid":   string(common.VolumeUidOf(pvc)),
 			},
+			PropagateFrom: &pvc.ObjectMeta,
+			Image:         s.Image,
+			Command: append(
+				[]string{
+					"bash", "-c", expansionScript, "bash", common.VolumeImageFormatOf(&pvc.ObjectMeta),
+					strconv.FormatInt(capacity, 10), strconv.FormatInt(currentCapacity, 10), volumeImagePath,
+				},
+				mirrorImagePaths...,
+			),
 			BackingPvcName:     backingPvcName,
 			BackingPvcBasePath: backingPvcBasePath,
+			ExtraPvcMounts:     extraPvcMounts,
 		},
 	)
 	if err != nil {
@@ -679,7 +2061,7 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 
 	// await volume expansion job
 
-	err = common.WaitForJobToSucceed(ctx, s.Clientset, expansionJobName, backingPvcNamespace)
+	err = s.waitForJob(ctx, expansionJobEvents(pvc), expansionJobName, backingPvcNamespace)
 	if err != nil {
 		return nil, err
 	}
@@ -691,17 +2073,15 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 		return nil, err
 	}
 
-	// set volume back to idle
+	// record new capacity, which also covers any expansion that was pending while the volume was staged, and set volume
+	// back to idle
 
-	err = common.StrategicMergePatchPvc(
+	err = common.UpdatePvcMetadata(
 		ctx, s.Clientset, pvc.Name, pvc.Namespace,
-		corev1.PersistentVolumeClaim{
-			ObjectMeta: metav1.ObjectMeta{
-				Annotations: map[string]string{
-					common.Domain + "/capacity": strconv.FormatInt(capacity, 10),
-					common.Domain + "/state":    "idle",
-				},
-			},
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			common.CommitCapacity(pvc, capacity)
+			pvc.Annotations[common.Domain+"/state"] = "idle"
+			return nil
 		},
 	)
 	if err != nil {
@@ -715,6 +2095,106 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 	return resp, nil
 }
 
+// Expands a volume while it is staged. Its image is in use by the qemu-storage-daemon instance serving it, so the new
+// capacity is only recorded as pending here, and NodeExpandVolume() then has that instance grow the image and commits
+// it. If the volume is
+// unstaged before that happens, Kubernetes expands it on the node when it is staged again.
+func (s *ControllerServer) expandStagedVolume(
+	ctx context.Context,
+	pvc *corev1.PersistentVolumeClaim,
+	mirrored bool,
+	capacity int64,
+) (*csi.ControllerExpandVolumeResponse, error) {
+	// the copies of a mirrored volume are served through a quorum, which can't be resized
+	if mirrored {
+		return nil, status.Errorf(codes.FailedPrecondition, "mirrored volumes can only be expanded while unstaged")
+	}
+	// the image is in use by the shared export, which no node plugin can reach
+	if pvc.Annotations[common.Domain+"/staged-shared"] == "true" {
+		return nil, status.Errorf(
+			codes.FailedPrecondition, "volumes staged on several nodes read-write can only be expanded while unstaged",
+		)
+	}
+	if pvc.Annotations[common.Domain+"/staged-read-write-on-node"] == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "volumes staged read-only can't be expanded")
+	}
+
+	// the capacity is only committed once the node plugin has grown the image, as until then the volume doesn't have it
+
+	err := common.UpdatePvcMetadata(
+		ctx, s.Clientset, pvc.Name, pvc.Namespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			pending, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/pending-capacity"], 10, 64)
+			if err != nil || pending < capacity {
+				pvc.Annotations[common.Domain+"/pending-capacity"] = strconv.FormatInt(capacity, 10)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s.emitEvent(
+		ctx, common.PvcEventObject(pvc), corev1.EventTypeNormal, "VolumeExpansionStarted",
+		"Expanding the volume to %d bytes while it is staged on node %s",
+		capacity, pvc.Annotations[common.Domain+"/staged-read-write-on-node"],
+	)
+
+	resp := &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         capacity,
+		NodeExpansionRequired: true,
+	}
+	return resp, nil
+}
+
+// Parses a "[<namespace>/]<name>" backing PVC reference given in a PVC annotation and checks that it is listed in
+// allowedList, a comma-separated list of references of the same form. References without a namespace refer to
+// defaultNamespace.
+func resolveBackingClaimOverride(
+	override string,
+	defaultNamespace string,
+	allowedList string,
+) (name string, namespace string, err error) {
+	name, namespace = parseBackingClaimRef(override, defaultNamespace)
+	if name == "" || namespace == "" {
+		return "", "", status.Errorf(
+			codes.InvalidArgument, "invalid annotation \"%s/backing-claim\": \"%s\"", common.Domain, override,
+		)
+	}
+
+	if allowedList != "" {
+		for _, allowed := range strings.Split(allowedList, ",") {
+			allowedName, allowedNamespace := parseBackingClaimRef(allowed, defaultNamespace)
+			if allowedName == name && allowedNamespace == namespace {
+				return name, namespace, nil
+			}
+		}
+	}
+
+	return "", "", status.Errorf(
+		codes.InvalidArgument,
+		"backing volume \"%s/%s\" requested by annotation \"%s/backing-claim\" is not allowed by the StorageClass",
+		namespace, name, common.Domain,
+	)
+}
+
+// Parses a "[<namespace>/]<name>" backing PVC reference. References without a namespace refer to defaultNamespace.
+func parseBackingClaimRef(ref string, defaultNamespace string) (name string, namespace string) {
+	ref = strings.TrimSpace(ref)
+	if i := strings.IndexByte(ref, '/'); i >= 0 {
+		return ref[i+1:], ref[:i]
+	}
+	return ref, defaultNamespace
+}
+
+// The node that the scheduler selected for the first pod using the given PVC, if its StorageClass has volumeBindingMode
+// WaitForFirstConsumer, or "". Running the Jobs that provision the volume there warms that node's caches for staging
+// the volume right afterwards.
+func selectedNodeOf(pvc *corev1.PersistentVolumeClaim) string {
+	return pvc.Annotations["volume.kubernetes.io/selected-node"]
+}
+
 func validateCapacity(capacityRange *csi.CapacityRange) (capacity int64, minCapacity int64, maxCapacity int64, err error) {
 	if capacityRange == nil {
 		return -1, -1, -1, status.Errorf(codes.InvalidArgument, "must specify capacity")
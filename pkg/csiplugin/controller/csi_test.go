@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResolveBackingClaimOverride(t *testing.T) {
+	tests := []struct {
+		override      string
+		allowed       string
+		wantName      string
+		wantNamespace string
+		wantCode      codes.Code
+	}{
+		{"fast", "fast", "fast", "default-ns", codes.OK},
+		{"fast", "default-ns/fast", "fast", "default-ns", codes.OK},
+		{"other-ns/fast", "slow, other-ns/fast", "fast", "other-ns", codes.OK},
+		{" other-ns/fast ", "other-ns/fast", "fast", "other-ns", codes.OK},
+		{"other-ns/fast", "fast", "", "", codes.InvalidArgument},
+		{"fast", "other-ns/fast", "", "", codes.InvalidArgument},
+		{"fast", "", "", "", codes.InvalidArgument},
+		{"other-ns/", "other-ns/", "", "", codes.InvalidArgument},
+		{"/fast", "/fast", "", "", codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		name, namespace, err := resolveBackingClaimOverride(test.override, "default-ns", test.allowed)
+
+		if code := status.Code(err); code != test.wantCode {
+			t.Errorf("resolveBackingClaimOverride(%q, %q): got code %v, want %v",
+				test.override, test.allowed, code, test.wantCode)
+			continue
+		}
+		if name != test.wantName || namespace != test.wantNamespace {
+			t.Errorf("resolveBackingClaimOverride(%q, %q): got %s/%s, want %s/%s",
+				test.override, test.allowed, namespace, name, test.wantNamespace, test.wantName)
+		}
+	}
+}
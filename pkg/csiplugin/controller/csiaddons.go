@@ -0,0 +1,334 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/csi-addons/spec/lib/go/replication"
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Implements the csi-addons replication API on top of VolumeReplication objects, so that tooling like Ramen can
+// orchestrate failover of volumes.
+//
+// Enabling replication creates a VolumeReplication object for the volume, configured from the VolumeReplicationClass
+// parameters "interval", "targetClaimName", and "targetPath", and disabling replication deletes it. Demoting a volume
+// turns it into a replication secondary, which stops its replication and only allows it to be staged read-only.
+// Resyncing a secondary replaces its contents with the latest replica in the target. Promoting a volume turns it back
+// into a regular volume.
+type ReplicationServer struct {
+	replication.UnimplementedControllerServer
+	Clientset *common.Clientset
+	Image     string
+
+	operations operationCache
+}
+
+func (s *ReplicationServer) EnableVolumeReplication(ctx context.Context, req *replication.EnableVolumeReplicationRequest) (*replication.EnableVolumeReplicationResponse, error) {
+	pvc, err := s.findPvc(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := time.ParseDuration(req.Parameters["interval"])
+	if err != nil || interval <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "missing/invalid parameter \"interval\"")
+	}
+
+	targetClaimName := req.Parameters["targetClaimName"]
+	if targetClaimName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing/empty parameter \"targetClaimName\"")
+	}
+
+	err = common.CreateVolumeReplication(ctx, s.Clientset, &common.VolumeReplication{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      common.GenerateVolumeReplicationName(common.VolumeUidOf(pvc)),
+			Namespace: pvc.Namespace,
+		},
+		Spec: common.VolumeReplicationSpec{
+			PvcName:  pvc.Name,
+			Interval: metav1.Duration{Duration: interval},
+			Target: common.VolumeReplicationTarget{
+				ClaimName: targetClaimName,
+				Path:      req.Parameters["targetPath"],
+			},
+			Managed: true,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &replication.EnableVolumeReplicationResponse{}
+	return resp, nil
+}
+
+func (s *ReplicationServer) DisableVolumeReplication(ctx context.Context, req *replication.DisableVolumeReplicationRequest) (*replication.DisableVolumeReplicationResponse, error) {
+	pvc, err := s.findPvc(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = common.DeleteVolumeReplication(
+		ctx, s.Clientset, common.GenerateVolumeReplicationName(common.VolumeUidOf(pvc)), pvc.Namespace,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = common.SetPvcReplicationRole(ctx, s.Clientset, pvc.Name, pvc.Namespace, false)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &replication.DisableVolumeReplicationResponse{}
+	return resp, nil
+}
+
+func (s *ReplicationServer) PromoteVolume(ctx context.Context, req *replication.PromoteVolumeRequest) (*replication.PromoteVolumeResponse, error) {
+	pvc, err := s.findPvc(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = common.SetPvcReplicationRole(ctx, s.Clientset, pvc.Name, pvc.Namespace, false)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &replication.PromoteVolumeResponse{}
+	return resp, nil
+}
+
+func (s *ReplicationServer) DemoteVolume(ctx context.Context, req *replication.DemoteVolumeRequest) (*replication.DemoteVolumeResponse, error) {
+	pvc, err := s.findPvc(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = common.SetPvcReplicationRole(ctx, s.Clientset, pvc.Name, pvc.Namespace, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &replication.DemoteVolumeResponse{}
+	return resp, nil
+}
+
+func (s *ReplicationServer) ResyncVolume(ctx context.Context, req *replication.ResyncVolumeRequest) (*replication.ResyncVolumeResponse, error) {
+	key := "resync of volume " + req.VolumeId
+	resp, err := s.operations.run(ctx, key, req, func(ctx context.Context) (protoiface.MessageV1, error) {
+		return s.resyncVolume(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*replication.ResyncVolumeResponse), nil
+}
+
+func (s *ReplicationServer) resyncVolume(ctx context.Context, req *replication.ResyncVolumeRequest) (resp *replication.ResyncVolumeResponse, err error) {
+	pvc, err := s.findPvc(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !common.PvcIsReplicationSecondary(pvc) {
+		return nil, status.Errorf(codes.FailedPrecondition, "only replication secondaries can be resynced")
+	}
+
+	volumeReplication, err := s.getVolumeReplication(ctx, pvc)
+	if err != nil {
+		return nil, err
+	}
+
+	capacity, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to determine volume capacity")
+	}
+
+	backingPvcName := pvc.Annotations[common.Domain+"/backing-pvc-name"]
+	backingPvcNamespace := pvc.Annotations[common.Domain+"/backing-pvc-namespace"]
+	backingPvcBasePath := pvc.Annotations[common.Domain+"/backing-pvc-base-path"]
+	pvcUid := common.VolumeUidOf(pvc)
+
+	err = common.CheckBackingPvcMaintenance(ctx, s.Clientset, backingPvcName, backingPvcNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	resyncJobName := common.GenerateResyncJobName(pvcUid)
+
+	// If we fail after this point, we remove the Job and return the volume to the "idle" state, so that a new
+	// attempt starts from scratch. If we crash instead, the next attempt resumes waiting for the Job.
+
+	err = common.WaitToSetPvcStateTo(ctx, s.Clientset, pvc, "resyncing")
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			// use a new context, as ours may have been canceled or timed out
+			rollbackCtx := context.Background()
+			rollbackErr := common.DeleteJobSynchronously(rollbackCtx, s.Clientset, resyncJobName, backingPvcNamespace)
+			if rollbackErr == nil {
+				rollbackErr = common.SetPvcStateToIdle(rollbackCtx, s.Clientset, pvc.Name, pvc.Namespace)
+			}
+			if rollbackErr != nil {
+				klog.ErrorS(rollbackErr, "Failed to roll back resync of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+			}
+		}
+	}()
+
+	resyncScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+
+		dest="$1"
+		target_dir="$2"
+		capacity="$3"
+
+		last="$(
+		    find "${target_dir}" -maxdepth 1 -regex '.*/[0-9]+\.qcow2' -printf '%f\n' |
+		    sort -n | tail -n 1
+		    )"
+
+		if [[ -z "${last}" ]]; then
+		    >&2 echo "no replica to resync from in ${target_dir}"
+		    exit 1
+		fi
+
+		size="$( qemu-img info -f qcow2 --output=json "${target_dir}/${last}" | jq '.["virtual-size"]' )"
+
+		if [ "${size}" -gt "${capacity}" ]; then
+		    >&2 echo "replica virtual size (${size}) exceeds volume capacity (${capacity})"
+		    exit 1
+		fi
+
+		# Only replace the volume image once the new one is complete. The old image may still be the backing file
+		# of snapshots, which are left untouched.
+
+		qemu-img convert -f qcow2 -O qcow2 "${target_dir}/${last}" "${dest}.resync"
+		qemu-img resize -f qcow2 "${dest}.resync" "${capacity}"
+		mv -f "${dest}.resync" "${dest}"
+		`,
+	)
+
+	resyncJobBackoffLimit := int32(2)
+
+	err = common.CreateJob(
+		ctx, s.Clientset,
+		common.JobConfig{
+			Name:      resyncJobName,
+			Namespace: backingPvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "volume-resync",
+				common.Domain + "/pvc-uid":   string(pvcUid),
+			},
+			PropagateFrom: &pvc.ObjectMeta,
+			Image:         s.Image,
+			Command: []string{
+				"bash", "-c", resyncScript, "bash",
+				common.GenerateVolumeImagePath(pvcUid),
+				"/var/target/" + volumeReplication.Spec.Target.ReplicaDirectory(pvcUid),
+				strconv.FormatInt(capacity, 10),
+			},
+			BackingPvcName:     backingPvcName,
+			BackingPvcBasePath: backingPvcBasePath,
+			ExtraPvcMounts: []common.PvcMount{
+				{
+					PvcName:   volumeReplication.Spec.Target.ClaimName,
+					MountPath: "/var/target",
+					SubPath:   volumeReplication.Spec.Target.Path,
+				},
+			},
+			BackoffLimit: &resyncJobBackoffLimit,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = common.WaitForJobToSucceedWithin(
+		ctx, s.Clientset, resyncJobName, backingPvcNamespace, volumeReplication.Spec.TimeoutOrDefault(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = common.DeleteJobSynchronously(ctx, s.Clientset, resyncJobName, backingPvcNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	location := common.BackingLocation{
+		PvcName: backingPvcName, PvcNamespace: backingPvcNamespace, BasePath: backingPvcBasePath,
+	}
+	recordBackingChainChanges(ctx, s.Clientset, location, func(chains common.BackingChains) {
+		chains[common.GenerateVolumeImageName(pvcUid)] = "" // now standalone
+	})
+
+	err = common.SetPvcStateToIdle(ctx, s.Clientset, pvc.Name, pvc.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	resp = &replication.ResyncVolumeResponse{
+		Ready: true,
+	}
+	return resp, nil
+}
+
+func (s *ReplicationServer) GetVolumeReplicationInfo(ctx context.Context, req *replication.GetVolumeReplicationInfoRequest) (*replication.GetVolumeReplicationInfoResponse, error) {
+	pvc, err := s.findPvc(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeReplication, err := s.getVolumeReplication(ctx, pvc)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &replication.GetVolumeReplicationInfoResponse{}
+	if volumeReplication.Status.LastSyncTime != nil {
+		resp.LastSyncTime = timestamppb.New(volumeReplication.Status.LastSyncTime.Time)
+	}
+	return resp, nil
+}
+
+func (s *ReplicationServer) findPvc(ctx context.Context, volumeId string) (*corev1.PersistentVolumeClaim, error) {
+	if volumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "must specify volume id")
+	}
+
+	pvcUid := types.UID(volumeId)
+	return common.FindPvcByLabelSelector(ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, pvcUid))
+}
+
+func (s *ReplicationServer) getVolumeReplication(
+	ctx context.Context,
+	pvc *corev1.PersistentVolumeClaim,
+) (*common.VolumeReplication, error) {
+	volumeReplication, err := common.GetVolumeReplication(
+		ctx, s.Clientset, common.GenerateVolumeReplicationName(common.VolumeUidOf(pvc)), pvc.Namespace,
+	)
+	if k8serrors.IsNotFound(err) {
+		return nil, status.Errorf(codes.FailedPrecondition, "replication is not enabled for this volume")
+	}
+	return volumeReplication, err
+}
@@ -0,0 +1,244 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/metrics"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	volumeDeletionQueueDepth = metrics.Default.NewGaugeVec(
+		"subprovisioner_volume_deletion_queue_depth",
+		"Number of deleted PVCs whose volumes are waiting to be deleted or being deleted.",
+	)
+	volumeDeletionQueueOldestSeconds = metrics.Default.NewGaugeVec(
+		"subprovisioner_volume_deletion_queue_oldest_seconds",
+		"How long the deleted PVC that has been waiting the longest for its volume to be deleted has been waiting.",
+	)
+	volumeDeletionsInProgress = metrics.Default.NewGaugeVec(
+		"subprovisioner_volume_deletions_in_progress",
+		"Number of volumes being deleted in a backing volume.",
+		"backing_pvc_namespace", "backing_pvc_name",
+	)
+)
+
+// How the deletion of the volumes of deleted PVCs is paced, so that deleting many PVCs at once doesn't flood a backing
+// volume with deletion Jobs. Zero values are replaced by defaults.
+type DeletionOptions struct {
+	// The number of volumes being deleted at once overall.
+	Workers int
+
+	// The number of volumes being deleted at once in the same backing volume. Further volumes wait for their turn
+	// without counting as failed attempts.
+	MaxConcurrentPerBackingVolume int
+
+	// The longest time after which a failed deletion is retried. The delay starts small and doubles with every
+	// consecutive failure of the same volume.
+	MaxRetryDelay time.Duration
+}
+
+const (
+	defaultDeletionWorkers                        = 4
+	defaultMaxConcurrentDeletionsPerBackingVolume = 2
+	defaultMaxDeletionRetryDelay                  = 5 * time.Minute
+
+	// the delay before the first retry of a failed deletion
+	deletionRetryBaseDelay = time.Second
+
+	// how long a volume waits before checking again whether its backing volume has room for another deletion
+	deletionBackpressureDelay = 5 * time.Second
+)
+
+func (o DeletionOptions) withDefaults() DeletionOptions {
+	if o.Workers <= 0 {
+		o.Workers = defaultDeletionWorkers
+	}
+	if o.MaxConcurrentPerBackingVolume <= 0 {
+		o.MaxConcurrentPerBackingVolume = defaultMaxConcurrentDeletionsPerBackingVolume
+	}
+	if o.MaxRetryDelay <= 0 {
+		o.MaxRetryDelay = defaultMaxDeletionRetryDelay
+	}
+	return o
+}
+
+// Tracks since when each deleted PVC has been waiting for its volume to be deleted, for the queue metrics.
+type deletionBacklog struct {
+	mutex sync.Mutex
+	since map[string]time.Time // keyed by the PVC's namespace and name
+}
+
+// Records that the PVC with the given key is waiting, unless it already was.
+func (b *deletionBacklog) add(key string, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.since == nil {
+		b.since = map[string]time.Time{}
+	}
+	if _, ok := b.since[key]; !ok {
+		b.since[key] = now
+	}
+}
+
+// Records that the PVC with the given key is no longer waiting, e.g., because its volume was deleted.
+func (b *deletionBacklog) remove(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.since, key)
+}
+
+// Returns the number of waiting PVCs and how long the one waiting the longest has been waiting.
+func (b *deletionBacklog) stats(now time.Time) (depth int, oldest time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, since := range b.since {
+		if age := now.Sub(since); age > oldest {
+			oldest = age
+		}
+	}
+	return len(b.since), oldest
+}
+
+func (b *deletionBacklog) exportMetrics() {
+	depth, oldest := b.stats(time.Now())
+	volumeDeletionQueueDepth.Set(float64(depth))
+	volumeDeletionQueueOldestSeconds.Set(oldest.Seconds())
+}
+
+// The API operations on a volume's creation Job and its pods that deleteCreationJobIfNeverRan() carries out.
+type creationJobApi interface {
+	getJob(ctx context.Context) (*batchv1.Job, error)
+	listPods(ctx context.Context) ([]corev1.Pod, error)
+
+	// Deletes the Job unless its UID differs, orphaning its pods so that it doesn't replace them.
+	orphanJob(ctx context.Context, uid types.UID) error
+
+	// Deletes the pod unless it changed since it was read, e.g., because it was scheduled to a node.
+	deletePod(ctx context.Context, pod *corev1.Pod) error
+}
+
+type clientsetCreationJobApi struct {
+	clientset *common.Clientset
+	namespace string
+	jobName   string
+}
+
+func (a *clientsetCreationJobApi) getJob(ctx context.Context) (*batchv1.Job, error) {
+	return a.clientset.BatchV1().Jobs(a.namespace).Get(ctx, a.jobName, metav1.GetOptions{})
+}
+
+func (a *clientsetCreationJobApi) listPods(ctx context.Context) ([]corev1.Pod, error) {
+	pods, err := a.clientset.CoreV1().Pods(a.namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + a.jobName})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+func (a *clientsetCreationJobApi) orphanJob(ctx context.Context, uid types.UID) error {
+	propagationPolicy := metav1.DeletePropagationOrphan
+	return a.clientset.BatchV1().Jobs(a.namespace).Delete(ctx, a.jobName, metav1.DeleteOptions{
+		Preconditions:     &metav1.Preconditions{UID: &uid},
+		PropagationPolicy: &propagationPolicy,
+	})
+}
+
+func (a *clientsetCreationJobApi) deletePod(ctx context.Context, pod *corev1.Pod) error {
+	return a.clientset.CoreV1().Pods(a.namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &pod.UID, ResourceVersion: &pod.ResourceVersion},
+	})
+}
+
+// Deletes the volume's creation Job and returns true if it never got to run, e.g., because the PVC was deleted while
+// the Job's pod was still being scheduled, in which case there is nothing in the backing volume to delete. Volumes
+// without a creation Job may still exist, as it is deleted when volumes are adopted, migrated, or relocated.
+//
+// A pod may be scheduled and start running at any time until it is deleted, so the Job is deleted first, orphaning its
+// pods, and then each pod only if it still hasn't changed since it was seen unscheduled. If any of that fails, the
+// Job may have run, and false is returned, possibly leaving pods behind for deleteVolume() to delete.
+func deleteCreationJobIfNeverRan(ctx context.Context, api creationJobApi) (bool, error) {
+	job, err := api.getJob(ctx)
+	if k8serrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	pods, err := api.listPods(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if jobMayHaveRun(job, pods) {
+		return false, nil
+	}
+
+	err = api.orphanJob(ctx, job.UID)
+	if k8serrors.IsNotFound(err) || k8serrors.IsConflict(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	deleted := map[types.UID]bool{}
+	for i := range pods {
+		err := api.deletePod(ctx, &pods[i])
+		if k8serrors.IsNotFound(err) || k8serrors.IsConflict(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		deleted[pods[i].UID] = true
+	}
+
+	// the Job may have created another pod before it was deleted
+
+	pods, err = api.listPods(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, pod := range pods {
+		if !deleted[pod.UID] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Whether any pod of the Job may have started running its containers, going by the Job and its current pods. Pods
+// are only certain not to have started until they are scheduled to a node, as their status lags behind their
+// containers'.
+func jobMayHaveRun(job *batchv1.Job, pods []corev1.Pod) bool {
+	if job.Status.Succeeded > 0 || job.Status.Failed > 0 {
+		return true
+	}
+
+	for _, pod := range pods {
+		if pod.Spec.NodeName != "" || pod.Status.Phase != corev1.PodPending {
+			return true
+		}
+		for _, container := range pod.Status.ContainerStatuses {
+			if container.State.Running != nil || container.State.Terminated != nil ||
+				container.LastTerminationState.Terminated != nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestDeletionBacklog(t *testing.T) {
+	var b deletionBacklog
+	start := time.Now()
+
+	if depth, oldest := b.stats(start); depth != 0 || oldest != 0 {
+		t.Errorf("got %d, %v, want 0, 0", depth, oldest)
+	}
+
+	b.add("ns/a", start)
+	b.add("ns/b", start.Add(time.Minute))
+	b.add("ns/a", start.Add(2*time.Minute)) // requeued, still waiting since the start
+
+	if depth, oldest := b.stats(start.Add(3 * time.Minute)); depth != 2 || oldest != 3*time.Minute {
+		t.Errorf("got %d, %v, want 2, 3m", depth, oldest)
+	}
+
+	b.remove("ns/a")
+
+	if depth, oldest := b.stats(start.Add(3 * time.Minute)); depth != 1 || oldest != 2*time.Minute {
+		t.Errorf("got %d, %v, want 1, 2m", depth, oldest)
+	}
+}
+
+func TestDeletionOptionsWithDefaults(t *testing.T) {
+	options := DeletionOptions{Workers: 8}.withDefaults()
+
+	want := DeletionOptions{
+		Workers:                       8,
+		MaxConcurrentPerBackingVolume: defaultMaxConcurrentDeletionsPerBackingVolume,
+		MaxRetryDelay:                 defaultMaxDeletionRetryDelay,
+	}
+	if options != want {
+		t.Errorf("got %+v, want %+v", options, want)
+	}
+}
+
+func TestJobMayHaveRun(t *testing.T) {
+	pending := corev1.Pod{Status: corev1.PodStatus{
+		Phase: corev1.PodPending,
+		ContainerStatuses: []corev1.ContainerStatus{
+			{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}},
+		},
+	}}
+	scheduled := corev1.Pod{Spec: corev1.PodSpec{NodeName: "node"}, Status: corev1.PodStatus{Phase: corev1.PodPending}}
+	running := corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodRunning}}
+	restarting := corev1.Pod{Status: corev1.PodStatus{
+		Phase: corev1.PodPending,
+		ContainerStatuses: []corev1.ContainerStatus{
+			{LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}}},
+		},
+	}}
+
+	tests := []struct {
+		name   string
+		status batchv1.JobStatus
+		pods   []corev1.Pod
+		want   bool
+	}{
+		{"no pods yet", batchv1.JobStatus{}, nil, false},
+		{"pod pending", batchv1.JobStatus{Active: 1}, []corev1.Pod{pending}, false},
+		{"pod scheduled", batchv1.JobStatus{Active: 1}, []corev1.Pod{scheduled}, true},
+		{"pod running", batchv1.JobStatus{Active: 1}, []corev1.Pod{pending, running}, true},
+		{"container restarting", batchv1.JobStatus{Active: 1}, []corev1.Pod{restarting}, true},
+		{"pod failed and was removed", batchv1.JobStatus{Failed: 1}, nil, true},
+		{"succeeded", batchv1.JobStatus{Succeeded: 1}, nil, true},
+	}
+
+	for _, test := range tests {
+		if got := jobMayHaveRun(&batchv1.Job{Status: test.status}, test.pods); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// A creation Job whose pods change as the test says between the calls that deleteCreationJobIfNeverRan() makes.
+type fakeCreationJobApi struct {
+	job         *batchv1.Job
+	pods        map[types.UID]*corev1.Pod
+	beforeCall  func(api *fakeCreationJobApi, call string)
+	deletedPods []types.UID
+}
+
+func (a *fakeCreationJobApi) getJob(ctx context.Context) (*batchv1.Job, error) {
+	a.beforeCall(a, "getJob")
+	if a.job == nil {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "jobs"}, "job")
+	}
+	return a.job.DeepCopy(), nil
+}
+
+func (a *fakeCreationJobApi) listPods(ctx context.Context) ([]corev1.Pod, error) {
+	a.beforeCall(a, "listPods")
+	var pods []corev1.Pod
+	for _, pod := range a.pods {
+		pods = append(pods, *pod.DeepCopy())
+	}
+	return pods, nil
+}
+
+func (a *fakeCreationJobApi) orphanJob(ctx context.Context, uid types.UID) error {
+	a.beforeCall(a, "orphanJob")
+	a.job = nil
+	return nil
+}
+
+func (a *fakeCreationJobApi) deletePod(ctx context.Context, pod *corev1.Pod) error {
+	a.beforeCall(a, "deletePod")
+	current, ok := a.pods[pod.UID]
+	if !ok {
+		return k8serrors.NewNotFound(schema.GroupResource{Resource: "pods"}, pod.Name)
+	}
+	if current.ResourceVersion != pod.ResourceVersion {
+		return k8serrors.NewConflict(schema.GroupResource{Resource: "pods"}, pod.Name, nil)
+	}
+	delete(a.pods, pod.UID)
+	a.deletedPods = append(a.deletedPods, pod.UID)
+	return nil
+}
+
+func TestDeleteCreationJobIfNeverRan(t *testing.T) {
+	unscheduledPod := func(uid types.UID) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: string(uid), UID: uid, ResourceVersion: "1"},
+			Status:     corev1.PodStatus{Phase: corev1.PodPending},
+		}
+	}
+
+	// schedules the pod to a node and starts it, as the kubelet would
+	start := func(pod *corev1.Pod) {
+		pod.ResourceVersion = "2"
+		pod.Spec.NodeName = "node"
+		pod.Status.Phase = corev1.PodRunning
+	}
+
+	tests := []struct {
+		name        string
+		noJob       bool
+		scheduled   bool
+		beforeCall  func(api *fakeCreationJobApi, call string)
+		want        bool
+		wantDeleted int
+	}{
+		{name: "no creation Job", noJob: true},
+		{name: "pod never started", want: true, wantDeleted: 1},
+		{name: "pod already scheduled", scheduled: true},
+		{
+			name: "pod started after being listed",
+			beforeCall: func(api *fakeCreationJobApi, call string) {
+				if call == "orphanJob" {
+					start(api.pods["a"])
+				}
+			},
+		},
+		{
+			name: "pod started while the Job was being deleted",
+			beforeCall: func(api *fakeCreationJobApi, call string) {
+				if call == "deletePod" {
+					start(api.pods["a"])
+				}
+			},
+		},
+		{
+			name: "Job created another pod before being deleted",
+			beforeCall: func(api *fakeCreationJobApi, call string) {
+				if call == "orphanJob" {
+					api.pods["b"] = unscheduledPod("b")
+				}
+			},
+			wantDeleted: 1,
+		},
+	}
+
+	for _, test := range tests {
+		api := &fakeCreationJobApi{
+			job:        &batchv1.Job{ObjectMeta: metav1.ObjectMeta{UID: "job"}},
+			pods:       map[types.UID]*corev1.Pod{"a": unscheduledPod("a")},
+			beforeCall: func(*fakeCreationJobApi, string) {},
+		}
+		if test.noJob {
+			api.job = nil
+		}
+		if test.scheduled {
+			api.pods["a"].Spec.NodeName = "node"
+		}
+		if test.beforeCall != nil {
+			api.beforeCall = test.beforeCall
+		}
+
+		got, err := deleteCreationJobIfNeverRan(context.Background(), api)
+		if err != nil || got != test.want || len(api.deletedPods) != test.wantDeleted {
+			t.Errorf(
+				"%s: got %v, %v, %d deleted pods, want %v, %d deleted pods",
+				test.name, got, err, len(api.deletedPods), test.want, test.wantDeleted,
+			)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Drains backing volumes whose PVCs have the "drain-to" annotation: new volumes are no longer created in them (see
+// common.CheckBackingPvcAcceptsVolumes), and their idle volumes are migrated one at a time to the backing volume named
+// by the annotation, which must be in the same namespace. Progress is recorded in the "drain-status" annotation.
+//
+// Migrating a volume flattens its backing chain into a standalone image in the target backing volume, so clones
+// stop sharing data with each other. Snapshots aren't migrated and keep the backing volume from being retired until
+// they are deleted.
+type drainController struct {
+	clientset *common.Clientset
+	image     string
+}
+
+func (c *drainController) run(stopCh chan struct{}) {
+	wait.Until(c.drainAll, time.Minute, stopCh)
+}
+
+func (c *drainController) drainAll() {
+	ctx := context.Background() // TODO
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	var draining []*corev1.PersistentVolumeClaim
+	for i := range pvcs.Items {
+		if _, ok := common.BackingPvcDrainTarget(&pvcs.Items[i]); ok {
+			draining = append(draining, &pvcs.Items[i])
+		}
+	}
+	if len(draining) == 0 {
+		return
+	}
+
+	volumeSnapshots, err := c.clientset.SnapshotV1().VolumeSnapshots(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	for _, backingPvc := range draining {
+		err := c.drain(ctx, backingPvc, pvcs.Items, volumeSnapshots.Items)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to drain backing PVC", "backingPvc", klog.KRef(backingPvc.Namespace, backingPvc.Name),
+			)
+		}
+	}
+}
+
+func (c *drainController) drain(
+	ctx context.Context,
+	backingPvc *corev1.PersistentVolumeClaim,
+	pvcs []corev1.PersistentVolumeClaim,
+	volumeSnapshots []volumesnapshotv1.VolumeSnapshot,
+) error {
+	target, _ := common.BackingPvcDrainTarget(backingPvc)
+
+	if target.PvcName == backingPvc.Name {
+		return c.recordDrainStatus(ctx, backingPvc, "failed: can't drain a backing PVC to itself")
+	}
+
+	// the target must be able to take the volumes
+
+	err := common.CheckBackingPvcAcceptsVolumes(ctx, c.clientset, target.PvcName, target.PvcNamespace)
+	if status.Code(err) == codes.Unavailable {
+		return c.recordDrainStatus(ctx, backingPvc, "failed: "+status.Convert(err).Message())
+	} else if err != nil {
+		return err
+	}
+
+	_, err = c.clientset.CoreV1().PersistentVolumeClaims(target.PvcNamespace).
+		Get(ctx, target.PvcName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return c.recordDrainStatus(ctx, backingPvc, fmt.Sprintf(
+			"failed: backing PVC %s in namespace %s does not exist", target.PvcName, target.PvcNamespace,
+		))
+	} else if err != nil {
+		return err
+	}
+
+	// migrate volumes
+
+	inBackingPvc := func(meta *metav1.ObjectMeta) bool {
+		location := common.BackingLocationOf(meta)
+		return location.PvcName == backingPvc.Name && location.PvcNamespace == backingPvc.Namespace
+	}
+
+	remaining, busy := 0, 0
+	var failures []string
+
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		if pvc.Labels[common.Domain+"/uid"] == "" || pvc.DeletionTimestamp != nil || !inBackingPvc(&pvc.ObjectMeta) {
+			continue
+		}
+
+		err := migrateVolume(ctx, c.clientset, c.image, pvc, target)
+		switch code := status.Code(err); {
+		case err == nil:
+			continue
+		case code == codes.Aborted || code == codes.FailedPrecondition:
+			busy++ // staged or busy with another operation, try again later
+		default:
+			klog.ErrorS(err, "Failed to migrate PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+			failures = append(failures, fmt.Sprintf("PVC %s in namespace %s", pvc.Name, pvc.Namespace))
+		}
+		remaining++
+	}
+
+	snapshots := 0
+	for i := range volumeSnapshots {
+		if volumeSnapshots[i].DeletionTimestamp == nil && inBackingPvc(&volumeSnapshots[i].ObjectMeta) {
+			snapshots++
+		}
+	}
+
+	return c.recordDrainStatus(ctx, backingPvc, drainStatus(remaining, busy, failures, snapshots))
+}
+
+// Describes the progress of draining a backing volume.
+func drainStatus(remaining int, busy int, failures []string, snapshots int) string {
+	var status string
+	if remaining == 0 {
+		status = "complete: all volumes were migrated"
+	} else {
+		status = fmt.Sprintf("in progress: %d volumes remaining", remaining)
+		if busy > 0 {
+			status += fmt.Sprintf(", %d of which are staged or busy and will be migrated once idle", busy)
+		}
+		if len(failures) > 0 {
+			status += fmt.Sprintf("; failed to migrate %s", strings.Join(failures, ", "))
+		}
+	}
+
+	if snapshots > 0 {
+		status += fmt.Sprintf("; %d snapshots remain and must be deleted before the backing PVC is retired", snapshots)
+	}
+
+	return status
+}
+
+// Records the drain status on the backing PVC, and emits an Event if it changed to complete or failed.
+func (c *drainController) recordDrainStatus(
+	ctx context.Context, backingPvc *corev1.PersistentVolumeClaim, drainStatus string,
+) error {
+	previous := backingPvc.Annotations[common.Domain+"/drain-status"]
+	if drainStatus == previous {
+		return nil
+	}
+
+	err := common.ApplyPvcMetadata(
+		ctx, c.clientset, backingPvc.Name, backingPvc.Namespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/drain-status": drainStatus},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS(
+		"Drain of backing PVC", "backingPvc", klog.KRef(backingPvc.Namespace, backingPvc.Name), "status", drainStatus,
+	)
+
+	switch {
+	case strings.HasPrefix(drainStatus, "complete") && !strings.HasPrefix(previous, "complete"):
+		return common.EmitEvent(
+			ctx, c.clientset, common.PvcEventObject(backingPvc),
+			corev1.EventTypeNormal, "DrainCompleted", "Drain %s", drainStatus,
+		)
+	case strings.HasPrefix(drainStatus, "failed"):
+		return common.EmitEvent(
+			ctx, c.clientset, common.PvcEventObject(backingPvc),
+			corev1.EventTypeWarning, "DrainFailed", "Drain %s", drainStatus,
+		)
+	default:
+		return nil
+	}
+}
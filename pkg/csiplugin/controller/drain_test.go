@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import "testing"
+
+func TestDrainStatus(t *testing.T) {
+	tests := []struct {
+		remaining int
+		busy      int
+		failures  []string
+		snapshots int
+		want      string
+	}{
+		{0, 0, nil, 0, "complete: all volumes were migrated"},
+		{
+			0, 0, nil, 2,
+			"complete: all volumes were migrated; 2 snapshots remain and must be deleted before the backing PVC is retired",
+		},
+		{3, 0, nil, 0, "in progress: 3 volumes remaining"},
+		{
+			3, 2, []string{"PVC a in namespace default"}, 0,
+			"in progress: 3 volumes remaining, 2 of which are staged or busy and will be migrated once idle; " +
+				"failed to migrate PVC a in namespace default",
+		},
+	}
+
+	for _, test := range tests {
+		got := drainStatus(test.remaining, test.busy, test.failures, test.snapshots)
+		if got != test.want {
+			t.Errorf("got \"%s\", want \"%s\"", got, test.want)
+		}
+	}
+}
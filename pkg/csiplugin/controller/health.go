@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// How long a staging pod may take to become ready before the volume is considered abnormal.
+const stagingPodGracePeriod = 2 * time.Minute
+
+// How long a volume is considered abnormal after a node plugin reported it failed, e.g., due to an I/O error.
+const failureConditionPeriod = time.Hour
+
+// Periodically checks the health of every volume, records abnormal conditions in an annotation on its PVC (which
+// ListVolumes reports to the external-health-monitor), and emits Events on the PVC when the condition changes. Also
+// records the volume's conditions (see volumeConditions()) on its PVC and PV.
+type volumeHealthController struct {
+	clientset *common.Clientset
+}
+
+func (c *volumeHealthController) run(stopCh chan struct{}) {
+	wait.Until(c.checkAll, time.Minute, stopCh)
+}
+
+func (c *volumeHealthController) checkAll() {
+	ctx := context.Background() // TODO
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	replicaSets, err := c.clientset.AppsV1().ReplicaSets(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/component in (volume-staging,volume-sharing)"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	// including the shared exports of volumes staged shared
+	stagingReplicaSets := map[string][]appsv1.ReplicaSet{}
+	for _, replicaSet := range replicaSets.Items {
+		pvcUid := replicaSet.Labels[common.Domain+"/pvc-uid"]
+		stagingReplicaSets[pvcUid] = append(stagingReplicaSets[pvcUid], replicaSet)
+	}
+
+	uninspectable, err := common.ListUninspectableImages(ctx, c.clientset)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	jobs, err := c.clientset.BatchV1().Jobs(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/component=volume-creation"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	creationJobs := map[string]*batchv1.Job{}
+	for i := range jobs.Items {
+		creationJobs[jobs.Items[i].Labels[common.Domain+"/pvc-uid"]] = &jobs.Items[i]
+	}
+
+	backingPvcs := map[string]*corev1.PersistentVolumeClaim{}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		pvcUid := common.VolumeUidOf(pvc)
+
+		if pvc.DeletionTimestamp != nil {
+			conditions := volumeConditions(
+				pvc, creationJobs[string(pvcUid)], pvc.Annotations[common.Domain+"/abnormal-condition"], time.Now(),
+			)
+			err := c.recordConditions(ctx, pvc, conditions)
+			if err != nil {
+				klog.ErrorS(err, "Failed to record conditions of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+			}
+			continue
+		}
+
+		location := common.BackingLocationOf(&pvc.ObjectMeta)
+		backingPvcKey := location.PvcNamespace + "/" + location.PvcName
+
+		backingPvc, ok := backingPvcs[backingPvcKey]
+		if !ok {
+			backingPvc, err = c.clientset.CoreV1().PersistentVolumeClaims(location.PvcNamespace).
+				Get(ctx, location.PvcName, metav1.GetOptions{})
+			if k8serrors.IsNotFound(err) {
+				backingPvc = nil
+			} else if err != nil {
+				runtime.HandleError(err)
+				continue
+			}
+			backingPvcs[backingPvcKey] = backingPvc
+		}
+
+		imageName := common.GenerateVolumeImageName(pvcUid)
+
+		imageFailed := false
+		for _, name := range uninspectable[location] {
+			imageFailed = imageFailed || name == imageName
+		}
+
+		condition := volumeCondition(
+			location, backingPvc, stagingReplicaSets[string(pvcUid)], imageFailed,
+			pvc.Annotations[common.Domain+"/last-failure"], time.Now(),
+		)
+
+		err := c.recordCondition(ctx, pvc, condition)
+		if err != nil {
+			klog.ErrorS(err, "Failed to record condition of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+
+		err = c.recordConditions(ctx, pvc, volumeConditions(pvc, creationJobs[string(pvcUid)], condition, time.Now()))
+		if err != nil {
+			klog.ErrorS(err, "Failed to record conditions of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+	}
+}
+
+// Describes what is wrong with a volume, or returns "" if nothing is. lastFailure is the value of the PVC's
+// last-failure annotation, which node plugins set to "<RFC 3339 time> <message>".
+func volumeCondition(
+	location common.BackingLocation,
+	backingPvc *corev1.PersistentVolumeClaim,
+	stagingReplicaSets []appsv1.ReplicaSet,
+	imageFailed bool,
+	lastFailure string,
+	now time.Time,
+) string {
+	var problems []string
+
+	if backingPvc == nil {
+		problems = append(problems, fmt.Sprintf(
+			"backing PVC %s in namespace %s does not exist", location.PvcName, location.PvcNamespace,
+		))
+	} else if backingPvc.Status.Phase != corev1.ClaimBound {
+		problems = append(problems, fmt.Sprintf(
+			"backing PVC %s in namespace %s is not bound (phase %s)",
+			location.PvcName, location.PvcNamespace, backingPvc.Status.Phase,
+		))
+	}
+
+	for _, replicaSet := range stagingReplicaSets {
+		if replicaSet.Status.ReadyReplicas >= 1 || now.Sub(replicaSet.CreationTimestamp.Time) <= stagingPodGracePeriod {
+			continue
+		}
+		if replicaSet.Labels[common.Domain+"/component"] == "volume-sharing" {
+			problems = append(problems, "shared export pod is not ready")
+		} else {
+			problems = append(problems, fmt.Sprintf(
+				"staging pod on node %s is not ready", replicaSet.Labels[common.Domain+"/node-name"],
+			))
+		}
+	}
+
+	if imageFailed {
+		problems = append(problems, "volume image could not be inspected, it may be corrupt")
+	}
+
+	if at, message, ok := strings.Cut(lastFailure, " "); ok {
+		failedAt, err := time.Parse(time.RFC3339, at)
+		if err == nil && now.Sub(failedAt) < failureConditionPeriod {
+			problems = append(problems, fmt.Sprintf("failed at %s: %s", at, message))
+		}
+	}
+
+	return strings.Join(problems, "; ")
+}
+
+// Records the volume's condition on its PVC and emits an Event if it changed. An empty condition means the volume is
+// healthy.
+func (c *volumeHealthController) recordCondition(
+	ctx context.Context, pvc *corev1.PersistentVolumeClaim, condition string,
+) error {
+	previous := pvc.Annotations[common.Domain+"/abnormal-condition"]
+	if condition == previous {
+		return nil
+	}
+
+	err := common.ApplyPvcMetadata(
+		ctx, c.clientset, pvc.Name, pvc.Namespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/abnormal-condition": condition},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if condition != "" {
+		klog.ErrorS(nil, "PVC is abnormal", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "condition", condition)
+		return common.EmitEvent(
+			ctx, c.clientset, common.PvcEventObject(pvc),
+			corev1.EventTypeWarning, "VolumeConditionAbnormal", "Volume is abnormal: %s", condition,
+		)
+	}
+
+	klog.InfoS("PVC is no longer abnormal", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+	return common.EmitEvent(
+		ctx, c.clientset, common.PvcEventObject(pvc),
+		corev1.EventTypeNormal, "VolumeConditionNormal", "Volume is no longer abnormal",
+	)
+}
@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestVolumeCondition(t *testing.T) {
+	now := time.Now()
+	location := common.BackingLocation{PvcName: "backing", PvcNamespace: "default"}
+
+	bound := &corev1.PersistentVolumeClaim{Status: corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound}}
+	pending := &corev1.PersistentVolumeClaim{Status: corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending}}
+
+	stagingReplicaSet := func(age time.Duration, readyReplicas int32) appsv1.ReplicaSet {
+		return appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				CreationTimestamp: metav1.NewTime(now.Add(-age)),
+				Labels:            map[string]string{common.Domain + "/node-name": "node-1"},
+			},
+			Status: appsv1.ReplicaSetStatus{ReadyReplicas: readyReplicas},
+		}
+	}
+
+	sharedExportReplicaSet := appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			CreationTimestamp: metav1.NewTime(now.Add(-time.Hour)),
+			Labels:            map[string]string{common.Domain + "/component": "volume-sharing"},
+		},
+	}
+
+	failure := func(age time.Duration) string {
+		return now.Add(-age).UTC().Format(time.RFC3339) + " I/O error on write: Input/output error on node node-1"
+	}
+	recentFailure := failure(time.Minute)
+	oldFailure := failure(2 * time.Hour)
+
+	tests := []struct {
+		name               string
+		backingPvc         *corev1.PersistentVolumeClaim
+		stagingReplicaSets []appsv1.ReplicaSet
+		imageFailed        bool
+		lastFailure        string
+		want               string
+	}{
+		{"healthy", bound, nil, false, "", ""},
+		{"staged", bound, []appsv1.ReplicaSet{stagingReplicaSet(time.Hour, 1)}, false, "", ""},
+		{"staging", bound, []appsv1.ReplicaSet{stagingReplicaSet(time.Second, 0)}, false, "", ""},
+		{
+			"staging pod down", bound, []appsv1.ReplicaSet{stagingReplicaSet(time.Hour, 0)}, false, "",
+			"staging pod on node node-1 is not ready",
+		},
+		{
+			"shared export down", bound, []appsv1.ReplicaSet{sharedExportReplicaSet}, false, "",
+			"shared export pod is not ready",
+		},
+		{"backing PVC missing", nil, nil, false, "", "backing PVC backing in namespace default does not exist"},
+		{
+			"backing PVC pending", pending, nil, false, "",
+			"backing PVC backing in namespace default is not bound (phase Pending)",
+		},
+		{
+			"recent failure", bound, nil, false, recentFailure,
+			"failed at " + strings.Replace(recentFailure, " ", ": ", 1),
+		},
+		{"old failure", bound, nil, false, oldFailure, ""},
+		{"malformed failure", bound, nil, false, "garbage", ""},
+		{
+			"several problems", nil, nil, true, "",
+			"backing PVC backing in namespace default does not exist; volume image could not be inspected, it may be corrupt",
+		},
+	}
+
+	for _, test := range tests {
+		got := volumeCondition(
+			location, test.backingPvc, test.stagingReplicaSets, test.imageFailed, test.lastFailure, now,
+		)
+		if got != test.want {
+			t.Errorf("%s: got \"%s\", want \"%s\"", test.name, got, test.want)
+		}
+	}
+}
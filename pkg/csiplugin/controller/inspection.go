@@ -0,0 +1,312 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Path in inspection pods at which the inspected volume or snapshot is exposed as a read-only block device.
+const inspectionDevicePath = "/var/inspect/device"
+
+// Exposes volumes and snapshots whose PVC or VolumeSnapshot has the "inspect-on-node" annotation as read-only block
+// devices in a pod on the named node, so that operators can look at their contents (e.g., by exec'ing into the pod and
+// mounting the device) without provisioning a new volume from them. Removing the annotation removes the pod. Progress
+// is recorded in the "inspection-status" annotation.
+//
+// Volumes are only inspected while not staged, and are kept in the "inspecting" state meanwhile so that they can't be
+// staged until the inspection ends. Snapshot images are never modified, so they can be inspected at any time.
+type inspectionController struct {
+	clientset *common.Clientset
+	image     string
+}
+
+func (c *inspectionController) run(stopCh chan struct{}) {
+	wait.Until(c.reconcileAll, 30*time.Second, stopCh)
+}
+
+func (c *inspectionController) reconcileAll() {
+	ctx := context.Background() // TODO
+
+	listOptions := metav1.ListOptions{LabelSelector: common.Domain + "/uid"}
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	volumeSnapshots, err := c.clientset.SnapshotV1().VolumeSnapshots(metav1.NamespaceAll).List(ctx, listOptions)
+	if k8serrors.IsNotFound(err) {
+		volumeSnapshots = &volumesnapshotv1.VolumeSnapshotList{} // volume snapshot CRDs aren't installed
+	} else if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	existing := map[types.UID]bool{}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		existing[common.VolumeUidOf(pvc)] = true
+
+		err := c.reconcilePvc(ctx, pvc)
+		if err != nil {
+			klog.ErrorS(err, "Failed to reconcile inspection of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+	}
+
+	for i := range volumeSnapshots.Items {
+		volumeSnapshot := &volumeSnapshots.Items[i]
+		existing[volumeSnapshot.UID] = true
+
+		err := c.reconcileVolumeSnapshot(ctx, volumeSnapshot)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to reconcile inspection of VolumeSnapshot",
+				"volumeSnapshot", klog.KRef(volumeSnapshot.Namespace, volumeSnapshot.Name),
+			)
+		}
+	}
+
+	// remove inspections of volumes and snapshots that no longer exist
+
+	replicaSets, err := c.clientset.AppsV1().ReplicaSets(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/component=volume-inspection"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	for i := range replicaSets.Items {
+		replicaSet := &replicaSets.Items[i]
+		if existing[types.UID(replicaSet.Labels[common.Domain+"/inspected-uid"])] {
+			continue
+		}
+
+		err := common.DeleteReplicaSetSynchronously(ctx, c.clientset, replicaSet.Name, replicaSet.Namespace)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to delete ReplicaSet", "replicaSet", klog.KRef(replicaSet.Namespace, replicaSet.Name),
+			)
+		}
+	}
+}
+
+func (c *inspectionController) reconcilePvc(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	nodeName, requested := pvc.Annotations[common.Domain+"/inspect-on-node"]
+	inspecting := pvc.Annotations[common.Domain+"/state"] == "inspecting"
+
+	if !requested || pvc.DeletionTimestamp != nil {
+		if !inspecting {
+			return nil
+		}
+
+		err := c.stop(ctx, common.VolumeUidOf(pvc), common.BackingLocationOf(&pvc.ObjectMeta))
+		if err != nil {
+			return err
+		}
+
+		err = common.SetPvcStateToIdle(ctx, c.clientset, pvc.Name, pvc.Namespace)
+		if err != nil {
+			return err
+		}
+
+		return c.recordPvcInspectionStatus(ctx, pvc, "stopped")
+	}
+
+	// volumes with integrity protection hold dm-integrity metadata that only staging knows how to interpret
+
+	if pvc.Spec.VolumeName != "" {
+		pv, err := c.clientset.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pv.Spec.CSI != nil && pv.Spec.CSI.VolumeAttributes["integrity"] == "true" {
+			return c.recordPvcInspectionStatus(ctx, pvc, "failed: volumes with integrity protection can't be inspected")
+		}
+	}
+
+	if !inspecting {
+		err := common.SetPvcStateTo(ctx, c.clientset, pvc.Name, pvc.Namespace, "inspecting")
+		if code := status.Code(err); code == codes.Aborted || code == codes.FailedPrecondition {
+			return c.recordPvcInspectionStatus(ctx, pvc, "waiting: "+status.Convert(err).Message())
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// only one copy of a mirrored volume is exposed, which must be up to date
+	location, _ := common.VolumeCopiesOf(&pvc.ObjectMeta)
+
+	inspectionStatus, err := c.start(
+		ctx, &pvc.ObjectMeta, common.VolumeUidOf(pvc), location,
+		common.GenerateVolumeImagePath(common.VolumeUidOf(pvc)), nodeName,
+	)
+	if err != nil {
+		return err
+	}
+
+	return c.recordPvcInspectionStatus(ctx, pvc, inspectionStatus)
+}
+
+func (c *inspectionController) reconcileVolumeSnapshot(
+	ctx context.Context,
+	volumeSnapshot *volumesnapshotv1.VolumeSnapshot,
+) error {
+	nodeName, requested := volumeSnapshot.Annotations[common.Domain+"/inspect-on-node"]
+	inspectionStatus, inspected := volumeSnapshot.Annotations[common.Domain+"/inspection-status"]
+
+	if !requested || volumeSnapshot.DeletionTimestamp != nil {
+		if !inspected || inspectionStatus == "stopped" {
+			return nil
+		}
+
+		err := c.stop(ctx, volumeSnapshot.UID, common.BackingLocationOf(&volumeSnapshot.ObjectMeta))
+		if err != nil {
+			return err
+		}
+
+		return c.recordVolumeSnapshotInspectionStatus(ctx, volumeSnapshot, "stopped")
+	}
+
+	inspectionStatus, err := c.start(
+		ctx, &volumeSnapshot.ObjectMeta, volumeSnapshot.UID, common.BackingLocationOf(&volumeSnapshot.ObjectMeta),
+		common.GenerateSnapshotImagePath(volumeSnapshot.UID), nodeName,
+	)
+	if err != nil {
+		return err
+	}
+
+	return c.recordVolumeSnapshotInspectionStatus(ctx, volumeSnapshot, inspectionStatus)
+}
+
+// Creates the ReplicaSet that exposes the given image of the PVC or VolumeSnapshot with the given metadata on the given
+// node, unless it already exists, and returns the inspection status to record.
+func (c *inspectionController) start(
+	ctx context.Context,
+	meta *metav1.ObjectMeta,
+	uid types.UID,
+	location common.BackingLocation,
+	imagePath string,
+	nodeName string,
+) (string, error) {
+	_, err := c.clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return fmt.Sprintf("failed: node %q does not exist", nodeName), nil
+	} else if err != nil {
+		return "", err
+	}
+
+	replicaSetName := common.GenerateInspectionReplicaSetName(uid)
+
+	// the annotation may have been changed to name another node
+
+	replicaSet, err := c.clientset.AppsV1().ReplicaSets(location.PvcNamespace).
+		Get(ctx, replicaSetName, metav1.GetOptions{})
+	if err == nil && replicaSet.Spec.Template.Spec.NodeName != nodeName {
+		err = common.DeleteReplicaSetSynchronously(ctx, c.clientset, replicaSetName, location.PvcNamespace)
+	}
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return "", err
+	}
+
+	labels := map[string]string{
+		common.Domain + "/component":     "volume-inspection",
+		common.Domain + "/inspected-uid": string(uid),
+	}
+
+	err = common.CreateReplicaSet(
+		ctx, c.clientset,
+		common.ReplicaSetConfig{
+			Name:        replicaSetName,
+			Namespace:   location.PvcNamespace,
+			Labels:      labels,
+			MatchLabels: labels,
+			Replicas:    1,
+			NodeName:    nodeName,
+			Image:       c.image,
+			Command: []string{
+				"/subprovisioner/qsd-with-nbd.sh",
+				imagePath, inspectionDevicePath, "true", "/var/inspect/qmp.sock",
+			},
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			WithoutKubeletDir:  true,
+			PropagateFrom:      meta,
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return inspectionStatus(nodeName, location.PvcNamespace, replicaSetName), nil
+}
+
+// Describes how to get at a volume or snapshot being inspected.
+func inspectionStatus(nodeName string, namespace string, replicaSetName string) string {
+	return fmt.Sprintf(
+		"started on node %s: the device is at %s in the pod of ReplicaSet %s in namespace %s (e.g., "+
+			"kubectl exec -it -n %s rs/%s -- bash)",
+		nodeName, inspectionDevicePath, replicaSetName, namespace, namespace, replicaSetName,
+	)
+}
+
+// Removes the ReplicaSet that exposes the image of the given volume or snapshot, if any, and waits for its pod to
+// terminate, which disconnects the device.
+func (c *inspectionController) stop(ctx context.Context, uid types.UID, location common.BackingLocation) error {
+	return common.DeleteReplicaSetSynchronously(
+		ctx, c.clientset, common.GenerateInspectionReplicaSetName(uid), location.PvcNamespace,
+	)
+}
+
+func (c *inspectionController) recordPvcInspectionStatus(
+	ctx context.Context, pvc *corev1.PersistentVolumeClaim, inspectionStatus string,
+) error {
+	if pvc.Annotations[common.Domain+"/inspection-status"] == inspectionStatus {
+		return nil
+	}
+
+	klog.InfoS("Inspection of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "status", inspectionStatus)
+
+	return common.ApplyPvcMetadata(
+		ctx, c.clientset, pvc.Name, pvc.Namespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/inspection-status": inspectionStatus},
+		},
+	)
+}
+
+func (c *inspectionController) recordVolumeSnapshotInspectionStatus(
+	ctx context.Context, volumeSnapshot *volumesnapshotv1.VolumeSnapshot, inspectionStatus string,
+) error {
+	if volumeSnapshot.Annotations[common.Domain+"/inspection-status"] == inspectionStatus {
+		return nil
+	}
+
+	klog.InfoS(
+		"Inspection of VolumeSnapshot", "volumeSnapshot", klog.KRef(volumeSnapshot.Namespace, volumeSnapshot.Name),
+		"status", inspectionStatus,
+	)
+
+	return common.ApplyVolumeSnapshotMetadata(
+		ctx, c.clientset, volumeSnapshot.Name, volumeSnapshot.Namespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/inspection-status": inspectionStatus},
+		},
+	)
+}
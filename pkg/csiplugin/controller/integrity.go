@@ -0,0 +1,15 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+// Size of the image of a volume with integrity protection (see the "integrity" StorageClass parameter), which must
+// also hold the dm-integrity superblock, journal, and checksums besides the volume's capacity.
+//
+// With 4 KiB sectors and 4-byte crc32c checksums, checksums take up 1/1024 of the capacity, and the kernel limits the
+// journal to 64 MiB. We leave twice that, rounded up to whole MiB, so that the device dm-integrity provides is never
+// smaller than the capacity.
+func integrityImageSize(capacity int64) int64 {
+	const mib = 1024 * 1024
+	size := capacity + capacity/512 + 128*mib
+	return (size + mib - 1) / mib * mib
+}
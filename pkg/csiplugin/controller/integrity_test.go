@@ -0,0 +1,26 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"testing"
+)
+
+func TestIntegrityImageSize(t *testing.T) {
+	const mib = 1024 * 1024
+
+	tests := []struct {
+		capacity int64
+		want     int64
+	}{
+		{512, 129 * mib},
+		{1024 * mib, (1024 + 2 + 128) * mib},
+		{100*1024*mib + 512, (100*1024 + 200 + 128 + 1) * mib},
+	}
+
+	for _, test := range tests {
+		if got := integrityImageSize(test.capacity); got != test.want {
+			t.Errorf("integrityImageSize(%d) = %d, want %d", test.capacity, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// The Events that report on an operation that a Job carries out, which are emitted on the PVC or VolumeSnapshot that
+// the operation is for, so that users can follow it with "kubectl describe" (see startJob() and waitForJob()).
+type jobEvents struct {
+	object    common.EventObject
+	operation string // e.g., "volume creation"
+
+	// the reasons of the Events
+	started   string
+	succeeded string
+	failed    string
+}
+
+func creationJobEvents(pvc *corev1.PersistentVolumeClaim) jobEvents {
+	return jobEvents{
+		object:    common.PvcEventObject(pvc),
+		operation: "volume creation",
+		started:   "VolumeCreationStarted",
+		succeeded: "VolumeCreated",
+		failed:    "VolumeCreationFailed",
+	}
+}
+
+func snapshottingJobEvents(volumeSnapshotMeta *metav1.ObjectMeta) jobEvents {
+	return jobEvents{
+		object:    common.VolumeSnapshotEventObject(volumeSnapshotMeta),
+		operation: "snapshotting",
+		started:   "SnapshotStarted",
+		succeeded: "SnapshotCompleted",
+		failed:    "SnapshotFailed",
+	}
+}
+
+func expansionJobEvents(pvc *corev1.PersistentVolumeClaim) jobEvents {
+	return jobEvents{
+		object:    common.PvcEventObject(pvc),
+		operation: "volume expansion",
+		started:   "VolumeExpansionStarted",
+		succeeded: "VolumeExpanded",
+		failed:    "VolumeExpansionFailed",
+	}
+}
+
+// Like common.CreateJob(), but also emits the events.started Event if the Job didn't exist yet, so that a retried
+// request doesn't report the operation as started again.
+func (s *ControllerServer) startJob(ctx context.Context, events jobEvents, config common.JobConfig) error {
+	created, err := common.CreateJobIfMissing(ctx, s.Clientset, config)
+	if err != nil {
+		return err
+	}
+
+	if created {
+		s.emitEvent(
+			ctx, events.object, corev1.EventTypeNormal, events.started,
+			"Started %s with Job %s in namespace %s", events.operation, config.Name, config.Namespace,
+		)
+	}
+	return nil
+}
+
+// Like common.WaitForJobToSucceed(), but also reports the outcome through the events.succeeded Event or, along with the
+// end of the logs of the Job's failed pod, the events.failed Event. A Job that had already succeeded before waiting
+// for it, e.g., because a request is retried after a later step failed, isn't reported again.
+func (s *ControllerServer) waitForJob(
+	ctx context.Context,
+	events jobEvents,
+	jobName string,
+	jobNamespace string,
+) error {
+	job, err := s.Clientset.BatchV1().Jobs(jobNamespace).Get(ctx, jobName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if job.Status.Succeeded > 0 {
+		return nil
+	}
+
+	err = common.WaitForJobToSucceed(ctx, s.Clientset, jobName, jobNamespace)
+	if info := common.ErrorInfoOf(err); info != nil && info.Reason == common.ReasonJobFailed {
+		s.reportJobFailure(ctx, events, jobName, jobNamespace)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.reportJobSuccess(ctx, events, jobName, jobNamespace)
+	return nil
+}
+
+// Emits the events.succeeded Event.
+func (s *ControllerServer) reportJobSuccess(
+	ctx context.Context,
+	events jobEvents,
+	jobName string,
+	jobNamespace string,
+) {
+	s.emitEvent(
+		ctx, events.object, corev1.EventTypeNormal, events.succeeded,
+		"Completed %s with Job %s in namespace %s", events.operation, jobName, jobNamespace,
+	)
+}
+
+// Emits the events.failed Event with the end of the logs of the Job's most recent failed pod.
+func (s *ControllerServer) reportJobFailure(
+	ctx context.Context,
+	events jobEvents,
+	jobName string,
+	jobNamespace string,
+) {
+	excerpt := common.JobLogExcerpt(ctx, s.Clientset, jobName, jobNamespace)
+	if excerpt == "" {
+		excerpt = "(no logs)"
+	}
+
+	s.emitEvent(
+		ctx, events.object, corev1.EventTypeWarning, events.failed,
+		"Job %s in namespace %s for %s failed, its logs ending with:\n%s",
+		jobName, jobNamespace, events.operation, excerpt,
+	)
+}
+
+// Emits an Event, only logging failures to do so, as Events are purely informational.
+func (s *ControllerServer) emitEvent(
+	ctx context.Context,
+	object common.EventObject,
+	eventType string,
+	reason string,
+	messageFmt string,
+	args ...interface{},
+) {
+	err := common.EmitEvent(ctx, s.Clientset, object, eventType, reason, messageFmt, args...)
+	if err != nil {
+		klog.ErrorS(
+			err, "Failed to emit event", "reason", reason, "kind", object.Kind,
+			"object", klog.KRef(object.Namespace, object.Name),
+		)
+	}
+}
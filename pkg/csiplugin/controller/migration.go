@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// How long copying a single volume to another backing volume may take.
+const migrationJobTimeout = 6 * time.Hour
+
+var migrationJobBackoffLimit int32 = 2
+
+// Moves an idle volume's image to the target backing location. Idempotent, and resumes an interrupted migration. Fails
+// with codes.Aborted or codes.FailedPrecondition if the volume is staged or busy.
+func migrateVolume(
+	ctx context.Context,
+	clientset *common.Clientset,
+	image string,
+	pvc *corev1.PersistentVolumeClaim,
+	target common.BackingLocation,
+) error {
+	source := common.BackingLocationOf(&pvc.ObjectMeta)
+	pvcUid := common.VolumeUidOf(pvc)
+	imageName := common.GenerateVolumeImageName(pvcUid)
+
+	err := common.SetPvcStateTo(ctx, clientset, pvc.Name, pvc.Namespace, "migrating")
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS(
+		"Migrating PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name),
+		"backingPvc", klog.KRef(target.PvcNamespace, target.PvcName),
+	)
+
+	// The source image is only removed once the target image is complete, and the volume stays in the "migrating"
+	// state until its annotations point to the target, so it is never staged while its image is missing.
+
+	migrationScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+
+		source="/var/backing/$1"
+		dest="/var/target/$1"
+
+		if [[ -e "${source}" ]]; then
+			qemu-img convert --bitmaps -f qcow2 -O qcow2 "${source}" "${dest}.tmp"
+			mv -f "${dest}.tmp" "${dest}"
+			rm -f "${source}"
+		fi
+
+		[[ -e "${dest}" ]]
+		`,
+	)
+
+	migrationJobName := common.GenerateMigrationJobName(pvcUid)
+
+	err = common.CreateJob(
+		ctx, clientset,
+		common.JobConfig{
+			Name:      migrationJobName,
+			Namespace: source.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "volume-migration",
+				common.Domain + "/pvc-uid":   string(pvcUid),
+			},
+			PropagateFrom:      &pvc.ObjectMeta,
+			Image:              image,
+			Command:            []string{"bash", "-c", migrationScript, "bash", imageName},
+			BackingPvcName:     source.PvcName,
+			BackingPvcBasePath: source.BasePath,
+			ExtraPvcMounts: []common.PvcMount{
+				{PvcName: target.PvcName, MountPath: "/var/target", SubPath: target.BasePath},
+			},
+			BackoffLimit: &migrationJobBackoffLimit,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = common.WaitForJobToSucceedWithin(
+		ctx, clientset, migrationJobName, source.PvcNamespace, migrationJobTimeout,
+	)
+	if err != nil {
+		// start over next time; the source image is still in place, as it is only removed at the very end
+		_ = common.DeleteJobSynchronously(context.Background(), clientset, migrationJobName, source.PvcNamespace)
+		if idleErr := common.SetPvcStateToIdle(ctx, clientset, pvc.Name, pvc.Namespace); idleErr != nil {
+			klog.ErrorS(idleErr, "Failed to return PVC to idle", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+		return err
+	}
+
+	// The PV's volume attributes still name the source, and can't be changed, so record the new location on the PV
+	// too, for adoptionController to use should the volume be retained and adopted.
+
+	if pvc.Spec.VolumeName != "" {
+		err = common.ApplyPvMetadata(
+			ctx, clientset, pvc.Spec.VolumeName, metav1.ObjectMeta{Annotations: backingLocationAnnotations(target)},
+		)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	recordBackingChainChanges(ctx, clientset, source, func(chains common.BackingChains) {
+		delete(chains, imageName)
+	})
+	recordBackingChainChanges(ctx, clientset, target, func(chains common.BackingChains) {
+		chains[imageName] = ""
+	})
+
+	for _, jobName := range []string{migrationJobName, common.GenerateCreationJobName(pvcUid)} {
+		err = common.DeleteJobSynchronously(ctx, clientset, jobName, source.PvcNamespace)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The image no longer has a backing file, so the volume doesn't depend on the snapshot it was created from, or on
+	// the common ancestor it shared with the volume it was cloned from.
+
+	err = common.UpdatePvcMetadata(
+		ctx, clientset, pvc.Name, pvc.Namespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			delete(pvc.Labels, common.Domain+"/source-snapshot-uid")
+			delete(pvc.Labels, common.Domain+"/source-pvc-uid")
+			for key, value := range backingLocationAnnotations(target) {
+				pvc.Annotations[key] = value
+			}
+			pvc.Annotations[common.Domain+"/state"] = "idle"
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS(
+		"Migrated PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name),
+		"backingPvc", klog.KRef(target.PvcNamespace, target.PvcName),
+	)
+	return nil
+}
+
+// The annotations that record a volume's backing location.
+func backingLocationAnnotations(location common.BackingLocation) map[string]string {
+	return map[string]string{
+		common.Domain + "/backing-pvc-name":      location.PvcName,
+		common.Domain + "/backing-pvc-namespace": location.PvcNamespace,
+		common.Domain + "/backing-pvc-base-path": location.BasePath,
+	}
+}
@@ -0,0 +1,25 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+)
+
+func TestBackingLocationAnnotations(t *testing.T) {
+	location := common.BackingLocation{PvcName: "target", PvcNamespace: "storage", BasePath: "volumes"}
+
+	got := backingLocationAnnotations(location)
+
+	want := map[string]string{
+		"subprovisioner.gitlab.io/backing-pvc-base-path": "volumes",
+		"subprovisioner.gitlab.io/backing-pvc-name":      "target",
+		"subprovisioner.gitlab.io/backing-pvc-namespace": "storage",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
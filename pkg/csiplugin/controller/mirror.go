@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Where mirror resync Jobs mount the backing volume holding the out-of-date copy.
+const mirrorResyncMountPath = "/var/degraded"
+
+var mirrorResyncJobBackoffLimit int32 = 2
+
+// Resynchronizes mirrored volumes whose PVCs have the "mirror-degraded" annotation, which the node plugin sets when it
+// stops serving a copy that failed, by overwriting the out-of-date copy with the up-to-date one once its backing volume
+// works again, and then removing the annotation so that both copies are served again.
+//
+// Volumes are only resynchronized while they aren't staged, and are kept in the "resyncing-mirror" state meanwhile.
+type mirrorResyncController struct {
+	clientset *common.Clientset
+	image     string
+}
+
+func (c *mirrorResyncController) run(stopCh chan struct{}) {
+	wait.Until(c.resyncAll, time.Minute, stopCh)
+}
+
+func (c *mirrorResyncController) resyncAll() {
+	ctx := context.Background() // TODO
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+
+		if _, mirrored := common.MirrorLocationOf(&pvc.ObjectMeta); !mirrored ||
+			common.DegradedCopyOf(&pvc.ObjectMeta) == "" || pvc.DeletionTimestamp != nil {
+			continue
+		}
+
+		err := c.resync(ctx, pvc)
+		switch code := status.Code(err); {
+		case err == nil:
+		case code == codes.Aborted || code == codes.FailedPrecondition:
+			// staged or busy with another operation, try again later
+		default:
+			klog.ErrorS(err, "Failed to resynchronize mirror of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+	}
+}
+
+// Overwrites the out-of-date copy of the given mirrored volume with the up-to-date one. Idempotent, and resumes an
+// interrupted resync. Fails with codes.Aborted or codes.FailedPrecondition if the volume is staged or busy.
+func (c *mirrorResyncController) resync(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	degraded := common.DegradedCopyOf(&pvc.ObjectMeta)
+	healthy, _ := common.VolumeCopiesOf(&pvc.ObjectMeta)
+
+	target := common.BackingLocationOf(&pvc.ObjectMeta)
+	if degraded == common.MirrorCopy {
+		target, _ = common.MirrorLocationOf(&pvc.ObjectMeta)
+	}
+
+	for _, location := range []common.BackingLocation{healthy, target} {
+		err := common.CheckBackingPvcMaintenance(ctx, c.clientset, location.PvcName, location.PvcNamespace)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Make sure that the backing volume of the out-of-date copy can be mounted again before keeping the volume from
+	// being staged, as it is likely what failed in the first place.
+
+	_, err := common.MeasureBackingUsage(ctx, c.clientset, c.image, target)
+	if err != nil {
+		return err
+	}
+
+	err = common.SetPvcStateTo(ctx, c.clientset, pvc.Name, pvc.Namespace, "resyncing-mirror")
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS(
+		"Resynchronizing copy of PVC from the other copy", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "copy", degraded,
+	)
+
+	// the out-of-date copy is replaced atomically, so an interrupted resync leaves it as it was
+
+	resyncScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+		cp --sparse=always "/var/backing/$1" "/var/degraded/$1.tmp"
+		mv -f "/var/degraded/$1.tmp" "/var/degraded/$1"
+		`,
+	)
+
+	pvcUid := common.VolumeUidOf(pvc)
+	resyncJobName := common.GenerateMirrorResyncJobName(pvcUid)
+
+	err = common.CreateJob(
+		ctx, c.clientset,
+		common.JobConfig{
+			Name:      resyncJobName,
+			Namespace: healthy.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "mirror-resync",
+				common.Domain + "/pvc-uid":   string(pvcUid),
+			},
+			PropagateFrom: &pvc.ObjectMeta,
+			Image:         c.image,
+			Command: []string{
+				"bash", "-c", resyncScript, "bash", common.GenerateVolumeImageName(pvcUid),
+			},
+			BackingPvcName:     healthy.PvcName,
+			BackingPvcBasePath: healthy.BasePath,
+			ExtraPvcMounts: []common.PvcMount{
+				{PvcName: target.PvcName, MountPath: mirrorResyncMountPath, SubPath: target.BasePath},
+			},
+			BackoffLimit: &mirrorResyncJobBackoffLimit,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = common.WaitForJobToSucceedWithin(ctx, c.clientset, resyncJobName, healthy.PvcNamespace, migrationJobTimeout)
+	if err != nil {
+		// start over next time; the volume is still served from the up-to-date copy only until then
+		_ = common.DeleteJobSynchronously(context.Background(), c.clientset, resyncJobName, healthy.PvcNamespace)
+		if idleErr := common.SetPvcStateToIdle(ctx, c.clientset, pvc.Name, pvc.Namespace); idleErr != nil {
+			klog.ErrorS(idleErr, "Failed to return PVC to idle", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+		return err
+	}
+
+	err = common.DeleteJobSynchronously(ctx, c.clientset, resyncJobName, healthy.PvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	err = common.UpdatePvcMetadata(
+		ctx, c.clientset, pvc.Name, pvc.Namespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			delete(pvc.Annotations, common.Domain+"/mirror-degraded")
+			pvc.Annotations[common.Domain+"/state"] = "idle"
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS("Resynchronized copy of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "copy", degraded)
+
+	return common.EmitEvent(
+		ctx, c.clientset, common.PvcEventObject(pvc),
+		corev1.EventTypeNormal, "MirrorResynced", "The %s copy of the volume is up to date again", degraded,
+	)
+}
@@ -4,8 +4,8 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
 	"time"
 
 	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
@@ -16,66 +16,176 @@ import (
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
 )
 
 type ControllerMonitor struct {
 	Clientset *common.Clientset
 	Image     string
+
+	// The cache of the driver's PVCs, which must be running (see NewPvcInformer()).
+	PvcInformer cache.SharedIndexInformer
+
+	// Whether to export metrics about the capacity of backing volumes, which periodically runs Jobs to measure them.
+	ExportCapacityMetrics bool
+
+	// How the deletion of volumes is paced.
+	Deletion DeletionOptions
+
+	// The controller service, whose breakers of backing volumes the probes of backing volumes feed.
+	Controller *ControllerServer
+
+	// How often to probe the health of backing volumes with a canary image (see backingStoreProbeController). Backing
+	// volumes aren't probed if 0.
+	BackingStoreProbeInterval time.Duration
+
+	// How and where to export usage records (see usageExportController).
+	UsageExport UsageExportOptions
 }
 
 func (m *ControllerMonitor) Run() {
-	optionsModifier := func(options *metav1.ListOptions) {
-		options.LabelSelector = common.Domain + "/uid"
-	}
-	pvcListWatcher := cache.NewFilteredListWatchFromClient(
-		m.Clientset.CoreV1().RESTClient(),
-		"persistentvolumeclaims",
-		corev1.NamespaceAll,
-		optionsModifier,
-	)
+	deletion := m.Deletion.withDefaults()
 
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	c := pvcDeletionController{
+		clientset: m.Clientset,
+		image:     m.Image,
+		indexer:   m.PvcInformer.GetIndexer(),
+		queue: workqueue.NewRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(deletionRetryBaseDelay, deletion.MaxRetryDelay),
+		),
+		controller: m.PvcInformer,
+		options:    deletion,
+	}
 
-	indexer, controller := cache.NewIndexerInformer(
-		pvcListWatcher,
-		&corev1.PersistentVolumeClaim{},
-		0,
+	_, err := m.PvcInformer.AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				pvc := obj.(*corev1.PersistentVolumeClaim)
 				if pvc.DeletionTimestamp != nil {
-					key, err := cache.MetaNamespaceKeyFunc(pvc)
-					if err == nil {
-						queue.Add(key)
-					}
+					c.enqueue(pvc)
 				}
 			},
 			UpdateFunc: func(oldObj interface{}, newObj interface{}) {
 				pvc := newObj.(*corev1.PersistentVolumeClaim)
 				if pvc.DeletionTimestamp != nil {
-					key, err := cache.MetaNamespaceKeyFunc(pvc)
-					if err == nil {
-						queue.Add(key)
-					}
+					c.enqueue(pvc)
 				}
 			},
 		},
-		cache.Indexers{},
 	)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
 
-	c := pvcDeletionController{
-		clientset:  m.Clientset,
-		image:      m.Image,
-		indexer:    indexer,
-		queue:      queue,
-		controller: controller,
+	r := replicationController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	a := adoptionController{
+		clientset: m.Clientset,
+	}
+
+	p := populatorController{
+		clientset: m.Clientset,
+	}
+
+	b := backingChainsController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	h := volumeHealthController{
+		clientset: m.Clientset,
+	}
+
+	d := drainController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	rb := rebalanceController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	bu := bundleController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	sh := shrinkController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	rl := relocationController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	in := inspectionController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	sc := snapshotCleanupController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	mr := mirrorResyncController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	tr := trashController{
+		clientset: m.Clientset,
+		image:     m.Image,
+	}
+
+	cm := capacityMetricsController{
+		clientset: m.Clientset,
+		image:     m.Image,
 	}
 
+	pr := backingStoreProbeController{
+		clientset: m.Clientset,
+		image:     m.Image,
+		server:    m.Controller,
+		interval:  m.BackingStoreProbeInterval,
+	}
+
+	ue := newUsageExportController(m.Clientset, m.Image, m.UsageExport)
+
 	stopCh := make(chan struct{})
 	defer close(stopCh)
 	go c.run(stopCh)
+	go r.run(stopCh)
+	go a.run(stopCh)
+	go p.run(stopCh)
+	go b.run(stopCh)
+	go h.run(stopCh)
+	go d.run(stopCh)
+	go rb.run(stopCh)
+	go bu.run(stopCh)
+	go sh.run(stopCh)
+	go rl.run(stopCh)
+	go in.run(stopCh)
+	go sc.run(stopCh)
+	go mr.run(stopCh)
+	go tr.run(stopCh)
+	if m.ExportCapacityMetrics {
+		go cm.run(stopCh)
+	}
+	if m.BackingStoreProbeInterval > 0 {
+		go pr.run(stopCh)
+	}
+	if len(m.UsageExport.Sinks) > 0 {
+		go ue.run(stopCh)
+	}
 
 	select {} // wait forever
 }
@@ -86,24 +196,36 @@ type pvcDeletionController struct {
 	indexer    cache.Indexer
 	queue      workqueue.RateLimitingInterface
 	controller cache.Controller
+	options    DeletionOptions
+
+	// the deleted PVCs waiting for their volumes to be deleted, and the deletions running in each backing volume
+	backlog    deletionBacklog
+	inProgress keyedSemaphore
+}
+
+func (c *pvcDeletionController) enqueue(pvc *corev1.PersistentVolumeClaim) {
+	key, err := cache.MetaNamespaceKeyFunc(pvc)
+	if err == nil {
+		c.backlog.add(key, time.Now())
+		c.queue.Add(key)
+	}
 }
 
 func (c *pvcDeletionController) run(stopCh chan struct{}) {
 	defer runtime.HandleCrash()
 	defer c.queue.ShutDown()
 
-	go c.controller.Run(stopCh)
-
 	if !cache.WaitForCacheSync(stopCh, c.controller.HasSynced) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
 		return
 	}
 
-	workers := 4 // TODO: Choose number of workers.
-	for i := 0; i < workers; i++ {
+	for i := 0; i < c.options.Workers; i++ {
 		go wait.Until(c.runWorker, 1*time.Second, stopCh)
 	}
 
+	go wait.Until(c.backlog.exportMetrics, 15*time.Second, stopCh)
+
 	<-stopCh
 }
 
@@ -138,6 +260,13 @@ func (c *pvcDeletionController) processNextItem() bool {
 	}
 
 	if err == nil {
+		_, err = common.ConvertState(&pvc.ObjectMeta)
+		if err != nil {
+			runtime.HandleError(err)
+			c.queue.AddRateLimited(key)
+			return true
+		}
+
 		pvcIsStaged := pvc.Annotations[common.Domain+"/staged-on-nodes"] != ""
 		pvcHasFinalizer := func() bool {
 			for _, finalizer := range pvc.GetFinalizers() {
@@ -149,14 +278,32 @@ func (c *pvcDeletionController) processNextItem() bool {
 		}
 
 		if !pvcIsStaged && pvcHasFinalizer() {
-			log.Printf("Deleting volume for PVC %s in namespace %s...", pvc.Name, pvc.Namespace)
+			// wait for our turn without counting it as a failure, freeing the worker for other backing volumes
 
-			err = c.deleteVolume(ctx, pvc)
+			backingPvcNamespace := pvc.Annotations[common.Domain+"/backing-pvc-namespace"]
+			backingPvcName := pvc.Annotations[common.Domain+"/backing-pvc-name"]
+			if !c.acquireBackingVolume(backingPvcNamespace, backingPvcName) {
+				c.queue.AddAfter(key, deletionBackpressureDelay)
+				return true
+			}
+			defer c.releaseBackingVolume(backingPvcNamespace, backingPvcName)
+
+			retain, err := c.volumeIsRetained(ctx, pvc)
 			if err != nil {
-				log.Printf(
-					"Failed to delete volume for PVC %s in namespace %s: %+v",
-					pvc.Name, pvc.Namespace, err,
-				)
+				runtime.HandleError(err)
+				c.queue.AddRateLimited(key)
+				return true
+			}
+
+			if retain {
+				klog.InfoS("Retaining volume", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+				err = c.retainVolume(ctx, pvc)
+			} else {
+				klog.InfoS("Deleting volume", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+				err = c.deleteVolume(ctx, pvc)
+			}
+			if err != nil {
+				klog.ErrorS(err, "Failed to delete volume", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
 				runtime.HandleError(err)
 				c.queue.AddRateLimited(key)
 				return true
@@ -166,21 +313,78 @@ func (c *pvcDeletionController) processNextItem() bool {
 	}
 
 	c.queue.Forget(key)
+	c.backlog.remove(key.(string))
+	return true
+}
+
+// Takes one of the slots for deletions in the backing volume, if one is free.
+func (c *pvcDeletionController) acquireBackingVolume(backingPvcNamespace string, backingPvcName string) bool {
+	key := backingPvcNamespace + "/" + backingPvcName
+	if !c.inProgress.tryAcquire(key, c.options.MaxConcurrentPerBackingVolume) {
+		return false
+	}
+
+	volumeDeletionsInProgress.Set(float64(c.inProgress.count(key)), backingPvcNamespace, backingPvcName)
 	return true
 }
 
+func (c *pvcDeletionController) releaseBackingVolume(backingPvcNamespace string, backingPvcName string) {
+	key := backingPvcNamespace + "/" + backingPvcName
+	c.inProgress.release(key)
+
+	if count := c.inProgress.count(key); count > 0 {
+		volumeDeletionsInProgress.Set(float64(count), backingPvcNamespace, backingPvcName)
+	} else {
+		volumeDeletionsInProgress.Delete(backingPvcNamespace, backingPvcName)
+	}
+}
+
 func (c *pvcDeletionController) deleteVolume(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
 	backingPvcName := pvc.Annotations[common.Domain+"/backing-pvc-name"]
 	backingPvcNamespace := pvc.Annotations[common.Domain+"/backing-pvc-namespace"]
 	backingPvcBasePath := pvc.Annotations[common.Domain+"/backing-pvc-base-path"]
+	pvcUid := common.VolumeUidOf(pvc)
 
-	// delete volume creation Job
+	// PVCs deleted before their volumes were created, e.g., by CI pipelines that create and cancel workloads, leave
+	// nothing to delete but the creation Job
 
-	creationJobName := common.GenerateCreationJobName(pvc.UID)
+	neverCreated, err := deleteCreationJobIfNeverRan(ctx, &clientsetCreationJobApi{
+		clientset: c.clientset,
+		namespace: backingPvcNamespace,
+		jobName:   common.GenerateCreationJobName(pvcUid),
+	})
+	if err != nil {
+		return err
+	}
 
-	err := common.DeleteJobSynchronously(
-		ctx, c.clientset,
-		creationJobName, backingPvcNamespace,
+	if neverCreated {
+		klog.InfoS("Volume was never created, nothing to delete", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		return c.removeFinalizer(ctx, pvc)
+	}
+
+	// deletion is retried until the backing volume's maintenance is over
+
+	err = common.CheckBackingPvcMaintenance(ctx, c.clientset, backingPvcName, backingPvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	// delete volume creation and replication Jobs
+
+	for _, jobName := range []string{
+		common.GenerateCreationJobName(pvcUid),
+		common.GenerateReplicationJobName(pvcUid),
+	} {
+		err := common.DeleteJobSynchronously(ctx, c.clientset, jobName, backingPvcNamespace)
+		if err != nil {
+			return err
+		}
+	}
+
+	// as well as the creation Job's pods that deleteCreationJobIfNeverRan() may have orphaned
+
+	err = common.DeleteJobPodsSynchronously(
+		ctx, c.clientset, common.GenerateCreationJobName(pvcUid), backingPvcNamespace,
 	)
 	if err != nil {
 		return err
@@ -188,13 +392,68 @@ func (c *pvcDeletionController) deleteVolume(ctx context.Context, pvc *corev1.Pe
 
 	// create and await volume deletion Job
 
-	volumeImagePath := common.GenerateVolumeImagePath(pvc.UID)
-	deletionJobName := common.GenerateDeletionJobName(pvc.UID)
+	volumeImagePath := common.GenerateVolumeImagePath(pvcUid)
+	deletionJobName := common.GenerateDeletionJobName(pvcUid)
+
+	// the mirror of a mirrored volume is deleted too, even if it is degraded
+
+	var extraPvcMounts []common.PvcMount
+	var mirrorImagePaths []string
+	if mirror, mirrored := common.MirrorLocationOf(&pvc.ObjectMeta); mirrored {
+		extraPvcMounts = []common.PvcMount{
+			{PvcName: mirror.PvcName, MountPath: common.MirrorMountPath, SubPath: mirror.BasePath},
+		}
+		mirrorImagePaths = []string{common.GenerateVolumeMirrorImagePath(pvcUid)}
+	}
+
+	command := append(
+		[]string{
+			// also remove the replication delta that an interrupted replication may have left behind
+			"bash", "-c", `rm -f "$1" "${@:3}" /var/backing/replication-"$2"-*.qcow2`, "bash",
+			volumeImagePath, string(pvcUid),
+		},
+		mirrorImagePaths...,
+	)
+
+	// volumes of StorageClasses with a trash retention period are moved to the trash instead (see trashController)
+
+	trashed, retention, err := trashedVolumeOf(ctx, c.clientset, pvc)
+	if err != nil {
+		return err
+	}
+
+	trashImageName := ""
+	expiresAt := time.Now().Add(retention)
+	if trashed != nil {
+		trashedJson, err := json.Marshal(trashed)
+		if err != nil {
+			return err
+		}
+
+		trashImageName = common.GenerateTrashImageName(pvcUid, expiresAt)
+		command = []string{
+			"bash", "-c", volumeTrashScript, "bash",
+			common.GenerateVolumeImageName(pvcUid), string(pvcUid), trashImageName, string(trashedJson),
+		}
+	}
+
+	// volumes of StorageClasses with sticky data are kept for a new PVC with the same name to reattach instead
+
+	stickyImageName, err := stickyImageNameOf(ctx, c.clientset, pvc)
+	if err != nil {
+		return err
+	}
+
+	if stickyImageName != "" {
+		command = []string{
+			"bash", "-c", volumeStickScript, "bash",
+			common.GenerateVolumeImageName(pvcUid), string(pvcUid), stickyImageName,
+			common.StickyImagePattern(pvc.Namespace, pvc.Name),
+		}
+	}
 
-	// TODO: Also delete any qcow2 images in the backing chains that aren't referenced by any PVC or snapshot
-	// anymore. To ensure idempotency, probably begin by creating graph of all qcow2 files connected to the
-	// top-level file being deleted (regardless of edge direction), determine which will be left dangling and should
-	// be deleted, and finally delete them all in one go.
+	// The images further down the volume's backing chain that nothing else depends on anymore are collected later by
+	// the snapshot cleanup controller.
 	err = common.CreateJob(
 		ctx, c.clientset,
 		common.JobConfig{
@@ -202,12 +461,14 @@ func (c *pvcDeletionController) deleteVolume(ctx context.Context, pvc *corev1.Pe
 			Namespace: backingPvcNamespace,
 			Labels: map[string]string{
 				common.Domain + "/component": "volume-deletion",
-				common.Domain + "/pvc-uid":   string(pvc.UID),
+				common.Domain + "/pvc-uid":   string(pvcUid),
 			},
+			PropagateFrom:      &pvc.ObjectMeta,
 			Image:              c.image,
-			Command:            []string{"rm", "-f", volumeImagePath},
+			Command:            command,
 			BackingPvcName:     backingPvcName,
 			BackingPvcBasePath: backingPvcBasePath,
+			ExtraPvcMounts:     extraPvcMounts,
 		},
 	)
 	if err != nil {
@@ -232,25 +493,103 @@ func (c *pvcDeletionController) deleteVolume(ctx context.Context, pvc *corev1.Pe
 		return err
 	}
 
-	// remove finalizer from PVC
+	location := common.BackingLocation{
+		PvcName: backingPvcName, PvcNamespace: backingPvcNamespace, BasePath: backingPvcBasePath,
+	}
+	keptImageName := trashImageName
+	if stickyImageName != "" {
+		keptImageName = stickyImageName
+	}
+
+	recordBackingChainChanges(ctx, c.clientset, location, func(chains common.BackingChains) {
+		volumeImageName := common.GenerateVolumeImageName(pvcUid)
+		backing, ok := chains[volumeImageName]
+		if ok && stickyImageName != "" {
+			// older sticky images of the same PVC were replaced
+			for imageName := range chains {
+				if _, sticky := common.ParseStickyImageName(imageName, pvc.Namespace, pvc.Name); sticky {
+					delete(chains, imageName)
+				}
+			}
+		}
+		if ok && keptImageName != "" {
+			chains[keptImageName] = backing
+		}
+		delete(chains, volumeImageName)
+	})
+
+	if trashImageName != "" {
+		klog.InfoS(
+			"Moved volume to the trash", "pvc", klog.KRef(pvc.Namespace, pvc.Name),
+			"expiresAt", expiresAt.UTC().Format(time.RFC3339),
+		)
+	} else if stickyImageName != "" {
+		klog.InfoS("Kept volume for reattaching", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+	}
+
+	return c.removeFinalizer(ctx, pvc)
+}
+
+// Whether the volume's PV has reclaim policy Retain, in which case the volume must be kept around so that it can later
+// be adopted by another PVC bound to the same PV.
+func (c *pvcDeletionController) volumeIsRetained(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	if pvc.Spec.VolumeName == "" {
+		return false, nil
+	}
+
+	pv, err := c.clientset.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return pv.Spec.PersistentVolumeReclaimPolicy == corev1.PersistentVolumeReclaimRetain, nil
+}
+
+func (c *pvcDeletionController) retainVolume(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	backingPvcNamespace := pvc.Annotations[common.Domain+"/backing-pvc-namespace"]
 
-	pvcs := c.clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace)
-	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		pvc, err := pvcs.Get(ctx, pvc.Name, metav1.GetOptions{})
+	err := common.DeleteJobSynchronously(
+		ctx, c.clientset,
+		common.GenerateCreationJobName(common.VolumeUidOf(pvc)), backingPvcNamespace,
+	)
+	if err != nil {
+		return err
+	}
+
+	// whether a copy of a mirrored volume is out of date must survive the volume being adopted by another PVC
+
+	if _, mirrored := common.MirrorLocationOf(&pvc.ObjectMeta); mirrored {
+		err = common.ApplyPvMetadata(
+			ctx, c.clientset, pvc.Spec.VolumeName,
+			metav1.ObjectMeta{
+				Annotations: map[string]string{
+					common.Domain + "/mirror-degraded": common.DegradedCopyOf(&pvc.ObjectMeta),
+				},
+			},
+		)
 		if err != nil {
 			return err
 		}
+	}
 
-		for i, finalizer := range pvc.GetFinalizers() {
-			if finalizer == common.Domain+"/cleanup" {
-				pvc.Finalizers = append(pvc.Finalizers[:i], pvc.Finalizers[i+1:]...)
-				break
-			}
-		}
+	return c.removeFinalizer(ctx, pvc)
+}
 
-		_, err = pvcs.Update(ctx, pvc, metav1.UpdateOptions{})
-		return err
-	})
+func (c *pvcDeletionController) removeFinalizer(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	err := common.UpdatePvcMetadata(
+		ctx, c.clientset, pvc.Name, pvc.Namespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			for i, finalizer := range pvc.GetFinalizers() {
+				if finalizer == common.Domain+"/cleanup" {
+					pvc.Finalizers = append(pvc.Finalizers[:i], pvc.Finalizers[i+1:]...)
+					break
+				}
+			}
+			return nil
+		},
+	)
 	if err != nil {
 		return err
 	}
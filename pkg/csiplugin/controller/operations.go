@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/runtime/protoimpl"
+)
+
+// How long the result of a completed operation is remembered for.
+const completedOperationTtl = 5 * time.Minute
+
+// How long an operation keeps running once no request is waiting for it anymore, which leaves the sidecars time to
+// retry and pick it up again.
+const defaultAbandonedOperationTimeout = 10 * time.Minute
+
+// Tracks in-flight and recently completed controller operations so that the sidecars' retries of long-running
+// operations don't redo all the work (looking up objects, creating Jobs, ...) or run concurrently with the original
+// attempt. Operations are keyed as per the CSI spec's idempotency rules, e.g., by volume name for CreateVolume().
+//
+// This is only an optimization: operations must still be idempotent on their own, as the cache doesn't survive
+// plugin restarts. The zero value is ready to use.
+type operationCache struct {
+	mutex     sync.Mutex
+	inFlight  map[string]*inFlightOperation
+	completed map[string]completedOperation
+
+	// defaultAbandonedOperationTimeout if zero
+	abandonedOperationTimeout time.Duration
+}
+
+// The CSI messages are generated against the original protobuf API, so requests and responses are kept as
+// protoiface.MessageV1 and only wrapped as current messages to compare them.
+type inFlightOperation struct {
+	req  protoiface.MessageV1
+	done chan struct{} // closed once resp and err are set
+	resp protoiface.MessageV1
+	err  error
+
+	// guarded by the cache's mutex
+	waiters      int
+	cancel       context.CancelFunc
+	abandonTimer *time.Timer
+}
+
+// A context with the values of another but without its deadline and cancellation, like context.WithoutCancel() in Go
+// 1.21.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+type completedOperation struct {
+	req         protoiface.MessageV1
+	resp        protoiface.MessageV1
+	completedAt time.Time
+}
+
+// Runs op, unless:
+//
+//   - an operation with the same key and an identical request is in flight (e.g., because the sidecar timed out
+//     waiting for it and retried), in which case this waits for it to finish and returns its outcome;
+//   - an operation with the same key but a different request is in flight, in which case this fails with
+//     codes.Aborted;
+//   - an operation with the same key and an identical request recently succeeded, in which case its response is
+//     returned.
+//
+// Only successful responses are remembered. If ctx is done while waiting for the operation, this fails with the
+// corresponding status code, but the operation goes on: it runs with a context that has the values of the ctx of the
+// request that started it but isn't canceled with it, and is only canceled once no request has been waiting for it for
+// the abandoned operation timeout.
+func (c *operationCache) run(
+	ctx context.Context,
+	key string,
+	req protoiface.MessageV1,
+	op func(ctx context.Context) (protoiface.MessageV1, error),
+) (protoiface.MessageV1, error) {
+	c.mutex.Lock()
+
+	if c.inFlight == nil {
+		c.inFlight = map[string]*inFlightOperation{}
+		c.completed = map[string]completedOperation{}
+	}
+
+	now := time.Now()
+	for k, completed := range c.completed {
+		if now.Sub(completed.completedAt) > completedOperationTtl {
+			delete(c.completed, k)
+		}
+	}
+
+	if inFlight, ok := c.inFlight[key]; ok {
+		if !requestsAreEqual(inFlight.req, req) {
+			c.mutex.Unlock()
+			return nil, status.Errorf(codes.Aborted, "an operation for %s is already in progress", key)
+		}
+
+		inFlight.waiters++
+		if inFlight.abandonTimer != nil {
+			inFlight.abandonTimer.Stop()
+			inFlight.abandonTimer = nil
+		}
+		c.mutex.Unlock()
+
+		return c.wait(ctx, inFlight)
+	}
+
+	if completed, ok := c.completed[key]; ok && requestsAreEqual(completed.req, req) {
+		c.mutex.Unlock()
+		return completed.resp, nil
+	}
+
+	opCtx, cancel := context.WithCancel(detachedContext{parent: ctx})
+	inFlight := &inFlightOperation{req: req, done: make(chan struct{}), waiters: 1, cancel: cancel}
+	c.inFlight[key] = inFlight
+	c.mutex.Unlock()
+
+	go func() {
+		defer cancel()
+
+		resp, err := op(opCtx)
+
+		c.mutex.Lock()
+		delete(c.inFlight, key)
+		if err == nil {
+			c.completed[key] = completedOperation{req: req, resp: resp, completedAt: time.Now()}
+		} else {
+			delete(c.completed, key)
+		}
+		if inFlight.abandonTimer != nil {
+			inFlight.abandonTimer.Stop()
+		}
+		c.mutex.Unlock()
+
+		inFlight.resp, inFlight.err = resp, err
+		close(inFlight.done)
+	}()
+
+	return c.wait(ctx, inFlight)
+}
+
+// Waits for the operation to finish or ctx to be done, whichever comes first. The operation is canceled if it is still
+// running after no request has waited for it for the abandoned operation timeout.
+func (c *operationCache) wait(ctx context.Context, inFlight *inFlightOperation) (protoiface.MessageV1, error) {
+	select {
+	case <-inFlight.done:
+		return inFlight.resp, inFlight.err
+	case <-ctx.Done():
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	inFlight.waiters--
+	if inFlight.waiters == 0 {
+		timeout := c.abandonedOperationTimeout
+		if timeout == 0 {
+			timeout = defaultAbandonedOperationTimeout
+		}
+		inFlight.abandonTimer = time.AfterFunc(timeout, inFlight.cancel)
+	}
+
+	return nil, status.FromContextError(ctx.Err()).Err()
+}
+
+func requestsAreEqual(a protoiface.MessageV1, b protoiface.MessageV1) bool {
+	return proto.Equal(protoimpl.X.ProtoMessageV2Of(a), protoimpl.X.ProtoMessageV2Of(b))
+}
+
+// Forgets the results of completed operations for which matches returns true, so that repeating them doesn't return
+// a stale response after the object they created was deleted.
+func (c *operationCache) forget(matches func(key string, resp protoiface.MessageV1) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, completed := range c.completed {
+		if matches(key, completed.resp) {
+			delete(c.completed, key)
+		}
+	}
+}
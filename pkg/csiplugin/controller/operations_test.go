@@ -0,0 +1,254 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+)
+
+func createVolumeOp(calls *int, volumeId string, err error) func(context.Context) (protoiface.MessageV1, error) {
+	return func(context.Context) (protoiface.MessageV1, error) {
+		*calls++
+		if err != nil {
+			return nil, err
+		}
+		return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: volumeId}}, nil
+	}
+}
+
+func TestOperationCacheRemembersSuccesses(t *testing.T) {
+	ctx := context.Background()
+	var cache operationCache
+	calls := 0
+	req := &csi.CreateVolumeRequest{Name: "pvc-1", Parameters: map[string]string{"a": "b"}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := cache.run(ctx, "volume pvc-1", req, createVolumeOp(&calls, "uid-1", nil))
+		if err != nil {
+			t.Fatalf("run %d failed: %v", i, err)
+		}
+		if id := resp.(*csi.CreateVolumeResponse).Volume.VolumeId; id != "uid-1" {
+			t.Fatalf("run %d returned volume %s", i, id)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("operation ran %d times, want 1", calls)
+	}
+
+	// a different request with the same key is run again
+
+	otherReq := &csi.CreateVolumeRequest{Name: "pvc-1", Parameters: map[string]string{"a": "c"}}
+	_, err := cache.run(ctx, "volume pvc-1", otherReq, createVolumeOp(&calls, "uid-1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("operation ran %d times, want 2", calls)
+	}
+}
+
+func TestOperationCacheDoesNotRememberFailures(t *testing.T) {
+	ctx := context.Background()
+	var cache operationCache
+	calls := 0
+	req := &csi.CreateVolumeRequest{Name: "pvc-1"}
+
+	_, err := cache.run(ctx, "volume pvc-1", req, createVolumeOp(&calls, "", errors.New("failed")))
+	if err == nil {
+		t.Fatal("expected failure")
+	}
+
+	_, err = cache.run(ctx, "volume pvc-1", req, createVolumeOp(&calls, "uid-1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 2 {
+		t.Errorf("operation ran %d times, want 2", calls)
+	}
+}
+
+func TestOperationCacheRejectsConcurrentOperations(t *testing.T) {
+	ctx := context.Background()
+	var cache operationCache
+	req := &csi.CreateVolumeRequest{Name: "pvc-1"}
+	otherReq := &csi.CreateVolumeRequest{Name: "pvc-1", Parameters: map[string]string{"a": "b"}}
+
+	_, err := cache.run(ctx, "volume pvc-1", req, func(context.Context) (protoiface.MessageV1, error) {
+		_, err := cache.run(ctx, "volume pvc-1", otherReq, func(context.Context) (protoiface.MessageV1, error) {
+			t.Error("concurrent operation ran")
+			return nil, nil
+		})
+		return nil, err
+	})
+
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("got code %v, want %v", code, codes.Aborted)
+	}
+}
+
+func TestOperationCacheJoinsRetries(t *testing.T) {
+	ctx := context.Background()
+	var cache operationCache
+	calls := 0
+	req := &csi.CreateVolumeRequest{Name: "pvc-1"}
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	result := make(chan error)
+
+	go func() {
+		_, err := cache.run(ctx, "volume pvc-1", req, func(opCtx context.Context) (protoiface.MessageV1, error) {
+			close(started)
+			<-finish
+			return createVolumeOp(&calls, "uid-1", nil)(opCtx)
+		})
+		result <- err
+	}()
+
+	<-started
+
+	// a retry that gives up doesn't affect the original operation
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err := cache.run(canceledCtx, "volume pvc-1", req, createVolumeOp(&calls, "uid-2", nil))
+	if code := status.Code(err); code != codes.Canceled {
+		t.Errorf("got code %v, want %v", code, codes.Canceled)
+	}
+
+	// a retry that waits gets the original operation's outcome
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(finish)
+	}()
+
+	resp, err := cache.run(ctx, "volume pvc-1", req, createVolumeOp(&calls, "uid-2", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := resp.(*csi.CreateVolumeResponse).Volume.VolumeId; id != "uid-1" {
+		t.Errorf("retry returned volume %s", id)
+	}
+
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("operation ran %d times, want 1", calls)
+	}
+}
+
+func TestOperationCacheOutlivesItsFirstRequest(t *testing.T) {
+	var cache operationCache
+	calls := 0
+	req := &csi.CreateVolumeRequest{Name: "pvc-1"}
+
+	type requestId struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), requestId{}, 1))
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	opErr := make(chan error, 1)
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	// the request that started the operation gives up, but the operation goes on with its context's values
+
+	_, err := cache.run(ctx, "volume pvc-1", req, func(opCtx context.Context) (protoiface.MessageV1, error) {
+		close(started)
+		<-finish
+		if opCtx.Value(requestId{}) != 1 {
+			t.Error("operation lost its request's context values")
+		}
+		opErr <- opCtx.Err()
+		return createVolumeOp(&calls, "uid-1", nil)(opCtx)
+	})
+	if code := status.Code(err); code != codes.Canceled {
+		t.Errorf("got code %v, want %v", code, codes.Canceled)
+	}
+
+	// a retry gets its outcome
+
+	close(finish)
+
+	resp, err := cache.run(context.Background(), "volume pvc-1", req, createVolumeOp(&calls, "uid-2", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := resp.(*csi.CreateVolumeResponse).Volume.VolumeId; id != "uid-1" || calls != 1 {
+		t.Errorf("retry returned volume %s after %d runs, want uid-1 after 1", id, calls)
+	}
+	if err := <-opErr; err != nil {
+		t.Errorf("operation's context was done: %v", err)
+	}
+}
+
+func TestOperationCacheCancelsAbandonedOperations(t *testing.T) {
+	cache := operationCache{abandonedOperationTimeout: 10 * time.Millisecond}
+	req := &csi.CreateVolumeRequest{Name: "pvc-1"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	canceled := make(chan struct{})
+
+	_, err := cache.run(ctx, "volume pvc-1", req, func(opCtx context.Context) (protoiface.MessageV1, error) {
+		<-opCtx.Done()
+		close(canceled)
+		return nil, opCtx.Err()
+	})
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Errorf("got code %v, want %v", code, codes.DeadlineExceeded)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("abandoned operation wasn't canceled")
+	}
+}
+
+func TestOperationCacheForget(t *testing.T) {
+	ctx := context.Background()
+	var cache operationCache
+	calls := 0
+	req1 := &csi.CreateVolumeRequest{Name: "pvc-1"}
+	req2 := &csi.CreateVolumeRequest{Name: "pvc-2"}
+
+	for _, req := range []*csi.CreateVolumeRequest{req1, req2} {
+		_, err := cache.run(ctx, "volume "+req.Name, req, createVolumeOp(&calls, "uid-"+req.Name, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache.forget(func(key string, resp protoiface.MessageV1) bool {
+		return resp.(*csi.CreateVolumeResponse).Volume.VolumeId == "uid-pvc-1"
+	})
+
+	for _, req := range []*csi.CreateVolumeRequest{req1, req2} {
+		_, err := cache.run(ctx, "volume "+req.Name, req, createVolumeOp(&calls, "uid-"+req.Name, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls != 3 {
+		t.Errorf("operations ran %d times, want 3", calls)
+	}
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// How long a measurement of the usage of a backing volume is reused when checking whether new volumes fit in it.
+const backingUsageCacheTtl = 5 * time.Minute
+
+// Caches measurements of the usage of backing volumes, since measuring it requires running a Job. Concurrent requests
+// for the same backing location wait for a single measurement.
+type backingUsageCache struct {
+	mutex   sync.Mutex
+	entries map[common.BackingLocation]*cachedBackingUsage
+}
+
+type cachedBackingUsage struct {
+	mutex      sync.Mutex
+	usage      common.BackingUsage
+	measuredAt time.Time
+}
+
+// Returns the usage of the given backing location, calling measure if it wasn't measured within backingUsageCacheTtl.
+func (c *backingUsageCache) get(
+	location common.BackingLocation,
+	now time.Time,
+	measure func() (common.BackingUsage, error),
+) (common.BackingUsage, error) {
+	c.mutex.Lock()
+	if c.entries == nil {
+		c.entries = map[common.BackingLocation]*cachedBackingUsage{}
+	}
+	entry := c.entries[location]
+	if entry == nil {
+		entry = &cachedBackingUsage{}
+		c.entries[location] = entry
+	}
+	c.mutex.Unlock()
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	if !entry.measuredAt.IsZero() && now.Sub(entry.measuredAt) < backingUsageCacheTtl {
+		return entry.usage, nil
+	}
+
+	usage, err := measure()
+	if err != nil {
+		return common.BackingUsage{}, err
+	}
+
+	entry.usage = usage
+	entry.measuredAt = now
+	return usage, nil
+}
+
+// Parses the "overcommitRatio" StorageClass parameter. Returns 0 if it isn't set, in which case volumes are created
+// regardless of the space left in the backing volume.
+func parseOvercommitRatio(parameters map[string]string) (float64, error) {
+	value, ok := parameters["overcommitRatio"]
+	if !ok || value == "" {
+		return 0, nil
+	}
+
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(ratio > 0) {
+		return 0, status.Errorf(codes.InvalidArgument, "parameter \"overcommitRatio\" must be a positive number")
+	}
+
+	return ratio, nil
+}
+
+// Fails with codes.ResourceExhausted unless a new volume with the given capacity fits in the backing location under
+// the given overcommit ratio, i.e., the capacities of all volumes in the backing volume, including the new one, add up
+// to at most ratio times the size of its file system. Volumes are only counted once, however many snapshots or clones
+// share their data, so this is conservative.
+func (s *ControllerServer) checkBackingSpace(
+	ctx context.Context,
+	location common.BackingLocation,
+	pvcUid types.UID,
+	capacity int64,
+	ratio float64,
+) error {
+	usage, err := s.backingUsage.get(location, time.Now(), func() (common.BackingUsage, error) {
+		return common.MeasureBackingUsage(ctx, s.Clientset, s.Image, location)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the PVC being provisioned is already labeled if this is a retry, and is accounted for by capacity instead
+	provisioned, err := s.provisionedCapacity(ctx, location, pvcUid)
+	if err != nil {
+		return err
+	}
+
+	return checkOvercommit(location, usage, provisioned, capacity, ratio)
+}
+
+// Returns the total capacity of the volumes in the given backing volume, except that of the given PVC, if any.
+func (s *ControllerServer) provisionedCapacity(
+	ctx context.Context,
+	location common.BackingLocation,
+	exceptPvcUid types.UID,
+) (int64, error) {
+	pvcs, err := s.Clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		return 0, err
+	}
+
+	var provisioned int64
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		other := common.BackingLocationOf(&pvc.ObjectMeta)
+		if pvc.UID == exceptPvcUid || other.PvcName != location.PvcName || other.PvcNamespace != location.PvcNamespace {
+			continue
+		}
+		if pvcCapacity, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64); err == nil {
+			provisioned += pvcCapacity
+		}
+	}
+
+	return provisioned, nil
+}
+
+// Fails with codes.ResourceExhausted if a volume with the given capacity doesn't fit in a backing volume with the given
+// usage, in which volumes with the given total capacity were already provisioned, under the given overcommit ratio.
+func checkOvercommit(
+	location common.BackingLocation,
+	usage common.BackingUsage,
+	provisioned int64,
+	capacity int64,
+	ratio float64,
+) error {
+	metadata := map[string]string{"backingPvcName": location.PvcName, "backingPvcNamespace": location.PvcNamespace}
+
+	if usage.Used >= usage.Size {
+		return common.ErrorWithReason(
+			codes.ResourceExhausted, common.ReasonBackingStoreFull, metadata, "backing volume is full",
+		)
+	}
+
+	limit := ratio * float64(usage.Size)
+	if float64(provisioned)+float64(capacity) > limit {
+		return common.ErrorWithReason(
+			codes.ResourceExhausted, common.ReasonBackingStoreFull, metadata,
+			"backing volume can hold volumes totalling %.0f bytes under overcommit ratio %g, but %d bytes are "+
+				"already provisioned and %d more were requested",
+			limit, ratio, provisioned, capacity,
+		)
+	}
+
+	return nil
+}
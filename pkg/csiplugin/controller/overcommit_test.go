@@ -0,0 +1,146 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseOvercommitRatio(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantRatio float64
+		wantErr   bool
+	}{
+		{"", 0, false},
+		{"1", 1, false},
+		{"2.5", 2.5, false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"NaN", 0, true},
+		{"lots", 0, true},
+	}
+
+	for _, test := range tests {
+		ratio, err := parseOvercommitRatio(map[string]string{"overcommitRatio": test.value})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %v", test.value, err, test.wantErr)
+		} else if ratio != test.wantRatio {
+			t.Errorf("%q: got ratio %v, want %v", test.value, ratio, test.wantRatio)
+		}
+	}
+}
+
+func TestCheckOvercommit(t *testing.T) {
+	usage := common.BackingUsage{Size: 100, Used: 10}
+
+	tests := []struct {
+		usage       common.BackingUsage
+		provisioned int64
+		capacity    int64
+		ratio       float64
+		wantErr     bool
+	}{
+		{usage, 0, 100, 1, false},
+		{usage, 50, 51, 1, true},
+		{usage, 150, 50, 2, false},
+		{usage, 150, 51, 2, true},
+		{usage, 0, 50, 0.5, false},
+		{common.BackingUsage{Size: 100, Used: 100}, 0, 1, 10, true},
+	}
+
+	location := common.BackingLocation{PvcName: "backing", PvcNamespace: "default"}
+
+	for _, test := range tests {
+		err := checkOvercommit(location, test.usage, test.provisioned, test.capacity, test.ratio)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%+v: got error %v, want error %v", test, err, test.wantErr)
+		} else if err != nil && status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("%+v: got code %v", test, status.Code(err))
+		} else if err != nil {
+			info := common.ErrorInfoOf(err)
+			if info == nil || info.Reason != common.ReasonBackingStoreFull ||
+				info.Metadata["backingPvcName"] != "backing" {
+				t.Errorf("%+v: got error info %v", test, info)
+			}
+		}
+	}
+}
+
+func TestCapacityLeft(t *testing.T) {
+	usage := common.BackingUsage{Size: 100, Used: 10}
+
+	tests := []struct {
+		usage       common.BackingUsage
+		provisioned int64
+		ratio       float64
+		want        int64
+	}{
+		{usage, 500, 0, 90},
+		{usage, 50, 1, 50},
+		{usage, 150, 2, 50},
+		{usage, 150, 1, 0},
+		{usage, 0, 0.5, 50},
+		{common.BackingUsage{Size: 100, Used: 100}, 0, 0, 0},
+		{common.BackingUsage{Size: 100, Used: 100}, 0, 10, 0},
+	}
+
+	location := common.BackingLocation{PvcName: "backing", PvcNamespace: "default"}
+
+	for _, test := range tests {
+		got := capacityLeft(test.usage, test.provisioned, test.ratio)
+		if got != test.want {
+			t.Errorf("%+v: got %d, want %d", test, got, test.want)
+		}
+
+		// the capacity left is exactly the largest volume that checkOvercommit() lets through
+		if test.ratio > 0 && got > 0 {
+			if err := checkOvercommit(location, test.usage, test.provisioned, got, test.ratio); err != nil {
+				t.Errorf("%+v: %d rejected: %v", test, got, err)
+			}
+			if err := checkOvercommit(location, test.usage, test.provisioned, got+1, test.ratio); err == nil {
+				t.Errorf("%+v: %d accepted", test, got+1)
+			}
+		}
+	}
+}
+
+func TestBackingUsageCache(t *testing.T) {
+	var c backingUsageCache
+	location := common.BackingLocation{PvcName: "backing", PvcNamespace: "default"}
+	now := time.Now()
+
+	measurements := 0
+	measure := func() (common.BackingUsage, error) {
+		measurements++
+		return common.BackingUsage{Size: 100, Used: int64(measurements)}, nil
+	}
+
+	for _, offset := range []time.Duration{0, time.Minute, backingUsageCacheTtl} {
+		if _, err := c.get(location, now.Add(offset), measure); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if measurements != 2 {
+		t.Errorf("measured %d times, want 2", measurements)
+	}
+
+	// failed measurements aren't cached
+
+	_, err := c.get(location, now.Add(2*backingUsageCacheTtl), func() (common.BackingUsage, error) {
+		return common.BackingUsage{}, errors.New("mount failed")
+	})
+	if err == nil {
+		t.Error("expected error")
+	}
+	usage, err := c.get(location, now.Add(2*backingUsageCacheTtl), measure)
+	if err != nil || usage.Used != 3 {
+		t.Errorf("got %+v, %v", usage, err)
+	}
+}
@@ -0,0 +1,276 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Provisions volumes for PVCs whose spec.dataSourceRef references a catalog image, i.e., has API group
+// "subprovisioner.gitlab.io", kind "ImageCatalog", and name "<catalog>/<image>".
+//
+// The external-provisioner leaves PVCs with such data sources to volume populators, so we act as one: For each such
+// PVC, we create a "prime" PVC with the same StorageClass, size, and modes that the external-provisioner does
+// provision, and which tells CreateVolume() which catalog image to provision it from. Once the prime PVC is bound, its
+// PV is rebound to the original PVC, and the labels, annotations, and finalizer that the plugin keeps on the PVC are
+// moved over to it before the prime PVC is deleted. Should we fail in between, adoptionController recovers the
+// essential ones.
+type populatorController struct {
+	clientset *common.Clientset
+}
+
+func (c *populatorController) run(stopCh chan struct{}) {
+	wait.Until(c.populateVolumes, 10*time.Second, stopCh)
+}
+
+func (c *populatorController) populateVolumes() {
+	ctx := context.Background() // TODO
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	// the provisioners of the StorageClasses looked up so far, as PVCs provisioned by other instances of the driver
+	// are left to them
+	provisioners := map[string]string{}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+
+		if _, ok := catalogImageRefOf(pvc); !ok || pvc.DeletionTimestamp != nil || pvc.Spec.StorageClassName == nil {
+			continue
+		}
+
+		className := *pvc.Spec.StorageClassName
+		if _, ok := provisioners[className]; !ok {
+			storageClass, err := c.clientset.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+			if err != nil {
+				klog.ErrorS(err, "Failed to get StorageClass to populate PVCs", "storageClass", className)
+				continue
+			}
+			provisioners[className] = storageClass.Provisioner
+		}
+		if provisioners[className] != common.Domain {
+			continue
+		}
+
+		err := c.populate(ctx, pvc)
+		if err != nil {
+			klog.ErrorS(err, "Failed to populate PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+	}
+}
+
+// Returns the "<catalog>/<image>" reference given in the PVC's spec.dataSourceRef, if it references a catalog image.
+func catalogImageRefOf(pvc *corev1.PersistentVolumeClaim) (string, bool) {
+	ref := pvc.Spec.DataSourceRef
+	if ref == nil || ref.APIGroup == nil || *ref.APIGroup != common.Group || ref.Kind != "ImageCatalog" {
+		return "", false
+	}
+	return ref.Name, true
+}
+
+func generatePrimePvcName(pvc *corev1.PersistentVolumeClaim) string {
+	return fmt.Sprintf("%s-populate-%s", common.NamePrefix, pvc.UID)
+}
+
+func (c *populatorController) populate(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	pvcs := c.clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace)
+	primeName := generatePrimePvcName(pvc)
+
+	prime, err := pvcs.Get(ctx, primeName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		if pvc.Spec.VolumeName != "" {
+			return nil // already populated
+		}
+		return c.createPrimePvc(ctx, pvc)
+	} else if err != nil {
+		return err
+	}
+
+	// the prime PVC loses its labels once released, but remains owned by the original PVC until deleted
+
+	if !metav1.IsControlledBy(prime, pvc) {
+		return fmt.Errorf(
+			"PVC %s in namespace %s already exists but isn't the prime PVC of PVC %s; if another driver instance "+
+				"created it, give the instances names with distinct first labels",
+			primeName, pvc.Namespace, pvc.Name,
+		)
+	}
+
+	if prime.Spec.VolumeName == "" {
+		return nil // not provisioned yet
+	}
+
+	// rebind the PV to the original PVC
+
+	pv, err := c.clientset.CoreV1().PersistentVolumes().Get(ctx, prime.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.UID == prime.UID {
+		klog.InfoS("Binding populated PV to PVC", "pv", pv.Name, "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+
+		pv.Spec.ClaimRef = &corev1.ObjectReference{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+			Namespace:  pvc.Namespace,
+			Name:       pvc.Name,
+			UID:        pvc.UID,
+		}
+
+		_, err = c.clientset.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
+	// move our metadata over to the original PVC
+
+	labels, annotations, err := c.releasePrimePvc(ctx, prime)
+	if err != nil {
+		return err
+	}
+
+	if len(labels) > 0 {
+		err = common.ApplyPvcMetadata(
+			ctx, c.clientset, pvc.Name, pvc.Namespace,
+			metav1.ObjectMeta{
+				Labels:      labels,
+				Annotations: annotations,
+				Finalizers:  []string{common.Domain + "/cleanup"},
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = pvcs.Delete(ctx, prime.Name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (c *populatorController) createPrimePvc(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	ref, _ := catalogImageRefOf(pvc)
+
+	annotations := map[string]string{
+		common.Domain + "/catalog-image": ref,
+	}
+	if node := pvc.Annotations["volume.kubernetes.io/selected-node"]; node != "" {
+		// the StorageClass has volumeBindingMode WaitForFirstConsumer
+		annotations["volume.kubernetes.io/selected-node"] = node
+	}
+
+	isController := true
+
+	prime := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      generatePrimePvcName(pvc),
+			Namespace: pvc.Namespace,
+			Labels: map[string]string{
+				common.Domain + "/component":         "volume-population",
+				common.Domain + "/populated-pvc-uid": string(pvc.UID),
+			},
+			Annotations: annotations,
+			// so that the prime PVC goes away if the original PVC is deleted before being populated
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "v1",
+					Kind:       "PersistentVolumeClaim",
+					Name:       pvc.Name,
+					UID:        pvc.UID,
+					Controller: &isController,
+				},
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      pvc.Spec.AccessModes,
+			Resources:        pvc.Spec.Resources,
+			StorageClassName: pvc.Spec.StorageClassName,
+			VolumeMode:       pvc.Spec.VolumeMode,
+		},
+	}
+
+	klog.InfoS("Populating PVC from catalog image", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "image", ref)
+
+	_, err := c.clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(ctx, prime, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// Removes the labels, annotations, and finalizer that the plugin keeps on the prime PVC, so that the volume no longer
+// belongs to it, and returns them. Returns no labels if they were already removed.
+func (c *populatorController) releasePrimePvc(
+	ctx context.Context,
+	prime *corev1.PersistentVolumeClaim,
+) (labels map[string]string, annotations map[string]string, err error) {
+	err = common.UpdatePvcMetadata(
+		ctx, c.clientset, prime.Name, prime.Namespace,
+		func(prime *corev1.PersistentVolumeClaim) error {
+			if _, err := common.ConvertState(&prime.ObjectMeta); err != nil {
+				return err
+			}
+
+			if prime.Labels[common.Domain+"/uid"] == "" {
+				labels, annotations = nil, nil
+				return nil
+			}
+
+			// the prime PVC is only ever used by us, so it must be idle
+			if state := prime.Annotations[common.Domain+"/state"]; state != "idle" {
+				return fmt.Errorf("prime PVC %s is in state %s", prime.Name, state)
+			}
+
+			labels = map[string]string{}
+			for key, value := range prime.Labels {
+				if strings.HasPrefix(key, common.Domain+"/") && key != common.Domain+"/component" &&
+					key != common.Domain+"/populated-pvc-uid" {
+					labels[key] = value
+					delete(prime.Labels, key)
+				}
+			}
+
+			annotations = map[string]string{}
+			for key, value := range prime.Annotations {
+				if strings.HasPrefix(key, common.Domain+"/") {
+					annotations[key] = value
+					delete(prime.Annotations, key)
+				}
+			}
+
+			for i, finalizer := range prime.Finalizers {
+				if finalizer == common.Domain+"/cleanup" {
+					prime.Finalizers = append(prime.Finalizers[:i], prime.Finalizers[i+1:]...)
+					break
+				}
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return labels, annotations, nil
+}
@@ -0,0 +1,240 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// How long probing a backing volume may take, including scheduling and starting its Job, before the probe fails.
+const backingStoreProbeTimeout = 2 * time.Minute
+
+// Probes whose I/O takes longer than this fail too, as volumes in the backing volume would hardly be usable.
+const backingStoreProbeSlowThreshold = 10 * time.Second
+
+var backingStoreProbeBackoffLimit int32 = 0
+
+var (
+	backingStoreProbeDurationSeconds = metrics.Default.NewGaugeVec(
+		"subprovisioner_backing_store_probe_duration_seconds",
+		"How long writing to, flushing, and reading back the canary image of a backing volume took when last probed.",
+		"backing_pvc_namespace", "backing_pvc_name",
+	)
+	backingStoreProbeFailures = metrics.Default.NewCounterVec(
+		"subprovisioner_backing_store_probe_failures_total",
+		"Number of probes of a backing volume that failed or were too slow.",
+		"backing_pvc_namespace", "backing_pvc_name",
+	)
+)
+
+// Periodically probes every backing volume that a StorageClass refers to or that holds volumes by writing to, flushing,
+// and reading back a tiny canary image in it (see common.BackingStoreCanaryImageName) with a Job, which goes through
+// the same mount and QEMU block layer as volumes do. Failed and slow probes count as failures in the breaker of the
+// backing volume (see backingStoreBreaker), and successful ones as successes, so that a degraded backing volume stops
+// receiving new volumes before creating them fails, and is found to have recovered without a volume being created.
+type backingStoreProbeController struct {
+	clientset *common.Clientset
+	image     string
+	server    *ControllerServer // whose breaker the probes feed
+	interval  time.Duration
+}
+
+func (c *backingStoreProbeController) run(stopCh chan struct{}) {
+	wait.Until(c.probeAll, c.interval, stopCh)
+}
+
+func (c *backingStoreProbeController) probeAll() {
+	ctx := context.Background() // TODO
+
+	storageClasses, err := c.clientset.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	// backing volumes are probed at once, so that a hanging one doesn't delay the others
+
+	var wg sync.WaitGroup
+	for _, summary := range summarizeBackingStores(storageClasses.Items, pvcs.Items, nil, nil) {
+		location := summary.location
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.probe(ctx, location)
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *backingStoreProbeController) probe(ctx context.Context, location common.BackingLocation) {
+	err := common.CheckBackingPvcMaintenance(ctx, c.clientset, location.PvcName, location.PvcNamespace)
+	if err != nil {
+		return // the backing volume may be unavailable on purpose
+	}
+
+	latency, err := runBackingStoreProbe(ctx, c.clientset, c.image, location)
+
+	var reason string
+	if info := common.ErrorInfoOf(err); info != nil &&
+		(info.Reason == common.ReasonJobFailed || info.Reason == common.ReasonJobUnschedulable) {
+		reason = "probe failed: " + lastLine(err.Error())
+	} else if err != nil {
+		// the probe couldn't be run, which says nothing about the backing volume
+		klog.ErrorS(
+			err, "Failed to probe backing PVC", "backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+		)
+		return
+	} else {
+		backingStoreProbeDurationSeconds.Set(latency.Seconds(), location.PvcNamespace, location.PvcName)
+		if latency > backingStoreProbeSlowThreshold {
+			reason = fmt.Sprintf("probe took %v, more than %v", latency, backingStoreProbeSlowThreshold)
+		}
+	}
+
+	key := location.PvcNamespace + "/" + location.PvcName
+
+	if reason == "" {
+		if c.server.backingStores.recordSuccess(key) {
+			c.server.reportBackingStoreHealth(ctx, location.PvcName, location.PvcNamespace, "")
+		}
+		return
+	}
+
+	klog.ErrorS(
+		nil, "Probe of backing PVC failed", "backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+		"reason", reason,
+	)
+	backingStoreProbeFailures.Inc(location.PvcNamespace, location.PvcName)
+
+	if c.server.backingStores.recordFailure(key, reason, time.Now()) {
+		c.server.reportBackingStoreHealth(ctx, location.PvcName, location.PvcNamespace, reason)
+	}
+}
+
+// Writes to, flushes, and reads back the canary image in the given backing location with a Job, creating the image if
+// needed, and returns how long the I/O took. Volumes are served with O_DIRECT unless the file system doesn't support it
+// (see qsd-with-nbd.sh), and so is the canary image. Fails with reason common.ReasonJobFailed or
+// common.ReasonJobUnschedulable if the Job doesn't succeed.
+func runBackingStoreProbe(
+	ctx context.Context,
+	clientset *common.Clientset,
+	image string,
+	location common.BackingLocation,
+) (time.Duration, error) {
+	probeScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset
+
+		canary="/var/backing/$1"
+		if [[ ! -e "${canary}" ]]; then
+		    qemu-img create -q -f qcow2 "${canary}.tmp" 1M
+		    mv "${canary}.tmp" "${canary}"
+		fi
+
+		cache=none
+		qemu-io -f qcow2 --cache=none --cmd quit "${canary}" &> /dev/null || cache=writeback
+
+		pattern="$(( RANDOM % 255 + 1 ))"
+		start="$( date +%s%N )"
+		output="$(
+		    qemu-io -f qcow2 --cache="${cache}" \
+		        --cmd "write -P ${pattern} 0 64k" --cmd flush --cmd "read -P ${pattern} 0 64k" \
+		        "${canary}" 2>&1
+		)"
+		end="$( date +%s%N )"
+
+		if grep -qi fail <<< "${output}"; then
+		    echo "${output}"
+		    exit 1
+		fi
+		echo "probed $(( end - start ))"
+		`,
+	)
+
+	jobName := common.GenerateBackingStoreProbeJobName(location)
+
+	// a Job left behind by a previous run of the controller plugin would tell about an earlier probe
+
+	err := common.DeleteJobSynchronously(ctx, clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return 0, err
+	}
+
+	err = common.CreateJob(
+		ctx, clientset,
+		common.JobConfig{
+			Name:      jobName,
+			Namespace: location.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "backing-store-probe",
+			},
+			Image:              image,
+			Command:            []string{"bash", "-c", probeScript, "bash", common.BackingStoreCanaryImageName},
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			BackoffLimit:       &backingStoreProbeBackoffLimit,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	err = common.WaitForJobToSucceedWithin(ctx, clientset, jobName, location.PvcNamespace, backingStoreProbeTimeout)
+	if err != nil {
+		_ = common.DeleteJobSynchronously(ctx, clientset, jobName, location.PvcNamespace)
+		return 0, err
+	}
+
+	logs, err := common.GetJobLogs(ctx, clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return 0, err
+	}
+
+	err = common.DeleteJobSynchronously(ctx, clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return 0, err
+	}
+
+	return parseBackingStoreProbeOutput(string(logs))
+}
+
+// Parses the "probed <nanoseconds>" line output by the probe Job.
+func parseBackingStoreProbeOutput(output string) (time.Duration, error) {
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "probed ") {
+			latency, err := strconv.ParseInt(strings.TrimPrefix(line, "probed "), 10, 64)
+			if err != nil || latency < 0 {
+				break
+			}
+			return time.Duration(latency), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unexpected probe output: %q", output)
+}
+
+// The last non-empty line of the given text, e.g., of an error that ends with the logs of a Job.
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
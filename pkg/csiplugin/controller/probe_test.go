@@ -0,0 +1,38 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBackingStoreProbeOutput(t *testing.T) {
+	got, err := parseBackingStoreProbeOutput("Formatting '/var/backing/.canary.qcow2.tmp'\nprobed 2500000\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 2500 * time.Microsecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, output := range []string{
+		"", "probed\n", "probed soon\n", "probed -1\n", "write failed: Input/output error\n",
+	} {
+		if _, err := parseBackingStoreProbeOutput(output); err == nil {
+			t.Errorf("%q: expected error", output)
+		}
+	}
+}
+
+func TestLastLine(t *testing.T) {
+	for text, want := range map[string]string{
+		"job x failed: BackoffLimitExceeded; its logs were:\nwrite failed: EIO\n\n": "write failed: EIO",
+		"job x didn't succeed within 2m0s":                                          "job x didn't succeed within 2m0s",
+		"":                                                                          "",
+	} {
+		if got := lastLine(text); got != want {
+			t.Errorf("%q: got %q, want %q", text, got, want)
+		}
+	}
+}
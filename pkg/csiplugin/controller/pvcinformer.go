@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"sort"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Creates the informer that caches the PVCs of the driver's volumes, i.e., those with the "uid" label, so that the
+// controller monitor and the controller service share a single watch on them. Every replica of the controller plugin
+// runs it, whether it runs the monitor or not (see ControllerMonitor).
+func NewPvcInformer(clientset *common.Clientset) cache.SharedIndexInformer {
+	listWatcher := cache.NewFilteredListWatchFromClient(
+		clientset.CoreV1().RESTClient(),
+		"persistentvolumeclaims",
+		corev1.NamespaceAll,
+		func(options *metav1.ListOptions) {
+			options.LabelSelector = common.Domain + "/uid"
+		},
+	)
+
+	return cache.NewSharedIndexInformer(listWatcher, &corev1.PersistentVolumeClaim{}, 0, cache.Indexers{})
+}
+
+// Returns the PVCs of the driver's volumes from the informer's cache, sorted by volume id. They are shared with the
+// cache and must not be modified. Fails with codes.Unavailable if the cache hasn't been filled yet.
+func listCachedPvcs(informer cache.SharedIndexInformer) ([]*corev1.PersistentVolumeClaim, error) {
+	if !informer.HasSynced() {
+		return nil, status.Errorf(codes.Unavailable, "PVC cache hasn't synced yet")
+	}
+
+	objects := informer.GetStore().List()
+
+	pvcs := make([]*corev1.PersistentVolumeClaim, 0, len(objects))
+	for _, obj := range objects {
+		pvcs = append(pvcs, obj.(*corev1.PersistentVolumeClaim))
+	}
+
+	sort.Slice(pvcs, func(i, j int) bool {
+		return common.VolumeUidOf(pvcs[i]) < common.VolumeUidOf(pvcs[j])
+	})
+
+	return pvcs, nil
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// An informer whose cache holds the given objects, without running it.
+type fakePvcInformer struct {
+	cache.SharedIndexInformer
+	store  cache.Store
+	synced bool
+}
+
+func (f *fakePvcInformer) HasSynced() bool       { return f.synced }
+func (f *fakePvcInformer) GetStore() cache.Store { return f.store }
+
+func TestListVolumesFromCache(t *testing.T) {
+	informer := &fakePvcInformer{store: cache.NewStore(cache.MetaNamespaceKeyFunc)}
+	for _, uid := range []string{"c", "a", "b"} {
+		_ = informer.store.Add(&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "pvc-" + uid,
+				Namespace:   "default",
+				Labels:      map[string]string{common.Domain + "/uid": uid},
+				Annotations: map[string]string{common.Domain + "/capacity": "1024"},
+			},
+		})
+	}
+
+	s := &ControllerServer{PvcInformer: informer}
+
+	_, err := s.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable before the cache synced, got %v", err)
+	}
+
+	informer.synced = true
+
+	var ids []string
+	token := ""
+	for pages := 0; pages < 3; pages++ {
+		resp, err := s.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, entry := range resp.Entries {
+			ids = append(ids, entry.Volume.VolumeId)
+		}
+		token = resp.NextToken
+		if token == "" {
+			break
+		}
+	}
+
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got volumes %v, want %v", ids, want)
+	}
+
+	_, err = s.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "4"})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted for an invalid starting token, got %v", err)
+	}
+}
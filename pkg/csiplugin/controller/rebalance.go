@@ -0,0 +1,294 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultRebalanceThreshold = 80
+	defaultRebalanceMinIdle   = 24 * time.Hour
+)
+
+// For StorageClasses with the "rebalance" parameter set to "true", periodically moves cold volumes from the class'
+// backing volumes (its default one and those in "allowedBackingClaims") whose usage is above the class'
+// "rebalanceThreshold" to the least used one, as long as that one stays below the threshold. Only volumes that haven't
+// been staged for at least "rebalanceMinIdle" and weren't placed in a specific backing volume by their PVC's
+// "backing-claim" annotation are moved, one per class at a time, in the same way as when draining backing volumes, and
+// only during the maintenance window, if any.
+type rebalanceController struct {
+	clientset *common.Clientset
+	image     string
+}
+
+// A backing volume that volumes of a StorageClass may be placed in, and its current usage.
+type rebalanceStore struct {
+	location common.BackingLocation
+	usage    common.BackingUsage
+}
+
+// A volume that may be moved to another backing volume.
+type rebalanceCandidate struct {
+	pvc       *corev1.PersistentVolumeClaim
+	location  common.BackingLocation
+	capacity  int64
+	idleSince time.Time
+}
+
+func (c *rebalanceController) run(stopCh chan struct{}) {
+	wait.Until(c.rebalanceAll, 10*time.Minute, stopCh)
+}
+
+func (c *rebalanceController) rebalanceAll() {
+	ctx := context.Background() // TODO
+
+	if !common.InMaintenanceWindow(time.Now()) {
+		return
+	}
+
+	storageClasses, err := c.clientset.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	var pvcs *corev1.PersistentVolumeClaimList
+
+	for i := range storageClasses.Items {
+		storageClass := &storageClasses.Items[i]
+		if storageClass.Provisioner != common.Domain || storageClass.Parameters["rebalance"] != "true" {
+			continue
+		}
+
+		if pvcs == nil {
+			pvcs, err = c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+				List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+			if err != nil {
+				runtime.HandleError(err)
+				return
+			}
+		}
+
+		err := c.rebalance(ctx, storageClass, pvcs.Items)
+		if err != nil {
+			klog.ErrorS(err, "Failed to rebalance volumes of StorageClass", "storageClass", storageClass.Name)
+		}
+	}
+}
+
+func (c *rebalanceController) rebalance(
+	ctx context.Context,
+	storageClass *storagev1.StorageClass,
+	pvcs []corev1.PersistentVolumeClaim,
+) error {
+	threshold, minIdle, err := parseRebalancePolicy(storageClass.Parameters)
+	if err != nil {
+		return err
+	}
+
+	// measure the usage of the class' backing volumes that can take volumes
+
+	var stores []rebalanceStore
+	for _, location := range rebalanceLocations(storageClass.Parameters) {
+		err := common.CheckBackingPvcAcceptsVolumes(ctx, c.clientset, location.PvcName, location.PvcNamespace)
+		if err != nil {
+			continue // under maintenance or being drained
+		}
+
+		usage, err := common.MeasureBackingUsage(ctx, c.clientset, c.image, location)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to measure usage of backing PVC",
+				"backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+			)
+			continue
+		}
+
+		stores = append(stores, rebalanceStore{location: location, usage: usage})
+	}
+
+	if len(stores) < 2 {
+		return nil
+	}
+
+	// find the volumes that may be moved
+
+	var candidates []rebalanceCandidate
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		if candidate, ok := rebalanceCandidateOf(pvc, storageClass.Name); ok {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	// move the coldest volume off the most used backing volume, if any needs it
+
+	candidate, target, ok := planRebalance(stores, candidates, threshold, minIdle, time.Now())
+	if !ok {
+		return nil
+	}
+
+	pvc := candidates[candidate].pvc
+	source := candidates[candidate].location
+	location := stores[target].location
+
+	err = migrateVolume(ctx, c.clientset, c.image, pvc, location)
+	if err != nil {
+		return fmt.Errorf("failed to migrate PVC %s in namespace %s: %w", pvc.Name, pvc.Namespace, err)
+	}
+
+	return common.EmitEvent(
+		ctx, c.clientset, common.PvcEventObject(pvc),
+		corev1.EventTypeNormal, "VolumeRebalanced", "Moved volume from backing PVC %s to backing PVC %s",
+		source.PvcName, location.PvcName,
+	)
+}
+
+// Parses the "rebalanceThreshold" (a percentage of a backing volume's size) and "rebalanceMinIdle" (a duration)
+// StorageClass parameters.
+func parseRebalancePolicy(parameters map[string]string) (threshold float64, minIdle time.Duration, err error) {
+	threshold = defaultRebalanceThreshold
+	if value := parameters["rebalanceThreshold"]; value != "" {
+		percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, 0, fmt.Errorf("invalid StorageClass parameter \"rebalanceThreshold\": \"%s\"", value)
+		}
+		threshold = float64(percent)
+	}
+
+	minIdle = defaultRebalanceMinIdle
+	if value := parameters["rebalanceMinIdle"]; value != "" {
+		minIdle, err = time.ParseDuration(value)
+		if err != nil || minIdle < 0 {
+			return 0, 0, fmt.Errorf("invalid StorageClass parameter \"rebalanceMinIdle\": \"%s\"", value)
+		}
+	}
+
+	return threshold / 100, minIdle, nil
+}
+
+// The backing volumes a StorageClass may place volumes in: its default one, followed by those in
+// "allowedBackingClaims". All use the class' base path.
+func rebalanceLocations(parameters map[string]string) []common.BackingLocation {
+	defaultNamespace := parameters["backingClaimNamespace"]
+	refs := []string{defaultNamespace + "/" + parameters["backingClaimName"]}
+	if allowed := parameters["allowedBackingClaims"]; allowed != "" {
+		refs = append(refs, strings.Split(allowed, ",")...)
+	}
+
+	var locations []common.BackingLocation
+	seen := map[string]bool{}
+
+	for _, ref := range refs {
+		name, namespace := parseBackingClaimRef(ref, defaultNamespace)
+		if name == "" || namespace == "" || seen[namespace+"/"+name] {
+			continue
+		}
+		seen[namespace+"/"+name] = true
+
+		locations = append(locations, common.BackingLocation{
+			PvcName:      name,
+			PvcNamespace: namespace,
+			BasePath:     parameters["basePath"],
+		})
+	}
+
+	return locations
+}
+
+// Whether the volume of the given PVC may be moved to another backing volume of the given StorageClass, i.e., it
+// belongs to that class, is idle and not staged, isn't mirrored, has a qcow2 image, and its PVC didn't ask for a
+// specific backing volume.
+func rebalanceCandidateOf(pvc *corev1.PersistentVolumeClaim, storageClassName string) (rebalanceCandidate, bool) {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != storageClassName ||
+		pvc.DeletionTimestamp != nil ||
+		pvc.Annotations[common.Domain+"/state"] != "idle" ||
+		pvc.Annotations[common.Domain+"/backing-claim"] != "" ||
+		pvc.Annotations[common.Domain+"/mirror-backing-pvc-name"] != "" ||
+		common.VolumeImageFormatOf(&pvc.ObjectMeta) != common.ImageFormatQcow2 ||
+		common.PvcIsReplicationSecondary(pvc) {
+		return rebalanceCandidate{}, false
+	}
+
+	capacity, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64)
+	if err != nil {
+		return rebalanceCandidate{}, false
+	}
+
+	// volumes that were never staged have been idle since they were created
+
+	idleSince := pvc.CreationTimestamp.Time
+	if lastUnstaged, err := time.Parse(time.RFC3339, pvc.Annotations[common.Domain+"/last-unstaged"]); err == nil {
+		idleSince = lastUnstaged
+	}
+
+	return rebalanceCandidate{
+		pvc:       pvc,
+		location:  common.BackingLocationOf(&pvc.ObjectMeta),
+		capacity:  capacity,
+		idleSince: idleSince,
+	}, true
+}
+
+// Picks the volume to move and the backing volume to move it to, as indices into candidates and stores: the volume
+// that has been idle the longest in the most used backing volume above the threshold (a fraction of the backing
+// volume's size), and the least used backing volume in the same namespace that stays at or below the threshold even if
+// the volume's image grows to its full capacity.
+func planRebalance(
+	stores []rebalanceStore,
+	candidates []rebalanceCandidate,
+	threshold float64,
+	minIdle time.Duration,
+	now time.Time,
+) (candidate int, target int, ok bool) {
+	source := -1
+	for i, store := range stores {
+		if store.usage.UsedFraction() > threshold &&
+			(source < 0 || store.usage.UsedFraction() > stores[source].usage.UsedFraction()) {
+			source = i
+		}
+	}
+	if source < 0 {
+		return -1, -1, false
+	}
+
+	candidate, target = -1, -1
+
+	for i, c := range candidates {
+		if c.location.PvcName != stores[source].location.PvcName ||
+			c.location.PvcNamespace != stores[source].location.PvcNamespace ||
+			now.Sub(c.idleSince) < minIdle {
+			continue
+		}
+
+		t := -1
+		for j, store := range stores {
+			if j == source || store.location.PvcNamespace != c.location.PvcNamespace ||
+				float64(store.usage.Used+c.capacity) > threshold*float64(store.usage.Size) {
+				continue
+			}
+			if t < 0 || store.usage.UsedFraction() < stores[t].usage.UsedFraction() {
+				t = j
+			}
+		}
+
+		if t >= 0 && (candidate < 0 || c.idleSince.Before(candidates[candidate].idleSince)) {
+			candidate, target = i, t
+		}
+	}
+
+	return candidate, target, candidate >= 0
+}
@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+)
+
+func TestParseRebalancePolicy(t *testing.T) {
+	threshold, minIdle, err := parseRebalancePolicy(map[string]string{})
+	if err != nil || threshold != 0.8 || minIdle != 24*time.Hour {
+		t.Errorf("defaults: got %v, %v, %v", threshold, minIdle, err)
+	}
+
+	threshold, minIdle, err = parseRebalancePolicy(map[string]string{
+		"rebalanceThreshold": "70%",
+		"rebalanceMinIdle":   "1h",
+	})
+	if err != nil || threshold != 0.7 || minIdle != time.Hour {
+		t.Errorf("got %v, %v, %v", threshold, minIdle, err)
+	}
+
+	for _, parameters := range []map[string]string{
+		{"rebalanceThreshold": "0"},
+		{"rebalanceThreshold": "101"},
+		{"rebalanceThreshold": "high"},
+		{"rebalanceMinIdle": "1d"},
+	} {
+		if _, _, err := parseRebalancePolicy(parameters); err == nil {
+			t.Errorf("%v: expected error", parameters)
+		}
+	}
+}
+
+func TestRebalanceLocations(t *testing.T) {
+	got := rebalanceLocations(map[string]string{
+		"backingClaimName":      "a",
+		"backingClaimNamespace": "ns",
+		"basePath":              "volumes",
+		"allowedBackingClaims":  "b, ns/a, other/c",
+	})
+
+	want := []common.BackingLocation{
+		{PvcName: "a", PvcNamespace: "ns", BasePath: "volumes"},
+		{PvcName: "b", PvcNamespace: "ns", BasePath: "volumes"},
+		{PvcName: "c", PvcNamespace: "other", BasePath: "volumes"},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestPlanRebalance(t *testing.T) {
+	const gi = 1 << 30
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	store := func(name string, namespace string, used int64) rebalanceStore {
+		return rebalanceStore{
+			location: common.BackingLocation{PvcName: name, PvcNamespace: namespace},
+			usage:    common.BackingUsage{Size: 100 * gi, Used: used * gi},
+		}
+	}
+	candidate := func(name string, namespace string, capacity int64, idleDays int) rebalanceCandidate {
+		return rebalanceCandidate{
+			location:  common.BackingLocation{PvcName: name, PvcNamespace: namespace},
+			capacity:  capacity * gi,
+			idleSince: now.Add(-time.Duration(idleDays) * 24 * time.Hour),
+		}
+	}
+
+	tests := []struct {
+		name          string
+		stores        []rebalanceStore
+		candidates    []rebalanceCandidate
+		wantCandidate int
+		wantTarget    int
+		wantOk        bool
+	}{
+		{
+			name:       "below threshold",
+			stores:     []rebalanceStore{store("a", "ns", 80), store("b", "ns", 10)},
+			candidates: []rebalanceCandidate{candidate("a", "ns", 10, 5)},
+			wantOk:     false,
+		},
+		{
+			name:   "coldest volume to least used store",
+			stores: []rebalanceStore{store("a", "ns", 90), store("b", "ns", 50), store("c", "ns", 20)},
+			candidates: []rebalanceCandidate{
+				candidate("a", "ns", 10, 2),
+				candidate("a", "ns", 10, 7),
+				candidate("b", "ns", 10, 30),
+			},
+			wantCandidate: 1,
+			wantTarget:    2,
+			wantOk:        true,
+		},
+		{
+			name:   "most used store first",
+			stores: []rebalanceStore{store("a", "ns", 85), store("b", "ns", 95), store("c", "ns", 0)},
+			candidates: []rebalanceCandidate{
+				candidate("a", "ns", 10, 9),
+				candidate("b", "ns", 10, 3),
+			},
+			wantCandidate: 1,
+			wantTarget:    2,
+			wantOk:        true,
+		},
+		{
+			name:       "not idle long enough",
+			stores:     []rebalanceStore{store("a", "ns", 90), store("b", "ns", 10)},
+			candidates: []rebalanceCandidate{candidate("a", "ns", 10, 0)},
+			wantOk:     false,
+		},
+		{
+			name:   "target would exceed threshold",
+			stores: []rebalanceStore{store("a", "ns", 90), store("b", "ns", 75)},
+			candidates: []rebalanceCandidate{
+				candidate("a", "ns", 10, 9),
+				candidate("a", "ns", 5, 2),
+			},
+			wantCandidate: 1,
+			wantTarget:    1,
+			wantOk:        true,
+		},
+		{
+			name:       "target in another namespace",
+			stores:     []rebalanceStore{store("a", "ns", 90), store("b", "other", 10)},
+			candidates: []rebalanceCandidate{candidate("a", "ns", 10, 9)},
+			wantOk:     false,
+		},
+	}
+
+	for _, test := range tests {
+		candidate, target, ok := planRebalance(test.stores, test.candidates, 0.8, 24*time.Hour, now)
+		if ok != test.wantOk || (ok && (candidate != test.wantCandidate || target != test.wantTarget)) {
+			t.Errorf(
+				"%s: got %d, %d, %v, want %d, %d, %v",
+				test.name, candidate, target, ok, test.wantCandidate, test.wantTarget, test.wantOk,
+			)
+		}
+	}
+}
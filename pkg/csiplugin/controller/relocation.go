@@ -0,0 +1,352 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Moves the images of idle volumes whose PVCs have the "relocate-to-base-path" annotation to that base path in the same
+// backing volume, e.g., when directories of the backing volume are re-tiered across the NFS exports underlying it. The
+// annotation is removed once the volume has been relocated, and the outcome is recorded in the "relocation-status"
+// annotation.
+//
+// Images without a backing file are moved by hard-linking them if both base paths are in the same file system, and
+// other images are flattened into a standalone image at the target, as when migrating volumes to another backing
+// volume. The volume is kept in the "relocating" state meanwhile. Its image at the previous base path is replaced by a
+// symlink to the new one in a single rename, which is only removed once the PVC and PV both point to the new base path,
+// so that the image can be found at either until then.
+type relocationController struct {
+	clientset *common.Clientset
+	image     string
+}
+
+// How long relocating a single volume may take, which is mostly spent copying its data if it can't be hard-linked.
+const relocationJobTimeout = 6 * time.Hour
+
+var relocationJobBackoffLimit int32 = 2
+
+func (c *relocationController) run(stopCh chan struct{}) {
+	wait.Until(c.relocateAll, time.Minute, stopCh)
+}
+
+func (c *relocationController) relocateAll() {
+	ctx := context.Background() // TODO
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if _, ok := pvc.Annotations[common.Domain+"/relocate-to-base-path"]; !ok || pvc.DeletionTimestamp != nil {
+			continue
+		}
+
+		err := c.relocate(ctx, pvc)
+		if err != nil {
+			klog.ErrorS(err, "Failed to relocate PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+	}
+}
+
+func (c *relocationController) relocate(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	request := pvc.Annotations[common.Domain+"/relocate-to-base-path"]
+	source := common.BackingLocationOf(&pvc.ObjectMeta)
+
+	basePath, err := parseRelocationRequest(request)
+	if err != nil {
+		return c.recordRelocationStatus(ctx, pvc, "failed: "+err.Error())
+	}
+
+	target := source
+	target.BasePath = basePath
+
+	if target == source {
+		return c.completeRelocation(ctx, pvc, request, target)
+	}
+
+	// replication deltas and mirror images are kept next to the image, and aren't relocated along with it
+
+	if _, mirrored := common.MirrorLocationOf(&pvc.ObjectMeta); mirrored {
+		return c.recordRelocationStatus(ctx, pvc, "failed: mirrored volumes can't be relocated")
+	}
+	if common.PvcIsReplicationSecondary(pvc) {
+		return c.recordRelocationStatus(ctx, pvc, "failed: replication secondaries can't be relocated")
+	}
+
+	replications, err := common.ListVolumeReplications(ctx, c.clientset)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	for i := range replications {
+		if replications[i].Namespace == pvc.Namespace && replications[i].Spec.PvcName == pvc.Name {
+			return c.recordRelocationStatus(ctx, pvc, "failed: replicated volumes can't be relocated")
+		}
+	}
+
+	err = common.CheckBackingPvcMaintenance(ctx, c.clientset, source.PvcName, source.PvcNamespace)
+	if status.Code(err) == codes.Unavailable {
+		return c.recordRelocationStatus(ctx, pvc, "waiting: "+status.Convert(err).Message())
+	} else if err != nil {
+		return err
+	}
+
+	// update volume state
+
+	err = common.SetPvcStateTo(ctx, c.clientset, pvc.Name, pvc.Namespace, "relocating")
+	if code := status.Code(err); code == codes.Aborted || code == codes.FailedPrecondition {
+		return c.recordRelocationStatus(ctx, pvc, "waiting: "+status.Convert(err).Message())
+	} else if err != nil {
+		return err
+	}
+
+	klog.InfoS(
+		"Relocating PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name),
+		"backingPvc", klog.KRef(target.PvcNamespace, target.PvcName), "basePath", target.BasePath,
+	)
+
+	// run volume relocation job, which mounts the whole backing volume so that the symlink resolves within it
+
+	pvcUid := common.VolumeUidOf(pvc)
+	imageName := common.GenerateVolumeImageName(pvcUid)
+	relocationJobName := common.GenerateRelocationJobName(pvcUid)
+
+	err = c.runRelocationJob(
+		ctx, pvc, source, relocationJobName, relocationScript, imageName, source.BasePath, target.BasePath,
+	)
+	if err != nil {
+		if idleErr := common.SetPvcStateToIdle(ctx, c.clientset, pvc.Name, pvc.Namespace); idleErr != nil {
+			klog.ErrorS(idleErr, "Failed to return PVC to idle", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+		klog.ErrorS(err, "Failed to relocate PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		return c.recordRelocationStatus(ctx, pvc, "failed: relocation Job failed, see the controller plugin's logs")
+	}
+
+	// The PV's volume attributes still name the previous base path, and can't be changed, so record the new location
+	// on the PV too, for adoptionController to use should the volume be retained and adopted.
+
+	if pvc.Spec.VolumeName != "" {
+		err = common.ApplyPvMetadata(
+			ctx, c.clientset, pvc.Spec.VolumeName, metav1.ObjectMeta{Annotations: backingLocationAnnotations(target)},
+		)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	err = common.DeleteJobSynchronously(ctx, c.clientset, common.GenerateCreationJobName(pvcUid), source.PvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	err = c.completeRelocation(ctx, pvc, request, target)
+	if err != nil {
+		return err
+	}
+
+	recordBackingChainChanges(ctx, c.clientset, source, func(chains common.BackingChains) {
+		delete(chains, imageName)
+	})
+	recordBackingChainChanges(ctx, c.clientset, target, func(chains common.BackingChains) {
+		chains[imageName] = ""
+	})
+
+	// nothing refers to the previous base path anymore, so remove the symlink left there
+
+	err = c.runRelocationJob(
+		ctx, pvc, source, common.GenerateRelocationCleanupJobName(pvcUid), relocationCleanupScript,
+		imageName, source.BasePath,
+	)
+	if err != nil {
+		// harmless, as nothing follows it anymore
+		klog.ErrorS(
+			err, "Failed to remove symlink to relocated image of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name),
+		)
+	}
+
+	return nil
+}
+
+// Moves image $1 from base path $2 to base path $3, and replaces it with a symlink to its new path. Resumes an
+// interrupted relocation.
+var relocationScript = dedent.Dedent(
+	`
+	set -o errexit -o pipefail -o nounset -o xtrace
+
+	source="/var/backing/$2/$1"
+	dest="/var/backing/$3/$1"
+
+	if [[ ! -L "${source}" ]]; then
+	    mkdir -p "${dest%/*}"
+	    rm -f "${dest}.tmp"
+
+	    info="$( qemu-img info -f qcow2 --output=json "${source}" )"
+	    if [[ -n "$( jq -r '.["backing-filename"] // empty' <<< "${info}" )" ]] ||
+	        ! ln "${source}" "${dest}.tmp"; then
+	        qemu-img convert --bitmaps -f qcow2 -O qcow2 "${source}" "${dest}.tmp"
+	    fi
+	    mv -f "${dest}.tmp" "${dest}"
+
+	    ln -sfn "$( realpath --relative-to="${source%/*}" "${dest}" )" "${source}.link"
+	    mv -fT "${source}.link" "${source}"
+	fi
+
+	[[ -f "${dest}" ]]
+	`,
+)
+
+// Removes the symlink that relocationScript left in place of image $1 at base path $2.
+var relocationCleanupScript = dedent.Dedent(
+	`
+	set -o errexit -o pipefail -o nounset -o xtrace
+
+	source="/var/backing/$2/$1"
+	if [[ -L "${source}" ]]; then
+	    rm -f "${source}"
+	fi
+	`,
+)
+
+// Runs a script with the given arguments to completion in a Job that mounts the whole backing volume. The Job is
+// deleted in any case, so that it is run anew if retried.
+func (c *relocationController) runRelocationJob(
+	ctx context.Context,
+	pvc *corev1.PersistentVolumeClaim,
+	source common.BackingLocation,
+	jobName string,
+	script string,
+	args ...string,
+) error {
+	err := common.CreateJob(
+		ctx, c.clientset,
+		common.JobConfig{
+			Name:      jobName,
+			Namespace: source.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "volume-relocation",
+				common.Domain + "/pvc-uid":   string(common.VolumeUidOf(pvc)),
+			},
+			PropagateFrom:  &pvc.ObjectMeta,
+			Image:          c.image,
+			Command:        append([]string{"bash", "-c", script, "bash"}, args...),
+			BackingPvcName: source.PvcName,
+			BackoffLimit:   &relocationJobBackoffLimit,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = common.DeleteJobSynchronously(context.Background(), c.clientset, jobName, source.PvcNamespace)
+	}()
+
+	return common.WaitForJobToSucceedWithin(ctx, c.clientset, jobName, source.PvcNamespace, relocationJobTimeout)
+}
+
+// Points the PVC to the new base path, consumes the request, and sets the volume back to idle.
+func (c *relocationController) completeRelocation(
+	ctx context.Context,
+	pvc *corev1.PersistentVolumeClaim,
+	request string,
+	target common.BackingLocation,
+) error {
+	relocationStatus := fmt.Sprintf("complete: relocated to base path \"%s\"", target.BasePath)
+
+	err := common.UpdatePvcMetadata(
+		ctx, c.clientset, pvc.Name, pvc.Namespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			if pvc.Annotations[common.Domain+"/relocate-to-base-path"] == request {
+				delete(pvc.Annotations, common.Domain+"/relocate-to-base-path")
+			}
+			if pvc.Annotations[common.Domain+"/state"] == "relocating" {
+				// the image no longer has a backing file, so the volume doesn't depend on the snapshot it was
+				// created from, or on the common ancestor it shared with the volume it was cloned from
+				delete(pvc.Labels, common.Domain+"/source-snapshot-uid")
+				delete(pvc.Labels, common.Domain+"/source-pvc-uid")
+				pvc.Annotations[common.Domain+"/state"] = "idle"
+			}
+			for key, value := range backingLocationAnnotations(target) {
+				pvc.Annotations[key] = value
+			}
+			pvc.Annotations[common.Domain+"/relocation-status"] = relocationStatus
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS("Relocation of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "status", relocationStatus)
+
+	return common.EmitEvent(
+		ctx, c.clientset, common.PvcEventObject(pvc),
+		corev1.EventTypeNormal, "VolumeRelocated", "Relocation %s", relocationStatus,
+	)
+}
+
+// Parses the value of a "relocate-to-base-path" annotation into the base path to relocate a volume to, which must be a
+// clean relative path that stays within the backing volume, or empty for its root.
+func parseRelocationRequest(request string) (string, error) {
+	basePath := strings.TrimSuffix(request, "/")
+
+	switch {
+	case basePath == "":
+		return "", nil
+	case path.IsAbs(basePath):
+		return "", fmt.Errorf("base path \"%s\" must be relative to the root of the backing volume", request)
+	case path.Clean(basePath) != basePath || basePath == ".." || strings.HasPrefix(basePath, "../"):
+		return "", fmt.Errorf("base path \"%s\" must be a clean path within the backing volume", request)
+	}
+
+	return basePath, nil
+}
+
+// Records the relocation status on the PVC, and emits an Event if it changed to failed.
+func (c *relocationController) recordRelocationStatus(
+	ctx context.Context, pvc *corev1.PersistentVolumeClaim, relocationStatus string,
+) error {
+	if relocationStatus == pvc.Annotations[common.Domain+"/relocation-status"] {
+		return nil
+	}
+
+	err := common.ApplyPvcMetadata(
+		ctx, c.clientset, pvc.Name, pvc.Namespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/relocation-status": relocationStatus},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS("Relocation of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "status", relocationStatus)
+
+	if !strings.HasPrefix(relocationStatus, "failed") {
+		return nil
+	}
+
+	return common.EmitEvent(
+		ctx, c.clientset, common.PvcEventObject(pvc),
+		corev1.EventTypeWarning, "VolumeRelocationFailed", "Relocation %s", relocationStatus,
+	)
+}
@@ -0,0 +1,32 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import "testing"
+
+func TestParseRelocationRequest(t *testing.T) {
+	tests := []struct {
+		request      string
+		wantBasePath string
+		wantErr      bool
+	}{
+		{"", "", false},
+		{"fast", "fast", false},
+		{"tiers/fast/", "tiers/fast", false},
+		{"/fast", "", true},
+		{"tiers//fast", "", true},
+		{"tiers/./fast", "", true},
+		{"..", "", true},
+		{"../other-pvc", "", true},
+		{"tiers/../../other-pvc", "", true},
+	}
+
+	for _, test := range tests {
+		basePath, err := parseRelocationRequest(test.request)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %v", test.request, err, test.wantErr)
+		} else if basePath != test.wantBasePath {
+			t.Errorf("%q: got base path %q, want %q", test.request, basePath, test.wantBasePath)
+		}
+	}
+}
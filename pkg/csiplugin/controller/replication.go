@@ -0,0 +1,490 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Periodically ships the changes made to volumes with a VolumeReplication object since their last replication to
+// the replication's target.
+//
+// Changes are tracked with persistent dirty bitmaps in the volume's top image, maintained by the qemu-storage-daemon
+// instance that serves the volume. If the volume is staged, the replication Job runs on the node it is staged on and
+// drives the staging qemu-storage-daemon through its QMP socket, so that replication doesn't disrupt the workload.
+// Otherwise, the Job serves the volume itself, and the volume is meanwhile kept in the "replicating" state so that it
+// can't be staged. Each replication creates a new bitmap and copies the clusters marked in the previous one to a new
+// layer in the target, which is stacked on top of the previously replicated layers. If there is no usable previous
+// bitmap, e.g., because the volume was last served by a qemu-storage-daemon instance that didn't terminate gracefully,
+// the whole volume is copied instead. Snapshotting and cloning carry the bitmaps over to the volume's new top image.
+//
+// Volumes staged read-only (whose bitmaps can't be updated) and volumes demoted to replication secondaries aren't
+// replicated.
+type replicationController struct {
+	clientset *common.Clientset
+	image     string
+
+	mutex      sync.Mutex
+	inProgress map[types.UID]context.CancelFunc // by VolumeReplication UID
+}
+
+var errReplicationSecondary = errors.New("volume is a replication secondary")
+
+// Replication Jobs are retried a few times, after which the replication is retried from scratch.
+var replicationJobBackoffLimit int32 = 2
+
+func (c *replicationController) run(stopCh chan struct{}) {
+	c.inProgress = map[types.UID]context.CancelFunc{}
+	wait.Until(c.startDueReplications, 30*time.Second, stopCh)
+}
+
+func (c *replicationController) startDueReplications() {
+	ctx := context.Background() // TODO
+
+	replications, err := common.ListVolumeReplications(ctx, c.clientset)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	c.abortRemovedReplications(replications)
+
+	err = c.releaseAbandonedVolumes(ctx, replications)
+	if err != nil {
+		runtime.HandleError(err)
+	}
+
+	for i := range replications {
+		replication := &replications[i]
+
+		lastSyncTime := replication.Status.LastSyncTime
+		if lastSyncTime != nil && time.Since(lastSyncTime.Time) < replication.Spec.Interval.Duration {
+			continue
+		}
+
+		c.mutex.Lock()
+		_, inProgress := c.inProgress[replication.UID]
+		replicationCtx, cancel := context.WithTimeout(ctx, replication.Spec.TimeoutOrDefault())
+		if !inProgress {
+			c.inProgress[replication.UID] = cancel
+		}
+		c.mutex.Unlock()
+
+		if inProgress {
+			cancel()
+			continue
+		}
+
+		go func() {
+			defer func() {
+				c.mutex.Lock()
+				delete(c.inProgress, replication.UID)
+				c.mutex.Unlock()
+				cancel()
+			}()
+
+			err := c.replicate(replicationCtx, replication)
+
+			if errors.Is(err, errReplicationSecondary) {
+				return
+			} else if err != nil {
+				klog.ErrorS(
+					err, "Failed to replicate PVC", "pvc", klog.KRef(replication.Namespace, replication.Spec.PvcName),
+				)
+				if replication.Status.LastSyncError == err.Error() || errors.Is(err, context.Canceled) {
+					return // avoid needless updates, as we retry often
+				}
+				replication.Status.LastSyncError = err.Error()
+			} else {
+				now := metav1.Now()
+				replication.Status.LastSyncTime = &now
+				replication.Status.LastSyncSequence++
+				replication.Status.LastSyncError = ""
+			}
+
+			err = common.UpdateVolumeReplicationStatus(ctx, c.clientset, replication)
+			if err != nil {
+				runtime.HandleError(err)
+			}
+		}()
+	}
+}
+
+// Cancels replications whose VolumeReplication object no longer exists.
+func (c *replicationController) abortRemovedReplications(replications []common.VolumeReplication) {
+	exists := map[types.UID]bool{}
+	for i := range replications {
+		exists[replications[i].UID] = true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for uid, cancel := range c.inProgress {
+		if !exists[uid] {
+			cancel()
+		}
+	}
+}
+
+// Returns volumes left in the "replicating" state to the "idle" state if they no longer have a VolumeReplication
+// object, e.g., because it was deleted while the controller plugin wasn't running.
+func (c *replicationController) releaseAbandonedVolumes(
+	ctx context.Context,
+	replications []common.VolumeReplication,
+) error {
+	replicated := map[types.NamespacedName]bool{}
+	for i := range replications {
+		replicated[types.NamespacedName{Namespace: replications[i].Namespace, Name: replications[i].Spec.PvcName}] = true
+	}
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		return err
+	}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+
+		if pvc.Annotations[common.Domain+"/state"] != "replicating" ||
+			replicated[types.NamespacedName{Namespace: pvc.Namespace, Name: pvc.Name}] {
+			continue
+		}
+
+		klog.InfoS("Releasing PVC, which is no longer replicated", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+
+		err := c.abortReplication(ctx, pvc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes the volume's replication Job, if any, and returns the volume to the "idle" state.
+func (c *replicationController) abortReplication(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	err := common.DeleteJobSynchronously(
+		ctx, c.clientset,
+		common.GenerateReplicationJobName(common.VolumeUidOf(pvc)), pvc.Annotations[common.Domain+"/backing-pvc-namespace"],
+	)
+	if err != nil {
+		return err
+	}
+
+	return common.SetPvcStateToIdle(ctx, c.clientset, pvc.Name, pvc.Namespace)
+}
+
+func (c *replicationController) replicate(ctx context.Context, replication *common.VolumeReplication) (err error) {
+	pvc, err := c.clientset.CoreV1().PersistentVolumeClaims(replication.Namespace).
+		Get(ctx, replication.Spec.PvcName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if pvc.Labels[common.Domain+"/uid"] == "" {
+		return fmt.Errorf("PVC is not a subprovisioner volume or hasn't been provisioned yet")
+	}
+
+	_, err = common.ConvertState(&pvc.ObjectMeta)
+	if err != nil {
+		return err
+	}
+
+	if common.PvcIsReplicationSecondary(pvc) {
+		return errReplicationSecondary
+	}
+
+	backingPvcName := pvc.Annotations[common.Domain+"/backing-pvc-name"]
+	backingPvcNamespace := pvc.Annotations[common.Domain+"/backing-pvc-namespace"]
+	backingPvcBasePath := pvc.Annotations[common.Domain+"/backing-pvc-base-path"]
+	pvcUid := common.VolumeUidOf(pvc)
+
+	err = common.CheckBackingPvcMaintenance(ctx, c.clientset, backingPvcName, backingPvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	replicationJobName := common.GenerateReplicationJobName(pvcUid)
+
+	// If the volume is staged, we use the qemu-storage-daemon instance that serves it. Otherwise, we keep the volume
+	// from being staged until we're done.
+
+	var nodeName, qmpSocketPath string
+
+	// Raw volumes can't be replicated, staged or not, which must be checked first, as failing to set the state below
+	// is taken to mean that the volume is staged.
+
+	err = common.CheckRawVolumeState(&pvc.ObjectMeta, "replicating")
+	if err != nil {
+		return err
+	}
+
+	err = common.SetPvcStateTo(ctx, c.clientset, pvc.Name, pvc.Namespace, "replicating")
+	if status.Code(err) == codes.FailedPrecondition && pvc.Annotations[common.Domain+"/state"] == "staged" {
+		nodeName, qmpSocketPath, err = c.findWritableStagingNode(ctx, pvc)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		defer func() {
+			if err != nil {
+				// use a new context, as ours may have been canceled or timed out
+				if abortErr := c.abortReplication(context.Background(), pvc); abortErr != nil {
+					runtime.HandleError(abortErr)
+				}
+			}
+		}()
+	}
+
+	klog.InfoS("Replicating PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+
+	replicationScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+
+		uid="$1"
+		target_dir="$2"
+		qmp_socket="$3"  # of the qemu-storage-daemon staging the volume, or empty if it isn't staged
+
+		image="/var/backing/pvc-${uid}.qcow2"
+		delta="/var/backing/replication-${uid}-delta.qcow2"
+		prefix=subprovisioner-replication-  # of the names of our dirty bitmaps
+
+		function qmp() {
+		    /subprovisioner/csi-plugin qmp "${qmp_socket}" "$@"
+		}
+
+		if [[ -n "${qmp_socket}" && ! -S "${qmp_socket}" ]]; then
+		    echo "volume is staged with qemu-nbd, which doesn't support replicating staged volumes" >&2
+		    exit 1
+		fi
+
+		if [[ -z "${qmp_socket}" ]]; then
+		    # Serve the volume ourselves. Bitmaps are only stored in the image when qemu-storage-daemon terminates
+		    # gracefully, so we make sure to stop it properly.
+		    qmp_socket=/tmp/qmp.sock
+		    qemu-storage-daemon \
+		        --blockdev driver=file,node-name=file,filename="${image}" \
+		        --blockdev driver=qcow2,node-name=qcow2,file=file \
+		        --chardev socket,id=qmp,path="${qmp_socket}",server=on,wait=off \
+		        --monitor chardev=qmp \
+		        --daemonize \
+		        --pidfile /tmp/qsd.pid
+		    qsd_pid="$( cat /tmp/qsd.pid )"
+		    trap 'kill "${qsd_pid}"; while kill -0 "${qsd_pid}" 2>/dev/null; do sleep 1; done' EXIT
+		else
+		    # Clean up after previous attempts, which may have left a block job and the target node behind.
+		    if qmp query-jobs | jq -e '.[] | select(.id == "replication")' > /dev/null; then
+		        qmp job-cancel '{"id": "replication"}' || true  # fails if the job already concluded
+		        until qmp query-jobs | jq -e '.[] | select(.id == "replication" and .status == "concluded")' > /dev/null; do
+		            sleep 1
+		        done
+		        qmp job-dismiss '{"id": "replication"}'
+		    fi
+		    if qmp query-named-block-nodes | jq -e '.[] | select(.["node-name"] == "replication-target")' > /dev/null; then
+		        qmp blockdev-del '{"node-name": "replication-target"}'
+		    fi
+		fi
+
+		# Find the last replication point, and whether we have a usable bitmap of the changes made since.
+
+		mkdir -p "${target_dir}"
+
+		last="$(
+		    find "${target_dir}" -maxdepth 1 -regex '.*/[0-9]+\.qcow2' -printf '%f\n' |
+		    sort -n | tail -n 1
+		    )"
+		last="${last%.qcow2}"
+		next="$(( ${last:-0} + 1 ))"
+
+		node="$( qmp query-named-block-nodes | jq -c '.[] | select(.["node-name"] == "qcow2")' )"
+		size="$( jq '.image["virtual-size"]' <<< "${node}" )"
+		bitmaps="$( jq -c '.["dirty-bitmaps"] // []' <<< "${node}" )"
+
+		incremental=false
+		if [[ -n "${last}" ]] && jq -e --arg name "${prefix}${last}" \
+		    '.[] | select(.name == $name and .recording and (.busy | not) and ((.inconsistent // false) | not))' \
+		    <<< "${bitmaps}" > /dev/null; then
+		    incremental=true
+		fi
+
+		# Remove the bitmaps that we won't use, e.g., those left behind by failed attempts or that are inconsistent.
+
+		for bitmap in $( jq -r --arg prefix "${prefix}" '.[].name | select(startswith($prefix))' <<< "${bitmaps}" ); do
+		    if [[ "${incremental}" == false || "${bitmap}" != "${prefix}${last}" ]]; then
+		        qmp block-dirty-bitmap-remove "$( jq -cn --arg name "${bitmap}" '{node: "qcow2", name: $name}' )"
+		    fi
+		done
+
+		# Start tracking changes for the next replication and, at the same point in time, start copying either the
+		# changes tracked since the last replication or the whole volume. Zeroed clusters are recorded as such in the
+		# delta, so they mask the previously replicated layers.
+
+		rm -f "${delta}"
+		qemu-img create -f qcow2 "${delta}" "${size}"
+
+		qmp blockdev-add "$( jq -cn --arg filename "${delta}" \
+		    '{driver: "qcow2", "node-name": "replication-target", file: {driver: "file", filename: $filename}}' )"
+
+		if [[ "${incremental}" == true ]]; then
+		    sync_args="$( jq -cn --arg name "${prefix}${last}" '{sync: "bitmap", bitmap: $name, "bitmap-mode": "never"}' )"
+		else
+		    sync_args='{"sync": "full"}'
+		fi
+
+		qmp transaction "$( jq -cn --arg name "${prefix}${next}" --argjson sync_args "${sync_args}" '{actions: [
+		    {type: "block-dirty-bitmap-add", data: {node: "qcow2", name: $name, persistent: true}},
+		    {type: "blockdev-backup", data: ({
+		        "job-id": "replication", device: "qcow2", target: "replication-target", "auto-dismiss": false
+		        } + $sync_args)}
+		    ]}' )"
+
+		while :; do
+		    job="$( qmp query-jobs | jq -c '.[] | select(.id == "replication")' )"
+		    [[ -n "${job}" ]]  # must not have disappeared
+		    [[ "$( jq -r .status <<< "${job}" )" != concluded ]] || break
+		    sleep 5
+		done
+
+		qmp job-dismiss '{"id": "replication"}'
+		qmp blockdev-del '{"node-name": "replication-target"}'
+
+		if jq -e '.error' <<< "${job}" > /dev/null; then
+		    >&2 echo "copying the volume failed: $( jq -r .error <<< "${job}" )"
+		    qmp block-dirty-bitmap-remove "$( jq -cn --arg name "${prefix}${next}" '{node: "qcow2", name: $name}' )"
+		    exit 1
+		fi
+
+		# Ship the delta to the target.
+
+		cp -f --sparse=always "${delta}" "${target_dir}/${next}.qcow2.tmp"
+		if [[ "${incremental}" == true ]]; then
+		    qemu-img rebase -u -f qcow2 -b "${last}.qcow2" -F qcow2 "${target_dir}/${next}.qcow2.tmp"
+		fi
+		sync -f "${target_dir}/${next}.qcow2.tmp"
+		mv -f "${target_dir}/${next}.qcow2.tmp" "${target_dir}/${next}.qcow2"
+
+		rm -f "${delta}"
+
+		if [[ "${incremental}" == true ]]; then
+		    qmp block-dirty-bitmap-remove "$( jq -cn --arg name "${prefix}${last}" '{node: "qcow2", name: $name}' )"
+		fi
+		`,
+	)
+
+	jobConfig := common.JobConfig{
+		Name:      replicationJobName,
+		Namespace: backingPvcNamespace,
+		Labels: map[string]string{
+			common.Domain + "/component": "volume-replication",
+			common.Domain + "/pvc-uid":   string(pvcUid),
+		},
+		Image: c.image,
+		Command: []string{
+			"bash", "-c", replicationScript, "bash",
+			string(pvcUid), "/var/target/" + replication.Spec.Target.ReplicaDirectory(pvcUid), qmpSocketPath,
+		},
+		BackingPvcName:     backingPvcName,
+		BackingPvcBasePath: backingPvcBasePath,
+		ExtraPvcMounts: []common.PvcMount{
+			{
+				PvcName:   replication.Spec.Target.ClaimName,
+				MountPath: "/var/target",
+				SubPath:   replication.Spec.Target.Path,
+			},
+		},
+		NodeName:      nodeName,
+		BackoffLimit:  &replicationJobBackoffLimit,
+		PropagateFrom: &pvc.ObjectMeta,
+	}
+	if qmpSocketPath != "" {
+		jobConfig.HostPathMounts = []string{filepath.Dir(qmpSocketPath)}
+	}
+
+	// A Job left behind by a previous attempt may be running on another node or with a different configuration.
+	err = common.DeleteJobSynchronously(ctx, c.clientset, replicationJobName, backingPvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	err = common.CreateJob(ctx, c.clientset, jobConfig)
+	if err != nil {
+		return err
+	}
+
+	err = common.WaitForJobToSucceedWithin(
+		ctx, c.clientset, replicationJobName, backingPvcNamespace, replication.Spec.TimeoutOrDefault(),
+	)
+	if err != nil {
+		if deleteErr := common.DeleteJobSynchronously(
+			context.Background(), c.clientset, replicationJobName, backingPvcNamespace,
+		); deleteErr != nil {
+			runtime.HandleError(deleteErr)
+		}
+		return err
+	}
+
+	err = common.DeleteJobSynchronously(ctx, c.clientset, replicationJobName, backingPvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	if qmpSocketPath != "" {
+		return nil
+	}
+
+	return common.SetPvcStateToIdle(ctx, c.clientset, pvc.Name, pvc.Namespace)
+}
+
+// Returns the node that the volume is staged on writable, and the path of the QMP socket of the qemu-storage-daemon
+// staging it there (which depends on the node's kubelet directory). Volumes staged read-only can't be replicated, as
+// the qemu-storage-daemon serving them can't update their bitmaps, but they don't change anyway.
+func (c *replicationController) findWritableStagingNode(
+	ctx context.Context,
+	pvc *corev1.PersistentVolumeClaim,
+) (nodeName string, qmpSocketPath string, err error) {
+	backingPvcNamespace := pvc.Annotations[common.Domain+"/backing-pvc-namespace"]
+	labelSelector := fmt.Sprintf(
+		"%s/component=volume-staging,%s/pvc-uid=%s", common.Domain, common.Domain, common.VolumeUidOf(pvc),
+	)
+
+	replicaSets, err := c.clientset.AppsV1().ReplicaSets(backingPvcNamespace).
+		List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return "", "", err
+	}
+
+	for i := range replicaSets.Items {
+		replicaSet := &replicaSets.Items[i]
+
+		// see NodeStageVolume in the node plugin for the command's layout
+		command := replicaSet.Spec.Template.Spec.Containers[0].Command
+		if len(command) >= 5 && command[3] == "false" {
+			return replicaSet.Labels[common.Domain+"/node-name"], command[4], nil
+		}
+	}
+
+	return "", "", status.Errorf(
+		codes.FailedPrecondition, "volume is staged read-only and will be replicated once it is unstaged",
+	)
+}
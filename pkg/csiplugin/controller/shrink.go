@@ -0,0 +1,260 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Shrinks volumes whose PVCs have the "shrink-to" annotation, which Kubernetes can't request itself since it doesn't
+// allow decreasing a PVC's storage request. Shrinking discards all data past the new end of the volume, so it only
+// ever happens through this explicit annotation, which is removed once the volume has been shrunk. The outcome is
+// recorded in the "shrink-status" annotation.
+//
+// Volumes are only shrunk while not staged, and are kept in the "shrinking" state meanwhile. Since the PVC's storage
+// request can't be lowered, the PVC and PV keep reporting the previous capacity, and the volume's actual capacity is
+// only reflected in the "capacity" annotation. Expanding the volume later works as usual.
+type shrinkController struct {
+	clientset *common.Clientset
+	image     string
+}
+
+// How long shrinking a single volume may take. This is usually quick, as it only discards clusters.
+const shrinkJobTimeout = 30 * time.Minute
+
+var shrinkJobBackoffLimit int32 = 2
+
+func (c *shrinkController) run(stopCh chan struct{}) {
+	wait.Until(c.shrinkAll, time.Minute, stopCh)
+}
+
+func (c *shrinkController) shrinkAll() {
+	ctx := context.Background() // TODO
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if _, ok := pvc.Annotations[common.Domain+"/shrink-to"]; !ok || pvc.DeletionTimestamp != nil {
+			continue
+		}
+
+		err := c.shrink(ctx, pvc)
+		if err != nil {
+			klog.ErrorS(err, "Failed to shrink PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		}
+	}
+}
+
+func (c *shrinkController) shrink(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	request := pvc.Annotations[common.Domain+"/shrink-to"]
+
+	currentCapacity, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to determine current volume capacity")
+	}
+
+	capacity, err := parseShrinkRequest(request, currentCapacity)
+	if err != nil {
+		return c.recordShrinkStatus(ctx, pvc, "failed: "+err.Error())
+	}
+
+	// only shrink volumes whose contents may be discarded
+
+	pv, err := c.clientset.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	switch {
+	case common.VolumeIsImmutable(pvc, pv):
+		return c.recordShrinkStatus(ctx, pvc, "failed: volume is immutable")
+	case pv.Spec.CSI != nil && pv.Spec.CSI.VolumeAttributes["integrity"] == "true":
+		return c.recordShrinkStatus(ctx, pvc, "failed: volumes with integrity protection can't be shrunk")
+	case common.PvcIsReplicationSecondary(pvc):
+		return c.recordShrinkStatus(ctx, pvc, "failed: replication secondaries can't be shrunk")
+	}
+
+	replications, err := common.ListVolumeReplications(ctx, c.clientset)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	for i := range replications {
+		if replications[i].Namespace == pvc.Namespace && replications[i].Spec.PvcName == pvc.Name {
+			return c.recordShrinkStatus(ctx, pvc, "failed: replicated volumes can't be shrunk")
+		}
+	}
+
+	location := common.BackingLocationOf(&pvc.ObjectMeta)
+
+	err = common.CheckBackingPvcMaintenance(ctx, c.clientset, location.PvcName, location.PvcNamespace)
+	if status.Code(err) == codes.Unavailable {
+		return c.recordShrinkStatus(ctx, pvc, "waiting: "+status.Convert(err).Message())
+	} else if err != nil {
+		return err
+	}
+
+	// update volume state
+
+	err = common.SetPvcStateTo(ctx, c.clientset, pvc.Name, pvc.Namespace, "shrinking")
+	if code := status.Code(err); code == codes.Aborted || code == codes.FailedPrecondition {
+		return c.recordShrinkStatus(ctx, pvc, "waiting: "+status.Convert(err).Message())
+	} else if err != nil {
+		return err
+	}
+
+	klog.InfoS("Shrinking PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "bytes", capacity)
+
+	// run volume shrinking job
+
+	shrinkScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+		size="$( qemu-img info -f qcow2 --output=json "$1" | jq '.["virtual-size"]' )"
+		if [ "${size}" -gt "$2" ]; then
+		    qemu-img resize -f qcow2 --shrink "$1" "$2"
+		fi
+		`,
+	)
+
+	pvcUid := common.VolumeUidOf(pvc)
+	shrinkJobName := common.GenerateShrinkJobName(pvcUid)
+
+	err = common.CreateJob(
+		ctx, c.clientset,
+		common.JobConfig{
+			Name:      shrinkJobName,
+			Namespace: location.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "volume-shrinking",
+				common.Domain + "/pvc-uid":   string(pvcUid),
+			},
+			PropagateFrom: &pvc.ObjectMeta,
+			Image:         c.image,
+			Command: []string{
+				"bash", "-c", shrinkScript, "bash",
+				common.GenerateVolumeImagePath(pvcUid), strconv.FormatInt(capacity, 10),
+			},
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			BackoffLimit:       &shrinkJobBackoffLimit,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = common.WaitForJobToSucceedWithin(ctx, c.clientset, shrinkJobName, location.PvcNamespace, shrinkJobTimeout)
+	if err != nil {
+		_ = common.DeleteJobSynchronously(ctx, c.clientset, shrinkJobName, location.PvcNamespace)
+		_ = common.SetPvcStateToIdle(ctx, c.clientset, pvc.Name, pvc.Namespace)
+		klog.ErrorS(err, "Failed to shrink PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name))
+		return c.recordShrinkStatus(ctx, pvc, "failed: shrinking Job failed, see the controller plugin's logs")
+	}
+
+	err = common.DeleteJobSynchronously(ctx, c.clientset, shrinkJobName, location.PvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	// record new capacity, consume the request, and set volume back to idle
+
+	shrinkStatus := fmt.Sprintf("complete: shrunk to %d bytes", capacity)
+
+	err = common.UpdatePvcMetadata(
+		ctx, c.clientset, pvc.Name, pvc.Namespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			if pvc.Annotations[common.Domain+"/shrink-to"] == request {
+				delete(pvc.Annotations, common.Domain+"/shrink-to")
+			}
+			// the shrink supersedes any expansion that the volume wasn't grown to while it was staged
+			delete(pvc.Annotations, common.Domain+"/pending-capacity")
+			pvc.Annotations[common.Domain+"/capacity"] = strconv.FormatInt(capacity, 10)
+			pvc.Annotations[common.Domain+"/shrink-status"] = shrinkStatus
+			pvc.Annotations[common.Domain+"/state"] = "idle"
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS("Shrink of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "status", shrinkStatus)
+
+	return common.EmitEvent(
+		ctx, c.clientset, common.PvcEventObject(pvc),
+		corev1.EventTypeNormal, "VolumeShrunk", "Shrink %s", shrinkStatus,
+	)
+}
+
+// Parses the value of a "shrink-to" annotation into the capacity to shrink a volume to, rounded up to a multiple of
+// 512 bytes like for new volumes. Fails if that wouldn't make the volume smaller.
+func parseShrinkRequest(request string, currentCapacity int64) (int64, error) {
+	quantity, err := resource.ParseQuantity(request)
+	if err != nil {
+		return 0, fmt.Errorf("invalid capacity %q: %w", request, err)
+	}
+
+	capacity := (quantity.Value() + 511) / 512 * 512
+	switch {
+	case capacity <= 0:
+		return 0, fmt.Errorf("capacity must be positive")
+	case capacity >= currentCapacity:
+		return 0, fmt.Errorf(
+			"capacity %d is not less than the current capacity %d; expand volumes through their PVC instead",
+			capacity, currentCapacity,
+		)
+	}
+
+	return capacity, nil
+}
+
+// Records the shrink status on the PVC, and emits an Event if it changed to failed.
+func (c *shrinkController) recordShrinkStatus(
+	ctx context.Context, pvc *corev1.PersistentVolumeClaim, shrinkStatus string,
+) error {
+	if shrinkStatus == pvc.Annotations[common.Domain+"/shrink-status"] {
+		return nil
+	}
+
+	err := common.ApplyPvcMetadata(
+		ctx, c.clientset, pvc.Name, pvc.Namespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/shrink-status": shrinkStatus},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS("Shrink of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name), "status", shrinkStatus)
+
+	if !strings.HasPrefix(shrinkStatus, "failed") {
+		return nil
+	}
+
+	return common.EmitEvent(
+		ctx, c.clientset, common.PvcEventObject(pvc),
+		corev1.EventTypeWarning, "VolumeShrinkFailed", "Shrink %s", shrinkStatus,
+	)
+}
@@ -0,0 +1,30 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import "testing"
+
+func TestParseShrinkRequest(t *testing.T) {
+	tests := []struct {
+		request      string
+		wantCapacity int64
+		wantErr      bool
+	}{
+		{"1Gi", 1 << 30, false},
+		{"1000", 1024, false},
+		{"2Gi", 0, true},
+		{"4Gi", 0, true},
+		{"0", 0, true},
+		{"-1Gi", 0, true},
+		{"lots", 0, true},
+	}
+
+	for _, test := range tests {
+		capacity, err := parseShrinkRequest(test.request, 2<<30)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %v", test.request, err, test.wantErr)
+		} else if capacity != test.wantCapacity {
+			t.Errorf("%q: got capacity %d, want %d", test.request, capacity, test.wantCapacity)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// How long deleting a single image may take, which is mostly spent checking that no other image in the
+// backing volume is backed by it.
+const snapshotCleanupJobTimeout = 30 * time.Minute
+
+var snapshotCleanupJobBackoffLimit int32 = 2
+
+// Deletes the images of deleted snapshots once nothing depends on them anymore.
+//
+// VolumeSnapshots get the "cleanup" finalizer when they are taken. When one is deleted, its image is deleted right
+// away if no other image is backed by it, and the finalizer is removed either way, as the image of a snapshot usually
+// remains the backing file of the snapshotted volume, or of volumes created from the snapshot, for as long as those
+// exist. The images of snapshots that no longer exist are thus also collected periodically, once the volumes and
+// snapshots backed by them are gone, along with the images that cloning leaves behind as the common ancestor of the
+// source and the clone once both are gone, along with the images further down their chains that only they depend on
+// (see unreachableImages()).
+type snapshotCleanupController struct {
+	clientset *common.Clientset
+	image     string
+}
+
+func (c *snapshotCleanupController) run(stopCh chan struct{}) {
+	wait.Until(c.cleanUpAll, time.Minute, stopCh)
+}
+
+func (c *snapshotCleanupController) cleanUpAll() {
+	ctx := context.Background() // TODO
+
+	volumeSnapshots, err := c.clientset.SnapshotV1().VolumeSnapshots(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if k8serrors.IsNotFound(err) {
+		return // volume snapshot CRDs aren't installed, and we can't tell which snapshots exist
+	} else if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	// the uids of the volumes and snapshots that exist, whose images may be in the process of being created
+
+	existing := map[types.UID]bool{}
+
+	for i := range pvcs.Items {
+		existing[common.VolumeUidOf(&pvcs.Items[i])] = true
+	}
+
+	for i := range volumeSnapshots.Items {
+		volumeSnapshot := &volumeSnapshots.Items[i]
+		existing[volumeSnapshot.UID] = true
+
+		if volumeSnapshot.DeletionTimestamp == nil || !hasCleanupFinalizer(&volumeSnapshot.ObjectMeta) {
+			continue
+		}
+
+		err := c.release(ctx, volumeSnapshot)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to clean up VolumeSnapshot",
+				"volumeSnapshot", klog.KRef(volumeSnapshot.Namespace, volumeSnapshot.Name),
+			)
+		}
+	}
+
+	// collect the images of snapshots that were deleted while their images were still in use, and those left behind
+	// by cloning, which is maintenance and thus waits for the maintenance window
+
+	if !common.InMaintenanceWindow(time.Now()) {
+		return
+	}
+
+	chains, err := common.ListBackingChains(ctx, c.clientset)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	for location, locationChains := range chains {
+		// an image that is retained keeps its backing file in use, so that isn't attempted
+		retained := map[string]bool{}
+
+		for _, imageName := range unreachableImages(locationChains, existing) {
+			if !retained[imageName] {
+				deleted, err := c.deleteUnusedImage(ctx, location, imageName)
+				if err != nil {
+					klog.ErrorS(
+						err, "Failed to delete orphaned image", "image", imageName,
+						"backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+					)
+				}
+				if deleted {
+					continue
+				}
+			}
+			retained[locationChains[imageName]] = true
+		}
+	}
+}
+
+// Deletes the image of a VolumeSnapshot being deleted unless it is still in use, and removes the VolumeSnapshot's
+// finalizer.
+func (c *snapshotCleanupController) release(
+	ctx context.Context,
+	volumeSnapshot *volumesnapshotv1.VolumeSnapshot,
+) error {
+	// wait for the inspection controller to stop exposing the snapshot
+	inspectionStatus := volumeSnapshot.Annotations[common.Domain+"/inspection-status"]
+	if inspectionStatus != "" && inspectionStatus != "stopped" {
+		return nil
+	}
+
+	deleted, err := c.deleteUnusedImage(
+		ctx, common.BackingLocationOf(&volumeSnapshot.ObjectMeta),
+		common.GenerateSnapshotImageName(volumeSnapshot.UID),
+	)
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		klog.V(2).InfoS(
+			"Retaining image of VolumeSnapshot until nothing depends on it",
+			"volumeSnapshot", klog.KRef(volumeSnapshot.Namespace, volumeSnapshot.Name),
+		)
+	}
+
+	return common.UpdateVolumeSnapshotMetadata(
+		ctx, c.clientset, volumeSnapshot.Name, volumeSnapshot.Namespace,
+		func(volumeSnapshot *volumesnapshotv1.VolumeSnapshot) error {
+			finalizers := volumeSnapshot.Finalizers
+			for i, finalizer := range finalizers {
+				if finalizer == common.Domain+"/cleanup" {
+					volumeSnapshot.Finalizers = append(finalizers[:i], finalizers[i+1:]...)
+					break
+				}
+			}
+			return nil
+		},
+	)
+}
+
+// Deletes the given image, unless it is the image of a snapshot that a volume was created from, or another image in the
+// backing volume is backed by it. Returns whether the image is gone.
+func (c *snapshotCleanupController) deleteUnusedImage(
+	ctx context.Context,
+	location common.BackingLocation,
+	imageName string,
+) (bool, error) {
+	// volumes created from a snapshot are recorded before their images are, so this covers ones being created
+
+	if volumeSnapshotUid, ok := snapshotUidOfImage(imageName); ok {
+		dependents, err := common.ListSnapshotDependents(ctx, c.clientset, volumeSnapshotUid)
+		if err != nil || len(dependents) > 0 {
+			return false, err
+		}
+	}
+
+	err := common.CheckBackingPvcMaintenance(ctx, c.clientset, location.PvcName, location.PvcNamespace)
+	if err != nil {
+		return false, err
+	}
+
+	// The recorded backing chains may be out of date, so the Job checks every image in the backing volume. Images
+	// may be in use, hence --force-share. Raw images have no backing files, and aren't opened so that no forged qcow2
+	// header in them is taken for real.
+
+	rawImageNames, err := common.ListRawImageNames(ctx, c.clientset, location)
+	if err != nil {
+		return false, err
+	}
+
+	cleanupScript := common.ImageFormatFunction + dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+		shopt -s nullglob
+
+		raw_image_names="$2"
+		cd /var/backing
+
+		for image in *.qcow2; do
+		    [[ "${image}" != "$1" ]] || continue
+		    [[ "$( image_format "${image}" )" != raw ]] || continue
+		    info="$( qemu-img info -f qcow2 --force-share --output=json "${image}" )" ||
+		        { has_qcow2_magic "${image}" && exit 1; info="{}"; }
+		    if [[ "$( jq -r '.["backing-filename"] // empty' <<< "${info}" )" == "$1" ]]; then
+		        echo "in-use ${image}"
+		        exit 0
+		    fi
+		done
+
+		rm -f "$1"
+		echo deleted
+		`,
+	)
+
+	jobName := common.GenerateImageCleanupJobName(imageName)
+
+	err = common.CreateJob(
+		ctx, c.clientset,
+		common.JobConfig{
+			Name:      jobName,
+			Namespace: location.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "image-cleanup",
+			},
+			Image: c.image,
+			Command: []string{
+				"bash", "-c", cleanupScript, "bash", imageName, common.RawImageNamesArg(rawImageNames),
+			},
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			BackoffLimit:       &snapshotCleanupJobBackoffLimit,
+			Maintenance:        true,
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	err = common.WaitForJobToSucceedWithin(ctx, c.clientset, jobName, location.PvcNamespace, snapshotCleanupJobTimeout)
+	if err != nil {
+		_ = common.DeleteJobSynchronously(ctx, c.clientset, jobName, location.PvcNamespace)
+		return false, err
+	}
+
+	logs, err := common.GetJobLogs(ctx, c.clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return false, err
+	}
+
+	err = common.DeleteJobSynchronously(ctx, c.clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := parseSnapshotCleanupOutput(string(logs))
+	if err != nil {
+		return false, fmt.Errorf("job %s: %w", jobName, err)
+	}
+
+	if deleted {
+		klog.InfoS(
+			"Deleted image", "image", imageName, "backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+		)
+
+		recordBackingChainChanges(ctx, c.clientset, location, func(chains common.BackingChains) {
+			delete(chains, imageName)
+		})
+
+		err = common.EmitBackingPvcEvent(
+			ctx, c.clientset, location.PvcName, location.PvcNamespace, corev1.EventTypeNormal, "ImageDeleted",
+			"Deleted image %s in base path \"%s\", which nothing depended on anymore", imageName, location.BasePath,
+		)
+		if err != nil {
+			klog.ErrorS(err, "Failed to emit event for deleted image", "image", imageName)
+		}
+	}
+
+	return deleted, nil
+}
+
+// Parses the output of the snapshot cleanup Job into whether it deleted the image.
+func parseSnapshotCleanupOutput(logs string) (bool, error) {
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "deleted":
+			return true, nil
+		case strings.HasPrefix(line, "in-use "):
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("didn't report whether the image was deleted")
+}
+
+// Returns the images in the given backing chains that can no longer be reached from any image that must be kept, in
+// the order in which they can be deleted, i.e., every image before its backing file, and otherwise sorted.
+//
+// Images must be kept if they belong to volumes, which are deleted along with their volumes, to snapshots that still
+// exist, or to clones whose source or clone volume still exists, and so must their backing files, all the way down
+// their chains. Images whose owners can't be told from their names, e.g., copies of images served over HTTPS, are
+// always kept. Whatever is left belongs to deleted snapshots or clones and is only backing other such images, if any,
+// so that a chain of them can be collected in one go rather than one image at a time.
+func unreachableImages(chains common.BackingChains, existing map[types.UID]bool) []string {
+	reachable := map[string]bool{}
+	for image := range chains {
+		if uids, ok := imageOwnerUids(image); ok && !existing[uids[0]] && !existing[uids[len(uids)-1]] {
+			continue
+		}
+		for name := image; name != "" && !reachable[name]; name = chains[name] {
+			reachable[name] = true
+		}
+	}
+
+	// the number of unreachable images that each unreachable image is the backing file of
+	dependents := map[string]int{}
+	for image := range chains {
+		if !reachable[image] {
+			dependents[image] = 0
+		}
+	}
+	for image := range dependents {
+		if _, ok := dependents[chains[image]]; ok {
+			dependents[chains[image]]++
+		}
+	}
+
+	// Repeatedly pick the images that no remaining image depends on. Images in a cycle, which can only be recorded if
+	// the records are broken, are never picked.
+	var unreachable []string
+	for {
+		var next []string
+		for image, count := range dependents {
+			if count == 0 {
+				next = append(next, image)
+			}
+		}
+		if len(next) == 0 {
+			return unreachable
+		}
+
+		sort.Strings(next)
+		for _, image := range next {
+			delete(dependents, image)
+			if _, ok := dependents[chains[image]]; ok {
+				dependents[chains[image]]--
+			}
+		}
+		unreachable = append(unreachable, next...)
+	}
+}
+
+// Returns the uids of the VolumeSnapshot that the given image belongs to, or of the source and clone volumes whose
+// common ancestor it is, if any. Volume images are never orphaned, as they are deleted along with their volumes.
+func imageOwnerUids(imageName string) ([]types.UID, bool) {
+	if uid, ok := snapshotUidOfImage(imageName); ok {
+		return []types.UID{uid}, true
+	}
+
+	if source, clone, ok := common.ParseCloneImageName(imageName); ok {
+		return []types.UID{source, clone}, true
+	}
+
+	return nil, false
+}
+
+// Returns the uid of the VolumeSnapshot that the given image belongs to, if any (see GenerateSnapshotImageName).
+func snapshotUidOfImage(imageName string) (types.UID, bool) {
+	if !strings.HasPrefix(imageName, "snapshot-") || !strings.HasSuffix(imageName, ".qcow2") {
+		return "", false
+	}
+	return types.UID(strings.TrimSuffix(strings.TrimPrefix(imageName, "snapshot-"), ".qcow2")), true
+}
+
+func hasCleanupFinalizer(meta *metav1.ObjectMeta) bool {
+	for _, finalizer := range meta.Finalizers {
+		if finalizer == common.Domain+"/cleanup" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestUnreachableImages(t *testing.T) {
+	chains := common.BackingChains{
+		"pvc-a.qcow2":         "snapshot-s2.qcow2",
+		"snapshot-s2.qcow2":   "snapshot-s1.qcow2",
+		"snapshot-s1.qcow2":   "",
+		"pvc-b.qcow2":         "snapshot-s3.qcow2",
+		"snapshot-s3.qcow2":   "",
+		"snapshot-s4.qcow2":   "",
+		"snapshot-s5.qcow2":   "",
+		"image.qcow2":         "",
+		"cloned-a-to-c.qcow2": "",
+		"cloned-d-to-e.qcow2": "",
+		"snapshot-s8.qcow2":   "snapshot-s7.qcow2",
+		"snapshot-s7.qcow2":   "snapshot-s6.qcow2",
+		"cloned-f-to-g.qcow2": "snapshot-s6.qcow2",
+		"snapshot-s6.qcow2":   "",
+	}
+
+	tests := []struct {
+		existing map[types.UID]bool
+		want     []string
+	}{
+		{
+			map[types.UID]bool{
+				"s1": true, "s2": true, "s3": true, "s4": true, "s5": true, "s8": true, "a": true, "e": true, "f": true,
+			},
+			nil,
+		},
+		{
+			map[types.UID]bool{"s5": true, "s7": true, "c": true},
+			[]string{"cloned-d-to-e.qcow2", "cloned-f-to-g.qcow2", "snapshot-s4.qcow2", "snapshot-s8.qcow2"},
+		},
+		{
+			map[types.UID]bool{},
+			[]string{
+				"cloned-a-to-c.qcow2", "cloned-d-to-e.qcow2", "cloned-f-to-g.qcow2", "snapshot-s4.qcow2",
+				"snapshot-s5.qcow2", "snapshot-s8.qcow2", "snapshot-s7.qcow2", "snapshot-s6.qcow2",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := unreachableImages(chains, test.existing)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.existing, got, test.want)
+		}
+	}
+}
+
+func TestParseSnapshotCleanupOutput(t *testing.T) {
+	tests := []struct {
+		logs        string
+		wantDeleted bool
+		wantErr     bool
+	}{
+		{"+ rm -f /var/backing/snapshot-s1.qcow2\ndeleted\n", true, false},
+		{"+ echo 'in-use pvc-a.qcow2'\nin-use pvc-a.qcow2\n", false, false},
+		{"+ qemu-img info --force-share --output=json /var/backing/pvc-a.qcow2\n", false, true},
+	}
+
+	for _, test := range tests {
+		deleted, err := parseSnapshotCleanupOutput(test.logs)
+		if deleted != test.wantDeleted || (err != nil) != test.wantErr {
+			t.Errorf("%q: got %v, %v, want %v, error %v", test.logs, deleted, err, test.wantDeleted, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"bufio"
+	"context"
+	"strconv"
+	"strings"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Determines the space that a new snapshot's image takes up in the backing volume from the logs of the Job that took
+// the snapshot, and records it in the "allocated-size" annotation of the VolumeSnapshot. This is what CreateSnapshot
+// reports as the snapshot's size, which becomes its restore size, since volumes created from a snapshot are made at
+// least as big as its source volume anyway. Falls back to the source volume's capacity if the logs are unavailable.
+func (s *ControllerServer) measureSnapshotAllocatedSize(
+	ctx context.Context,
+	volumeSnapshotName string,
+	volumeSnapshotNamespace string,
+	jobName string,
+	jobNamespace string,
+	capacity int64,
+) int64 {
+	logs, err := common.GetJobLogs(ctx, s.Clientset, jobName, jobNamespace)
+	if err != nil {
+		klog.ErrorS(err, "Failed to get logs of Job", "job", klog.KRef(jobNamespace, jobName))
+		return capacity
+	}
+
+	allocatedSize, ok := parseSnapshotAllocatedSize(string(logs))
+	if !ok {
+		klog.ErrorS(
+			nil, "Failed to determine allocated size of VolumeSnapshot",
+			"volumeSnapshot", klog.KRef(volumeSnapshotNamespace, volumeSnapshotName),
+		)
+		return capacity
+	}
+
+	err = common.ApplyVolumeSnapshotMetadata(
+		ctx, s.Clientset, volumeSnapshotName, volumeSnapshotNamespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/allocated-size": strconv.FormatInt(allocatedSize, 10)},
+		},
+	)
+	if err != nil {
+		klog.ErrorS(
+			err, "Failed to record allocated size of VolumeSnapshot",
+			"volumeSnapshot", klog.KRef(volumeSnapshotNamespace, volumeSnapshotName),
+		)
+	}
+
+	return allocatedSize
+}
+
+// Returns the allocated size that measureSnapshotAllocatedSize() recorded on a VolumeSnapshot, e.g., when its creation
+// is retried after the Job already took the snapshot, or the source volume's capacity if none was recorded.
+func recordedSnapshotAllocatedSize(volumeSnapshotMeta *metav1.ObjectMeta, capacity int64) int64 {
+	allocatedSize, err := strconv.ParseInt(volumeSnapshotMeta.Annotations[common.Domain+"/allocated-size"], 10, 64)
+	if err != nil || allocatedSize < 0 {
+		return capacity
+	}
+	return allocatedSize
+}
+
+// Parses the "allocated-size <bytes>" line output by the snapshotting Job.
+func parseSnapshotAllocatedSize(logs string) (int64, bool) {
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "allocated-size ") {
+			size, err := strconv.ParseInt(strings.TrimPrefix(line, "allocated-size "), 10, 64)
+			return size, err == nil && size >= 0
+		}
+	}
+	return 0, false
+}
+
+// Updates the "allocated-size" annotation of the given VolumeSnapshots whose images are in a backing location, given
+// what inspecting the images there found out about them, since their allocated sizes change as snapshots are moved to
+// other backing volumes.
+func recordSnapshotAllocatedSizes(
+	ctx context.Context,
+	clientset *common.Clientset,
+	volumeSnapshots []volumesnapshotv1.VolumeSnapshot,
+	stats map[string]common.ImageStats,
+) {
+	for i := range volumeSnapshots {
+		volumeSnapshot := &volumeSnapshots[i]
+
+		imageName := common.GenerateSnapshotImageName(types.UID(volumeSnapshot.Labels[common.Domain+"/uid"]))
+		imageStats, ok := stats[imageName]
+		size := imageStats.AllocatedBytes
+		if !ok || size < 0 {
+			continue
+		}
+		if volumeSnapshot.Annotations[common.Domain+"/allocated-size"] == strconv.FormatInt(size, 10) {
+			continue
+		}
+
+		err := common.ApplyVolumeSnapshotMetadata(
+			ctx, clientset, volumeSnapshot.Name, volumeSnapshot.Namespace,
+			metav1.ObjectMeta{
+				Annotations: map[string]string{common.Domain + "/allocated-size": strconv.FormatInt(size, 10)},
+			},
+		)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to record allocated size of VolumeSnapshot",
+				"volumeSnapshot", klog.KRef(volumeSnapshot.Namespace, volumeSnapshot.Name),
+			)
+		}
+	}
+}
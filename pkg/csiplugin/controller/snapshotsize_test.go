@@ -0,0 +1,41 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"testing"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseSnapshotAllocatedSize(t *testing.T) {
+	tests := []struct {
+		logs     string
+		wantSize int64
+		wantOk   bool
+	}{
+		{"+ qemu-img commit\nallocated-size 196616\n", 196616, true},
+		{"allocated-size 0", 0, true},
+		{"allocated-size null\n", 0, false},
+		{"allocated-size -1\n", 0, false},
+		{"+ echo 'allocated-size 5'\n", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		size, ok := parseSnapshotAllocatedSize(test.logs)
+		if ok != test.wantOk || (ok && size != test.wantSize) {
+			t.Errorf("%q: got (%d, %v), want (%d, %v)", test.logs, size, ok, test.wantSize, test.wantOk)
+		}
+	}
+}
+
+func TestRecordedSnapshotAllocatedSize(t *testing.T) {
+	for annotation, want := range map[string]int64{"196616": 196616, "0": 0, "": 1024, "-1": 1024, "null": 1024} {
+		meta := &metav1.ObjectMeta{Annotations: map[string]string{common.Domain + "/allocated-size": annotation}}
+		if got := recordedSnapshotAllocatedSize(meta, 1024); got != want {
+			t.Errorf("%q: got %d, want %d", annotation, got, want)
+		}
+	}
+}
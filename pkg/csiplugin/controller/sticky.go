@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// How long discarding the sticky image of a PVC may take.
+const stickyDiscardJobTimeout = 10 * time.Minute
+
+var stickyDiscardJobBackoffLimit int32 = 2
+
+// Keeps the image of a deleted volume as the sticky image of its PVC (see common.GenerateStickyImageName), replacing any
+// older sticky image of a PVC with the same namespace and name, and removes any replication delta that an interrupted
+// replication left behind. Does nothing if the image is already gone, e.g., because it was kept in a previous attempt.
+var volumeStickScript = dedent.Dedent(
+	`
+	set -o errexit -o pipefail -o nounset -o xtrace
+	shopt -s nullglob
+	cd /var/backing
+	rm -f replication-"$2"-*.qcow2
+	if [[ -e "$1" ]]; then
+	    for old in $4; do
+	        [[ "${old}" == "$3" ]] || rm -f "${old}"
+	    done
+	    mv -f "$1" "$3"
+	fi
+	`,
+)
+
+// Returns the name under which the image of the volume of the given PVC being deleted is to be kept for a PVC with the
+// same namespace and name to reattach, or "" if it is to be removed: if its StorageClass doesn't have the "stickyData"
+// parameter set to "true", or the volume is mirrored.
+func stickyImageNameOf(
+	ctx context.Context,
+	clientset *common.Clientset,
+	pvc *corev1.PersistentVolumeClaim,
+) (string, error) {
+	if _, mirrored := common.MirrorLocationOf(&pvc.ObjectMeta); mirrored || pvc.Spec.StorageClassName == nil {
+		return "", nil
+	}
+
+	capacity, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64)
+	if err != nil || capacity <= 0 {
+		return "", nil // never fully created
+	}
+
+	storageClass, err := clientset.StorageV1().StorageClasses().
+		Get(ctx, *pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if storageClass.Parameters["stickyData"] != "true" {
+		return "", nil
+	}
+
+	return common.GenerateStickyImageName(pvc.Namespace, pvc.Name, capacity), nil
+}
+
+// Returns the sticky image that a deleted volume of a PVC with the same namespace and name as the given one left behind
+// in the given backing location, and the capacity of that volume, or "" if there is none.
+func (s *ControllerServer) findStickyImage(
+	ctx context.Context,
+	location common.BackingLocation,
+	pvc *corev1.PersistentVolumeClaim,
+) (string, int64, error) {
+	chains, err := common.ListBackingChains(ctx, s.Clientset)
+	if err != nil {
+		return "", 0, err
+	}
+
+	for imageName := range chains[location] {
+		if capacity, ok := common.ParseStickyImageName(imageName, pvc.Namespace, pvc.Name); ok {
+			return imageName, capacity, nil
+		}
+	}
+
+	return "", 0, nil
+}
+
+// Makes the given sticky image the image of the new volume of the given PVC, growing it to the given capacity if it is
+// smaller.
+func (s *ControllerServer) createVolumeFromStickyImage(
+	ctx context.Context,
+	location common.BackingLocation,
+	pvc *corev1.PersistentVolumeClaim,
+	capacity int64,
+	stickyImageName string,
+) error {
+	creationJobName := common.GenerateCreationJobName(pvc.UID)
+	volumeImageName := common.GenerateVolumeImageName(pvc.UID)
+
+	script := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+		cd /var/backing
+		if [[ -e "$2" ]]; then
+		    size="$( qemu-img info -f qcow2 --output=json "$2" | jq -r '.["virtual-size"]' )"
+		    if (( size < $3 )); then
+		        qemu-img resize -f qcow2 "$2" "$3"
+		    fi
+		    mv -n "$2" "$1"
+		fi
+		[[ -e "$1" ]]
+		`,
+	)
+
+	err := s.startJob(
+		ctx, creationJobEvents(pvc),
+		common.JobConfig{
+			Name:      creationJobName,
+			Namespace: location.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "volume-creation",
+				common.Domain + "/pvc-uid":   string(pvc.UID),
+			},
+			PropagateFrom: &pvc.ObjectMeta,
+			Image:         s.Image,
+			Command: []string{
+				"bash", "-c", script, "bash", volumeImageName, stickyImageName, strconv.FormatInt(capacity, 10),
+			},
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			NodeName:           selectedNodeOf(pvc),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = s.waitForCreationJob(ctx, creationJobEvents(pvc), creationJobName, location.PvcName, location.PvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	recordBackingChainChanges(ctx, s.Clientset, location, func(chains common.BackingChains) {
+		if backing, ok := chains[stickyImageName]; ok {
+			chains[volumeImageName] = backing
+			delete(chains, stickyImageName)
+		}
+	})
+
+	// like for empty volumes, the creation Job is kept around until the volume is deleted
+
+	return common.EmitEvent(
+		ctx, s.Clientset, common.PvcEventObject(pvc), corev1.EventTypeNormal, "DataReattached",
+		"Reattached the data of the previous PVC with the same name",
+	)
+}
+
+// Removes the given sticky image, as confirmed by the PVC that would have reattached it.
+func (s *ControllerServer) discardStickyImage(
+	ctx context.Context,
+	location common.BackingLocation,
+	stickyImageName string,
+) error {
+	jobName := common.GenerateImageCleanupJobName(stickyImageName)
+
+	err := common.CreateJob(
+		ctx, s.Clientset,
+		common.JobConfig{
+			Name:      jobName,
+			Namespace: location.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "image-cleanup",
+			},
+			Image:              s.Image,
+			Command:            []string{"rm", "-f", "/var/backing/" + stickyImageName},
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			BackoffLimit:       &stickyDiscardJobBackoffLimit,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = common.WaitForJobToSucceedWithin(ctx, s.Clientset, jobName, location.PvcNamespace, stickyDiscardJobTimeout)
+	if err != nil {
+		_ = common.DeleteJobSynchronously(ctx, s.Clientset, jobName, location.PvcNamespace)
+		return err
+	}
+
+	err = common.DeleteJobSynchronously(ctx, s.Clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	recordBackingChainChanges(ctx, s.Clientset, location, func(chains common.BackingChains) {
+		delete(chains, stickyImageName)
+	})
+
+	return nil
+}
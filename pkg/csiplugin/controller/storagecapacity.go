@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reports how large a volume of a StorageClass can be, which the external-provisioner publishes as
+// CSIStorageCapacity objects for the scheduler to place pods whose volumes are yet to be provisioned where they fit.
+// Volumes are thinly provisioned, so this is the free space in the class' backing volume or, if the class limits
+// overcommitment, what its overcommit ratio leaves. Backing volumes that don't accept new volumes, e.g., because they
+// are under maintenance, have no capacity. The usage of a backing volume is measured by a Job, and measurements are
+// reused for a while (see backingUsageCache).
+//
+// Zonal StorageClasses report the capacity of the backing volume of the given zone, or the largest one if none is
+// given. Mirrored volumes must fit in both backing volumes.
+func (s *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	backingPvcNamespace := req.Parameters["backingClaimNamespace"]
+	if backingPvcNamespace == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing/empty parameter \"backingClaimNamespace\"")
+	}
+	basePath := req.Parameters["basePath"]
+
+	zonalBackingClaims, err := parseZonalBackingClaims(req.Parameters["zonalBackingClaims"], backingPvcNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	overcommitRatio, err := parseOvercommitRatio(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []common.BackingLocation
+	switch zone := req.AccessibleTopology.GetSegments()[common.ZoneTopologyKey]; {
+	case zonalBackingClaims == nil && req.Parameters["backingClaimName"] == "":
+		return nil, status.Errorf(codes.InvalidArgument, "missing/empty parameter \"backingClaimName\"")
+	case zonalBackingClaims == nil:
+		locations = append(locations, common.BackingLocation{
+			PvcName: req.Parameters["backingClaimName"], PvcNamespace: backingPvcNamespace, BasePath: basePath,
+		})
+	default:
+		for _, claim := range zonalBackingClaims {
+			if zone == "" || claim.zone == zone {
+				locations = append(locations, common.BackingLocation{
+					PvcName: claim.name, PvcNamespace: claim.namespace, BasePath: basePath,
+				})
+			}
+		}
+	}
+
+	var capacity int64
+	for _, location := range locations {
+		available, err := s.availableCapacity(ctx, location, overcommitRatio)
+		if err != nil {
+			return nil, err
+		}
+
+		if mirrorBackingPvcName := req.Parameters["mirrorBackingClaimName"]; mirrorBackingPvcName != "" {
+			mirror := location
+			mirror.PvcName = mirrorBackingPvcName
+
+			mirrorAvailable, err := s.availableCapacity(ctx, mirror, overcommitRatio)
+			if err != nil {
+				return nil, err
+			}
+			if mirrorAvailable < available {
+				available = mirrorAvailable
+			}
+		}
+
+		if available > capacity {
+			capacity = available
+		}
+	}
+
+	resp := &csi.GetCapacityResponse{
+		AvailableCapacity: capacity,
+		MaximumVolumeSize: &wrappers.Int64Value{Value: capacity},
+	}
+	return resp, nil
+}
+
+// Returns how large a new volume in the given backing location can be under the given overcommit ratio, if any.
+func (s *ControllerServer) availableCapacity(
+	ctx context.Context,
+	location common.BackingLocation,
+	overcommitRatio float64,
+) (int64, error) {
+	err := common.CheckBackingPvcAcceptsVolumes(ctx, s.Clientset, location.PvcName, location.PvcNamespace)
+	if err == nil {
+		err = s.backingStores.check(location.PvcNamespace+"/"+location.PvcName, time.Now())
+	}
+	if _, ok := status.FromError(err); err != nil && ok {
+		return 0, nil // the backing volume doesn't accept new volumes for now
+	} else if err != nil {
+		return 0, err
+	}
+
+	usage, err := s.backingUsage.get(location, time.Now(), func() (common.BackingUsage, error) {
+		return common.MeasureBackingUsage(ctx, s.Clientset, s.Image, location)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var provisioned int64
+	if overcommitRatio > 0 {
+		provisioned, err = s.provisionedCapacity(ctx, location, "")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return capacityLeft(usage, provisioned, overcommitRatio), nil
+}
+
+// Returns how large a new volume can be in a backing volume with the given usage, in which volumes with the given total
+// capacity were already provisioned, under the given overcommit ratio, or regardless of overcommitment if it is 0. This
+// is the largest volume that checkOvercommit() lets through.
+func capacityLeft(usage common.BackingUsage, provisioned int64, overcommitRatio float64) int64 {
+	if usage.Used >= usage.Size {
+		return 0
+	}
+
+	left := usage.Size - usage.Used
+	if overcommitRatio > 0 {
+		left = int64(overcommitRatio*float64(usage.Size)) - provisioned
+	}
+
+	if left < 0 {
+		return 0
+	}
+	return left
+}
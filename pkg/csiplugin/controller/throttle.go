@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"sync"
+)
+
+// Limits the number of concurrent operations per key (e.g., per volume), making further operations wait for their
+// turn in the order they arrived. The zero value is ready to use.
+type keyedSemaphore struct {
+	mutex   sync.Mutex
+	held    map[string]int
+	waiters map[string][]chan struct{}
+}
+
+// Waits until fewer than limit operations with the given key are running, or the context is done. Must be paired with
+// a call to release() if it succeeds. Values of limit less than 1 are treated as 1.
+func (s *keyedSemaphore) acquire(ctx context.Context, key string, limit int) error {
+	s.mutex.Lock()
+
+	if s.held == nil {
+		s.held = map[string]int{}
+		s.waiters = map[string][]chan struct{}{}
+	}
+
+	if limit < 1 {
+		limit = 1
+	}
+
+	if s.held[key] < limit && len(s.waiters[key]) == 0 {
+		s.held[key]++
+		s.mutex.Unlock()
+		return nil
+	}
+
+	ch := make(chan struct{})
+	s.waiters[key] = append(s.waiters[key], ch)
+	s.mutex.Unlock()
+
+	select {
+	case <-ch:
+		return nil // release() handed its slot over to us
+	case <-ctx.Done():
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		for i, waiter := range s.waiters[key] {
+			if waiter == ch {
+				s.waiters[key] = append(s.waiters[key][:i], s.waiters[key][i+1:]...)
+				if len(s.waiters[key]) == 0 {
+					delete(s.waiters, key)
+				}
+				return ctx.Err()
+			}
+		}
+
+		// release() handed its slot over to us in the meantime, so pass it on
+		s.releaseLocked(key)
+		return ctx.Err()
+	}
+}
+
+// Like acquire(), but returns false instead of waiting if limit operations with the given key are already running or
+// waiting to run.
+func (s *keyedSemaphore) tryAcquire(key string, limit int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.held == nil {
+		s.held = map[string]int{}
+		s.waiters = map[string][]chan struct{}{}
+	}
+
+	if limit < 1 {
+		limit = 1
+	}
+
+	if s.held[key] >= limit || len(s.waiters[key]) > 0 {
+		return false
+	}
+
+	s.held[key]++
+	return true
+}
+
+// The number of operations with the given key that are running.
+func (s *keyedSemaphore) count(key string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.held[key]
+}
+
+func (s *keyedSemaphore) release(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.releaseLocked(key)
+}
+
+func (s *keyedSemaphore) releaseLocked(key string) {
+	if waiters := s.waiters[key]; len(waiters) > 0 {
+		close(waiters[0])
+		s.waiters[key] = waiters[1:]
+		if len(s.waiters[key]) == 0 {
+			delete(s.waiters, key)
+		}
+		return
+	}
+
+	s.held[key]--
+	if s.held[key] == 0 {
+		delete(s.held, key)
+	}
+}
@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Whether acquire() is still waiting after a short while.
+func acquireBlocks(s *keyedSemaphore, key string, limit int) (blocked bool, done <-chan error) {
+	result := make(chan error, 1)
+	go func() { result <- s.acquire(context.Background(), key, limit) }()
+
+	select {
+	case err := <-result:
+		result <- err
+		return false, result
+	case <-time.After(20 * time.Millisecond):
+		return true, result
+	}
+}
+
+func TestKeyedSemaphoreLimitsPerKey(t *testing.T) {
+	ctx := context.Background()
+	var s keyedSemaphore
+
+	for i := 0; i < 2; i++ {
+		if err := s.acquire(ctx, "a", 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// other keys are independent
+
+	if err := s.acquire(ctx, "b", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked, done := acquireBlocks(&s, "a", 2)
+	if !blocked {
+		t.Fatal("acquired more than limit")
+	}
+
+	s.release("a")
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	s.release("a")
+	s.release("a")
+	s.release("b")
+
+	if len(s.held) != 0 || len(s.waiters) != 0 {
+		t.Errorf("state not cleaned up: held %v, waiters %v", s.held, s.waiters)
+	}
+}
+
+func TestKeyedSemaphoreTreatsLimitBelowOneAsOne(t *testing.T) {
+	var s keyedSemaphore
+
+	if err := s.acquire(context.Background(), "a", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked, done := acquireBlocks(&s, "a", 0)
+	if !blocked {
+		t.Fatal("acquired more than one")
+	}
+
+	s.release("a")
+	<-done
+	s.release("a")
+}
+
+func TestKeyedSemaphoreIsFifo(t *testing.T) {
+	ctx := context.Background()
+	var s keyedSemaphore
+
+	if err := s.acquire(ctx, "a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		blocked, done := acquireBlocks(&s, "a", 1)
+		if !blocked {
+			t.Fatal("acquired more than limit")
+		}
+		go func() {
+			if err := <-done; err == nil {
+				order <- i
+				s.release("a")
+			}
+		}()
+	}
+
+	s.release("a")
+
+	for want := 0; want < 3; want++ {
+		if got := <-order; got != want {
+			t.Fatalf("waiter %d acquired in position %d", got, want)
+		}
+	}
+}
+
+func TestKeyedSemaphoreCancellation(t *testing.T) {
+	var s keyedSemaphore
+
+	if err := s.acquire(context.Background(), "a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- s.acquire(ctx, "a", 1) }()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	// the canceled waiter must not take the slot
+
+	s.release("a")
+
+	if err := s.acquire(context.Background(), "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	s.release("a")
+
+	if len(s.held) != 0 || len(s.waiters) != 0 {
+		t.Errorf("state not cleaned up: held %v, waiters %v", s.held, s.waiters)
+	}
+}
+
+func TestKeyedSemaphoreTryAcquire(t *testing.T) {
+	var s keyedSemaphore
+
+	if !s.tryAcquire("a", 2) || !s.tryAcquire("a", 2) {
+		t.Fatal("failed to acquire below limit")
+	}
+	if s.tryAcquire("a", 2) {
+		t.Fatal("acquired more than limit")
+	}
+	if !s.tryAcquire("b", 2) {
+		t.Fatal("failed to acquire other key")
+	}
+	if s.count("a") != 2 || s.count("b") != 1 {
+		t.Errorf("got counts %d and %d, want 2 and 1", s.count("a"), s.count("b"))
+	}
+
+	s.release("a")
+
+	if !s.tryAcquire("a", 2) {
+		t.Fatal("failed to acquire released slot")
+	}
+
+	s.release("a")
+	s.release("a")
+	s.release("b")
+
+	if len(s.held) != 0 || len(s.waiters) != 0 {
+		t.Errorf("state not cleaned up: held %v, waiters %v", s.held, s.waiters)
+	}
+}
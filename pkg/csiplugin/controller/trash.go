@@ -0,0 +1,490 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// How long a Job that purges or restores a single image in the trash may take. Images are only ever renamed or
+// removed, so this is mostly time spent waiting for the Job to be scheduled.
+const trashJobTimeout = 30 * time.Minute
+
+var trashJobBackoffLimit int32 = 2
+
+// Moves the image of a deleted volume to the trash (see common.GenerateTrashImageName), recording the given description
+// of the volume next to it, and removes any replication delta that an interrupted replication left behind. Does nothing
+// if the image is already gone, e.g., because it was moved to the trash in a previous attempt.
+var volumeTrashScript = dedent.Dedent(
+	`
+	set -o errexit -o pipefail -o nounset -o xtrace
+	cd /var/backing
+	rm -f replication-"$2"-*.qcow2
+	if [[ -e "$1" ]]; then
+	    rm -f trash-"$2"-*.json
+	    printf '%s\n' "$4" > "${3%.qcow2}.json"
+	    mv -f "$1" "$3"
+	fi
+	`,
+)
+
+// Returned for undelete requests that can't be carried out, which are dropped rather than retried.
+var errUndeleteImpossible = errors.New("can't undelete volume")
+
+// Purges the images of deleted volumes from the trash once their retention period is over, and restores deleted
+// volumes that an administrator asked for by listing their ids in the "undelete" annotation of their backing PVC.
+//
+// Restoring a volume recreates its PVC, with its original name, labels, size, and modes, and its PV, with its original
+// id and volume attributes, pre-bound to each other, and then moves its image back out of the trash; adoptionController
+// then takes over as for retained and imported volumes.
+type trashController struct {
+	clientset *common.Clientset
+	image     string
+}
+
+func (c *trashController) run(stopCh chan struct{}) {
+	wait.Until(c.collectAll, time.Minute, stopCh)
+}
+
+func (c *trashController) collectAll() {
+	ctx := context.Background() // TODO
+
+	chains, err := common.ListBackingChains(ctx, c.clientset)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	// restore volumes first, so that a volume that is requested just before its retention period ends isn't purged
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	for i := range pvcs.Items {
+		if backingPvc := &pvcs.Items[i]; backingPvc.Annotations[common.Domain+"/undelete"] != "" {
+			c.undeleteRequested(ctx, backingPvc, chains)
+		}
+	}
+
+	// purging is maintenance, which waits for the maintenance window, and expired volumes remain undeletable until then
+
+	if !common.InMaintenanceWindow(time.Now()) {
+		return
+	}
+
+	for location, locationChains := range chains {
+		for _, imageName := range expiredTrashImages(locationChains, time.Now()) {
+			err := c.purge(ctx, location, imageName)
+			if err != nil {
+				klog.ErrorS(
+					err, "Failed to purge image from the trash", "image", imageName,
+					"backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+				)
+			}
+		}
+	}
+}
+
+// Returns the images in the given backing chains that are in the trash and whose retention period is over at the given
+// time, sorted.
+func expiredTrashImages(chains common.BackingChains, now time.Time) []string {
+	var expired []string
+	for imageName := range chains {
+		if _, expiresAt, ok := common.ParseTrashImageName(imageName); ok && !now.Before(expiresAt) {
+			expired = append(expired, imageName)
+		}
+	}
+
+	sort.Strings(expired)
+	return expired
+}
+
+func (c *trashController) purge(ctx context.Context, location common.BackingLocation, imageName string) error {
+	err := common.CheckBackingPvcMaintenance(ctx, c.clientset, location.PvcName, location.PvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	volumeId, _, _ := common.ParseTrashImageName(imageName)
+
+	_, err = c.runTrashJob(ctx, common.JobConfig{
+		Name:      common.GenerateTrashPurgeJobName(string(volumeId)),
+		Namespace: location.PvcNamespace,
+		Command: []string{
+			"bash", "-c", `rm -f "/var/backing/$1" "/var/backing/$2"`, "bash",
+			imageName, common.TrashMetadataName(imageName),
+		},
+		BackingPvcName:     location.PvcName,
+		BackingPvcBasePath: location.BasePath,
+		Maintenance:        true,
+	})
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS(
+		"Purged image from the trash", "image", imageName,
+		"backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+	)
+
+	// the images that it was backed by are collected by snapshotCleanupController once nothing else depends on them
+
+	recordBackingChainChanges(ctx, c.clientset, location, func(chains common.BackingChains) {
+		delete(chains, imageName)
+	})
+
+	return nil
+}
+
+// Restores the volumes listed in the backing PVC's "undelete" annotation, and removes those that were restored or can't
+// be from it.
+func (c *trashController) undeleteRequested(
+	ctx context.Context,
+	backingPvc *corev1.PersistentVolumeClaim,
+	chains map[common.BackingLocation]common.BackingChains,
+) {
+	done := map[string]bool{}
+
+	for _, volumeId := range strings.Split(backingPvc.Annotations[common.Domain+"/undelete"], ",") {
+		volumeId = strings.TrimSpace(volumeId)
+		if volumeId == "" || done[volumeId] {
+			continue
+		}
+
+		restored, err := c.undelete(ctx, backingPvc, chains, types.UID(volumeId))
+
+		switch {
+		case err == nil:
+			done[volumeId] = true
+			klog.InfoS("Undeleted volume", "volume", volumeId, "pvc", klog.KRef(restored.Namespace, restored.Name))
+			err = common.EmitEvent(
+				ctx, c.clientset, common.PvcEventObject(backingPvc), corev1.EventTypeNormal, "VolumeUndeleted",
+				"Restored volume %s from the trash as PVC %s in namespace %s",
+				volumeId, restored.Name, restored.Namespace,
+			)
+		case errors.Is(err, errUndeleteImpossible):
+			done[volumeId] = true
+			err = common.EmitEvent(
+				ctx, c.clientset, common.PvcEventObject(backingPvc), corev1.EventTypeWarning, "UndeleteFailed",
+				"%s", err.Error(),
+			)
+		}
+		if err != nil {
+			klog.ErrorS(err, "Failed to undelete volume", "volume", volumeId)
+		}
+	}
+
+	if len(done) == 0 {
+		return
+	}
+
+	err := common.UpdatePvcMetadata(
+		ctx, c.clientset, backingPvc.Name, backingPvc.Namespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			var remaining []string
+			for _, volumeId := range strings.Split(pvc.Annotations[common.Domain+"/undelete"], ",") {
+				if volumeId = strings.TrimSpace(volumeId); volumeId != "" && !done[volumeId] {
+					remaining = append(remaining, volumeId)
+				}
+			}
+
+			if len(remaining) == 0 {
+				delete(pvc.Annotations, common.Domain+"/undelete")
+			} else {
+				pvc.Annotations[common.Domain+"/undelete"] = strings.Join(remaining, ",")
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		runtime.HandleError(err)
+	}
+}
+
+// Idempotent. Recreates the PVC and PV of the volume with the given id from the trash of the given backing PVC, and
+// moves its image back out of the trash. Fails with errUndeleteImpossible if the volume isn't in the trash or its PVC
+// or PV can't be recreated.
+func (c *trashController) undelete(
+	ctx context.Context,
+	backingPvc *corev1.PersistentVolumeClaim,
+	chains map[common.BackingLocation]common.BackingChains,
+	volumeId types.UID,
+) (*common.TrashedVolume, error) {
+	pvName := fmt.Sprintf("pvc-%s", volumeId)
+
+	location, imageName, ok := findTrashImage(chains, backingPvc, volumeId)
+	if !ok {
+		// a previous attempt may have restored the volume without removing it from the annotation
+		pv, err := c.clientset.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+		if err == nil && pv.Annotations[common.Domain+"/undeleted-from"] != "" && pv.Spec.ClaimRef != nil {
+			restored := &common.TrashedVolume{Namespace: pv.Spec.ClaimRef.Namespace}
+			restored.Name = pv.Spec.ClaimRef.Name
+			return restored, nil
+		} else if err != nil && !k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf(
+			"%w %s: not in the trash of backing PVC %s", errUndeleteImpossible, volumeId, backingPvc.Name,
+		)
+	}
+
+	err := common.CheckBackingPvcMaintenance(ctx, c.clientset, location.PvcName, location.PvcNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.runTrashJob(ctx, common.JobConfig{
+		Name:               common.GenerateUndeleteJobName(string(volumeId)),
+		Namespace:          location.PvcNamespace,
+		Command:            []string{"cat", "/var/backing/" + common.TrashMetadataName(imageName)},
+		BackingPvcName:     location.PvcName,
+		BackingPvcBasePath: location.BasePath,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	trashed, err := common.ParseTrashedVolume(output)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %s", errUndeleteImpossible, volumeId, err.Error())
+	}
+
+	// The volume's old PV may still be around until the external-provisioner deletes it, and a new PVC may have been
+	// created with the same name since. PVs and PVCs that a previous attempt created are reused.
+
+	pv, err := c.clientset.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+	case err != nil:
+		return nil, err
+	case pv.Annotations[common.Domain+"/undeleted-from"] == imageName:
+	case pv.DeletionTimestamp != nil || pv.Status.Phase == corev1.VolumeReleased:
+		return nil, fmt.Errorf("waiting for the old PV %s to be deleted", pvName)
+	default:
+		return nil, fmt.Errorf("%w %s: PV %s already exists", errUndeleteImpossible, volumeId, pvName)
+	}
+
+	pvc, err := c.clientset.CoreV1().PersistentVolumeClaims(trashed.Namespace).
+		Get(ctx, trashed.Name, metav1.GetOptions{})
+	if err == nil && pvc.Spec.VolumeName != pvName {
+		return nil, fmt.Errorf(
+			"%w %s: PVC %s already exists in namespace %s",
+			errUndeleteImpossible, volumeId, trashed.Name, trashed.Namespace,
+		)
+	} else if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	storageClass, err := c.clientset.StorageV1().StorageClasses().
+		Get(ctx, trashed.StorageClassName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		storageClass = &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: trashed.StorageClassName}}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// create the PVC first, so that the PV is never available to other PVCs
+
+	_, err = c.clientset.CoreV1().PersistentVolumeClaims(trashed.Namespace).Create(
+		ctx,
+		bundlePersistentVolumeClaim(&trashed.VolumeBundleEntry, trashed.Namespace, trashed.StorageClassName),
+		metav1.CreateOptions{},
+	)
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	_, err = c.clientset.CoreV1().PersistentVolumes().Create(
+		ctx, trashPersistentVolume(trashed, storageClass, location, imageName), metav1.CreateOptions{},
+	)
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	// the volume can't be staged until its image is back, which may thus happen after its PV is adopted
+
+	script := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+		cd /var/backing
+		if [[ -e "$1" ]]; then
+		    mv -n "$1" "$2"
+		fi
+		rm -f "$3"
+		`,
+	)
+
+	_, err = c.runTrashJob(ctx, common.JobConfig{
+		Name:      common.GenerateUndeleteJobName(string(volumeId)),
+		Namespace: location.PvcNamespace,
+		Command: []string{
+			"bash", "-c", script, "bash",
+			imageName, trashed.ImageName(), common.TrashMetadataName(imageName),
+		},
+		BackingPvcName:     location.PvcName,
+		BackingPvcBasePath: location.BasePath,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	recordBackingChainChanges(ctx, c.clientset, location, func(chains common.BackingChains) {
+		if backing, ok := chains[imageName]; ok {
+			chains[trashed.ImageName()] = backing
+			delete(chains, imageName)
+		}
+	})
+
+	return trashed, nil
+}
+
+// Finds the image of the volume with the given id in the trash of the given backing PVC, under any base path.
+func findTrashImage(
+	chains map[common.BackingLocation]common.BackingChains,
+	backingPvc *corev1.PersistentVolumeClaim,
+	volumeId types.UID,
+) (common.BackingLocation, string, bool) {
+	for location, locationChains := range chains {
+		if location.PvcName != backingPvc.Name || location.PvcNamespace != backingPvc.Namespace {
+			continue
+		}
+		for imageName := range locationChains {
+			if id, _, ok := common.ParseTrashImageName(imageName); ok && id == volumeId {
+				return location, imageName, true
+			}
+		}
+	}
+	return common.BackingLocation{}, "", false
+}
+
+// The PV of a volume restored from the trash, pre-bound to the PVC that bundlePersistentVolumeClaim returns for it.
+func trashPersistentVolume(
+	trashed *common.TrashedVolume,
+	storageClass *storagev1.StorageClass,
+	location common.BackingLocation,
+	imageName string,
+) *corev1.PersistentVolume {
+	pv := bundlePersistentVolume(&trashed.VolumeBundleEntry, trashed.Namespace, storageClass, location)
+
+	for key, value := range trashed.PvAnnotations {
+		pv.Annotations[key] = value
+	}
+	pv.Annotations[common.Domain+"/undeleted-from"] = imageName
+
+	// the volume may have been migrated since its PV was first created, and adoptionController prefers these
+	pv.Annotations[common.Domain+"/backing-pvc-name"] = location.PvcName
+	pv.Annotations[common.Domain+"/backing-pvc-namespace"] = location.PvcNamespace
+	pv.Annotations[common.Domain+"/backing-pvc-base-path"] = location.BasePath
+
+	for key, value := range trashed.VolumeAttributes {
+		pv.Spec.CSI.VolumeAttributes[key] = value
+	}
+
+	return pv
+}
+
+// Runs a Job to completion and returns its logs. The Job is deleted in any case, so that it is run anew if retried.
+func (c *trashController) runTrashJob(ctx context.Context, config common.JobConfig) ([]byte, error) {
+	config.Image = c.image
+	config.BackoffLimit = &trashJobBackoffLimit
+	config.Labels = map[string]string{common.Domain + "/component": "trash"}
+
+	err := common.CreateJob(ctx, c.clientset, config)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err := common.DeleteJobSynchronously(context.Background(), c.clientset, config.Name, config.Namespace)
+		if err != nil {
+			runtime.HandleError(err)
+		}
+	}()
+
+	err = common.WaitForJobToSucceedWithin(ctx, c.clientset, config.Name, config.Namespace, trashJobTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return common.GetJobLogs(ctx, c.clientset, config.Name, config.Namespace)
+}
+
+// Returns how to describe the volume of the given PVC in the trash and for how long to keep it there, or nil if the
+// volume is to be removed right away: if its StorageClass has no "trashRetention" parameter, if it is mirrored, or if it
+// was never bound to a PV.
+func trashedVolumeOf(
+	ctx context.Context,
+	clientset *common.Clientset,
+	pvc *corev1.PersistentVolumeClaim,
+) (*common.TrashedVolume, time.Duration, error) {
+	if _, mirrored := common.MirrorLocationOf(&pvc.ObjectMeta); mirrored || pvc.Spec.StorageClassName == nil ||
+		pvc.Spec.VolumeName == "" {
+		return nil, 0, nil
+	}
+
+	storageClass, err := clientset.StorageV1().StorageClasses().
+		Get(ctx, *pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	retention, err := common.ParseTrashRetention(storageClass.Parameters)
+	if err != nil || retention == 0 {
+		return nil, 0, err
+	}
+
+	pv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	entry, err := bundleEntryOf(pvc)
+	if err != nil {
+		return nil, 0, nil // never bound
+	}
+
+	trashed := &common.TrashedVolume{
+		VolumeBundleEntry: entry,
+		Namespace:         pvc.Namespace,
+		StorageClassName:  storageClass.Name,
+	}
+
+	if pv.Spec.CSI != nil {
+		trashed.VolumeAttributes = pv.Spec.CSI.VolumeAttributes
+	}
+
+	for key, value := range pv.Annotations {
+		if strings.HasPrefix(key, common.Domain+"/") {
+			if trashed.PvAnnotations == nil {
+				trashed.PvAnnotations = map[string]string{}
+			}
+			trashed.PvAnnotations[key] = value
+		}
+	}
+
+	return trashed, retention, nil
+}
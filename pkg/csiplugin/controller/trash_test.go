@@ -0,0 +1,32 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+)
+
+func TestExpiredTrashImages(t *testing.T) {
+	chains := common.BackingChains{
+		"pvc-a.qcow2":              "snapshot-s.qcow2",
+		"snapshot-s.qcow2":         "",
+		"trash-b-1000.qcow2":       "snapshot-s.qcow2",
+		"trash-c-2000.qcow2":       "",
+		"trash-d-e-f-1500.qcow2":   "",
+		"trash-malformed-x.qcow2":  "",
+		"cloned-a-to-b.qcow2":      "",
+		"replication-a-1.qcow2":    "pvc-a.qcow2",
+		"trash-without-expiry.img": "",
+	}
+
+	got := expiredTrashImages(chains, time.Unix(1500, 0))
+	want := []string{"trash-b-1000.qcow2", "trash-d-e-f-1500.qcow2"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Maximum number of NBD connections per staged volume, which is also what the kernel NBD client can make use of.
+const maxNbdConnections = 16
+
+// The qcow2 driver options that the "qcow2Options" StorageClass parameter may set, which only affect how much memory
+// qemu-storage-daemon uses for metadata caches and how long it keeps it. Other options could compromise the volume's
+// data or the node, and are thus not allowed.
+var qcow2OptionParsers = map[string]func(value string) (string, error){
+	"cache-size":           parsePositiveByteCount,
+	"l2-cache-size":        parsePositiveByteCount,
+	"refcount-cache-size":  parsePositiveByteCount,
+	"l2-cache-entry-size":  parseL2CacheEntrySize,
+	"cache-clean-interval": parseCacheCleanInterval,
+}
+
+// Validates the StorageClass parameters that tune how staged volumes are served, and returns the volume context
+// entries that pass them on to NodeStageVolume. Parameters that aren't set are left out, so that staging uses the
+// defaults:
+//
+//   - "nbdConnections": number of connections the kernel NBD client makes to the export, each with its own queue
+//     (default 1);
+//   - "aio": how qemu-storage-daemon submits I/O to the image file, "threads" (default), "native", or "io_uring";
+//   - "iothread": whether qemu-storage-daemon serves the export in a dedicated I/O thread ("true" or "false", the
+//     default);
+//   - "cacheMode": how writes reach the backing volume, "none" (default, direct I/O), "writeback" (through the node's
+//     page cache), or "unsafe" (like "writeback" but ignoring flushes, so that nothing is durable until the page cache
+//     is written back on its own);
+//   - "stagingCpu" and "stagingMemory": the CPU and memory that staging pods request and are limited to (unlimited by
+//     default). Setting both, with a whole number of CPUs, gives staging pods dedicated CPUs on nodes where kubelet
+//     uses the static CPU manager policy;
+//   - "qcow2Options": comma-separated key=value options for the qcow2 driver, limited to those in qcow2OptionParsers,
+//     e.g., "l2-cache-size=64Mi" (sized for the volume by default, see the node plugin's qcow2CacheOptions()). Ignored
+//     when falling back to qemu-nbd;
+//   - "maxQcow2CacheSize": the most memory that the qcow2 metadata caches of a volume sized for it may take, in bytes,
+//     or 0 to keep QEMU's defaults (256Mi by default);
+//   - "readAhead": the read-ahead of the volume's block device, in bytes (the kernel's default by default);
+//   - "maxIops" and "maxBandwidth": the most operations and bytes per second that the volume may read and write,
+//     combined, or 0 for unlimited (the default). PVC annotations may lower these limits, but not lift them (see
+//     common.StorageClassQosOf()).
+func parseStagingTuning(parameters map[string]string) (map[string]string, error) {
+	volumeContext := map[string]string{}
+
+	if value := parameters["nbdConnections"]; value != "" {
+		connections, err := strconv.Atoi(value)
+		if err != nil || connections < 1 || connections > maxNbdConnections {
+			return nil, status.Errorf(
+				codes.InvalidArgument, "parameter \"nbdConnections\" must be an integer between 1 and %d",
+				maxNbdConnections,
+			)
+		}
+		volumeContext["nbdConnections"] = strconv.Itoa(connections)
+	}
+
+	switch value := parameters["aio"]; value {
+	case "":
+	case "threads", "native", "io_uring":
+		volumeContext["aio"] = value
+	default:
+		return nil, status.Errorf(
+			codes.InvalidArgument, "parameter \"aio\" must be \"threads\", \"native\", or \"io_uring\"",
+		)
+	}
+
+	switch value := parameters["cacheMode"]; value {
+	case "":
+	case "none", "writeback", "unsafe":
+		volumeContext["cacheMode"] = value
+	default:
+		return nil, status.Errorf(
+			codes.InvalidArgument, "parameter \"cacheMode\" must be \"none\", \"writeback\", or \"unsafe\"",
+		)
+	}
+
+	// Linux AIO requires direct I/O
+	if volumeContext["aio"] == "native" && volumeContext["cacheMode"] != "" && volumeContext["cacheMode"] != "none" {
+		return nil, status.Errorf(
+			codes.InvalidArgument, "parameter \"aio\" can only be \"native\" with parameter \"cacheMode\" \"none\"",
+		)
+	}
+
+	switch parameters["iothread"] {
+	case "", "false":
+	case "true":
+		volumeContext["iothread"] = "true"
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "parameter \"iothread\" must be \"true\" or \"false\"")
+	}
+
+	for _, key := range []string{"stagingCpu", "stagingMemory"} {
+		if value := parameters[key]; value != "" {
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil || quantity.Sign() <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "parameter \"%s\" must be a positive quantity", key)
+			}
+			volumeContext[key] = quantity.String()
+		}
+	}
+
+	if value := parameters["qcow2Options"]; value != "" {
+		options, err := parseQcow2Options(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "parameter \"qcow2Options\" is invalid: %v", err)
+		}
+		volumeContext["qcow2Options"] = options
+	}
+
+	if value := parameters["maxQcow2CacheSize"]; value != "" {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Sign() < 0 {
+			return nil, status.Errorf(
+				codes.InvalidArgument, "parameter \"maxQcow2CacheSize\" must be a non-negative quantity",
+			)
+		}
+		volumeContext["maxQcow2CacheSize"] = strconv.FormatInt(quantity.Value(), 10)
+	}
+
+	if value := parameters["readAhead"]; value != "" {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Sign() < 0 || quantity.Value()%512 != 0 {
+			return nil, status.Errorf(
+				codes.InvalidArgument, "parameter \"readAhead\" must be a non-negative multiple of 512 bytes",
+			)
+		}
+		volumeContext["readAhead"] = strconv.FormatInt(quantity.Value(), 10)
+	}
+
+	for _, key := range []string{"maxIops", "maxBandwidth"} {
+		if value := parameters[key]; value != "" {
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil || quantity.Sign() < 0 {
+				return nil, status.Errorf(
+					codes.InvalidArgument, "parameter \"%s\" must be a non-negative quantity", key,
+				)
+			}
+			volumeContext[key] = strconv.FormatInt(quantity.Value(), 10)
+		}
+	}
+
+	return volumeContext, nil
+}
+
+// Parses the value of the "qcow2Options" StorageClass parameter into the equivalent qcow2 blockdev options, sorted by
+// key and with sizes in bytes, e.g., "cache-clean-interval=600,l2-cache-size=67108864".
+func parseQcow2Options(value string) (string, error) {
+	options := map[string]string{}
+
+	for _, option := range strings.Split(value, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(option), "=")
+		if !ok {
+			return "", fmt.Errorf("option %q is not of the form key=value", option)
+		}
+
+		parse, ok := qcow2OptionParsers[key]
+		if !ok {
+			return "", fmt.Errorf("option %q is not supported", key)
+		}
+		if _, ok := options[key]; ok {
+			return "", fmt.Errorf("option %q is given more than once", key)
+		}
+
+		parsed, err := parse(value)
+		if err != nil {
+			return "", fmt.Errorf("option %q %v", key, err)
+		}
+		options[key] = parsed
+	}
+
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		keys[i] = key + "=" + options[key]
+	}
+
+	return strings.Join(keys, ","), nil
+}
+
+func parsePositiveByteCount(value string) (string, error) {
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil || quantity.Sign() <= 0 {
+		return "", fmt.Errorf("must be a positive quantity")
+	}
+	return strconv.FormatInt(quantity.Value(), 10), nil
+}
+
+func parseL2CacheEntrySize(value string) (string, error) {
+	quantity, err := resource.ParseQuantity(value)
+	size := quantity.Value()
+	if err != nil || size < 512 || size > 2*1024*1024 || size&(size-1) != 0 {
+		return "", fmt.Errorf("must be a power of 2 between 512 and 2Mi")
+	}
+	return strconv.FormatInt(size, 10), nil
+}
+
+func parseCacheCleanInterval(value string) (string, error) {
+	seconds, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("must be a non-negative number of seconds")
+	}
+	return strconv.FormatUint(seconds, 10), nil
+}
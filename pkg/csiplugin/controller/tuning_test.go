@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStagingTuning(t *testing.T) {
+	tests := []struct {
+		parameters map[string]string
+		want       map[string]string
+	}{
+		{map[string]string{}, map[string]string{}},
+		{
+			map[string]string{"nbdConnections": "4", "aio": "io_uring", "iothread": "true"},
+			map[string]string{"nbdConnections": "4", "aio": "io_uring", "iothread": "true"},
+		},
+		{map[string]string{"aio": "threads", "iothread": "false"}, map[string]string{"aio": "threads"}},
+		{map[string]string{"nbdConnections": "0"}, nil},
+		{map[string]string{"nbdConnections": "17"}, nil},
+		{map[string]string{"nbdConnections": "many"}, nil},
+		{map[string]string{"aio": "posix"}, nil},
+		{map[string]string{"iothread": "2"}, nil},
+		{
+			map[string]string{"cacheMode": "unsafe", "aio": "io_uring"},
+			map[string]string{"cacheMode": "unsafe", "aio": "io_uring"},
+		},
+		{map[string]string{"cacheMode": "none", "aio": "native"}, map[string]string{"cacheMode": "none", "aio": "native"}},
+		{map[string]string{"cacheMode": "writeback", "aio": "native"}, nil},
+		{map[string]string{"cacheMode": "writethrough"}, nil},
+		{
+			map[string]string{"stagingCpu": "2", "stagingMemory": "0.5Gi"},
+			map[string]string{"stagingCpu": "2", "stagingMemory": "512Mi"},
+		},
+		{map[string]string{"stagingCpu": "two"}, nil},
+		{map[string]string{"stagingMemory": "0"}, nil},
+		{
+			map[string]string{"qcow2Options": "l2-cache-size=64Mi, cache-clean-interval=600", "readAhead": "1Mi"},
+			map[string]string{
+				"qcow2Options": "cache-clean-interval=600,l2-cache-size=67108864",
+				"readAhead":    "1048576",
+			},
+		},
+		{
+			map[string]string{"qcow2Options": "l2-cache-entry-size=64Ki"},
+			map[string]string{"qcow2Options": "l2-cache-entry-size=65536"},
+		},
+		{map[string]string{"readAhead": "0"}, map[string]string{"readAhead": "0"}},
+		{map[string]string{"qcow2Options": "l2-cache-entry-size=1000"}, nil},
+		{map[string]string{"qcow2Options": "l2-cache-size=0"}, nil},
+		{map[string]string{"qcow2Options": "cache-clean-interval=-1"}, nil},
+		{map[string]string{"qcow2Options": "l2-cache-size=1Mi,l2-cache-size=2Mi"}, nil},
+		{map[string]string{"qcow2Options": "discard-no-unref=on"}, nil},
+		{map[string]string{"qcow2Options": "file.filename=/etc/passwd"}, nil},
+		{map[string]string{"qcow2Options": "l2-cache-size"}, nil},
+		{map[string]string{"readAhead": "1000"}, nil},
+		{map[string]string{"readAhead": "-512"}, nil},
+		{map[string]string{"maxQcow2CacheSize": "1Gi"}, map[string]string{"maxQcow2CacheSize": "1073741824"}},
+		{map[string]string{"maxQcow2CacheSize": "0"}, map[string]string{"maxQcow2CacheSize": "0"}},
+		{map[string]string{"maxQcow2CacheSize": "-1Mi"}, nil},
+		{
+			map[string]string{"maxIops": "2k", "maxBandwidth": "100Mi"},
+			map[string]string{"maxIops": "2000", "maxBandwidth": "104857600"},
+		},
+		{map[string]string{"maxIops": "0"}, map[string]string{"maxIops": "0"}},
+		{map[string]string{"maxIops": "-1"}, nil},
+		{map[string]string{"maxBandwidth": "fast"}, nil},
+	}
+
+	for _, test := range tests {
+		got, err := parseStagingTuning(test.parameters)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%v: expected error", test.parameters)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, %v, want %v", test.parameters, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/metrics"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// The file that the "csv" usage sink appends to if its spec doesn't give one, relative to the root of the backing
+// volume.
+const defaultUsageCsvFileName = "subprovisioner-usage.csv"
+
+// How long the Job that appends usage records to a CSV file may take, and how long an HTTP endpoint may take to accept
+// them, before exporting them is given up on.
+const (
+	usageCsvExportTimeout  = 5 * time.Minute
+	usageHttpExportTimeout = 30 * time.Second
+)
+
+var usageCsvExportBackoffLimit int32 = 2
+
+var (
+	namespaceUsageLabels = []string{"namespace"}
+
+	namespaceProvisionedBytes = metrics.Default.NewGaugeVec(
+		"subprovisioner_namespace_provisioned_bytes",
+		"Total capacity of the volumes of the PVCs in a namespace, counting mirrors, as of the last usage export.",
+		namespaceUsageLabels...,
+	)
+	namespaceAllocatedBytes = metrics.Default.NewGaugeVec(
+		"subprovisioner_namespace_allocated_bytes",
+		"Space that the images of the volumes of the PVCs in a namespace take up in backing volumes, counting "+
+			"mirrors, as of the last usage export.",
+		namespaceUsageLabels...,
+	)
+	namespaceSnapshotBytes = metrics.Default.NewGaugeVec(
+		"subprovisioner_namespace_snapshot_bytes",
+		"Space that the images of the VolumeSnapshots in a namespace take up in backing volumes, as of the last "+
+			"usage export.",
+		namespaceUsageLabels...,
+	)
+	usageExportFailures = metrics.Default.NewCounterVec(
+		"subprovisioner_usage_export_failures_total",
+		"Number of times that exporting usage records to a sink failed.",
+		"sink",
+	)
+)
+
+// How and where the controller plugin periodically exports usage records, e.g., for chargeback of the space that each
+// namespace takes up in the shared backing volumes.
+type UsageExportOptions struct {
+	// The length of the periods that each usage record covers. Periods are aligned to multiples of it, e.g., hourly
+	// periods start on the hour.
+	Interval time.Duration
+
+	// Where to export usage records to. They aren't exported if empty.
+	Sinks []UsageSinkConfig
+}
+
+// A sink for usage records, as given by a --usage-export-sink flag (see ParseUsageSinkConfig()).
+type UsageSinkConfig struct {
+	Kind string // "csv", "http", or "metrics"
+
+	// for "csv", the backing volume and the path in it of the file that records are appended to
+	Location common.BackingLocation
+	FilePath string
+
+	// for "http", the endpoint that records are POSTed to
+	Url string
+}
+
+// Parses the spec of a usage sink, which is one of:
+//
+//   - "csv:<namespace>/<backing-pvc>[/<path>]", to append records to a CSV file in the root of a backing volume, or at
+//     the given path in it;
+//   - an "http://" or "https://" URL, to POST records to as JSON;
+//   - "metrics", to export the latest records as metrics.
+func ParseUsageSinkConfig(spec string) (UsageSinkConfig, error) {
+	switch {
+	case spec == "metrics":
+		return UsageSinkConfig{Kind: "metrics"}, nil
+
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return UsageSinkConfig{Kind: "http", Url: spec}, nil
+
+	case strings.HasPrefix(spec, "csv:"):
+		parts := strings.SplitN(strings.TrimPrefix(spec, "csv:"), "/", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return UsageSinkConfig{}, fmt.Errorf(
+				"invalid usage sink \"%s\": must be of the form csv:<namespace>/<backing-pvc>[/<path>]", spec,
+			)
+		}
+
+		filePath := defaultUsageCsvFileName
+		if len(parts) == 3 {
+			filePath = path.Clean(parts[2])
+			if filePath == "." || filePath == ".." || path.IsAbs(filePath) || strings.HasPrefix(filePath, "../") {
+				return UsageSinkConfig{}, fmt.Errorf(
+					"invalid usage sink \"%s\": path must be relative to the root of the backing volume", spec,
+				)
+			}
+		}
+
+		return UsageSinkConfig{
+			Kind:     "csv",
+			Location: common.BackingLocation{PvcName: parts[1], PvcNamespace: parts[0]},
+			FilePath: filePath,
+		}, nil
+
+	default:
+		return UsageSinkConfig{}, fmt.Errorf(
+			"invalid usage sink \"%s\": must be csv:<namespace>/<backing-pvc>[/<path>], an http(s) URL, or metrics",
+			spec,
+		)
+	}
+}
+
+// What the volumes and snapshots of a namespace took up at the end of a period, i.e., when the period's record was
+// taken. Multiplying the byte counts by the duration gives the usage over the period, e.g., in byte-hours.
+type usageRecord struct {
+	Namespace       string    `json:"namespace"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds int64     `json:"durationSeconds"`
+
+	Volumes          int   `json:"volumes"`
+	ProvisionedBytes int64 `json:"provisionedBytes"`
+	AllocatedBytes   int64 `json:"allocatedBytes"`
+
+	Snapshots     int   `json:"snapshots"`
+	SnapshotBytes int64 `json:"snapshotBytes"`
+}
+
+var usageCsvHeader = []string{
+	"namespace", "start", "end", "duration_seconds", "volumes", "provisioned_bytes", "allocated_bytes", "snapshots",
+	"snapshot_bytes",
+}
+
+func (r usageRecord) csvFields() []string {
+	return []string{
+		r.Namespace,
+		r.Start.UTC().Format(time.RFC3339),
+		r.End.UTC().Format(time.RFC3339),
+		strconv.FormatInt(r.DurationSeconds, 10),
+		strconv.Itoa(r.Volumes),
+		strconv.FormatInt(r.ProvisionedBytes, 10),
+		strconv.FormatInt(r.AllocatedBytes, 10),
+		strconv.Itoa(r.Snapshots),
+		strconv.FormatInt(r.SnapshotBytes, 10),
+	}
+}
+
+// Periodically takes a usage record of every namespace with volumes or VolumeSnapshots of the driver, and exports them
+// to the configured sinks. Records are taken from what the PVCs and VolumeSnapshots record about their volumes and
+// images, i.e., their capacities and the allocated sizes that the backing chains controller keeps up to date, so this
+// doesn't run any Jobs besides those of the "csv" sink.
+//
+// The period that ended last is exported again when the controller starts, e.g., after another replica of the
+// controller plugin takes over, so that it isn't missed if the previous leader didn't export it. Consumers should thus
+// deduplicate records by namespace and start.
+type usageExportController struct {
+	clientset *common.Clientset
+	interval  time.Duration
+	sinks     []usageSink
+
+	lastEnd time.Time // the end of the last period that was exported
+}
+
+func newUsageExportController(
+	clientset *common.Clientset,
+	image string,
+	options UsageExportOptions,
+) *usageExportController {
+	c := &usageExportController{
+		clientset: clientset,
+		interval:  options.Interval,
+	}
+
+	for _, config := range options.Sinks {
+		switch config.Kind {
+		case "csv":
+			c.sinks = append(c.sinks, &usageCsvSink{
+				clientset: clientset, image: image, location: config.Location, filePath: config.FilePath,
+			})
+		case "http":
+			c.sinks = append(c.sinks, &usageHttpSink{url: config.Url, client: &http.Client{}})
+		case "metrics":
+			c.sinks = append(c.sinks, usageMetricsSink{})
+		}
+	}
+
+	return c
+}
+
+func (c *usageExportController) run(stopCh chan struct{}) {
+	c.lastEnd = time.Now().Truncate(c.interval).Add(-c.interval)
+
+	checkInterval := time.Minute
+	if c.interval < checkInterval {
+		checkInterval = c.interval
+	}
+
+	wait.Until(c.exportDue, checkInterval, stopCh)
+}
+
+// Exports the records of the period that ended since the last export, if any. Periods that were skipped, e.g., because
+// listing PVCs failed, are merged into it, so that the records cover all time without gaps.
+func (c *usageExportController) exportDue() {
+	ctx := context.Background() // TODO
+
+	end := time.Now().Truncate(c.interval)
+	if !end.After(c.lastEnd) {
+		return
+	}
+
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	volumeSnapshots, err := c.clientset.SnapshotV1().VolumeSnapshots(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: common.Domain + "/uid"})
+	if k8serrors.IsNotFound(err) {
+		volumeSnapshots = &volumesnapshotv1.VolumeSnapshotList{} // volume snapshot CRDs aren't installed
+	} else if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	records := summarizeNamespaceUsage(pvcs.Items, volumeSnapshots.Items, c.lastEnd, end)
+
+	// records that a sink fails to take aren't retried, as retrying could hold up the following periods indefinitely
+
+	for _, sink := range c.sinks {
+		err := sink.export(ctx, records)
+		if err != nil {
+			klog.ErrorS(err, "Failed to export usage records", "sink", sink.name())
+			usageExportFailures.Inc(sink.name())
+		}
+	}
+
+	c.lastEnd = end
+}
+
+// Sums up the capacities and allocated sizes of the given volumes, and the allocated sizes of the given
+// VolumeSnapshots, by namespace, into records of the given period ordered by namespace. Volumes that haven't been
+// created yet are left out, and volumes and VolumeSnapshots whose allocated sizes haven't been recorded yet are counted
+// as taking up no space.
+func summarizeNamespaceUsage(
+	pvcs []corev1.PersistentVolumeClaim,
+	volumeSnapshots []volumesnapshotv1.VolumeSnapshot,
+	start time.Time,
+	end time.Time,
+) []usageRecord {
+	records := map[string]*usageRecord{}
+
+	recordOf := func(namespace string) *usageRecord {
+		record, ok := records[namespace]
+		if !ok {
+			record = &usageRecord{
+				Namespace:       namespace,
+				Start:           start,
+				End:             end,
+				DurationSeconds: int64(end.Sub(start) / time.Second),
+			}
+			records[namespace] = record
+		}
+		return record
+	}
+
+	for i := range pvcs {
+		pvc := &pvcs[i]
+
+		capacity, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64)
+		if err != nil {
+			continue // not created yet
+		}
+
+		copies := int64(1)
+		if _, mirrored := common.MirrorLocationOf(&pvc.ObjectMeta); mirrored {
+			copies = 2 // the mirror is assumed to take up as much space as the volume
+		}
+
+		record := recordOf(pvc.Namespace)
+		record.Volumes++
+		record.ProvisionedBytes += copies * capacity
+		record.AllocatedBytes += copies * recordedAllocatedSize(&pvc.ObjectMeta)
+	}
+
+	for i := range volumeSnapshots {
+		volumeSnapshot := &volumeSnapshots[i]
+
+		record := recordOf(volumeSnapshot.Namespace)
+		record.Snapshots++
+		record.SnapshotBytes += recordedAllocatedSize(&volumeSnapshot.ObjectMeta)
+	}
+
+	result := make([]usageRecord, 0, len(records))
+	for _, record := range records {
+		result = append(result, *record)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Namespace < result[j].Namespace })
+
+	return result
+}
+
+// Returns the allocated size recorded on a PVC or VolumeSnapshot, or 0 if none was recorded.
+func recordedAllocatedSize(meta *metav1.ObjectMeta) int64 {
+	size, err := strconv.ParseInt(meta.Annotations[common.Domain+"/allocated-size"], 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
+// Updates the "allocated-size" annotation of the given PVCs whose volumes are in a backing location, given what
+// inspecting the images there found out about them, for usage records to account for (see usageExportController).
+// Like recordSnapshotAllocatedSizes(), but for volumes.
+func recordVolumeAllocatedSizes(
+	ctx context.Context,
+	clientset *common.Clientset,
+	pvcs []corev1.PersistentVolumeClaim,
+	stats map[string]common.ImageStats,
+) {
+	for i := range pvcs {
+		pvc := &pvcs[i]
+
+		imageStats, ok := stats[common.GenerateVolumeImageName(common.VolumeUidOf(pvc))]
+		size := imageStats.AllocatedBytes
+		if !ok || size < 0 {
+			continue
+		}
+		if pvc.Annotations[common.Domain+"/allocated-size"] == strconv.FormatInt(size, 10) {
+			continue
+		}
+
+		err := common.ApplyPvcMetadata(
+			ctx, clientset, pvc.Name, pvc.Namespace,
+			metav1.ObjectMeta{
+				Annotations: map[string]string{common.Domain + "/allocated-size": strconv.FormatInt(size, 10)},
+			},
+		)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to record allocated size of volume of PVC", "pvc", klog.KRef(pvc.Namespace, pvc.Name),
+			)
+		}
+	}
+}
+
+type usageSink interface {
+	// how the sink is referred to in logs and in the "sink" label of usageExportFailures
+	name() string
+
+	export(ctx context.Context, records []usageRecord) error
+}
+
+// Appends records to a CSV file in a backing volume with a Job, writing the header first if the file doesn't exist yet.
+type usageCsvSink struct {
+	clientset *common.Clientset
+	image     string
+	location  common.BackingLocation
+	filePath  string
+}
+
+func (s *usageCsvSink) name() string {
+	return "csv"
+}
+
+func (s *usageCsvSink) export(ctx context.Context, records []usageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	header, err := formatUsageCsv([][]string{usageCsvHeader})
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, len(records))
+	for i, record := range records {
+		rows[i] = record.csvFields()
+	}
+
+	lines, err := formatUsageCsv(rows)
+	if err != nil {
+		return err
+	}
+
+	script := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset
+
+		file="/var/backing/$1"
+		mkdir -p "$( dirname "${file}" )"
+		if [[ ! -e "${file}" ]]; then
+		    printf '%s' "$2" > "${file}.tmp"
+		    mv "${file}.tmp" "${file}"
+		fi
+		printf '%s' "$3" >> "${file}"
+		`,
+	)
+
+	jobName := common.GenerateUsageExportJobName(s.location)
+
+	// a Job left behind by a previous export that failed would keep this one from being created
+
+	err = common.DeleteJobSynchronously(ctx, s.clientset, jobName, s.location.PvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	err = common.CreateJob(
+		ctx, s.clientset,
+		common.JobConfig{
+			Name:      jobName,
+			Namespace: s.location.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "usage-export",
+			},
+			Image:              s.image,
+			Command:            []string{"bash", "-c", script, "bash", s.filePath, header, lines},
+			BackingPvcName:     s.location.PvcName,
+			BackingPvcBasePath: s.location.BasePath,
+			BackoffLimit:       &usageCsvExportBackoffLimit,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = common.WaitForJobToSucceedWithin(ctx, s.clientset, jobName, s.location.PvcNamespace, usageCsvExportTimeout)
+	if err != nil {
+		// the Job may still append the records later, but not if it is deleted
+		_ = common.DeleteJobSynchronously(ctx, s.clientset, jobName, s.location.PvcNamespace)
+		return err
+	}
+
+	return common.DeleteJobSynchronously(ctx, s.clientset, jobName, s.location.PvcNamespace)
+}
+
+func formatUsageCsv(rows [][]string) (string, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+
+	err := writer.WriteAll(rows)
+	if err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// POSTs records to an HTTP endpoint as a JSON object with a "records" array, which must respond with a 2xx status.
+type usageHttpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *usageHttpSink) name() string {
+	return "http"
+}
+
+func (s *usageHttpSink) export(ctx context.Context, records []usageRecord) error {
+	body, err := json.Marshal(map[string][]usageRecord{"records": records})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, usageHttpExportTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s responded with status %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// Exports the byte counts of the latest records as metrics labeled by namespace, replacing those of earlier records.
+type usageMetricsSink struct{}
+
+func (usageMetricsSink) name() string {
+	return "metrics"
+}
+
+func (usageMetricsSink) export(ctx context.Context, records []usageRecord) error {
+	for _, gauge := range []*metrics.GaugeVec{
+		namespaceProvisionedBytes, namespaceAllocatedBytes, namespaceSnapshotBytes,
+	} {
+		gauge.Reset()
+	}
+
+	for _, record := range records {
+		namespaceProvisionedBytes.Set(float64(record.ProvisionedBytes), record.Namespace)
+		namespaceAllocatedBytes.Set(float64(record.AllocatedBytes), record.Namespace)
+		namespaceSnapshotBytes.Set(float64(record.SnapshotBytes), record.Namespace)
+	}
+
+	return nil
+}
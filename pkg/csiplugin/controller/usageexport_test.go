@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseUsageSinkConfig(t *testing.T) {
+	backing := common.BackingLocation{PvcName: "backing", PvcNamespace: "ns"}
+
+	for spec, want := range map[string]UsageSinkConfig{
+		"metrics":                      {Kind: "metrics"},
+		"https://billing/usage":        {Kind: "http", Url: "https://billing/usage"},
+		"csv:ns/backing":               {Kind: "csv", Location: backing, FilePath: defaultUsageCsvFileName},
+		"csv:ns/backing/usage/./a.csv": {Kind: "csv", Location: backing, FilePath: "usage/a.csv"},
+	} {
+		got, err := ParseUsageSinkConfig(spec)
+		if err != nil || got != want {
+			t.Errorf("%s: got %+v, %v, want %+v", spec, got, err, want)
+		}
+	}
+
+	for _, spec := range []string{
+		"", "csv", "csv:ns", "csv:/backing", "csv:ns/backing/", "csv:ns/backing/../x", "ftp://x",
+	} {
+		if _, err := ParseUsageSinkConfig(spec); err == nil {
+			t.Errorf("%s: got no error", spec)
+		}
+	}
+}
+
+func TestSummarizeNamespaceUsage(t *testing.T) {
+	withAnnotations := func(namespace string, annotations map[string]string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Namespace: namespace, Annotations: annotations}
+	}
+
+	pvcs := []corev1.PersistentVolumeClaim{
+		{ObjectMeta: withAnnotations("a", map[string]string{
+			common.Domain + "/capacity":       "100",
+			common.Domain + "/allocated-size": "40",
+		})},
+		{ObjectMeta: withAnnotations("a", map[string]string{
+			common.Domain + "/capacity":                "50",
+			common.Domain + "/allocated-size":          "10",
+			common.Domain + "/mirror-backing-pvc-name": "mirror",
+		})},
+		{ObjectMeta: withAnnotations("b", map[string]string{
+			common.Domain + "/capacity": "70", // allocated size not recorded yet
+		})},
+		{ObjectMeta: withAnnotations("c", nil)}, // not created yet
+	}
+
+	volumeSnapshots := []volumesnapshotv1.VolumeSnapshot{
+		{ObjectMeta: withAnnotations("a", map[string]string{common.Domain + "/allocated-size": "5"})},
+		{ObjectMeta: withAnnotations("d", map[string]string{common.Domain + "/allocated-size": "7"})},
+		{ObjectMeta: withAnnotations("d", nil)},
+	}
+
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+
+	got := summarizeNamespaceUsage(pvcs, volumeSnapshots, start, end)
+
+	record := func(namespace string) usageRecord {
+		return usageRecord{Namespace: namespace, Start: start, End: end, DurationSeconds: 3600}
+	}
+
+	a := record("a")
+	a.Volumes, a.ProvisionedBytes, a.AllocatedBytes, a.Snapshots, a.SnapshotBytes = 2, 200, 60, 1, 5
+	b := record("b")
+	b.Volumes, b.ProvisionedBytes = 1, 70
+	d := record("d")
+	d.Snapshots, d.SnapshotBytes = 2, 7
+
+	want := []usageRecord{a, b, d}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestUsageCsv(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	record := usageRecord{
+		Namespace: "a,b", Start: start, End: start.Add(time.Hour), DurationSeconds: 3600,
+		Volumes: 1, ProvisionedBytes: 100, AllocatedBytes: 40, Snapshots: 2, SnapshotBytes: 5,
+	}
+
+	got, err := formatUsageCsv([][]string{usageCsvHeader, record.csvFields()})
+	want := "namespace,start,end,duration_seconds,volumes,provisioned_bytes,allocated_bytes,snapshots," +
+		"snapshot_bytes\n\"a,b\",2024-01-01T10:00:00Z,2024-01-01T11:00:00Z,3600,1,100,40,2,5\n"
+	if err != nil || got != want {
+		t.Errorf("got %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestUsageHttpSink(t *testing.T) {
+	var received map[string][]usageRecord
+	status := http.StatusNoContent
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s request with content type %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := &usageHttpSink{url: server.URL, client: server.Client()}
+	records := []usageRecord{{Namespace: "a", DurationSeconds: 3600, ProvisionedBytes: 100}}
+
+	if err := sink.export(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	if len(received["records"]) != 1 || received["records"][0].ProvisionedBytes != 100 {
+		t.Errorf("got %+v", received)
+	}
+
+	status = http.StatusInternalServerError
+	if err := sink.export(context.Background(), records); err == nil {
+		t.Error("got no error for status 500")
+	}
+}
@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A backing volume that only nodes in the given zone can access, e.g., because it is a zonal shared file system.
+type zonalBackingClaim struct {
+	zone      string
+	name      string
+	namespace string
+}
+
+// Parses the "zonalBackingClaims" StorageClass parameter, a comma-separated list of "<zone>=[<namespace>/]<name>"
+// entries in order of preference. References without a namespace refer to defaultNamespace. Returns nil if the
+// parameter isn't set.
+func parseZonalBackingClaims(value string, defaultNamespace string) ([]zonalBackingClaim, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var claims []zonalBackingClaim
+	seen := map[string]bool{}
+
+	for _, entry := range strings.Split(value, ",") {
+		zone, ref, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		name, namespace := parseBackingClaimRef(ref, defaultNamespace)
+		if !ok || zone == "" || name == "" || namespace == "" {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"parameter \"zonalBackingClaims\" must be a comma-separated list of <zone>=[<namespace>/]<name>",
+			)
+		}
+		if seen[zone] {
+			return nil, status.Errorf(
+				codes.InvalidArgument, "parameter \"zonalBackingClaims\" lists zone \"%s\" more than once", zone,
+			)
+		}
+
+		seen[zone] = true
+		claims = append(claims, zonalBackingClaim{zone: zone, name: name, namespace: namespace})
+	}
+
+	return claims, nil
+}
+
+// Selects the backing volume of a new volume among the given zonal ones, from the first zone in the volume's
+// accessibility requirements (preferred zones first) that has one, or the first one if the requirements don't name any
+// zones. If required is given, only the backing volume that it names is considered, since clones and volumes created
+// from snapshots share backing chains with their sources, and retries must stick to the backing volume picked before.
+func selectZonalBackingClaim(
+	claims []zonalBackingClaim,
+	requirement *csi.TopologyRequirement,
+	required *common.BackingLocation,
+) (zonalBackingClaim, error) {
+	var zones []string
+	seen := map[string]bool{}
+	for _, topology := range append(requirement.GetPreferred(), requirement.GetRequisite()...) {
+		if zone := topology.GetSegments()[common.ZoneTopologyKey]; zone != "" && !seen[zone] {
+			seen[zone] = true
+			zones = append(zones, zone)
+		}
+	}
+
+	if len(zones) == 0 {
+		for _, claim := range claims {
+			zones = append(zones, claim.zone)
+		}
+	}
+
+	for _, zone := range zones {
+		for _, claim := range claims {
+			if claim.zone != zone {
+				continue
+			}
+			if required != nil && (claim.name != required.PvcName || claim.namespace != required.PvcNamespace) {
+				continue
+			}
+			return claim, nil
+		}
+	}
+
+	if required != nil {
+		return zonalBackingClaim{}, status.Errorf(
+			codes.ResourceExhausted,
+			"backing volume \"%s/%s\" isn't in any zone that the volume may be accessible from",
+			required.PvcNamespace, required.PvcName,
+		)
+	}
+
+	return zonalBackingClaim{}, status.Errorf(
+		codes.ResourceExhausted,
+		"none of the zones that the volume may be accessible from (%s) has a backing volume", strings.Join(zones, ", "),
+	)
+}
+
+// Returns the location of the volume or snapshot that a new volume is created from, if any.
+func (s *ControllerServer) sourceBackingLocation(
+	ctx context.Context,
+	contentSource *csi.VolumeContentSource,
+) (*common.BackingLocation, error) {
+	if source := contentSource.GetVolume(); source != nil {
+		pvc, err := common.FindPvcByLabelSelector(
+			ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, source.VolumeId))
+		if err != nil {
+			return nil, err
+		}
+		location := common.BackingLocationOf(&pvc.ObjectMeta)
+		return &location, nil
+	}
+
+	if source := contentSource.GetSnapshot(); source != nil {
+		volumeSnapshot, err := common.FindVolumeSnapshotByLabelSelector(
+			ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, source.SnapshotId))
+		if err != nil {
+			return nil, err
+		}
+		location := common.BackingLocationOf(&volumeSnapshot.ObjectMeta)
+		return &location, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseZonalBackingClaims(t *testing.T) {
+	tests := []struct {
+		value    string
+		want     []zonalBackingClaim
+		wantCode codes.Code
+	}{
+		{"", nil, codes.OK},
+		{
+			"zone-a=backing-a, zone-b=other-ns/backing-b",
+			[]zonalBackingClaim{{"zone-a", "backing-a", "default-ns"}, {"zone-b", "backing-b", "other-ns"}},
+			codes.OK,
+		},
+		{"zone-a", nil, codes.InvalidArgument},
+		{"=backing-a", nil, codes.InvalidArgument},
+		{"zone-a=", nil, codes.InvalidArgument},
+		{"zone-a=other-ns/", nil, codes.InvalidArgument},
+		{"zone-a=backing-a,zone-a=backing-b", nil, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		got, err := parseZonalBackingClaims(test.value, "default-ns")
+
+		if code := status.Code(err); code != test.wantCode {
+			t.Errorf("parseZonalBackingClaims(%q): got code %v, want %v", test.value, code, test.wantCode)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseZonalBackingClaims(%q): got %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestSelectZonalBackingClaim(t *testing.T) {
+	claims := []zonalBackingClaim{
+		{"zone-a", "backing-a", "ns"},
+		{"zone-b", "backing-b", "ns"},
+		{"zone-c", "backing-c", "ns"},
+	}
+
+	topology := func(zones ...string) []*csi.Topology {
+		var result []*csi.Topology
+		for _, zone := range zones {
+			result = append(result, &csi.Topology{Segments: map[string]string{common.ZoneTopologyKey: zone}})
+		}
+		return result
+	}
+
+	tests := []struct {
+		name        string
+		requirement *csi.TopologyRequirement
+		required    *common.BackingLocation
+		wantZone    string
+		wantCode    codes.Code
+	}{
+		{"no requirements", nil, nil, "zone-a", codes.OK},
+		{
+			"requirements without zones",
+			&csi.TopologyRequirement{Requisite: []*csi.Topology{{Segments: map[string]string{"rack": "1"}}}},
+			nil, "zone-a", codes.OK,
+		},
+		{
+			"requisite only",
+			&csi.TopologyRequirement{Requisite: topology("zone-x", "zone-c", "zone-b")},
+			nil, "zone-c", codes.OK,
+		},
+		{
+			"preferred first",
+			&csi.TopologyRequirement{Requisite: topology("zone-a", "zone-b"), Preferred: topology("zone-b")},
+			nil, "zone-b", codes.OK,
+		},
+		{
+			"no zone has a backing volume",
+			&csi.TopologyRequirement{Requisite: topology("zone-x")},
+			nil, "", codes.ResourceExhausted,
+		},
+		{
+			"source in an allowed zone",
+			&csi.TopologyRequirement{Requisite: topology("zone-a", "zone-c"), Preferred: topology("zone-a")},
+			&common.BackingLocation{PvcName: "backing-c", PvcNamespace: "ns"}, "zone-c", codes.OK,
+		},
+		{
+			"source in another zone",
+			&csi.TopologyRequirement{Requisite: topology("zone-a")},
+			&common.BackingLocation{PvcName: "backing-c", PvcNamespace: "ns"}, "", codes.ResourceExhausted,
+		},
+		{
+			"source not in a zonal backing volume",
+			nil,
+			&common.BackingLocation{PvcName: "backing-c", PvcNamespace: "other-ns"}, "", codes.ResourceExhausted,
+		},
+	}
+
+	for _, test := range tests {
+		claim, err := selectZonalBackingClaim(claims, test.requirement, test.required)
+
+		if code := status.Code(err); code != test.wantCode {
+			t.Errorf("%s: got code %v, want %v", test.name, code, test.wantCode)
+			continue
+		}
+		if claim.zone != test.wantZone {
+			t.Errorf("%s: got zone %q, want %q", test.name, claim.zone, test.wantZone)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/controller"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// How long the Job that checks the prerequisites on a node may take, which is mostly spent pulling the image.
+const doctorJobTimeout = 5 * time.Minute
+
+var doctorJobBackoffLimit int32 // failures are reported rather than retried
+
+// The oldest QEMU that has every qemu-img subcommand that the plugin uses ("qemu-img bitmap" was added last).
+const minQemuMajor, minQemuMinor = 5, 2
+
+// The permissions that the controller plugin itself needs, as granted by the subprovisioner-csi-controller-plugin
+// ClusterRole in deployment.yaml (which additionally grants those that the sidecars need).
+var controllerPluginPermissions = []struct {
+	group    string
+	resource string
+	verbs    []string
+}{
+	{"", "persistentvolumeclaims", []string{"get", "list", "watch", "create", "patch", "update", "delete"}},
+	{"", "persistentvolumes", []string{"get", "list", "create", "patch", "update"}},
+	{"batch", "jobs", []string{"get", "list", "create", "delete"}},
+	{"", "pods", []string{"list"}},
+	{"", "pods/log", []string{"get"}},
+	{"apps", "replicasets", []string{"get", "list", "create", "delete"}},
+	{"", "nodes", []string{"get"}},
+	{"", "configmaps", []string{"get", "list", "create", "update"}},
+	{"", "events", []string{"create"}},
+	{"storage.k8s.io", "storageclasses", []string{"get", "list"}},
+	{"snapshot.storage.k8s.io", "volumesnapshots", []string{"get", "list", "patch", "update"}},
+	{common.Group, "imagecatalogs", []string{"get"}},
+	{common.Group, "volumereplications", []string{"get", "list", "create", "delete"}},
+	{common.Group, "volumeexports", []string{"list"}},
+	{common.Group, "volumeimports", []string{"list"}},
+}
+
+type DoctorOptions struct {
+	// The service account of the controller plugin, as "<namespace>/<name>", whose permissions to check. If empty,
+	// those of whoever runs the command are checked, which are the controller plugin's when run in its pod.
+	ServiceAccount string
+
+	// Namespace in which to run the Jobs that check the prerequisites on each node.
+	Namespace string
+}
+
+type doctorReport struct {
+	out      io.Writer
+	problems int
+	warnings int
+}
+
+func (r *doctorReport) ok(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "OK       "+format+"\n", args...)
+}
+
+func (r *doctorReport) warn(format string, args ...interface{}) {
+	r.warnings++
+	fmt.Fprintf(r.out, "WARNING  "+format+"\n", args...)
+}
+
+func (r *doctorReport) problem(format string, args ...interface{}) {
+	r.problems++
+	fmt.Fprintf(r.out, "PROBLEM  "+format+"\n", args...)
+}
+
+// Checks the prerequisites of the driver in the cluster, whose absence would otherwise only show as volumes that never
+// get provisioned or staged, and reports the outcome of each check: the controller plugin's permissions, the backing
+// PVCs that StorageClasses refer to, the volume snapshot CRDs, and the NBD support, qemu versions, and node plugin
+// registration on each node. Returns whether no problems were found (warnings are fine).
+//
+// Like the backing-chains command, this runs from an operator's machine or in the controller plugin's pod. It mounts
+// backing volumes and checks nodes with Jobs that run the given plugin image.
+func RunDoctor(out io.Writer, image string, options DoctorOptions) (bool, error) {
+	ctx := context.Background()
+
+	clientset, err := newCliClientset()
+	if err != nil {
+		return false, err
+	}
+
+	report := &doctorReport{out: out}
+
+	fmt.Fprintln(out, "Permissions:")
+	err = checkPermissions(ctx, clientset, options.ServiceAccount, report)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintln(out, "\nBacking volumes:")
+	err = checkBackingVolumes(ctx, clientset, image, report)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintln(out, "\nVolume snapshots:")
+	checkSnapshotCrds(ctx, clientset, report)
+
+	fmt.Fprintln(out, "\nNodes:")
+	err = checkNodes(ctx, clientset, image, options.Namespace, report)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(out, "\n%d problems, %d warnings.\n", report.problems, report.warnings)
+
+	return report.problems == 0, nil
+}
+
+func checkPermissions(
+	ctx context.Context,
+	clientset *common.Clientset,
+	serviceAccount string,
+	report *doctorReport,
+) error {
+	var user string
+	var groups []string
+	if serviceAccount != "" {
+		namespace, name, ok := strings.Cut(serviceAccount, "/")
+		if !ok || namespace == "" || name == "" {
+			return fmt.Errorf("invalid service account \"%s\", must be \"<namespace>/<name>\"", serviceAccount)
+		}
+		user = fmt.Sprintf("system:serviceaccount:%s:%s", namespace, name)
+		groups = []string{"system:serviceaccounts", "system:serviceaccounts:" + namespace, "system:authenticated"}
+	}
+
+	missing := 0
+
+	for _, permission := range controllerPluginPermissions {
+		for _, verb := range permission.verbs {
+			resource, subresource, _ := strings.Cut(permission.resource, "/")
+			attributes := &authorizationv1.ResourceAttributes{
+				Verb:        verb,
+				Group:       permission.group,
+				Resource:    resource,
+				Subresource: subresource,
+			}
+
+			var allowed bool
+			var err error
+			if user == "" {
+				var review *authorizationv1.SelfSubjectAccessReview
+				review, err = clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(
+					ctx,
+					&authorizationv1.SelfSubjectAccessReview{
+						Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attributes},
+					},
+					metav1.CreateOptions{},
+				)
+				allowed = err == nil && review.Status.Allowed
+			} else {
+				var review *authorizationv1.SubjectAccessReview
+				review, err = clientset.AuthorizationV1().SubjectAccessReviews().Create(
+					ctx,
+					&authorizationv1.SubjectAccessReview{
+						Spec: authorizationv1.SubjectAccessReviewSpec{
+							ResourceAttributes: attributes,
+							User:               user,
+							Groups:             groups,
+						},
+					},
+					metav1.CreateOptions{},
+				)
+				allowed = err == nil && review.Status.Allowed
+			}
+			if err != nil {
+				return fmt.Errorf("failed to review permissions: %w", err)
+			}
+
+			if !allowed {
+				missing++
+				report.problem("can't %s %s", verb, qualifiedResource(permission.group, permission.resource))
+			}
+		}
+	}
+
+	if missing == 0 {
+		report.ok("all permissions that the controller plugin needs are granted")
+	}
+
+	return nil
+}
+
+func qualifiedResource(group string, resource string) string {
+	if group == "" {
+		return resource
+	}
+	return resource + "." + group
+}
+
+func checkBackingVolumes(
+	ctx context.Context,
+	clientset *common.Clientset,
+	image string,
+	report *doctorReport,
+) error {
+	storageClasses, err := clientset.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	// the StorageClasses that refer to each backing volume, which may do so with different base paths
+
+	referrers := map[common.BackingLocation][]string{}
+	for i := range storageClasses.Items {
+		storageClass := &storageClasses.Items[i]
+		if storageClass.Provisioner != common.Domain {
+			continue
+		}
+		for _, location := range controller.StorageClassLocations(storageClass.Parameters) {
+			referrers[location] = append(referrers[location], storageClass.Name)
+		}
+	}
+
+	if len(referrers) == 0 {
+		report.warn("no StorageClass has provisioner %s", common.Domain)
+		return nil
+	}
+
+	locations := make([]common.BackingLocation, 0, len(referrers))
+	for location := range referrers {
+		locations = append(locations, location)
+	}
+	sort.Slice(locations, func(i, j int) bool {
+		return fmt.Sprint(locations[i]) < fmt.Sprint(locations[j])
+	})
+
+	for _, location := range locations {
+		description := fmt.Sprintf(
+			"backing PVC %s in namespace %s, base path \"%s\" (StorageClass %s)",
+			location.PvcName, location.PvcNamespace, location.BasePath, strings.Join(referrers[location], ", "),
+		)
+
+		pvc, err := clientset.CoreV1().PersistentVolumeClaims(location.PvcNamespace).
+			Get(ctx, location.PvcName, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			report.problem("%s doesn't exist", description)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if pvc.Status.Phase != corev1.ClaimBound {
+			report.problem("%s isn't bound", description)
+			continue
+		}
+
+		if !hasAccessMode(pvc, corev1.ReadWriteMany) {
+			report.warn("%s isn't ReadWriteMany, so volumes can only be used on one node at a time", description)
+		}
+
+		usage, err := common.MeasureBackingUsage(ctx, clientset, image, location)
+		if err != nil {
+			report.problem("%s can't be mounted: %v", description, err)
+			continue
+		}
+
+		report.ok("%s is mounted fine and %.0f%% full", description, 100*usage.UsedFraction())
+	}
+
+	return nil
+}
+
+func hasAccessMode(pvc *corev1.PersistentVolumeClaim, mode corev1.PersistentVolumeAccessMode) bool {
+	for _, m := range pvc.Status.AccessModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func checkSnapshotCrds(ctx context.Context, clientset *common.Clientset, report *doctorReport) {
+	_, err := clientset.SnapshotV1().VolumeSnapshots(metav1.NamespaceAll).List(ctx, metav1.ListOptions{Limit: 1})
+
+	switch {
+	case k8serrors.IsNotFound(err):
+		report.warn("the volume snapshot CRDs aren't installed, so volumes can't be snapshotted")
+	case err != nil:
+		report.problem("the volume snapshot CRDs can't be listed: %v", err)
+	default:
+		report.ok("the volume snapshot CRDs are installed")
+	}
+}
+
+// What the Job that the doctor command runs on a node found.
+type nodeDiagnosis struct {
+	kernel            string
+	nbd               string // "devices", "loaded" (without devices), "loadable", or "missing"
+	qemuImg           string // version line, or "" if missing
+	qemuStorageDaemon string // version line, or "" if missing
+}
+
+func checkNodes(
+	ctx context.Context,
+	clientset *common.Clientset,
+	image string,
+	namespace string,
+	report *doctorReport,
+) error {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	csiNodes, err := clientset.StorageV1().CSINodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	registered := map[string]bool{}
+	for i := range csiNodes.Items {
+		for _, driver := range csiNodes.Items[i].Spec.Drivers {
+			if driver.Name == common.Domain {
+				registered[csiNodes.Items[i].Name] = true
+			}
+		}
+	}
+
+	// diagnose all nodes at once, as each Job mostly waits for its image to be pulled
+
+	diagnoses := make([]nodeDiagnosis, len(nodes.Items))
+	errs := make([]error, len(nodes.Items))
+
+	var wg sync.WaitGroup
+	for i := range nodes.Items {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			diagnoses[i], errs[i] = diagnoseNode(ctx, clientset, image, namespace, nodes.Items[i].Name)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range nodes.Items {
+		name := nodes.Items[i].Name
+
+		if !registered[name] {
+			report.warn("node %s: the node plugin isn't registered, so volumes can't be used on it", name)
+		}
+
+		if errs[i] != nil {
+			report.problem("node %s: couldn't be checked: %v", name, errs[i])
+			continue
+		}
+
+		diagnosis := diagnoses[i]
+
+		switch diagnosis.nbd {
+		case "devices":
+			report.ok("node %s: NBD devices are available (kernel %s)", name, diagnosis.kernel)
+		case "loaded":
+			report.problem("node %s: the nbd kernel module is loaded but there are no NBD devices", name)
+		case "loadable":
+			report.ok("node %s: the nbd kernel module will be loaded when needed (kernel %s)", name, diagnosis.kernel)
+		default:
+			report.problem("node %s: the nbd kernel module isn't available for kernel %s", name, diagnosis.kernel)
+		}
+
+		if !qemuVersionAtLeast(diagnosis.qemuImg, minQemuMajor, minQemuMinor) {
+			report.problem(
+				"node %s: qemu-img must be at least version %d.%d, but is \"%s\"",
+				name, minQemuMajor, minQemuMinor, diagnosis.qemuImg,
+			)
+		}
+
+		if diagnosis.qemuStorageDaemon == "" {
+			report.warn(
+				"node %s: qemu-storage-daemon is missing, so volumes can only be staged with --qemu-nbd-fallback", name,
+			)
+		} else {
+			report.ok("node %s: %s", name, diagnosis.qemuStorageDaemon)
+		}
+	}
+
+	return nil
+}
+
+// Runs a Job on the given node that checks its NBD support and the qemu versions in the image.
+func diagnoseNode(
+	ctx context.Context,
+	clientset *common.Clientset,
+	image string,
+	namespace string,
+	nodeName string,
+) (nodeDiagnosis, error) {
+	// NBD devices appear in /sys/block once the nbd kernel module is loaded, which the node plugin does if it can
+	// find the module under /lib/modules (see node.NbdModuleOptions)
+
+	diagnosisScript := dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset
+		shopt -s nullglob
+		kernel="$( uname -r )"
+		echo "kernel ${kernel}"
+		devices=( /sys/block/nbd* )
+		modules=( "/lib/modules/${kernel}"/kernel/drivers/block/nbd.ko* )
+		if (( ${#devices[@]} > 0 )); then
+		    echo "nbd devices"
+		elif [[ -d /sys/module/nbd ]]; then
+		    echo "nbd loaded"
+		elif (( ${#modules[@]} > 0 )) || grep -q '/nbd\.ko' "/lib/modules/${kernel}/modules.builtin" 2> /dev/null; then
+		    echo "nbd loadable"
+		else
+		    echo "nbd missing"
+		fi
+		echo "qemu-img $( qemu-img --version 2> /dev/null | head -n 1 || true )"
+		echo "qemu-storage-daemon $( qemu-storage-daemon --version 2> /dev/null | head -n 1 || true )"
+		echo done
+		`,
+	)
+
+	jobName := common.GenerateDoctorJobName(nodeName)
+
+	err := common.CreateJob(
+		ctx, clientset,
+		common.JobConfig{
+			Name:      jobName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				common.Domain + "/component": "doctor",
+			},
+			Image:          image,
+			Command:        []string{"bash", "-c", diagnosisScript},
+			NodeName:       nodeName,
+			HostPathMounts: []string{"/lib/modules"},
+			BackoffLimit:   &doctorJobBackoffLimit,
+		},
+	)
+	if err != nil {
+		return nodeDiagnosis{}, err
+	}
+
+	defer func() {
+		_ = common.DeleteJobSynchronously(context.Background(), clientset, jobName, namespace)
+	}()
+
+	err = common.WaitForJobToSucceedWithin(ctx, clientset, jobName, namespace, doctorJobTimeout)
+	if err != nil {
+		return nodeDiagnosis{}, err
+	}
+
+	logs, err := common.GetJobLogs(ctx, clientset, jobName, namespace)
+	if err != nil {
+		return nodeDiagnosis{}, err
+	}
+
+	return parseNodeDiagnosis(string(logs))
+}
+
+// Parses the output of the Job that diagnoses a node.
+func parseNodeDiagnosis(logs string) (nodeDiagnosis, error) {
+	var diagnosis nodeDiagnosis
+
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		value = strings.TrimSpace(value)
+		switch key {
+		case "kernel":
+			diagnosis.kernel = value
+		case "nbd":
+			diagnosis.nbd = value
+		case "qemu-img":
+			diagnosis.qemuImg = value
+		case "qemu-storage-daemon":
+			diagnosis.qemuStorageDaemon = value
+		case "done":
+			return diagnosis, nil
+		}
+	}
+
+	return nodeDiagnosis{}, fmt.Errorf("node diagnosis didn't complete")
+}
+
+// Returns whether the given "... version X.Y.Z ..." line, as output by the --version option of qemu tools, is of at
+// least the given version.
+func qemuVersionAtLeast(versionLine string, major int, minor int) bool {
+	fields := strings.Fields(versionLine)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] != "version" {
+			continue
+		}
+
+		parts := strings.SplitN(fields[i+1], ".", 3)
+		if len(parts) < 2 {
+			return false
+		}
+		gotMajor, err1 := strconv.Atoi(parts[0])
+		gotMinor, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		return gotMajor > major || (gotMajor == major && gotMinor >= minor)
+	}
+	return false
+}
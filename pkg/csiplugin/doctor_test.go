@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"testing"
+)
+
+func TestParseNodeDiagnosis(t *testing.T) {
+	diagnosis, err := parseNodeDiagnosis(
+		"kernel 6.1.0-13-amd64\n" +
+			"nbd loadable\n" +
+			"qemu-img qemu-img version 7.0.0 (qemu-7.0.0-15.fc37)\n" +
+			"qemu-storage-daemon \n" +
+			"done\n",
+	)
+	want := nodeDiagnosis{
+		kernel:  "6.1.0-13-amd64",
+		nbd:     "loadable",
+		qemuImg: "qemu-img version 7.0.0 (qemu-7.0.0-15.fc37)",
+	}
+	if err != nil || diagnosis != want {
+		t.Errorf("got %+v, %v", diagnosis, err)
+	}
+
+	if _, err := parseNodeDiagnosis("kernel 6.1.0-13-amd64\n"); err == nil {
+		t.Errorf("expected error for truncated output")
+	}
+}
+
+func TestQemuVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		versionLine string
+		want        bool
+	}{
+		{"qemu-img version 7.0.0 (qemu-7.0.0-15.fc37)", true},
+		{"qemu-img version 5.2.0", true},
+		{"qemu-img version 5.1.0", false},
+		{"qemu-img version 4.2.1 (Debian 1:4.2-3ubuntu6)", false},
+		{"qemu-storage-daemon version 10.0.2", true},
+		{"", false},
+		{"qemu-img version unknown", false},
+	}
+	for _, test := range tests {
+		if got := qemuVersionAtLeast(test.versionLine, 5, 2); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.versionLine, got, test.want)
+		}
+	}
+}
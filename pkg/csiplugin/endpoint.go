@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// The endpoint that the CSI sidecars and kubelet expect the plugins to serve at.
+const DefaultEndpoint = "unix:///run/csi/socket"
+
+// Where a plugin serves its CSI gRPC server.
+type Endpoint struct {
+	// "unix://<path>" or "tcp://<host>:<port>". Serving over TCP is meant for running test harnesses such as
+	// csi-sanity against a plugin from outside its pod, and requires mutual TLS unless the host is a loopback address.
+	Address string
+
+	// PEM files with the certificate and key to serve TCP endpoints over TLS with, and the CA certificates that
+	// clients must present certificates signed by.
+	TlsCertFile     string
+	TlsKeyFile      string
+	TlsClientCaFile string
+}
+
+// Splits an endpoint address into the network and address to listen on.
+func parseEndpointAddress(address string) (string, string, error) {
+	network, rest, ok := strings.Cut(address, "://")
+	if !ok || rest == "" || (network != "unix" && network != "tcp") {
+		return "", "", fmt.Errorf(
+			"invalid endpoint \"%s\", must be \"unix://<path>\" or \"tcp://<host>:<port>\"", address,
+		)
+	}
+
+	if network == "tcp" {
+		if _, _, err := net.SplitHostPort(rest); err != nil {
+			return "", "", fmt.Errorf("invalid endpoint \"%s\": %w", address, err)
+		}
+	}
+
+	return network, rest, nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Returns the options with which to create the gRPC server for the given endpoint, failing if its TLS configuration
+// doesn't suit it.
+func (e *Endpoint) serverOptions() ([]grpc.ServerOption, error) {
+	network, address, err := parseEndpointAddress(e.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	useTls := e.TlsCertFile != "" || e.TlsKeyFile != "" || e.TlsClientCaFile != ""
+
+	switch {
+	case network == "unix" && useTls:
+		return nil, fmt.Errorf("TLS is only supported for TCP endpoints")
+	case network == "unix":
+		return nil, nil
+	case !useTls:
+		host, _, _ := net.SplitHostPort(address)
+		if !isLoopbackHost(host) {
+			return nil, fmt.Errorf(
+				"refusing to serve at non-loopback endpoint \"%s\" without mutual TLS; "+
+					"specify a TLS certificate, key, and client CA", e.Address,
+			)
+		}
+		return nil, nil
+	case e.TlsCertFile == "" || e.TlsKeyFile == "" || e.TlsClientCaFile == "":
+		return nil, fmt.Errorf("serving over TLS requires a certificate, a key, and a client CA")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(e.TlsCertFile, e.TlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	clientCaPem, err := os.ReadFile(e.TlsClientCaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS client CA: %w", err)
+	}
+
+	clientCas := x509.NewCertPool()
+	if !clientCas.AppendCertsFromPEM(clientCaPem) {
+		return nil, fmt.Errorf("no certificates found in TLS client CA file %s", e.TlsClientCaFile)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCas,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(config))}, nil
+}
+
+// Listens at the given endpoint, replacing any stale unix socket.
+func (e *Endpoint) listen() (net.Listener, error) {
+	network, address, err := parseEndpointAddress(e.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		err = os.Remove(address)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"testing"
+)
+
+func TestParseEndpointAddress(t *testing.T) {
+	tests := []struct {
+		address     string
+		wantNetwork string
+		wantAddress string
+	}{
+		{"unix:///run/csi/socket", "unix", "/run/csi/socket"},
+		{"tcp://127.0.0.1:10000", "tcp", "127.0.0.1:10000"},
+		{"tcp://:10000", "tcp", ":10000"},
+	}
+	for _, test := range tests {
+		network, address, err := parseEndpointAddress(test.address)
+		if err != nil || network != test.wantNetwork || address != test.wantAddress {
+			t.Errorf("%s: got %s, %s, %v", test.address, network, address, err)
+		}
+	}
+
+	for _, address := range []string{"/run/csi/socket", "unix://", "udp://127.0.0.1:1", "tcp://127.0.0.1"} {
+		if _, _, err := parseEndpointAddress(address); err == nil {
+			t.Errorf("%s: expected error", address)
+		}
+	}
+}
+
+func TestEndpointServerOptions(t *testing.T) {
+	for _, endpoint := range []Endpoint{
+		{Address: DefaultEndpoint},
+		{Address: "tcp://127.0.0.1:10000"},
+		{Address: "tcp://[::1]:10000"},
+		{Address: "tcp://localhost:10000"},
+	} {
+		if options, err := endpoint.serverOptions(); err != nil || len(options) != 0 {
+			t.Errorf("%+v: got %v, %v", endpoint, options, err)
+		}
+	}
+
+	for _, endpoint := range []Endpoint{
+		{Address: "tcp://:10000"},
+		{Address: "tcp://10.0.0.1:10000"},
+		{Address: DefaultEndpoint, TlsCertFile: "tls.crt", TlsKeyFile: "tls.key", TlsClientCaFile: "ca.crt"},
+		{Address: "tcp://10.0.0.1:10000", TlsCertFile: "tls.crt", TlsKeyFile: "tls.key"},
+		{
+			Address:         "tcp://10.0.0.1:10000",
+			TlsCertFile:     "missing.crt",
+			TlsKeyFile:      "missing.key",
+			TlsClientCaFile: "ca.crt",
+		},
+	} {
+		if _, err := endpoint.serverOptions(); err == nil {
+			t.Errorf("%+v: expected error", endpoint)
+		}
+	}
+}
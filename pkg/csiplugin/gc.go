@@ -0,0 +1,646 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// How long scanning a backing location, or deleting the garbage found in it, may take. Both inspect every image in
+// the backing location.
+const garbageJobTimeout = 30 * time.Minute
+
+var garbageJobBackoffLimit int32 = 1
+
+type GarbageCollectionOptions struct {
+	// Whether to delete the garbage found, instead of only reporting it.
+	Delete bool
+
+	// How old Jobs and ReplicaSets must be to be considered garbage, so as not to race with their creation.
+	MinAge time.Duration
+}
+
+// The volumes, snapshots, and nodes that exist, which the images, Jobs, and ReplicaSets left behind by those that no
+// longer exist are told apart from.
+type garbageInventory struct {
+	// uids of PVCs and of the volumes of PVCs and PVs, which the labels and image names of volumes may refer to
+	volumes map[types.UID]bool
+
+	// uids of VolumeSnapshots, or nil if the volume snapshot CRDs aren't installed and so it can't be told which
+	// snapshots exist
+	snapshots map[types.UID]bool
+
+	nodes map[string]bool
+
+	// the backing locations that hold or held volumes or snapshots
+	locations map[common.BackingLocation]bool
+}
+
+// Scans all backing locations and the cluster for images, Jobs, and ReplicaSets left behind by volumes and snapshots
+// that no longer exist, e.g., after an incident interrupted their deletion, and reports them, deleting them too if
+// requested. Images that other images are backed by are never garbage.
+//
+// Like the backing-chains command, this runs from an operator's machine or as a Job. It scans backing locations with
+// Jobs that run the given plugin image. Does nothing outside of the maintenance window, if any, so that it can be run
+// periodically, e.g., by a CronJob.
+func CollectGarbage(out io.Writer, image string, options GarbageCollectionOptions) error {
+	ctx := context.Background()
+
+	if !common.InMaintenanceWindow(time.Now()) {
+		fmt.Fprintln(out, "Outside of the maintenance window, not collecting garbage.")
+		return nil
+	}
+
+	clientset, err := newCliClientset()
+	if err != nil {
+		return err
+	}
+
+	inventory, err := takeGarbageInventory(ctx, clientset)
+	if err != nil {
+		return err
+	}
+
+	found := 0
+
+	report := func(format string, args ...interface{}) {
+		found++
+		fmt.Fprintf(out, format+"\n", args...)
+	}
+
+	// images
+
+	locations := make([]common.BackingLocation, 0, len(inventory.locations))
+	for location := range inventory.locations {
+		locations = append(locations, location)
+	}
+	sort.Slice(locations, func(i, j int) bool {
+		return fmt.Sprint(locations[i]) < fmt.Sprint(locations[j])
+	})
+
+	for _, location := range locations {
+		garbage, err := scanBackingLocationForGarbage(ctx, clientset, image, location, inventory)
+		if err != nil {
+			fmt.Fprintf(
+				out, "Skipping backing PVC %s in namespace %s, base path \"%s\": %v\n",
+				location.PvcName, location.PvcNamespace, location.BasePath, err,
+			)
+			continue
+		}
+
+		deleted := map[string]bool{}
+		if options.Delete && len(garbage) > 0 {
+			deleted, err = deleteGarbageImages(ctx, clientset, image, location, garbage)
+			if err != nil {
+				fmt.Fprintf(
+					out, "Failed to delete garbage in backing PVC %s in namespace %s, base path \"%s\": %v\n",
+					location.PvcName, location.PvcNamespace, location.BasePath, err,
+				)
+			}
+		}
+
+		for _, name := range garbage {
+			reason, _ := garbageImageReason(name, inventory)
+			report(
+				"Orphaned image %s in backing PVC %s in namespace %s, base path \"%s\" (%s)%s",
+				name, location.PvcName, location.PvcNamespace, location.BasePath, reason, deletedSuffix(deleted[name]),
+			)
+		}
+	}
+
+	// Jobs and ReplicaSets
+
+	now := time.Now()
+	listOptions := metav1.ListOptions{LabelSelector: common.Domain + "/component"}
+
+	jobs, err := clientset.BatchV1().Jobs(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+
+		reason, ok := garbageJobReason(job, inventory, now, options.MinAge)
+		if !ok {
+			continue
+		}
+
+		deleted := false
+		if options.Delete {
+			err := common.DeleteJobSynchronously(ctx, clientset, job.Name, job.Namespace)
+			if err != nil {
+				fmt.Fprintf(out, "Failed to delete Job %s in namespace %s: %v\n", job.Name, job.Namespace, err)
+			}
+			deleted = err == nil
+		}
+
+		report("Orphaned Job %s in namespace %s (%s)%s", job.Name, job.Namespace, reason, deletedSuffix(deleted))
+	}
+
+	replicaSets, err := clientset.AppsV1().ReplicaSets(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+
+	for i := range replicaSets.Items {
+		replicaSet := &replicaSets.Items[i]
+
+		reason, ok := garbageReplicaSetReason(replicaSet, inventory, now, options.MinAge)
+		if !ok {
+			continue
+		}
+
+		deleted := false
+		if options.Delete {
+			err := common.DeleteReplicaSetSynchronously(ctx, clientset, replicaSet.Name, replicaSet.Namespace)
+			if err != nil {
+				fmt.Fprintf(
+					out, "Failed to delete ReplicaSet %s in namespace %s: %v\n",
+					replicaSet.Name, replicaSet.Namespace, err,
+				)
+			}
+			deleted = err == nil
+		}
+
+		report(
+			"Orphaned ReplicaSet %s in namespace %s (%s)%s",
+			replicaSet.Name, replicaSet.Namespace, reason, deletedSuffix(deleted),
+		)
+	}
+
+	switch {
+	case found == 0:
+		fmt.Fprintln(out, "No garbage found.")
+	case !options.Delete:
+		fmt.Fprintf(out, "Found %d orphaned objects; run with --delete to delete them.\n", found)
+	}
+
+	return nil
+}
+
+func deletedSuffix(deleted bool) string {
+	if deleted {
+		return ": deleted"
+	}
+	return ""
+}
+
+func takeGarbageInventory(ctx context.Context, clientset *common.Clientset) (*garbageInventory, error) {
+	inventory := &garbageInventory{
+		volumes:   map[types.UID]bool{},
+		nodes:     map[string]bool{},
+		locations: map[common.BackingLocation]bool{},
+	}
+
+	pvcs, err := clientset.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		inventory.volumes[pvc.UID] = true
+		if uid := common.VolumeUidOf(pvc); uid != "" {
+			inventory.volumes[uid] = true
+			inventory.locations[common.BackingLocationOf(&pvc.ObjectMeta)] = true
+			if mirror, mirrored := common.MirrorLocationOf(&pvc.ObjectMeta); mirrored {
+				inventory.locations[mirror] = true
+			}
+		}
+	}
+
+	// retained volumes outlive their PVCs, and are keyed by their PVs' volume handles
+
+	pvs, err := clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == common.Domain {
+			inventory.volumes[types.UID(pv.Spec.CSI.VolumeHandle)] = true
+		}
+	}
+
+	volumeSnapshots, err := clientset.SnapshotV1().VolumeSnapshots(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, err
+	} else if err == nil {
+		inventory.snapshots = map[types.UID]bool{}
+		for i := range volumeSnapshots.Items {
+			volumeSnapshot := &volumeSnapshots.Items[i]
+			inventory.snapshots[volumeSnapshot.UID] = true
+			if volumeSnapshot.Labels[common.Domain+"/uid"] != "" {
+				inventory.locations[common.BackingLocationOf(&volumeSnapshot.ObjectMeta)] = true
+			}
+		}
+	}
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range nodes.Items {
+		inventory.nodes[nodes.Items[i].Name] = true
+	}
+
+	// backing locations that no longer hold any volume or snapshot may still hold their leftovers
+
+	chains, err := common.ListBackingChains(ctx, clientset)
+	if err != nil {
+		return nil, err
+	}
+	for location := range chains {
+		inventory.locations[location] = true
+	}
+
+	return inventory, nil
+}
+
+// Lists the files in the given backing location with a Job, and returns those that are garbage, in the order in which
+// they can be deleted (see garbageImages()).
+func scanBackingLocationForGarbage(
+	ctx context.Context,
+	clientset *common.Clientset,
+	image string,
+	location common.BackingLocation,
+	inventory *garbageInventory,
+) ([]string, error) {
+	_, err := clientset.CoreV1().PersistentVolumeClaims(location.PvcNamespace).
+		Get(ctx, location.PvcName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	err = common.CheckBackingPvcMaintenance(ctx, clientset, location.PvcName, location.PvcNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	rawImageNames, err := common.ListRawImageNames(ctx, clientset, location)
+	if err != nil {
+		return nil, err
+	}
+
+	// images may be in use, hence --force-share; temporary files are only listed, as they may be incomplete; raw
+	// images have no backing files, and aren't opened so that no forged qcow2 header in them is taken for real
+
+	scanScript := common.ImageFormatFunction + dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset
+		shopt -s nullglob
+		raw_image_names="$1"
+		cd /var/backing
+		for image in *.qcow2; do
+		    if [[ "$( image_format "${image}" )" == raw ]]; then
+		        echo "image ${image}"
+		        continue
+		    fi
+		    info="$( qemu-img info -f qcow2 --force-share --output=json "${image}" )" || info="{}"
+		    backing="$( jq -r '.["backing-filename"] // empty' <<< "${info}" )"
+		    echo "image ${image} ${backing}"
+		done
+		for file in *.qcow2.new *.qcow2.tmp; do
+		    echo "image ${file}"
+		done
+		echo done
+		`,
+	)
+
+	logs, err := runGarbageJob(
+		ctx, clientset, image, location, common.GenerateGarbageScanJobName(location), "garbage-scan",
+		[]string{"bash", "-c", scanScript, "bash", common.RawImageNamesArg(rawImageNames)},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := parseGarbageScanOutput(logs)
+	if err != nil {
+		return nil, err
+	}
+
+	return garbageImages(files, inventory), nil
+}
+
+// Deletes the given files from the given backing location with a Job, except those that another image turns out to
+// be backed by. Returns the files that were deleted.
+func deleteGarbageImages(
+	ctx context.Context,
+	clientset *common.Clientset,
+	image string,
+	location common.BackingLocation,
+	names []string,
+) (map[string]bool, error) {
+	rawImageNames, err := common.ListRawImageNames(ctx, clientset, location)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteScript := common.ImageFormatFunction + dedent.Dedent(
+		`
+		set -o errexit -o pipefail -o nounset -o xtrace
+		shopt -s nullglob
+		raw_image_names="$1"
+		shift
+		cd /var/backing
+		for name in "$@"; do
+		    for image in *.qcow2; do
+		        [[ "${image}" != "${name}" ]] || continue
+		        [[ "$( image_format "${image}" )" != raw ]] || continue
+		        info="$( qemu-img info -f qcow2 --force-share --output=json "${image}" )" ||
+		            { has_qcow2_magic "${image}" && exit 1; info="{}"; }
+		        if [[ "$( jq -r '.["backing-filename"] // empty' <<< "${info}" )" == "${name}" ]]; then
+		            continue 2
+		        fi
+		    done
+		    rm -f "${name}"
+		    echo "deleted ${name}"
+		done
+		`,
+	)
+
+	logs, err := runGarbageJob(
+		ctx, clientset, image, location, common.GenerateGarbageCollectionJobName(location), "garbage-collection",
+		append([]string{"bash", "-c", deleteScript, "bash", common.RawImageNamesArg(rawImageNames)}, names...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "deleted ") {
+			deleted[strings.TrimPrefix(line, "deleted ")] = true
+		}
+	}
+
+	err = common.RecordBackingChainChanges(ctx, clientset, location, func(chains common.BackingChains) {
+		for name := range deleted {
+			delete(chains, name)
+		}
+	})
+	if err != nil {
+		// the next periodic refresh of backing chains catches up
+		klog.ErrorS(
+			err, "Failed to record backing chain changes",
+			"backingPvc", klog.KRef(location.PvcNamespace, location.PvcName),
+		)
+	}
+
+	if len(deleted) > 0 {
+		deletedNames := make([]string, 0, len(deleted))
+		for name := range deleted {
+			deletedNames = append(deletedNames, name)
+		}
+		sort.Strings(deletedNames)
+
+		err = common.EmitBackingPvcEvent(
+			ctx, clientset, location.PvcName, location.PvcNamespace, corev1.EventTypeNormal, "GarbageCollected",
+			"Deleted %d orphaned images in base path \"%s\": %s",
+			len(deletedNames), location.BasePath, strings.Join(deletedNames, ", "),
+		)
+		if err != nil {
+			klog.ErrorS(err, "Failed to emit event", "backingPvc", klog.KRef(location.PvcNamespace, location.PvcName))
+		}
+	}
+
+	return deleted, nil
+}
+
+func runGarbageJob(
+	ctx context.Context,
+	clientset *common.Clientset,
+	image string,
+	location common.BackingLocation,
+	jobName string,
+	component string,
+	command []string,
+) (string, error) {
+	err := common.CreateJob(
+		ctx, clientset,
+		common.JobConfig{
+			Name:      jobName,
+			Namespace: location.PvcNamespace,
+			Labels: map[string]string{
+				common.Domain + "/component": component,
+			},
+			Image:              image,
+			Command:            command,
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			BackoffLimit:       &garbageJobBackoffLimit,
+			Maintenance:        true,
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		_ = common.DeleteJobSynchronously(context.Background(), clientset, jobName, location.PvcNamespace)
+	}()
+
+	err = common.WaitForJobToSucceedWithin(ctx, clientset, jobName, location.PvcNamespace, garbageJobTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	logs, err := common.GetJobLogs(ctx, clientset, jobName, location.PvcNamespace)
+	if err != nil {
+		return "", err
+	}
+
+	return string(logs), nil
+}
+
+// Parses the output of the garbage scan Job into the files in the backing location, mapped to their backing files.
+func parseGarbageScanOutput(logs string) (common.BackingChains, error) {
+	files := common.BackingChains{}
+
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 1 && fields[0] == "done":
+			return files, nil
+		case len(fields) == 2 && fields[0] == "image":
+			files[fields[1]] = ""
+		case len(fields) == 3 && fields[0] == "image":
+			files[fields[1]] = fields[2]
+		}
+	}
+
+	return nil, fmt.Errorf("garbage scan didn't complete")
+}
+
+// Returns the files among the given ones that were left behind by volumes or snapshots that no longer exist: images of
+// volumes, snapshots, and clones, their replication deltas, and temporary files that operations on them left behind.
+// Images that images other than garbage are backed by aren't garbage, and neither are the images in the trash, sticky
+// images, and copies of catalog images, which are managed elsewhere.
+//
+// Files are returned in the order in which they can be deleted, i.e., every image before its backing file, and
+// otherwise sorted, so that a chain of garbage, e.g., the image of a deleted volume and the common ancestor that it
+// shared with a deleted clone, is deleted in one go.
+func garbageImages(files common.BackingChains, inventory *garbageInventory) []string {
+	// the number of garbage candidates that each garbage candidate is the backing file of
+	dependents := map[string]int{}
+	for name := range files {
+		if _, ok := garbageImageReason(name, inventory); ok {
+			dependents[name] = 0
+		}
+	}
+	for name := range dependents {
+		if _, ok := dependents[files[name]]; ok {
+			dependents[files[name]]++
+		}
+	}
+
+	// candidates that something other than garbage is backed by aren't garbage, nor are their backing files
+	for name, backingFile := range files {
+		if _, candidate := dependents[name]; candidate {
+			continue
+		}
+		for ; backingFile != ""; backingFile = files[backingFile] {
+			if _, ok := dependents[backingFile]; !ok {
+				break
+			}
+			delete(dependents, backingFile)
+		}
+	}
+
+	// repeatedly pick the candidates that no remaining candidate depends on
+	var garbage []string
+	for {
+		var next []string
+		for name, count := range dependents {
+			if count == 0 {
+				next = append(next, name)
+			}
+		}
+		if len(next) == 0 {
+			return garbage
+		}
+
+		sort.Strings(next)
+		for _, name := range next {
+			delete(dependents, name)
+			if _, ok := dependents[files[name]]; ok {
+				dependents[files[name]]--
+			}
+		}
+		garbage = append(garbage, next...)
+	}
+}
+
+// Returns why the given file is garbage, judging only by its name: it belongs to a volume or snapshot that no longer
+// exists, or is the common ancestor of a volume and its clone that both no longer exist.
+func garbageImageReason(name string, inventory *garbageInventory) (string, bool) {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".new"), ".tmp")
+	if !strings.HasSuffix(name, ".qcow2") {
+		return "", false
+	}
+
+	if source, clone, ok := common.ParseCloneImageName(name); ok {
+		if inventory.volumes[source] || inventory.volumes[clone] {
+			return "", false
+		}
+		return fmt.Sprintf("source volume %s and clone %s no longer exist", source, clone), true
+	}
+
+	name = strings.TrimSuffix(name, ".qcow2")
+
+	var uid string
+	switch {
+	case strings.HasPrefix(name, "pvc-"):
+		uid = strings.TrimPrefix(name, "pvc-")
+
+	case strings.HasPrefix(name, "replication-") && strings.HasSuffix(name, "-delta"):
+		uid = strings.TrimSuffix(strings.TrimPrefix(name, "replication-"), "-delta")
+
+	case strings.HasPrefix(name, "snapshot-"):
+		uid = strings.TrimPrefix(name, "snapshot-")
+		if inventory.snapshots == nil || inventory.snapshots[types.UID(uid)] {
+			return "", false
+		}
+		return fmt.Sprintf("snapshot %s no longer exists", uid), true
+
+	default:
+		return "", false
+	}
+
+	if inventory.volumes[types.UID(uid)] {
+		return "", false
+	}
+	return fmt.Sprintf("volume %s no longer exists", uid), true
+}
+
+// Returns why the given Job is garbage, if it is: it operates on a volume or snapshot that no longer exists.
+func garbageJobReason(
+	job *batchv1.Job,
+	inventory *garbageInventory,
+	now time.Time,
+	minAge time.Duration,
+) (string, bool) {
+	if now.Sub(job.CreationTimestamp.Time) < minAge {
+		return "", false
+	}
+
+	for _, key := range []string{"/pvc-uid", "/populated-pvc-uid"} {
+		if uid, ok := job.Labels[common.Domain+key]; ok && !inventory.volumes[types.UID(uid)] {
+			return fmt.Sprintf("volume %s no longer exists", uid), true
+		}
+	}
+
+	if uid, ok := job.Labels[common.Domain+"/snapshot-uid"]; ok && inventory.snapshots != nil &&
+		!inventory.snapshots[types.UID(uid)] {
+		return fmt.Sprintf("snapshot %s no longer exists", uid), true
+	}
+
+	return "", false
+}
+
+// Returns why the given ReplicaSet is garbage, if it is: it stages a volume that no longer exists or on a node that no
+// longer exists, or exposes a volume or snapshot for inspection that no longer exists.
+func garbageReplicaSetReason(
+	replicaSet *appsv1.ReplicaSet,
+	inventory *garbageInventory,
+	now time.Time,
+	minAge time.Duration,
+) (string, bool) {
+	if now.Sub(replicaSet.CreationTimestamp.Time) < minAge {
+		return "", false
+	}
+
+	if uid, ok := replicaSet.Labels[common.Domain+"/pvc-uid"]; ok && !inventory.volumes[types.UID(uid)] {
+		return fmt.Sprintf("volume %s no longer exists", uid), true
+	}
+
+	if node, ok := replicaSet.Labels[common.Domain+"/node-name"]; ok && !inventory.nodes[node] {
+		return fmt.Sprintf("node %s no longer exists", node), true
+	}
+
+	if uid, ok := replicaSet.Labels[common.Domain+"/inspected-uid"]; ok && inventory.snapshots != nil &&
+		!inventory.volumes[types.UID(uid)] && !inventory.snapshots[types.UID(uid)] {
+		return fmt.Sprintf("volume or snapshot %s no longer exists", uid), true
+	}
+
+	return "", false
+}
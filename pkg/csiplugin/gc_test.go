@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestParseGarbageScanOutput(t *testing.T) {
+	files, err := parseGarbageScanOutput(
+		"image pvc-a.qcow2 snapshot-s.qcow2\nimage snapshot-s.qcow2\nimage pvc-a.qcow2.new\ndone\n",
+	)
+	want := common.BackingChains{
+		"pvc-a.qcow2":      "snapshot-s.qcow2",
+		"snapshot-s.qcow2": "",
+		"pvc-a.qcow2.new":  "",
+	}
+	if err != nil || !reflect.DeepEqual(files, want) {
+		t.Errorf("got %v, %v", files, err)
+	}
+
+	if _, err := parseGarbageScanOutput("image pvc-a.qcow2\n"); err == nil {
+		t.Errorf("expected error for truncated output")
+	}
+}
+
+func TestGarbageImages(t *testing.T) {
+	inventory := &garbageInventory{
+		volumes:   map[types.UID]bool{"a": true, "b": true},
+		snapshots: map[types.UID]bool{"s1": true},
+	}
+
+	files := common.BackingChains{
+		"pvc-a.qcow2":               "snapshot-s1.qcow2",
+		"pvc-b.qcow2":               "snapshot-s2.qcow2", // deleted snapshot still backing a volume
+		"pvc-c.qcow2":               "cloned-c-to-d.qcow2",
+		"pvc-c.qcow2.new":           "",
+		"pvc-a.qcow2.new":           "", // may be in progress
+		"replication-c-delta.qcow2": "",
+		"replication-a-delta.qcow2": "",
+		"snapshot-s1.qcow2":         "",
+		"snapshot-s2.qcow2":         "",
+		"snapshot-s3.qcow2":         "",
+		"cloned-c-to-d.qcow2":       "",
+		"cloned-a-to-e.qcow2":       "",
+		"cloned-e-to-f.qcow2":       "",
+		"trash-c-1700000000.qcow2":  "",
+		"sticky-0123-1024.qcow2":    "",
+		"catalog-abcd.qcow2":        "",
+		"something-else.qcow2":      "",
+		"pvc-a.qcow2.tmp":           "",
+		"replication-c-other.qcow2": "",
+	}
+
+	// the common ancestor of deleted volumes c and d only backs garbage, so it goes after it
+
+	got := garbageImages(files, inventory)
+	want := []string{
+		"cloned-e-to-f.qcow2",
+		"pvc-c.qcow2",
+		"pvc-c.qcow2.new",
+		"replication-c-delta.qcow2",
+		"snapshot-s3.qcow2",
+		"cloned-c-to-d.qcow2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// without VolumeSnapshot CRDs, it can't be told which snapshot images are garbage
+	inventory.snapshots = nil
+	for _, name := range garbageImages(files, inventory) {
+		if name == "snapshot-s3.qcow2" {
+			t.Errorf("snapshot image considered garbage without knowing which snapshots exist")
+		}
+	}
+}
+
+func TestGarbageImagesKeepsChainsInUse(t *testing.T) {
+	inventory := &garbageInventory{volumes: map[types.UID]bool{"g": true}}
+
+	// a volume that still exists is backed by a chain of common ancestors of deleted volumes, which must all be kept
+
+	files := common.BackingChains{
+		"pvc-g.qcow2":         "cloned-e-to-g.qcow2",
+		"cloned-e-to-g.qcow2": "cloned-c-to-d.qcow2",
+		"cloned-c-to-d.qcow2": "",
+		"pvc-c.qcow2":         "cloned-c-to-d.qcow2",
+	}
+
+	got := garbageImages(files, inventory)
+	if want := []string{"pvc-c.qcow2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestGarbageImageReason(t *testing.T) {
+	inventory := &garbageInventory{
+		volumes:   map[types.UID]bool{"a": true},
+		snapshots: map[types.UID]bool{},
+	}
+
+	tests := map[string]string{
+		"pvc-a.qcow2":               "",
+		"pvc-b.qcow2.new":           "volume b no longer exists",
+		"replication-b-delta.qcow2": "volume b no longer exists",
+		"snapshot-s.qcow2":          "snapshot s no longer exists",
+		"cloned-a-to-b.qcow2":       "",
+		"cloned-b-to-c.qcow2":       "source volume b and clone c no longer exist",
+		"cloned-b.qcow2":            "",
+		".canary.qcow2":             "",
+	}
+	for name, want := range tests {
+		if got, ok := garbageImageReason(name, inventory); got != want || ok != (want != "") {
+			t.Errorf("%s: got %q, %v, want %q", name, got, ok, want)
+		}
+	}
+}
+
+func TestGarbageJobAndReplicaSetReasons(t *testing.T) {
+	now := time.Now()
+	old := metav1.NewTime(now.Add(-2 * time.Hour))
+	recent := metav1.NewTime(now.Add(-time.Minute))
+
+	inventory := &garbageInventory{
+		volumes:   map[types.UID]bool{"a": true},
+		snapshots: map[types.UID]bool{"s": true},
+		nodes:     map[string]bool{"node-1": true},
+	}
+
+	job := func(created metav1.Time, labels map[string]string) *batchv1.Job {
+		return &batchv1.Job{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: created, Labels: labels}}
+	}
+
+	jobTests := []struct {
+		job  *batchv1.Job
+		want bool
+	}{
+		{job(old, map[string]string{common.Domain + "/pvc-uid": "a"}), false},
+		{job(old, map[string]string{common.Domain + "/pvc-uid": "b"}), true},
+		{job(recent, map[string]string{common.Domain + "/pvc-uid": "b"}), false},
+		{job(old, map[string]string{common.Domain + "/populated-pvc-uid": "b"}), true},
+		{job(old, map[string]string{common.Domain + "/snapshot-uid": "s"}), false},
+		{job(old, map[string]string{common.Domain + "/snapshot-uid": "t"}), true},
+		{job(old, map[string]string{common.Domain + "/component": "backing-usage-measurement"}), false},
+	}
+	for i, test := range jobTests {
+		if _, got := garbageJobReason(test.job, inventory, now, time.Hour); got != test.want {
+			t.Errorf("job %d: got %v, want %v", i, got, test.want)
+		}
+	}
+
+	replicaSet := func(labels map[string]string) *appsv1.ReplicaSet {
+		return &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: old, Labels: labels}}
+	}
+
+	replicaSetTests := []struct {
+		replicaSet *appsv1.ReplicaSet
+		want       bool
+	}{
+		{replicaSet(map[string]string{common.Domain + "/pvc-uid": "a", common.Domain + "/node-name": "node-1"}), false},
+		{replicaSet(map[string]string{common.Domain + "/pvc-uid": "b", common.Domain + "/node-name": "node-1"}), true},
+		{replicaSet(map[string]string{common.Domain + "/pvc-uid": "a", common.Domain + "/node-name": "node-2"}), true},
+		{replicaSet(map[string]string{common.Domain + "/inspected-uid": "s"}), false},
+		{replicaSet(map[string]string{common.Domain + "/inspected-uid": "t"}), true},
+	}
+	for i, test := range replicaSetTests {
+		if _, got := garbageReplicaSetReason(test.replicaSet, inventory, now, time.Hour); got != test.want {
+			t.Errorf("ReplicaSet %d: got %v, want %v", i, got, test.want)
+		}
+	}
+}
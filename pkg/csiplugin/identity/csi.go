@@ -31,10 +31,17 @@ func (s *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.Get
 				},
 			},
 		},
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		},
 		{
 			Type: &csi.PluginCapability_VolumeExpansion_{
 				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
-					Type: csi.PluginCapability_VolumeExpansion_OFFLINE,
+					Type: csi.PluginCapability_VolumeExpansion_ONLINE,
 				},
 			},
 		},
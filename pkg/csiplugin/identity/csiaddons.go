@@ -0,0 +1,57 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package identity
+
+import (
+	"context"
+
+	csiaddons "github.com/csi-addons/spec/lib/go/identity"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+)
+
+// Identity service of the csi-addons API, which the csi-addons sidecar uses to discover the replication API.
+type CsiAddonsIdentityServer struct {
+	csiaddons.UnimplementedIdentityServer
+}
+
+func (s *CsiAddonsIdentityServer) GetIdentity(ctx context.Context, req *csiaddons.GetIdentityRequest) (*csiaddons.GetIdentityResponse, error) {
+	resp := &csiaddons.GetIdentityResponse{
+		Name:          common.Domain,
+		VendorVersion: common.Version,
+	}
+	return resp, nil
+}
+
+func (s *CsiAddonsIdentityServer) GetCapabilities(ctx context.Context, req *csiaddons.GetCapabilitiesRequest) (*csiaddons.GetCapabilitiesResponse, error) {
+	caps := []*csiaddons.Capability{
+		{
+			Type: &csiaddons.Capability_Service_{
+				Service: &csiaddons.Capability_Service{
+					Type: csiaddons.Capability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		},
+		{
+			Type: &csiaddons.Capability_VolumeReplication_{
+				VolumeReplication: &csiaddons.Capability_VolumeReplication{
+					Type: csiaddons.Capability_VolumeReplication_VOLUME_REPLICATION,
+				},
+			},
+		},
+	}
+
+	resp := &csiaddons.GetCapabilitiesResponse{
+		Capabilities: caps,
+	}
+	return resp, nil
+}
+
+func (s *CsiAddonsIdentityServer) Probe(ctx context.Context, req *csiaddons.ProbeRequest) (*csiaddons.ProbeResponse, error) {
+	resp := &csiaddons.ProbeResponse{
+		Ready: &wrappers.BoolValue{
+			Value: true,
+		},
+	}
+	return resp, nil
+}
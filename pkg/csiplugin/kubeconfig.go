@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/tools/clientcmd/api/latest"
+)
+
+// Like newClientset(), but when not running in a cluster, falls back to the current context of the kubeconfig file
+// given by $KUBECONFIG (the first existing one, if it lists several) or of ~/.kube/config, as kubectl would. Meant for
+// commands that operators run from their own machines.
+func newCliClientset() (*common.Clientset, error) {
+	config, err := rest.InClusterConfig()
+	if err == rest.ErrNotInCluster {
+		config, err = kubeconfigRestConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newClientsetForConfig(config)
+}
+
+func kubeconfigRestConfig() (*rest.Config, error) {
+	var paths []string
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		paths = filepath.SplitList(env)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		paths = []string{filepath.Join(home, ".kube", "config")}
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		obj, err := runtime.Decode(latest.Codec, data)
+		if err != nil {
+			return nil, fmt.Errorf("malformed kubeconfig file %s: %w", path, err)
+		}
+
+		config, err := restConfigFromKubeconfig(obj.(*clientcmdapi.Config), filepath.Dir(path))
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig file %s: %w", path, err)
+		}
+		return config, nil
+	}
+
+	return nil, fmt.Errorf("not running in a cluster and no kubeconfig file found")
+}
+
+// Relative file paths in the kubeconfig are resolved against dir, the directory containing the kubeconfig file.
+func restConfigFromKubeconfig(kubeconfig *clientcmdapi.Config, dir string) (*rest.Config, error) {
+	context, ok := kubeconfig.Contexts[kubeconfig.CurrentContext]
+	if !ok {
+		return nil, fmt.Errorf("current context \"%s\" not found", kubeconfig.CurrentContext)
+	}
+	cluster, ok := kubeconfig.Clusters[context.Cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster \"%s\" not found", context.Cluster)
+	}
+	authInfo, ok := kubeconfig.AuthInfos[context.AuthInfo]
+	if !ok {
+		authInfo = clientcmdapi.NewAuthInfo()
+	}
+
+	resolve := func(path string) string {
+		if path != "" && !filepath.IsAbs(path) {
+			return filepath.Join(dir, path)
+		}
+		return path
+	}
+
+	config := &rest.Config{
+		Host:            cluster.Server,
+		BearerToken:     authInfo.Token,
+		BearerTokenFile: resolve(authInfo.TokenFile),
+		Username:        authInfo.Username,
+		Password:        authInfo.Password,
+		ExecProvider:    authInfo.Exec,
+		AuthProvider:    authInfo.AuthProvider,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure:   cluster.InsecureSkipTLSVerify,
+			ServerName: cluster.TLSServerName,
+			CAFile:     resolve(cluster.CertificateAuthority),
+			CAData:     cluster.CertificateAuthorityData,
+			CertFile:   resolve(authInfo.ClientCertificate),
+			CertData:   authInfo.ClientCertificateData,
+			KeyFile:    resolve(authInfo.ClientKey),
+			KeyData:    authInfo.ClientKeyData,
+		},
+	}
+
+	return config, nil
+}
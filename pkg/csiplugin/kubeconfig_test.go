@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"testing"
+
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestRestConfigFromKubeconfig(t *testing.T) {
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.CurrentContext = "ctx"
+	kubeconfig.Contexts["ctx"] = &clientcmdapi.Context{Cluster: "cluster", AuthInfo: "user"}
+	kubeconfig.Clusters["cluster"] = &clientcmdapi.Cluster{
+		Server:               "https://example.com:6443",
+		CertificateAuthority: "ca.crt",
+	}
+	kubeconfig.AuthInfos["user"] = &clientcmdapi.AuthInfo{
+		ClientCertificate: "/abs/client.crt",
+		ClientKeyData:     []byte("key"),
+	}
+
+	config, err := restConfigFromKubeconfig(kubeconfig, "/home/user/.kube")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Host != "https://example.com:6443" {
+		t.Errorf("got host %s", config.Host)
+	}
+	if config.CAFile != "/home/user/.kube/ca.crt" {
+		t.Errorf("got CA file %s, want it resolved against the kubeconfig's directory", config.CAFile)
+	}
+	if config.CertFile != "/abs/client.crt" {
+		t.Errorf("got cert file %s", config.CertFile)
+	}
+	if string(config.KeyData) != "key" {
+		t.Errorf("got key data %q", config.KeyData)
+	}
+
+	kubeconfig.CurrentContext = "missing"
+	if _, err := restConfigFromKubeconfig(kubeconfig, "/"); err == nil {
+		t.Error("expected failure for missing current context")
+	}
+}
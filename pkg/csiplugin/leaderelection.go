@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+// How the replicas of the controller plugin elect the one that runs the controller monitor (see
+// controller.ControllerMonitor), so that the controller plugin can run several replicas for high availability without
+// them racing on the same PVCs and Jobs. All replicas serve gRPC requests. Zero values are replaced by defaults, which
+// match those of the CSI sidecars.
+type LeaderElectionOptions struct {
+	// Whether to elect a leader at all. If not, the controller plugin assumes it is the only replica.
+	Enabled bool
+
+	// Namespace of the Lease, which defaults to the namespace of the controller plugin's pod.
+	Namespace string
+
+	// How long other replicas wait after the leader last renewed the Lease before taking over.
+	LeaseDuration time.Duration
+
+	// How long the leader keeps trying to renew the Lease before giving up on leading.
+	RenewDeadline time.Duration
+
+	// How long replicas wait between attempts to acquire or renew the Lease.
+	RetryPeriod time.Duration
+}
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 5 * time.Second
+)
+
+// Where the namespace of a pod's service account, which is the pod's own namespace, is mounted.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+func (o LeaderElectionOptions) withDefaults(readFile func(name string) ([]byte, error)) (LeaderElectionOptions, error) {
+	if o.Namespace == "" {
+		namespace, err := readFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return o, fmt.Errorf("failed to determine the namespace of the leader election Lease: %w", err)
+		}
+		o.Namespace = strings.TrimSpace(string(namespace))
+	}
+	if o.LeaseDuration <= 0 {
+		o.LeaseDuration = defaultLeaseDuration
+	}
+	if o.RenewDeadline <= 0 {
+		o.RenewDeadline = defaultRenewDeadline
+	}
+	if o.RetryPeriod <= 0 {
+		o.RetryPeriod = defaultRetryPeriod
+	}
+	return o, nil
+}
+
+// Competes for the Lease of the controller plugin in the background, and calls run once this replica acquires it.
+// Whatever run starts can't be stopped cleanly, so the process exits if this replica stops leading, and its
+// replacement competes again.
+func startLeaderElection(clientset *common.Clientset, options LeaderElectionOptions, run func()) error {
+	options, err := options.withDefaults(os.ReadFile)
+	if err != nil {
+		return err
+	}
+
+	identity, err := os.Hostname() // the pod's name
+	if err != nil {
+		return err
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      common.GenerateControllerLeaseName(),
+			Namespace: options.Namespace,
+		},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: options.LeaseDuration,
+		RenewDeadline: options.RenewDeadline,
+		RetryPeriod:   options.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				klog.InfoS("Acquired Lease, now leading", "lease", klog.KRef(options.Namespace, lock.LeaseMeta.Name))
+				run()
+			},
+			OnStoppedLeading: func() {
+				klog.ErrorS(nil, "Lost Lease, exiting", "lease", klog.KRef(options.Namespace, lock.LeaseMeta.Name))
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					klog.InfoS("Another replica is leading, waiting for it to stop", "leader", leader)
+				}
+			},
+		},
+		Name: common.GenerateControllerLeaseName(),
+	})
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS(
+		"Waiting to acquire Lease", "lease", klog.KRef(options.Namespace, lock.LeaseMeta.Name), "identity", identity,
+	)
+	go elector.Run(context.Background())
+
+	return nil
+}
@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLeaderElectionOptionsWithDefaults(t *testing.T) {
+	readFile := func(name string) ([]byte, error) {
+		if name != serviceAccountNamespaceFile {
+			t.Errorf("read %s", name)
+		}
+		return []byte("subprovisioner\n"), nil
+	}
+
+	got, err := LeaderElectionOptions{Enabled: true, RetryPeriod: time.Second}.withDefaults(readFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := LeaderElectionOptions{
+		Enabled:       true,
+		Namespace:     "subprovisioner",
+		LeaseDuration: defaultLeaseDuration,
+		RenewDeadline: defaultRenewDeadline,
+		RetryPeriod:   time.Second,
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// a given namespace is kept, and the file isn't needed then
+
+	noFile := func(string) ([]byte, error) { return nil, os.ErrNotExist }
+
+	got, err = LeaderElectionOptions{Namespace: "storage"}.withDefaults(noFile)
+	if err != nil || got.Namespace != "storage" {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	_, err = LeaderElectionOptions{}.withDefaults(noFile)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v", err)
+	}
+}
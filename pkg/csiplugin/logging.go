@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	protov1 "github.com/golang/protobuf/proto"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"k8s.io/klog/v2"
+)
+
+// What the values of secret fields are replaced with in logged requests.
+const strippedSecret = "***stripped***"
+
+// The id of the last gRPC request the plugin received, which identifies requests in the log.
+var lastRequestId uint64
+
+// Logs each gRPC request with an id that all of its log entries carry, which is also added to the logger in the
+// request's context (see klog.FromContext()). Failed requests are always logged, succeeded ones from verbosity 2, and
+// the requests and responses themselves from verbosity 4, with secrets stripped (see sanitize()).
+func logRequest(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	logger := klog.LoggerWithValues(
+		klog.FromContext(ctx), "method", info.FullMethod, "requestId", atomic.AddUint64(&lastRequestId, 1),
+	)
+	ctx = klog.NewContext(ctx, logger)
+
+	if v := logger.V(4); v.Enabled() {
+		v.Info("Handling request", "request", sanitize(req))
+	}
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	err = common.ToGrpcError(err)
+
+	if err != nil {
+		logger.Error(err, "Request failed", "duration", time.Since(start))
+	} else {
+		logger.V(2).Info("Request succeeded", "duration", time.Since(start))
+		if v := logger.V(4); v.Enabled() {
+			v.Info("Sending response", "response", sanitize(resp))
+		}
+	}
+
+	return resp, err
+}
+
+// Renders a gRPC message as JSON, with the values of the fields that the CSI spec marks as secret, and of any other
+// field named "secrets" (e.g., in csi-addons requests), replaced by strippedSecret.
+func sanitize(message interface{}) string {
+	v1, ok := message.(protoiface.MessageV1)
+	if !ok {
+		return fmt.Sprintf("%+v", message)
+	}
+
+	sanitized := proto.Clone(protov1.MessageV2(v1))
+	stripSecrets(sanitized.ProtoReflect())
+
+	json, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(sanitized)
+	if err != nil {
+		return fmt.Sprintf("<failed to render %T: %v>", message, err)
+	}
+	return string(json)
+}
+
+func stripSecrets(message protoreflect.Message) {
+	var secretFields []protoreflect.FieldDescriptor
+
+	message.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		switch {
+		case isSecretField(field):
+			secretFields = append(secretFields, field) // stripped below, as message must not change while ranging
+		case field.IsMap() && field.MapValue().Message() != nil:
+			value.Map().Range(func(_ protoreflect.MapKey, value protoreflect.Value) bool {
+				stripSecrets(value.Message())
+				return true
+			})
+		case field.IsList() && field.Message() != nil:
+			for i := 0; i < value.List().Len(); i++ {
+				stripSecrets(value.List().Get(i).Message())
+			}
+		case field.Message() != nil && !field.IsMap() && !field.IsList():
+			stripSecrets(value.Message())
+		}
+		return true
+	})
+
+	for _, field := range secretFields {
+		stripSecretField(message, field)
+	}
+}
+
+func isSecretField(field protoreflect.FieldDescriptor) bool {
+	if field.Name() == "secrets" {
+		return true
+	}
+
+	options, ok := field.Options().(*descriptorpb.FieldOptions)
+	if !ok || options == nil {
+		return false
+	}
+
+	secret, _ := proto.GetExtension(options, csi.E_CsiSecret).(bool)
+	return secret
+}
+
+// Keeps the keys of secret maps, which only name the secrets, but strips their values.
+func stripSecretField(message protoreflect.Message, field protoreflect.FieldDescriptor) {
+	switch {
+	case field.IsMap() && field.MapValue().Kind() == protoreflect.StringKind:
+		secrets := message.Mutable(field).Map()
+		var keys []protoreflect.MapKey
+		secrets.Range(func(key protoreflect.MapKey, _ protoreflect.Value) bool {
+			keys = append(keys, key)
+			return true
+		})
+		for _, key := range keys {
+			secrets.Set(key, protoreflect.ValueOfString(strippedSecret))
+		}
+	case !field.IsList() && !field.IsMap() && field.Kind() == protoreflect.StringKind:
+		message.Set(field, protoreflect.ValueOfString(strippedSecret))
+	default:
+		message.Clear(field)
+	}
+}
@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	protov1 "github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestSanitize(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:       "pvc-1234",
+		Parameters: map[string]string{"backingClaimName": "backing"},
+		Secrets:    map[string]string{"password": "hunter2"},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "5678"},
+			},
+		},
+	}
+
+	got := sanitize(req)
+
+	for _, want := range []string{`"pvc-1234"`, `"backing"`, `"password":"***stripped***"`, `"5678"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %s, missing %s", got, want)
+		}
+	}
+	if strings.Contains(got, "hunter2") {
+		t.Errorf("got %s, which leaks a secret", got)
+	}
+
+	// the request itself is left alone
+
+	if req.Secrets["password"] != "hunter2" {
+		t.Errorf("request was modified: %v", req.Secrets)
+	}
+}
+
+func TestIsSecretField(t *testing.T) {
+	message := protov1.MessageV2(&csi.NodeStageVolumeRequest{}).ProtoReflect().Descriptor()
+
+	// the CSI spec marks secret fields with the csi_secret option, which we rely on beyond the field's name
+
+	secrets := message.Fields().ByName("secrets")
+	options := secrets.Options().(*descriptorpb.FieldOptions)
+	if secret, _ := proto.GetExtension(options, csi.E_CsiSecret).(bool); !secret {
+		t.Errorf("field %s isn't marked as secret", secrets.FullName())
+	}
+
+	for name, want := range map[string]bool{"secrets": true, "volume_context": false, "volume_id": false} {
+		if got := isSecretField(message.Fields().ByName(protoreflect.Name(name))); got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
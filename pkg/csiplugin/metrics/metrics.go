@@ -0,0 +1,226 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics is a minimal implementation of Prometheus metrics: labeled counters and gauges that are exposed in
+// the Prometheus text format over HTTP.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// The registry that the plugin's metrics are defined in and served from.
+var Default = NewRegistry()
+
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name       string
+	help       string
+	kind       string // "counter" or "gauge"
+	labelNames []string
+	samples    map[string]*sample // keyed by the label values joined by "\xff"
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// A counter that is partitioned by the given labels. Panics if a metric with the same name already exists.
+type CounterVec struct {
+	registry *Registry
+	family   *family
+}
+
+// A gauge that is partitioned by the given labels. Panics if a metric with the same name already exists.
+type GaugeVec struct {
+	registry *Registry
+	family   *family
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{registry: r, family: r.register(name, help, "counter", labelNames)}
+}
+
+func (r *Registry) NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{registry: r, family: r.register(name, help, "gauge", labelNames)}
+}
+
+func (r *Registry) register(name string, help string, kind string, labelNames []string) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metric %s defined twice", name))
+	}
+
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		samples:    map[string]*sample{},
+	}
+	r.families[name] = f
+	return f
+}
+
+// Must be called with the registry's mutex held.
+func (f *family) sample(labelValues []string) *sample {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.name, len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.samples[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		f.samples[key] = s
+	}
+	return s
+}
+
+// Must be called with the registry's mutex held.
+func (f *family) delete(labelValues []string) {
+	delete(f.samples, strings.Join(labelValues, "\xff"))
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Panics if value is negative, as counters only go up.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.family.name))
+	}
+
+	c.registry.mutex.Lock()
+	defer c.registry.mutex.Unlock()
+	c.family.sample(labelValues).value += value
+}
+
+// Sets the counter to a count that is maintained elsewhere, e.g., by the kernel. The count may only go down when its
+// source restarts counting, which Prometheus treats like any other counter reset.
+func (c *CounterVec) Set(value float64, labelValues ...string) {
+	c.registry.mutex.Lock()
+	defer c.registry.mutex.Unlock()
+	c.family.sample(labelValues).value = value
+}
+
+// Stops exposing the counter with the given label values, e.g., because the volume it is about is gone.
+func (c *CounterVec) Delete(labelValues ...string) {
+	c.registry.mutex.Lock()
+	defer c.registry.mutex.Unlock()
+	c.family.delete(labelValues)
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.registry.mutex.Lock()
+	defer g.registry.mutex.Unlock()
+	g.family.sample(labelValues).value = value
+}
+
+// Stops exposing the gauge with the given label values, e.g., because the volume it is about is gone.
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.registry.mutex.Lock()
+	defer g.registry.mutex.Unlock()
+	g.family.delete(labelValues)
+}
+
+// Stops exposing the gauge for all label values, e.g., before setting it anew from a full listing.
+func (g *GaugeVec) Reset() {
+	g.registry.mutex.Lock()
+	defer g.registry.mutex.Unlock()
+	g.family.samples = map[string]*sample{}
+}
+
+// Writes all metrics in the Prometheus text format, sorted so that the output is stable.
+func (r *Registry) Write(out io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+
+	for _, name := range names {
+		f := r.families[name]
+
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, escape(f.help, false))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.samples))
+		for key := range f.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.samples[key]
+
+			b.WriteString(f.name)
+			if len(f.labelNames) > 0 {
+				b.WriteString("{")
+				for i, labelName := range f.labelNames {
+					if i > 0 {
+						b.WriteString(",")
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", labelName, escape(s.labelValues[i], true))
+				}
+				b.WriteString("}")
+			}
+			fmt.Fprintf(&b, " %s\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := r.Write(w); err != nil {
+		klog.ErrorS(err, "Failed to write metrics")
+	}
+}
+
+// Serves the default registry's metrics at "/metrics" on the given address, in the background. Failing to listen is
+// logged but not fatal, as metrics are auxiliary.
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		klog.ErrorS(err, "Failed to serve metrics", "address", address)
+	}()
+}
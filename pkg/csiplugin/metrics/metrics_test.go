@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+
+	errors := r.NewCounterVec("test_errors_total", "Number of errors.", "volume", "kind")
+	size := r.NewGaugeVec("test_size_bytes", "Size\nin bytes.", "volume")
+	up := r.NewGaugeVec("test_up", "Whether it is up.")
+
+	errors.Inc("b", "write")
+	errors.Add(2, "a", "read")
+	errors.Inc("a", "read")
+	errors.Inc("c", "read")
+	errors.Delete("c", "read")
+	errors.Inc("b", "write")
+	errors.Set(1, "b", "write")
+	size.Set(1.5e10, `quo"te`)
+	up.Set(1)
+
+	var out strings.Builder
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_errors_total Number of errors.
+# TYPE test_errors_total counter
+test_errors_total{volume="a",kind="read"} 3
+test_errors_total{volume="b",kind="write"} 1
+# HELP test_size_bytes Size\nin bytes.
+# TYPE test_size_bytes gauge
+test_size_bytes{volume="quo\"te"} 1.5e+10
+# HELP test_up Whether it is up.
+# TYPE test_up gauge
+test_up 1
+`
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	size.Reset()
+	out.Reset()
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "test_size_bytes{") {
+		t.Errorf("reset gauge still has samples:\n%s", out.String())
+	}
+}
+
+func TestRegistryRejectsMisuse(t *testing.T) {
+	expectPanic := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: expected panic", name)
+			}
+		}()
+		f()
+	}
+
+	r := NewRegistry()
+	counter := r.NewCounterVec("test_total", "Test.", "volume")
+
+	expectPanic("duplicate", func() { r.NewGaugeVec("test_total", "Test.") })
+	expectPanic("wrong label count", func() { counter.Inc() })
+	expectPanic("negative", func() { counter.Add(-1, "a") })
+}
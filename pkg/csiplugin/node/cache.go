@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// The cluster size of the images that volumes are created with, which is QEMU's default.
+	qcow2ClusterSize = 64 * 1024
+
+	// How much of a volume QEMU's default L2 cache of 32 MiB covers. Smaller volumes are fully covered as is.
+	qcow2DefaultL2CacheCoverage = 32 * 1024 * 1024 / 8 * qcow2ClusterSize
+
+	// The most memory that the metadata caches sized for a volume take, unless the "maxQcow2CacheSize" StorageClass
+	// parameter says otherwise, which fully covers volumes of up to 1.6 TiB.
+	defaultMaxQcow2CacheSize = 256 * 1024 * 1024
+
+	// The smallest caches that QEMU accepts are 2 L2 tables and 4 refcount blocks.
+	minQcow2L2CacheSize       = 2 * qcow2ClusterSize
+	minQcow2RefcountCacheSize = 4 * qcow2ClusterSize
+)
+
+// Returns the qcow2 blockdev options that staging pods serve a volume of the given capacity with, given its volume
+// context. QEMU's default L2 cache only covers 256 GiB of a volume, so random I/O to larger volumes reads metadata from
+// the backing volume on every cache miss. Their L2 cache is thus sized to cover the whole volume, with a refcount cache
+// covering as many clusters for allocating writes, within the "maxQcow2CacheSize" StorageClass parameter and half the
+// memory of staging pods, if limited. Options given by the "qcow2Options" parameter are kept, and setting any cache
+// size there leaves the caches to it.
+//
+// Volumes expanded while staged keep their caches until they are staged again.
+func qcow2CacheOptions(volumeContext map[string]string, capacity int64) string {
+	options := volumeContext["qcow2Options"]
+
+	if capacity <= qcow2DefaultL2CacheCoverage {
+		return options
+	}
+
+	for _, option := range strings.Split(options, ",") {
+		key, _, _ := strings.Cut(option, "=")
+		if key == "cache-size" || key == "l2-cache-size" || key == "refcount-cache-size" {
+			return options
+		}
+	}
+
+	// validated by CreateVolume
+	maxSize := int64(defaultMaxQcow2CacheSize)
+	if value, err := strconv.ParseInt(volumeContext["maxQcow2CacheSize"], 10, 64); err == nil {
+		maxSize = value
+	}
+	if memory, err := resource.ParseQuantity(volumeContext["stagingMemory"]); err == nil && memory.Value()/2 < maxSize {
+		maxSize = memory.Value() / 2
+	}
+	if maxSize == 0 {
+		return options
+	}
+
+	// each L2 entry maps a cluster with 8 bytes, and each refcount entry counts the references to one with 2 bytes
+	clusters := (capacity + qcow2ClusterSize - 1) / qcow2ClusterSize
+	l2CacheSize := roundUpToCluster(clusters * 8)
+	refcountCacheSize := roundUpToCluster(clusters * 2)
+
+	if total := l2CacheSize + refcountCacheSize; total > maxSize {
+		l2CacheSize = roundUpToCluster(maxSize * 4 / 5)
+		refcountCacheSize = roundUpToCluster(maxSize / 5)
+	}
+	if l2CacheSize < minQcow2L2CacheSize {
+		l2CacheSize = minQcow2L2CacheSize
+	}
+	if refcountCacheSize < minQcow2RefcountCacheSize {
+		refcountCacheSize = minQcow2RefcountCacheSize
+	}
+
+	sized := []string{
+		"l2-cache-size=" + strconv.FormatInt(l2CacheSize, 10),
+		"refcount-cache-size=" + strconv.FormatInt(refcountCacheSize, 10),
+	}
+	if options != "" {
+		sized = append(sized, strings.Split(options, ",")...)
+	}
+	sort.Strings(sized)
+
+	return strings.Join(sized, ",")
+}
+
+func roundUpToCluster(size int64) int64 {
+	return (size + qcow2ClusterSize - 1) / qcow2ClusterSize * qcow2ClusterSize
+}
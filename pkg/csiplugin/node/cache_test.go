@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import "testing"
+
+func TestQcow2CacheOptions(t *testing.T) {
+	const gi = 1024 * 1024 * 1024
+
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		capacity      int64
+		want          string
+	}{
+		{"covered by default", map[string]string{}, 256 * gi, ""},
+		{"1 TiB", map[string]string{}, 1024 * gi, "l2-cache-size=134217728,refcount-cache-size=33554432"},
+		{
+			"limited by default", map[string]string{}, 4096 * gi,
+			"l2-cache-size=214761472,refcount-cache-size=53739520",
+		},
+		{
+			"limited by parameter", map[string]string{"maxQcow2CacheSize": "10485760"}, 1024 * gi,
+			"l2-cache-size=8388608,refcount-cache-size=2097152",
+		},
+		{
+			"limited by staging memory", map[string]string{"stagingMemory": "20Mi"}, 1024 * gi,
+			"l2-cache-size=8388608,refcount-cache-size=2097152",
+		},
+		{"disabled", map[string]string{"maxQcow2CacheSize": "0"}, 1024 * gi, ""},
+		{
+			"other options kept", map[string]string{"qcow2Options": "cache-clean-interval=600"}, 1024 * gi,
+			"cache-clean-interval=600,l2-cache-size=134217728,refcount-cache-size=33554432",
+		},
+		{
+			"overridden", map[string]string{"qcow2Options": "l2-cache-size=67108864"}, 1024 * gi,
+			"l2-cache-size=67108864",
+		},
+	}
+
+	for _, test := range tests {
+		if got := qcow2CacheOptions(test.volumeContext, test.capacity); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
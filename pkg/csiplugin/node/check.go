@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Waits until the staging pod exposes the volume's block device at the staging path, or reports that the volume's
+// image chain is corrupt (see the "checkOnStage" StorageClass parameter). In the latter case, the staging ReplicaSet is
+// deleted, so that the image is checked anew when staging is retried, e.g., after the image has been repaired, and
+// staging fails with an Event on the PVC.
+func (s *NodeServer) waitForStagingDevice(
+	ctx context.Context,
+	pvc *corev1.PersistentVolumeClaim,
+	stagingTargetPath string,
+	replicaSetName string,
+	replicaSetNamespace string,
+) error {
+	pvcUid := common.VolumeUidOf(pvc)
+	reportPath := common.GenerateStagingCheckReportPath(s.KubeletDir, pvcUid)
+
+	for {
+		if isBlockDevice(stagingTargetPath) {
+			return nil
+		}
+
+		report, err := os.ReadFile(reportPath)
+		if err == nil {
+			return s.refuseCorruptVolume(ctx, pvc, pvcUid, string(report), replicaSetName, replicaSetNamespace)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *NodeServer) refuseCorruptVolume(
+	ctx context.Context,
+	pvc *corev1.PersistentVolumeClaim,
+	pvcUid types.UID,
+	report string,
+	replicaSetName string,
+	replicaSetNamespace string,
+) error {
+	message := summarizeCheckReport(report)
+	klog.ErrorS(nil, "Refusing to stage corrupt volume", "volume", pvcUid, "message", message)
+
+	err := common.DeleteReplicaSetSynchronously(ctx, s.Clientset, replicaSetName, replicaSetNamespace)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(common.GenerateStagingCheckReportPath(s.KubeletDir, pvcUid))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = common.EmitEvent(
+		ctx, s.Clientset, common.PvcEventObject(pvc),
+		corev1.EventTypeWarning, "VolumeCorrupt",
+		"Refusing to stage volume on node %s because its image is corrupt (see \"Repairing corrupt volumes\" in the "+
+			"Subprovisioner documentation): %s",
+		s.NodeName, message,
+	)
+	if err != nil {
+		klog.ErrorS(err, "Failed to emit event for corrupt volume", "volume", pvcUid)
+	}
+
+	return status.Errorf(codes.FailedPrecondition, "volume image is corrupt: %s", message)
+}
+
+// Reduces the output of qemu-img check, prefixed with the image's name, to the image's name and the first few lines
+// describing errors, so that it fits in an Event.
+func summarizeCheckReport(report string) string {
+	const maxLines = 3
+
+	image, output, _ := strings.Cut(strings.TrimSpace(report), ":")
+
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && len(lines) < maxLines {
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) == 0 {
+		return image
+	}
+	return image + ": " + strings.Join(lines, "; ")
+}
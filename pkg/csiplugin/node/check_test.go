@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import "testing"
+
+func TestSummarizeCheckReport(t *testing.T) {
+	tests := []struct {
+		report string
+		want   string
+	}{
+		{
+			"pvc-1234.qcow2: ERROR cluster 5 refcount=0 reference=1\n" +
+				"ERROR cluster 6 refcount=0 reference=1\n" +
+				"ERROR OFLAG_COPIED data cluster: l2_entry=50000 refcount=0\n" +
+				"\n" +
+				"3 errors were found on the image.\n",
+			"pvc-1234.qcow2: ERROR cluster 5 refcount=0 reference=1; ERROR cluster 6 refcount=0 reference=1; " +
+				"ERROR OFLAG_COPIED data cluster: l2_entry=50000 refcount=0",
+		},
+		{
+			"snapshot-5678.qcow2: qemu-img: Could not open 'snapshot-5678.qcow2': Image is not in qcow2 format\n",
+			"snapshot-5678.qcow2: qemu-img: Could not open 'snapshot-5678.qcow2': Image is not in qcow2 format",
+		},
+		{"pvc-1234.qcow2: \n", "pvc-1234.qcow2"},
+	}
+
+	for _, test := range tests {
+		if got := summarizeCheckReport(test.report); got != test.want {
+			t.Errorf("got \"%s\", want \"%s\"", got, test.want)
+		}
+	}
+}
@@ -6,17 +6,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/fs"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
 )
 
 type NodeServer struct {
@@ -24,9 +29,76 @@ type NodeServer struct {
 	Clientset *common.Clientset
 	NodeName  string
 	Image     string
+	State     *State
+
+	// where kubelet keeps its state on this node
+	KubeletDir string
+
+	// whether staging pods fall back to qemu-nbd if qemu-storage-daemon can't be used
+	QemuNbdFallback bool
+
+	// how to load the nbd kernel module if it isn't loaded
+	NbdModule NbdModuleOptions
+
+	// how many volumes may be staged at once on this node, further ones waiting for their turn (unlimited if 0)
+	MaxConcurrentStagings int
+	stagings              stagingQueue
+
+	// serializes publishing and unpublishing with repairing broken publish paths
+	publishMutex sync.Mutex
+
+	// what qemu-storage-daemon can do on this node, probed when first staging a volume
+	qemuCapabilities     qemuCapabilities
+	qemuCapabilitiesOnce sync.Once
+
+	// cancels the watching of each staged volume's qemu-storage-daemon events
+	qsdEventWatchers      map[types.UID]context.CancelFunc
+	qsdEventWatchersMutex sync.Mutex
 }
 
 func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	resp, err := s.nodeStageVolume(ctx, req)
+	if err != nil {
+		s.reportStagingFailure(types.UID(req.VolumeId), err)
+	}
+	return resp, err
+}
+
+// Lets users know why staging a volume failed through an Event on its PVC, as kubelet only reports that mounting the
+// volume timed out or failed on the pod, along with the end of the error, which may include logs of the staging pod.
+// Stagings that are waiting for their turn (see waitForStagingTurn()) or were cancelled aren't reported. Best-effort.
+func (s *NodeServer) reportStagingFailure(pvcUid types.UID, stagingErr error) {
+	switch status.Code(common.ToGrpcError(stagingErr)) {
+	case codes.Aborted, codes.Canceled:
+		return
+	}
+
+	// the request's context may be what ran out
+	ctx := context.Background()
+
+	pvc, err := common.FindPvcByLabelSelector(ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, pvcUid))
+	if err == nil {
+		err = common.EmitEvent(
+			ctx, s.Clientset, common.PvcEventObject(pvc), corev1.EventTypeWarning, "StagingFailed",
+			"Failed to stage the volume on node %s: %s", s.NodeName, errorExcerpt(stagingErr),
+		)
+	}
+	if err != nil && !k8serrors.IsNotFound(err) {
+		klog.ErrorS(err, "Failed to emit event for volume that failed to stage", "volume", pvcUid)
+	}
+}
+
+// The first line of the error, which says what failed, followed by an excerpt of the rest, e.g., of the logs of a pod
+// that the error includes (see common.LogExcerpt()).
+func errorExcerpt(err error) string {
+	lines := strings.SplitN(err.Error(), "\n", 2)
+	if len(lines) == 1 {
+		return lines[0]
+	}
+	return lines[0] + "\n" + common.LogExcerpt(lines[1])
+}
+
+func (s *NodeServer) nodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	// TODO: If QSD pod fails, Kubernetes might just try to continuously unpublish and publish the volume, which
 	// will go nowhere, instead of also unstaging and restaging it. How can we avoid this? Maybe just make the QSD
 	// pod recover automatically?
@@ -48,23 +120,126 @@ func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 		readonly = false
 	}
 
+	// volumes staged read-write on several nodes are served by a shared export that each of them connects to
+	shared := req.VolumeCapability.AccessMode.Mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+
 	pvcUid := types.UID(req.VolumeId)
-	pvcName := req.VolumeContext["pvcName"]
-	pvcNamespace := req.VolumeContext["pvcNamespace"]
-	backingPvcName := req.VolumeContext["backingPvcName"]
-	backingPvcNamespace := req.VolumeContext["backingPvcNamespace"]
-	backingPvcBasePath := req.VolumeContext["backingPvcBasePath"]
+
+	// fail early if the volume couldn't get an NBD device, unless it already has one from a previous attempt
+
+	if !isBlockDevice(req.StagingTargetPath) {
+		err := s.ensureNbdDeviceAvailable()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The volume context names the PVC that the volume was created for and its backing volume, but the volume may
+	// since have been adopted by another PVC or migrated to another backing volume, so we look the PVC up by the
+	// volume's uid instead and take the backing volume from it.
+
+	pvc, err := common.FindPvcByLabelSelector(ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, pvcUid))
+	if err != nil {
+		return nil, err
+	}
+
+	pvcName := pvc.Name
+	pvcNamespace := pvc.Namespace
+
+	// Many pods getting scheduled onto the node at once would otherwise have their volumes staged all at once,
+	// racing for NBD devices and starting many staging pods together, so we make them take turns.
+
+	err = s.waitForStagingTurn(ctx, pvcUid, common.PvcEventObject(pvc))
+	if err != nil {
+		return nil, err
+	}
+	defer s.stagings.leave()
 
 	// add node name to PVC annotation listing nodes on which it is staged
 
-	err := common.StagePvcOnNode(ctx, s.Clientset, pvcName, pvcNamespace, s.NodeName)
+	immutable, err := common.LockImmutableVolume(ctx, s.Clientset, pvc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = common.StagePvcOnNode(ctx, s.Clientset, pvcName, pvcNamespace, s.NodeName, readonly, shared, immutable)
 	if err != nil {
 		return nil, err
 	}
 
+	// the volume can't be migrated anymore now that it is staged, but it may have been since we looked it up
+
+	pvc, err = s.Clientset.CoreV1().PersistentVolumeClaims(pvcNamespace).Get(ctx, pvcName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// mirrored volumes are served from both copies, or only from the up-to-date one if the other is degraded
+
+	location, mirrorMount := common.VolumeCopiesOf(&pvc.ObjectMeta)
+	backingPvcName := location.PvcName
+	backingPvcNamespace := location.PvcNamespace
+	backingPvcBasePath := location.BasePath
+
+	var extraPvcMounts []common.PvcMount
+	mirrorImagePath := ""
+	if mirrorMount != nil {
+		extraPvcMounts = []common.PvcMount{*mirrorMount}
+		mirrorImagePath = common.GenerateVolumeMirrorImagePath(pvcUid)
+	}
+
+	// the throttle limits may change while the volume is staged, in which case the QoS updater applies them
+
+	qos, err := volumeQos(pvc, req.VolumeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	// pick the data path for what qemu-storage-daemon can do on this node
+
+	capabilities := s.probedQemuCapabilities()
+	if !capabilities.qsdNbdExport && (mirrorImagePath != "" || shared) {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"qemu-storage-daemon can't serve volumes on node %s, which mirrored and ReadWriteMany volumes require",
+			s.NodeName,
+		)
+	}
+
+	// qcow2 metadata caches are sized for the volume's current capacity
+
+	format := common.VolumeImageFormatOf(&pvc.ObjectMeta)
+	qcow2Options := req.VolumeContext["qcow2Options"]
+	if format == common.ImageFormatQcow2 {
+		if capacity, err := strconv.ParseInt(pvc.Annotations[common.Domain+"/capacity"], 10, 64); err == nil {
+			qcow2Options = qcow2CacheOptions(req.VolumeContext, capacity)
+		}
+	}
+
 	// stage volume
 
-	volumeImagePath := common.GenerateVolumeImagePath(pvcUid)
+	args := qsdWithNbdArgs{
+		pvcUid:          pvcUid,
+		outDevPath:      req.StagingTargetPath,
+		qmpSocketPath:   common.GenerateQmpSocketPath(s.KubeletDir, pvcUid),
+		readonly:        readonly,
+		volumeContext:   req.VolumeContext,
+		aio:             capabilities.aioFor(valueOrDefault(req.VolumeContext["aio"], "threads")),
+		qemuNbdFallback: s.QemuNbdFallback || !capabilities.qsdNbdExport,
+		mirrorImagePath: mirrorImagePath,
+		qos:             qos,
+		format:          format,
+		qcow2Options:    qcow2Options,
+	}
+
+	if shared {
+		address, err := s.ensureSharedExport(ctx, pvc, args, location, extraPvcMounts)
+		if err != nil {
+			return nil, err
+		}
+		args.sharedRole, args.sharedExportAddress = "client", address
+	}
+
 	stagingReplicaSetName := common.GenerateStagingReplicaSetName(pvcUid, s.NodeName)
 
 	labels := map[string]string{
@@ -73,6 +248,27 @@ func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 		common.Domain + "/pvc-uid":   string(pvcUid),
 	}
 
+	// Record the volume before creating the ReplicaSet so that we can still unstage it if we crash in between.
+
+	err = s.State.Set(pvcUid, StagedVolume{
+		StagingTargetPath:   req.StagingTargetPath,
+		Readonly:            readonly,
+		PvcName:             pvcName,
+		PvcNamespace:        pvcNamespace,
+		ReplicaSetName:      stagingReplicaSetName,
+		ReplicaSetNamespace: backingPvcNamespace,
+		Integrity:           req.VolumeContext["integrity"] == "true",
+		Shared:              shared,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = common.InjectFault(ctx, common.FaultNbdAttach)
+	if err != nil {
+		return nil, err
+	}
+
 	// TODO: Is it possible to configure NBD block devices without having to set
 	// securityContext.privileged to true on the QSD container? Does it matter, given we need it for
 	// file system mounts (probably)?
@@ -88,23 +284,24 @@ func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 				common.Domain + "/backing-pvc-name":      backingPvcName,
 				common.Domain + "/backing-pvc-namespace": backingPvcNamespace,
 			},
-			MatchLabels: labels,
-			Replicas:    1,
-			NodeName:    s.NodeName,
-			Image:       s.Image,
-			Command: []string{
-				"/subprovisioner/qsd-with-nbd.sh",
-				volumeImagePath, req.StagingTargetPath, strconv.FormatBool(readonly),
-			},
+			MatchLabels:        labels,
+			Replicas:           1,
+			NodeName:           s.NodeName,
+			PropagateFrom:      &pvc.ObjectMeta,
+			Image:              s.Image,
+			Command:            qsdWithNbdCommand(args),
+			Resources:          stagingResources(req.VolumeContext),
 			BackingPvcName:     backingPvcName,
 			BackingPvcBasePath: backingPvcBasePath,
+			ExtraPvcMounts:     extraPvcMounts,
+			KubeletDir:         s.KubeletDir,
 		},
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	err = common.WaitUntilFileIsBlockDevice(ctx, req.StagingTargetPath)
+	err = s.waitForStagingDevice(ctx, pvc, req.StagingTargetPath, stagingReplicaSetName, backingPvcNamespace)
 	if err != nil {
 		return nil, err
 	}
@@ -116,33 +313,75 @@ func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	pvcUid := types.UID(req.VolumeId)
 
-	// delete volume staging ReplicaSet
+	// Volumes staged by this plugin are recorded in the node state, which tells us where to find the staging
+	// ReplicaSet and PVC. Otherwise, fall back to looking them up.
 
-	stagingReplicaSet, err := common.FindReplicaSetByLabelSelector(
-		ctx, s.Clientset,
-		strings.Join(
-			[]string{
-				fmt.Sprintf("%s/component=volume-staging", common.Domain),
-				fmt.Sprintf("%s/node-name=%s", common.Domain, s.NodeName),
-				fmt.Sprintf("%s/pvc-uid=%s", common.Domain, pvcUid),
-			},
-			",",
-		),
-	)
-	if err != nil && !k8serrors.IsNotFound(err) {
-		return nil, err
+	stagedVolume, known := s.State.Get(pvcUid)
+
+	if !known {
+		stagingReplicaSet, err := common.FindReplicaSetByLabelSelector(
+			ctx, s.Clientset, stagingReplicaSetLabelSelector(s.NodeName, pvcUid),
+		)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		if err == nil {
+			stagedVolume.ReplicaSetName = stagingReplicaSet.Name
+			stagedVolume.ReplicaSetNamespace = stagingReplicaSet.Namespace
+		}
+
+		pvc, err := common.FindPvcByLabelSelector(
+			ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, pvcUid),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		stagedVolume.PvcName = pvc.Name
+		stagedVolume.PvcNamespace = pvc.Namespace
 	}
 
-	if err == nil {
-		err = common.DeleteReplicaSetSynchronously(
+	// delete volume staging ReplicaSet
+
+	s.stopQsdEventWatcher(pvcUid)
+
+	if stagedVolume.ReplicaSetName != "" {
+		err := common.DeleteReplicaSetSynchronously(
 			ctx, s.Clientset,
-			stagingReplicaSet.Name, stagingReplicaSet.Namespace,
+			stagedVolume.ReplicaSetName, stagedVolume.ReplicaSetNamespace,
 		)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	// A copy removed from the quorum of a mirrored volume must be recorded as degraded on the PVC before forgetting
+	// about it, or it would be served again. This normally already happened when it was removed.
+
+	degradedMirrorCopy, err := os.ReadFile(common.GenerateMirrorDegradedRecordPath(s.KubeletDir, pvcUid))
+	if err == nil && len(degradedMirrorCopy) > 0 {
+		err = recordDegradedMirrorCopy(
+			ctx, s.Clientset, stagedVolume.PvcName, stagedVolume.PvcNamespace, string(degradedMirrorCopy),
+		)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// the volume may be connected to any device when it is staged again, and which of its copies are served is
+	// decided anew
+
+	for _, path := range []string{
+		common.GenerateNbdDeviceRecordPath(s.KubeletDir, pvcUid),
+		common.GenerateMirrorDegradedRecordPath(s.KubeletDir, pvcUid),
+	} {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
 	// delete block special file
 
 	err = os.Remove(req.StagingTargetPath)
@@ -152,12 +391,19 @@ func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 
 	// remove node name to PVC annotation listing nodes on which it is staged
 
-	pvc, err := common.FindPvcByLabelSelector(ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, pvcUid))
+	err = common.UnstagePvcFromNode(ctx, s.Clientset, stagedVolume.PvcName, stagedVolume.PvcNamespace, s.NodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the last node to unstage a volume staged shared shuts down its shared export
+
+	err = s.unshareVolume(ctx, pvcUid, stagedVolume.PvcName, stagedVolume.PvcNamespace)
 	if err != nil {
 		return nil, err
 	}
 
-	err = common.UnstagePvcFromNode(ctx, s.Clientset, pvc.Name, pvc.Namespace, s.NodeName)
+	err = s.State.Remove(pvcUid)
 	if err != nil {
 		return nil, err
 	}
@@ -169,30 +415,30 @@ func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	// TODO: Must enforce access modes ourselves; check the CSI spec.
 
-	// Kubernetes might place a directory at the path where the block node should go (for some reason). TODO: Check
-	// if that isn't our fault somehow.
-	err := os.Remove(req.TargetPath)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return nil, err
+	// Kubelet may publish a volume right after the node reboots, before the staging pod has exposed the device
+	// again, so give it a moment instead of publishing a path that leads nowhere.
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	err := common.WaitUntilFileIsBlockDevice(waitCtx, req.StagingTargetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "staging path of volume %s is not a block device", req.VolumeId)
 	}
 
-	err = os.Symlink(req.StagingTargetPath, req.TargetPath)
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+
+	err = publishBlockDevice(req.StagingTargetPath, req.TargetPath, req.Readonly)
 	if err != nil {
 		return nil, err
 	}
 
-	if req.Readonly {
-		// TODO: Is changing the block node mode sufficient here?
+	// record the target so that it can be repaired if it breaks
 
-		stat, err := os.Stat(req.TargetPath)
-		if err != nil {
-			return nil, err
-		}
-
-		err = os.Chmod(req.TargetPath, stat.Mode() & ^fs.FileMode(0222)) // clear write bits
-		if err != nil {
-			return nil, err
-		}
+	err = s.State.AddPublishedTarget(types.UID(req.VolumeId), req.TargetPath, req.Readonly)
+	if err != nil {
+		return nil, err
 	}
 
 	resp := &csi.NodePublishVolumeResponse{}
@@ -200,8 +446,16 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 }
 
 func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	err := os.Remove(req.TargetPath)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+
+	err := s.State.RemovePublishedTarget(types.UID(req.VolumeId), req.TargetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unpublishBlockDevice(req.TargetPath)
+	if err != nil {
 		return nil, err
 	}
 
@@ -213,6 +467,8 @@ func (s *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCa
 	caps := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 	}
 
 	csiCaps := make([]*csi.NodeServiceCapability, len(caps))
@@ -233,8 +489,91 @@ func (s *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCa
 }
 
 func (s *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	node, err := s.Clientset.CoreV1().Nodes().Get(ctx, s.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
 	resp := &csi.NodeGetInfoResponse{
 		NodeId: s.NodeName,
 	}
+
+	// lets zonal volumes be scheduled in the zone of their backing volume
+	if zone := node.Labels[common.ZoneTopologyKey]; zone != "" {
+		resp.AccessibleTopology = &csi.Topology{
+			Segments: map[string]string{common.ZoneTopologyKey: zone},
+		}
+	}
+
 	return resp, nil
 }
+
+// What a pod running scripts/qsd-with-nbd.sh serves, and how.
+type qsdWithNbdArgs struct {
+	pvcUid          types.UID
+	outDevPath      string
+	qmpSocketPath   string
+	readonly        bool
+	volumeContext   map[string]string
+	aio             string
+	qemuNbdFallback bool
+	mirrorImagePath string
+	qos             common.VolumeQos
+	format          string
+	qcow2Options    string
+
+	// "server" for a volume's shared export, "client" for the pods that connect to it, or "" otherwise
+	sharedRole          string
+	sharedExportAddress string
+}
+
+func qsdWithNbdCommand(args qsdWithNbdArgs) []string {
+	// clients of a shared export leave checking the image to it
+	checkOnStage := args.volumeContext["checkOnStage"] == "true" && args.sharedRole != "client"
+
+	return []string{
+		"/subprovisioner/qsd-with-nbd.sh",
+		common.GenerateVolumeImagePath(args.pvcUid), args.outDevPath, strconv.FormatBool(args.readonly),
+		args.qmpSocketPath, strconv.FormatBool(args.qemuNbdFallback),
+		strconv.FormatBool(checkOnStage),
+		valueOrDefault(args.volumeContext["nbdConnections"], "1"),
+		valueOrDefault(args.aio, "threads"),
+		strconv.FormatBool(args.volumeContext["iothread"] == "true"),
+		strconv.FormatBool(args.volumeContext["integrity"] == "true"),
+		valueOrDefault(args.volumeContext["cacheMode"], "none"),
+		args.qcow2Options, args.volumeContext["readAhead"],
+		args.mirrorImagePath,
+		strconv.FormatInt(args.qos.MaxIops, 10), strconv.FormatInt(args.qos.MaxBandwidth, 10),
+		args.sharedRole, args.sharedExportAddress,
+		valueOrDefault(args.format, common.ImageFormatQcow2),
+	}
+}
+
+func valueOrDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// The compute resources of a volume's staging pod, given by the "stagingCpu" and "stagingMemory" StorageClass
+// parameters. Both are requested and set as the limit, so that the pod has the Guaranteed QoS class, and thus gets
+// dedicated CPUs from the static CPU manager policy, if both are set.
+func stagingResources(volumeContext map[string]string) corev1.ResourceRequirements {
+	resources := corev1.ResourceList{}
+
+	for key, name := range map[string]corev1.ResourceName{
+		"stagingCpu":    corev1.ResourceCPU,
+		"stagingMemory": corev1.ResourceMemory,
+	} {
+		// validated by CreateVolume
+		if quantity, err := resource.ParseQuantity(volumeContext[key]); err == nil {
+			resources[name] = quantity
+		}
+	}
+
+	if len(resources) == 0 {
+		return corev1.ResourceRequirements{}
+	}
+	return corev1.ResourceRequirements{Requests: resources, Limits: resources}
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestStagingResources(t *testing.T) {
+	resources := stagingResources(map[string]string{})
+	if resources.Requests != nil || resources.Limits != nil {
+		t.Errorf("got %v, want no resources", resources)
+	}
+
+	resources = stagingResources(map[string]string{"stagingCpu": "2", "stagingMemory": "512Mi"})
+	for _, list := range []corev1.ResourceList{resources.Requests, resources.Limits} {
+		cpu, memory := list[corev1.ResourceCPU], list[corev1.ResourceMemory]
+		if cpu.String() != "2" || memory.String() != "512Mi" {
+			t.Errorf("got %v, want 2 CPUs and 512Mi of memory", list)
+		}
+	}
+
+	resources = stagingResources(map[string]string{"stagingCpu": "500m"})
+	if len(resources.Limits) != 1 || resources.Limits.Cpu().MilliValue() != 500 {
+		t.Errorf("got %v, want only 500m CPUs", resources.Limits)
+	}
+}
+
+func TestQsdWithNbdCommand(t *testing.T) {
+	args := qsdWithNbdArgs{
+		pvcUid:        "uid",
+		outDevPath:    "/staging",
+		qmpSocketPath: "/qmp.sock",
+		volumeContext: map[string]string{"checkOnStage": "true"},
+	}
+
+	command := qsdWithNbdCommand(args)
+	if len(command) != 20 || command[6] != "true" || command[17] != "" || command[19] != "qcow2" {
+		t.Errorf("got %v, want 19 arguments to the script, checking a qcow2 image, and not shared", command)
+	}
+
+	// clients of a shared export leave checking the image to it
+
+	args.sharedRole, args.sharedExportAddress = "client", "export.default.svc:10809"
+	command = qsdWithNbdCommand(args)
+	if command[6] != "false" || command[17] != "client" || command[18] != "export.default.svc:10809" {
+		t.Errorf("got %v, want a client of the shared export that doesn't check the image", command)
+	}
+
+	// raw images are opened as such
+
+	args.format = "raw"
+	command = qsdWithNbdCommand(args)
+	if command[19] != "raw" {
+		t.Errorf("got %v, want a raw image", command)
+	}
+}
+
+func TestErrorExcerpt(t *testing.T) {
+	if got := errorExcerpt(errors.New("no NBD devices left")); got != "no NBD devices left" {
+		t.Errorf("got %q", got)
+	}
+
+	logs := strings.Repeat("+ qemu-storage-daemon\n", 20) + "qemu-storage-daemon: Could not open image\n"
+	got := errorExcerpt(errors.New("staging pod failed; its logs were:\n" + logs))
+	want := "staging pod failed; its logs were:\n" + strings.Repeat("+ qemu-storage-daemon\n", 4) +
+		"qemu-storage-daemon: Could not open image"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
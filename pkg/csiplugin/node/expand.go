@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// The block node that qemu-storage-daemon exports a staged volume from (see scripts/qsd-with-nbd.sh). Resizing it
+// resizes the volume's image underneath it.
+const qsdExportNodeName = "throttled"
+
+// NBD_SET_SIZE from linux/nbd.h, which sets the size of an NBD device in bytes. Unlike connecting the device, this may
+// be done while it is in use, as long as it was configured through ioctls rather than netlink (see nbd-client's
+// "-nonetlink" in scripts/qsd-with-nbd.sh).
+const nbdSetSizeIoctl = 0xab02
+
+// Grows a volume that the controller plugin expanded while it was staged on this node. The qemu-storage-daemon
+// instance serving the volume grows its image to the pending capacity recorded on the PVC, the NBD device is then told
+// the new size, as the kernel only learns the size of the export when connecting to it, and only then is the capacity
+// committed on the PVC. Volumes are only ever
+// exposed as block devices, so there is no file system to grow. As qemu-storage-daemon has the image's backing chain
+// open, growing it zeroes whatever part of the new area a bigger backing file would otherwise show through, e.g., after
+// the volume was shrunk (see the expansion Job in the controller plugin).
+func (s *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "must specify volume id")
+	}
+
+	pvcUid := types.UID(req.VolumeId)
+
+	stagedVolume, known := s.State.Get(pvcUid)
+	if !known {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not staged on this node", pvcUid)
+	}
+	if stagedVolume.Readonly {
+		return nil, status.Errorf(codes.FailedPrecondition, "volumes staged read-only can't be expanded")
+	}
+	if stagedVolume.Integrity {
+		return nil, status.Errorf(codes.FailedPrecondition, "volumes with integrity protection can't be expanded")
+	}
+	if stagedVolume.Shared {
+		return nil, status.Errorf(
+			codes.FailedPrecondition, "volumes staged on several nodes read-write can only be expanded while unstaged",
+		)
+	}
+
+	// the controller plugin rounded the capacity to what the image can have
+
+	pvc, err := s.Clientset.CoreV1().PersistentVolumeClaims(stagedVolume.PvcNamespace).
+		Get(ctx, stagedVolume.PvcName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	capacity, err := common.TargetCapacityOf(pvc)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to determine volume capacity")
+	}
+
+	// grow the image, unless a previous attempt already did
+
+	socketPath := common.GenerateQmpSocketPath(s.KubeletDir, pvcUid)
+
+	size, err := queryExportedSize(ctx, socketPath)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, unix.ECONNREFUSED) {
+		if _, statErr := os.Stat(common.GenerateQemuNbdSocketPath(s.KubeletDir, pvcUid)); statErr == nil {
+			return nil, status.Errorf(
+				codes.FailedPrecondition, "volumes served by qemu-nbd can only be expanded while unstaged",
+			)
+		}
+		return nil, status.Errorf(codes.Unavailable, "the staging pod of volume %s isn't running", pvcUid)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if size < capacity {
+		_, err = common.QmpExecute(
+			ctx, socketPath, "block_resize",
+			map[string]interface{}{"node-name": qsdExportNodeName, "size": capacity},
+		)
+		if err != nil {
+			return nil, err
+		}
+		size = capacity
+
+		err = common.EmitEvent(
+			ctx, s.Clientset, common.PvcEventObject(pvc), corev1.EventTypeNormal, "VolumeExpanded",
+			"Grew the volume staged on node %s to %d bytes", s.NodeName, size,
+		)
+		if err != nil {
+			klog.ErrorS(err, "Failed to emit event for expanded volume", "volume", pvcUid)
+		}
+	}
+
+	// make the new size visible through the device
+
+	err = setNbdDeviceSize(stagedVolume.StagingTargetPath, size)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resize NBD device of volume %s: %v", pvcUid, err)
+	}
+
+	// record the new capacity, now that the volume has it
+
+	err = common.UpdatePvcMetadata(
+		ctx, s.Clientset, pvc.Name, pvc.Namespace,
+		func(pvc *corev1.PersistentVolumeClaim) error {
+			common.CommitCapacity(pvc, size)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.V(2).InfoS("Expanded staged volume", "volume", pvcUid, "bytes", size)
+
+	resp := &csi.NodeExpandVolumeResponse{
+		CapacityBytes: size,
+	}
+	return resp, nil
+}
+
+// Returns the virtual size of the node that the given qemu-storage-daemon instance exports.
+func queryExportedSize(ctx context.Context, socketPath string) (int64, error) {
+	result, err := common.QmpExecute(ctx, socketPath, "query-named-block-nodes", map[string]bool{"flat": true})
+	if err != nil {
+		return 0, err
+	}
+	return parseNodeVirtualSize(result, qsdExportNodeName)
+}
+
+// Parses the virtual size of the given node out of the result of query-named-block-nodes.
+func parseNodeVirtualSize(result json.RawMessage, nodeName string) (int64, error) {
+	image, err := parseNodeImage(result, nodeName)
+	if err != nil {
+		return 0, err
+	}
+	return image.VirtualSize, nil
+}
+
+// What query-named-block-nodes tells about the image of a block node.
+type blockNodeImage struct {
+	VirtualSize int64 `json:"virtual-size"`
+	ActualSize  int64 `json:"actual-size"` // the space the image file takes up, or 0 for nodes without one
+}
+
+// Parses the image of the given node out of the result of query-named-block-nodes.
+func parseNodeImage(result json.RawMessage, nodeName string) (blockNodeImage, error) {
+	var nodes []struct {
+		NodeName string         `json:"node-name"`
+		Image    blockNodeImage `json:"image"`
+	}
+	err := json.Unmarshal(result, &nodes)
+	if err != nil {
+		return blockNodeImage{}, fmt.Errorf("malformed block nodes: %w", err)
+	}
+
+	for _, node := range nodes {
+		if node.NodeName == nodeName {
+			return node.Image, nil
+		}
+	}
+
+	return blockNodeImage{}, fmt.Errorf("block node %s not found", nodeName)
+}
+
+// Sets the size of the NBD device at the given path. The staging path holds a copy of the device's special file, which
+// refers to the same device.
+func setNbdDeviceSize(devicePath string, size int64) error {
+	device, err := os.OpenFile(devicePath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	return unix.IoctlSetInt(int(device.Fd()), nbdSetSizeIoctl, int(size))
+}
@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"testing"
+)
+
+func TestParseNodeVirtualSize(t *testing.T) {
+	result := `[
+		{"node-name": "throttled", "drv": "throttle", "image": {"virtual-size": 2147483648, "filename": "json:{}"}},
+		{"node-name": "qcow2", "drv": "qcow2", "image": {"virtual-size": 1073741824, "filename": "/var/backing/a"}}
+	]`
+
+	got, err := parseNodeVirtualSize([]byte(result), "throttled")
+	if err != nil || got != 2147483648 {
+		t.Errorf("got %d, %v", got, err)
+	}
+
+	if _, err := parseNodeVirtualSize([]byte(result), "quorum"); err == nil {
+		t.Errorf("expected error for missing node")
+	}
+
+	if _, err := parseNodeVirtualSize([]byte(`{"node-name": "throttled"}`), "throttled"); err == nil {
+		t.Errorf("expected error for malformed result")
+	}
+}
+
+func TestParseNodeImage(t *testing.T) {
+	result := `[
+		{"node-name": "throttled", "drv": "throttle", "image": {"virtual-size": 2147483648, "filename": "json:{}"}},
+		{"node-name": "qcow2", "drv": "qcow2", "image": {"virtual-size": 2147483648, "actual-size": 196608}}
+	]`
+
+	got, err := parseNodeImage([]byte(result), "qcow2")
+	if err != nil || got != (blockNodeImage{VirtualSize: 2147483648, ActualSize: 196608}) {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	got, err = parseNodeImage([]byte(result), "throttled")
+	if err != nil || got.ActualSize != 0 {
+		t.Errorf("got %+v, %v, want no actual size for a node without an image file", got, err)
+	}
+}
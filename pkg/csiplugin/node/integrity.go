@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Periodically checks the dm-integrity devices of staged volumes with integrity protection for checksum mismatches,
+// i.e., data that was corrupted in the backing store, and reports new ones like other volume failures. The reads that
+// hit them fail with EILSEQ, so the workload notices too, but not necessarily in a way that points at the volume.
+func (s *NodeServer) RunIntegrityMonitor(stopCh <-chan struct{}) {
+	// the mismatch counts last seen for each volume, which start from zero whenever a volume is staged
+	mismatches := map[types.UID]uint64{}
+
+	wait.Until(func() { s.checkIntegrityMismatches(mismatches) }, 30*time.Second, stopCh)
+}
+
+func (s *NodeServer) checkIntegrityMismatches(mismatches map[types.UID]uint64) {
+	volumes := s.State.List()
+
+	for pvcUid := range mismatches {
+		if volume, ok := volumes[pvcUid]; !ok || !volume.Integrity {
+			delete(mismatches, pvcUid)
+		}
+	}
+
+	for pvcUid, volume := range volumes {
+		if !volume.Integrity {
+			continue
+		}
+
+		output, err := exec.Command("dmsetup", "status", common.GenerateIntegrityDeviceName(pvcUid)).Output()
+		if err != nil {
+			continue // the volume may still be being staged
+		}
+
+		count, err := parseIntegrityMismatches(string(output))
+		if err != nil {
+			klog.ErrorS(err, "Failed to check integrity of volume", "volume", pvcUid)
+			continue
+		}
+
+		previous, seen := mismatches[pvcUid]
+		mismatches[pvcUid] = count
+
+		// the count is reset when the volume is restaged, which we may have missed
+		if seen && count < previous {
+			previous = 0
+		}
+		if count <= previous {
+			continue
+		}
+
+		volumeFailures.Add(float64(count-previous), string(pvcUid), "integrity")
+
+		message := fmt.Sprintf(
+			"%d checksum mismatches detected (%d in total since staging), data in the backing volume is corrupt",
+			count-previous, count,
+		)
+		klog.ErrorS(nil, "Volume failed", "volume", pvcUid, "message", message)
+
+		err = s.reportQsdFailure(context.Background(), pvcUid, time.Now(), message)
+		if err != nil {
+			klog.ErrorS(err, "Failed to report failure of volume", "volume", pvcUid)
+		}
+	}
+}
+
+// Parses the mismatch count out of the status of a dm-integrity device, as printed by "dmsetup status":
+//
+//	<start> <length> integrity <mismatches> <provided data sectors> <recalculated sector or "-">
+func parseIntegrityMismatches(status string) (uint64, error) {
+	fields := strings.Fields(status)
+	if len(fields) < 4 || fields[2] != "integrity" {
+		return 0, fmt.Errorf("unexpected dm-integrity status %q", strings.TrimSpace(status))
+	}
+	return strconv.ParseUint(fields[3], 10, 64)
+}
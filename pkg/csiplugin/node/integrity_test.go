@@ -0,0 +1,29 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"testing"
+)
+
+func TestParseIntegrityMismatches(t *testing.T) {
+	tests := []struct {
+		status  string
+		want    uint64
+		wantErr bool
+	}{
+		{"0 2097152 integrity 0 2097152 -\n", 0, false},
+		{"0 2097152 integrity 7 2097152 1048576\n", 7, false},
+		{"0 2097152 linear\n", 0, true},
+		{"0 2097152 integrity x 2097152 -\n", 0, true},
+		{"", 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseIntegrityMismatches(test.status)
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("parseIntegrityMismatches(%q) = %d, %v, want %d (error: %v)",
+				test.status, got, err, test.want, test.wantErr)
+		}
+	}
+}
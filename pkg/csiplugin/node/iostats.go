@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/metrics"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+var (
+	volumeIoLabels = []string{"volume_id", "namespace", "persistentvolumeclaim"}
+
+	volumeReadOperations = metrics.Default.NewCounterVec(
+		"subprovisioner_volume_read_operations_total",
+		"Number of reads completed on a volume staged on this node.",
+		volumeIoLabels...,
+	)
+	volumeWriteOperations = metrics.Default.NewCounterVec(
+		"subprovisioner_volume_write_operations_total",
+		"Number of writes completed on a volume staged on this node.",
+		volumeIoLabels...,
+	)
+	volumeReadBytes = metrics.Default.NewCounterVec(
+		"subprovisioner_volume_read_bytes_total",
+		"Number of bytes read from a volume staged on this node.",
+		volumeIoLabels...,
+	)
+	volumeWrittenBytes = metrics.Default.NewCounterVec(
+		"subprovisioner_volume_written_bytes_total",
+		"Number of bytes written to a volume staged on this node.",
+		volumeIoLabels...,
+	)
+	volumeReadTime = metrics.Default.NewCounterVec(
+		"subprovisioner_volume_read_time_seconds_total",
+		"Total time that reads from a volume staged on this node took, summed over all reads.",
+		volumeIoLabels...,
+	)
+	volumeWriteTime = metrics.Default.NewCounterVec(
+		"subprovisioner_volume_write_time_seconds_total",
+		"Total time that writes to a volume staged on this node took, summed over all writes.",
+		volumeIoLabels...,
+	)
+	volumeInFlightOperations = metrics.Default.NewGaugeVec(
+		"subprovisioner_volume_in_flight_operations",
+		"Number of I/O operations currently in flight on a volume staged on this node.",
+		volumeIoLabels...,
+	)
+)
+
+// Where the kernel exposes block devices by their device numbers.
+var blockDeviceSysfsDir = "/sys/dev/block"
+
+// I/O statistics of a block device, as the kernel reports them in its "stat" attribute.
+type blockDeviceStats struct {
+	ReadOperations   uint64
+	ReadSectors      uint64
+	ReadTicks        uint64 // milliseconds
+	WriteOperations  uint64
+	WriteSectors     uint64
+	WriteTicks       uint64 // milliseconds
+	InFlightRequests uint64
+}
+
+// Parses the contents of a block device's "stat" attribute (see Documentation/block/stat.rst in the kernel).
+func parseBlockDeviceStats(data string) (blockDeviceStats, error) {
+	fields := strings.Fields(data)
+	if len(fields) < 9 {
+		return blockDeviceStats{}, fmt.Errorf("expected at least 9 fields in block device stats, got %d", len(fields))
+	}
+
+	values := make([]uint64, 9)
+	for i := range values {
+		value, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return blockDeviceStats{}, fmt.Errorf("invalid block device stats field %q", fields[i])
+		}
+		values[i] = value
+	}
+
+	return blockDeviceStats{
+		ReadOperations:   values[0],
+		ReadSectors:      values[2],
+		ReadTicks:        values[3],
+		WriteOperations:  values[4],
+		WriteSectors:     values[6],
+		WriteTicks:       values[7],
+		InFlightRequests: values[8],
+	}, nil
+}
+
+// Reads the I/O statistics of the block device at the given path, e.g., a volume's staging path, which is a copy of
+// the NBD device node.
+func readBlockDeviceStats(devicePath string) (blockDeviceStats, error) {
+	sysfsDir, err := blockDeviceSysfsDirOf(devicePath)
+	if err != nil {
+		return blockDeviceStats{}, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(sysfsDir, "stat"))
+	if err != nil {
+		return blockDeviceStats{}, err
+	}
+
+	return parseBlockDeviceStats(string(data))
+}
+
+// Returns the sysfs directory of the block device whose special file is at the given path.
+func blockDeviceSysfsDirOf(devicePath string) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(devicePath, &stat); err != nil {
+		return "", err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", devicePath)
+	}
+
+	major, minor := unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev))
+	return filepath.Join(blockDeviceSysfsDir, fmt.Sprintf("%d:%d", major, minor)), nil
+}
+
+// Periodically exports the I/O statistics of every staged volume as metrics.
+//
+// The statistics are those of the volume's NBD device, which only ever serves that volume, rather than those that
+// qemu-storage-daemon reports through query-blockstats, as it doesn't account for the I/O of its exports (and qemu-nbd
+// has no QMP monitor to begin with).
+func (s *NodeServer) RunVolumeStatsCollector(stopCh <-chan struct{}) {
+	// the label values of the volumes whose statistics are exported, so that they can be removed once unstaged
+	exported := map[types.UID][]string{}
+
+	wait.Until(func() { s.collectVolumeStats(exported) }, 15*time.Second, stopCh)
+}
+
+func (s *NodeServer) collectVolumeStats(exported map[types.UID][]string) {
+	volumes := s.State.List()
+
+	for pvcUid, labels := range exported {
+		if _, ok := volumes[pvcUid]; !ok {
+			deleteVolumeStats(labels)
+			delete(exported, pvcUid)
+		}
+	}
+
+	for pvcUid, volume := range volumes {
+		stats, err := readBlockDeviceStats(volume.StagingTargetPath)
+		if err != nil {
+			// the volume may still be being staged
+			if !os.IsNotExist(err) {
+				klog.ErrorS(err, "Failed to read I/O statistics of volume", "volume", pvcUid)
+			}
+			continue
+		}
+
+		labels := []string{string(pvcUid), volume.PvcNamespace, volume.PvcName}
+		exported[pvcUid] = labels
+
+		volumeReadOperations.Set(float64(stats.ReadOperations), labels...)
+		volumeWriteOperations.Set(float64(stats.WriteOperations), labels...)
+		volumeReadBytes.Set(float64(stats.ReadSectors*512), labels...)
+		volumeWrittenBytes.Set(float64(stats.WriteSectors*512), labels...)
+		volumeReadTime.Set(float64(stats.ReadTicks)/1000, labels...)
+		volumeWriteTime.Set(float64(stats.WriteTicks)/1000, labels...)
+		volumeInFlightOperations.Set(float64(stats.InFlightRequests), labels...)
+	}
+}
+
+func deleteVolumeStats(labels []string) {
+	volumeReadOperations.Delete(labels...)
+	volumeWriteOperations.Delete(labels...)
+	volumeReadBytes.Delete(labels...)
+	volumeWrittenBytes.Delete(labels...)
+	volumeReadTime.Delete(labels...)
+	volumeWriteTime.Delete(labels...)
+	volumeInFlightOperations.Delete(labels...)
+}
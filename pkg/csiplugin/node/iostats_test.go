@@ -0,0 +1,41 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"testing"
+)
+
+func TestParseBlockDeviceStats(t *testing.T) {
+	// read: 120 ops, 2048 sectors, 35 ms; write: 40 ops, 640 sectors, 90 ms; 3 in flight; then discard and flush
+	stats, err := parseBlockDeviceStats("     120        4     2048       35       40        2      640       90        3" +
+		"      110      125        0        0        0        0        7        5\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := blockDeviceStats{
+		ReadOperations:   120,
+		ReadSectors:      2048,
+		ReadTicks:        35,
+		WriteOperations:  40,
+		WriteSectors:     640,
+		WriteTicks:       90,
+		InFlightRequests: 3,
+	}
+	if stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+
+	for _, data := range []string{"", "1 2 3", "1 2 3 4 5 6 7 8 x"} {
+		if _, err := parseBlockDeviceStats(data); err == nil {
+			t.Errorf("%q: expected error", data)
+		}
+	}
+}
+
+func TestReadBlockDeviceStatsRejectsNonDevices(t *testing.T) {
+	if _, err := readBlockDeviceStats(t.TempDir()); err == nil {
+		t.Errorf("expected error for a directory")
+	}
+}
@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// Parameters for loading the nbd kernel module if it isn't loaded. Zero values leave the module's defaults in place.
+type NbdModuleOptions struct {
+	NbdsMax int // number of NBD devices
+	MaxPart int // number of partitions per NBD device
+}
+
+// The NBD devices are looked up in sysfs rather than /dev, as privileged containers only get the device nodes that
+// exist when they are started. A device is connected while it has a "pid" attribute.
+var nbdSysfsBlockDir = "/sys/block"
+
+var nbdDeviceNameRegexp = regexp.MustCompile(`^nbd[0-9]+$`)
+
+// Counts the NBD devices on the node and those of them that aren't connected.
+func countNbdDevices() (total int, free int, err error) {
+	entries, err := os.ReadDir(nbdSysfsBlockDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, entry := range entries {
+		if !nbdDeviceNameRegexp.MatchString(entry.Name()) {
+			continue
+		}
+
+		total++
+		if _, err := os.Stat(filepath.Join(nbdSysfsBlockDir, entry.Name(), "pid")); os.IsNotExist(err) {
+			free++
+		}
+	}
+
+	return total, free, nil
+}
+
+// Arguments to modprobe for loading the nbd kernel module.
+func (o NbdModuleOptions) modprobeArgs() []string {
+	args := []string{"nbd"}
+	if o.NbdsMax > 0 {
+		args = append(args, fmt.Sprintf("nbds_max=%d", o.NbdsMax))
+	}
+	if o.MaxPart > 0 {
+		args = append(args, fmt.Sprintf("max_part=%d", o.MaxPart))
+	}
+	return args
+}
+
+// serializes loading the module, which concurrent NodeStageVolume calls may otherwise attempt at once
+var nbdModuleMutex sync.Mutex
+
+// Loads the nbd kernel module if there are no NBD devices, and fails with a precise error if there still are none, or
+// if all of them are in use, so that staging volumes doesn't wait for a device that will never appear.
+func (s *NodeServer) ensureNbdDeviceAvailable() error {
+	nbdModuleMutex.Lock()
+	defer nbdModuleMutex.Unlock()
+
+	total, free, err := countNbdDevices()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list NBD devices: %v", err)
+	}
+
+	if total == 0 {
+		args := s.NbdModule.modprobeArgs()
+		klog.InfoS("No NBD devices found, loading nbd kernel module", "args", args)
+
+		output, err := exec.Command("modprobe", args...).CombinedOutput()
+		if err != nil {
+			return status.Errorf(
+				codes.FailedPrecondition, "node %s has no NBD devices and loading the nbd kernel module failed: %v: %s",
+				s.NodeName, err, strings.TrimSpace(string(output)),
+			)
+		}
+
+		total, free, err = countNbdDevices()
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to list NBD devices: %v", err)
+		}
+		if total == 0 {
+			return status.Errorf(
+				codes.FailedPrecondition, "node %s has no NBD devices even after loading the nbd kernel module",
+				s.NodeName,
+			)
+		}
+	}
+
+	if free == 0 {
+		return common.ErrorWithReason(
+			codes.ResourceExhausted, common.ReasonNbdDevicesExhausted, map[string]string{"node": s.NodeName},
+			"all %d NBD devices on node %s are in use; reload the nbd kernel module with a higher nbds_max",
+			total, s.NodeName,
+		)
+	}
+
+	return nil
+}
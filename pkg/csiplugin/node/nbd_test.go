@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCountNbdDevices(t *testing.T) {
+	dir := t.TempDir()
+
+	defer func(previous string) { nbdSysfsBlockDir = previous }(nbdSysfsBlockDir)
+	nbdSysfsBlockDir = dir
+
+	for _, name := range []string{"nbd0", "nbd1", "nbd10", "sda", "nbd1p1"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "nbd1", "pid"), []byte("42\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	total, free, err := countNbdDevices()
+	if err != nil || total != 3 || free != 2 {
+		t.Errorf("got %d, %d, %v, want 3, 2, nil", total, free, err)
+	}
+
+	// all devices in use
+
+	for _, name := range []string{"nbd0", "nbd10"} {
+		if err := os.WriteFile(filepath.Join(dir, name, "pid"), []byte("42\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &NodeServer{NodeName: "node"}
+	if err := s.ensureNbdDeviceAvailable(); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got %v, want ResourceExhausted", err)
+	}
+}
+
+func TestNbdModprobeArgs(t *testing.T) {
+	tests := []struct {
+		options NbdModuleOptions
+		want    []string
+	}{
+		{NbdModuleOptions{}, []string{"nbd"}},
+		{NbdModuleOptions{NbdsMax: 64}, []string{"nbd", "nbds_max=64"}},
+		{NbdModuleOptions{NbdsMax: 64, MaxPart: 8}, []string{"nbd", "nbds_max=64", "max_part=8"}},
+	}
+
+	for _, test := range tests {
+		if got := test.options.modprobeArgs(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("got %v, want %v", got, test.want)
+		}
+	}
+}
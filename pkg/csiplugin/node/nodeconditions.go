@@ -0,0 +1,228 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// The condition of this node's Node object through which problems with its NBD devices are reported, in the manner of
+// node-problem-detector's conditions: it is "True" while there is a problem, so that automation like draino or a
+// Cluster API MachineHealthCheck can cordon, drain, or replace the node.
+const nbdProblemConditionType = corev1.NodeConditionType("SubprovisionerNbdProblem")
+
+// Reasons of the condition, from most to least severe.
+const (
+	nbdReasonModuleNotLoaded    = "NbdModuleNotLoaded"
+	nbdReasonDeviceMissing      = "NbdDeviceMissing"
+	nbdReasonDeviceDisconnected = "NbdDeviceDisconnected"
+	nbdReasonDeviceReadOnly     = "NbdDeviceReadOnly"
+	nbdReasonHealthy            = "NbdDevicesHealthy"
+)
+
+var nbdReasonSeverity = map[string]int{
+	nbdReasonModuleNotLoaded:    0,
+	nbdReasonDeviceMissing:      1,
+	nbdReasonDeviceDisconnected: 2,
+	nbdReasonDeviceReadOnly:     3,
+}
+
+// A problem with the NBD device of a staged volume, or with the nbd kernel module if pvcUid is empty.
+type nbdProblem struct {
+	pvcUid  types.UID
+	reason  string
+	message string
+}
+
+// Periodically checks the NBD devices of staged volumes and reports whether any is broken in the node's
+// SubprovisionerNbdProblem condition. A problem must be seen twice in a row to be reported, so that devices being
+// connected or disconnected while staging or unstaging volumes, or while staging pods restart, aren't mistaken for
+// broken ones.
+func (s *NodeServer) RunNbdProblemDetector(stopCh <-chan struct{}) {
+	var previous map[nbdProblem]bool
+	var reported *corev1.NodeCondition
+
+	wait.Until(func() {
+		current := map[nbdProblem]bool{}
+		var persistent []nbdProblem
+
+		for _, problem := range s.findNbdProblems() {
+			current[problem] = true
+			if previous[problem] {
+				persistent = append(persistent, problem)
+			}
+		}
+		previous = current
+
+		condition := nbdProblemCondition(persistent)
+
+		err := s.reportNbdProblemCondition(context.Background(), &reported, condition)
+		if err != nil {
+			klog.ErrorS(
+				err, "Failed to update node condition", "node", s.NodeName, "condition", nbdProblemConditionType,
+			)
+		}
+	}, 30*time.Second, stopCh)
+}
+
+func (s *NodeServer) findNbdProblems() []nbdProblem {
+	var problems []nbdProblem
+	staged := false
+
+	for pvcUid, volume := range s.State.List() {
+		sysfsDir, err := blockDeviceSysfsDirOf(volume.StagingTargetPath)
+		if err != nil {
+			continue // the volume may still be being staged
+		}
+		staged = true
+
+		reason, description := inspectNbdDevice(sysfsDir, volume.Readonly)
+		if reason != "" {
+			problems = append(problems, nbdProblem{
+				pvcUid:  pvcUid,
+				reason:  reason,
+				message: fmt.Sprintf("%s of volume %s %s", nbdDeviceName(sysfsDir), pvcUid, description),
+			})
+		}
+	}
+
+	// the module is loaded on demand, so its absence is only a problem if there are volumes using it
+
+	if total, _, err := countNbdDevices(); err == nil && total == 0 && staged {
+		problems = append(problems, nbdProblem{
+			reason:  nbdReasonModuleNotLoaded,
+			message: "the nbd kernel module isn't loaded although volumes are staged",
+		})
+	}
+
+	return problems
+}
+
+// Checks the NBD device with the given sysfs directory, returning the reason for and a description of its problem, or
+// "" if it has none. A device is expected to be read-only only if the volume was staged read-only.
+func inspectNbdDevice(sysfsDir string, readonly bool) (reason string, description string) {
+	if _, err := os.Stat(sysfsDir); errors.Is(err, os.ErrNotExist) {
+		return nbdReasonDeviceMissing, "no longer exists, e.g., because the nbd kernel module was reloaded"
+	}
+
+	if _, err := os.Stat(filepath.Join(sysfsDir, "pid")); errors.Is(err, os.ErrNotExist) {
+		return nbdReasonDeviceDisconnected, "is disconnected, so all I/O to it fails"
+	}
+
+	ro, err := os.ReadFile(filepath.Join(sysfsDir, "ro"))
+	if err == nil && strings.TrimSpace(string(ro)) == "1" && !readonly {
+		return nbdReasonDeviceReadOnly, "became read-only"
+	}
+
+	return "", ""
+}
+
+// Returns the name of the NBD device with the given sysfs directory, e.g., "nbd3".
+func nbdDeviceName(sysfsDir string) string {
+	if target, err := os.Readlink(sysfsDir); err == nil {
+		return filepath.Base(target)
+	}
+	return "device " + filepath.Base(sysfsDir)
+}
+
+// Returns the condition that reports the given problems, whose reason is that of the most severe one.
+func nbdProblemCondition(problems []nbdProblem) corev1.NodeCondition {
+	if len(problems) == 0 {
+		return corev1.NodeCondition{
+			Type:    nbdProblemConditionType,
+			Status:  corev1.ConditionFalse,
+			Reason:  nbdReasonHealthy,
+			Message: "The NBD devices of all staged volumes are working",
+		}
+	}
+
+	problems = append([]nbdProblem(nil), problems...)
+	sort.Slice(problems, func(i, j int) bool {
+		if nbdReasonSeverity[problems[i].reason] != nbdReasonSeverity[problems[j].reason] {
+			return nbdReasonSeverity[problems[i].reason] < nbdReasonSeverity[problems[j].reason]
+		}
+		return problems[i].pvcUid < problems[j].pvcUid
+	})
+
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.message
+	}
+
+	return corev1.NodeCondition{
+		Type:    nbdProblemConditionType,
+		Status:  corev1.ConditionTrue,
+		Reason:  problems[0].reason,
+		Message: strings.Join(messages, "; "),
+	}
+}
+
+// Sets the condition on the node unless it is already set as given, as recorded in reported, which is nil until the
+// condition is first looked up.
+func (s *NodeServer) reportNbdProblemCondition(
+	ctx context.Context,
+	reported **corev1.NodeCondition,
+	condition corev1.NodeCondition,
+) error {
+	if *reported == nil {
+		node, err := s.Clientset.CoreV1().Nodes().Get(ctx, s.NodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		*reported = &corev1.NodeCondition{}
+		for _, existing := range node.Status.Conditions {
+			if existing.Type == nbdProblemConditionType {
+				*reported = existing.DeepCopy()
+			}
+		}
+	}
+
+	previous := *reported
+	if previous.Status == condition.Status && previous.Reason == condition.Reason &&
+		previous.Message == condition.Message {
+		return nil
+	}
+
+	now := metav1.Now()
+	condition.LastHeartbeatTime = now
+	condition.LastTransitionTime = previous.LastTransitionTime
+	if previous.Status != condition.Status {
+		condition.LastTransitionTime = now
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{"conditions": []corev1.NodeCondition{condition}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Clientset.CoreV1().Nodes().PatchStatus(ctx, s.NodeName, patch)
+	if err != nil {
+		return err
+	}
+
+	if condition.Status == corev1.ConditionTrue {
+		klog.ErrorS(nil, "NBD problem on node", "node", s.NodeName, "message", condition.Message)
+	} else if previous.Status == corev1.ConditionTrue {
+		klog.InfoS("NBD problems resolved", "node", s.NodeName)
+	}
+
+	*reported = &condition
+	return nil
+}
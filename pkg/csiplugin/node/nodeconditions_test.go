@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestInspectNbdDevice(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "43:0")
+
+	check := func(readonly bool, want string) {
+		t.Helper()
+		if reason, _ := inspectNbdDevice(device, readonly); reason != want {
+			t.Errorf("readonly=%v: got %q, want %q", readonly, reason, want)
+		}
+	}
+
+	check(false, nbdReasonDeviceMissing)
+
+	if err := os.Mkdir(device, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(device, "ro"), []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(false, nbdReasonDeviceDisconnected)
+
+	if err := os.WriteFile(filepath.Join(device, "pid"), []byte("42\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(false, "")
+
+	if err := os.WriteFile(filepath.Join(device, "ro"), []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(false, nbdReasonDeviceReadOnly)
+	check(true, "")
+}
+
+func TestNbdProblemCondition(t *testing.T) {
+	condition := nbdProblemCondition(nil)
+	if condition.Status != corev1.ConditionFalse || condition.Reason != nbdReasonHealthy {
+		t.Errorf("got %+v, want a healthy condition", condition)
+	}
+
+	condition = nbdProblemCondition([]nbdProblem{
+		{pvcUid: "b", reason: nbdReasonDeviceReadOnly, message: "nbd1 of volume b became read-only"},
+		{pvcUid: "a", reason: nbdReasonDeviceDisconnected, message: "nbd0 of volume a is disconnected"},
+		{pvcUid: "c", reason: nbdReasonDeviceReadOnly, message: "nbd2 of volume c became read-only"},
+	})
+	if condition.Status != corev1.ConditionTrue || condition.Reason != nbdReasonDeviceDisconnected {
+		t.Errorf("got %+v, want reason %s", condition, nbdReasonDeviceDisconnected)
+	}
+	want := "nbd0 of volume a is disconnected; nbd1 of volume b became read-only; nbd2 of volume c became read-only"
+	if condition.Message != want {
+		t.Errorf("got message %q, want %q", condition.Message, want)
+	}
+}
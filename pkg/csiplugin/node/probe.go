@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// What qemu-storage-daemon can do on this node, as far as serving staged volumes is concerned. Staging pods run the
+// same image as the node plugin, which may be a build for another architecture with other features on some nodes,
+// and nodes may run kernels that lack io_uring or have it disabled, so clusters with mixed nodes get a data path that
+// works on each node without having to configure it per node.
+type qemuCapabilities struct {
+	// Whether qemu-storage-daemon can serve images over NBD. If not, volumes are served by qemu-nbd, if possible.
+	qsdNbdExport bool
+
+	// Whether qemu-storage-daemon can submit I/O with io_uring. If not, volumes with aio "io_uring" use threads, as
+	// Linux AIO would require direct I/O, i.e., cacheMode "none".
+	ioUring bool
+}
+
+// How long a probe may take.
+const qemuProbeTimeout = 10 * time.Second
+
+// Returns the capabilities of qemu-storage-daemon on this node, probing them when first staging a volume. They can only
+// change along with the image or the kernel, i.e., when the node plugin restarts.
+func (s *NodeServer) probedQemuCapabilities() qemuCapabilities {
+	s.qemuCapabilitiesOnce.Do(func() {
+		s.qemuCapabilities = probeQemuCapabilities(s.KubeletDir + "/plugins/subprovisioner/probe")
+		klog.InfoS(
+			"Probed qemu-storage-daemon", "node", s.NodeName, "arch", runtime.GOARCH,
+			"nbdExport", s.qemuCapabilities.qsdNbdExport, "ioUring", s.qemuCapabilities.ioUring,
+		)
+	})
+	return s.qemuCapabilities
+}
+
+// Probes by starting qemu-storage-daemon with each feature in the given directory. If probing is impossible, everything
+// is assumed to work, which leaves it to staging pods to find out otherwise.
+func probeQemuCapabilities(dir string) qemuCapabilities {
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "probe.img"), make([]byte, 4096), 0600)
+	}
+	if err != nil {
+		klog.ErrorS(err, "Failed to set up probing qemu-storage-daemon, assuming all features work")
+		return qemuCapabilities{qsdNbdExport: true, ioUring: true}
+	}
+	defer os.RemoveAll(dir)
+
+	return qemuCapabilities{
+		qsdNbdExport: runQsdProbe(
+			dir,
+			"--blockdev", "driver=null-co,node-name=probe",
+			"--nbd-server", "addr.type=unix,addr.path="+filepath.Join(dir, "probe.sock"),
+			"--export", "type=nbd,id=probe,node-name=probe",
+		),
+		ioUring: runQsdProbe(
+			dir,
+			"--blockdev", "driver=file,node-name=probe,filename="+filepath.Join(dir, "probe.img")+",aio=io_uring",
+		),
+	}
+}
+
+// Whether qemu-storage-daemon starts with the given arguments. It daemonizes once it is set up, after which it is
+// stopped again.
+func runQsdProbe(dir string, args ...string) bool {
+	pidFile := filepath.Join(dir, "probe.pid")
+	_ = os.Remove(pidFile)
+
+	// the daemon keeps the output files open, which must thus be files rather than pipes that would never be closed
+	output, err := os.Create(filepath.Join(dir, "probe.log"))
+	if err != nil {
+		return false
+	}
+	defer output.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), qemuProbeTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "qemu-storage-daemon", append(args, "--daemonize", "--pidfile", pidFile)...)
+	cmd.Stdout, cmd.Stderr = output, output
+
+	if err := cmd.Run(); err != nil {
+		if message, readErr := os.ReadFile(output.Name()); readErr == nil && len(message) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(message)))
+		}
+		klog.V(2).InfoS("qemu-storage-daemon probe failed", "args", args, "err", err)
+		return false
+	}
+
+	if pid, err := os.ReadFile(pidFile); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(pid))); err == nil {
+			_ = syscall.Kill(pid, syscall.SIGTERM)
+		}
+	}
+
+	return true
+}
+
+// Returns the aio backend that staging pods on this node use for the one the volume asks for.
+func (c qemuCapabilities) aioFor(requested string) string {
+	if requested == "io_uring" && !c.ioUring {
+		return "threads"
+	}
+	return requested
+}
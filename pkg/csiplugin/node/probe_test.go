@@ -0,0 +1,24 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import "testing"
+
+func TestAioFor(t *testing.T) {
+	tests := []struct {
+		capabilities qemuCapabilities
+		requested    string
+		want         string
+	}{
+		{qemuCapabilities{ioUring: true}, "io_uring", "io_uring"},
+		{qemuCapabilities{}, "io_uring", "threads"},
+		{qemuCapabilities{}, "native", "native"},
+		{qemuCapabilities{}, "threads", "threads"},
+	}
+
+	for _, test := range tests {
+		if got := test.capabilities.aioFor(test.requested); got != test.want {
+			t.Errorf("%+v: got %s for %s, want %s", test.capabilities, got, test.requested, test.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Makes the staged block device available at the target path by bind-mounting it onto a file there, as other block
+// CSI drivers do, since some container runtimes and tools don't follow symlinks to device nodes.
+func publishBlockDevice(stagingPath string, targetPath string, readonly bool) error {
+	err := unpublishBlockDevice(targetPath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	err = unix.Mount(stagingPath, targetPath, "", unix.MS_BIND, "")
+	if err != nil {
+		return fmt.Errorf("failed to bind-mount %s onto %s: %w", stagingPath, targetPath, err)
+	}
+
+	if readonly {
+		// TODO: Is changing the block node mode sufficient here? (Mounting read-only doesn't restrict writes to device
+		// nodes.)
+
+		stat, err := os.Stat(targetPath)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chmod(targetPath, stat.Mode() & ^fs.FileMode(0222)) // clear write bits
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Undoes publishBlockDevice(). Also removes symlinks left behind by plugin versions that published volumes that way,
+// and directories that Kubernetes might place at the target path (for some reason). TODO: Check if that isn't our
+// fault somehow.
+func unpublishBlockDevice(targetPath string) error {
+	for {
+		// the target may be mounted over several times if publishing raced with itself
+		err := unix.Unmount(targetPath, unix.UMOUNT_NOFOLLOW)
+		if err == unix.EINVAL || errors.Is(err, os.ErrNotExist) {
+			break // not (or no longer) a mount point
+		} else if err != nil {
+			return fmt.Errorf("failed to unmount %s: %w", targetPath, err)
+		}
+	}
+
+	err := os.Remove(targetPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// Whether the target path still leads to the device at the staging path, i.e., it wasn't unmounted (e.g., by a node
+// reboot) and the staging pod didn't expose a different device in the meantime.
+func publishedTargetIsIntact(stagingPath string, targetPath string) bool {
+	var staging, target unix.Stat_t
+	return unix.Stat(stagingPath, &staging) == nil && unix.Stat(targetPath, &target) == nil &&
+		staging.Mode&unix.S_IFMT == unix.S_IFBLK && target.Mode&unix.S_IFMT == unix.S_IFBLK &&
+		staging.Rdev == target.Rdev
+}
+
+func isBlockDevice(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.Mode()&(fs.ModeDevice|fs.ModeCharDevice) == fs.ModeDevice
+}
+
+// Periodically repairs the paths at which staged volumes are published, which may have been removed or replaced behind
+// our back, e.g., across node reboots, while kubelet still considers the volumes published.
+func (s *NodeServer) RunPublishRepair(stopCh <-chan struct{}) {
+	wait.Until(s.repairPublishedTargets, 30*time.Second, stopCh)
+}
+
+func (s *NodeServer) repairPublishedTargets() {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+
+	for pvcUid, volume := range s.State.List() {
+		// Until the staging pod exposes the device again, there is nothing the targets could lead to. NodePublishVolume
+		// waits for it too.
+		if !isBlockDevice(volume.StagingTargetPath) {
+			continue
+		}
+
+		for targetPath, readonly := range volume.PublishedTargets {
+			if publishedTargetIsIntact(volume.StagingTargetPath, targetPath) {
+				continue
+			}
+
+			// the pod may be gone already, in which case kubelet will soon unpublish the volume anyway
+			if _, err := os.Stat(filepath.Dir(targetPath)); errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			klog.InfoS("Repairing broken publish path of volume", "volume", pvcUid, "path", targetPath)
+
+			err := publishBlockDevice(volume.StagingTargetPath, targetPath, readonly)
+			if err != nil {
+				klog.ErrorS(err, "Failed to repair publish path of volume", "volume", pvcUid, "path", targetPath)
+			}
+		}
+	}
+}
+
+// Removes the device nodes at the staging paths of volumes whose qemu-storage-daemon isn't running, e.g., after a node
+// reboot. Such a device node is a copy of an NBD device that isn't connected to the volume anymore, and may even have
+// been taken over by another volume since. The staging pod puts a new device node in place once it is running again.
+func (s *NodeServer) RemoveStaleStagingDevices() {
+	for pvcUid, volume := range s.State.List() {
+		if !isBlockDevice(volume.StagingTargetPath) {
+			continue
+		}
+
+		// volumes staged shared are served by their shared export, so their devices are stale once disconnected
+		var stale error
+		if volume.Shared {
+			stale = nbdDeviceDisconnected(volume.StagingTargetPath)
+		} else {
+			stale = stagingDaemonGone(s.KubeletDir, pvcUid)
+		}
+		if stale == nil {
+			continue
+		}
+
+		klog.InfoS("Removing stale staging device of volume", "volume", pvcUid, "reason", stale)
+
+		err := os.Remove(volume.StagingTargetPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			klog.ErrorS(err, "Failed to remove stale staging device of volume", "volume", pvcUid)
+		}
+	}
+}
+
+// Returns why the qemu-storage-daemon or qemu-nbd instance staging the given volume on this node is conclusively not
+// running, or nil if it may be.
+func stagingDaemonGone(kubeletDir string, pvcUid types.UID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	_, err := common.QmpExecute(ctx, common.GenerateQmpSocketPath(kubeletDir, pvcUid), "query-version", nil)
+	cancel()
+
+	// only conclusive errors, as the daemon may just be slow to respond
+	if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, unix.ECONNREFUSED) {
+		return nil
+	}
+
+	// the volume may be served by qemu-nbd instead, which has no QMP socket
+	if qemuNbdIsRunning(common.GenerateQemuNbdSocketPath(kubeletDir, pvcUid)) {
+		return nil
+	}
+
+	return err
+}
+
+// Returns an error if the NBD device whose special file is at the given path is conclusively disconnected, or nil if
+// it may be connected.
+func nbdDeviceDisconnected(devicePath string) error {
+	sysfsDir, err := blockDeviceSysfsDirOf(devicePath)
+	if err != nil {
+		return nil
+	}
+
+	reason, description := inspectNbdDevice(sysfsDir, true)
+	if reason == nbdReasonDeviceMissing || reason == nbdReasonDeviceDisconnected {
+		return fmt.Errorf("%s %s", nbdDeviceName(sysfsDir), description)
+	}
+
+	return nil
+}
+
+// Whether a qemu-nbd instance may be listening on the given socket, i.e., connecting to it doesn't fail conclusively.
+func qemuNbdIsRunning(socketPath string) bool {
+	conn, err := net.DialTimeout("unix", socketPath, 10*time.Second)
+	if err != nil {
+		return !errors.Is(err, os.ErrNotExist) && !errors.Is(err, unix.ECONNREFUSED)
+	}
+	_ = conn.Close()
+	return true
+}
@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPublishedTargetIsIntact(t *testing.T) {
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging")
+	target := filepath.Join(dir, "target")
+
+	// publishing requires privileges, so only check that anything but the staged device isn't considered intact
+
+	if publishedTargetIsIntact(staging, target) {
+		t.Error("missing paths are intact")
+	}
+
+	for _, path := range []string{staging, target} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if publishedTargetIsIntact(staging, target) {
+		t.Error("regular files are intact")
+	}
+
+	if err := os.Remove(target); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/dev/null", target); err != nil {
+		t.Fatal(err)
+	}
+	if publishedTargetIsIntact("/dev/null", target) {
+		t.Error("character devices are intact")
+	}
+}
+
+func TestUnpublishBlockDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("unmounting requires root, even of paths that aren't mount points")
+	}
+
+	dir := t.TempDir()
+
+	// unmounted files, symlinks from older plugin versions, directories, and missing paths are all removed fine
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "staging"), link); err != nil {
+		t.Fatal(err)
+	}
+	subdir := filepath.Join(dir, "dir")
+	if err := os.Mkdir(subdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{file, link, subdir, filepath.Join(dir, "missing")} {
+		if err := unpublishBlockDevice(path); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists", path)
+		}
+	}
+}
+
+func TestQemuNbdIsRunning(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "nbd.sock")
+
+	if qemuNbdIsRunning(socketPath) {
+		t.Errorf("missing socket considered running")
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !qemuNbdIsRunning(socketPath) {
+		t.Errorf("listening socket considered not running")
+	}
+
+	// leave the socket file behind, as a killed qemu-nbd would
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = listener.Close()
+
+	if qemuNbdIsRunning(socketPath) {
+		t.Errorf("stale socket considered running")
+	}
+}
@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Periodically applies the throttle limits of every staged volume, as given by its PVC and StorageClass, to the
+// qemu-storage-daemon instance serving it, so that changing them doesn't require restaging the volume and thus
+// interrupting its workload.
+//
+// The limits in effect are queried from the instance each time rather than remembered, as a restarted staging pod
+// starts over with the limits the volume was staged with. Volumes served by qemu-nbd can't be throttled and are
+// skipped.
+func (s *NodeServer) RunQosUpdater(stopCh <-chan struct{}) {
+	wait.Until(s.updateQos, 15*time.Second, stopCh)
+}
+
+func (s *NodeServer) updateQos() {
+	for pvcUid := range s.State.List() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		qos, changed, err := s.applyQos(ctx, pvcUid)
+		cancel()
+
+		if err != nil {
+			klog.ErrorS(err, "Failed to apply throttle limits to volume", "volume", pvcUid)
+		} else if changed {
+			klog.V(2).InfoS(
+				"Applied throttle limits to volume (0 is unlimited)",
+				"volume", pvcUid, "iops", qos.MaxIops, "bytesPerSecond", qos.MaxBandwidth,
+			)
+		}
+	}
+}
+
+// Returns the throttle limits of the volume of the given PVC: those given by the PVC's annotations, capped by those of
+// the volume's StorageClass, as recorded in the given volume context.
+func volumeQos(pvc *corev1.PersistentVolumeClaim, volumeContext map[string]string) (common.VolumeQos, error) {
+	qos, err := common.VolumeQosOf(&pvc.ObjectMeta)
+	if err != nil {
+		return common.VolumeQos{}, err
+	}
+
+	storageClassQos, err := common.StorageClassQosOf(volumeContext)
+	if err != nil {
+		return common.VolumeQos{}, err
+	}
+
+	return qos.CappedBy(storageClassQos), nil
+}
+
+// Applies the volume's current throttle limits unless they are already in effect, and returns them and whether they
+// were applied.
+func (s *NodeServer) applyQos(ctx context.Context, pvcUid types.UID) (common.VolumeQos, bool, error) {
+	pvc, err := common.FindPvcByLabelSelector(ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, pvcUid))
+	if err != nil {
+		return common.VolumeQos{}, false, err
+	}
+
+	// the limits of the StorageClass are kept in the PV's volume attributes, which are the volume context
+
+	pv, err := s.Clientset.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return common.VolumeQos{}, false, err
+	}
+
+	var volumeContext map[string]string
+	if pv.Spec.CSI != nil {
+		volumeContext = pv.Spec.CSI.VolumeAttributes
+	}
+
+	qos, err := volumeQos(pvc, volumeContext)
+	if err != nil {
+		return common.VolumeQos{}, false, err
+	}
+
+	socketPath := common.GenerateQmpSocketPath(s.KubeletDir, pvcUid)
+	throttleGroupPath := "/objects/" + common.QsdThrottleGroupId
+
+	result, err := common.QmpExecute(
+		ctx, socketPath, "qom-get", map[string]string{"path": throttleGroupPath, "property": "limits"},
+	)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, unix.ECONNREFUSED) {
+		return qos, false, nil // still being staged, restarting, or served by qemu-nbd
+	} else if err != nil {
+		return common.VolumeQos{}, false, err
+	}
+
+	inEffect, err := parseThrottleLimits(result)
+	if err != nil {
+		return common.VolumeQos{}, false, err
+	}
+	if inEffect == qos {
+		return qos, false, nil
+	}
+
+	_, err = common.QmpExecute(
+		ctx, socketPath, "qom-set",
+		map[string]interface{}{"path": throttleGroupPath, "property": "limits", "value": qos.ThrottleLimits()},
+	)
+	if err != nil {
+		return common.VolumeQos{}, false, err
+	}
+
+	return qos, true, nil
+}
+
+// Parses the "limits" property of a qemu-storage-daemon throttle group, as returned by qom-get.
+func parseThrottleLimits(result json.RawMessage) (common.VolumeQos, error) {
+	var limits struct {
+		IopsTotal int64 `json:"iops-total"`
+		BpsTotal  int64 `json:"bps-total"`
+	}
+	err := json.Unmarshal(result, &limits)
+	if err != nil {
+		return common.VolumeQos{}, fmt.Errorf("malformed throttle limits: %w", err)
+	}
+
+	return common.VolumeQos{MaxIops: limits.IopsTotal, MaxBandwidth: limits.BpsTotal}, nil
+}
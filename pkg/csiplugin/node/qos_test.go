@@ -0,0 +1,47 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"testing"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseThrottleLimits(t *testing.T) {
+	result := `{"bps-total": 104857600, "iops-total": 500, "bps-read": 0, "iops-total-max": 0, "iops-size": 0}`
+
+	got, err := parseThrottleLimits([]byte(result))
+	want := common.VolumeQos{MaxIops: 500, MaxBandwidth: 104857600}
+	if err != nil || got != want {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	if _, err := parseThrottleLimits([]byte(`"throttle"`)); err == nil {
+		t.Errorf("expected error for malformed limits")
+	}
+}
+
+func TestVolumeQos(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/max-iops": "5k", common.Domain + "/max-bandwidth": "1Mi"},
+		},
+	}
+
+	// annotations can lower the limits of the StorageClass, but not lift them
+
+	got, err := volumeQos(pvc, map[string]string{"maxIops": "1000", "maxBandwidth": "104857600"})
+	want := common.VolumeQos{MaxIops: 1000, MaxBandwidth: 1 << 20}
+	if err != nil || got != want {
+		t.Errorf("got %+v, %v, want %+v", got, err, want)
+	}
+
+	got, err = volumeQos(pvc, nil)
+	want = common.VolumeQos{MaxIops: 5000, MaxBandwidth: 1 << 20}
+	if err != nil || got != want {
+		t.Errorf("got %+v, %v, want %+v", got, err, want)
+	}
+}
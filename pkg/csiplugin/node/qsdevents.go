@@ -0,0 +1,275 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/metrics"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// How often at most a volume's failures on this node are reported on its PVC, as a failing backing store may make
+// every request fail.
+const qsdFailureReportInterval = time.Minute
+
+var volumeFailures = metrics.Default.NewCounterVec(
+	"subprovisioner_volume_failures_total",
+	"Number of failures that qemu-storage-daemon reported for a volume staged on this node, by kind (io, export, integrity, or mirror).",
+	"volume_id", "kind",
+)
+
+// Periodically makes sure that the qemu-storage-daemon events of every staged volume are being watched, so that I/O
+// errors on the backing store and failed exports are reported instead of only surfacing in the workload.
+func (s *NodeServer) RunQsdEventWatchers(stopCh <-chan struct{}) {
+	wait.Until(s.updateQsdEventWatchers, 10*time.Second, stopCh)
+}
+
+func (s *NodeServer) updateQsdEventWatchers() {
+	s.qsdEventWatchersMutex.Lock()
+	defer s.qsdEventWatchersMutex.Unlock()
+
+	if s.qsdEventWatchers == nil {
+		s.qsdEventWatchers = map[types.UID]context.CancelFunc{}
+	}
+
+	volumes := s.State.List()
+
+	for pvcUid, cancel := range s.qsdEventWatchers {
+		if _, ok := volumes[pvcUid]; !ok {
+			cancel()
+			delete(s.qsdEventWatchers, pvcUid)
+		}
+	}
+
+	for pvcUid := range volumes {
+		if _, ok := s.qsdEventWatchers[pvcUid]; !ok {
+			ctx, cancel := context.WithCancel(context.Background())
+			s.qsdEventWatchers[pvcUid] = cancel
+			go s.watchQsdEvents(ctx, pvcUid)
+		}
+	}
+}
+
+// Stops watching the volume's events, so that its qemu-storage-daemon shutting down while unstaging it isn't reported
+// as a failure.
+func (s *NodeServer) stopQsdEventWatcher(pvcUid types.UID) {
+	s.qsdEventWatchersMutex.Lock()
+	defer s.qsdEventWatchersMutex.Unlock()
+
+	if cancel, ok := s.qsdEventWatchers[pvcUid]; ok {
+		cancel()
+		delete(s.qsdEventWatchers, pvcUid)
+	}
+
+	volumeFailures.Delete(string(pvcUid), "io")
+	volumeFailures.Delete(string(pvcUid), "export")
+	volumeFailures.Delete(string(pvcUid), "integrity")
+	volumeFailures.Delete(string(pvcUid), "mirror")
+}
+
+func (s *NodeServer) watchQsdEvents(ctx context.Context, pvcUid types.UID) {
+	socketPath := common.GenerateQmpEventsSocketPath(s.KubeletDir, pvcUid)
+
+	var lastReport time.Time
+	unreported := 0
+
+	// reconnect whenever the connection ends, e.g., because the staging pod was recreated
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		err := common.QmpReadEvents(ctx, socketPath, func(event common.QmpEvent) {
+			kind, message := describeQsdEvent(event)
+			if kind == "" {
+				return
+			}
+
+			volumeFailures.Inc(string(pvcUid), kind)
+			klog.ErrorS(nil, "Volume failed", "volume", pvcUid, "message", message)
+
+			if kind == "mirror" {
+				err := s.removeFailedMirrorCopy(ctx, pvcUid, mirrorCopyOfEvent(event))
+				if err != nil {
+					klog.ErrorS(err, "Failed to remove failed copy of volume", "volume", pvcUid)
+				}
+			}
+
+			unreported++
+			if time.Since(lastReport) < qsdFailureReportInterval {
+				return
+			}
+
+			if unreported > 1 {
+				message = fmt.Sprintf("%s (and %d earlier failures)", message, unreported-1)
+			}
+
+			err := s.reportQsdFailure(ctx, pvcUid, event.Time(), message)
+			if err != nil {
+				klog.ErrorS(err, "Failed to report failure of volume", "volume", pvcUid)
+				return
+			}
+
+			lastReport = time.Now()
+			unreported = 0
+		})
+
+		// the daemon not running (yet) is expected and left to the staging pod's readiness to surface
+		if ctx.Err() == nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, unix.ECONNREFUSED) {
+			klog.ErrorS(err, "Stopped receiving events of volume", "volume", pvcUid)
+		}
+	}, 5*time.Second)
+}
+
+// Returns the kind of failure the event reports and a description of it, or "" if it doesn't report a failure.
+func describeQsdEvent(event common.QmpEvent) (kind string, message string) {
+	switch event.Event {
+	case "BLOCK_IO_ERROR":
+		var data struct {
+			Operation string `json:"operation"`
+			NoSpace   bool   `json:"nospace"`
+			Reason    string `json:"reason"`
+		}
+		_ = json.Unmarshal(event.Data, &data)
+
+		if data.NoSpace {
+			return "io", fmt.Sprintf("I/O error on %s: no space left in backing volume", data.Operation)
+		}
+		return "io", fmt.Sprintf("I/O error on %s: %s", data.Operation, data.Reason)
+
+	case "BLOCK_EXPORT_DELETED":
+		var data struct {
+			Id string `json:"id"`
+		}
+		_ = json.Unmarshal(event.Data, &data)
+
+		return "export", fmt.Sprintf("export %s was removed, the volume is no longer accessible", data.Id)
+
+	case "QUORUM_REPORT_BAD":
+		var data struct {
+			Type     string `json:"type"`
+			Error    string `json:"error"`
+			NodeName string `json:"node-name"`
+		}
+		_ = json.Unmarshal(event.Data, &data)
+
+		which := common.MirrorCopyOfNode(data.NodeName)
+		if which == "" {
+			return "", ""
+		}
+		return "mirror", fmt.Sprintf("%s copy failed on %s: %s", which, data.Type, data.Error)
+
+	case "QUORUM_FAILURE":
+		return "io", "I/O error on both copies of the mirrored volume"
+
+	default:
+		return "", ""
+	}
+}
+
+// Emits an Event on the volume's PVC and records the failure in its last-failure annotation, from which the controller
+// plugin derives the volume's condition.
+func (s *NodeServer) reportQsdFailure(ctx context.Context, pvcUid types.UID, at time.Time, message string) error {
+	pvc, err := common.FindPvcByLabelSelector(ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, pvcUid))
+	if err != nil {
+		return err
+	}
+
+	err = common.ApplyPvcMetadata(
+		ctx, s.Clientset, pvc.Name, pvc.Namespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{
+				common.Domain + "/last-failure": fmt.Sprintf(
+					"%s %s on node %s", at.UTC().Format(time.RFC3339), message, s.NodeName,
+				),
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return common.EmitEvent(
+		ctx, s.Clientset, common.PvcEventObject(pvc),
+		corev1.EventTypeWarning, "VolumeFailure", "Volume failed on node %s: %s", s.NodeName, message,
+	)
+}
+
+// Returns the copy of a mirrored volume that a QUORUM_REPORT_BAD event is about.
+func mirrorCopyOfEvent(event common.QmpEvent) string {
+	var data struct {
+		NodeName string `json:"node-name"`
+	}
+	_ = json.Unmarshal(event.Data, &data)
+	return common.MirrorCopyOfNode(data.NodeName)
+}
+
+// Removes a failed copy of a mirrored volume from the quorum that the volume is served from, as writes that failed on
+// it left it out of date, and records that it is degraded so that it isn't served again until the controller plugin
+// resynchronizes it. Refuses to remove the last up-to-date copy.
+func (s *NodeServer) removeFailedMirrorCopy(ctx context.Context, pvcUid types.UID, which string) error {
+	recordPath := common.GenerateMirrorDegradedRecordPath(s.KubeletDir, pvcUid)
+
+	recorded, err := os.ReadFile(recordPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(recorded) > 0 && string(recorded) != which {
+		return fmt.Errorf("the %s copy was already removed, so the %s copy is the only one left", recorded, which)
+	}
+
+	pvc, err := common.FindPvcByLabelSelector(ctx, s.Clientset, fmt.Sprintf("%s/uid=%s", common.Domain, pvcUid))
+	if err != nil {
+		return err
+	}
+	if degraded := common.DegradedCopyOf(&pvc.ObjectMeta); degraded != "" && degraded != which {
+		return fmt.Errorf("the %s copy is out of date, so the %s copy is the only one left", degraded, which)
+	}
+
+	if len(recorded) == 0 {
+		// recorded first so that a restarted staging pod doesn't serve the copy again, even if removing it fails
+
+		err = os.WriteFile(recordPath, []byte(which), 0o644)
+		if err != nil {
+			return err
+		}
+
+		_, err = common.QmpExecute(
+			ctx, common.GenerateQmpSocketPath(s.KubeletDir, pvcUid), "x-blockdev-change",
+			map[string]string{"parent": "quorum", "child": common.MirrorCopyChildName(which)},
+		)
+		if err != nil {
+			return err
+		}
+
+		klog.InfoS(
+			"Removed copy of volume, which is now served from the other copy only", "volume", pvcUid, "copy", which,
+		)
+	}
+
+	return recordDegradedMirrorCopy(ctx, s.Clientset, pvc.Name, pvc.Namespace, which)
+}
+
+// Records in the "mirror-degraded" annotation of a mirrored volume's PVC that the given copy is out of date.
+func recordDegradedMirrorCopy(
+	ctx context.Context,
+	clientset *common.Clientset,
+	pvcName string,
+	pvcNamespace string,
+	which string,
+) error {
+	return common.ApplyPvcMetadata(
+		ctx, clientset, pvcName, pvcNamespace,
+		metav1.ObjectMeta{
+			Annotations: map[string]string{common.Domain + "/mirror-degraded": which},
+		},
+	)
+}
@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"testing"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+)
+
+func TestDescribeQsdEvent(t *testing.T) {
+	tests := []struct {
+		event       string
+		data        string
+		wantKind    string
+		wantMessage string
+	}{
+		{
+			"BLOCK_IO_ERROR", `{"operation": "write", "action": "report", "nospace": false, "reason": "Input/output error"}`,
+			"io", "I/O error on write: Input/output error",
+		},
+		{
+			"BLOCK_IO_ERROR", `{"operation": "write", "action": "report", "nospace": true, "reason": "No space left"}`,
+			"io", "I/O error on write: no space left in backing volume",
+		},
+		{
+			"BLOCK_EXPORT_DELETED", `{"id": "export"}`,
+			"export", "export export was removed, the volume is no longer accessible",
+		},
+		{
+			"QUORUM_REPORT_BAD", `{"type": "write", "error": "Input/output error", "node-name": "mirror-qcow2"}`,
+			"mirror", "mirror copy failed on write: Input/output error",
+		},
+		{"QUORUM_REPORT_BAD", `{"type": "read", "node-name": "file"}`, "", ""},
+		{"QUORUM_FAILURE", `{"reference": "quorum"}`, "io", "I/O error on both copies of the mirrored volume"},
+		{"JOB_STATUS_CHANGE", `{"id": "job", "status": "running"}`, "", ""},
+	}
+
+	for _, test := range tests {
+		kind, message := describeQsdEvent(common.QmpEvent{Event: test.event, Data: []byte(test.data)})
+		if kind != test.wantKind || message != test.wantMessage {
+			t.Errorf("%s: got (%s, \"%s\"), want (%s, \"%s\")", test.event, kind, message, test.wantKind, test.wantMessage)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog/v2"
+)
+
+// Makes sure the shared export of a volume being staged shared is running, and returns the address at which the nodes
+// it is staged on reach it. The export is a ReplicaSet whose pod runs qemu-storage-daemon on whichever node the backing
+// volume can be mounted, serving the image over NBD through a Service, so that only that instance opens the image,
+// however many nodes write to the volume. Those get the given arguments of their own staging pods, which serve the
+// image the same way.
+//
+// NBD has no authentication, so a NetworkPolicy only lets the volume's staging pods connect to the export. It is
+// created before the ReplicaSet, so that the export's pod is never reachable without it, and then owned by it, as is
+// the Service, so that they go away with it.
+func (s *NodeServer) ensureSharedExport(
+	ctx context.Context,
+	pvc *corev1.PersistentVolumeClaim,
+	args qsdWithNbdArgs,
+	location common.BackingLocation,
+	extraPvcMounts []common.PvcMount,
+) (string, error) {
+	pvcUid := common.VolumeUidOf(pvc)
+	name := common.GenerateSharedExportName(pvcUid)
+
+	labels := map[string]string{
+		common.Domain + "/component": "volume-sharing",
+		common.Domain + "/pvc-uid":   string(pvcUid),
+	}
+
+	// No node plugin manages the export's qemu-storage-daemon instance, so its QMP monitor stays inside the pod. It may
+	// run on another node than this one, so it gets the volume's aio as is and falls back on its own if it must.
+	args.outDevPath = ""
+	args.qmpSocketPath = fmt.Sprintf("/tmp/qmp/%s.sock", pvcUid)
+	args.aio = args.volumeContext["aio"]
+	args.sharedRole = "server"
+
+	networkPolicies := s.Clientset.NetworkingV1().NetworkPolicies(location.PvcNamespace)
+
+	_, err := networkPolicies.Create(
+		ctx, sharedExportNetworkPolicy(name, location.PvcNamespace, labels, pvcUid), metav1.CreateOptions{},
+	)
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return "", err
+	}
+
+	networkPolicy, err := networkPolicies.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	err = common.CheckNameCollision("NetworkPolicy", &networkPolicy.ObjectMeta, "volume-sharing")
+	if err != nil {
+		return "", err
+	}
+
+	err = common.CreateReplicaSet(
+		ctx, s.Clientset,
+		common.ReplicaSetConfig{
+			Name:      name,
+			Namespace: location.PvcNamespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				common.Domain + "/pvc-name":              pvc.Name,
+				common.Domain + "/pvc-namespace":         pvc.Namespace,
+				common.Domain + "/backing-pvc-name":      location.PvcName,
+				common.Domain + "/backing-pvc-namespace": location.PvcNamespace,
+			},
+			MatchLabels:        labels,
+			Replicas:           1,
+			PropagateFrom:      &pvc.ObjectMeta,
+			Image:              s.Image,
+			Command:            qsdWithNbdCommand(args),
+			Resources:          stagingResources(args.volumeContext),
+			BackingPvcName:     location.PvcName,
+			BackingPvcBasePath: location.BasePath,
+			ExtraPvcMounts:     extraPvcMounts,
+			WithoutKubeletDir:  true,
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	replicaSet, err := s.Clientset.AppsV1().ReplicaSets(location.PvcNamespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	ownerReferences := []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: replicaSet.Name, UID: replicaSet.UID},
+	}
+
+	if len(networkPolicy.OwnerReferences) == 0 {
+		networkPolicy.OwnerReferences = ownerReferences
+		_, err = networkPolicies.Update(ctx, networkPolicy, metav1.UpdateOptions{})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       location.PvcNamespace,
+			Labels:          labels,
+			OwnerReferences: ownerReferences,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports:    []corev1.ServicePort{{Name: "nbd", Port: common.SharedExportPort}},
+		},
+	}
+
+	services := s.Clientset.CoreV1().Services(location.PvcNamespace)
+
+	_, err = services.Create(ctx, service, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		existing, err := services.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		err = common.CheckNameCollision("Service", &existing.ObjectMeta, "volume-sharing")
+		if err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s.%s.svc:%d", name, location.PvcNamespace, common.SharedExportPort), nil
+}
+
+// The NetworkPolicy that only admits connections to the shared export of a volume from the volume's staging pods.
+// The export's pod has the given labels.
+func sharedExportNetworkPolicy(
+	name string,
+	namespace string,
+	labels map[string]string,
+	pvcUid types.UID,
+) *networkingv1.NetworkPolicy {
+	protocol := corev1.ProtocolTCP
+	port := intstr.FromInt(common.SharedExportPort)
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: labels},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From: []networkingv1.NetworkPolicyPeer{
+						{
+							PodSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{
+									common.Domain + "/component": "volume-staging",
+									common.Domain + "/pvc-uid":   string(pvcUid),
+								},
+							},
+						},
+					},
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &protocol, Port: &port}},
+				},
+			},
+		},
+	}
+}
+
+// Shuts down the shared export of a volume that was staged shared and is no longer staged on any node, i.e., that
+// UnstagePvcFromNode() put in the "unsharing" state, and then makes the volume idle. Does nothing for other volumes.
+func (s *NodeServer) unshareVolume(
+	ctx context.Context,
+	pvcUid types.UID,
+	pvcName string,
+	pvcNamespace string,
+) error {
+	pvc, err := s.Clientset.CoreV1().PersistentVolumeClaims(pvcNamespace).Get(ctx, pvcName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if pvc.Annotations[common.Domain+"/state"] != "unsharing" {
+		return nil
+	}
+
+	location := common.BackingLocationOf(&pvc.ObjectMeta)
+
+	name := common.GenerateSharedExportName(pvcUid)
+
+	err = common.DeleteReplicaSetSynchronously(ctx, s.Clientset, name, location.PvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	// the NetworkPolicy is only owned by the ReplicaSet once the latter exists
+
+	err = s.Clientset.NetworkingV1().NetworkPolicies(location.PvcNamespace).
+		Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	err = common.FinishUnsharingPvc(ctx, s.Clientset, pvcName, pvcNamespace)
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS("Shut down shared export of volume", "volume", pvcUid)
+	return nil
+}
@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"testing"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestSharedExportNetworkPolicy(t *testing.T) {
+	exportLabels := map[string]string{
+		common.Domain + "/component": "volume-sharing",
+		common.Domain + "/pvc-uid":   "uid",
+	}
+
+	policy := sharedExportNetworkPolicy("export", "ns", exportLabels, "uid")
+
+	if len(policy.Spec.PolicyTypes) != 1 || policy.Spec.PolicyTypes[0] != networkingv1.PolicyTypeIngress {
+		t.Fatalf("got policy types %v, want only ingress", policy.Spec.PolicyTypes)
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+	if err != nil || !selector.Matches(labels.Set(exportLabels)) {
+		t.Errorf("got pod selector %v, %v, want one that selects the export", selector, err)
+	}
+
+	if len(policy.Spec.Ingress) != 1 || len(policy.Spec.Ingress[0].From) != 1 {
+		t.Fatalf("got %v, want a single ingress rule with a single peer", policy.Spec.Ingress)
+	}
+
+	rule := policy.Spec.Ingress[0]
+	if len(rule.Ports) != 1 || rule.Ports[0].Port.IntValue() != common.SharedExportPort {
+		t.Errorf("got ports %v, want only the export's", rule.Ports)
+	}
+
+	peer := rule.From[0]
+	if peer.NamespaceSelector != nil || peer.IPBlock != nil {
+		t.Errorf("got peer %v, want only pods in the export's namespace", peer)
+	}
+
+	peers, err := metav1.LabelSelectorAsSelector(peer.PodSelector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, podLabels := range []struct {
+		labels map[string]string
+		admit  bool
+	}{
+		{map[string]string{common.Domain + "/component": "volume-staging", common.Domain + "/pvc-uid": "uid"}, true},
+		{map[string]string{common.Domain + "/component": "volume-staging", common.Domain + "/pvc-uid": "other"}, false},
+		{map[string]string{common.Domain + "/pvc-uid": "uid"}, false},
+		{map[string]string{}, false},
+	} {
+		if got := peers.Matches(labels.Set(podLabels.labels)); got != podLabels.admit {
+			t.Errorf("%v: got admitted %t, want %t", podLabels.labels, got, podLabels.admit)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"sync"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"google.golang.org/grpc/codes"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Limits the number of volumes being staged at once on the node, making further stagings wait for their turn in the
+// order they arrived. The zero value is ready to use.
+type stagingQueue struct {
+	mutex   sync.Mutex
+	running int
+	waiters []chan struct{}
+}
+
+// Waits until fewer than limit stagings are running, or the context is done. If the staging has to wait, queued is
+// first called with the number of stagings running or waiting ahead of it. Must be paired with a call to leave() if it
+// succeeds. Stagings never wait if limit is less than 1.
+func (q *stagingQueue) enter(ctx context.Context, limit int, queued func(ahead int)) error {
+	q.mutex.Lock()
+
+	if limit < 1 || (q.running < limit && len(q.waiters) == 0) {
+		q.running++
+		q.mutex.Unlock()
+		return nil
+	}
+
+	ahead := q.running + len(q.waiters)
+	ch := make(chan struct{})
+	q.waiters = append(q.waiters, ch)
+	q.mutex.Unlock()
+
+	queued(ahead)
+
+	select {
+	case <-ch:
+		return nil // leave() handed its slot over to us
+	case <-ctx.Done():
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+
+		for i, waiter := range q.waiters {
+			if waiter == ch {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				return ctx.Err()
+			}
+		}
+
+		// leave() handed its slot over to us in the meantime, so pass it on
+		q.leaveLocked()
+		return ctx.Err()
+	}
+}
+
+func (q *stagingQueue) leave() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.leaveLocked()
+}
+
+func (q *stagingQueue) leaveLocked() {
+	if len(q.waiters) > 0 {
+		close(q.waiters[0])
+		q.waiters = q.waiters[1:]
+		return
+	}
+
+	q.running--
+}
+
+// Waits for the volume of the given PVC to take its turn to be staged on this node, under MaxConcurrentStagings, and
+// lets users know through an Event on the PVC if it has to wait. Fails with codes.Aborted if the request times out
+// first, in which case kubelet retries it. Must be paired with a call to s.stagings.leave() if it succeeds.
+func (s *NodeServer) waitForStagingTurn(ctx context.Context, pvcUid types.UID, pvcObject common.EventObject) error {
+	err := s.stagings.enter(ctx, s.MaxConcurrentStagings, func(ahead int) {
+		klog.V(2).InfoS(
+			"Staging of volume is queued behind other volumes on this node", "volume", pvcUid, "ahead", ahead,
+		)
+
+		err := common.EmitEvent(
+			ctx, s.Clientset, pvcObject,
+			corev1.EventTypeNormal, "StagingQueued",
+			"Waiting for %d other volumes to be staged on node %s before staging this one", ahead, s.NodeName,
+		)
+		if err != nil {
+			klog.ErrorS(err, "Failed to emit event for queued volume", "volume", pvcUid)
+		}
+	})
+	if err != nil {
+		return common.ErrorWithReason(
+			codes.Aborted, common.ReasonStagingQueued, map[string]string{"node": s.NodeName},
+			"still waiting for other volumes to be staged on node %s: %v", s.NodeName, err,
+		)
+	}
+
+	return nil
+}
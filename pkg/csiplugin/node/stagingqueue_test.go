@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStagingQueue(t *testing.T) {
+	ctx := context.Background()
+	var q stagingQueue
+
+	noQueueing := func(ahead int) { t.Errorf("queued behind %d", ahead) }
+
+	for i := 0; i < 2; i++ {
+		if err := q.enter(ctx, 2, noQueueing); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// further stagings wait in order, and are told how many are ahead of them
+
+	var order []int
+	done := make(chan int, 2)
+
+	for i := 0; i < 2; i++ {
+		i := i
+		queued := make(chan int, 1)
+		go func() {
+			if err := q.enter(ctx, 2, func(ahead int) { queued <- ahead }); err != nil {
+				t.Error(err)
+			}
+			done <- i
+		}()
+		if ahead := <-queued; ahead != 2+i {
+			t.Errorf("staging %d queued behind %d, want %d", i, ahead, 2+i)
+		}
+	}
+
+	select {
+	case i := <-done:
+		t.Fatalf("staging %d entered beyond the limit", i)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	q.leave()
+	order = append(order, <-done)
+	q.leave()
+	order = append(order, <-done)
+
+	if order[0] != 0 || order[1] != 1 {
+		t.Errorf("got order %v", order)
+	}
+
+	q.leave()
+	q.leave()
+
+	if q.running != 0 || len(q.waiters) != 0 {
+		t.Errorf("state not cleaned up: running %d, waiters %d", q.running, len(q.waiters))
+	}
+}
+
+func TestStagingQueueTimeout(t *testing.T) {
+	var q stagingQueue
+
+	if err := q.enter(context.Background(), 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := q.enter(ctx, 1, func(int) {})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v", err)
+	}
+
+	q.leave()
+
+	if q.running != 0 || len(q.waiters) != 0 {
+		t.Errorf("state not cleaned up: running %d, waiters %d", q.running, len(q.waiters))
+	}
+}
+
+func TestStagingQueueUnlimited(t *testing.T) {
+	var q stagingQueue
+
+	for i := 0; i < 100; i++ {
+		if err := q.enter(context.Background(), 0, func(int) { t.Fatal("queued") }); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
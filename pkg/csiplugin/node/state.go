@@ -0,0 +1,273 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Where the node plugin persists the volumes it staged, so that it survives plugin restarts. Instances of the driver
+// with other names than the default one keep separate state files.
+func GenerateStateFilePath(kubeletDir string) string {
+	if common.Domain != common.DefaultDomain {
+		return fmt.Sprintf("%s/plugins/subprovisioner/node-state-%s.json", kubeletDir, common.Domain)
+	}
+	return kubeletDir + "/plugins/subprovisioner/node-state.json"
+}
+
+// What the node plugin needs to know to unstage a volume without having to look anything up in the cluster.
+type StagedVolume struct {
+	StagingTargetPath   string `json:"stagingTargetPath"`
+	Readonly            bool   `json:"readonly"`
+	PvcName             string `json:"pvcName"`
+	PvcNamespace        string `json:"pvcNamespace"`
+	ReplicaSetName      string `json:"replicaSetName"`
+	ReplicaSetNamespace string `json:"replicaSetNamespace"`
+
+	// Whether the staging device is a dm-integrity device whose checksum mismatches must be reported.
+	Integrity bool `json:"integrity,omitempty"`
+
+	// Whether the volume is staged shared, i.e., its device is connected to the volume's shared export rather than to
+	// a qemu-storage-daemon instance on this node.
+	Shared bool `json:"shared,omitempty"`
+
+	// The paths the volume is published at, mapped to whether they were published read-only.
+	PublishedTargets map[string]bool `json:"publishedTargets,omitempty"`
+}
+
+// The volumes staged on the current node, keyed by volume uid. Every modification is written through to the state
+// file.
+type State struct {
+	mutex   sync.Mutex
+	path    string
+	volumes map[types.UID]StagedVolume
+}
+
+// Loads the state from the given file, starting out empty if it doesn't exist.
+func LoadState(path string) (*State, error) {
+	state := &State{
+		path:    path,
+		volumes: map[types.UID]StagedVolume{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &state.volumes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse node state file %s: %w", path, err)
+	}
+
+	return state, nil
+}
+
+func (s *State) Get(pvcUid types.UID) (StagedVolume, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	volume, ok := s.volumes[pvcUid]
+	return volume, ok
+}
+
+// Returns a copy of all volumes in the state.
+func (s *State) List() map[types.UID]StagedVolume {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	volumes := make(map[types.UID]StagedVolume, len(s.volumes))
+	for pvcUid, volume := range s.volumes {
+		volumes[pvcUid] = volume
+	}
+	return volumes
+}
+
+// Keeps the paths the volume is already published at, if any, as staging the volume again doesn't unpublish it.
+func (s *State) Set(pvcUid types.UID, volume StagedVolume) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	volume.PublishedTargets = s.volumes[pvcUid].PublishedTargets
+	s.volumes[pvcUid] = volume
+	return s.save()
+}
+
+// Does nothing if the volume isn't in the state, e.g., because it was staged by a plugin version that didn't keep a
+// state file and Reconcile() couldn't recover it.
+func (s *State) AddPublishedTarget(pvcUid types.UID, targetPath string, readonly bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	volume, ok := s.volumes[pvcUid]
+	if !ok {
+		return nil
+	}
+	if ro, published := volume.PublishedTargets[targetPath]; published && ro == readonly {
+		return nil
+	}
+
+	// copy on write, as List() shares the map with its callers
+
+	targets := make(map[string]bool, len(volume.PublishedTargets)+1)
+	for path, ro := range volume.PublishedTargets {
+		targets[path] = ro
+	}
+	targets[targetPath] = readonly
+
+	volume.PublishedTargets = targets
+	s.volumes[pvcUid] = volume
+	return s.save()
+}
+
+// Succeeds if the volume isn't in the state or isn't published at the given path.
+func (s *State) RemovePublishedTarget(pvcUid types.UID, targetPath string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	volume, ok := s.volumes[pvcUid]
+	if _, published := volume.PublishedTargets[targetPath]; !ok || !published {
+		return nil
+	}
+
+	targets := make(map[string]bool, len(volume.PublishedTargets))
+	for path, ro := range volume.PublishedTargets {
+		if path != targetPath {
+			targets[path] = ro
+		}
+	}
+
+	volume.PublishedTargets = targets
+	s.volumes[pvcUid] = volume
+	return s.save()
+}
+
+// Succeeds if the volume isn't in the state.
+func (s *State) Remove(pvcUid types.UID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.volumes[pvcUid]; !ok {
+		return nil
+	}
+
+	delete(s.volumes, pvcUid)
+	return s.save()
+}
+
+// Adds volumes whose staging ReplicaSets exist on the given node but are missing from the state, e.g., because they
+// were staged by a plugin version that didn't keep a state file, and drops volumes that are neither backed by a
+// staging ReplicaSet nor have a staging path anymore.
+func (s *State) Reconcile(ctx context.Context, clientset *common.Clientset, nodeName string) error {
+	replicaSets, err := clientset.AppsV1().ReplicaSets(metav1.NamespaceAll).
+		List(ctx, metav1.ListOptions{LabelSelector: stagingReplicaSetLabelSelector(nodeName, "")})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.reconcile(replicaSets.Items, func(path string) bool {
+		_, err := os.Stat(path)
+		return !errors.Is(err, os.ErrNotExist)
+	})
+
+	return s.save()
+}
+
+// Must be called with the mutex held. Does what Reconcile() does given the node's staging ReplicaSets, without
+// persisting the result.
+func (s *State) reconcile(replicaSets []appsv1.ReplicaSet, pathExists func(path string) bool) {
+	found := map[types.UID]bool{}
+
+	for i := range replicaSets {
+		replicaSet := &replicaSets[i]
+		pvcUid := types.UID(replicaSet.Labels[common.Domain+"/pvc-uid"])
+		found[pvcUid] = true
+
+		if _, ok := s.volumes[pvcUid]; ok {
+			continue
+		}
+
+		// see NodeStageVolume for the command's layout
+		command := replicaSet.Spec.Template.Spec.Containers[0].Command
+		if len(command) < 4 {
+			klog.InfoS(
+				"Ignoring staging ReplicaSet with unexpected command",
+				"replicaSet", klog.KRef(replicaSet.Namespace, replicaSet.Name), "command", command,
+			)
+			continue
+		}
+
+		klog.InfoS(
+			"Recovered staged volume", "volume", pvcUid, "replicaSet", klog.KRef(replicaSet.Namespace, replicaSet.Name),
+		)
+
+		s.volumes[pvcUid] = StagedVolume{
+			StagingTargetPath:   command[2],
+			Readonly:            command[3] == "true",
+			PvcName:             replicaSet.Annotations[common.Domain+"/pvc-name"],
+			PvcNamespace:        replicaSet.Annotations[common.Domain+"/pvc-namespace"],
+			ReplicaSetName:      replicaSet.Name,
+			ReplicaSetNamespace: replicaSet.Namespace,
+			Integrity:           len(command) > 10 && command[10] == "true",
+		}
+	}
+
+	for pvcUid, volume := range s.volumes {
+		if !found[pvcUid] && !pathExists(volume.StagingTargetPath) {
+			klog.V(2).InfoS("Forgetting volume, which is no longer staged", "volume", pvcUid)
+			delete(s.volumes, pvcUid)
+		}
+	}
+}
+
+// Must be called with the mutex held. Writes to a temporary file first so that a crash can't leave a truncated state
+// file behind.
+func (s *State) save() error {
+	data, err := json.Marshal(s.volumes)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tempPath := s.path + ".tmp"
+
+	err = os.WriteFile(tempPath, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, s.path)
+}
+
+func stagingReplicaSetLabelSelector(nodeName string, pvcUid types.UID) string {
+	selectors := []string{
+		fmt.Sprintf("%s/component=volume-staging", common.Domain),
+		fmt.Sprintf("%s/node-name=%s", common.Domain, nodeName),
+	}
+	if pvcUid != "" {
+		selectors = append(selectors, fmt.Sprintf("%s/pvc-uid=%s", common.Domain, pvcUid))
+	}
+	return strings.Join(selectors, ",")
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestStatePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "node-state.json")
+
+	state, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := StagedVolume{StagingTargetPath: "/staging/a", PvcName: "pvc-a", ReplicaSetName: "rs-a"}
+	if err := state.Set("a", volume); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Set("b", StagedVolume{StagingTargetPath: "/staging/b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Remove("missing"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := loaded.Get("a"); !ok || !reflect.DeepEqual(got, volume) {
+		t.Errorf("got %+v (%v), want %+v", got, ok, volume)
+	}
+	if _, ok := loaded.Get("b"); ok {
+		t.Errorf("removed volume was persisted")
+	}
+}
+
+func stagingReplicaSet(pvcUid types.UID, command ...string) appsv1.ReplicaSet {
+	return appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "rs-" + string(pvcUid),
+			Namespace: "backing",
+			Labels:    map[string]string{common.Domain + "/pvc-uid": string(pvcUid)},
+			Annotations: map[string]string{
+				common.Domain + "/pvc-name":      "pvc-" + string(pvcUid),
+				common.Domain + "/pvc-namespace": "default",
+			},
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Command: command}}},
+			},
+		},
+	}
+}
+
+func TestStateReconcile(t *testing.T) {
+	known := StagedVolume{StagingTargetPath: "/staging/known", ReplicaSetName: "custom"}
+
+	state := &State{
+		volumes: map[types.UID]StagedVolume{
+			"known":          known,                                          // kept, has a ReplicaSet
+			"still-staged":   {StagingTargetPath: "/staging/still-staged"},   // kept, staging path exists
+			"no-longer-here": {StagingTargetPath: "/staging/no-longer-here"}, // dropped
+		},
+	}
+
+	replicaSets := []appsv1.ReplicaSet{
+		stagingReplicaSet("known", "qsd-with-nbd.sh", "image", "/other", "false"),
+		stagingReplicaSet("recovered", "qsd-with-nbd.sh", "image", "/staging/recovered", "true", "qmp"),
+		stagingReplicaSet("malformed", "qsd-with-nbd.sh"),
+		stagingReplicaSet(
+			"integrity", "qsd-with-nbd.sh", "image", "/staging/integrity", "false", "qmp", "false", "false", "1",
+			"threads", "false", "true",
+		),
+	}
+
+	state.reconcile(replicaSets, func(path string) bool {
+		return path == "/staging/still-staged"
+	})
+
+	want := map[types.UID]StagedVolume{
+		"known":        known,
+		"still-staged": {StagingTargetPath: "/staging/still-staged"},
+		"recovered": {
+			StagingTargetPath:   "/staging/recovered",
+			Readonly:            true,
+			PvcName:             "pvc-recovered",
+			PvcNamespace:        "default",
+			ReplicaSetName:      "rs-recovered",
+			ReplicaSetNamespace: "backing",
+		},
+		"integrity": {
+			StagingTargetPath:   "/staging/integrity",
+			PvcName:             "pvc-integrity",
+			PvcNamespace:        "default",
+			ReplicaSetName:      "rs-integrity",
+			ReplicaSetNamespace: "backing",
+			Integrity:           true,
+		},
+	}
+
+	if !reflect.DeepEqual(state.volumes, want) {
+		t.Errorf("got %+v, want %+v", state.volumes, want)
+	}
+}
+
+func TestStatePublishedTargets(t *testing.T) {
+	state, err := LoadState(filepath.Join(t.TempDir(), "node-state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown volumes are ignored
+
+	if err := state.AddPublishedTarget("unknown", "/target", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Get("unknown"); ok {
+		t.Error("unknown volume was added")
+	}
+
+	if err := state.Set("a", StagedVolume{StagingTargetPath: "/staging/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.AddPublishedTarget("a", "/target/1", false); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := state.List()
+
+	if err := state.AddPublishedTarget("a", "/target/2", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// staging again keeps the targets, and earlier listings aren't affected by later changes
+
+	if err := state.Set("a", StagedVolume{StagingTargetPath: "/staging/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.RemovePublishedTarget("a", "/target/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := state.Get("a")
+	if want := map[string]bool{"/target/2": true}; !reflect.DeepEqual(got.PublishedTargets, want) {
+		t.Errorf("got targets %v, want %v", got.PublishedTargets, want)
+	}
+	if want := map[string]bool{"/target/1": false}; !reflect.DeepEqual(listed["a"].PublishedTargets, want) {
+		t.Errorf("earlier listing has targets %v, want %v", listed["a"].PublishedTargets, want)
+	}
+}
@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// The block node of the image of a staged volume, whatever its format, or of the primary copy of a mirrored volume (see
+// scripts/qsd-with-nbd.sh).
+const qsdImageNodeName = "qcow2"
+
+// Reports the usage of a volume published on this node, which kubelet exposes as the kubelet_volume_stats_* metrics.
+//
+// Volumes are block devices, whose total is the size of the device. What they use is the space that the volume's image
+// takes up in its backing volume, as qemu-storage-daemon reports it, which shows how thinly provisioned the volume is,
+// and may exceed its capacity by the image's metadata. Volumes whose staging pod has no QMP monitor on this node, i.e.,
+// those served by qemu-nbd or by a shared export, only report their total. Should file system volumes ever be
+// published, their usage is that of the mounted file system.
+func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "must specify volume id")
+	}
+	if req.VolumePath == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "must specify volume path")
+	}
+
+	pvcUid := types.UID(req.VolumeId)
+
+	if _, known := s.State.Get(pvcUid); !known {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not staged on this node", pvcUid)
+	}
+
+	info, err := os.Stat(req.VolumePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not published at %s", pvcUid, req.VolumePath)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		usage, err := fileSystemUsage(req.VolumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get file system usage of volume %s: %v", pvcUid, err)
+		}
+		return &csi.NodeGetVolumeStatsResponse{Usage: usage}, nil
+	}
+
+	size, err := blockDeviceSize(req.VolumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get size of volume %s: %v", pvcUid, err)
+	}
+
+	usage := &csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: size}
+
+	allocated, err := s.queryAllocatedSize(ctx, pvcUid)
+	if err == nil {
+		usage.Used = allocated
+		usage.Available = size - allocated
+		if usage.Available < 0 {
+			usage.Available = 0
+		}
+	} else if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, unix.ECONNREFUSED) {
+		klog.ErrorS(err, "Failed to query allocated size of volume", "volume", pvcUid)
+	}
+
+	resp := &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{usage},
+	}
+	return resp, nil
+}
+
+// Returns the space that the image of the given staged volume takes up in its backing volume.
+func (s *NodeServer) queryAllocatedSize(ctx context.Context, pvcUid types.UID) (int64, error) {
+	result, err := common.QmpExecute(
+		ctx, common.GenerateQmpSocketPath(s.KubeletDir, pvcUid), "query-named-block-nodes",
+		map[string]bool{"flat": true},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	image, err := parseNodeImage(result, qsdImageNodeName)
+	if err != nil {
+		return 0, err
+	}
+	return image.ActualSize, nil
+}
+
+// Returns the size of the block device at the given path.
+func blockDeviceSize(path string) (int64, error) {
+	device, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer device.Close()
+
+	return device.Seek(0, io.SeekEnd)
+}
+
+// Returns the byte and inode usage of the file system mounted at the given path.
+func fileSystemUsage(path string) ([]*csi.VolumeUsage, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := int64(stat.Bsize)
+
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(stat.Blocks) * blockSize,
+			Used:      int64(stat.Blocks-stat.Bfree) * blockSize,
+			Available: int64(stat.Bavail) * blockSize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(stat.Files),
+			Used:      int64(stat.Files - stat.Ffree),
+			Available: int64(stat.Ffree),
+		},
+	}, nil
+}
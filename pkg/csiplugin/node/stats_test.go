@@ -0,0 +1,38 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestBlockDeviceSize(t *testing.T) {
+	// regular files report their size the same way
+	path := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(path, make([]byte, 8192), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := blockDeviceSize(path)
+	if err != nil || size != 8192 {
+		t.Errorf("got %d, %v, want 8192", size, err)
+	}
+}
+
+func TestFileSystemUsage(t *testing.T) {
+	usage, err := fileSystemUsage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(usage) != 2 || usage[0].Unit != csi.VolumeUsage_BYTES || usage[1].Unit != csi.VolumeUsage_INODES {
+		t.Fatalf("got %v, want byte and inode usage", usage)
+	}
+	if usage[0].Total <= 0 || usage[0].Used > usage[0].Total {
+		t.Errorf("got %v, want consistent byte usage", usage[0])
+	}
+}
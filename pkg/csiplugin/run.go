@@ -5,117 +5,299 @@ package csiplugin
 import (
 	"context"
 	"fmt"
-	"log"
 	"net"
-	"os"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	csiaddonsidentity "github.com/csi-addons/spec/lib/go/identity"
+	"github.com/csi-addons/spec/lib/go/replication"
 	"github.com/kubernetes-csi/external-snapshotter/client/v6/clientset/versioned"
 	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
 	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/controller"
 	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/identity"
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/metrics"
 	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/node"
 	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
 )
 
-func RunControllerPlugin(csiSocketPath string, image string) error {
-	clientset, listener, server, err := setup(csiSocketPath)
+type ControllerPluginOptions struct {
+	MaxConcurrentSnapshotsPerBackingVolume int
+
+	// How the volumes of deleted PVCs are deleted without overwhelming backing volumes.
+	Deletion controller.DeletionOptions
+
+	// Where to serve Prometheus metrics, e.g., ":8080". Metrics aren't served if empty.
+	MetricsAddress string
+
+	// How long in-flight requests may take to finish when the plugin is asked to terminate.
+	ShutdownGracePeriod time.Duration
+
+	// Where to run the Jobs that operate on volumes, e.g., creating, cloning, and deleting them.
+	JobPlacement common.JobPlacement
+
+	// Which labels and annotations of PVCs to copy onto the Jobs that operate on their volumes.
+	MetadataPropagation common.MetadataPropagation
+
+	// How often to probe the health of backing volumes by writing to and reading from a canary image in each of them.
+	// Backing volumes aren't probed if 0.
+	BackingStoreProbeInterval time.Duration
+
+	// How and where to periodically export the usage of the volumes and snapshots of each namespace, e.g., for
+	// chargeback. Usage isn't exported if there are no sinks.
+	UsageExport controller.UsageExportOptions
+
+	// How the replica that runs the monitor is elected if the controller plugin runs several replicas.
+	LeaderElection LeaderElectionOptions
+}
+
+func RunControllerPlugin(endpoint Endpoint, image string, options ControllerPluginOptions) error {
+	if len(options.UsageExport.Sinks) > 0 && options.UsageExport.Interval <= 0 {
+		return fmt.Errorf("usage export interval must be positive")
+	}
+	for _, sink := range options.UsageExport.Sinks {
+		if sink.Kind == "metrics" && options.MetricsAddress == "" {
+			return fmt.Errorf("usage sink \"metrics\" requires --metrics-address")
+		}
+	}
+
+	clientset, listener, server, err := setup(endpoint)
 	if err != nil {
 		return err
 	}
 
-	// run monitor
+	// check and convert state left behind by other plugin versions
+
+	err = common.CheckPvcStateVersions(context.Background(), clientset, true)
+	if err != nil {
+		return err
+	}
+
+	err = common.CheckVolumeSnapshotStateVersions(context.Background(), clientset, true)
+	if err != nil {
+		return err
+	}
+
+	common.DefaultJobPlacement = options.JobPlacement
+	common.DefaultMetadataPropagation = options.MetadataPropagation
+
+	// run the PVC cache that the controller service and the monitor share, which every replica needs
+
+	pvcInformer := controller.NewPvcInformer(clientset)
+	go pvcInformer.Run(wait.NeverStop)
+
+	controllerServer := &controller.ControllerServer{
+		Clientset:                              clientset,
+		Image:                                  image,
+		PvcInformer:                            pvcInformer,
+		MaxConcurrentSnapshotsPerBackingVolume: options.MaxConcurrentSnapshotsPerBackingVolume,
+	}
 
 	monitor := controller.ControllerMonitor{
-		Clientset: clientset,
-		Image:     image,
+		Clientset:                 clientset,
+		Image:                     image,
+		PvcInformer:               pvcInformer,
+		ExportCapacityMetrics:     options.MetricsAddress != "",
+		Deletion:                  options.Deletion,
+		Controller:                controllerServer,
+		BackingStoreProbeInterval: options.BackingStoreProbeInterval,
+		UsageExport:               options.UsageExport,
+	}
+
+	// run the monitor, in only one replica if there may be several
+
+	if options.LeaderElection.Enabled {
+		err = startLeaderElection(clientset, options.LeaderElection, monitor.Run)
+		if err != nil {
+			return err
+		}
+	} else {
+		go monitor.Run()
+	}
+
+	if options.MetricsAddress != "" {
+		metrics.Serve(options.MetricsAddress)
 	}
-	go monitor.Run()
 
 	// run gRPC server
 
-	csi.RegisterIdentityServer(server, &identity.IdentityServer{})
-	csi.RegisterControllerServer(server, &controller.ControllerServer{
+	csi.RegisterIdentityServer(server.Server, &identity.IdentityServer{})
+	csi.RegisterControllerServer(server.Server, controllerServer)
+	csiaddonsidentity.RegisterIdentityServer(server.Server, &identity.CsiAddonsIdentityServer{})
+	replication.RegisterControllerServer(server.Server, &controller.ReplicationServer{
 		Clientset: clientset,
 		Image:     image,
 	})
-	return server.Serve(listener)
+	return server.serveUntilTerminated(listener, options.ShutdownGracePeriod)
+}
+
+type NodePluginOptions struct {
+	KubeletDir string
+
+	// Where to serve Prometheus metrics, e.g., ":8080". Metrics aren't served if empty.
+	MetricsAddress string
+
+	// How long in-flight requests may take to finish when the plugin is asked to terminate.
+	ShutdownGracePeriod time.Duration
+
+	// Whether to stage volumes with qemu-nbd if qemu-storage-daemon isn't present in the image or fails to start.
+	QemuNbdFallback bool
+
+	// Parameters for loading the nbd kernel module when staging a volume on a node that has no NBD devices.
+	NbdModule node.NbdModuleOptions
 
-	// TODO: Handle SIGTERM gracefully.
+	// How many volumes may be staged at once on the node, further ones waiting for their turn. Unlimited if 0.
+	MaxConcurrentStagings int
+
+	// Which labels and annotations of PVCs to copy onto the ReplicaSets that stage their volumes.
+	MetadataPropagation common.MetadataPropagation
 }
 
-func RunNodePlugin(csiSocketPath string, nodeName string, image string) error {
-	clientset, listener, server, err := setup(csiSocketPath)
+func RunNodePlugin(endpoint Endpoint, nodeName string, image string, options NodePluginOptions) error {
+	clientset, listener, server, err := setup(endpoint)
 	if err != nil {
 		return err
 	}
 
-	// run gRPC server
+	// check state left behind by other plugin versions (conversion is left to the controller plugin)
 
-	csi.RegisterIdentityServer(server, &identity.IdentityServer{})
-	csi.RegisterNodeServer(server, &node.NodeServer{
-		Clientset: clientset,
-		NodeName:  nodeName,
-		Image:     image,
-	})
-	return server.Serve(listener)
+	err = common.CheckPvcStateVersions(context.Background(), clientset, false)
+	if err != nil {
+		return err
+	}
 
-	// TODO: Handle SIGTERM gracefully.
-}
+	common.DefaultMetadataPropagation = options.MetadataPropagation
 
-func setup(csiSocketPath string) (*common.Clientset, net.Listener, *grpc.Server, error) {
-	// set up Kubernetes API connection
+	// recover the volumes staged before the plugin last restarted, in case the state file is out of date (a failure
+	// to reconcile isn't fatal, as the state file alone is enough to unstage volumes)
 
-	config, err := rest.InClusterConfig()
+	state, err := node.LoadState(node.GenerateStateFilePath(options.KubeletDir))
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
 
-	kubernetesClientset, err := kubernetes.NewForConfig(config)
+	err = state.Reconcile(context.Background(), clientset, nodeName)
 	if err != nil {
-		return nil, nil, nil, err
+		klog.ErrorS(err, "Failed to reconcile node state with staging ReplicaSets")
 	}
 
-	snapshotClientset, err := versioned.NewForConfig(config)
-	if err != nil {
-		return nil, nil, nil, err
+	nodeServer := &node.NodeServer{
+		Clientset:  clientset,
+		NodeName:   nodeName,
+		Image:      image,
+		State:      state,
+		KubeletDir: options.KubeletDir,
+
+		QemuNbdFallback:       options.QemuNbdFallback,
+		NbdModule:             options.NbdModule,
+		MaxConcurrentStagings: options.MaxConcurrentStagings,
 	}
 
-	clientset := &common.Clientset{
-		Clientset:         kubernetesClientset,
-		SnapshotClientSet: snapshotClientset,
+	// the staging devices of volumes may have outlived their qemu-storage-daemon instances, e.g., across node
+	// reboots, and their publish paths may have broken
+
+	nodeServer.RemoveStaleStagingDevices()
+	go nodeServer.RunPublishRepair(make(chan struct{}))
+
+	// report failures of staged volumes
+
+	go nodeServer.RunQsdEventWatchers(make(chan struct{}))
+	go nodeServer.RunIntegrityMonitor(make(chan struct{}))
+
+	// report broken NBD devices in the node's conditions
+
+	go nodeServer.RunNbdProblemDetector(make(chan struct{}))
+
+	// apply changes to the throttle limits of staged volumes
+
+	go nodeServer.RunQosUpdater(make(chan struct{}))
+
+	if options.MetricsAddress != "" {
+		go nodeServer.RunVolumeStatsCollector(make(chan struct{}))
+		metrics.Serve(options.MetricsAddress)
+	}
+
+	// run gRPC server
+
+	csi.RegisterIdentityServer(server.Server, &identity.IdentityServer{})
+	csi.RegisterNodeServer(server.Server, nodeServer)
+	return server.serveUntilTerminated(listener, options.ShutdownGracePeriod)
+}
+
+func setup(endpoint Endpoint) (*common.Clientset, net.Listener, *pluginServer, error) {
+	// set up Kubernetes API connection
+
+	clientset, err := newClientset()
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
 	// create gRPC server
 
-	err = os.Remove(csiSocketPath)
-	if err != nil && !os.IsNotExist(err) {
+	serverOptions, err := endpoint.serverOptions()
+	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	listener, err := net.Listen("unix", csiSocketPath)
+	listener, err := endpoint.listen()
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to listen: %v", err)
+		return nil, nil, nil, err
 	}
 
+	server := &pluginServer{}
+
 	interceptor := func(
 		ctx context.Context,
 		req interface{},
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler,
 	) (interface{}, error) {
-		log.Printf("%s({ %+v})", info.FullMethod, req)
-		resp, err := handler(ctx, req)
-		if err == nil {
-			log.Printf("%s(...) --> { %+v}", info.FullMethod, resp)
-		} else {
-			log.Printf("%s(...) --> %+v", info.FullMethod, err)
+		ctx, done, err := server.track(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
 		}
-		return resp, err
+		defer done()
+
+		return logRequest(ctx, req, info, handler)
 	}
-	server := grpc.NewServer(grpc.UnaryInterceptor(interceptor))
+	server.Server = grpc.NewServer(append(serverOptions, grpc.UnaryInterceptor(interceptor))...)
 
 	return clientset, listener, server, nil
 }
+
+func newClientset() (*common.Clientset, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return newClientsetForConfig(config)
+}
+
+func newClientsetForConfig(config *rest.Config) (*common.Clientset, error) {
+	kubernetesClientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotClientset, err := versioned.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset := &common.Clientset{
+		Clientset:         kubernetesClientset,
+		SnapshotClientSet: snapshotClientset,
+		Dynamic:           dynamicClient,
+	}
+	return clientset, nil
+}
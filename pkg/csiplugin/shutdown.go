@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// The default time that a plugin gives in-flight requests to finish when asked to terminate, which leaves room within
+// the 30 seconds that Kubernetes waits by default before killing it.
+const DefaultShutdownGracePeriod = 20 * time.Second
+
+// How long requests that didn't finish within the grace period have to return once their contexts are canceled.
+const shutdownCancellationTimeout = 5 * time.Second
+
+// A plugin's gRPC server, which keeps track of the requests it is serving so that it can shut down without cutting
+// them off.
+type pluginServer struct {
+	*grpc.Server
+
+	mutex    sync.Mutex
+	draining bool
+	inFlight map[*inFlightRpc]struct{}
+}
+
+type inFlightRpc struct {
+	method string
+	cancel context.CancelFunc
+}
+
+// Registers a request that is starting, returning the context to serve it with and a function to call when it is done.
+// Fails with codes.Unavailable if the server is shutting down, so that the client retries against its replacement.
+func (s *pluginServer) track(ctx context.Context, method string) (context.Context, func(), error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.draining {
+		return nil, nil, status.Errorf(codes.Unavailable, "the plugin is shutting down")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	rpc := &inFlightRpc{method: method, cancel: cancel}
+
+	if s.inFlight == nil {
+		s.inFlight = map[*inFlightRpc]struct{}{}
+	}
+	s.inFlight[rpc] = struct{}{}
+
+	done := func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		delete(s.inFlight, rpc)
+		cancel()
+	}
+
+	return ctx, done, nil
+}
+
+// Refuses further requests and returns the methods of those that are in flight.
+func (s *pluginServer) drain() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.draining = true
+
+	methods := make([]string, 0, len(s.inFlight))
+	for rpc := range s.inFlight {
+		methods = append(methods, rpc.method)
+	}
+	return methods
+}
+
+// Cancels the contexts of the requests in flight, returning their methods.
+func (s *pluginServer) cancelInFlight() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	methods := make([]string, 0, len(s.inFlight))
+	for rpc := range s.inFlight {
+		methods = append(methods, rpc.method)
+		rpc.cancel()
+	}
+	return methods
+}
+
+// Serves until the plugin receives SIGTERM or SIGINT, then shuts down gracefully: new requests are refused, and those
+// in flight are given the grace period to finish. The contexts of those that are still running after that are
+// canceled, which makes them return at their next wait, e.g., for a Job. This leaves the operation at a point from
+// which retrying the request resumes it, as the Jobs that operations run and the state annotations on PVCs and
+// VolumeSnapshots record their progress. Finally, the server is stopped.
+func (s *pluginServer) serveUntilTerminated(listener net.Listener, gracePeriod time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(listener) }()
+
+	select {
+	case err := <-served:
+		return err
+	case received := <-signals:
+		klog.InfoS("Shutting down after in-flight requests finish", "signal", received, "requests", s.drain())
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		klog.InfoS("Shut down gracefully")
+		return nil
+	case <-time.After(gracePeriod):
+	}
+
+	klog.InfoS(
+		"Canceling requests that didn't finish in time", "requests", s.cancelInFlight(), "gracePeriod", gracePeriod,
+	)
+
+	select {
+	case <-stopped:
+		klog.InfoS("Shut down after canceling requests")
+	case <-time.After(shutdownCancellationTimeout):
+		klog.InfoS("Requests didn't return after being canceled, stopping anyway")
+		s.Stop()
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPluginServerDrainsRequests(t *testing.T) {
+	var s pluginServer
+
+	ctx, done, err := s.track(context.Background(), "/csi.v1.Controller/CreateVolume")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if methods := s.drain(); !reflect.DeepEqual(methods, []string{"/csi.v1.Controller/CreateVolume"}) {
+		t.Errorf("got in-flight methods %v", methods)
+	}
+
+	// requests are refused while draining
+
+	_, _, err = s.track(context.Background(), "/csi.v1.Controller/DeleteVolume")
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v, want code Unavailable", err)
+	}
+
+	// in-flight requests are canceled
+
+	if ctx.Err() != nil {
+		t.Fatal("context canceled before canceling in-flight requests")
+	}
+	s.cancelInFlight()
+	if ctx.Err() == nil {
+		t.Error("context not canceled")
+	}
+
+	done()
+
+	if methods := s.cancelInFlight(); len(methods) != 0 {
+		t.Errorf("got in-flight methods %v after they finished", methods)
+	}
+}
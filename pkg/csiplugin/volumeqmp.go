@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"gitlab.com/subprovisioner/subprovisioner/pkg/csiplugin/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// QMP commands that the volume-qmp command may run against the qemu-storage-daemon instance serving a staged volume.
+// These only report on the state of the instance, so that debugging can't disrupt the workload using the volume.
+//
+// Commands that change how volumes are served, like qom-set or block-latency-histogram-set, aren't included. Throttle
+// limits in particular are managed by the node plugin, which would undo changes made here (see the "max-iops" and
+// "max-bandwidth" PVC annotations).
+var volumeQmpAllowlist = map[string]bool{
+	"query-block":               true,
+	"query-block-exports":       true,
+	"query-blockstats":          true,
+	"query-named-block-nodes":   true,
+	"query-version":             true,
+	"x-debug-query-block-graph": true,
+}
+
+// Runs an allowlisted QMP command against the qemu-storage-daemon instance serving the volume of the PVC given as
+// "<namespace>/<name>", and prints its result. Must be run on the node that the volume is staged on, e.g., by
+// exec'ing into the node plugin's container there.
+func RunVolumeQmp(out io.Writer, kubeletDir string, pvcRef string, command string, arguments string) error {
+	ctx := context.Background()
+
+	err := checkVolumeQmpCommand(command)
+	if err != nil {
+		return err
+	}
+
+	pvcNamespace, pvcName, ok := strings.Cut(pvcRef, "/")
+	if !ok || pvcNamespace == "" || pvcName == "" {
+		return fmt.Errorf("PVC must be given as <namespace>/<name>, got %q", pvcRef)
+	}
+
+	var args interface{}
+	if arguments != "" {
+		if !json.Valid([]byte(arguments)) {
+			return fmt.Errorf("arguments must be a JSON object, got %q", arguments)
+		}
+		args = json.RawMessage(arguments)
+	}
+
+	clientset, err := newCliClientset()
+	if err != nil {
+		return err
+	}
+
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(pvcNamespace).Get(ctx, pvcName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	pvcUid := common.VolumeUidOf(pvc)
+	if pvcUid == "" {
+		return fmt.Errorf("PVC %s in namespace %s has no volume of driver %s", pvcName, pvcNamespace, common.Domain)
+	}
+
+	socketPath := common.GenerateQmpSocketPath(kubeletDir, pvcUid)
+	if _, err := os.Stat(socketPath); os.IsNotExist(err) {
+		return fmt.Errorf(
+			"the volume of PVC %s in namespace %s isn't served by qemu-storage-daemon on this node",
+			pvcName, pvcNamespace,
+		)
+	}
+
+	result, err := common.QmpExecute(ctx, socketPath, command, args)
+	if err != nil {
+		return err
+	}
+
+	var indented bytes.Buffer
+	if json.Indent(&indented, result, "", "  ") != nil {
+		indented.Reset()
+		indented.Write(result)
+	}
+	indented.WriteString("\n")
+
+	_, err = indented.WriteTo(out)
+	return err
+}
+
+// Fails unless the given QMP command is in volumeQmpAllowlist.
+func checkVolumeQmpCommand(command string) error {
+	if volumeQmpAllowlist[command] {
+		return nil
+	}
+
+	allowed := make([]string, 0, len(volumeQmpAllowlist))
+	for allowedCommand := range volumeQmpAllowlist {
+		allowed = append(allowed, allowedCommand)
+	}
+	sort.Strings(allowed)
+
+	return fmt.Errorf("QMP command %q isn't allowed; allowed commands are %s", command, strings.Join(allowed, ", "))
+}
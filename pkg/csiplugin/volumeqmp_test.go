@@ -0,0 +1,19 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package csiplugin
+
+import "testing"
+
+func TestCheckVolumeQmpCommand(t *testing.T) {
+	for _, command := range []string{"query-block", "query-blockstats", "x-debug-query-block-graph"} {
+		if err := checkVolumeQmpCommand(command); err != nil {
+			t.Errorf("%s: unexpected error: %v", command, err)
+		}
+	}
+
+	for _, command := range []string{"quit", "block-export-del", "human-monitor-command", "", "Query-Block"} {
+		if err := checkVolumeQmpCommand(command); err == nil {
+			t.Errorf("%q: expected error", command)
+		}
+	}
+}
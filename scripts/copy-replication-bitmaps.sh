@@ -0,0 +1,23 @@
+#!/bin/bash
+# SPDX-License-Identifier: Apache-2.0
+
+# Copies the dirty bitmaps used for replication from a volume's top image to
+# the image that is about to replace it (e.g., when snapshotting or cloning the
+# volume), so that the next replication of the volume can still be incremental.
+# Inconsistent bitmaps are skipped, as they are useless.
+
+set -o errexit -o pipefail -o nounset -o xtrace
+
+from="$1"
+to="$2"
+
+qemu-img info -f qcow2 --output=json "${from}" |
+    jq -r '
+        .["format-specific"].data.bitmaps // [] | .[]
+        | select((.name | startswith("subprovisioner-replication-")) and (.flags | index("in-use") | not))
+        | "\(.name) \(.granularity)"
+        ' |
+    while read -r name granularity; do
+        qemu-img bitmap -f qcow2 --add -g "${granularity}" "${to}" "${name}"
+        qemu-img bitmap -f qcow2 --merge "${name}" -b "${from}" -F qcow2 "${to}" "${name}"
+    done
@@ -6,44 +6,306 @@ set -o errexit -o pipefail -o nounset -o xtrace
 qcow2_file_path="$1"
 out_dev_path="$2"
 readonly="$3"  # must be "true" or "false"
+qmp_socket_path="$4"
+qemu_nbd_fallback="${5:-false}"  # "true" to fall back to qemu-nbd if qemu-storage-daemon can't be used
+check_on_stage="${6:-false}"  # "true" to check the image chain for corruption first
+nbd_connections="${7:-1}"  # number of NBD connections, each with its own queue
+aio="${8:-threads}"  # "threads", "native", or "io_uring"
+iothread="${9:-false}"  # "true" to serve the export in a dedicated I/O thread
+integrity="${10:-false}"  # "true" to verify the volume's data with dm-integrity
+cache_mode="${11:-none}"  # "none", "writeback", or "unsafe"
+qcow2_options="${12:-}"  # extra qcow2 blockdev options, e.g., "l2-cache-size=67108864"
+read_ahead="${13:-}"  # read-ahead of the device in bytes, or empty to keep the default
+mirror_qcow2_file_path="${14:-}"  # the volume's mirror image, or empty if it isn't mirrored
+max_iops="${15:-0}"  # throttle limit in operations per second, or 0 for unlimited
+max_bandwidth="${16:-0}"  # throttle limit in bytes per second, or 0 for unlimited
+shared_role="${17:-}"  # "server" to serve the volume's shared export, "client" to connect to it, or empty
+shared_export_address="${18:-}"  # "<host>:<port>" of the volume's shared export, for "client"
+image_format="${19:-qcow2}"  # "qcow2" or "raw", as recorded in the "format" annotation of the volume's PVC
+
+# must match GenerateQmpEventsSocketPath(), GenerateQemuNbdSocketPath(),
+# GenerateStagingCheckReportPath(), GenerateNbdDeviceRecordPath(), and
+# GenerateMirrorDegradedRecordPath() in pkg/csiplugin/common/qmp.go
+events_socket_path="${qmp_socket_path%.sock}-events.sock"
+qemu_nbd_socket_path="${qmp_socket_path%.sock}-nbd.sock"
+check_report_path="${qmp_socket_path%.sock}-check.txt"
+nbd_dev_record_path="${qmp_socket_path%.sock}-nbd-dev"
+mirror_degraded_record_path="${qmp_socket_path%.sock}-mirror-degraded"
+
+# must match GenerateIntegrityDeviceName() in pkg/csiplugin/common/config.go
+integrity_dev_name="subprovisioner-$( basename "${qmp_socket_path}" .sock )"
 
 case "${readonly}" in
     true)
+        extra_qsd_blockdev_options=read-only=on
         extra_qsd_export_options=writable=off
         extra_nbd_connect_flags=-readonly
+        extra_qemu_nbd_flags=--read-only
         ;;
     false)
+        extra_qsd_blockdev_options=read-only=off
         extra_qsd_export_options=writable=on
         extra_nbd_connect_flags=
+        extra_qemu_nbd_flags=
         ;;
     *)
         exit 2
         ;;
 esac
 
+# only cache sizing options are passed, as validated by the controller plugin
+extra_qcow2_options="${qcow2_options:+,${qcow2_options}}"
+
+case "${image_format}" in
+    qcow2) ;;
+    raw)   extra_qcow2_options= ;;
+    *)     exit 2 ;;
+esac
+
+# The kernel can only use several connections if the export advertises that
+# they are consistent with each other, which they are for qemu-storage-daemon.
+# The same goes for the connections of the nodes a shared export serves.
+extra_qsd_args=()
+if (( nbd_connections > 1 )) || [[ "${shared_role}" == server ]]; then
+    extra_qsd_export_options+=,multi-conn=on
+fi
+if [[ "${iothread}" == true ]]; then
+    extra_qsd_args+=( --object iothread,id=iothread )
+    extra_qsd_export_options+=,iothread=iothread
+fi
+
+# Some file systems don't support O_DIRECT (e.g., tmpfs), in which case cache
+# mode "none" falls back to "writeback", which still honors flushes. aio=native
+# requires O_DIRECT. aio=io_uring may not be supported by the QEMU build or the
+# kernel of the node, which the node plugin usually finds out beforehand, but a
+# shared export may run on any node.
+case "${cache_mode}" in
+    none)             fallback_cache_mode=writeback ;;
+    writeback|unsafe) fallback_cache_mode="${cache_mode}" ;;
+    *)                exit 2 ;;
+esac
+
+case "${aio}" in
+    native|io_uring) fallback_aio=threads ;;
+    *)               fallback_aio="${aio}" ;;
+esac
+
+# the qemu-storage-daemon equivalent of qemu-nbd's --cache
+function qsd_cache_options() {
+    case "$1" in
+        none)      echo cache.direct=on ;;
+        writeback) echo cache.direct=off ;;
+        unsafe)    echo cache.direct=off,cache.no-flush=on ;;
+    esac
+}
+
+function wait_for_termination() {
+    # If we simply invoked sleep, we wouldn't be able to react to SIGTERM, even
+    # if we installed the trap beforehand, because we are the init process (PID
+    # 1).
+    sleep infinity &
+    trap "kill %1" TERM
+    wait || true
+}
+
+# If the node plugin removed a copy of a mirrored volume from its quorum because
+# it failed, that copy is out of date, so it isn't served again if this pod or
+# its container restarts.
+if [[ -n "${mirror_qcow2_file_path}" && -f "${mirror_degraded_record_path}" ]]; then
+    case "$( cat "${mirror_degraded_record_path}" )" in
+        primary)
+            qcow2_file_path="${mirror_qcow2_file_path}"
+            mirror_qcow2_file_path=
+            ;;
+        mirror)
+            mirror_qcow2_file_path=
+            ;;
+    esac
+fi
+
+qcow2_file_paths=( "${qcow2_file_path}" )
+if [[ -n "${mirror_qcow2_file_path}" ]]; then
+    qcow2_file_paths+=( "${mirror_qcow2_file_path}" )
+fi
+
+# check image chain
+
+# qemu-img check only checks the given image, so we check each image in the
+# chain. Leaked clusters (exit code 3) waste space but are harmless. If an image
+# is corrupt, the node plugin picks up the report and removes this pod.
+mkdir -p "$( dirname "${qmp_socket_path}" )"
+rm -f "${check_report_path}"
+
+if [[ "${check_on_stage}" == true ]]; then
+    for image in $(
+        for top in "${qcow2_file_paths[@]}"; do
+            qemu-img info --backing-chain --output=json "${top}" | jq -r '.[].filename'
+        done
+    ); do
+        exit_code=0
+        output="$( qemu-img check -f qcow2 "${image}" 2>&1 )" || exit_code="$?"
+        if [[ "${exit_code}" != 0 && "${exit_code}" != 3 ]]; then
+            # no node plugin picks up the report of a shared export, whose
+            # restarts tell instead
+            if [[ "${shared_role}" == server ]]; then
+                printf '%s: %s\n' "$( basename "${image}" )" "${output}" >&2
+                exit 1
+            fi
+            printf '%s: %s\n' "$( basename "${image}" )" "${output}" > "${check_report_path}.tmp"
+            mv -f "${check_report_path}.tmp" "${check_report_path}"
+            wait_for_termination
+            exit 1
+        fi
+    done
+fi
+
+# switch to local copies of images served over HTTPS
+
+# Images backed by an image served over HTTPS are switched to its local copy
+# once it has been pulled into the backing volume (see
+# ImageCatalogHttpBackingFileSource in pkg/csiplugin/common/imagecatalog.go).
+# The copy has the same contents, so only the reference to the backing file
+# changes. Images that are in use elsewhere, e.g., snapshots that other staged
+# volumes are backed by, can't be changed and keep reading over HTTPS. Clients
+# of a shared export leave this to it, as it has the volume's image open. Raw
+# images have no backing files, and probing their format could mistake their
+# contents for a qcow2 header.
+if [[ "${shared_role}" != client && "${image_format}" == qcow2 ]]; then
+    for top in "${qcow2_file_paths[@]}"; do
+        qemu-img info -U --backing-chain --output=json "${top}" |
+            jq -r '.[] | select(.["backing-filename"] // "" | startswith("https://")) |
+                [.filename, .["backing-filename"]] | @tsv' |
+            while IFS=$'\t' read -r image url; do
+                # must match GenerateHttpBackingCopyName() in pkg/csiplugin/common/config.go
+                copy="http-$( printf '%s' "${url}" | sha256sum | cut -d ' ' -f 1 ).qcow2"
+                if [[ -e "$( dirname "${image}" )/${copy}" ]]; then
+                    qemu-img rebase -u -f qcow2 -b "${copy}" -F qcow2 "${image}" || true
+                fi
+            done
+    done
+fi
+
 # launch qemu-storage-daemon
 
+# The QMP monitor allows the node plugin to manipulate the running export, e.g.,
+# to propagate volume expansion to it. The second monitor is where the node
+# plugin listens for events, e.g., I/O errors on the volume image, since each
+# monitor only serves one client at a time.
+rm -f "${qmp_socket_path}" "${events_socket_path}" "${qemu_nbd_socket_path}"
+
+# A shared export serves the nodes the volume is staged on over TCP, through its
+# Service (see GenerateSharedExportName() in pkg/csiplugin/common/config.go).
+# NBD has no authentication, so its NetworkPolicy only admits the volume's
+# staging pods (see ensureSharedExport() in pkg/csiplugin/node/shared.go).
+if [[ "${shared_role}" == server ]]; then
+    # must match SharedExportPort in pkg/csiplugin/common/config.go
+    nbd_server_addr=addr.type=inet,addr.host=0.0.0.0,addr.port=10809
+else
+    nbd_server_addr=addr.type=unix,addr.path=qsd.sock
+fi
+
+# The format node keeps the name "qcow2" for raw images too, so that QMP
+# commands address it the same way whatever the format.
 function qsd() {
+    local blockdev_args=(
+        --blockdev driver=file,node-name=file,filename="${qcow2_file_path}","${extra_qsd_blockdev_options}","$1"
+        --blockdev driver="${image_format}",node-name=qcow2,file=file,"${extra_qsd_blockdev_options}${extra_qcow2_options}"
+    )
+    local export_node_name=qcow2
+
+    # Mirrored volumes are served from a quorum of both copies, which writes to
+    # both and reads from the primary, falling back to the mirror if that fails.
+    # A write succeeds as long as it succeeds on either copy, so that the volume
+    # remains available if a backing volume fails, after which the node plugin
+    # removes the failed copy from the quorum (see MirrorCopyChildName() in
+    # pkg/csiplugin/common/mirror.go).
+    if [[ -n "${mirror_qcow2_file_path}" ]]; then
+        blockdev_args+=(
+            --blockdev driver=file,node-name=mirror-file,filename="${mirror_qcow2_file_path}","${extra_qsd_blockdev_options}","$1"
+            --blockdev driver=qcow2,node-name=mirror-qcow2,file=mirror-file,"${extra_qsd_blockdev_options}${extra_qcow2_options}"
+            --blockdev driver=quorum,node-name=quorum,children.0=qcow2,children.1=mirror-qcow2,vote-threshold=1,read-pattern=fifo,"${extra_qsd_blockdev_options}"
+        )
+        export_node_name=quorum
+    fi
+
+    # The export is always throttled, even without limits, so that the node
+    # plugin can apply new limits to the throttle group while the volume is
+    # staged (see QsdThrottleGroupId in pkg/csiplugin/common/qos.go).
+    blockdev_args+=(
+        --blockdev driver=throttle,node-name=throttled,throttle-group=throttle,file="${export_node_name}"
+    )
+    export_node_name=throttled
+
     qemu-storage-daemon \
-        --blockdev driver=file,node-name=file,filename="${qcow2_file_path}","$1" \
-        --blockdev driver=qcow2,node-name=qcow2,file=file \
-        --nbd-server addr.type=unix,addr.path=qsd.sock \
-        --export type=nbd,id=export,name=default,node-name=qcow2,"${extra_qsd_export_options}" \
+        "${extra_qsd_args[@]}" \
+        --object throttle-group,id=throttle,x-iops-total="${max_iops}",x-bps-total="${max_bandwidth}" \
+        "${blockdev_args[@]}" \
+        --nbd-server "${nbd_server_addr}" \
+        --export type=nbd,id=export,name=default,node-name="${export_node_name}","${extra_qsd_export_options}" \
+        --chardev socket,id=qmp,path="${qmp_socket_path}",server=on,wait=off \
+        --monitor chardev=qmp \
+        --chardev socket,id=events,path="${events_socket_path}",server=on,wait=off \
+        --monitor chardev=events \
         --daemonize \
         --pidfile qsd.pid
 }
 
-qsd cache.direct=on ||
-    qsd cache.direct=off  # some file systems don't support O_DIRECT (e.g., tmpfs)
+# qemu-nbd lacks a QMP monitor, so volumes it serves don't report I/O errors and
+# can't be replicated while staged. It can't throttle I/O or serve mirrored volumes either. Its socket is placed where
+# the node plugin can check whether it is still running.
+function qemu_nbd() {
+    qemu-nbd \
+        --format="${image_format}" --cache="$1" --aio="$2" ${extra_qemu_nbd_flags} \
+        --socket="${qemu_nbd_socket_path}" --export-name=default \
+        --persistent --shared="$(( nbd_connections + 1 ))" \
+        --fork \
+        --pid-file=qsd.pid \
+        "${qcow2_file_path}"
+}
+
+# Clients of a shared export don't run a server of their own.
+server_pid=
+if [[ "${shared_role}" == client ]]; then
+    nbd_server_args=( "${shared_export_address%:*}" "${shared_export_address##*:}" )
+elif command -v qemu-storage-daemon > /dev/null &&
+    { qsd "$( qsd_cache_options "${cache_mode}" )",aio="${aio}" ||
+        qsd "$( qsd_cache_options "${fallback_cache_mode}" )",aio="${fallback_aio}"; }
+then
+    nbd_server_args=( -unix qsd.sock )
+    server_pid="$( cat qsd.pid )"
+elif [[ "${qemu_nbd_fallback}" == true && -z "${mirror_qcow2_file_path}" && -z "${shared_role}" ]]; then
+    echo "qemu-storage-daemon is unavailable, falling back to qemu-nbd" >&2
+    [[ -z "${qcow2_options}" ]] || echo "qemu-nbd ignores qcow2 options ${qcow2_options}" >&2
+    [[ "${max_iops}" == 0 && "${max_bandwidth}" == 0 ]] || echo "qemu-nbd ignores throttle limits" >&2
+    nbd_server_args=( -unix "${qemu_nbd_socket_path}" )
+    qemu_nbd "${cache_mode}" "${aio}" ||
+        qemu_nbd "${fallback_cache_mode}" "${fallback_aio}"
+    server_pid="$( cat qsd.pid )"
+else
+    exit 1
+fi
 
-qsd_pid="$( cat qsd.pid )"
+function stop_server() {
+    [[ -n "${server_pid}" ]] || return 0
 
-function stop_qsd() {
     # Attempt graceful termination. If this blocks, we'll eventually be killed.
-    kill "${qsd_pid}" || true
-    while kill -0 "${qsd_pid}" 2>/dev/null; do sleep 1; done
+    kill "${server_pid}" || true
+    while kill -0 "${server_pid}" 2>/dev/null; do sleep 1; done
+    rm -f "${qmp_socket_path}" "${events_socket_path}" "${qemu_nbd_socket_path}"
 }
-trap stop_qsd EXIT
+trap stop_server EXIT
+
+# A shared export serves until asked to terminate. If its server goes away,
+# e.g., because it crashed, the container exits so that it is restarted, and the
+# nodes reconnect to it.
+if [[ "${shared_role}" == server ]]; then
+    trap 'exit 0' TERM
+    while kill -0 "${server_pid}" 2>/dev/null; do
+        sleep 5 &
+        wait $! || true
+    done
+    exit 1
+fi
 
 # configure NBD client
 
@@ -58,9 +320,22 @@ function nbd_dev_is_connected() {
     esac
 }
 
+# If this pod or its container restarted, e.g., because its image was rolled,
+# the volume's previous device is tried first. Once reconnected, it serves the
+# volume again to whoever still has it open or bind-mounted, so that workloads
+# only see I/O errors while the volume was disconnected, rather than a device
+# that went away for good. If it was taken by another volume in the meantime, a
+# new device is used instead.
+function candidate_devices() {
+    if [[ -f "${nbd_dev_record_path}" ]]; then
+        cat "${nbd_dev_record_path}"
+    fi
+    find /dev -regex '/dev/nbd[0-9]+' | shuf
+}
+
 function setup_device() {
     # shellcheck disable=SC2044
-    for dev in $( find /dev -regex '/dev/nbd[0-9]+' | shuf ); do
+    for dev in $( candidate_devices ); do
         if ! nbd_dev_is_connected "${dev}"; then
             # $dev isn't connected, so we try to take it. This is racy, as
             # someone else might try to do the same at the same time. If this
@@ -72,8 +347,8 @@ function setup_device() {
             # trying to configure it and move on to try the next device.
 
             nbd-client \
-                -unix qsd.sock "${dev}" \
-                -name default -connections 1 -no-optgo -nonetlink \
+                "${nbd_server_args[@]}" "${dev}" \
+                -name default -connections "${nbd_connections}" -no-optgo -nonetlink \
                 ${extra_nbd_connect_flags}
 
             if nbd_dev_is_connected "${dev}"; then
@@ -86,23 +361,74 @@ function setup_device() {
     return 1
 }
 
+# the shared export may still be starting
+if [[ "${shared_role}" == client ]]; then
+    until ( exec 3<> "/dev/tcp/${nbd_server_args[0]}/${nbd_server_args[1]}" ) 2>/dev/null; do
+        sleep 1
+    done
+fi
+
 setup_device
+echo "${dev}" > "${nbd_dev_record_path}"
 
 [[ $( blockdev --getsize64 "${dev}" ) != 0 ]]  # sanity check
 
-trap 'nbd-client -nonetlink -d "${dev}"; stop_qsd' EXIT
+trap 'nbd-client -nonetlink -d "${dev}"; stop_server' EXIT
+
+# set up integrity verification
+
+# Volumes with integrity protection are created empty and formatted when first
+# staged. Rather than wiping the device, which would allocate the whole image,
+# the checksums of its (all-zero) contents are computed in the background. That
+# must only be requested while it is in progress, as requesting it again
+# restarts it, recomputing checksums of data that may have been corrupted since.
+exposed_dev="${dev}"
+
+if [[ "${integrity}" == true ]]; then
+    integritysetup close "${integrity_dev_name}" 2>/dev/null || true  # left behind by a previous pod
+
+    if ! integritysetup dump "${dev}" > /dev/null 2>&1; then
+        integritysetup format --batch-mode --no-wipe \
+            --integrity crc32c --sector-size 4096 --tag-size 4 "${dev}"
+        recalculate_flags=--integrity-recalculate
+    elif integritysetup dump "${dev}" | grep -qw recalculating; then
+        recalculate_flags=--integrity-recalculate
+    else
+        recalculate_flags=
+    fi
+
+    integritysetup open --integrity crc32c ${recalculate_flags} "${dev}" "${integrity_dev_name}"
+
+    trap 'integritysetup close "${integrity_dev_name}"; nbd-client -nonetlink -d "${dev}"; stop_server' EXIT
+
+    exposed_dev="$( readlink -f "/dev/mapper/${integrity_dev_name}" )"
+fi
+
+# The read-ahead is given in 512-byte sectors and applies to the exposed device,
+# which is what the file system reads through.
+if [[ -n "${read_ahead}" ]]; then
+    blockdev --setra "$(( read_ahead / 512 ))" "${exposed_dev}"
+fi
 
 # expose device at the target path
 
 rmdir "${out_dev_path}" || true  # Kubernetes might place a directory there
 [[ ! -d "${out_dev_path}" ]]  # must not exist or not be a directory
 
-cp -fpR "${dev}" "${out_dev_path}"
+cp -fpR "${exposed_dev}" "${out_dev_path}"
 
 # wait until the container is asked to terminate
 
-# If we simply invoked sleep, we wouldn't be able to react to SIGTERM, even if
-# we installed the trap beforehand, because we are the init process (PID 1).
-sleep infinity &
-trap "kill %1" TERM
-wait || true
+# The device of a client of a shared export is disconnected if the export goes
+# away, e.g., because its pod was rescheduled, in which case the container exits
+# so that it is restarted and reconnects the device, which workloads keep using.
+if [[ "${shared_role}" == client ]]; then
+    trap 'exit 0' TERM
+    while nbd_dev_is_connected "${dev}"; do
+        sleep 5 &
+        wait $! || true
+    done
+    exit 1
+fi
+
+wait_for_termination
@@ -0,0 +1,152 @@
+# SPDX-License-Identifier: Apache-2.0
+
+mib64="$(( 64 * 1024 * 1024 ))"
+mib128="$(( 128 * 1024 * 1024 ))"
+
+__stage 'Provisioning volume 1...'
+
+kubectl create -f - <<EOF
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: pvc-1
+spec:
+  accessModes:
+    - ReadWriteOnce
+  resources:
+    requests:
+      storage: 128Mi
+  volumeMode: Block
+  storageClassName: storage-class
+EOF
+
+__wait_for_pvc_to_be_bound 45 pvc-1
+
+__stage 'Writing some random data to volume 1...'
+
+kubectl create -f - <<EOF
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-pod
+spec:
+  restartPolicy: Never
+  containers:
+    - name: container
+      image: subprovisioner/test:test
+      command:
+        - bash
+        - -c
+        - |
+          set -o errexit -o pipefail -o nounset -o xtrace
+          dd if=/dev/urandom of=/var/pvc-1 conv=fsync bs=1M count=128
+      volumeDevices:
+        - { name: pvc-1, devicePath: /var/pvc-1 }
+  volumes:
+    - { name: pvc-1, persistentVolumeClaim: { claimName: pvc-1 } }
+EOF
+
+__wait_for_pod_to_succeed 45 test-pod
+kubectl delete pod test-pod --timeout=45s
+
+__stage 'Creating volume 2 by cloning volume 1...'
+
+kubectl create -f - <<EOF
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: pvc-2
+spec:
+  storageClassName: storage-class
+  volumeMode: Block
+  dataSource:
+    kind: PersistentVolumeClaim
+    name: pvc-1
+  accessModes:
+    - ReadWriteOnce
+  resources:
+    requests:
+      storage: 128Mi
+EOF
+
+__wait_for_pvc_to_be_bound 45 pvc-2
+
+# Usage: expect_pvc_2 <size> <bytes_equal_to_pvc_1>
+function expect_pvc_2() {
+    kubectl create -f - <<EOF
+    apiVersion: v1
+    kind: Pod
+    metadata:
+      name: test-pod
+    spec:
+      restartPolicy: Never
+      containers:
+        - name: container
+          image: subprovisioner/test:test
+          command:
+            - bash
+            - -c
+            - |
+              set -o errexit -o pipefail -o nounset -o xtrace
+              [[ "\$( blockdev --getsize64 /var/pvc-2 )" = $1 ]]
+              cmp -n $2 /var/pvc-1 /var/pvc-2
+              cmp -n $(( $1 - $2 )) /var/pvc-2 /dev/zero $2
+          volumeDevices:
+            - { name: pvc-1, devicePath: /var/pvc-1 }
+            - { name: pvc-2, devicePath: /var/pvc-2 }
+      volumes:
+        - { name: pvc-1, persistentVolumeClaim: { claimName: pvc-1 } }
+        - { name: pvc-2, persistentVolumeClaim: { claimName: pvc-2 } }
+EOF
+
+    __wait_for_pod_to_succeed 45 test-pod
+    kubectl delete pod test-pod --timeout=45s
+}
+
+__stage 'Expanding volume 2 beyond the size of its backing file...'
+
+kubectl patch pvc pvc-2 --patch-file <( echo '
+spec:
+  resources:
+    requests:
+      storage: 256Mi
+')
+
+# shellcheck disable=SC2016
+__poll 1 45 '[[ "$( kubectl get pvc pvc-2 -o=jsonpath="{.status.capacity.storage}" )" = 256Mi ]]'
+
+__stage 'Validating that the new area of volume 2 reads as zeros...'
+
+expect_pvc_2 "$(( 256 * 1024 * 1024 ))" "${mib128}"
+
+__stage 'Shrinking volume 2 below the size of its backing file...'
+
+kubectl annotate pvc pvc-2 subprovisioner.gitlab.io/shrink-to=64Mi
+
+# shellcheck disable=SC2016
+__poll 1 90 '[[
+    "$( kubectl get pvc pvc-2 -o=jsonpath="{.metadata.annotations.subprovisioner\.gitlab\.io/shrink-status}" )" \
+    =~ ^complete
+    ]]'
+
+expect_pvc_2 "${mib64}" "${mib64}"
+
+__stage 'Expanding volume 2 again...'
+
+kubectl patch pvc pvc-2 --patch-file <( echo '
+spec:
+  resources:
+    requests:
+      storage: 384Mi
+')
+
+# shellcheck disable=SC2016
+__poll 1 45 '[[ "$( kubectl get pvc pvc-2 -o=jsonpath="{.status.capacity.storage}" )" = 384Mi ]]'
+
+__stage 'Validating that the data of volume 1 discarded by shrinking does not show through...'
+
+expect_pvc_2 "$(( 384 * 1024 * 1024 ))" "${mib64}"
+
+__stage 'Deleting volumes...'
+
+kubectl delete pvc pvc-1 pvc-2 --timeout=45s
@@ -0,0 +1,69 @@
+# SPDX-License-Identifier: Apache-2.0
+
+# This test makes the plugins fail creating Jobs, updating metadata, and
+# attaching volumes to NBD devices a few times each, and ensures that they
+# recover and still provision, stage, and delete a volume.
+
+__stage 'Injecting faults into the plugins...'
+
+kubectl set env -n=subprovisioner deployment/csi-controller-plugin -c=subprovisioner-csi-plugin \
+    SUBPROVISIONER_INJECT_FAULTS=job-creation:fail:2,metadata-update:fail:3,metadata-update:delay:1s
+kubectl set env -n=subprovisioner daemonset/csi-node-plugin -c=subprovisioner-csi-plugin \
+    SUBPROVISIONER_INJECT_FAULTS=nbd-attach:fail:2,nbd-attach:delay:5s
+
+kubectl rollout status -n=subprovisioner --timeout=120s \
+    deployment/csi-controller-plugin daemonset/csi-node-plugin
+
+__stage 'Provisioning volume...'
+
+kubectl create -f - <<EOF
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: image-pvc
+spec:
+  accessModes:
+    - ReadWriteOnce
+  resources:
+    requests:
+      storage: 128Mi
+  volumeMode: Block
+  storageClassName: storage-class
+EOF
+
+__wait_for_pvc_to_be_bound 120 image-pvc
+
+__stage 'Writing to and reading from volume...'
+
+kubectl create -f - <<EOF
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-pod
+spec:
+  restartPolicy: Never
+  containers:
+    - name: container
+      image: subprovisioner/test:test
+      command:
+        - bash
+        - -c
+        - |
+          set -o errexit -o pipefail -o nounset -o xtrace
+          echo hello | dd of=/var/image conv=fsync
+          [[ "\$( head -c 6 /var/image )" == hello ]]
+      volumeDevices:
+        - name: image
+          devicePath: /var/image
+  volumes:
+    - name: image
+      persistentVolumeClaim:
+        claimName: image-pvc
+EOF
+
+__wait_for_pod_to_succeed 180 test-pod
+kubectl delete pod test-pod --timeout=60s
+
+__stage 'Deleting volume...'
+
+kubectl delete pvc image-pvc --timeout=120s